@@ -0,0 +1,227 @@
+package socks4
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// AccessLogFields are the fields of the access log lines. The labels of
+// the sessions are the fields "label.NAME".
+var AccessLogFields = []string{
+	"time", "start", "duration", "id", "client", "listener", "user_id",
+	"identity", "cmd", "target", "remote", "egress", "sniffed_host",
+	"decision", "error", "client_to_remote_bytes", "remote_to_client_bytes",
+}
+
+// defaultAccessLogFields are the fields of the lines if none are selected.
+var defaultAccessLogFields = []string{
+	"time", "client", "user_id", "cmd", "target", "remote", "decision",
+	"duration", "client_to_remote_bytes", "remote_to_client_bytes", "error",
+}
+
+// AccessLogOptions formats the lines of an AccessLog.
+type AccessLogOptions struct {
+	// Format is "json" or "logfmt" (key=value), json if empty.
+	Format string
+	// Fields are the fields of the lines in order, among AccessLogFields,
+	// label.NAME and the static fields. Time, client, user id, command,
+	// target, remote, decision, duration, byte counts and error if empty.
+	Fields []string
+	// Static are fields of constant values, e.g. the datacenter, added to
+	// every line after the other fields unless they are in Fields.
+	Static map[string]string
+	// Template is a text/template of the lines replacing the format and
+	// fields, executed with the map of the fields by name, e.g.
+	// `{{.client}} {{.target}} {{index . "label.env"}}`. A line break is
+	// added if it has none.
+	Template string
+}
+
+// AccessLog is an EventNotifier writing a line to an io.Writer for every
+// session once it is rejected or closed, in the schema of the downstream
+// log pipelines. The empty fields are omitted from the JSON and logfmt
+// lines.
+type AccessLog struct {
+	w      io.Writer
+	fields []string
+	format string
+	static map[string]string
+	tmpl   *template.Template
+	logger Logger
+
+	mu sync.Mutex
+}
+
+// NewAccessLog creates an access log writing to w. Write errors are
+// logged to logger if it is not nil.
+func NewAccessLog(w io.Writer, opts AccessLogOptions, logger Logger) (*AccessLog, error) {
+	l := &AccessLog{w: w, format: opts.Format, static: opts.Static, logger: logger}
+	if opts.Template != "" {
+		tmpl, err := template.New("access").Option("missingkey=zero").Parse(opts.Template)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access log template: %v", err)
+		}
+		l.tmpl = tmpl
+		return l, nil
+	}
+	switch l.format {
+	case "":
+		l.format = "json"
+	case "json", "logfmt":
+	default:
+		return nil, fmt.Errorf("invalid access log format %q", opts.Format)
+	}
+	l.fields = opts.Fields
+	if len(l.fields) == 0 {
+		l.fields = defaultAccessLogFields
+	}
+	selected := make(map[string]bool)
+	for _, f := range l.fields {
+		if !validAccessLogField(f) && opts.Static[f] == "" {
+			return nil, fmt.Errorf("unknown access log field %q", f)
+		}
+		selected[f] = true
+	}
+	// the static fields not placed are appended in name order.
+	var static []string
+	for k := range opts.Static {
+		if !selected[k] {
+			static = append(static, k)
+		}
+	}
+	sort.Strings(static)
+	l.fields = append(l.fields[:len(l.fields):len(l.fields)], static...)
+	return l, nil
+}
+
+func validAccessLogField(f string) bool {
+	if name, ok := strings.CutPrefix(f, "label."); ok {
+		return ValidLabelName(name)
+	}
+	for _, known := range AccessLogFields {
+		if f == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify writes the line of a rejected or closed session.
+func (l *AccessLog) Notify(ev Event) {
+	var decision string
+	switch ev.Type {
+	case EventClosed:
+		decision = "granted"
+	case EventRejected:
+		decision = "rejected"
+	default:
+		return
+	}
+	values := l.values(ev, decision)
+	var b bytes.Buffer
+	switch {
+	case l.tmpl != nil:
+		if err := l.tmpl.Execute(&b, values); err != nil {
+			l.error(err)
+			return
+		}
+		if !bytes.HasSuffix(b.Bytes(), []byte("\n")) {
+			b.WriteByte('\n')
+		}
+	case l.format == "logfmt":
+		for _, f := range l.fields {
+			if v := values[f]; v != "" {
+				if b.Len() > 0 {
+					b.WriteByte(' ')
+				}
+				b.WriteString(f + "=" + logfmtValue(v))
+			}
+		}
+		b.WriteByte('\n')
+	default:
+		// the object is written by hand to keep the order of the fields.
+		b.WriteByte('{')
+		for _, f := range l.fields {
+			if v := values[f]; v != "" {
+				if b.Len() > 1 {
+					b.WriteByte(',')
+				}
+				k, _ := json.Marshal(f)
+				b.Write(k)
+				b.WriteByte(':')
+				b.Write(accessLogJSON(f, v))
+			}
+		}
+		b.WriteString("}\n")
+	}
+	l.mu.Lock()
+	_, err := l.w.Write(b.Bytes())
+	l.mu.Unlock()
+	if err != nil {
+		l.error(err)
+	}
+}
+
+func (l *AccessLog) error(err error) {
+	if l.logger != nil {
+		l.logger.Errorf("access log: %v", err)
+	}
+}
+
+// values returns the fields of the event by name.
+func (l *AccessLog) values(ev Event, decision string) map[string]string {
+	ss := ev.Session
+	values := map[string]string{
+		"time":                   ev.Time.UTC().Format(time.RFC3339Nano),
+		"start":                  ss.Start.UTC().Format(time.RFC3339Nano),
+		"duration":               strconv.FormatFloat(ev.Time.Sub(ss.Start).Seconds(), 'f', 3, 64),
+		"id":                     strconv.FormatUint(ss.ID, 10),
+		"client":                 ss.Client,
+		"listener":               ev.Listener,
+		"user_id":                ss.UserId,
+		"identity":               ss.Identity,
+		"cmd":                    ss.Cmd,
+		"target":                 ss.Target,
+		"remote":                 ev.Remote,
+		"egress":                 ev.Egress,
+		"sniffed_host":           ss.SniffedHost,
+		"decision":               decision,
+		"error":                  ev.Error,
+		"client_to_remote_bytes": strconv.FormatUint(ss.ClientToRemote, 10),
+		"remote_to_client_bytes": strconv.FormatUint(ss.RemoteToClient, 10),
+	}
+	for k, v := range ss.Labels {
+		values["label."+k] = v
+	}
+	for k, v := range l.static {
+		values[k] = v
+	}
+	return values
+}
+
+// accessLogJSON returns the JSON value of a field, a number for the
+// numeric ones.
+func accessLogJSON(field, v string) []byte {
+	switch field {
+	case "duration", "id", "client_to_remote_bytes", "remote_to_client_bytes":
+		return []byte(v)
+	}
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// logfmtValue quotes v if it has spaces, quotes or equal signs.
+func logfmtValue(v string) string {
+	if strings.ContainsAny(v, " \"=\t\n") {
+		return strconv.Quote(v)
+	}
+	return v
+}
@@ -0,0 +1,160 @@
+package socks4
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewAccessLog(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		opts   AccessLogOptions
+		fields []string // of the lines, none for a template.
+		err    string   // in the error, none if empty.
+	}{
+		{name: "defaults", fields: defaultAccessLogFields},
+		{name: "fields", opts: AccessLogOptions{Format: "logfmt", Fields: []string{"client", "label.env", "target"}}, fields: []string{"client", "label.env", "target"}},
+		{name: "static fields", opts: AccessLogOptions{Fields: []string{"dc", "client"}, Static: map[string]string{"dc": "eu", "az": "b", "region": "west"}}, fields: []string{"dc", "client", "az", "region"}},
+		{name: "template", opts: AccessLogOptions{Template: "{{.client}}", Format: "other", Fields: []string{"other"}}},
+		{name: "invalid format", opts: AccessLogOptions{Format: "xml"}, err: `invalid access log format "xml"`},
+		{name: "unknown field", opts: AccessLogOptions{Fields: []string{"client", "port"}}, err: `unknown access log field "port"`},
+		{name: "invalid label", opts: AccessLogOptions{Fields: []string{"label.my-env"}}, err: `unknown access log field "label.my-env"`},
+		{name: "invalid template", opts: AccessLogOptions{Template: "{{.client"}, err: "invalid access log template"},
+	} {
+		l, err := NewAccessLog(&bytes.Buffer{}, tt.opts, nil)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%v: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(l.fields, tt.fields) {
+			t.Errorf("%v: fields %v, want %v", tt.name, l.fields, tt.fields)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	closed := Event{
+		Type: EventClosed,
+		Time: start.Add(1500 * time.Millisecond),
+		Session: SessionInfo{
+			ID: 7, Client: "10.0.0.1:5000", Cmd: "connect", Target: "example.com:80", UserId: "alice",
+			Labels: map[string]string{"env": "prod"}, Start: start, ClientToRemote: 10, RemoteToClient: 2000,
+		},
+		Remote: "192.0.2.1:80",
+	}
+	rejected := Event{
+		Type:    EventRejected,
+		Time:    start,
+		Session: SessionInfo{ID: 8, Client: "10.0.0.2:5000", Cmd: "connect", Target: "example.com:25", UserId: "bob smith", Start: start},
+		Error:   `denied by rule "deny port 25"`,
+	}
+	for _, tt := range []struct {
+		name string
+		opts AccessLogOptions
+		ev   Event
+		line string // none if empty.
+	}{
+		{
+			name: "closed",
+			ev:   closed,
+			line: `{"time":"2024-05-01T12:00:01.5Z","client":"10.0.0.1:5000","user_id":"alice","cmd":"connect","target":"example.com:80","remote":"192.0.2.1:80","decision":"granted","duration":1.500,"client_to_remote_bytes":10,"remote_to_client_bytes":2000}` + "\n",
+		},
+		{
+			name: "rejected",
+			opts: AccessLogOptions{Fields: []string{"id", "decision", "error"}},
+			ev:   rejected,
+			line: `{"id":8,"decision":"rejected","error":"denied by rule \"deny port 25\""}` + "\n",
+		},
+		{
+			name: "logfmt",
+			opts: AccessLogOptions{Format: "logfmt", Fields: []string{"user_id", "decision", "label.env", "error"}, Static: map[string]string{"dc": "eu"}},
+			ev:   rejected,
+			line: `user_id="bob smith" decision=rejected error="denied by rule \"deny port 25\"" dc=eu` + "\n",
+		},
+		{
+			name: "labels and static fields",
+			opts: AccessLogOptions{Fields: []string{"label.env", "dc"}, Static: map[string]string{"dc": "eu"}},
+			ev:   closed,
+			line: `{"label.env":"prod","dc":"eu"}` + "\n",
+		},
+		{
+			name: "template",
+			opts: AccessLogOptions{Template: `{{.client}} {{.target}} {{index . "label.env"}} {{.dc}}{{.unknown}}`, Static: map[string]string{"dc": "eu"}},
+			ev:   closed,
+			line: "10.0.0.1:5000 example.com:80 prod eu\n",
+		},
+		{
+			name: "template with a line break",
+			opts: AccessLogOptions{Template: "{{.decision}}\n"},
+			ev:   rejected,
+			line: "rejected\n",
+		},
+		{
+			name: "established",
+			ev:   Event{Type: EventEstablished, Time: start, Session: closed.Session},
+		},
+	} {
+		var b bytes.Buffer
+		l, err := NewAccessLog(&b, tt.opts, nil)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		l.Notify(tt.ev)
+		if b.String() != tt.line {
+			t.Errorf("%v: wrote\n%s\nwant\n%s", tt.name, b.String(), tt.line)
+		}
+	}
+}
+
+func TestAccessLogWriteError(t *testing.T) {
+	var logger linesLogger
+	l, err := NewAccessLog(closedConn{}, AccessLogOptions{}, &logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Notify(Event{Type: EventClosed})
+	if want := []string{"error: access log: " + net.ErrClosed.Error()}; !reflect.DeepEqual(logger.lines, want) {
+		t.Errorf("logged %q, want %q", logger.lines, want)
+	}
+}
+
+func TestAccessLogServer(t *testing.T) {
+	target := echoOnceTarget(t)
+	rules, err := ParseRules(strings.NewReader("deny port 25\nallow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b lockedBuffer
+	l, err := NewAccessLog(&b, AccessLogOptions{Format: "logfmt", Fields: []string{"user_id", "target", "decision"}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := serve(t, WithRules(rules), WithEventNotifier(l))
+	d := NewDialer(addr, WithDialerUserId("alice"), WithDialerTimeout(5*time.Second))
+	if _, err := d.Dial("tcp", "127.0.0.1:25"); err == nil {
+		t.Fatal("dialed a denied port")
+	}
+	conn, err := d.Dial("tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn, []byte("hello"))
+	conn.Close()
+	want := "user_id=alice target=127.0.0.1:25 decision=rejected\nuser_id=alice target=" + target + " decision=granted\n"
+	for deadline := time.Now().Add(5 * time.Second); b.String() != want; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("access log\n%s\nwant\n%s", b.String(), want)
+		}
+	}
+}
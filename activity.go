@@ -0,0 +1,147 @@
+package socks4
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// WithIdleTimeout makes the server close a proxy connection when no data
+// has been relayed in either direction for the given duration.
+func WithIdleTimeout(timeout time.Duration) OptionFunc {
+	return func(s *Server) {
+		s.config().IdleTimeout = timeout
+	}
+}
+
+// RelayHook is called when the server begins to relay data for a proxy
+// connection. The Activity may be read until the relay stops.
+type RelayHook func(client net.Conn, req Request, act *Activity)
+
+// WithRelayHook sets a hook called at the beginning of every relay.
+func WithRelayHook(hook RelayHook) OptionFunc {
+	return func(s *Server) {
+		s.relayHook = hook
+	}
+}
+
+// Activity records the last time data was relayed and the number of bytes
+// relayed in each direction of a proxy connection. It is safe for
+// concurrent use.
+type Activity struct {
+	start          time.Time
+	clientToRemote direction
+	remoteToClient direction
+}
+
+// direction is the activity of one direction of a relay.
+type direction struct {
+	last    atomic.Int64  // unix nano of the last write.
+	bytes   atomic.Uint64 // bytes written.
+	blocked atomic.Int64  // unix nano of the start of the write in progress, 0 if none.
+}
+
+func newActivity(clock Clock) *Activity {
+	now := clock.Now()
+	a := &Activity{start: now}
+	a.clientToRemote.last.Store(now.UnixNano())
+	a.remoteToClient.last.Store(now.UnixNano())
+	return a
+}
+
+// ClientToRemote returns the last time data was relayed from the client to
+// the remote host, or the start of the relay if none was.
+func (a *Activity) ClientToRemote() time.Time {
+	return time.Unix(0, a.clientToRemote.last.Load())
+}
+
+// RemoteToClient returns the last time data was relayed from the remote host
+// to the client, or the start of the relay if none was.
+func (a *Activity) RemoteToClient() time.Time {
+	return time.Unix(0, a.remoteToClient.last.Load())
+}
+
+// Last returns the last time data was relayed in either direction.
+func (a *Activity) Last() time.Time {
+	c2r, r2c := a.clientToRemote.last.Load(), a.remoteToClient.last.Load()
+	if c2r > r2c {
+		return time.Unix(0, c2r)
+	}
+	return time.Unix(0, r2c)
+}
+
+// Bytes returns the number of bytes relayed in each direction.
+func (a *Activity) Bytes() (clientToRemote, remoteToClient uint64) {
+	return a.clientToRemote.bytes.Load(), a.remoteToClient.bytes.Load()
+}
+
+// Blocked returns for how long the writes in progress in each direction
+// have been blocked at now, 0 for none.
+func (a *Activity) Blocked(now time.Time) (clientToRemote, remoteToClient time.Duration) {
+	blocked := func(d *direction) time.Duration {
+		if since := d.blocked.Load(); since != 0 {
+			return now.Sub(time.Unix(0, since))
+		}
+		return 0
+	}
+	return blocked(&a.clientToRemote), blocked(&a.remoteToClient)
+}
+
+// activityWriter stamps the time of every successful write, which is far
+// cheaper than resetting a deadline on the connection before each read.
+// It also counts the written bytes to the direction and to total, and
+// stamps the start of the write in progress for the stall detection.
+type activityWriter struct {
+	w     io.Writer
+	dir   *direction
+	total *atomic.Uint64
+	clock Clock
+}
+
+func (w activityWriter) Write(p []byte) (int, error) {
+	w.dir.blocked.Store(w.clock.Now().UnixNano())
+	n, err := w.w.Write(p)
+	w.dir.blocked.Store(0)
+	if n > 0 {
+		w.dir.last.Store(w.clock.Now().UnixNano())
+		w.dir.bytes.Add(uint64(n))
+		w.total.Add(uint64(n))
+	}
+	return n, err
+}
+
+// minWatchInterval is the min interval between the checks of the activity
+// of a relay, whatever its timeout.
+const minWatchInterval = time.Millisecond
+
+// watchInterval returns the interval between the checks of the activity
+// of a relay against timeout.
+func watchInterval(timeout time.Duration) time.Duration {
+	if timeout/2 < minWatchInterval {
+		return minWatchInterval
+	}
+	return timeout / 2
+}
+
+// watchIdle closes the connections once the activity has been idle longer
+// than timeout. It returns when done is closed.
+func (s *Server) watchIdle(timeout time.Duration, act *Activity, done <-chan struct{}, conns ...net.Conn) {
+	ticker := s.clock.NewTicker(watchInterval(timeout))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C():
+			if idle := now.Sub(act.Last()); idle >= timeout {
+				s.log(LogRelay).Infof("close proxy conn for client %v: idle for %v", conns[0].RemoteAddr(), idle.Round(time.Second))
+				for _, c := range conns {
+					c.Close()
+				}
+				return
+			}
+		}
+	}
+}
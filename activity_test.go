@@ -0,0 +1,68 @@
+package socks4
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchInterval(t *testing.T) {
+	for _, tt := range []struct {
+		timeout, want time.Duration
+	}{
+		{time.Minute, 30 * time.Second},
+		{2 * time.Millisecond, time.Millisecond},
+		{time.Millisecond, minWatchInterval},
+		{time.Nanosecond, minWatchInterval},
+	} {
+		if got := watchInterval(tt.timeout); got != tt.want {
+			t.Errorf("interval of timeout %v: %v, want %v", tt.timeout, got, tt.want)
+		}
+	}
+}
+
+func TestWatchIdleTinyTimeout(t *testing.T) {
+	s := newTestServer()
+	client, peer := net.Pipe()
+	defer peer.Close()
+	act := newActivity(s.clock)
+	done := make(chan struct{})
+	defer close(done)
+	watched := make(chan struct{})
+	go func() {
+		s.watchIdle(time.Nanosecond, act, done, client)
+		close(watched)
+	}()
+	select {
+	case <-watched:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection not closed")
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Error("idle connection left open")
+	}
+}
+
+func TestActivityWriter(t *testing.T) {
+	clock := &stepClock{now: time.Unix(1000, 0)}
+	act := newActivity(clock)
+	var total atomic.Uint64
+	var buf bytes.Buffer
+	w := activityWriter{&buf, &act.clientToRemote, &total, clock}
+
+	clock.now = clock.now.Add(time.Second)
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if c2r, r2c := act.Bytes(); c2r != 5 || r2c != 0 || total.Load() != 5 {
+		t.Errorf("bytes %v and %v, total %v, want 5, 0 and 5", c2r, r2c, total.Load())
+	}
+	if !act.ClientToRemote().Equal(clock.now) || !act.RemoteToClient().Equal(time.Unix(1000, 0)) || !act.Last().Equal(clock.now) {
+		t.Errorf("activity at %v, %v and %v, want the time of the write", act.ClientToRemote(), act.RemoteToClient(), act.Last())
+	}
+	if c2r, r2c := act.Blocked(clock.now); c2r != 0 || r2c != 0 {
+		t.Errorf("writes blocked for %v and %v once done", c2r, r2c)
+	}
+}
@@ -0,0 +1,224 @@
+package socks4
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// AuditRecord is the audit record of a session.
+type AuditRecord struct {
+	Start          time.Time
+	End            time.Time
+	Client         string // address of the client.
+	UserId         string
+	Identity       string // identity of the TLS client certificate.
+	Cmd            string
+	Target         string // target host address of the request.
+	Remote         string // address of the remote host, empty if rejected.
+	Decision       string // "granted" or "rejected".
+	Error          string // reason of a rejection.
+	ClientToRemote uint64
+	RemoteToClient uint64
+	// Request is the JSON of the complete request of a rejection, empty
+	// unless detailed by WithRejectAudit.
+	Request string
+}
+
+// AuditStore stores audit records, e.g. in a database.
+type AuditStore interface {
+	// Write stores the records.
+	Write(records []AuditRecord) error
+	// Prune deletes the records of the sessions started before the time
+	// and returns their number.
+	Prune(before time.Time) (int64, error)
+}
+
+// AuditLog is an EventNotifier writing a record of every session to an
+// AuditStore once it is rejected or closed, for after-the-fact
+// investigations. The records are written in batches by a goroutine, and
+// those older than the retention are pruned hourly.
+type AuditLog struct {
+	store     AuditStore
+	retention time.Duration
+	logger    Logger
+	batcher   *batcher[AuditRecord]
+}
+
+// NewAuditLog creates an audit log writing to store and starts its writer.
+// Records are kept for retention, or forever if it is 0. Write errors are
+// logged to logger if it is not nil. Close it to write the pending
+// records.
+func NewAuditLog(store AuditStore, retention time.Duration, logger Logger) *AuditLog {
+	a := &AuditLog{store: store, retention: retention, logger: logger}
+	a.batcher = newBatcher(50, time.Second, a.write)
+	if retention > 0 {
+		go a.pruneLoop()
+	}
+	return a
+}
+
+// Notify queues the record of a rejected or closed session.
+func (a *AuditLog) Notify(ev Event) {
+	rec := AuditRecord{
+		Start:          ev.Session.Start,
+		End:            ev.Time,
+		Client:         ev.Session.Client,
+		UserId:         ev.Session.UserId,
+		Identity:       ev.Session.Identity,
+		Cmd:            ev.Session.Cmd,
+		Target:         ev.Session.Target,
+		Remote:         ev.Remote,
+		Error:          ev.Error,
+		ClientToRemote: ev.Session.ClientToRemote,
+		RemoteToClient: ev.Session.RemoteToClient,
+	}
+	if ev.Request != nil {
+		if b, err := json.Marshal(ev.Request); err == nil {
+			rec.Request = string(b)
+		}
+	}
+	switch ev.Type {
+	case EventClosed:
+		rec.Decision = "granted"
+	case EventRejected:
+		rec.Decision = "rejected"
+	default:
+		return
+	}
+	if !a.batcher.add(rec) && a.logger != nil {
+		a.logger.Warnf("audit queue is full, record of session %v dropped", ev.Session.ID)
+	}
+}
+
+// Close writes the pending records and stops the writer.
+func (a *AuditLog) Close() error {
+	a.batcher.close()
+	return nil
+}
+
+func (a *AuditLog) write(records []AuditRecord) {
+	if err := a.store.Write(records); err != nil && a.logger != nil {
+		a.logger.Errorf("audit: %v records lost: %v", len(records), err)
+	}
+}
+
+func (a *AuditLog) pruneLoop() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		n, err := a.store.Prune(time.Now().Add(-a.retention))
+		if err != nil && a.logger != nil {
+			a.logger.Errorf("audit: prune records: %v", err)
+		} else if n > 0 && a.logger != nil {
+			a.logger.Infof("audit: pruned %v records older than %v", n, a.retention)
+		}
+		select {
+		case <-ticker.C:
+		case <-a.batcher.done:
+			return
+		}
+	}
+}
+
+// auditTimeFormat is the format of the times in SQL, of fixed width so that
+// they sort as strings in any database.
+const auditTimeFormat = "2006-01-02T15:04:05.000000Z"
+
+// SQLAuditStore is an AuditStore in the socks4_audit table of a SQL
+// database, created if it does not exist.
+type SQLAuditStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+// NewSQLAuditStore creates a store in db, whose dialect is "sqlite" or
+// "postgres".
+func NewSQLAuditStore(db *sql.DB, dialect string) (*SQLAuditStore, error) {
+	id := "id INTEGER PRIMARY KEY AUTOINCREMENT"
+	switch dialect {
+	case "sqlite":
+	case "postgres":
+		id = "id BIGSERIAL PRIMARY KEY"
+	default:
+		return nil, fmt.Errorf("unsupported SQL dialect %q", dialect)
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS socks4_audit (
+	` + id + `,
+	start_time TEXT NOT NULL,
+	end_time TEXT NOT NULL,
+	client TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	identity TEXT NOT NULL,
+	cmd TEXT NOT NULL,
+	target TEXT NOT NULL,
+	remote TEXT NOT NULL,
+	decision TEXT NOT NULL,
+	error TEXT NOT NULL,
+	client_to_remote_bytes BIGINT NOT NULL,
+	remote_to_client_bytes BIGINT NOT NULL,
+	request TEXT NOT NULL DEFAULT ''
+)`)
+	if err == nil {
+		_, err = db.Exec(`CREATE INDEX IF NOT EXISTS socks4_audit_start ON socks4_audit (start_time)`)
+	}
+	// the tables created before the requests were recorded.
+	if err == nil {
+		if _, qErr := db.Exec(`SELECT request FROM socks4_audit WHERE 1 = 0`); qErr != nil {
+			_, err = db.Exec(`ALTER TABLE socks4_audit ADD COLUMN request TEXT NOT NULL DEFAULT ''`)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &SQLAuditStore{db: db, dialect: dialect}, nil
+}
+
+// placeholders returns the n placeholders of the parameters of a row
+// starting at the parameter i.
+func (s *SQLAuditStore) placeholders(i, n int) string {
+	return sqlPlaceholders(s.dialect, i, n)
+}
+
+// sqlPlaceholders returns the n placeholders of the dialect for the
+// parameters of a row starting at the parameter i.
+func sqlPlaceholders(dialect string, i, n int) string {
+	p := make([]string, n)
+	for j := range p {
+		if dialect == "postgres" {
+			p[j] = fmt.Sprintf("$%d", i+j+1)
+		} else {
+			p[j] = "?"
+		}
+	}
+	return "(" + strings.Join(p, ", ") + ")"
+}
+
+func (s *SQLAuditStore) Write(records []AuditRecord) error {
+	const columns = 13
+	var b strings.Builder
+	b.WriteString(`INSERT INTO socks4_audit (start_time, end_time, client, user_id, identity, cmd, target, remote,
+	decision, error, client_to_remote_bytes, remote_to_client_bytes, request) VALUES `)
+	args := make([]any, 0, columns*len(records))
+	for i, r := range records {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(s.placeholders(len(args), columns))
+		args = append(args, r.Start.UTC().Format(auditTimeFormat), r.End.UTC().Format(auditTimeFormat),
+			r.Client, r.UserId, r.Identity, r.Cmd, r.Target, r.Remote, r.Decision, r.Error,
+			int64(r.ClientToRemote), int64(r.RemoteToClient), r.Request)
+	}
+	_, err := s.db.Exec(b.String(), args...)
+	return err
+}
+
+func (s *SQLAuditStore) Prune(before time.Time) (int64, error) {
+	res, err := s.db.Exec(`DELETE FROM socks4_audit WHERE start_time < `+s.placeholders(0, 1), before.UTC().Format(auditTimeFormat))
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
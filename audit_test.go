@@ -0,0 +1,201 @@
+package socks4
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+)
+
+// auditRecords stores the audit records in memory.
+type auditRecords struct {
+	mu      sync.Mutex
+	records []AuditRecord
+	pruned  chan time.Time // times of the prunings, if not nil.
+	err     error
+}
+
+func (a *auditRecords) Write(records []AuditRecord) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.err != nil {
+		return a.err
+	}
+	a.records = append(a.records, records...)
+	return nil
+}
+
+func (a *auditRecords) Prune(before time.Time) (int64, error) {
+	if a.pruned != nil {
+		a.pruned <- before
+	}
+	return 0, nil
+}
+
+func TestAuditLogNotify(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	session := SessionInfo{ID: 1, Client: "192.0.2.1:50000", UserId: "alice", Cmd: "connect", Target: "198.51.100.1:80", Start: start, ClientToRemote: 10, RemoteToClient: 20}
+	for _, tt := range []struct {
+		name   string
+		ev     Event
+		record *AuditRecord
+	}{
+		{
+			name: "closed",
+			ev:   Event{Type: EventClosed, Time: start.Add(time.Minute), Session: session, Remote: "198.51.100.1:80"},
+			record: &AuditRecord{Start: start, End: start.Add(time.Minute), Client: "192.0.2.1:50000", UserId: "alice", Cmd: "connect",
+				Target: "198.51.100.1:80", Remote: "198.51.100.1:80", Decision: "granted", ClientToRemote: 10, RemoteToClient: 20},
+		},
+		{
+			name: "rejected",
+			ev:   Event{Type: EventRejected, Time: start, Session: session, Error: "denied by the rules"},
+			record: &AuditRecord{Start: start, End: start, Client: "192.0.2.1:50000", UserId: "alice", Cmd: "connect",
+				Target: "198.51.100.1:80", Decision: "rejected", Error: "denied by the rules", ClientToRemote: 10, RemoteToClient: 20},
+		},
+		{name: "established", ev: Event{Type: EventEstablished, Time: start, Session: session}},
+		{name: "stalled", ev: Event{Type: EventStalled, Time: start, Session: session}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &auditRecords{}
+			a := NewAuditLog(store, 0, nil)
+			a.Notify(tt.ev)
+			a.Close()
+			var want []AuditRecord
+			if tt.record != nil {
+				want = append(want, *tt.record)
+			}
+			if !reflect.DeepEqual(store.records, want) {
+				t.Errorf("records %+v, want %+v", store.records, want)
+			}
+		})
+	}
+}
+
+func TestAuditLogRetention(t *testing.T) {
+	store := &auditRecords{pruned: make(chan time.Time, 1)}
+	a := NewAuditLog(store, 24*time.Hour, nil)
+	defer a.Close()
+	select {
+	case before := <-store.pruned:
+		if age := time.Since(before); age < 24*time.Hour || age > 25*time.Hour {
+			t.Errorf("records pruned before %v, want those older than the retention", before)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("records not pruned on start")
+	}
+}
+
+// openTestDB opens a SQLite database in a temporary directory.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "audit.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestSQLAuditStore(t *testing.T) {
+	db := openTestDB(t)
+	s, err := NewSQLAuditStore(db, "sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var records []AuditRecord
+	for i := 0; i < 3; i++ {
+		records = append(records, AuditRecord{
+			Start: start.Add(time.Duration(i) * time.Hour), End: start.Add(time.Duration(i)*time.Hour + time.Minute),
+			Client: "192.0.2.1:50000", UserId: "alice", Cmd: "connect", Target: "198.51.100.1:80", Remote: "198.51.100.1:80",
+			Decision: "granted", ClientToRemote: uint64(i), RemoteToClient: 1 << 40,
+		})
+	}
+	if err := s.Write(records); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(records[:1]); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	var first, end string
+	var toClient int64
+	if err := db.QueryRow(`SELECT COUNT(*), MIN(start_time), MIN(end_time), MAX(remote_to_client_bytes) FROM socks4_audit`).Scan(&count, &first, &end, &toClient); err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 || first != "2024-05-01T12:00:00.000000Z" || end != "2024-05-01T12:01:00.000000Z" || toClient != 1<<40 {
+		t.Errorf("%v records from %v to %v of %v bytes", count, first, end, toClient)
+	}
+
+	for _, tt := range []struct {
+		before time.Time
+		pruned int64
+	}{
+		{before: start, pruned: 0},
+		{before: start.Add(90 * time.Minute), pruned: 3},
+		{before: start.Add(90 * time.Minute), pruned: 0},
+		{before: start.Add(24 * time.Hour), pruned: 1},
+	} {
+		if n, err := s.Prune(tt.before); err != nil || n != tt.pruned {
+			t.Errorf("pruned %v records before %v: %v, want %v", n, tt.before, err, tt.pruned)
+		}
+	}
+}
+
+func TestSQLAuditStoreMigration(t *testing.T) {
+	db := openTestDB(t)
+	// a table of the first version, without the requests.
+	if _, err := db.Exec(`CREATE TABLE socks4_audit (id INTEGER PRIMARY KEY AUTOINCREMENT, start_time TEXT NOT NULL, end_time TEXT NOT NULL,
+	client TEXT NOT NULL, user_id TEXT NOT NULL, identity TEXT NOT NULL, cmd TEXT NOT NULL, target TEXT NOT NULL, remote TEXT NOT NULL,
+	decision TEXT NOT NULL, error TEXT NOT NULL, client_to_remote_bytes BIGINT NOT NULL, remote_to_client_bytes BIGINT NOT NULL)`); err != nil {
+		t.Fatal(err)
+	}
+	// created again on each start.
+	for i := 0; i < 2; i++ {
+		s, err := NewSQLAuditStore(db, "sqlite")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Write([]AuditRecord{{Decision: "rejected", Request: `{"version":4}`}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := NewSQLAuditStore(db, "mysql"); err == nil {
+		t.Error("store of an unsupported dialect created")
+	}
+}
+
+func TestSQLPlaceholders(t *testing.T) {
+	for _, tt := range []struct {
+		dialect string
+		i, n    int
+		want    string
+	}{
+		{"sqlite", 0, 3, "(?, ?, ?)"},
+		{"sqlite", 13, 1, "(?)"},
+		{"postgres", 0, 3, "($1, $2, $3)"},
+		{"postgres", 13, 2, "($14, $15)"},
+	} {
+		if got := sqlPlaceholders(tt.dialect, tt.i, tt.n); got != tt.want {
+			t.Errorf("%v placeholders from %v of %v: %q, want %q", tt.n, tt.i, tt.dialect, got, tt.want)
+		}
+	}
+}
+
+func TestAuditLogWriteError(t *testing.T) {
+	var log lockedBuffer
+	store := &auditRecords{err: errors.New("disk full")}
+	a := NewAuditLog(store, 0, &logrus.Logger{Out: &log, Formatter: &logrus.TextFormatter{}, Level: logrus.DebugLevel})
+	a.Notify(Event{Type: EventClosed})
+	a.Close()
+	if !strings.Contains(log.String(), "disk full") {
+		t.Errorf("log %q, want the write error", log.String())
+	}
+}
@@ -0,0 +1,87 @@
+package socks4
+
+import (
+	"sync"
+	"time"
+)
+
+// batcher queues items and flushes them in batches by a goroutine, when a
+// batch is full or at the interval. The batches passed to flush are reused
+// and must not be retained.
+type batcher[T any] struct {
+	size     int
+	interval time.Duration
+	flush    func(batch []T)
+	done     chan struct{} // closed when the pending items are flushed after close.
+
+	mu     sync.Mutex
+	items  chan T
+	closed bool
+}
+
+// newBatcher starts a batcher queuing up to 10 batches.
+func newBatcher[T any](size int, interval time.Duration, flush func(batch []T)) *batcher[T] {
+	b := &batcher[T]{
+		size:     size,
+		interval: interval,
+		flush:    flush,
+		done:     make(chan struct{}),
+		items:    make(chan T, 10*size),
+	}
+	go b.run()
+	return b
+}
+
+// add queues the item. It reports false if the queue is full and the item
+// is dropped. Items added after close are dropped too.
+func (b *batcher[T]) add(item T) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return true
+	}
+	select {
+	case b.items <- item:
+		return true
+	default:
+		return false
+	}
+}
+
+// close flushes the pending items and stops the goroutine.
+func (b *batcher[T]) close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.items)
+	}
+	b.mu.Unlock()
+	<-b.done
+}
+
+func (b *batcher[T]) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	batch := make([]T, 0, b.size)
+	for {
+		select {
+		case item, ok := <-b.items:
+			if !ok {
+				if len(batch) > 0 {
+					b.flush(batch)
+				}
+				return
+			}
+			batch = append(batch, item)
+			if len(batch) < b.size {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if len(batch) > 0 {
+			b.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
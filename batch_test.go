@@ -0,0 +1,79 @@
+package socks4
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatcher(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		size    int
+		items   int
+		batches [][]int
+	}{
+		{name: "partial batch", size: 3, items: 2, batches: [][]int{{0, 1}}},
+		{name: "full batches", size: 2, items: 4, batches: [][]int{{0, 1}, {2, 3}}},
+		{name: "full and partial batches", size: 2, items: 5, batches: [][]int{{0, 1}, {2, 3}, {4}}},
+		{name: "no items", size: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var batches [][]int
+			b := newBatcher(tt.size, time.Hour, func(batch []int) {
+				// the batches are reused.
+				batches = append(batches, append([]int(nil), batch...))
+			})
+			for i := 0; i < tt.items; i++ {
+				if !b.add(i) {
+					t.Fatalf("item %v dropped", i)
+				}
+			}
+			b.close()
+			if !reflect.DeepEqual(batches, tt.batches) {
+				t.Errorf("batches %v, want %v", batches, tt.batches)
+			}
+			// dropped once closed, without blocking.
+			if !b.add(tt.items) || !reflect.DeepEqual(batches, tt.batches) {
+				t.Error("item added once closed")
+			}
+			b.close()
+		})
+	}
+}
+
+func TestBatcherInterval(t *testing.T) {
+	flushed := make(chan []int, 1)
+	b := newBatcher(10, 10*time.Millisecond, func(batch []int) {
+		flushed <- append([]int(nil), batch...)
+	})
+	defer b.close()
+	b.add(1)
+	select {
+	case batch := <-flushed:
+		if !reflect.DeepEqual(batch, []int{1}) {
+			t.Errorf("batch %v, want the item", batch)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("partial batch not flushed at the interval")
+	}
+}
+
+func TestBatcherFull(t *testing.T) {
+	var block sync.WaitGroup
+	block.Add(1)
+	b := newBatcher(1, time.Hour, func(batch []int) { block.Wait() })
+	// the goroutine holds an item while flushing, the queue 10 batches.
+	var added int
+	for i := 0; i < 20; i++ {
+		if b.add(i) {
+			added++
+		}
+	}
+	if added < 10 || added > 11 {
+		t.Errorf("%v items added, want the queue of 10 and at most the one flushing", added)
+	}
+	block.Done()
+	b.close()
+}
@@ -0,0 +1,70 @@
+package socks4
+
+import (
+	"errors"
+	"net"
+)
+
+// errShutDown is the error of the pending BIND requests whose listener is
+// closed by the shutdown of the server.
+var errShutDown = errors.New("server is shut down")
+
+// WithBindDrain makes ShutDown and ShutdownContext let the pending BIND
+// requests wait for the connections of their remote hosts until their
+// timeout, or until the context of the shutdown is done. By default their
+// listeners are closed as soon as the shutdown begins.
+func WithBindDrain() OptionFunc {
+	return func(s *Server) {
+		s.bindDrain = true
+	}
+}
+
+// addBind tracks the listener of a pending BIND request. It returns false
+// if the server is shut down and does not drain the BIND requests.
+func (s *Server) addBind(lis net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed && !s.bindDrain {
+		return false
+	}
+	if s.binds == nil {
+		s.binds = make(map[net.Listener]bool)
+	}
+	s.binds[lis] = false
+	return true
+}
+
+// removeBind stops tracking the listener of a BIND request, and reports
+// whether it was closed by the shutdown.
+func (s *Server) removeBind(lis net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	aborted := s.binds[lis]
+	delete(s.binds, lis)
+	return aborted
+}
+
+// pendingBinds returns the number of pending BIND requests.
+func (s *Server) pendingBinds() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.binds)
+}
+
+// closeBinds closes the listeners of the pending BIND requests, and returns
+// their number.
+func (s *Server) closeBinds() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for lis, aborted := range s.binds {
+		if aborted {
+			continue
+		}
+		s.binds[lis] = true
+		lis.Close()
+		s.stats.abortedBinds.Add(1)
+		n++
+	}
+	return n
+}
@@ -0,0 +1,126 @@
+package socks4
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// pendingBind sends a BIND request to the server at addr, and returns the
+// connection and the address its remote host connects to once granted.
+func pendingBind(t *testing.T, addr string) (net.Conn, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(request(CmdBind, 80, [4]byte{127, 0, 0, 1}, ""))
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != Granted {
+		t.Fatalf("first reply %x: %v", reply, err)
+	}
+	return conn, net.JoinHostPort("127.0.0.1", strconv.Itoa(int(binary.BigEndian.Uint16(reply[2:4]))))
+}
+
+func TestBindShutdown(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		drain   bool
+		timeout time.Duration // of the shutdown.
+		connect bool          // the remote host after the shutdown began.
+		granted bool          // the second reply.
+		err     error         // of the shutdown.
+		aborted uint64
+	}{
+		{name: "closed", timeout: 5 * time.Second, connect: true, aborted: 1},
+		{name: "drained", drain: true, timeout: 5 * time.Second, connect: true, granted: true},
+		{name: "drained until the shutdown deadline", drain: true, timeout: 200 * time.Millisecond, err: context.DeadlineExceeded, aborted: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []OptionFunc
+			if tt.drain {
+				opts = append(opts, WithBindDrain())
+			}
+			s, addr := serve(t, opts...)
+			conn, bindAddr := pendingBind(t, addr)
+			if st := s.Stats(); st.PendingBinds != 1 {
+				t.Fatalf("%v pending BIND requests, want 1", st.PendingBinds)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			shutdown := make(chan error, 1)
+			go func() { shutdown <- s.ShutdownContext(ctx) }()
+			var remote net.Conn
+			if tt.connect {
+				// the listener is closed by the shutdown, or drained.
+				remote, _ = net.Dial("tcp", bindAddr)
+			}
+
+			reply := make([]byte, 8)
+			_, err := io.ReadFull(conn, reply)
+			if tt.granted && (err != nil || reply[1] != Granted) {
+				t.Errorf("second reply %x (%v), want granted", reply, err)
+			} else if !tt.granted && err == nil && reply[1] == Granted {
+				t.Errorf("second reply %x, want the BIND request aborted", reply)
+			}
+			conn.Close()
+			if remote != nil {
+				remote.Close()
+			}
+
+			select {
+			case err := <-shutdown:
+				if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+					t.Errorf("shutdown error %v, want %v", err, tt.err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("shutdown not done")
+			}
+			if st := s.Stats(); st.PendingBinds != 0 || st.AbortedBinds != tt.aborted {
+				t.Errorf("%v pending and %v aborted BIND requests, want 0 and %v", st.PendingBinds, st.AbortedBinds, tt.aborted)
+			}
+		})
+	}
+}
+
+func TestBindAfterShutdown(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		drain bool
+		added bool
+	}{
+		{name: "closed"},
+		{name: "drained", drain: true, added: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []OptionFunc
+			if tt.drain {
+				opts = append(opts, WithBindDrain())
+			}
+			s, _ := serve(t, opts...)
+			// closed once serving.
+			for s.Close() != nil {
+				time.Sleep(time.Millisecond)
+			}
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lis.Close()
+			if added := s.addBind(lis); added != tt.added {
+				t.Errorf("BIND added %v after the shutdown, want %v", added, tt.added)
+			}
+			if aborted := s.removeBind(lis); aborted {
+				t.Error("BIND aborted")
+			}
+		})
+	}
+}
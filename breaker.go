@@ -0,0 +1,155 @@
+package socks4
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is the error of the requests rejected by the circuit
+// breaker.
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// WithCircuitBreaker makes the server reject CONNECT requests to a
+// destination immediately once threshold consecutive dials to it have
+// failed, or once their failure rate is beyond that of
+// WithCircuitBreakerRatio; threshold 0 counts only the failure rate.
+// After cooldown a single request is let through to probe the
+// destination; the circuit closes again when the probe succeeds.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) OptionFunc {
+	return func(s *Server) {
+		s.breaker = newBreaker(threshold, cooldown)
+	}
+}
+
+// WithCircuitBreakerRatio makes the circuit breaker also open the circuit
+// of a destination once at least ratio of its dials within a window have
+// failed, over at least minDials dials, so that the destinations failing
+// most of the time open their circuits even though some dials succeed.
+// It applies with WithCircuitBreaker, set before or after it.
+func WithCircuitBreakerRatio(ratio float64, minDials int, window time.Duration) OptionFunc {
+	return func(s *Server) {
+		if minDials < 1 {
+			minDials = 1
+		}
+		s.breakerRatio = breakerRatio{ratio: ratio, minDials: minDials, window: window}
+	}
+}
+
+// breakerRatio is the failure rate opening the circuits, see
+// WithCircuitBreakerRatio.
+type breakerRatio struct {
+	ratio    float64 // 0 if disabled.
+	minDials int
+	window   time.Duration
+}
+
+// maxBreakerHosts is the number of tracked destinations above which
+// stale entries are pruned.
+const maxBreakerHosts = 4096
+
+type breakerHost struct {
+	failures int       // consecutive failures.
+	start    time.Time // start of the window of dials and failed.
+	dials    int       // dials within the window.
+	failed   int       // failed dials within the window.
+	open     bool      // the circuit is open.
+	openedAt time.Time // time the circuit opened or the last probe failed.
+	probing  bool      // a half-open probe is in flight.
+}
+
+// breaker tracks dial failures per destination address.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+	ratio     breakerRatio
+	clock     Clock
+
+	mu    sync.Mutex
+	hosts map[string]*breakerHost
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		clock:     systemClock{},
+		hosts:     make(map[string]*breakerHost),
+	}
+}
+
+// allow reports whether a dial to addr may be attempted.
+func (b *breaker) allow(addr string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	h, ok := b.hosts[addr]
+	if !ok || !h.open {
+		return true
+	}
+	if h.probing || b.clock.Now().Sub(h.openedAt) < b.cooldown {
+		return false
+	}
+	// half-open: let one request probe the destination.
+	h.probing = true
+	return true
+}
+
+// report records the result of a dial to addr.
+func (b *breaker) report(addr string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil && b.ratio.ratio == 0 {
+		delete(b.hosts, addr)
+		return
+	}
+	h, ok := b.hosts[addr]
+	if !ok {
+		if len(b.hosts) >= maxBreakerHosts {
+			b.prune()
+		}
+		h = &breakerHost{}
+		b.hosts[addr] = h
+	}
+	now := b.clock.Now()
+	if now.Sub(h.start) >= b.ratio.window {
+		h.start, h.dials, h.failed = now, 0, 0
+	}
+	h.dials++
+	if err == nil {
+		if h.open {
+			delete(b.hosts, addr)
+			return
+		}
+		h.failures = 0
+		return
+	}
+	h.failures++
+	h.failed++
+	h.probing = false
+	if h.open || b.trips(h) {
+		h.open = true
+		h.openedAt = now
+	}
+}
+
+// trips reports whether the failures of the destination open its circuit.
+func (b *breaker) trips(h *breakerHost) bool {
+	if b.threshold > 0 && h.failures >= b.threshold {
+		return true
+	}
+	r := b.ratio
+	return r.ratio > 0 && h.dials >= r.minDials && float64(h.failed) >= r.ratio*float64(h.dials)
+}
+
+// prune drops the destinations whose circuit is not open or whose cooldown
+// has long passed. It must be called with b.mu held.
+func (b *breaker) prune() {
+	now := b.clock.Now()
+	for addr, h := range b.hosts {
+		if (!h.open && now.Sub(h.start) >= b.ratio.window) || (h.open && now.Sub(h.openedAt) > 2*b.cooldown) {
+			delete(b.hosts, addr)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package socks4
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// stepClock is a system clock whose Now is set by the tests.
+type stepClock struct {
+	systemClock
+	now time.Time
+}
+
+func (c *stepClock) Now() time.Time { return c.now }
+
+var errDial = errors.New("connection refused")
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	clock := &stepClock{now: time.Unix(1000, 0)}
+	b := newBreaker(3, time.Minute)
+	b.clock = clock
+
+	for i := 0; i < 2; i++ {
+		b.report("a:80", errDial)
+	}
+	b.report("a:80", nil)
+	b.report("a:80", errDial)
+	if !b.allow("a:80") {
+		t.Fatal("circuit opened without 3 consecutive failures")
+	}
+	b.report("a:80", errDial)
+	b.report("a:80", errDial)
+	if b.allow("a:80") {
+		t.Fatal("circuit not opened after 3 consecutive failures")
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	if !b.allow("a:80") {
+		t.Fatal("probe not allowed after the cooldown")
+	}
+	if b.allow("a:80") {
+		t.Fatal("second probe allowed while the first is in flight")
+	}
+	b.report("a:80", nil)
+	if !b.allow("a:80") {
+		t.Fatal("circuit not closed by the successful probe")
+	}
+}
+
+func TestBreakerFailureRatio(t *testing.T) {
+	clock := &stepClock{now: time.Unix(1000, 0)}
+	b := newBreaker(0, time.Minute)
+	b.ratio = breakerRatio{ratio: 0.8, minDials: 10, window: time.Minute}
+	b.clock = clock
+
+	// 9 failures out of 10 dials, one succeeding.
+	for i := 0; i < 9; i++ {
+		if !b.allow("a:80") {
+			t.Fatal("circuit opened before the min dials")
+		}
+		b.report("a:80", errDial)
+		if i == 0 {
+			b.report("a:80", nil)
+		}
+	}
+	if b.allow("a:80") {
+		t.Fatal("circuit not opened by 90% of failed dials")
+	}
+
+	// the dials of an earlier window do not count.
+	b.report("b:80", nil)
+	for i := 0; i < 8; i++ {
+		b.report("b:80", errDial)
+	}
+	clock.now = clock.now.Add(time.Minute)
+	b.report("b:80", errDial)
+	if !b.allow("b:80") {
+		t.Fatal("circuit opened by the dials of the previous window")
+	}
+}
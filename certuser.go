@@ -0,0 +1,62 @@
+package socks4
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+)
+
+// CertUserIdMode is how the user ids of the requests follow the client
+// certificates, see WithCertUserId.
+type CertUserIdMode int
+
+const (
+	// CertUserIdOff keeps the user ids of the requests.
+	CertUserIdOff CertUserIdMode = iota
+	// CertUserIdOverride replaces the user ids of the requests by the one
+	// of the certificate.
+	CertUserIdOverride
+	// CertUserIdValidate rejects the requests whose user id differs from
+	// the one of the certificate with ErrUserIdRejected.
+	CertUserIdValidate
+)
+
+// CertUserId returns the user id of a client certificate, "" for none.
+type CertUserId func(cert *x509.Certificate) string
+
+// WithCertUserId makes the server map the verified client certificates of
+// the TLS listeners to the user ids of their requests, overriding or
+// validating the user ids sent by the clients, so that the rules, the
+// limits and the logs see the user of the certificate. userId returns the
+// user id of a certificate, CertIdentity if nil. The requests of the
+// clients without certificate keep their user ids.
+func WithCertUserId(mode CertUserIdMode, userId CertUserId) OptionFunc {
+	return func(s *Server) {
+		if userId == nil {
+			userId = CertIdentity
+		}
+		s.certUserIdMode = mode
+		s.certUserId = userId
+	}
+}
+
+// mapCertUserId returns the request with the user id of the client
+// certificate of conn, or an error if it does not validate.
+func (s *Server) mapCertUserId(conn net.Conn, req Request) (Request, error) {
+	if s.certUserIdMode == CertUserIdOff {
+		return req, nil
+	}
+	cert := clientCert(conn)
+	if cert == nil {
+		return req, nil
+	}
+	user := s.certUserId(cert)
+	if user == "" {
+		return req, fmt.Errorf("%w: no user id in the client certificate", ErrUserIdRejected)
+	}
+	if s.certUserIdMode == CertUserIdValidate && req.UserId != user {
+		return req, fmt.Errorf("%w: the client certificate is of user %q", ErrUserIdRejected, user)
+	}
+	req.UserId = user
+	return req, nil
+}
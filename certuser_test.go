@@ -0,0 +1,64 @@
+package socks4
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCertUserId(t *testing.T) {
+	pki := newTestPKI(t)
+	echo := echoTarget(t)
+	alice := &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, EmailAddresses: []string{"alice@example.com"}}
+	for _, tt := range []struct {
+		name   string
+		mode   CertUserIdMode
+		userId CertUserId
+		cert   *x509.Certificate // of the client, none if nil.
+		sent   string            // user id of the request.
+		user   string            // of the session, rejected if empty.
+	}{
+		{name: "off", mode: CertUserIdOff, cert: alice, sent: "mallory", user: "mallory"},
+		{name: "override", mode: CertUserIdOverride, cert: alice, sent: "mallory", user: "alice"},
+		{name: "override of no user id", mode: CertUserIdOverride, cert: alice, user: "alice"},
+		{name: "override without certificate", mode: CertUserIdOverride, sent: "mallory", user: "mallory"},
+		{name: "override by email", mode: CertUserIdOverride, userId: func(cert *x509.Certificate) string { return cert.EmailAddresses[0] }, cert: alice, sent: "mallory", user: "alice@example.com"},
+		{name: "validated", mode: CertUserIdValidate, cert: alice, sent: "alice", user: "alice"},
+		{name: "not validated", mode: CertUserIdValidate, cert: alice, sent: "mallory"},
+		{name: "no user id in the certificate", mode: CertUserIdOverride, cert: &x509.Certificate{}, sent: "mallory"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := serve(t, WithCertUserId(tt.mode, tt.userId), WithTLS(&tls.Config{
+				Certificates: []tls.Certificate{pki.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "proxy"}})},
+				ClientCAs:    pki.pool,
+				ClientAuth:   tls.VerifyClientCertIfGiven,
+			}))
+			config := &tls.Config{RootCAs: pki.pool}
+			if tt.cert != nil {
+				config.Certificates = []tls.Certificate{pki.issue(t, tt.cert)}
+			}
+			conn, err := NewDialer(addr, WithDialerTLS(config), WithDialerUserId(tt.sent), WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+			if tt.user == "" {
+				var rej *RejectError
+				if !errors.As(err, &rej) || rej.Code != RejectWrongUserId {
+					t.Fatalf("error %v, want a rejection of the user id", err)
+				}
+				if n := s.Stats().Rejections["user_id"]; n != 1 {
+					t.Errorf("%v rejections of user ids, want 1", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			assertEcho(t, conn, []byte("hello"))
+			if sessions := s.Sessions(); len(sessions) != 1 || sessions[0].UserId != tt.user {
+				t.Errorf("sessions %+v, want the one of %v", sessions, tt.user)
+			}
+		})
+	}
+}
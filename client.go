@@ -0,0 +1,631 @@
+package socks4
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// RejectError is returned by Dialer when the server rejects a request.
+type RejectError struct {
+	Code   byte   // the reply code.
+	Reason string // the reason written by the server, see WithDialerRejectReason.
+}
+
+func (e *RejectError) Error() string {
+	var msg string
+	switch e.Code {
+	case RejectNoIdentd:
+		msg = "SOCKS request rejected: server can't connect to identd on client"
+	case RejectWrongUserId:
+		msg = "SOCKS request rejected: user id mismatch"
+	default:
+		msg = fmt.Sprintf("SOCKS request rejected or failed (code %#x)", e.Code)
+	}
+	if e.Reason != "" {
+		msg += ": " + e.Reason
+	}
+	return msg
+}
+
+type DialerOption func(*Dialer)
+
+// WithDialerUserId sets the user id sent in the requests.
+func WithDialerUserId(userId string) DialerOption {
+	return func(d *Dialer) {
+		d.userId = userId
+	}
+}
+
+// WithDialerTimeout sets the timeout of connecting to the server and
+// completing the request.
+func WithDialerTimeout(timeout time.Duration) DialerOption {
+	return func(d *Dialer) {
+		d.timeout = timeout
+	}
+}
+
+// WithLocalResolve makes the dialer resolve domain names itself and send
+// SOCKS 4 requests, instead of letting the server resolve them by SOCKS 4A.
+func WithLocalResolve() DialerOption {
+	return func(d *Dialer) {
+		d.localResolve = true
+	}
+}
+
+// WithDialerRejectReason makes the dialer read the reason the server
+// writes after its rejections, see WithRejectReasons, into the Reason of
+// the RejectErrors. The servers writing none close the connection, or are
+// waited for up to a second.
+func WithDialerRejectReason() DialerOption {
+	return func(d *Dialer) {
+		d.rejectReason = true
+	}
+}
+
+// WithDialerTLS makes the dialer connect to the server over TLS with
+// config. The server name defaults to the host of the proxy address.
+func WithDialerTLS(config *tls.Config) DialerOption {
+	return func(d *Dialer) {
+		d.tlsConfig = config
+	}
+}
+
+// WithDialerWebSocket makes the dialer connect to the server by a
+// WebSocket connection to url (ws:// or wss://), which carries the SOCKS
+// session in place of a TCP connection to the proxy address (see
+// Server.WebSocketHandler). wss:// URLs are verified with the config of
+// WithDialerTLS if set.
+func WithDialerWebSocket(url string) DialerOption {
+	return func(d *Dialer) {
+		d.wsURL = url
+	}
+}
+
+// WithDialerTransport makes the dialer connect to the server by dial, in
+// place of a TCP connection to the proxy address, e.g. to open a stream
+// of a multiplexed transport.
+func WithDialerTransport(dial func(ctx context.Context) (net.Conn, error)) DialerOption {
+	return func(d *Dialer) {
+		d.transport = dial
+	}
+}
+
+// Conn is a connection through a SOCKS server, returned by the dials of a
+// Dialer as a net.Conn, i.e.:
+//
+//	conn, err := d.Dial("tcp", "example.com:80")
+//	bound := conn.(*socks4.Conn).BoundAddr()
+type Conn struct {
+	net.Conn
+	reply Reply
+}
+
+// Reply returns the reply of the server granting the request.
+func (c *Conn) Reply() Reply {
+	return c.reply
+}
+
+// BoundAddr returns the address the server reported in its reply, like the
+// local address of its connection to the destination. Its IP is 0.0.0.0
+// when the server reports none.
+func (c *Conn) BoundAddr() *net.TCPAddr {
+	return &net.TCPAddr{IP: c.reply.IP, Port: c.reply.Port}
+}
+
+// NetConn returns the connection to the SOCKS server.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side of the connection to the SOCKS
+// server, if it supports it.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return fmt.Errorf("%T does not support CloseWrite", c.Conn)
+}
+
+// DialOptions override the options of a Dialer for the dials of a context,
+// see ContextWithDialOptions.
+type DialOptions struct {
+	// UserId is the user id sent in the request in place of the one of
+	// WithDialerUserId, if not empty.
+	UserId string
+}
+
+type dialOptionsKey struct{}
+
+// ContextWithDialOptions returns a copy of ctx whose dials by
+// Dialer.DialContext use opts, e.g. to attribute the connections of each
+// tenant of an application sharing a dialer:
+//
+//	ctx = socks4.ContextWithDialOptions(ctx, socks4.DialOptions{UserId: tenant})
+//	conn, err := d.DialContext(ctx, "tcp", "example.com:80")
+func ContextWithDialOptions(ctx context.Context, opts DialOptions) context.Context {
+	return context.WithValue(ctx, dialOptionsKey{}, opts)
+}
+
+// dialOptions returns the options of the dials of ctx, zero if not set.
+func dialOptions(ctx context.Context) DialOptions {
+	opts, _ := ctx.Value(dialOptionsKey{}).(DialOptions)
+	return opts
+}
+
+// Dialer connects to addresses through a SOCKS 4 proxy server.
+type Dialer struct {
+	proxyAddress string
+	userId       string
+	timeout      time.Duration
+	localResolve bool
+	rejectReason bool // read the reasons of the rejections.
+	tlsConfig    *tls.Config
+	wsURL        string // WebSocket URL of the server, "" to connect by TCP.
+	transport    func(ctx context.Context) (net.Conn, error)
+	layer        Transport // wraps the TCP connections to the server, nil for none.
+	compression  bool      // compress the connections to the server.
+
+	fallbacks     []string       // proxy servers after the proxy address.
+	selection     ProxySelection // of the proxy servers.
+	checkInterval time.Duration  // of the health checks, 0 for none.
+	proxies       *proxySet      // nil with the proxy address only.
+
+	hooks []DialerHooks
+}
+
+// NewDialer creates a dialer with the SOCKS server address and options.
+// i.e.:
+//
+//	d := socks4.NewDialer("127.0.0.1:1080", socks4.WithDialerUserId("alice"))
+//	conn, err := d.Dial("tcp", "example.com:80")
+func NewDialer(proxyAddress string, opts ...DialerOption) *Dialer {
+	d := &Dialer{proxyAddress: proxyAddress}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if len(d.fallbacks) > 0 || d.checkInterval > 0 {
+		d.proxies = newProxySet(append([]string{proxyAddress}, d.fallbacks...), d.selection)
+		if d.checkInterval > 0 {
+			go d.proxies.check(d.checkInterval, d.timeout)
+		}
+	}
+	return d
+}
+
+// Dial connects to the address through the SOCKS server.
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to the address through the SOCKS server using the
+// provided context. Only TCP networks are supported. The connections are
+// *Conn.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("SOCKS 4 does not support network %v", network)
+	}
+	if d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.timeout)
+		defer cancel()
+	}
+
+	ev := DialEvent{Target: address, UserId: d.requestUserId(ctx)}
+	start := time.Now()
+	d.dialStarted(ev)
+	conn, rep, err := d.dial(ctx, address, &ev)
+	ev.Code, ev.Err = rep.Cd, err
+	if ev.Proxy == "" {
+		ev.Proxy = d.proxyAddress
+		if d.wsURL != "" {
+			ev.Proxy = d.wsURL
+		}
+	}
+	d.dialDone(ev, start)
+	return conn, err
+}
+
+// dial connects to the address through the SOCKS server, setting the proxy
+// of ev once connected to it.
+func (d *Dialer) dial(ctx context.Context, address string, ev *DialEvent) (net.Conn, Reply, error) {
+	req, err := d.request(ctx, address)
+	if err != nil {
+		return nil, Reply{}, err
+	}
+	b, err := req.ToBytes()
+	if err != nil {
+		return nil, Reply{}, err
+	}
+
+	conn, err := d.dialProxy(ctx)
+	if err != nil {
+		return nil, Reply{}, err
+	}
+	ev.Proxy = conn.RemoteAddr().String()
+	rep, err := d.handshake(ctx, conn, b)
+	if err != nil {
+		conn.Close()
+		return nil, rep, err
+	}
+	return &Conn{Conn: conn, reply: rep}, rep, nil
+}
+
+// requestUserId returns the user id of the requests of ctx.
+func (d *Dialer) requestUserId(ctx context.Context) string {
+	if opts := dialOptions(ctx); opts.UserId != "" {
+		return opts.UserId
+	}
+	return d.userId
+}
+
+// dialProxy connects to the SOCKS server, compressing the connection if
+// enabled.
+func (d *Dialer) dialProxy(ctx context.Context) (net.Conn, error) {
+	conn, err := d.connectProxy(ctx)
+	if err != nil || !d.compression {
+		return conn, err
+	}
+	return newCompressedClient(conn), nil
+}
+
+// connectProxy connects to the SOCKS server.
+func (d *Dialer) connectProxy(ctx context.Context) (net.Conn, error) {
+	if d.transport != nil {
+		return d.transport(ctx)
+	}
+	if d.wsURL != "" {
+		return d.dialWebSocket(ctx)
+	}
+	if d.proxies != nil {
+		return d.proxies.dial(ctx, d)
+	}
+	return d.dialAddress(ctx, d.proxyAddress)
+}
+
+// dialAddress connects to the SOCKS server at address.
+func (d *Dialer) dialAddress(ctx context.Context, address string) (net.Conn, error) {
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err = d.wrapLayer(conn); err != nil {
+		return nil, err
+	}
+	if d.tlsConfig != nil {
+		return d.tlsClient(ctx, conn, d.tlsConfig, address)
+	}
+	return conn, nil
+}
+
+// dialWebSocket connects to the SOCKS server by a WebSocket connection.
+func (d *Dialer) dialWebSocket(ctx context.Context) (net.Conn, error) {
+	config, err := websocket.NewConfig(d.wsURL, "http://localhost/")
+	if err != nil {
+		return nil, err
+	}
+	address := config.Location.Host
+	if config.Location.Port() == "" {
+		port := "80"
+		if config.Location.Scheme == "wss" {
+			port = "443"
+		}
+		address = net.JoinHostPort(config.Location.Hostname(), port)
+	}
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if conn, err = d.wrapLayer(conn); err != nil {
+		return nil, err
+	}
+	if config.Location.Scheme == "wss" {
+		tlsConfig := d.tlsConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		if conn, err = d.tlsClient(ctx, conn, tlsConfig, address); err != nil {
+			return nil, err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("WebSocket handshake with SOCKS server: %v", err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return ws, nil
+}
+
+// wrapLayer wraps a TCP connection to the server with the transport of
+// WithDialerTransportLayer, if any.
+func (d *Dialer) wrapLayer(conn net.Conn) (net.Conn, error) {
+	if d.layer == nil {
+		return conn, nil
+	}
+	wrapped, err := d.layer.Client(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("transport to SOCKS server: %v", err)
+	}
+	return wrapped, nil
+}
+
+// tlsClient completes the TLS handshake with the server at address on
+// conn, closing conn on failure.
+func (d *Dialer) tlsClient(ctx context.Context, conn net.Conn, config *tls.Config, address string) (net.Conn, error) {
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+	tc := tls.Client(conn, config)
+	if err := tc.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake with SOCKS server: %v", err)
+	}
+	return tc, nil
+}
+
+// request builds the CONNECT request for the address.
+func (d *Dialer) request(ctx context.Context, address string) (Request, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return Request{}, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return Request{}, fmt.Errorf("invalid port %v", portStr)
+	}
+	req := Request{
+		Version: Version4,
+		Cmd:     CmdConnect,
+		Port:    port,
+		Address: address,
+		UserId:  d.requestUserId(ctx),
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return req, nil
+	}
+	if !d.localResolve {
+		req.IsV4A = true
+		return req, nil
+	}
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", host)
+	if err != nil {
+		return Request{}, err
+	}
+	req.Address = net.JoinHostPort(ips[0].String(), portStr)
+	return req, nil
+}
+
+// handshake sends the request on conn and reads the reply of the server.
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn, req []byte) (Reply, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	// unblock the handshake when ctx is canceled.
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-done:
+		}
+	}()
+	defer func() {
+		close(done)
+		<-stopped
+		conn.SetDeadline(time.Time{})
+	}()
+
+	if _, err := conn.Write(req); err != nil {
+		return Reply{}, err
+	}
+	rep, err := readReply(conn)
+	var rejErr *RejectError
+	if d.rejectReason && errors.As(err, &rejErr) {
+		rejErr.Reason = readRejectReason(conn)
+	}
+	return rep, err
+}
+
+// readReply reads a reply of the server, returning a RejectError if the
+// request is not granted.
+func readReply(conn net.Conn) (Reply, error) {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return Reply{}, fmt.Errorf("failed to read SOCKS reply: %v", err)
+	}
+	rep, err := ParseReply(b)
+	if err != nil {
+		return Reply{}, err
+	}
+	if rep.Cd != Granted {
+		return rep, &RejectError{Code: rep.Cd}
+	}
+	return rep, nil
+}
+
+const (
+	// registrations kept waiting by a ReverseListener.
+	reverseBacklog = 4
+	// max wait between attempts to register again.
+	maxReverseBackoff = 30 * time.Second
+)
+
+// Listen publishes a service of the name on a public port of the server,
+// by reverse requests (see WithReverse), 0 to let the server assign the
+// port. The returned listener accepts the connections to the public port.
+// It keeps registrations waiting at the server and registers again when
+// they fail, so the service survives reconnects with a stable port.
+func (d *Dialer) Listen(name string, port int) (*ReverseListener, error) {
+	l := &ReverseListener{
+		d:     d,
+		name:  name,
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	// the first registration validates the request and gets the port.
+	conn, rep, err := l.register(port)
+	if err != nil {
+		return nil, err
+	}
+	l.addr = &net.TCPAddr{IP: rep.IP, Port: rep.Port}
+	if host, _, err := net.SplitHostPort(d.proxyAddress); err == nil && rep.IP.IsUnspecified() {
+		if ip := net.ParseIP(host); ip != nil {
+			l.addr.IP = ip
+		}
+	}
+	go l.run(conn)
+	for i := 1; i < reverseBacklog; i++ {
+		go l.run(nil)
+	}
+	return l, nil
+}
+
+// ReverseListener is a net.Listener accepting the connections to a service
+// published through a SOCKS server by reverse requests.
+type ReverseListener struct {
+	d     *Dialer
+	name  string
+	addr  *net.TCPAddr // public address, the IP of the server if unspecified.
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Accept waits for and returns the next connection to the public port.
+func (l *ReverseListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops registering the service. The server closes the public port
+// after its grace period.
+func (l *ReverseListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns the public address of the service.
+func (l *ReverseListener) Addr() net.Addr {
+	return l.addr
+}
+
+// register sends a reverse request and reads the first reply.
+func (l *ReverseListener) register(port int) (net.Conn, Reply, error) {
+	ctx := context.Background()
+	if l.d.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.d.timeout)
+		defer cancel()
+	}
+	req := Request{
+		Version: Version4,
+		Cmd:     CmdReverse,
+		Address: net.JoinHostPort(l.name, strconv.Itoa(port)),
+		IsV4A:   true,
+		UserId:  l.d.userId,
+	}
+	b, err := req.ToBytes()
+	if err != nil {
+		return nil, Reply{}, err
+	}
+	conn, err := l.d.dialProxy(ctx)
+	if err != nil {
+		return nil, Reply{}, err
+	}
+	rep, err := l.d.handshake(ctx, conn, b)
+	if err != nil {
+		conn.Close()
+		return nil, Reply{}, err
+	}
+	return conn, rep, nil
+}
+
+// run keeps a registration waiting until the listener is closed, starting
+// with conn if not nil.
+func (l *ReverseListener) run(conn net.Conn) {
+	backoff := time.Second
+	for {
+		var err error
+		if conn == nil {
+			conn, _, err = l.register(l.addr.Port)
+		}
+		if err != nil {
+			select {
+			case <-time.After(backoff):
+			case <-l.done:
+				return
+			}
+			if backoff *= 2; backoff > maxReverseBackoff {
+				backoff = maxReverseBackoff
+			}
+			continue
+		}
+		backoff = time.Second
+		if !l.wait(conn) {
+			return
+		}
+		conn = nil
+	}
+}
+
+// wait reads the second reply on a registration and delivers its
+// connection, returning false if the listener is closed.
+func (l *ReverseListener) wait(conn net.Conn) bool {
+	// unblock the read when the listener is closed.
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-l.done:
+			conn.Close()
+		case <-done:
+		}
+	}()
+	_, err := readReply(conn)
+	close(done)
+	if err != nil {
+		conn.Close()
+		select {
+		case <-l.done:
+			return false
+		default:
+			return true
+		}
+	}
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.done:
+		conn.Close()
+		return false
+	}
+}
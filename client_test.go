@@ -0,0 +1,223 @@
+package socks4
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeProxy serves a single connection: it reads a SOCKS 4 request and
+// sends it to requests, then writes reply and closes the connection. The
+// address is returned.
+func fakeProxy(t *testing.T, reply []byte) (string, <-chan []byte) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	requests := make(chan []byte, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var raw bytes.Buffer
+		if _, err := readRequest(io.TeeReader(conn, &raw), 255); err != nil {
+			return
+		}
+		requests <- raw.Bytes()
+		conn.Write(reply)
+	}()
+	return lis.Addr().String(), requests
+}
+
+func TestDialerRequest(t *testing.T) {
+	granted := []byte{0, Granted, 0, 80, 10, 0, 0, 1}
+	for _, tt := range []struct {
+		name    string
+		opts    []DialerOption
+		network string
+		address string
+		request []byte // nil if not sent.
+		err     string
+	}{
+		{name: "IPv4", address: "10.0.0.1:80", request: request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, "")},
+		{name: "user id", opts: []DialerOption{WithDialerUserId("alice")}, address: "10.0.0.1:8080", request: request(CmdConnect, 8080, [4]byte{10, 0, 0, 1}, "alice")},
+		{name: "host name", address: "example.com:443", request: request(CmdConnect, 443, [4]byte{0, 0, 0, 1}, "", "example.com")},
+		{name: "local resolve", opts: []DialerOption{WithLocalResolve()}, address: "localhost:80", request: request(CmdConnect, 80, [4]byte{127, 0, 0, 1}, "")},
+		{name: "UDP", network: "udp", address: "10.0.0.1:53", err: "does not support network udp"},
+		{name: "no port", address: "10.0.0.1", err: "missing port"},
+		{name: "invalid port", address: "10.0.0.1:http", err: "invalid port"},
+		{name: "IPv6", address: "[2001:db8::1]:80", err: "can't request IPv6"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, requests := fakeProxy(t, granted)
+			network := tt.network
+			if network == "" {
+				network = "tcp"
+			}
+			conn, err := NewDialer(addr, append(tt.opts, WithDialerTimeout(5*time.Second))...).Dial(network, tt.address)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if req := <-requests; !bytes.Equal(req, tt.request) {
+				t.Errorf("request %x, want %x", req, tt.request)
+			}
+		})
+	}
+}
+
+func TestDialOptions(t *testing.T) {
+	granted := []byte{0, Granted, 0, 80, 10, 0, 0, 1}
+	for _, tt := range []struct {
+		name    string
+		opts    []DialerOption
+		ctx     func(ctx context.Context) context.Context
+		request []byte
+	}{
+		{name: "none", request: request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, "")},
+		{name: "user id", ctx: func(ctx context.Context) context.Context {
+			return ContextWithDialOptions(ctx, DialOptions{UserId: "alice"})
+		}, request: request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, "alice")},
+		{name: "user id of the dialer", opts: []DialerOption{WithDialerUserId("bob")}, ctx: func(ctx context.Context) context.Context {
+			return ContextWithDialOptions(ctx, DialOptions{UserId: "alice"})
+		}, request: request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, "alice")},
+		{name: "empty user id", opts: []DialerOption{WithDialerUserId("bob")}, ctx: func(ctx context.Context) context.Context {
+			return ContextWithDialOptions(ctx, DialOptions{})
+		}, request: request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, "bob")},
+		{name: "last options", ctx: func(ctx context.Context) context.Context {
+			ctx = ContextWithDialOptions(ctx, DialOptions{UserId: "alice"})
+			return ContextWithDialOptions(ctx, DialOptions{UserId: "carol"})
+		}, request: request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, "carol")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, requests := fakeProxy(t, granted)
+			ctx := context.Background()
+			if tt.ctx != nil {
+				ctx = tt.ctx(ctx)
+			}
+			conn, err := NewDialer(addr, append(tt.opts, WithDialerTimeout(5*time.Second))...).DialContext(ctx, "tcp", "10.0.0.1:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if req := <-requests; !bytes.Equal(req, tt.request) {
+				t.Errorf("request %x, want %x", req, tt.request)
+			}
+		})
+	}
+}
+
+func TestDialerConn(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		reply []byte
+		bound string
+	}{
+		{name: "bound address", reply: []byte{0, Granted, 0x1f, 0x90, 10, 0, 0, 1}, bound: "10.0.0.1:8080"},
+		{name: "no bound address", reply: []byte{0, Granted, 0, 0, 0, 0, 0, 0}, bound: "0.0.0.0:0"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, _ := fakeProxy(t, tt.reply)
+			conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", "10.0.0.1:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			c, ok := conn.(*Conn)
+			if !ok {
+				t.Fatalf("connection %T, want a *Conn", conn)
+			}
+			if rep := c.Reply(); rep.Cd != Granted || c.BoundAddr().String() != tt.bound {
+				t.Errorf("reply %+v bound to %v, want granted and bound to %v", rep, c.BoundAddr(), tt.bound)
+			}
+			if nc, ok := c.NetConn().(*net.TCPConn); !ok || nc.RemoteAddr().String() != addr {
+				t.Errorf("connection to the server %T to %v, want a TCP one to %v", c.NetConn(), c.NetConn().RemoteAddr(), addr)
+			}
+			// the fake proxy closes its connection once replied.
+			if err := c.CloseWrite(); err != nil {
+				t.Errorf("CloseWrite: %v", err)
+			}
+		})
+	}
+
+	client, server := net.Pipe()
+	defer server.Close()
+	if err := (&Conn{Conn: client}).CloseWrite(); err == nil || !strings.Contains(err.Error(), "does not support CloseWrite") {
+		t.Errorf("CloseWrite of a pipe: %v, want not supported", err)
+	}
+}
+
+func TestDialerReply(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		reply []byte
+		code  byte // of the RejectError, 0 if granted.
+		err   string
+	}{
+		{name: "granted", reply: []byte{0, Granted, 0, 80, 10, 0, 0, 1}},
+		{name: "rejected", reply: []byte{0, RejectOrFailure, 0, 0, 0, 0, 0, 0}, code: RejectOrFailure, err: "rejected or failed (code 0x5b)"},
+		{name: "no identd", reply: []byte{0, RejectNoIdentd, 0, 0, 0, 0, 0, 0}, code: RejectNoIdentd, err: "identd"},
+		{name: "wrong user id", reply: []byte{0, RejectWrongUserId, 0, 0, 0, 0, 0, 0}, code: RejectWrongUserId, err: "user id mismatch"},
+		{name: "short reply", reply: []byte{0, Granted, 0}, err: "failed to read SOCKS reply"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, _ := fakeProxy(t, tt.reply)
+			conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", "10.0.0.1:80")
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+			var rej *RejectError
+			if errors.As(err, &rej) != (tt.code != 0) || tt.code != 0 && rej.Code != tt.code {
+				t.Errorf("error %#v, want code %#x", err, tt.code)
+			}
+		})
+	}
+}
+
+func TestDialerThroughServer(t *testing.T) {
+	echo := echoTarget(t)
+	_, addr := serve(t)
+	conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, []byte("hello"))
+	if _, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", closedAddr(t)); err == nil {
+		t.Error("connected to a closed port")
+	}
+}
+
+// closedAddr returns the address of a closed local port.
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	return addr
+}
@@ -0,0 +1,106 @@
+package socks4
+
+import (
+	"net"
+	"time"
+)
+
+// Clock is the source of time of the server: the session times, the
+// waits of the dial retries, the idle and BIND timeouts, the circuit
+// breaker cooldowns and the reverse grace periods. The deadlines of the
+// connections remain those of the system clock. Tests may replace it by a
+// fake one, see socks4test.FakeClock.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+	// AfterFunc calls f in its own goroutine after d.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a timer of a Clock, like time.Timer.
+type Timer interface {
+	C() <-chan time.Time // nil for the timers of AfterFunc.
+	Stop() bool
+}
+
+// Ticker is a ticker of a Clock, like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// WithClock sets the clock of the server, the system clock by default.
+func WithClock(c Clock) OptionFunc {
+	return func(s *Server) {
+		s.clock = c
+	}
+}
+
+// systemClock is the Clock of the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time        { return time.Now() }
+func (systemClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+type systemTimer struct{ t *time.Timer }
+
+func (t systemTimer) C() <-chan time.Time { return t.t.C }
+func (t systemTimer) Stop() bool          { return t.t.Stop() }
+
+type systemTicker struct{ t *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+func (t systemTicker) Stop()               { t.t.Stop() }
+
+// Network creates the connections of the server to the destinations,
+// directly or to the upstream server and SSH egresses, and the listeners
+// of the BIND and reverse requests. Tests may replace it by an in-memory
+// one.
+type Network interface {
+	// Dial connects to the address, failing after timeout if it is not 0.
+	Dial(network, address string, timeout time.Duration) (net.Conn, error)
+	Listen(network, address string) (net.Listener, error)
+}
+
+// WithNetwork sets the network of the server, the system network with the
+// socket options of the server by default.
+func WithNetwork(n Network) OptionFunc {
+	return func(s *Server) {
+		s.network = n
+	}
+}
+
+// systemNetwork is the Network of the net package, marking the
+// connections it dials with the DSCP class if not 0, from the source IP
+// and ports if set.
+type systemNetwork struct {
+	dscp   uint8
+	source net.IP    // nil for any.
+	ports  portRange // unset for any.
+}
+
+func (n systemNetwork) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	if n.dscp != 0 {
+		d.Control = dscpControl(n.dscp)
+	}
+	return n.dialFrom(d, network, address)
+}
+
+func (systemNetwork) Listen(network, address string) (net.Listener, error) {
+	return net.Listen(network, address)
+}
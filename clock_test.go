@@ -0,0 +1,97 @@
+package socks4
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeNetwork dials in-memory connections to echo peers and listens on
+// the loopback interface, recording the addresses.
+type pipeNetwork struct {
+	mu       sync.Mutex
+	dials    []string
+	timeouts []time.Duration
+	listens  []string
+}
+
+func (n *pipeNetwork) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	n.mu.Lock()
+	n.dials = append(n.dials, network+" "+address)
+	n.timeouts = append(n.timeouts, timeout)
+	n.mu.Unlock()
+	conn, peer := net.Pipe()
+	go func() {
+		defer peer.Close()
+		b := make([]byte, 1024)
+		for {
+			m, err := peer.Read(b)
+			if err != nil {
+				return
+			}
+			peer.Write(b[:m])
+		}
+	}()
+	return conn, nil
+}
+
+func (n *pipeNetwork) Listen(network, address string) (net.Listener, error) {
+	n.mu.Lock()
+	n.listens = append(n.listens, network+" "+address)
+	n.mu.Unlock()
+	return net.Listen(network, "127.0.0.1:0")
+}
+
+func TestWithNetwork(t *testing.T) {
+	network := &pipeNetwork{}
+	_, addr := serve(t, WithNetwork(network), WithDialTimeout(3*time.Second))
+	// the address is not routable: the dial is made by the network.
+	conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", "203.0.113.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, []byte("hello"))
+
+	// the listener of a BIND request too.
+	bind, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bind.Close()
+	bind.SetDeadline(time.Now().Add(5 * time.Second))
+	bind.Write(request(CmdBind, 80, [4]byte{127, 0, 0, 1}, ""))
+	reply := make([]byte, 8)
+	if _, err := bind.Read(reply); err != nil || reply[1] != Granted {
+		t.Fatalf("BIND reply %x: %v", reply, err)
+	}
+
+	network.mu.Lock()
+	defer network.mu.Unlock()
+	if len(network.dials) != 1 || network.dials[0] != "tcp 203.0.113.1:80" || network.timeouts[0] != 3*time.Second {
+		t.Errorf("dialed %v with the timeouts %v, want 203.0.113.1:80 with 3s", network.dials, network.timeouts)
+	}
+	if len(network.listens) != 1 || network.listens[0] != "tcp " {
+		t.Errorf("listened on %q, want a BIND listener", network.listens)
+	}
+}
+
+func TestWithClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := &stepClock{now: start}
+	s, addr := serve(t, WithClock(clock))
+	echo := echoTarget(t)
+	conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, []byte("hello"))
+	if st := s.Stats(); !st.StartTime.Equal(start) {
+		t.Errorf("start time %v, want the time of the clock", st.StartTime)
+	}
+	if sessions := s.Sessions(); len(sessions) != 1 || !sessions[0].Start.Equal(start) || !sessions[0].LastActivity.Equal(start) {
+		t.Errorf("sessions %+v, want the times of the clock", sessions)
+	}
+}
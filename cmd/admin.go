@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/cccxg/socks4"
+	"github.com/sirupsen/logrus"
+)
+
+// admin serves the HTTP endpoints for monitoring and debugging the proxy.
+type admin struct {
+	instances []*instance
+	logs      *logHub
+	logger    *logrus.Logger
+	args      []string    // arguments of the configuration, reloaded by the management API.
+	tls       *tls.Config // serves HTTPS and the management API if set.
+	ready     atomic.Bool // the proxy is accepting connections.
+}
+
+func (a *admin) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !a.ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		// drains the load balancers sending traffic to the proxy.
+		if inMaintenance(a.instances) {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		if !probesHealthy(a.instances) {
+			http.Error(w, "probe failed", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	// the instance parameter selects an instance, all of them by default.
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		instances, err := a.selectInstances(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, sumStats(instances))
+	})
+	mux.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		instances, err := a.selectInstances(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, instanceSessions(instances))
+	})
+	// n is the number of destinations, 20 by default.
+	mux.HandleFunc("/destinations", func(w http.ResponseWriter, r *http.Request) {
+		instances, err := a.selectInstances(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		n := 20
+		if v := r.URL.Query().Get("n"); v != "" {
+			if n, err = strconv.Atoi(v); err != nil || n < 0 {
+				http.Error(w, "invalid n", http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, topDestinations(instances, n))
+	})
+	mux.HandleFunc("/state", func(w http.ResponseWriter, r *http.Request) {
+		instances, err := a.selectInstances(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, instanceStates(instances))
+	})
+	// the progress of the instances shutting down, empty before the
+	// shutdown.
+	mux.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
+		instances, err := a.selectInstances(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, shutdownProgress(instances))
+	})
+	mux.HandleFunc("/maintenance", a.handleMaintenance)
+	mux.HandleFunc("/loglevel", a.handleLogLevel)
+	mux.HandleFunc("/metrics", a.handleMetrics)
+	mux.Handle("/dashboard/", dashboardHandler())
+	// the goroutines of the sessions, to find those of a stuck one in the
+	// profiles by their labels.
+	mux.HandleFunc("/debug/sessions", func(w http.ResponseWriter, r *http.Request) {
+		instances, err := a.selectInstances(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		list, err := sessionGoroutines(instances)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, list)
+	})
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// serve serves the admin endpoints on the listener until it is closed.
+// With TLS, the gRPC management API is served on it too.
+func (a *admin) serve(lis net.Listener) {
+	a.logger.Infof("admin server listen on %v", lis.Addr())
+	var err error
+	if a.tls != nil {
+		srv := &http.Server{
+			Handler:   a.grpcHandler(a.handler()),
+			TLSConfig: a.tls,
+			ErrorLog:  log.New(a.logger.WriterLevel(logrus.WarnLevel), "admin server: ", 0),
+		}
+		err = srv.ServeTLS(lis, "", "")
+	} else {
+		err = http.Serve(lis, a.handler())
+	}
+	if err != nil && !isClosedErr(err) {
+		a.logger.Errorf("admin server: %v", err)
+	}
+}
+
+func (a *admin) selectInstances(r *http.Request) ([]*instance, error) {
+	return a.named(r.URL.Query().Get("instance"))
+}
+
+// named returns the instance of the name, all of them if empty.
+func (a *admin) named(name string) ([]*instance, error) {
+	if name == "" {
+		return a.instances, nil
+	}
+	inst, err := findInstance(a.instances, name)
+	if err != nil {
+		return nil, err
+	}
+	return []*instance{inst}, nil
+}
+
+// handleMaintenance returns the maintenance mode of the instances, and on
+// POST switches it: state=on|off, with allow=CIDR,... and close=true when
+// on.
+func (a *admin) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	instances, err := a.selectInstances(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var st maintenanceState
+		switch r.FormValue("state") {
+		case "on":
+			st.Enabled = true
+			if allow := r.FormValue("allow"); allow != "" {
+				st.Allow = strings.Split(allow, ",")
+			}
+			st.Close = r.FormValue("close") == "true"
+		case "off":
+		default:
+			http.Error(w, "state must be on or off", http.StatusBadRequest)
+			return
+		}
+		if err := setMaintenance(instances, st); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, maintenanceStates(instances))
+}
+
+// handleLogLevel returns the log levels, and on POST sets the level=L of
+// the binary, or with subsystem=S the one of the subsystem of the servers,
+// reset to the configured level by an empty level.
+func (a *admin) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := setLogLevel(a.instances, a.logs, r.FormValue("subsystem"), r.FormValue("level")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, a.logs.levels())
+}
+
+// topDestinations returns the n first destinations of the instances, with
+// the counters of the same destinations added up.
+func topDestinations(instances []*instance, n int) []socks4.DestinationStats {
+	index := make(map[string]int)
+	var list []socks4.DestinationStats
+	for _, inst := range instances {
+		for _, d := range inst.srv.TopDestinations(-1) {
+			i, ok := index[d.Destination]
+			if !ok {
+				index[d.Destination] = len(list)
+				list = append(list, d)
+				continue
+			}
+			m := &list[i]
+			m.Sessions += d.Sessions
+			m.ClientToRemoteBytes += d.ClientToRemoteBytes
+			m.RemoteToClientBytes += d.RemoteToClientBytes
+			if d.LastSeen.After(m.LastSeen) {
+				m.LastSeen = d.LastSeen
+			}
+		}
+	}
+	socks4.SortDestinations(list)
+	if n < len(list) {
+		list = list[:n]
+	}
+	return list
+}
+
+// sumStats returns the stats of the instances added up.
+func sumStats(instances []*instance) socks4.Stats {
+	sum := socks4.Stats{Protocols: make(map[string]uint64)}
+	labeled := make(map[string]int) // index in sum.Labeled by label set.
+	for _, inst := range instances {
+		st := inst.srv.Stats()
+		if sum.StartTime.IsZero() || st.StartTime.Before(sum.StartTime) {
+			sum.StartTime = st.StartTime
+		}
+		sum.Accepted += st.Accepted
+		sum.Refused += st.Refused
+		sum.Active += st.Active
+		sum.Handshakes += st.Handshakes
+		sum.Relays += st.Relays
+		sum.Established += st.Established
+		sum.Failed += st.Failed
+		sum.Tarpitted += st.Tarpitted
+		sum.Stalled += st.Stalled
+		sum.PendingBinds += st.PendingBinds
+		sum.AbortedBinds += st.AbortedBinds
+		sum.ClientToRemoteBytes += st.ClientToRemoteBytes
+		sum.RemoteToClientBytes += st.RemoteToClientBytes
+		for p, n := range st.Protocols {
+			sum.Protocols[p] += n
+		}
+		for p, n := range st.Sniffed {
+			if sum.Sniffed == nil {
+				sum.Sniffed = make(map[string]uint64)
+			}
+			sum.Sniffed[p] += n
+		}
+		for r, n := range st.Rejections {
+			if sum.Rejections == nil {
+				sum.Rejections = make(map[string]uint64)
+			}
+			sum.Rejections[r] += n
+		}
+		for id, rs := range st.Rules {
+			if sum.Rules == nil {
+				sum.Rules = make(map[string]socks4.RuleStats)
+			}
+			sum.Rules[id] = socks4.RuleStats{
+				Matches: sum.Rules[id].Matches + rs.Matches,
+				Denied:  sum.Rules[id].Denied + rs.Denied,
+			}
+		}
+		for _, l := range st.Labeled {
+			key := fmt.Sprint(l.Labels) // the keys are sorted.
+			if i, ok := labeled[key]; ok {
+				sum.Labeled[i].Established += l.Established
+				sum.Labeled[i].Failed += l.Failed
+				sum.Labeled[i].ClientToRemoteBytes += l.ClientToRemoteBytes
+				sum.Labeled[i].RemoteToClientBytes += l.RemoteToClientBytes
+				continue
+			}
+			labeled[key] = len(sum.Labeled)
+			sum.Labeled = append(sum.Labeled, l)
+		}
+		// the histograms of instances with other buckets are left out.
+		sum.HandshakeLatency.Add(st.HandshakeLatency)
+		sum.DialLatency.Add(st.DialLatency)
+	}
+	return sum
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func isClosedErr(err error) bool {
+	return errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cccxg/socks4"
+	"github.com/cccxg/socks4/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+// testAdmin returns an admin of the instances of the names, ready unless
+// told otherwise.
+func testAdmin(ready bool, names ...string) *admin {
+	logger := &logrus.Logger{Out: io.Discard, Formatter: &logrus.TextFormatter{}}
+	a := &admin{logger: logger}
+	for _, name := range names {
+		a.instances = append(a.instances, &instance{name: name, srv: socks4.NewServer(socks4.WithLogger(logger))})
+	}
+	a.ready.Store(ready)
+	return a
+}
+
+// get requests the path from the handler and returns the status and body.
+func get(h http.Handler, method, path string) (int, string) {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w.Code, w.Body.String()
+}
+
+func TestAdminHandler(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		admin  *admin
+		path   string
+		status int
+		body   string // in the body.
+	}{
+		{name: "health", admin: testAdmin(false, "a"), path: "/healthz", status: http.StatusOK, body: "ok"},
+		{name: "not ready", admin: testAdmin(false, "a"), path: "/readyz", status: http.StatusServiceUnavailable, body: "not ready"},
+		{name: "ready", admin: testAdmin(true, "a"), path: "/readyz", status: http.StatusOK, body: "ok"},
+		{name: "stats", admin: testAdmin(true, "a", "b"), path: "/stats", status: http.StatusOK, body: `"accepted": 0`},
+		{name: "stats of an instance", admin: testAdmin(true, "a", "b"), path: "/stats?instance=b", status: http.StatusOK, body: `"accepted": 0`},
+		{name: "stats of an unknown instance", admin: testAdmin(true, "a", "b"), path: "/stats?instance=c", status: http.StatusNotFound},
+		{name: "no sessions", admin: testAdmin(true, "a"), path: "/sessions", status: http.StatusOK, body: "null"},
+		{name: "state", admin: testAdmin(true, "a", "b"), path: "/state", status: http.StatusOK, body: `"instance": "b"`},
+		{name: "state of an unknown instance", admin: testAdmin(true, "a", "b"), path: "/state?instance=c", status: http.StatusNotFound},
+		{name: "metrics", admin: testAdmin(true, "a"), path: "/metrics", status: http.StatusOK, body: "# TYPE socks4_connections_accepted_total counter"},
+		{name: "dashboard", admin: testAdmin(true, "a"), path: "/dashboard/", status: http.StatusOK, body: "<title>socks4 dashboard</title>"},
+		{name: "dashboard index", admin: testAdmin(true, "a"), path: "/dashboard/index.html", status: http.StatusMovedPermanently},
+		{name: "dashboard unknown file", admin: testAdmin(true, "a"), path: "/dashboard/app.js", status: http.StatusNotFound},
+		{name: "pprof", admin: testAdmin(true, "a"), path: "/debug/pprof/", status: http.StatusOK, body: "goroutine"},
+		{name: "unknown path", admin: testAdmin(true, "a"), path: "/unknown", status: http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := get(tt.admin.handler(), http.MethodGet, tt.path)
+			if status != tt.status || !strings.Contains(body, tt.body) {
+				t.Errorf("GET %v: %v %q, want %v with %q", tt.path, status, body, tt.status, tt.body)
+			}
+		})
+	}
+}
+
+func TestAdminState(t *testing.T) {
+	for _, tt := range []struct {
+		path      string
+		instances []string
+	}{
+		{"/state", []string{"a", "b"}},
+		{"/state?instance=b", []string{"b"}},
+	} {
+		status, body := get(testAdmin(true, "a", "b").handler(), http.MethodGet, tt.path)
+		var states []instanceState
+		if err := json.Unmarshal([]byte(body), &states); status != http.StatusOK || err != nil {
+			t.Fatalf("GET %v: %v %q: %v", tt.path, status, body, err)
+		}
+		var names []string
+		for _, st := range states {
+			names = append(names, st.Instance)
+			if st.Time.IsZero() || st.Rules.Default != "allow" {
+				t.Errorf("GET %v: state %+v of %v, want the state of its server", tt.path, st.State, st.Instance)
+			}
+		}
+		if !reflect.DeepEqual(names, tt.instances) {
+			t.Errorf("GET %v: states of %v, want %v", tt.path, names, tt.instances)
+		}
+	}
+}
+
+func TestTopDestinations(t *testing.T) {
+	var targets []*testutil.Server
+	for i := 0; i < 2; i++ {
+		target, err := testutil.NewEchoServer("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer target.Close()
+		targets = append(targets, target)
+	}
+	a, addrA := serveInstance(t, "a")
+	b, addrB := serveInstance(t, "b")
+	// 2 sessions to the first target, through each instance, and 1 to
+	// the second.
+	for _, dial := range []struct{ proxy, target string }{
+		{addrA, targets[0].Addr},
+		{addrB, targets[0].Addr},
+		{addrB, targets[1].Addr},
+	} {
+		conn, err := socks4.NewDialer(dial.proxy, socks4.WithDialerTimeout(5*time.Second)).Dial("tcp", dial.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	instances := []*instance{a, b}
+	// the sessions are counted once established, after the reply.
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var sessions float64
+		for _, d := range topDestinations(instances, 20) {
+			sessions += d.Sessions
+		}
+		if sessions > 2.99 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v sessions counted, want 3", sessions)
+		}
+	}
+	for _, tt := range []struct {
+		n        int
+		sessions []float64 // of the targets in order.
+	}{
+		{n: 20, sessions: []float64{2, 1}},
+		{n: 1, sessions: []float64{2}},
+		{n: 0},
+	} {
+		top := topDestinations(instances, tt.n)
+		if len(top) != len(tt.sessions) {
+			t.Errorf("top %v destinations: %+v, want %v", tt.n, top, len(tt.sessions))
+			continue
+		}
+		for i, d := range top {
+			if d.Destination != targets[i].Addr || d.Sessions < tt.sessions[i]*0.99 || d.Sessions > tt.sessions[i] {
+				t.Errorf("top %v destinations: %+v, want %v sessions to %v", tt.n, d, tt.sessions[i], targets[i].Addr)
+			}
+		}
+	}
+
+	adm := testAdmin(true)
+	adm.instances = instances
+	for _, tt := range []struct {
+		path   string
+		status int
+		count  int
+	}{
+		{path: "/destinations", status: http.StatusOK, count: 2},
+		{path: "/destinations?n=1", status: http.StatusOK, count: 1},
+		{path: "/destinations?instance=a", status: http.StatusOK, count: 1},
+		{path: "/destinations?n=-1", status: http.StatusBadRequest},
+		{path: "/destinations?n=all", status: http.StatusBadRequest},
+		{path: "/destinations?instance=c", status: http.StatusNotFound},
+	} {
+		status, body := get(adm.handler(), http.MethodGet, tt.path)
+		if status != tt.status {
+			t.Errorf("GET %v: %v %q, want %v", tt.path, status, body, tt.status)
+			continue
+		}
+		var list []socks4.DestinationStats
+		if status == http.StatusOK && (json.Unmarshal([]byte(body), &list) != nil || len(list) != tt.count) {
+			t.Errorf("GET %v: %q, want %v destinations", tt.path, body, tt.count)
+		}
+	}
+}
+
+func TestAdminShutdown(t *testing.T) {
+	echo, err := testutil.NewEchoServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	a, addr := serveInstance(t, "a")
+	b, _ := serveInstance(t, "b")
+	h := (&admin{logger: logrus.New(), instances: []*instance{a, b}}).handler()
+	if status, body := get(h, http.MethodGet, "/shutdown"); status != http.StatusOK || strings.TrimSpace(body) != "[]" {
+		t.Errorf("GET /shutdown: %v %q before the shutdown, want no progress", status, body)
+	}
+
+	conn, err := socks4.NewDialer(addr, socks4.WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go a.srv.ShutDown()
+	var progress []instanceProgress
+	for deadline := time.Now().Add(5 * time.Second); len(progress) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no shutdown progress")
+		}
+		_, body := get(h, http.MethodGet, "/shutdown")
+		if err := json.Unmarshal([]byte(body), &progress); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(progress) != 1 || progress[0].Instance != "a" || progress[0].Sessions != 1 {
+		t.Errorf("progress %+v, want the session of a", progress)
+	}
+	if status, _ := get(h, http.MethodGet, "/shutdown?instance=c"); status != http.StatusNotFound {
+		t.Errorf("GET /shutdown of an unknown instance: %v", status)
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	a := testAdmin(true, "a")
+	a.logs = &logHub{logger: &logrus.Logger{Out: io.Discard, Formatter: &logrus.TextFormatter{}}}
+	a.logs.setLevel(logrus.InfoLevel)
+	h := a.handler()
+	for _, tt := range []struct {
+		method string
+		path   string
+		status int
+		body   string // in the body.
+	}{
+		{method: http.MethodGet, path: "/loglevel", status: http.StatusOK, body: `"level": "info"`},
+		{method: http.MethodPost, path: "/loglevel?subsystem=relay&level=debug", status: http.StatusOK, body: `"relay": "debug"`},
+		{method: http.MethodPost, path: "/loglevel?level=warning", status: http.StatusOK, body: `"level": "warning"`},
+		{method: http.MethodPost, path: "/loglevel?subsystem=dns&level=debug", status: http.StatusBadRequest, body: "unknown log subsystem"},
+		{method: http.MethodPost, path: "/loglevel?subsystem=relay", status: http.StatusOK, body: `"level": "warning"`},
+		{method: http.MethodPut, path: "/loglevel?level=debug", status: http.StatusMethodNotAllowed},
+	} {
+		status, body := get(h, tt.method, tt.path)
+		if status != tt.status || !strings.Contains(body, tt.body) {
+			t.Errorf("%v %v: status %v with %q, want %v with %q", tt.method, tt.path, status, body, tt.status, tt.body)
+		}
+	}
+	if levels := a.instances[0].srv.LogLevels(); len(levels) != 0 {
+		t.Errorf("levels %v after the reset of the relay", levels)
+	}
+}
+
+func TestAdminRejections(t *testing.T) {
+	rules, err := socks4.ParseRules(strings.NewReader("deny"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, addrA := serveInstance(t, "a", socks4.WithRules(rules))
+	b, addrB := serveInstance(t, "b", socks4.WithRules(rules))
+	for _, addr := range []string{addrA, addrB, addrB} {
+		if _, err := socks4.NewDialer(addr, socks4.WithDialerTimeout(5*time.Second)).Dial("tcp", "127.0.0.1:80"); err == nil {
+			t.Fatal("request allowed, want it denied")
+		}
+	}
+	adm := testAdmin(true)
+	adm.instances = []*instance{a, b}
+	// the rejections are counted once replied.
+	for deadline := time.Now().Add(5 * time.Second); sumStats(adm.instances).Rejections["denied"] != 3; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("rejections %v, want 3 denied", sumStats(adm.instances).Rejections)
+		}
+	}
+	for _, tt := range []struct {
+		path string
+		body string // in the body.
+	}{
+		{path: "/stats", body: `"denied": 3`},
+		{path: "/stats?instance=a", body: `"denied": 1`},
+		{path: "/stats?instance=b", body: `"denied": 2`},
+		{path: "/metrics", body: `socks4_rejections_total{reason="denied",instance="a"} 1` + "\n"},
+		{path: "/metrics", body: `socks4_rejections_total{reason="denied",instance="b"} 2` + "\n"},
+	} {
+		if status, body := get(adm.handler(), http.MethodGet, tt.path); status != http.StatusOK || !strings.Contains(body, tt.body) {
+			t.Errorf("GET %v: %v %q, want %q", tt.path, status, body, tt.body)
+		}
+	}
+}
+
+func TestAdminSessionGoroutines(t *testing.T) {
+	echo, err := testutil.NewEchoServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	a, addrA := serveInstance(t, "a")
+	b, addrB := serveInstance(t, "b")
+	// a session through a, 2 through b.
+	for _, proxy := range []string{addrA, addrB, addrB} {
+		conn, err := socks4.NewDialer(proxy, socks4.WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	adm := testAdmin(true)
+	adm.instances = []*instance{a, b}
+	for _, tt := range []struct {
+		path      string
+		status    int
+		instances string // of the sessions listed in order.
+	}{
+		{path: "/debug/sessions", status: http.StatusOK, instances: "a,b,b"},
+		{path: "/debug/sessions?instance=b", status: http.StatusOK, instances: "b,b"},
+		{path: "/debug/sessions?instance=c", status: http.StatusNotFound},
+	} {
+		status, body := get(adm.handler(), http.MethodGet, tt.path)
+		if status != tt.status {
+			t.Errorf("GET %v: %v %q, want %v", tt.path, status, body, tt.status)
+			continue
+		}
+		if status != http.StatusOK {
+			continue
+		}
+		var list []instanceGoroutines
+		if err := json.Unmarshal([]byte(body), &list); err != nil {
+			t.Fatalf("GET %v: %v in %q", tt.path, err, body)
+		}
+		var instances []string
+		for _, sg := range list {
+			instances = append(instances, sg.Instance)
+			if sg.Goroutines == 0 || sg.Labels[socks4.SessionLabel] != strconv.FormatUint(sg.Session.ID, 10) {
+				t.Errorf("GET %v: goroutines %+v, want those of the session", tt.path, sg)
+			}
+		}
+		if strings.Join(instances, ",") != tt.instances {
+			t.Errorf("GET %v: sessions of %v, want %v", tt.path, instances, tt.instances)
+		}
+	}
+}
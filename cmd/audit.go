@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cccxg/socks4"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// auditConfig is the configuration of the audit log of the sessions.
+type auditConfig struct {
+	SQLite    string        `yaml:"sqlite"`    // path of the SQLite database, disabled if empty.
+	Retention time.Duration `yaml:"retention"` // age of the pruned records, 0 to keep them forever.
+	// Rejections is the number of rejected requests detailed per minute,
+	// see socks4.WithRejectAudit; 0 to disable.
+	Rejections int `yaml:"rejections"`
+}
+
+var (
+	auditMu     sync.Mutex
+	auditStores = make(map[string]*socks4.SQLAuditStore)
+	snapshotDBs = make(map[string]*sql.DB)
+)
+
+// openSQLite opens the SQLite database at path.
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite has a single writer.
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// auditLog returns the audit log of the configuration, nil if disabled.
+// The instances using the same database share its store.
+func (c *auditConfig) auditLog(logger socks4.Logger) (*socks4.AuditLog, error) {
+	if c.SQLite == "" {
+		return nil, nil
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	store, ok := auditStores[c.SQLite]
+	if !ok {
+		db, err := openSQLite(c.SQLite)
+		if err != nil {
+			return nil, err
+		}
+		if store, err = socks4.NewSQLAuditStore(db, "sqlite"); err != nil {
+			db.Close()
+			return nil, err
+		}
+		auditStores[c.SQLite] = store
+	}
+	return socks4.NewAuditLog(store, c.Retention, logger), nil
+}
+
+// persistentStore returns the store of the instance named name, saved
+// every interval to the SQLite database at path. The instances using the
+// same database share it, each with its own counters.
+func persistentStore(path, name string, interval time.Duration, logger socks4.Logger) (*socks4.PersistentStore, error) {
+	if interval == 0 {
+		interval = time.Minute
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	db, ok := snapshotDBs[path]
+	if !ok {
+		var err error
+		if db, err = openSQLite(path); err != nil {
+			return nil, err
+		}
+		snapshotDBs[path] = db
+	}
+	snap, err := socks4.NewSQLStoreSnapshotter(db, "sqlite", name)
+	if err != nil {
+		return nil, fmt.Errorf("store snapshot: %v", err)
+	}
+	store, err := socks4.NewPersistentStore(snap, interval, logger)
+	if err != nil {
+		return nil, fmt.Errorf("store snapshot: %v", err)
+	}
+	return store, nil
+}
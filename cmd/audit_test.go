@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditConfig(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name    string
+		config  auditConfig
+		enabled bool
+		err     bool
+	}{
+		{name: "disabled", config: auditConfig{}},
+		{name: "SQLite", config: auditConfig{SQLite: filepath.Join(dir, "audit.db")}, enabled: true},
+		{name: "directory missing", config: auditConfig{SQLite: filepath.Join(dir, "missing", "audit.db")}, err: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := tt.config.auditLog(nil)
+			if (err != nil) != tt.err || (a != nil) != tt.enabled {
+				t.Fatalf("audit log %v with error %v, want enabled %v", a, err, tt.enabled)
+			}
+			if a != nil {
+				a.Close()
+			}
+		})
+	}
+	// the instances of the same database share its store.
+	path := filepath.Join(dir, "audit.db")
+	auditMu.Lock()
+	store := auditStores[path]
+	auditMu.Unlock()
+	a, err := (&auditConfig{SQLite: path}).auditLog(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Close()
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if store == nil || auditStores[path] != store {
+		t.Errorf("store of %v not shared", path)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cccxg/socks4/testutil"
+)
+
+// benchResult collects the results of the bench workers.
+type benchResult struct {
+	mu        sync.Mutex
+	latencies []time.Duration // handshake latencies of successful dials.
+	errors    map[string]int
+	bytes     int64
+}
+
+func (r *benchResult) add(latency time.Duration, n int64, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bytes += n
+	if err != nil {
+		r.errors[err.Error()]++
+		return
+	}
+	r.latencies = append(r.latencies, latency)
+}
+
+// bench drives concurrent CONNECT requests through the proxy and reports
+// handshake latency, throughput and errors.
+func bench(args []string) int {
+	var cf clientFlags
+	fs := newClientFlagSet("socks4 bench", &cf)
+	target := fs.String("target", "", "target address, a built-in echo sink is used if empty")
+	sinkAddr := fs.String("sink-listen", "127.0.0.1:0", "listen address of the built-in echo sink, which must be reachable by the proxy")
+	concurrency := fs.Int("concurrency", 10, "number of concurrent connections")
+	duration := fs.Duration("duration", 10*time.Second, "duration of the test")
+	size := fs.Int("size", 32*1024, "bytes sent on each connection")
+	echo := fs.Bool("echo", false, "read back the bytes sent, implied with the built-in sink")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	var sink *testutil.Server
+	if *target == "" {
+		var err error
+		if sink, err = testutil.NewEchoServer(*sinkAddr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer sink.Close()
+		*target = sink.Addr
+		*echo = true
+	}
+
+	d, err := cf.dialer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	payload := bytes.Repeat([]byte("socks4"), *size/6+1)[:*size]
+	result := &benchResult{errors: make(map[string]int)}
+	deadline := time.Now().Add(*duration)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, len(payload))
+			for time.Now().Before(deadline) {
+				t := time.Now()
+				conn, err := d.Dial("tcp", *target)
+				if err != nil {
+					result.add(0, 0, err)
+					continue
+				}
+				latency := time.Since(t)
+				n, err := conn.Write(payload)
+				total := int64(n)
+				if err == nil && *echo {
+					n, err = io.ReadFull(conn, buf)
+					total += int64(n)
+				}
+				conn.Close()
+				result.add(latency, total, err)
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	printBenchResult(os.Stdout, result, elapsed)
+	if sink != nil {
+		// the bytes lost by the relay show up as a difference with the
+		// bytes sent.
+		fmt.Fprintf(os.Stdout, "sink:        %v connections, %v bytes received, %v sent back\n",
+			sink.Accepted(), sink.Received(), sink.Sent())
+	}
+	if len(result.latencies) == 0 {
+		return 1
+	}
+	return 0
+}
+
+func printBenchResult(w io.Writer, r *benchResult, elapsed time.Duration) {
+	var failed int
+	for _, n := range r.errors {
+		failed += n
+	}
+	ok := len(r.latencies)
+	total := ok + failed
+	fmt.Fprintf(w, "connections: %v in %v (%.1f/s)\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds())
+	if total > 0 {
+		fmt.Fprintf(w, "errors:      %v (%.2f%%)\n", failed, float64(failed)*100/float64(total))
+	}
+	fmt.Fprintf(w, "throughput:  %.2f MiB/s\n", float64(r.bytes)/(1<<20)/elapsed.Seconds())
+
+	if ok > 0 {
+		sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+		pct := func(p float64) time.Duration {
+			return r.latencies[int(float64(ok-1)*p)]
+		}
+		fmt.Fprintf(w, "handshake:   p50 %v, p90 %v, p99 %v, max %v\n",
+			pct(0.5), pct(0.9), pct(0.99), r.latencies[ok-1])
+	}
+	for msg, n := range r.errors {
+		fmt.Fprintf(w, "  %v x %v\n", n, msg)
+	}
+}
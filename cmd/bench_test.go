@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cccxg/socks4"
+	"github.com/sirupsen/logrus"
+)
+
+func TestPrintBenchResult(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		adds  func(r *benchResult)
+		lines []string
+	}{
+		{
+			name:  "no connections",
+			adds:  func(r *benchResult) {},
+			lines: []string{"connections: 0 in 2s (0.0/s)", "throughput:  0.00 MiB/s"},
+		},
+		{
+			name: "successes",
+			adds: func(r *benchResult) {
+				for i := 1; i <= 10; i++ {
+					r.add(time.Duration(i)*time.Millisecond, 1<<20, nil)
+				}
+			},
+			lines: []string{"connections: 10 in 2s (5.0/s)", "errors:      0 (0.00%)", "throughput:  5.00 MiB/s", "handshake:   p50 5ms, p90 9ms, p99 9ms, max 10ms"},
+		},
+		{
+			name: "errors",
+			adds: func(r *benchResult) {
+				r.add(time.Millisecond, 0, nil)
+				r.add(0, 0, errors.New("connection refused"))
+				r.add(0, 0, errors.New("connection refused"))
+				r.add(time.Millisecond, 100, errors.New("reset"))
+			},
+			lines: []string{"connections: 4 in 2s (2.0/s)", "errors:      3 (75.00%)", "  2 x connection refused", "  1 x reset"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &benchResult{errors: make(map[string]int)}
+			tt.adds(r)
+			var b bytes.Buffer
+			printBenchResult(&b, r, 2*time.Second)
+			for _, line := range tt.lines {
+				if !strings.Contains(b.String(), line+"\n") {
+					t.Errorf("no line %q in:\n%s", line, b.String())
+				}
+			}
+		})
+	}
+}
+
+func TestBench(t *testing.T) {
+	logger := &logrus.Logger{Out: io.Discard, Formatter: &logrus.TextFormatter{}}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := socks4.NewServer(socks4.WithLogger(logger))
+	go srv.Serve(lis)
+	defer srv.Close()
+	// the report is not checked, only the exit code.
+	stdout := os.Stdout
+	os.Stdout, _ = os.Open(os.DevNull)
+	defer func() { os.Stdout = stdout }()
+	for _, tt := range []struct {
+		name string
+		args []string
+		code int
+	}{
+		{name: "built-in sink", args: []string{"-proxy", lis.Addr().String(), "-concurrency", "2", "-duration", "200ms", "-size", "1024"}},
+		{name: "unreachable proxy", args: []string{"-proxy", "127.0.0.1:1", "-concurrency", "1", "-duration", "100ms"}, code: 1},
+		{name: "invalid flag", args: []string{"-concurrency", "many"}, code: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := bench(tt.args); code != tt.code {
+				t.Errorf("exit code %v, want %v", code, tt.code)
+			}
+		})
+	}
+}
+
+func TestBenchSinkReport(t *testing.T) {
+	logger := &logrus.Logger{Out: io.Discard, Formatter: &logrus.TextFormatter{}}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := socks4.NewServer(socks4.WithLogger(logger))
+	go srv.Serve(lis)
+	defer srv.Close()
+	var code int
+	out := captureStdout(t, func() {
+		code = bench([]string{"-proxy", lis.Addr().String(), "-concurrency", "1", "-duration", "100ms", "-size", "1024"})
+	})
+	if code != 0 {
+		t.Fatalf("exit code %v", code)
+	}
+	// the built-in sink echoes back the bytes it receives.
+	m := regexp.MustCompile(`(?m)^sink: +(\d+) connections, (\d+) bytes received, (\d+) sent back$`).FindStringSubmatch(out)
+	if m == nil || m[1] == "0" || m[2] == "0" || m[3] == "0" {
+		t.Errorf("sink report of %q, want the connections and bytes echoed", out)
+	}
+}
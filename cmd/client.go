@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cccxg/socks4"
+)
+
+// clientFlags are the flags shared by the client subcommands.
+type clientFlags struct {
+	proxy        string
+	userId       string
+	timeout      time.Duration
+	localResolve bool
+	tls          bool
+	tlsCA        string
+	tlsCert      string
+	tlsKey       string
+	websocket    string
+	obfsKey      string
+	compress     bool
+}
+
+func newClientFlagSet(name string, cf *clientFlags) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.StringVar(&cf.proxy, "proxy", "127.0.0.1:1080", "address of the SOCKS server, or comma separated addresses tried in turn when they fail")
+	fs.StringVar(&cf.userId, "user", "", "user id sent in the request")
+	fs.DurationVar(&cf.timeout, "timeout", 30*time.Second, "timeout of connecting through the proxy")
+	fs.BoolVar(&cf.localResolve, "local-resolve", false, "resolve domain names locally instead of using SOCKS 4A")
+	fs.BoolVar(&cf.tls, "tls", false, "connect to the SOCKS server over TLS")
+	fs.StringVar(&cf.tlsCA, "tls-ca", "", "path of the CA certificates verifying the server, the system ones if empty")
+	fs.StringVar(&cf.tlsCert, "tls-cert", "", "path of the TLS client certificate")
+	fs.StringVar(&cf.tlsKey, "tls-key", "", "path of the TLS client private key")
+	fs.StringVar(&cf.websocket, "websocket", "", "connect to the SOCKS server by this ws:// or wss:// URL instead of -proxy")
+	fs.BoolVar(&cf.compress, "compress", false, "compress the connections to the SOCKS server, which must accept it")
+	fs.StringVar(&cf.obfsKey, "obfs-key", "", "obfuscate the connections to the SOCKS server with this key, shared with the server")
+	return fs
+}
+
+func (cf *clientFlags) dialer() (*socks4.Dialer, error) {
+	opts := []socks4.DialerOption{
+		socks4.WithDialerUserId(cf.userId),
+		socks4.WithDialerTimeout(cf.timeout),
+	}
+	if cf.localResolve {
+		opts = append(opts, socks4.WithLocalResolve())
+	}
+	if cf.websocket != "" {
+		opts = append(opts, socks4.WithDialerWebSocket(cf.websocket))
+	}
+	if cf.compress {
+		opts = append(opts, socks4.WithDialerCompression())
+	}
+	if cf.obfsKey != "" {
+		opts = append(opts, socks4.WithDialerTransportLayer(socks4.ObfsTransport([]byte(cf.obfsKey))))
+	}
+	if cf.tls || cf.tlsCA != "" || cf.tlsCert != "" {
+		config := &tls.Config{MinVersion: tls.VersionTLS12}
+		if cf.tlsCA != "" {
+			pool, err := loadCertPool(cf.tlsCA)
+			if err != nil {
+				return nil, err
+			}
+			config.RootCAs = pool
+		}
+		if cf.tlsCert != "" {
+			cert, err := tls.LoadX509KeyPair(cf.tlsCert, cf.tlsKey)
+			if err != nil {
+				return nil, err
+			}
+			config.Certificates = []tls.Certificate{cert}
+		}
+		opts = append(opts, socks4.WithDialerTLS(config))
+	}
+	proxies := strings.Split(cf.proxy, ",")
+	if len(proxies) > 1 {
+		opts = append(opts, socks4.WithDialerFailover(proxies[1:]...))
+	}
+	return socks4.NewDialer(proxies[0], opts...), nil
+}
+
+// connect pipes stdin and stdout to the target through the proxy, like
+// netcat.
+func connect(args []string) int {
+	var cf clientFlags
+	fs := newClientFlagSet("socks4 connect", &cf)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: socks4 connect [flags] host:port")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	d, err := cf.dialer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	conn, err := d.Dial("tcp", fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		io.Copy(os.Stdout, conn)
+		close(done)
+	}()
+	io.Copy(conn, os.Stdin)
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	<-done
+	return 0
+}
+
+// fetch does an HTTP GET through the proxy and writes the response body to
+// stdout.
+func fetch(args []string) int {
+	var cf clientFlags
+	fs := newClientFlagSet("socks4 fetch", &cf)
+	verbose := fs.Bool("v", false, "print the response status and headers to stderr")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: socks4 fetch [flags] URL")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	d, err := cf.dialer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	resp, err := client.Get(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	if *verbose {
+		fmt.Fprintln(os.Stderr, resp.Proto, resp.Status)
+		resp.Header.Write(os.Stderr)
+	}
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if resp.StatusCode >= 400 {
+		return 1
+	}
+	return 0
+}
+
+// expose publishes a local service on a public port of the proxy by
+// reverse requests, forwarding the connections to the port to the local
+// address.
+func expose(args []string) int {
+	var cf clientFlags
+	fs := newClientFlagSet("socks4 expose", &cf)
+	name := fs.String("name", "", "name of the service, which keeps its public port across reconnects")
+	port := fs.Int("port", 0, "public port, assigned by the proxy if 0")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: socks4 expose [flags] -name NAME host:port")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 || *name == "" {
+		fs.Usage()
+		return 2
+	}
+
+	d, err := cf.dialer()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	lis, err := d.Listen(*name, *port)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer lis.Close()
+	fmt.Fprintf(os.Stderr, "%v published on %v\n", fs.Arg(0), lis.Addr())
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		go func() {
+			defer conn.Close()
+			local, err := net.DialTimeout("tcp", fs.Arg(0), cf.timeout)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return
+			}
+			defer local.Close()
+			// the connections are closed when either side is done.
+			done := make(chan struct{}, 2)
+			go func() {
+				io.Copy(local, conn)
+				done <- struct{}{}
+			}()
+			go func() {
+				io.Copy(conn, local)
+				done <- struct{}{}
+			}()
+			<-done
+		}()
+	}
+}
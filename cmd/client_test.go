@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cccxg/socks4"
+	"github.com/cccxg/socks4/testutil"
+)
+
+func TestClientDialerProxies(t *testing.T) {
+	for _, tt := range []struct {
+		proxy   string
+		proxies []string
+	}{
+		{proxy: "127.0.0.1:1080", proxies: []string{"127.0.0.1:1080"}},
+		{proxy: "10.0.0.1:1080,10.0.0.2:1080", proxies: []string{"10.0.0.1:1080", "10.0.0.2:1080"}},
+		{proxy: "a:1080,b:1080,c:1081", proxies: []string{"a:1080", "b:1080", "c:1081"}},
+	} {
+		var cf clientFlags
+		if err := newClientFlagSet("connect", &cf).Parse([]string{"-proxy", tt.proxy}); err != nil {
+			t.Fatal(err)
+		}
+		d, err := cf.dialer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var proxies []string
+		for _, h := range d.ProxyHealth() {
+			proxies = append(proxies, h.Address)
+		}
+		if !reflect.DeepEqual(proxies, tt.proxies) {
+			t.Errorf("-proxy %v: proxies %v, want %v", tt.proxy, proxies, tt.proxies)
+		}
+	}
+}
+
+func TestClientDialerObfuscation(t *testing.T) {
+	echo, err := testutil.NewEchoServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := socks4.NewServer(socks4.WithHandshakeTimeout(time.Second))
+	go srv.Serve(socks4.TransportListener(lis, socks4.ObfsTransport([]byte("secret"))))
+	defer srv.Close()
+	for _, tt := range []struct {
+		args []string
+		ok   bool
+	}{
+		{args: []string{"-obfs-key", "secret"}, ok: true},
+		{args: []string{"-obfs-key", "other"}},
+		{},
+	} {
+		var cf clientFlags
+		if err := newClientFlagSet("connect", &cf).Parse(append([]string{"-proxy", lis.Addr().String(), "-timeout", "5s"}, tt.args...)); err != nil {
+			t.Fatal(err)
+		}
+		d, err := cf.dialer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := d.Dial("tcp", echo.Addr)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: error %v, want dialed %v", tt.args, err, tt.ok)
+		}
+		if err == nil {
+			conn.Close()
+		}
+	}
+}
+
+func TestClientDialerCompression(t *testing.T) {
+	echo, err := testutil.NewEchoServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	_, compressing := serveInstance(t, "a", socks4.WithCompression())
+	_, plain := serveInstance(t, "b")
+	for _, tt := range []struct {
+		proxy string
+		args  []string
+		ok    bool
+	}{
+		{proxy: compressing, args: []string{"-compress"}, ok: true},
+		{proxy: compressing, ok: true},
+		{proxy: plain, args: []string{"-compress"}},
+	} {
+		var cf clientFlags
+		if err := newClientFlagSet("connect", &cf).Parse(append([]string{"-proxy", tt.proxy, "-timeout", "5s"}, tt.args...)); err != nil {
+			t.Fatal(err)
+		}
+		d, err := cf.dialer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := d.Dial("tcp", echo.Addr)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v through %v: error %v, want dialed %v", tt.args, tt.proxy, err, tt.ok)
+		}
+		if err == nil {
+			conn.Close()
+		}
+	}
+}
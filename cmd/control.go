@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// controlRequest is a command sent to the control socket as a JSON line.
+type controlRequest struct {
+	Command  string `json:"command"`
+	Instance string `json:"instance,omitempty"`
+	ID       uint64 `json:"id,omitempty"`
+	Level    string `json:"level,omitempty"`
+
+	Maintenance *maintenanceState `json:"maintenance,omitempty"` // state to switch to, nil to query it.
+}
+
+// controlResponse is the JSON reply of the control socket to a command.
+type controlResponse struct {
+	Error       string             `json:"error,omitempty"`
+	Sessions    []sessionInfo      `json:"sessions,omitempty"`
+	Maintenance []maintenanceState `json:"maintenance,omitempty"`
+}
+
+// control serves the control socket, which lets an operator inspect and
+// manage the running server.
+type control struct {
+	instances []*instance
+	logs      *logHub
+	logger    *logrus.Logger
+}
+
+// listenControl listens on the unix socket path, replacing a stale socket
+// file left by a previous run.
+func listenControl(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("control socket %v is in use", path)
+		}
+		os.Remove(path)
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	return lis, nil
+}
+
+func (c *control) serve(lis net.Listener) {
+	c.logger.Infof("control socket listen on %v", lis.Addr())
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				c.logger.Errorf("control socket: %v", err)
+			}
+			return
+		}
+		go c.handle(conn)
+	}
+}
+
+func (c *control) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var req controlRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(controlResponse{Error: err.Error()})
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var resp controlResponse
+	switch req.Command {
+	case "tail":
+		c.tail(conn, req.Level)
+		return
+	case "sessions":
+		instances := c.instances
+		if req.Instance != "" {
+			inst, err := findInstance(c.instances, req.Instance)
+			if err != nil {
+				resp.Error = err.Error()
+				break
+			}
+			instances = []*instance{inst}
+		}
+		resp.Sessions = instanceSessions(instances)
+	case "kill":
+		// the session IDs are unique within an instance.
+		inst, err := findInstance(c.instances, req.Instance)
+		if err != nil {
+			resp.Error = err.Error()
+		} else if !inst.srv.KillSession(req.ID) {
+			resp.Error = fmt.Sprintf("session %v not found", req.ID)
+		}
+	case "maintenance":
+		// all the instances by default.
+		instances := c.instances
+		if req.Instance != "" {
+			inst, err := findInstance(c.instances, req.Instance)
+			if err != nil {
+				resp.Error = err.Error()
+				break
+			}
+			instances = []*instance{inst}
+		}
+		if req.Maintenance != nil {
+			if err := setMaintenance(instances, *req.Maintenance); err != nil {
+				resp.Error = err.Error()
+				break
+			}
+		}
+		resp.Maintenance = maintenanceStates(instances)
+	default:
+		resp.Error = fmt.Sprintf("unknown command %q", req.Command)
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// controlCall sends the request to the control socket and returns the
+// response.
+func controlCall(path string, req controlRequest) (*controlResponse, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	var resp controlResponse
+	if err := json.NewDecoder(bufio.NewReader(conn)).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
+
+func newControlFlagSet(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	path := fs.String("control", os.Getenv("SOCKS4_CONTROL"), "path of the control socket of the server")
+	return fs, path
+}
+
+// sessions lists the sessions of a running server.
+func sessions(args []string) int {
+	fs, path := newControlFlagSet("socks4 sessions")
+	asJSON := fs.Bool("json", false, "print the sessions as JSON")
+	inst := fs.String("instance", "", "list the sessions of this instance only")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	resp, err := controlCall(*path, controlRequest{Command: "sessions", Instance: *inst})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(resp.Sessions)
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tID\tCLIENT\tCMD\tTARGET\tUSER\tAGE\tIDLE\tSENT\tRECEIVED")
+	now := time.Now()
+	for _, ss := range resp.Sessions {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", ss.Instance, ss.ID, ss.Client, ss.Cmd, ss.Target, ss.UserId,
+			now.Sub(ss.Start).Round(time.Second), now.Sub(ss.LastActivity).Round(time.Second),
+			ss.ClientToRemote, ss.RemoteToClient)
+	}
+	w.Flush()
+	return 0
+}
+
+// kill terminates sessions of a running server by ID.
+func kill(args []string) int {
+	fs, path := newControlFlagSet("socks4 kill")
+	inst := fs.String("instance", "", "instance of the sessions, required with several instances")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: socks4 kill [flags] id...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	code := 0
+	for _, arg := range fs.Args() {
+		id, err := strconv.ParseUint(arg, 10, 64)
+		if err == nil {
+			_, err = controlCall(*path, controlRequest{Command: "kill", Instance: *inst, ID: id})
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "kill %v: %v\n", arg, err)
+			code = 1
+		}
+	}
+	return code
+}
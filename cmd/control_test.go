@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cccxg/socks4"
+	"github.com/cccxg/socks4/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+// serveControl serves the control socket in a temporary directory and
+// returns its path.
+func serveControl(t *testing.T, c *control) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "control.sock")
+	lis, err := listenControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	if c.logger == nil {
+		c.logger = &logrus.Logger{Out: io.Discard, Formatter: &logrus.TextFormatter{}}
+	}
+	go c.serve(lis)
+	return path
+}
+
+// serveInstance serves an instance of the name on 127.0.0.1:0 and returns
+// it with its address.
+func serveInstance(t *testing.T, name string, opts ...socks4.OptionFunc) (*instance, string) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := &logrus.Logger{Out: io.Discard, Formatter: &logrus.TextFormatter{}}
+	srv := socks4.NewServer(append([]socks4.OptionFunc{socks4.WithLogger(logger)}, opts...)...)
+	go srv.Serve(lis)
+	t.Cleanup(func() { srv.Close() })
+	return &instance{name: name, srv: srv}, lis.Addr().String()
+}
+
+func TestControl(t *testing.T) {
+	echo, err := testutil.NewEchoServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	a, addr := serveInstance(t, "a")
+	b, _ := serveInstance(t, "b")
+	path := serveControl(t, &control{instances: []*instance{a, b}})
+	conn, err := socks4.NewDialer(addr, socks4.WithDialerUserId("alice")).Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	resp, err := controlCall(path, controlRequest{Command: "sessions"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Sessions) != 1 || resp.Sessions[0].Instance != "a" || resp.Sessions[0].UserId != "alice" {
+		t.Fatalf("sessions %+v, want the session of alice on a", resp.Sessions)
+	}
+	id := resp.Sessions[0].ID
+	for _, tt := range []struct {
+		name     string
+		req      controlRequest
+		sessions int
+		err      string
+	}{
+		{name: "sessions of an instance", req: controlRequest{Command: "sessions", Instance: "b"}},
+		{name: "sessions of an unknown instance", req: controlRequest{Command: "sessions", Instance: "c"}, err: "c"},
+		{name: "kill without instance", req: controlRequest{Command: "kill", ID: id}, err: "an instance is required"},
+		{name: "kill in another instance", req: controlRequest{Command: "kill", Instance: "b", ID: id}, err: "not found"},
+		{name: "unknown command", req: controlRequest{Command: "restart"}, err: `unknown command "restart"`},
+		{name: "kill", req: controlRequest{Command: "kill", Instance: "a", ID: id}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := controlCall(path, tt.req)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Sessions) != tt.sessions {
+				t.Errorf("sessions %+v, want %v", resp.Sessions, tt.sessions)
+			}
+		})
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("killed session not closed")
+	}
+}
+
+func TestListenControl(t *testing.T) {
+	dir := t.TempDir()
+	// a stale socket file is replaced.
+	stale := filepath.Join(dir, "stale.sock")
+	lis, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis.(*net.UnixListener).SetUnlinkOnClose(false)
+	lis.Close()
+	if lis, err = listenControl(stale); err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	defer lis.Close()
+	if fi, err := os.Stat(stale); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode %v: %v, want 0600", fi.Mode().Perm(), err)
+	}
+	// the socket of a running server is not.
+	if _, err := listenControl(stale); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("error %v, want the socket in use", err)
+	}
+}
@@ -0,0 +1,18 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// dashboardFiles are the static files of the dashboard, which polls the
+// stats, sessions and destinations endpoints of the admin server.
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+func dashboardHandler() http.Handler {
+	sub, _ := fs.Sub(dashboardFiles, "dashboard")
+	return http.StripPrefix("/dashboard/", http.FileServer(http.FS(sub)))
+}
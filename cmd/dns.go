@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/cccxg/socks4"
+)
+
+// resolverConfig resolves the domain names of the requests with the
+// resolvers of the split routes matching them, or else with its DNS
+// server, the system resolver if none.
+type resolverConfig struct {
+	dnsServerConfig `yaml:",inline"`
+	Split           []splitRouteConfig `yaml:"split"`
+}
+
+// dnsServerConfig is a DNS-over-HTTPS, DNS-over-TLS or plain DNS server,
+// the system resolver if none.
+type dnsServerConfig struct {
+	DoH       string        `yaml:"doh"`       // URL like https://cloudflare-dns.com/dns-query.
+	DoT       string        `yaml:"dot"`       // address like dns.google:853.
+	DNS       string        `yaml:"dns"`       // address like 10.0.0.2:53.
+	Bootstrap []string      `yaml:"bootstrap"` // IPs of the DoH or DoT server.
+	Timeout   time.Duration `yaml:"timeout"`
+	Fallback  bool          `yaml:"fallback"` // to the system resolver when the server fails.
+}
+
+// splitRouteConfig resolves the names matching one of its patterns, names
+// or "*.domain" matching their subdomains, with its DNS server.
+type splitRouteConfig struct {
+	Match           []string `yaml:"match"`
+	dnsServerConfig `yaml:",inline"`
+}
+
+func (c *resolverConfig) validate() error {
+	if err := c.dnsServerConfig.validate(); err != nil {
+		return err
+	}
+	for i, route := range c.Split {
+		if len(route.Match) == 0 {
+			return fmt.Errorf("split route %v: no match", i)
+		}
+		if err := route.validate(); err != nil {
+			return fmt.Errorf("split route %v: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (c *dnsServerConfig) validate() error {
+	set := 0
+	for _, s := range []string{c.DoH, c.DoT, c.DNS} {
+		if s != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return errors.New("more than one of doh, dot and dns are set")
+	}
+	for _, ip := range c.Bootstrap {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid bootstrap IP %q", ip)
+		}
+	}
+	_, err := c.resolver()
+	return err
+}
+
+// resolver returns the resolver of the configuration, nil for the system
+// one.
+func (c *resolverConfig) resolver() (socks4.Resolver, error) {
+	def, err := c.dnsServerConfig.resolver()
+	if err != nil || len(c.Split) == 0 {
+		return def, err
+	}
+	split := socks4.NewSplitResolver(def)
+	for _, route := range c.Split {
+		r, err := route.resolver()
+		if err != nil {
+			return nil, err
+		}
+		// the patterns of a route share its resolver and cache.
+		for _, pattern := range route.Match {
+			split.Route(pattern, r)
+		}
+	}
+	return split, nil
+}
+
+// resolver returns the resolver of the server, nil for the system one.
+func (c *dnsServerConfig) resolver() (socks4.Resolver, error) {
+	opts := socks4.DNSOptions{Bootstrap: c.Bootstrap, Timeout: c.Timeout, Fallback: c.Fallback}
+	switch {
+	case c.DoH != "":
+		return socks4.NewDoHResolver(c.DoH, opts)
+	case c.DoT != "":
+		return socks4.NewDoTResolver(c.DoT, opts)
+	case c.DNS != "":
+		return socks4.NewDNSResolver(c.DNS, opts)
+	}
+	return nil, nil
+}
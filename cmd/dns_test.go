@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDNSServerConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		c        dnsServerConfig
+		resolver string // type of the resolver, none if empty.
+		err      string // in the error, valid if empty.
+	}{
+		{name: "system"},
+		{name: "DoH", c: dnsServerConfig{DoH: "https://cloudflare-dns.com/dns-query", Bootstrap: []string{"1.1.1.1"}, Timeout: time.Second}, resolver: "*socks4.DoHResolver"},
+		{name: "DoT", c: dnsServerConfig{DoT: "dns.google:853", Bootstrap: []string{"8.8.8.8", "2001:4860:4860::8888"}, Fallback: true}, resolver: "*socks4.DoTResolver"},
+		{name: "DNS", c: dnsServerConfig{DNS: "10.0.0.2:53"}, resolver: "*socks4.DNSResolver"},
+		{name: "DNS without port", c: dnsServerConfig{DNS: "10.0.0.2"}, err: "invalid DNS address"},
+		{name: "DoT and DNS", c: dnsServerConfig{DoT: "dns.google:853", DNS: "10.0.0.2:53"}, err: "more than one"},
+		{name: "DoH and DoT", c: dnsServerConfig{DoH: "https://cloudflare-dns.com/dns-query", DoT: "dns.google:853"}, err: "more than one"},
+		{name: "invalid bootstrap IP", c: dnsServerConfig{DoT: "dns.google:853", Bootstrap: []string{"dns.google"}}, err: "invalid bootstrap IP"},
+		{name: "DoH over HTTP", c: dnsServerConfig{DoH: "http://cloudflare-dns.com/dns-query"}, err: "not https"},
+		{name: "DoT without port", c: dnsServerConfig{DoT: "dns.google"}, err: "invalid DoT address"},
+	} {
+		err := tt.c.validate()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%v: error %v, want %q", tt.name, err, tt.err)
+			continue
+		}
+		if tt.err != "" {
+			continue
+		}
+		r, err := tt.c.resolver()
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+		}
+		if typ := fmt.Sprintf("%T", r); r != nil && typ != tt.resolver || r == nil && tt.resolver != "" {
+			t.Errorf("%v: resolver %v, want %v", tt.name, typ, tt.resolver)
+		}
+	}
+}
+
+func TestResolverConfigSplit(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		c        resolverConfig
+		resolver string // type of the resolver, none if empty.
+		err      string // in the error, valid if empty.
+	}{
+		{name: "split with DoH by default", c: resolverConfig{
+			dnsServerConfig: dnsServerConfig{DoH: "https://cloudflare-dns.com/dns-query"},
+			Split:           []splitRouteConfig{{Match: []string{"*.corp.example", "intranet"}, dnsServerConfig: dnsServerConfig{DNS: "10.0.0.2:53"}}},
+		}, resolver: "*socks4.SplitResolver"},
+		{name: "split with the system resolver by default", c: resolverConfig{
+			Split: []splitRouteConfig{{Match: []string{"*.corp.example"}, dnsServerConfig: dnsServerConfig{DNS: "10.0.0.2:53"}}},
+		}, resolver: "*socks4.SplitResolver"},
+		{name: "split route without match", c: resolverConfig{
+			Split: []splitRouteConfig{{dnsServerConfig: dnsServerConfig{DNS: "10.0.0.2:53"}}},
+		}, err: "split route 0: no match"},
+		{name: "invalid split route", c: resolverConfig{
+			Split: []splitRouteConfig{{Match: []string{"*.corp.example"}, dnsServerConfig: dnsServerConfig{DNS: "10.0.0.2"}}},
+		}, err: "split route 0: invalid DNS address"},
+	} {
+		err := tt.c.validate()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%v: error %v, want %q", tt.name, err, tt.err)
+			continue
+		}
+		if tt.err != "" {
+			continue
+		}
+		r, err := tt.c.resolver()
+		if typ := fmt.Sprintf("%T", r); err != nil || typ != tt.resolver {
+			t.Errorf("%v: resolver %v with error %v, want %v", tt.name, typ, err, tt.resolver)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/cccxg/socks4"
+	"github.com/sirupsen/logrus"
+)
+
+// instance is a proxy server of the process with its listeners. The
+// instances share the logs, the admin server and the control socket.
+type instance struct {
+	name        string // empty for the single instance of a plain configuration.
+	srv         *socks4.Server
+	listeners   []net.Listener
+	transparent bool        // serves connections intercepted by the firewall.
+	wsPath      string      // path of the WebSocket endpoint, "" for plain TCP.
+	notifiers   []io.Closer // notifiers of the session events, closed after the shutdown.
+	store       io.Closer   // store saving its counters when closed after the shutdown, nil if none.
+
+	labels         map[string]string            // labels of the sessions of all listeners.
+	listenerLabels map[string]map[string]string // labels of the sessions by listen address.
+
+	rules socks4.RuleSource // backend watched for the rules, nil if none.
+	layer socks4.Transport  // wraps the connections of the listeners, nil if none.
+	probe *prober           // synthetic CONNECT requests to the first listener, nil if none.
+}
+
+// newInstance creates the server of the instance configuration. The
+// listeners are created by listen.
+func newInstance(cfg *instanceConfig, logs *logHub, acm *acmeManager) (*instance, error) {
+	var logger socks4.Logger = logs.logger
+	if cfg.Name != "" || len(cfg.Labels) > 0 {
+		fields := logrus.Fields{}
+		for k, v := range cfg.Labels {
+			fields[k] = v
+		}
+		if cfg.Name != "" {
+			fields["instance"] = cfg.Name
+		}
+		logger = logs.logger.WithFields(fields)
+	}
+	opts, err := serverOptions(&cfg.proxyConfig, logger, acm)
+	if err != nil {
+		return nil, err
+	}
+	opts = append(opts, logs.sampling...)
+	store, err := cfg.Store.store(cfg.Name, logger)
+	if err != nil {
+		return nil, err
+	}
+	if store != nil {
+		opts = append(opts, socks4.WithStore(store))
+	}
+	notifiers, err := cfg.notifiers(logger)
+	if err != nil {
+		return nil, err
+	}
+	closers := make([]io.Closer, len(notifiers))
+	for i, n := range notifiers {
+		opts = append(opts, socks4.WithEventNotifier(n))
+		closers[i] = n
+	}
+	inst := &instance{
+		name:        cfg.Name,
+		srv:         socks4.NewServer(opts...),
+		transparent: cfg.Transparent != "",
+		wsPath:      cfg.WebSocket,
+		notifiers:   closers,
+
+		labels:         cfg.Labels,
+		listenerLabels: cfg.ListenerLabels,
+	}
+	if c, ok := store.(io.Closer); ok {
+		inst.store = c
+	}
+	inst.rules = cfg.RulesSource.source()
+	if cfg.ObfsKey != "" {
+		inst.layer = socks4.ObfsTransport([]byte(cfg.ObfsKey))
+	}
+	inst.probe = newProber(&cfg.Probe, cfg.TLS.enabled(), cfg.WebSocket, inst.layer, logger)
+	return inst, nil
+}
+
+// notifier is an event notifier sending its pending events on Close.
+type notifier interface {
+	socks4.EventNotifier
+	io.Closer
+}
+
+// notifiers returns the event notifiers of the configuration.
+func (cfg *proxyConfig) notifiers(logger socks4.Logger) (notifiers []notifier, err error) {
+	defer func() {
+		if err != nil {
+			for _, n := range notifiers {
+				n.Close()
+			}
+			notifiers = nil
+		}
+	}()
+	if webhook := cfg.Webhook.webhook(logger); webhook != nil {
+		notifiers = append(notifiers, webhook)
+	}
+	audit, err := cfg.Audit.auditLog(logger)
+	if err != nil {
+		return notifiers, fmt.Errorf("audit: %v", err)
+	}
+	if audit != nil {
+		notifiers = append(notifiers, audit)
+	}
+	access, err := cfg.AccessLog.accessLog(logger)
+	if err != nil {
+		return notifiers, fmt.Errorf("access log: %v", err)
+	}
+	if access != nil {
+		notifiers = append(notifiers, access)
+	}
+	if cfg.IPFIX.Collector != "" {
+		exporter, err := socks4.NewIPFIXExporter(cfg.IPFIX.Collector, cfg.IPFIX.DomainID, logger)
+		if err != nil {
+			return notifiers, fmt.Errorf("IPFIX: %v", err)
+		}
+		notifiers = append(notifiers, exporter)
+	}
+	return notifiers, nil
+}
+
+// listen creates the listeners of the instances on their addresses, or
+// assigns them those passed by socket activation or inherited from an
+// upgraded process. With several instances the activated sockets are
+// assigned by their names (FileDescriptorName=), which must be the
+// instance names. The listeners are added to h.
+func listen(instances []*instance, configs []instanceConfig, h *handoff, logger *logrus.Logger) (err error) {
+	defer func() {
+		if err == nil {
+			for _, inst := range instances {
+				for _, lis := range inst.listeners {
+					h.add("instance/"+inst.name, lis)
+				}
+			}
+		}
+	}()
+	activated, names, err := systemdListeners()
+	if err != nil {
+		return err
+	}
+	if activated != nil {
+		// socket activation replaces the configured listen addresses.
+		logger.Infof("using %v listeners passed by socket activation", len(activated))
+		if len(instances) == 1 {
+			instances[0].listeners = activated
+			return nil
+		}
+		byName := make(map[string]*instance)
+		for _, inst := range instances {
+			byName[inst.name] = inst
+		}
+		for i, lis := range activated {
+			inst := byName[names[i]]
+			if inst == nil {
+				closeListeners(activated)
+				return fmt.Errorf("socket activation fd %v: no instance named %q", listenFDsStart+i, names[i])
+			}
+			inst.listeners = append(inst.listeners, lis)
+		}
+		return nil
+	}
+
+	for i, inst := range instances {
+		// inherited listeners replace the configured listen addresses.
+		if inst.listeners = h.take("instance/" + inst.name); inst.listeners != nil {
+			logger.Infof("using %v listeners inherited from the upgraded process", len(inst.listeners))
+			continue
+		}
+		for _, addr := range configs[i].Listen {
+			var lis net.Listener
+			if configs[i].Transparent == "tproxy" {
+				lis, err = socks4.ListenTransparent(addr)
+			} else {
+				lis, err = net.Listen("tcp", addr)
+			}
+			if err != nil {
+				for _, inst := range instances {
+					closeListeners(inst.listeners)
+				}
+				return err
+			}
+			inst.listeners = append(inst.listeners, lis)
+		}
+	}
+	return nil
+}
+
+// findInstance returns the instance named name, or the only instance if
+// name is empty.
+func findInstance(instances []*instance, name string) (*instance, error) {
+	if name == "" {
+		if len(instances) == 1 {
+			return instances[0], nil
+		}
+		return nil, fmt.Errorf("an instance is required, one of %v", instanceNames(instances))
+	}
+	for _, inst := range instances {
+		if inst.name == name {
+			return inst, nil
+		}
+	}
+	return nil, fmt.Errorf("no instance named %q", name)
+}
+
+func instanceNames(instances []*instance) []string {
+	names := make([]string, len(instances))
+	for i, inst := range instances {
+		names[i] = inst.name
+	}
+	return names
+}
+
+// sessionInfo is a session of an instance.
+type sessionInfo struct {
+	Instance string `json:"instance,omitempty"`
+	socks4.SessionInfo
+}
+
+// instanceSessions returns the sessions of the instances.
+func instanceSessions(instances []*instance) []sessionInfo {
+	var list []sessionInfo
+	for _, inst := range instances {
+		for _, ss := range inst.srv.Sessions() {
+			list = append(list, sessionInfo{Instance: inst.name, SessionInfo: ss})
+		}
+	}
+	return list
+}
+
+// instanceGoroutines are the goroutines of a session of an instance.
+type instanceGoroutines struct {
+	Instance string `json:"instance,omitempty"`
+	socks4.SessionGoroutines
+}
+
+// sessionGoroutines returns the goroutines of the sessions of the
+// instances.
+func sessionGoroutines(instances []*instance) ([]instanceGoroutines, error) {
+	var list []instanceGoroutines
+	for _, inst := range instances {
+		sessions, err := inst.srv.SessionGoroutines()
+		if err != nil {
+			return nil, err
+		}
+		for _, sg := range sessions {
+			list = append(list, instanceGoroutines{Instance: inst.name, SessionGoroutines: sg})
+		}
+	}
+	return list, nil
+}
+
+// instanceState is the state of an instance.
+type instanceState struct {
+	Instance string `json:"instance,omitempty"`
+	socks4.State
+}
+
+// instanceStates returns the states of the instances.
+func instanceStates(instances []*instance) []instanceState {
+	list := make([]instanceState, len(instances))
+	for i, inst := range instances {
+		list[i] = instanceState{Instance: inst.name, State: inst.srv.State()}
+	}
+	return list
+}
+
+// instanceProgress is the shutdown progress of an instance.
+type instanceProgress struct {
+	Instance string `json:"instance,omitempty"`
+	socks4.ShutdownProgress
+}
+
+// shutdownProgress returns the shutdown progress of the instances shutting
+// down.
+func shutdownProgress(instances []*instance) []instanceProgress {
+	list := []instanceProgress{}
+	for _, inst := range instances {
+		if p, ok := inst.srv.ShutdownProgress(); ok {
+			list = append(list, instanceProgress{Instance: inst.name, ShutdownProgress: p})
+		}
+	}
+	return list
+}
+
+// labelsOf returns the labels of the sessions of the listener: those of
+// the instance and of its listen address, matched by port and IP so that
+// they apply to activated and inherited listeners too.
+func (inst *instance) labelsOf(lis net.Listener) map[string]string {
+	labels := inst.labels
+	addr, ok := lis.Addr().(*net.TCPAddr)
+	if !ok {
+		return labels
+	}
+	for listen, more := range inst.listenerLabels {
+		host, port, err := net.SplitHostPort(listen)
+		if err != nil || port != strconv.Itoa(addr.Port) {
+			continue
+		}
+		if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.Equal(addr.IP)) {
+			continue
+		}
+		merged := make(map[string]string, len(labels)+len(more))
+		for k, v := range labels {
+			merged[k] = v
+		}
+		for k, v := range more {
+			merged[k] = v
+		}
+		return merged
+	}
+	return labels
+}
+
+// serve serves the connections of the listener.
+func (inst *instance) serve(lis net.Listener) error {
+	labels := inst.labelsOf(lis)
+	if inst.layer != nil {
+		lis = socks4.TransportListener(lis, inst.layer)
+	}
+	lis = socks4.LabelListener(lis, labels)
+	if inst.transparent {
+		return inst.srv.ServeTransparent(lis)
+	}
+	if inst.wsPath != "" {
+		return inst.srv.ServeWebSocket(lis, inst.wsPath)
+	}
+	return inst.srv.Serve(lis)
+}
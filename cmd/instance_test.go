@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigInstances(t *testing.T) {
+	os.Unsetenv("SOCKS4_CONFIG")
+	const top = "idle_timeout: 5m\nmax_conns: 10\nlisten: [\":1080\"]\n"
+	for _, tt := range []struct {
+		name      string
+		instances string
+		check     func(instances []instanceConfig) bool
+		err       string // in the loading or validation error, none if empty.
+	}{
+		{name: "top level defaults", instances: "  - name: internal\n    listen: [\"127.0.0.1:1080\"]\n  - name: external\n    listen: [\":1081\"]\n    max_conns: 100\n    labels: {zone: dmz}\n", check: func(instances []instanceConfig) bool {
+			internal, external := instances[0], instances[1]
+			return internal.IdleTimeout == 5*time.Minute && internal.MaxConns == 10 && external.IdleTimeout == 5*time.Minute && external.MaxConns == 100 &&
+				reflect.DeepEqual(internal.Listen, []string{"127.0.0.1:1080"}) && external.Labels["zone"] == "dmz" && internal.Labels == nil
+		}},
+		{name: "no listen address", instances: "  - name: internal\n", err: "instance internal: no listen address"},
+		{name: "invalid name", instances: "  - name: \"in ternal\"\n    listen: [\":1081\"]\n", err: "invalid instance name"},
+		{name: "no name", instances: "  - listen: [\":1081\"]\n", err: "invalid instance name"},
+		{name: "duplicate name", instances: "  - name: a\n    listen: [\":1081\"]\n  - name: a\n    listen: [\":1082\"]\n", err: "duplicate instance"},
+		{name: "shared address", instances: "  - name: a\n    listen: [\":1081\"]\n  - name: b\n    listen: [\":1081\"]\n", err: "instances a and b both listen on :1081"},
+		{name: "invalid policy", instances: "  - name: a\n    listen: [\":1081\"]\n    dscp: 64\n", err: "instance a: DSCP"},
+		{name: "instance label", instances: "  - name: a\n    listen: [\":1081\"]\n    labels: {instance: b}\n", err: "instance a: invalid label name \"instance\""},
+		{name: "invalid label name", instances: "  - name: a\n    listen: [\":1081\"]\n    labels: {team-name: b}\n", err: "invalid label name"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeConfig(t, "socks4.yaml", top+"instances:\n"+tt.instances)
+			cfg, err := loadConfig("socks4", []string{"-config", path})
+			if err == nil {
+				err = cfg.validate()
+			}
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if instances := cfg.instances(); !tt.check(instances) {
+				t.Errorf("instances %+v", instances)
+			}
+		})
+	}
+}
+
+func TestConfigSingleInstance(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.MaxConns = 10
+	instances := cfg.instances()
+	if len(instances) != 1 || instances[0].Name != "" || instances[0].MaxConns != 10 {
+		t.Errorf("instances %+v, want the top level one", instances)
+	}
+}
+
+func TestNotifiers(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name   string
+		modify func(cfg *proxyConfig)
+		types  []string
+		err    bool
+	}{
+		{name: "none", modify: func(cfg *proxyConfig) {}},
+		{name: "webhook and IPFIX", modify: func(cfg *proxyConfig) {
+			cfg.Webhook.URLs = []string{"http://127.0.0.1:1/events"}
+			cfg.IPFIX.Collector = "127.0.0.1:4739"
+		}, types: []string{"*socks4.Webhook", "*socks4.IPFIXExporter"}},
+		{name: "audit", modify: func(cfg *proxyConfig) { cfg.Audit.SQLite = filepath.Join(dir, "audit.db") }, types: []string{"*socks4.AuditLog"}},
+		{name: "invalid IPFIX collector", modify: func(cfg *proxyConfig) {
+			cfg.Webhook.URLs = []string{"http://127.0.0.1:1/events"}
+			cfg.IPFIX.Collector = "127.0.0.1:ipfix-collector"
+		}, err: true},
+		{name: "invalid audit database", modify: func(cfg *proxyConfig) { cfg.Audit.SQLite = filepath.Join(dir, "missing", "audit.db") }, err: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			tt.modify(&cfg.proxyConfig)
+			notifiers, err := cfg.notifiers(nil)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			var types []string
+			for _, n := range notifiers {
+				types = append(types, fmt.Sprintf("%T", n))
+				n.Close()
+			}
+			if !reflect.DeepEqual(types, tt.types) {
+				t.Errorf("notifiers %v, want %v", types, tt.types)
+			}
+		})
+	}
+}
+
+func TestInstanceLabelsOf(t *testing.T) {
+	inst := &instance{
+		labels: map[string]string{"tenant": "a"},
+		listenerLabels: map[string]map[string]string{
+			"127.0.0.1:1080": {"zone": "internal"},
+			":1081":          {"zone": "external", "tenant": "b"},
+		},
+	}
+	for _, tt := range []struct {
+		addr   net.Addr
+		labels map[string]string
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}, map[string]string{"tenant": "a", "zone": "internal"}},
+		{&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1080}, map[string]string{"tenant": "a"}},
+		{&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1081}, map[string]string{"tenant": "b", "zone": "external"}},
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1082}, map[string]string{"tenant": "a"}},
+		{&net.UnixAddr{Name: "/run/socks4.sock", Net: "unix"}, map[string]string{"tenant": "a"}},
+	} {
+		if labels := inst.labelsOf(addrListener{tt.addr}); !reflect.DeepEqual(labels, tt.labels) {
+			t.Errorf("listener %v labels %v, want %v", tt.addr, labels, tt.labels)
+		}
+	}
+}
+
+// addrListener is a listener of the address only.
+type addrListener struct {
+	addr net.Addr
+}
+
+func (l addrListener) Accept() (net.Conn, error) { return nil, net.ErrClosed }
+func (l addrListener) Close() error              { return nil }
+func (l addrListener) Addr() net.Addr            { return l.addr }
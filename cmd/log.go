@@ -0,0 +1,635 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cccxg/socks4"
+	"github.com/sirupsen/logrus"
+)
+
+type logConfig struct {
+	Level         string        `yaml:"level"`
+	Format        string        `yaml:"format"`
+	Output        string        `yaml:"output"` // stdout, stderr, file, syslog or journald.
+	File          string        `yaml:"file"`
+	MaxSizeMB     int           `yaml:"max_size_mb"`
+	MaxAge        time.Duration `yaml:"max_age"`
+	MaxBackups    int           `yaml:"max_backups"`
+	SyslogAddress string        `yaml:"syslog_address"` // e.g. udp://10.0.0.1:514, the local syslog if empty.
+	// Sampling collapses the repeated messages of the servers by level:
+	// debug, info, warn or error.
+	Sampling map[string]logSamplingConfig `yaml:"sampling"`
+}
+
+// logSamplingConfig logs at most Burst messages of the same class within
+// each Window.
+type logSamplingConfig struct {
+	Window time.Duration `yaml:"window"`
+	Burst  int           `yaml:"burst"`
+}
+
+// serverLevels are the levels of the servers, which may be sampled or set
+// by subsystem.
+var serverLevels = map[string]socks4.LogLevel{
+	"debug":   socks4.LogDebug,
+	"info":    socks4.LogInfo,
+	"warn":    socks4.LogWarn,
+	"warning": socks4.LogWarn,
+	"error":   socks4.LogError,
+}
+
+func (c *logConfig) validate() error {
+	if _, err := logrus.ParseLevel(c.Level); err != nil {
+		return err
+	}
+	if c.Format != "text" && c.Format != "json" {
+		return fmt.Errorf("unknown log format %q", c.Format)
+	}
+	switch c.Output {
+	case "stdout", "stderr", "syslog", "journald":
+	case "file":
+		if c.File == "" {
+			return fmt.Errorf("log output file requires a log file path")
+		}
+	default:
+		return fmt.Errorf("unknown log output %q", c.Output)
+	}
+	for level, s := range c.Sampling {
+		if _, ok := serverLevels[level]; !ok {
+			return fmt.Errorf("unknown log sampling level %q", level)
+		}
+		if s.Window <= 0 || s.Burst < 0 {
+			return fmt.Errorf("invalid log sampling of level %v", level)
+		}
+	}
+	return nil
+}
+
+// samplingOptions returns the options sampling the logs of the servers.
+func (c *logConfig) samplingOptions() []socks4.OptionFunc {
+	var opts []socks4.OptionFunc
+	for level, s := range c.Sampling {
+		opts = append(opts, socks4.WithLogSampling(serverLevels[level], s.Window, s.Burst))
+	}
+	return opts
+}
+
+// logHub owns the logger of the binary and dispatches its entries to the
+// configured output and to the tail subscribers. The logger level is the
+// most verbose of the configured level and the subscribers' levels, while
+// the output only gets the entries of the configured level.
+type logHub struct {
+	logger *logrus.Logger
+	file   *rotatingFile // non-nil for the file output.
+	base   atomic.Uint32 // the configured level.
+	// sampling are the options sampling the logs of the servers.
+	sampling []socks4.OptionFunc
+
+	mu   sync.Mutex
+	subs map[*logSub]struct{}
+	// subsystems are the levels set by subsystem name, whose entries are
+	// output regardless of the configured level.
+	subsystems map[string]logrus.Level
+}
+
+// newLogger creates the logger of the configuration.
+func newLogger(c *logConfig) (*logHub, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	level, _ := logrus.ParseLevel(c.Level)
+	h := &logHub{
+		logger: &logrus.Logger{
+			Out:       io.Discard,
+			Level:     level,
+			Hooks:     make(logrus.LevelHooks),
+			Formatter: nopFormatter{},
+		},
+	}
+	h.base.Store(uint32(level))
+	h.logger.Hooks.Add(h)
+	h.sampling = c.samplingOptions()
+
+	var formatter logrus.Formatter = &logrus.TextFormatter{TimestampFormat: time.DateTime}
+	if c.Format == "json" {
+		formatter = &logrus.JSONFormatter{}
+	}
+	switch c.Output {
+	case "stdout":
+		h.logger.Hooks.Add(&writerHook{h, os.Stdout, formatter})
+	case "stderr":
+		h.logger.Hooks.Add(&writerHook{h, os.Stderr, formatter})
+	case "file":
+		f, err := openRotatingFile(c.File, int64(c.MaxSizeMB)<<20, c.MaxAge, c.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		h.file = f
+		h.logger.Hooks.Add(&writerHook{h, f, formatter})
+	case "syslog":
+		hook, err := newSyslogHook(h, c.SyslogAddress, formatter)
+		if err != nil {
+			return nil, err
+		}
+		h.logger.Hooks.Add(hook)
+	case "journald":
+		h.logger.Hooks.Add(newJournaldHook(h))
+	}
+	return h, nil
+}
+
+// enabled reports whether the entry is within the configured level, or
+// within the level of its subsystem if set.
+func (h *logHub) enabled(entry *logrus.Entry) bool {
+	if sub, ok := entry.Data["subsystem"].(string); ok {
+		h.mu.Lock()
+		level, ok := h.subsystems[sub]
+		h.mu.Unlock()
+		if ok {
+			return entry.Level <= level
+		}
+	}
+	return entry.Level <= logrus.Level(h.base.Load())
+}
+
+// setLevel changes the configured level.
+func (h *logHub) setLevel(level logrus.Level) {
+	h.base.Store(uint32(level))
+	h.updateLevel()
+}
+
+// updateLevel sets the logger level to the most verbose one needed.
+func (h *logHub) updateLevel() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	level := logrus.Level(h.base.Load())
+	for sub := range h.subs {
+		if sub.level > level {
+			level = sub.level
+		}
+	}
+	for _, l := range h.subsystems {
+		if l > level {
+			level = l
+		}
+	}
+	h.logger.SetLevel(level)
+}
+
+// setSubsystemLevel sets the level of the subsystem of the servers, or
+// resets it to the configured level if level is empty.
+func (h *logHub) setSubsystemLevel(instances []*instance, sub socks4.LogSubsystem, level string) error {
+	h.mu.Lock()
+	if level == "" {
+		delete(h.subsystems, sub.String())
+		for _, inst := range instances {
+			inst.srv.ResetLogLevel(sub)
+		}
+	} else {
+		l, ok := serverLevels[level]
+		if !ok {
+			h.mu.Unlock()
+			return fmt.Errorf("unknown log level %q", level)
+		}
+		if h.subsystems == nil {
+			h.subsystems = make(map[string]logrus.Level)
+		}
+		h.subsystems[sub.String()], _ = logrus.ParseLevel(level)
+		for _, inst := range instances {
+			inst.srv.SetLogLevel(sub, l)
+		}
+	}
+	h.mu.Unlock()
+	h.updateLevel()
+	return nil
+}
+
+// setLogLevel sets the level of the binary, or of the subsystem of the
+// servers if not empty.
+func setLogLevel(instances []*instance, logs *logHub, subsystem, level string) error {
+	if subsystem != "" {
+		sub, err := socks4.ParseLogSubsystem(subsystem)
+		if err != nil {
+			return err
+		}
+		return logs.setSubsystemLevel(instances, sub, level)
+	}
+	l, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	logs.setLevel(l)
+	return nil
+}
+
+// logLevels are the configured level and the levels set by subsystem.
+type logLevels struct {
+	Level      string            `json:"level"`
+	Subsystems map[string]string `json:"subsystems,omitempty"`
+}
+
+func (h *logHub) levels() logLevels {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	l := logLevels{Level: logrus.Level(h.base.Load()).String()}
+	for sub, level := range h.subsystems {
+		if l.Subsystems == nil {
+			l.Subsystems = make(map[string]string)
+		}
+		l.Subsystems[sub] = level.String()
+	}
+	return l
+}
+
+// reopen reopens the log file, if any.
+func (h *logHub) reopen() error {
+	if h.file == nil {
+		return nil
+	}
+	return h.file.reopen()
+}
+
+// logEntry is a log entry sent to the tail subscribers.
+type logEntry struct {
+	Time    time.Time      `json:"time"`
+	Level   string         `json:"level"`
+	Message string         `json:"msg"`
+	Fields  map[string]any `json:"fields,omitempty"`
+}
+
+// logSub is a subscriber of the log entries up to level. Entries are
+// dropped when the subscriber falls behind.
+type logSub struct {
+	level   logrus.Level
+	entries chan logEntry
+}
+
+func (h *logHub) subscribe(level logrus.Level) *logSub {
+	sub := &logSub{level: level, entries: make(chan logEntry, 256)}
+	h.mu.Lock()
+	if h.subs == nil {
+		h.subs = make(map[*logSub]struct{})
+	}
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	h.updateLevel()
+	return sub
+}
+
+func (h *logHub) unsubscribe(sub *logSub) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+	h.updateLevel()
+}
+
+func (h *logHub) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire sends the entry to the subscribers.
+func (h *logHub) Fire(entry *logrus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.subs) == 0 {
+		return nil
+	}
+	e := logEntry{Time: entry.Time, Level: entry.Level.String(), Message: entry.Message}
+	if len(entry.Data) > 0 {
+		e.Fields = make(map[string]any, len(entry.Data))
+		for k, v := range entry.Data {
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			e.Fields[k] = v
+		}
+	}
+	for sub := range h.subs {
+		if entry.Level <= sub.level {
+			select {
+			case sub.entries <- e:
+			default:
+			}
+		}
+	}
+	return nil
+}
+
+// nopFormatter skips formatting for the logger output, which is discarded
+// since the entries are written by hooks.
+type nopFormatter struct{}
+
+func (nopFormatter) Format(*logrus.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+// writerHook writes the entries within the configured level to w.
+type writerHook struct {
+	hub       *logHub
+	w         io.Writer
+	formatter logrus.Formatter
+}
+
+func (h *writerHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *writerHook) Fire(entry *logrus.Entry) error {
+	if !h.hub.enabled(entry) {
+		return nil
+	}
+	b, err := h.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	_, err = h.w.Write(b)
+	return err
+}
+
+// rotatingFile is a log file rotated when it grows over maxSize bytes or
+// gets older than maxAge. The rotated files are renamed with a timestamp
+// suffix and at most maxBackups of them are kept. Zero values disable the
+// respective limits.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	now        func() time.Time // time.Now, but in the tests.
+
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	openedAt time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxBackups: maxBackups, now: time.Now}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.openedAt = f, info.Size(), r.now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if (r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize && r.size > 0) ||
+		(r.maxAge > 0 && r.now().Sub(r.openedAt) > r.maxAge) {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "rotate log file: %v\n", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file and opens a new one. It must be called
+// with r.mu held.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	backup := r.path + "." + r.now().Format("20060102-150405.000")
+	if err := os.Rename(r.path, backup); err != nil {
+		return r.open()
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	if r.maxBackups > 0 {
+		backups, _ := filepath.Glob(r.path + ".*")
+		sort.Strings(backups)
+		for len(backups) > r.maxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return nil
+}
+
+// reopen closes and reopens the file, for it may have been moved by an
+// external tool like logrotate.
+func (r *rotatingFile) reopen() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.f.Close()
+	return r.open()
+}
+
+// syslogHook sends log entries to syslog in the RFC 5424 format.
+type syslogHook struct {
+	hub              *logHub
+	formatter        logrus.Formatter
+	network, address string
+	hostname, app    string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// newSyslogHook creates a hook sending to address like udp://host:514 or
+// tcp://host:514, or to the local syslog if address is empty.
+func newSyslogHook(hub *logHub, address string, formatter logrus.Formatter) (*syslogHook, error) {
+	h := &syslogHook{hub: hub, formatter: formatter, app: filepath.Base(os.Args[0])}
+	if h.hostname, _ = os.Hostname(); h.hostname == "" {
+		h.hostname = "-" // the nil value of RFC 5424.
+	}
+	if address == "" {
+		h.network, h.address = "unixgram", "/dev/log"
+	} else {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme != "udp" && u.Scheme != "tcp" {
+			return nil, fmt.Errorf("unsupported syslog address %q", address)
+		}
+		h.network, h.address = u.Scheme, u.Host
+	}
+	if err := h.connect(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *syslogHook) connect() error {
+	conn, err := net.Dial(h.network, h.address)
+	if err != nil {
+		return err
+	}
+	h.conn = conn
+	return nil
+}
+
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	if !h.hub.enabled(entry) {
+		return nil
+	}
+	line, err := h.format(entry)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, err := h.conn.Write([]byte(line)); err != nil {
+		h.conn.Close()
+		if err := h.connect(); err != nil {
+			return err
+		}
+		_, err = h.conn.Write([]byte(line))
+		return err
+	}
+	return nil
+}
+
+// format returns the syslog message of the entry, framed by octet counting
+// over TCP (RFC 6587).
+func (h *syslogHook) format(entry *logrus.Entry) (string, error) {
+	msg, err := h.formatter.Format(entry)
+	if err != nil {
+		return "", err
+	}
+	const facilityDaemon = 3
+	pri := facilityDaemon*8 + syslogSeverity(entry.Level)
+	line := fmt.Sprintf("<%d>1 %v %v %v %v - - %v", pri, entry.Time.Format(time.RFC3339Nano),
+		h.hostname, h.app, os.Getpid(), strings.TrimRight(string(msg), "\n"))
+	if h.network == "tcp" {
+		line = strconv.Itoa(len(line)) + " " + line // octet counting framing.
+	}
+	return line, nil
+}
+
+func syslogSeverity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2 // critical
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	default:
+		return 7 // debug
+	}
+}
+
+// journaldHook sends log entries to the systemd journal with its native
+// protocol, over a connection kept open and made again once it fails.
+type journaldHook struct {
+	hub  *logHub
+	app  string
+	addr *net.UnixAddr
+
+	mu   sync.Mutex
+	conn *net.UnixConn // nil until the first entry or once it failed.
+}
+
+func newJournaldHook(hub *logHub) *journaldHook {
+	return &journaldHook{
+		hub:  hub,
+		app:  filepath.Base(os.Args[0]),
+		addr: &net.UnixAddr{Name: "/run/systemd/journal/socket", Net: "unixgram"},
+	}
+}
+
+func (h *journaldHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *journaldHook) Fire(entry *logrus.Entry) error {
+	if !h.hub.enabled(entry) {
+		return nil
+	}
+	msg := h.format(entry)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// the connection may fail once the journal restarts: the entry is
+	// sent again over a new one.
+	for retry := h.conn != nil; ; retry = false {
+		if h.conn == nil {
+			conn, err := net.DialUnix("unixgram", nil, h.addr)
+			if err != nil {
+				return err
+			}
+			h.conn = conn
+		}
+		_, err := h.conn.Write(msg)
+		if err == nil {
+			return nil
+		}
+		h.conn.Close()
+		h.conn = nil
+		if !retry {
+			return err
+		}
+	}
+}
+
+// format returns the datagram of the entry in the native protocol of the
+// journal.
+func (h *journaldHook) format(entry *logrus.Entry) []byte {
+	var b strings.Builder
+	writeField := func(key, value string) {
+		if strings.Contains(value, "\n") {
+			// binary safe form: KEY\n<little endian uint64 length><value>\n
+			var n [8]byte
+			for i := range n {
+				n[i] = byte(uint64(len(value)) >> (8 * i))
+			}
+			b.WriteString(key + "\n")
+			b.Write(n[:])
+			b.WriteString(value + "\n")
+			return
+		}
+		b.WriteString(key + "=" + value + "\n")
+	}
+	writeField("MESSAGE", entry.Message)
+	writeField("PRIORITY", strconv.Itoa(syslogSeverity(entry.Level)))
+	writeField("SYSLOG_IDENTIFIER", h.app)
+	for k, v := range entry.Data {
+		key := strings.ToUpper(strings.Map(func(r rune) rune {
+			if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+				return r
+			}
+			return '_'
+		}, k))
+		// the journal rejects the keys not starting with a letter.
+		if key = strings.TrimLeft(key, "_0123456789"); key != "" {
+			writeField(key, fmt.Sprint(v))
+		}
+	}
+	return []byte(b.String())
+}
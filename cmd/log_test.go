@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cccxg/socks4"
+	"github.com/sirupsen/logrus"
+)
+
+// testHub returns a hub enabling all the entries.
+func testHub() *logHub {
+	h := &logHub{}
+	h.base.Store(uint32(logrus.TraceLevel))
+	return h
+}
+
+func testEntry(level logrus.Level, msg string, data logrus.Fields) *logrus.Entry {
+	return &logrus.Entry{Time: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), Level: level, Message: msg, Data: data}
+}
+
+func TestRotatingFile(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		maxSize    int64
+		maxAge     time.Duration
+		maxBackups int
+		writes     []string
+		step       time.Duration // clock advance before each write.
+		backups    int
+		current    string
+	}{
+		{name: "within limits", maxSize: 100, maxAge: time.Hour, writes: []string{"aaaa\n", "bbbb\n"}, step: time.Second, current: "aaaa\nbbbb\n"},
+		{name: "size", maxSize: 8, writes: []string{"aaaa\n", "bbbb\n", "cccc\n"}, step: time.Second, backups: 2, current: "cccc\n"},
+		{name: "entry larger than the size", maxSize: 4, writes: []string{"aaaaaaaa\n"}, current: "aaaaaaaa\n"},
+		{name: "age", maxAge: time.Minute, writes: []string{"aaaa\n", "bbbb\n", "cccc\n"}, step: 40 * time.Second, backups: 1, current: "bbbb\ncccc\n"},
+		{name: "max backups", maxSize: 1, maxBackups: 2, writes: []string{"a\n", "b\n", "c\n", "d\n", "e\n"}, step: time.Second, backups: 2, current: "e\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "socks4.log")
+			now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+			r := &rotatingFile{path: path, maxSize: tt.maxSize, maxAge: tt.maxAge, maxBackups: tt.maxBackups, now: func() time.Time { return now }}
+			if err := r.open(); err != nil {
+				t.Fatal(err)
+			}
+			defer r.f.Close()
+			for _, w := range tt.writes {
+				now = now.Add(tt.step)
+				if _, err := r.Write([]byte(w)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if b, _ := os.ReadFile(path); string(b) != tt.current {
+				t.Errorf("log file %q, want %q", b, tt.current)
+			}
+			backups, _ := filepath.Glob(path + ".*")
+			if len(backups) != tt.backups {
+				t.Errorf("backups %v, want %v", backups, tt.backups)
+			}
+			if tt.maxBackups > 0 && len(backups) > 0 {
+				// the oldest backups are removed.
+				if b, _ := os.ReadFile(backups[len(backups)-1]); string(b) != tt.writes[len(tt.writes)-2] {
+					t.Errorf("last backup %q, want %q", b, tt.writes[len(tt.writes)-2])
+				}
+			}
+		})
+	}
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socks4.log")
+	r, err := openRotatingFile(path, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.f.Close()
+	r.Write([]byte("before\n"))
+	// moved away like by logrotate.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.reopen(); err != nil {
+		t.Fatal(err)
+	}
+	r.Write([]byte("after\n"))
+	if b, _ := os.ReadFile(path); string(b) != "after\n" {
+		t.Errorf("log file %q after reopen, want the entries written since", b)
+	}
+}
+
+// rfc5424 matches a syslog message of the daemon facility.
+var rfc5424 = regexp.MustCompile(`^<(\d+)>1 (\S+) (\S+) (\S+) (\d+) - - (.*)$`)
+
+func TestSyslogFormat(t *testing.T) {
+	for _, tt := range []struct {
+		network string
+		level   logrus.Level
+		pri     int
+	}{
+		{"udp", logrus.ErrorLevel, 3*8 + 3},
+		{"udp", logrus.InfoLevel, 3*8 + 6},
+		{"tcp", logrus.WarnLevel, 3*8 + 4},
+		{"tcp", logrus.DebugLevel, 3*8 + 7},
+	} {
+		h := &syslogHook{hub: testHub(), formatter: &logrus.TextFormatter{DisableTimestamp: true}, network: tt.network, hostname: "host", app: "socks4"}
+		line, err := h.format(testEntry(tt.level, "hello\nworld", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.network == "tcp" {
+			// octet counting: the length of the message, a space, then it.
+			n, rest, ok := strings.Cut(line, " ")
+			if length, err := strconv.Atoi(n); !ok || err != nil || length != len(rest) {
+				t.Fatalf("TCP message %q not framed by its length", line)
+			}
+			line = rest
+		}
+		m := rfc5424.FindStringSubmatch(strings.ReplaceAll(line, "\n", " "))
+		if m == nil {
+			t.Fatalf("message %q not in the RFC 5424 format", line)
+		}
+		if pri, _ := strconv.Atoi(m[1]); pri != tt.pri || m[2] != "2024-05-01T12:00:00Z" || m[3] != "host" || m[4] != "socks4" || m[5] != strconv.Itoa(os.Getpid()) {
+			t.Errorf("message %q, want priority %v and the header of the entry", line, tt.pri)
+		}
+	}
+}
+
+func TestSyslogHookTCP(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	h, err := newSyslogHook(testHub(), "tcp://"+lis.Addr().String(), &logrus.JSONFormatter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := lis.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, msg := range []string{"first", "second"} {
+		if err := h.Fire(testEntry(logrus.InfoLevel, msg, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the messages are read back by their length.
+	r := bufio.NewReader(conn)
+	for _, want := range []string{"first", "second"} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := r.ReadString(' ')
+		if err != nil {
+			t.Fatal(err)
+		}
+		length, _ := strconv.Atoi(strings.TrimSpace(n))
+		msg := make([]byte, length)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(msg), want) {
+			t.Errorf("message %q, want %q", msg, want)
+		}
+	}
+}
+
+// listenJournal listens to the datagrams at path like the journal.
+func listenJournal(t *testing.T, path string) *net.UnixConn {
+	t.Helper()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readJournal reads a datagram of the journal and returns its fields.
+func readJournal(t *testing.T, conn *net.UnixConn) map[string]string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 65536)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]string)
+	for b = b[:n]; len(b) > 0; {
+		line, rest, _ := strings.Cut(string(b), "\n")
+		if key, value, ok := strings.Cut(line, "="); ok {
+			fields[key] = value
+			b = []byte(rest)
+			continue
+		}
+		// binary safe form.
+		length := binary.LittleEndian.Uint64([]byte(rest[:8]))
+		fields[line] = rest[8 : 8+length]
+		b = []byte(rest[8+length+1:])
+	}
+	return fields
+}
+
+func TestJournaldHook(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.socket")
+	journal := listenJournal(t, path)
+	h := newJournaldHook(testHub())
+	h.addr = &net.UnixAddr{Name: path, Net: "unixgram"}
+
+	if err := h.Fire(testEntry(logrus.WarnLevel, "two\nlines", logrus.Fields{"client-addr": "10.0.0.1", "_x": 1, "42": "dropped"})); err != nil {
+		t.Fatal(err)
+	}
+	fields := readJournal(t, journal)
+	if fields["MESSAGE"] != "two\nlines" || fields["PRIORITY"] != "4" || fields["CLIENT_ADDR"] != "10.0.0.1" || fields["X"] != "1" || len(fields) != 5 {
+		t.Errorf("fields %q, want the message, priority, identifier and fields of the entry", fields)
+	}
+	conn := h.conn
+
+	// the connection is kept for the next entries.
+	if err := h.Fire(testEntry(logrus.InfoLevel, "again", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if readJournal(t, journal)["MESSAGE"] != "again" || h.conn != conn {
+		t.Error("entry not sent over the same connection")
+	}
+
+	// and made again once the journal restarts.
+	journal.Close()
+	os.Remove(path)
+	journal = listenJournal(t, path)
+	defer journal.Close()
+	if err := h.Fire(testEntry(logrus.InfoLevel, "restarted", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if readJournal(t, journal)["MESSAGE"] != "restarted" {
+		t.Error("entry not sent once the journal restarted")
+	}
+}
+
+func TestLogSamplingConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		sampling map[string]logSamplingConfig
+		options  int
+		valid    bool
+	}{
+		{name: "none", valid: true},
+		{name: "levels", sampling: map[string]logSamplingConfig{"warn": {Window: time.Minute, Burst: 10}, "error": {Window: time.Second}}, options: 2, valid: true},
+		{name: "warning level", sampling: map[string]logSamplingConfig{"warning": {Window: time.Minute, Burst: 10}}, options: 1, valid: true},
+		{name: "unknown level", sampling: map[string]logSamplingConfig{"fatal": {Window: time.Minute, Burst: 10}}},
+		{name: "no window", sampling: map[string]logSamplingConfig{"warn": {Burst: 10}}},
+		{name: "negative burst", sampling: map[string]logSamplingConfig{"warn": {Window: time.Minute, Burst: -1}}},
+	} {
+		c := logConfig{Level: "info", Format: "text", Output: "stdout", Sampling: tt.sampling}
+		if err := c.validate(); (err == nil) != tt.valid {
+			t.Errorf("%v: error %v, want valid %v", tt.name, err, tt.valid)
+			continue
+		}
+		if tt.valid && len(c.samplingOptions()) != tt.options {
+			t.Errorf("%v: %v sampling options, want %v", tt.name, len(c.samplingOptions()), tt.options)
+		}
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	a := testAdmin(true, "a", "b")
+	hub := &logHub{logger: &logrus.Logger{Out: io.Discard, Formatter: &logrus.TextFormatter{}}}
+	hub.setLevel(logrus.InfoLevel)
+	for _, tt := range []struct {
+		name      string
+		subsystem string
+		level     string
+		levels    string // of the hub, as printed.
+		logger    logrus.Level
+		err       string // in the error, none if empty.
+	}{
+		{name: "level", level: "warning", levels: "{warning map[]}", logger: logrus.WarnLevel},
+		{name: "subsystem", subsystem: "relay", level: "debug", levels: "{warning map[relay:debug]}", logger: logrus.DebugLevel},
+		{name: "another subsystem", subsystem: "rules", level: "error", levels: "{warning map[relay:debug rules:error]}", logger: logrus.DebugLevel},
+		{name: "subsystem reset", subsystem: "relay", levels: "{warning map[rules:error]}", logger: logrus.WarnLevel},
+		{name: "unknown subsystem", subsystem: "dns", level: "debug", err: `unknown log subsystem "dns"`},
+		{name: "unknown subsystem level", subsystem: "relay", level: "trace", err: `unknown log level "trace"`},
+		{name: "unknown level", level: "verbose", err: "not a valid logrus Level"},
+	} {
+		err := setLogLevel(a.instances, hub, tt.subsystem, tt.level)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%v: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if levels := fmt.Sprint(hub.levels()); levels != tt.levels || hub.logger.GetLevel() != tt.logger {
+			t.Errorf("%v: levels %v with the logger at %v, want %v at %v", tt.name, levels, hub.logger.GetLevel(), tt.levels, tt.logger)
+		}
+	}
+	// the levels of the subsystems are set in every server.
+	for _, inst := range a.instances {
+		if levels := inst.srv.LogLevels(); !reflect.DeepEqual(levels, map[socks4.LogSubsystem]socks4.LogLevel{socks4.LogRules: socks4.LogError}) {
+			t.Errorf("instance %v: levels %v, want the rules at error", inst.name, levels)
+		}
+	}
+	// the entries of a subsystem pass by its level.
+	for _, tt := range []struct {
+		entry   *logrus.Entry
+		enabled bool
+	}{
+		{testEntry(logrus.InfoLevel, "closed", logrus.Fields{"subsystem": "rules"}), false},
+		{testEntry(logrus.ErrorLevel, "invalid rules", logrus.Fields{"subsystem": "rules"}), true},
+		{testEntry(logrus.InfoLevel, "closed", logrus.Fields{"subsystem": "relay"}), false},
+		{testEntry(logrus.WarnLevel, "idle", logrus.Fields{"subsystem": "relay"}), true},
+		{testEntry(logrus.InfoLevel, "listening", nil), false},
+	} {
+		if enabled := hub.enabled(tt.entry); enabled != tt.enabled {
+			t.Errorf("%v entry %q of %v enabled %v, want %v", tt.entry.Level, tt.entry.Message, tt.entry.Data["subsystem"], enabled, tt.enabled)
+		}
+	}
+}
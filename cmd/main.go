@@ -1,10 +1,386 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
 	"github.com/cccxg/socks4"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
 func main() {
-	srv := socks4.NewServer()
-	srv.Run(":1080")
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "check":
+			os.Exit(check(os.Args[2:]))
+		case "connect":
+			os.Exit(connect(os.Args[2:]))
+		case "fetch":
+			os.Exit(fetch(os.Args[2:]))
+		case "expose":
+			os.Exit(expose(os.Args[2:]))
+		case "bench":
+			os.Exit(bench(os.Args[2:]))
+		case "sessions":
+			os.Exit(sessions(os.Args[2:]))
+		case "kill":
+			os.Exit(kill(os.Args[2:]))
+		case "maintenance":
+			os.Exit(maintenance(os.Args[2:]))
+		case "tail":
+			os.Exit(tailCmd(os.Args[2:]))
+		case "version":
+			os.Exit(versionCmd(os.Args[2:]))
+		}
+	}
+	os.Exit(run(os.Args[1:]))
+}
+
+// run starts the proxy server and serves until it is shut down by SIGTERM
+// or SIGINT. SIGHUP reloads the configuration and reopens the log file.
+// SIGUSR2 starts the executable again on the same listeners, and drains
+// once it serves.
+func run(args []string) int {
+	cfg, err := loadConfig("socks4", args)
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	logs, err := newLogger(&cfg.Log)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	logger := logs.logger
+	var acm *acmeManager
+	if cfg.usesACME() {
+		acm = cfg.ACME.manager()
+		if cfg.ACME.CacheDir == "" {
+			logger.Warn("no ACME cache directory, certificates are requested again on every start")
+		}
+	}
+	configs := cfg.instances()
+	instances := make([]*instance, len(configs))
+	for i := range configs {
+		if instances[i], err = newInstance(&configs[i], logs, acm); err != nil {
+			if configs[i].Name != "" {
+				err = fmt.Errorf("instance %v: %v", configs[i].Name, err)
+			}
+			logger.Error(err)
+			return 1
+		}
+	}
+	// fail before taking over the listeners rather than accept clients
+	// that can't be served.
+	for _, inst := range instances {
+		if err := inst.srv.CheckStartup(); err != nil {
+			if inst.name != "" {
+				err = fmt.Errorf("instance %v: %v", inst.name, err)
+			}
+			logger.Error(err)
+			return 1
+		}
+	}
+	h, err := inheritListeners()
+	if err != nil {
+		logger.Error(err)
+		return 1
+	}
+	if err := listen(instances, configs, h, logger); err != nil {
+		logger.Error(err)
+		h.closeInherited()
+		return 1
+	}
+
+	if acm != nil {
+		lis, err := serveACME(&cfg.ACME, acm, h, logger)
+		if err != nil {
+			logger.Error(err)
+			closeInstances(instances)
+			h.closeInherited()
+			return 1
+		}
+		if lis != nil {
+			defer lis.Close()
+		}
+	}
+	adm := &admin{instances: instances, logs: logs, logger: logger, args: args}
+	if cfg.AdminTLS.enabled() {
+		if adm.tls, err = cfg.AdminTLS.load(nil, logger); err != nil {
+			logger.Error(err)
+			closeInstances(instances)
+			h.closeInherited()
+			return 1
+		}
+	}
+	if cfg.Admin != "" {
+		lis, err := h.listen("admin", func() (net.Listener, error) { return net.Listen("tcp", cfg.Admin) })
+		if err != nil {
+			logger.Error(err)
+			closeInstances(instances)
+			h.closeInherited()
+			return 1
+		}
+		defer lis.Close()
+		go adm.serve(lis)
+	}
+	if cfg.ControlSocket != "" {
+		lis, err := h.listen("control", func() (net.Listener, error) { return listenControl(cfg.ControlSocket) })
+		if err != nil {
+			logger.Error(err)
+			closeInstances(instances)
+			h.closeInherited()
+			return 1
+		}
+		defer lis.Close()
+		ctl := &control{instances: instances, logs: logs, logger: logger}
+		go ctl.serve(lis)
+	}
+	watchCtx, stopWatches := context.WithCancel(context.Background())
+	defer stopWatches()
+	for _, inst := range instances {
+		if inst.rules != nil {
+			go inst.srv.WatchRules(watchCtx, inst.rules)
+		}
+		for _, lis := range inst.listeners {
+			go inst.serve(lis)
+		}
+		if inst.probe != nil && len(inst.listeners) > 0 {
+			go inst.probe.run(watchCtx, inst.listeners[0].Addr())
+		}
+	}
+	h.closeInherited()
+	adm.ready.Store(true)
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Warnf("notify systemd: %v", err)
+	}
+	h.serving()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, append([]os.Signal{syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP}, upgradeSignals...)...)
+	for sig := range sigs {
+		if isUpgradeSignal(sig) {
+			logger.Infof("received %v, upgrading", sig)
+			pid, err := h.upgrade(logger)
+			if err != nil {
+				logger.Errorf("upgrade: %v", err)
+				continue
+			}
+			// the new process serves on the same sockets, this one drains.
+			h.release()
+			if err := sdNotify(fmt.Sprintf("MAINPID=%v", pid)); err != nil {
+				logger.Warnf("notify systemd: %v", err)
+			}
+		} else if sig == syscall.SIGHUP {
+			sdNotify("RELOADING=1")
+			reload(instances, logs, args)
+			if err := logs.reopen(); err != nil {
+				fmt.Fprintf(os.Stderr, "reopen log file: %v\n", err)
+			}
+			sdNotify("READY=1")
+			continue
+		}
+
+		logger.Infof("received %v, shutting down within %v", sig, cfg.DrainTimeout)
+		adm.ready.Store(false)
+		sdNotify("STOPPING=1")
+		signal.Stop(sigs)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.DrainTimeout)
+		err := shutdown(ctx, instances)
+		cancel()
+		if cfg.ShutdownReport != "" {
+			if rErr := writeShutdownReport(cfg.ShutdownReport, instances); rErr != nil {
+				logger.Errorf("write shutdown report: %v", rErr)
+			}
+		}
+		if err != nil {
+			logger.Warnf("shutdown: %v", err)
+			return 1
+		}
+		break
+	}
+	return 0
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, lis := range listeners {
+		lis.Close()
+	}
+}
+
+// closeInstances closes the listeners of the instances which are not
+// served yet.
+func closeInstances(instances []*instance) {
+	for _, inst := range instances {
+		closeListeners(inst.listeners)
+	}
+}
+
+// shutdown shuts down the instances concurrently, within the deadline of
+// ctx.
+func shutdown(ctx context.Context, instances []*instance) error {
+	errs := make(chan error, len(instances))
+	for _, inst := range instances {
+		go func(inst *instance) {
+			err := inst.srv.ShutdownContext(ctx)
+			// send the events of the last sessions.
+			for _, n := range inst.notifiers {
+				n.Close()
+			}
+			if inst.store != nil {
+				if sErr := inst.store.Close(); sErr != nil && err == nil {
+					err = fmt.Errorf("save the store: %v", sErr)
+				}
+			}
+			if err != nil && inst.name != "" {
+				err = fmt.Errorf("instance %v: %v", inst.name, err)
+			}
+			errs <- err
+		}(inst)
+	}
+	var first error
+	for range instances {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// instanceReport is the shutdown report of an instance.
+type instanceReport struct {
+	Instance string `json:"instance,omitempty"`
+	socks4.ShutdownReport
+}
+
+// writeShutdownReport writes the shutdown reports of the instances to path
+// as a JSON array.
+func writeShutdownReport(path string, instances []*instance) error {
+	reports := make([]instanceReport, 0, len(instances))
+	for _, inst := range instances {
+		if rep, ok := inst.srv.ShutdownReport(); ok {
+			reports = append(reports, instanceReport{inst.name, rep})
+		}
+	}
+	data, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// reload reloads the configuration and applies the rules, the timeouts,
+// the limits and the log level to the running instances. Other changes,
+// including added or removed instances, take effect after a restart.
+func reload(instances []*instance, logs *logHub, args []string) {
+	logger := logs.logger
+	cfg, n, err := reloadConfig(instances, args, logger)
+	if err != nil {
+		logger.Errorf("reload configuration: %v", err)
+		return
+	}
+	level, _ := logrus.ParseLevel(cfg.Log.Level)
+	logs.setLevel(level)
+	logger.Infof("configuration reloaded, %v rules", n)
+}
+
+// reloadMu serializes the reloads of the signals and of the management
+// API.
+var reloadMu sync.Mutex
+
+// reloadConfig loads the configuration and applies its rules, timeouts and
+// limits to the running instances, and returns the configuration and the
+// number of rules. Nothing is applied on errors.
+func reloadConfig(instances []*instance, args []string, logger *logrus.Logger) (*config, int, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	cfg, err := loadConfig("socks4", args)
+	if err == nil {
+		err = cfg.validate()
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	configs := cfg.instances()
+	rules := make([][]socks4.Rule, len(instances))
+	found := make([]*instanceConfig, len(instances))
+	for i, inst := range instances {
+		var c *instanceConfig
+		for j := range configs {
+			if configs[j].Name == inst.name {
+				c = &configs[j]
+			}
+		}
+		if c == nil {
+			return nil, 0, fmt.Errorf("instance %v is removed, restart to apply", inst.name)
+		}
+		found[i] = c
+		if rules[i], err = c.loadRules(); err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(configs) != len(instances) {
+		logger.Warn("reload configuration: instances are added, restart to apply")
+	}
+	for i, inst := range instances {
+		c := found[i].reconfigure(inst.srv.Config())
+		// the rules of a rules source are updated by its watch.
+		if inst.rules == nil {
+			c.Rules = rules[i]
+		}
+		inst.srv.Reconfigure(c)
+	}
+	n := 0
+	for _, r := range rules {
+		n += len(r)
+	}
+	return cfg, n, nil
+}
+
+// check validates the configuration and prints the effective one, its
+// secrets redacted, without starting the server.
+func check(args []string) int {
+	cfg, err := loadConfig("socks4 check", args)
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		return 1
+	}
+	if err := printConfig(os.Stdout, cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// printConfig writes the configuration to w as YAML, with its secrets
+// redacted.
+func printConfig(w io.Writer, cfg *config) error {
+	b, err := yaml.Marshal(cfg.redacted())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
 }
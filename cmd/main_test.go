@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cccxg/socks4"
+	"github.com/sirupsen/logrus"
+)
+
+func TestReloadConfig(t *testing.T) {
+	os.Unsetenv("SOCKS4_CONFIG")
+	logger := &logrus.Logger{Out: io.Discard, Formatter: &logrus.TextFormatter{}}
+	acl := filepath.Join(t.TempDir(), "acl")
+	for _, tt := range []struct {
+		name    string
+		config  string
+		acl     string
+		args    []string
+		rules   int // of the server after the reload.
+		timeout time.Duration
+		err     string // in the error, none if empty.
+	}{
+		{name: "rules and timeouts", config: "idle_timeout: 5m\nacl: " + acl + "\n", acl: "deny to 10.0.0.0/8\nallow\n", rules: 2, timeout: 5 * time.Minute},
+		{name: "flags and inline rules", config: "idle_timeout: 5m\nrules: [\"deny port 25\"]\n", args: []string{"-idle-timeout", "1m"}, rules: 1, timeout: time.Minute},
+		{name: "invalid rules", config: "idle_timeout: 5m\nacl: " + acl + "\n", acl: "deny to nowhere port x\n", err: acl},
+		{name: "invalid configuration", config: "idle_timeout: 5m\nlisten: []\n", err: "listen"},
+		{name: "instance removed", config: "instances:\n  - name: a\n    listen: [\":1080\"]\n", err: "instance  is removed"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := socks4.NewServer(socks4.WithLogger(logger), socks4.WithRules([]socks4.Rule{{Action: socks4.Allow}}), socks4.WithIdleTimeout(time.Hour))
+			instances := []*instance{{srv: srv}}
+			if err := os.WriteFile(acl, []byte(tt.acl), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			path := writeConfig(t, "socks4.yaml", tt.config)
+			_, n, err := reloadConfig(instances, append([]string{"-config", path}, tt.args...), logger)
+			c := srv.Config()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				// nothing is applied.
+				if len(c.Rules) != 1 || c.IdleTimeout != time.Hour {
+					t.Errorf("%v rules and idle timeout %v applied on errors", len(c.Rules), c.IdleTimeout)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.rules || len(c.Rules) != tt.rules || c.IdleTimeout != tt.timeout {
+				t.Errorf("%v rules and idle timeout %v reloaded, want %v and %v", len(c.Rules), c.IdleTimeout, tt.rules, tt.timeout)
+			}
+		})
+	}
+}
+
+func TestWriteShutdownReport(t *testing.T) {
+	dir := t.TempDir()
+	a, _ := serveInstance(t, "a")
+	b, _ := serveInstance(t, "b")
+	// a is shut down once serving, b still serving.
+	for deadline := time.Now().Add(5 * time.Second); a.srv.Close() != nil; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("instance not served")
+		}
+	}
+	for _, tt := range []struct {
+		name      string
+		path      string
+		instances []*instance
+		report    string // instances of the report in order.
+		err       bool
+	}{
+		{name: "shut down", path: filepath.Join(dir, "a.json"), instances: []*instance{a}, report: "a"},
+		{name: "not shut down", path: filepath.Join(dir, "b.json"), instances: []*instance{b}},
+		{name: "some shut down", path: filepath.Join(dir, "ab.json"), instances: []*instance{b, a}, report: "a"},
+		{name: "directory missing", path: filepath.Join(dir, "missing", "a.json"), instances: []*instance{a}, err: true},
+	} {
+		err := writeShutdownReport(tt.path, tt.instances)
+		if (err != nil) != tt.err {
+			t.Errorf("%v: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reports []instanceReport
+		if err := json.Unmarshal(data, &reports); err != nil {
+			t.Fatalf("%v: %v in %s", tt.name, err, data)
+		}
+		var names []string
+		for _, r := range reports {
+			names = append(names, r.Instance)
+			if r.Started.IsZero() {
+				t.Errorf("%v: report %+v, want the shutdown", tt.name, r)
+			}
+		}
+		if strings.Join(names, ",") != tt.report || !strings.HasSuffix(string(data), "]\n") {
+			t.Errorf("%v: wrote %s, want the reports of %q", tt.name, data, tt.report)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cccxg/socks4"
+)
+
+// maintenanceState is the maintenance mode of an instance.
+type maintenanceState struct {
+	Instance string   `json:"instance,omitempty"`
+	Enabled  bool     `json:"enabled"`
+	Allow    []string `json:"allow,omitempty"` // networks of the clients still served.
+	Close    bool     `json:"close,omitempty"` // close the connections of the other clients without a reply.
+}
+
+// maintenanceStates returns the maintenance mode of the instances.
+func maintenanceStates(instances []*instance) []maintenanceState {
+	states := make([]maintenanceState, len(instances))
+	for i, inst := range instances {
+		states[i].Instance = inst.name
+		if m := inst.srv.Maintenance(); m != nil {
+			states[i].Enabled = true
+			states[i].Close = m.Close
+			for _, n := range m.Allow {
+				states[i].Allow = append(states[i].Allow, n.String())
+			}
+		}
+	}
+	return states
+}
+
+// setMaintenance applies the maintenance mode of st to the instances.
+func setMaintenance(instances []*instance, st maintenanceState) error {
+	var m *socks4.Maintenance
+	if st.Enabled {
+		allow, err := parseNetworks(st.Allow)
+		if err != nil {
+			return err
+		}
+		m = &socks4.Maintenance{Allow: allow, Close: st.Close}
+	}
+	for _, inst := range instances {
+		inst.srv.SetMaintenance(m)
+	}
+	return nil
+}
+
+// inMaintenance reports whether all the instances are in maintenance.
+func inMaintenance(instances []*instance) bool {
+	for _, inst := range instances {
+		if inst.srv.Maintenance() == nil {
+			return false
+		}
+	}
+	return len(instances) > 0
+}
+
+// maintenance shows or switches the maintenance mode of a running server.
+func maintenance(args []string) int {
+	fs, path := newControlFlagSet("socks4 maintenance")
+	inst := fs.String("instance", "", "switch this instance only")
+	var allow listValue
+	fs.Var(&allow, "allow", "comma separated CIDRs of the clients still served in maintenance")
+	closeConns := fs.Bool("close", false, "close the connections of the other clients without a reply, instead of rejecting their requests")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: socks4 maintenance [flags] [on|off|status]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	req := controlRequest{Command: "maintenance", Instance: *inst}
+	switch fs.Arg(0) {
+	case "", "status":
+	case "on":
+		req.Maintenance = &maintenanceState{Enabled: true, Allow: allow, Close: *closeConns}
+	case "off":
+		req.Maintenance = &maintenanceState{}
+	default:
+		fs.Usage()
+		return 2
+	}
+	resp, err := controlCall(*path, req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tMAINTENANCE\tALLOW\tCLOSE")
+	for _, st := range resp.Maintenance {
+		state := "off"
+		if st.Enabled {
+			state = "on"
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", st.Instance, state, strings.Join(st.Allow, ","), st.Close)
+	}
+	w.Flush()
+	return 0
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetMaintenance(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		state  maintenanceState
+		states []maintenanceState
+		all    bool
+		err    bool
+	}{
+		{name: "on", state: maintenanceState{Enabled: true}, states: []maintenanceState{{Instance: "a", Enabled: true}, {Instance: "b", Enabled: true}}, all: true},
+		{
+			name:   "on with allowed clients",
+			state:  maintenanceState{Enabled: true, Allow: []string{"10.0.0.0/8", "192.0.2.1"}, Close: true},
+			states: []maintenanceState{{Instance: "a", Enabled: true, Allow: []string{"10.0.0.0/8", "192.0.2.1/32"}, Close: true}, {Instance: "b", Enabled: true, Allow: []string{"10.0.0.0/8", "192.0.2.1/32"}, Close: true}},
+			all:    true,
+		},
+		{name: "off", state: maintenanceState{}, states: []maintenanceState{{Instance: "a"}, {Instance: "b"}}},
+		{name: "invalid network", state: maintenanceState{Enabled: true, Allow: []string{"10.0.0.0/33"}}, states: []maintenanceState{{Instance: "a"}, {Instance: "b"}}, err: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			instances := testAdmin(true, "a", "b").instances
+			if err := setMaintenance(instances, tt.state); (err != nil) != tt.err {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if states := maintenanceStates(instances); !reflect.DeepEqual(states, tt.states) {
+				t.Errorf("states %+v, want %+v", states, tt.states)
+			}
+			if all := inMaintenance(instances); all != tt.all {
+				t.Errorf("all in maintenance: %v, want %v", all, tt.all)
+			}
+		})
+	}
+	instances := testAdmin(true, "a", "b").instances
+	setMaintenance(instances[:1], maintenanceState{Enabled: true})
+	if inMaintenance(instances) || inMaintenance(nil) {
+		t.Error("instances in maintenance while one is not")
+	}
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	a := testAdmin(true, "a", "b")
+	h := a.handler()
+	for _, tt := range []struct {
+		method string
+		path   string
+		status int
+		states []maintenanceState // replied, if the status is OK.
+		ready  int                // status of /readyz then.
+	}{
+		{method: http.MethodGet, path: "/maintenance", status: http.StatusOK, states: []maintenanceState{{Instance: "a"}, {Instance: "b"}}, ready: http.StatusOK},
+		{method: http.MethodPost, path: "/maintenance?state=on&instance=b", status: http.StatusOK, states: []maintenanceState{{Instance: "b", Enabled: true}}, ready: http.StatusOK},
+		{
+			method: http.MethodPost, path: "/maintenance?state=on&allow=10.0.0.0/8,192.0.2.0/24&close=true", status: http.StatusOK,
+			states: []maintenanceState{{Instance: "a", Enabled: true, Allow: []string{"10.0.0.0/8", "192.0.2.0/24"}, Close: true}, {Instance: "b", Enabled: true, Allow: []string{"10.0.0.0/8", "192.0.2.0/24"}, Close: true}},
+			ready:  http.StatusServiceUnavailable,
+		},
+		{method: http.MethodPost, path: "/maintenance?state=on&allow=10.0.0", status: http.StatusBadRequest, ready: http.StatusServiceUnavailable},
+		{method: http.MethodPost, path: "/maintenance?state=maybe", status: http.StatusBadRequest, ready: http.StatusServiceUnavailable},
+		{method: http.MethodPut, path: "/maintenance?state=off", status: http.StatusMethodNotAllowed, ready: http.StatusServiceUnavailable},
+		{method: http.MethodPost, path: "/maintenance?state=off&instance=c", status: http.StatusNotFound, ready: http.StatusServiceUnavailable},
+		{method: http.MethodPost, path: "/maintenance?state=off&instance=a", status: http.StatusOK, states: []maintenanceState{{Instance: "a"}}, ready: http.StatusOK},
+	} {
+		status, body := get(h, tt.method, tt.path)
+		if status != tt.status {
+			t.Fatalf("%v %v: %v %q, want %v", tt.method, tt.path, status, body, tt.status)
+		}
+		if status == http.StatusOK {
+			var states []maintenanceState
+			if err := json.Unmarshal([]byte(body), &states); err != nil || !reflect.DeepEqual(states, tt.states) {
+				t.Errorf("%v %v: states %+v, want %+v: %v", tt.method, tt.path, states, tt.states, err)
+			}
+		}
+		// the load balancers stop sending traffic once all the instances
+		// are in maintenance.
+		if status, _ := get(h, http.MethodGet, "/readyz"); status != tt.ready {
+			t.Errorf("after %v %v: ready status %v, want %v", tt.method, tt.path, status, tt.ready)
+		}
+	}
+}
+
+func TestControlMaintenance(t *testing.T) {
+	a := testAdmin(true, "a", "b")
+	path := serveControl(t, &control{instances: a.instances})
+	for _, tt := range []struct {
+		name   string
+		req    controlRequest
+		states []maintenanceState
+		err    string
+	}{
+		{name: "status", req: controlRequest{Command: "maintenance"}, states: []maintenanceState{{Instance: "a"}, {Instance: "b"}}},
+		{name: "on", req: controlRequest{Command: "maintenance", Instance: "a", Maintenance: &maintenanceState{Enabled: true, Allow: []string{"10.0.0.0/8"}}}, states: []maintenanceState{{Instance: "a", Enabled: true, Allow: []string{"10.0.0.0/8"}}}},
+		{name: "status after on", req: controlRequest{Command: "maintenance"}, states: []maintenanceState{{Instance: "a", Enabled: true, Allow: []string{"10.0.0.0/8"}}, {Instance: "b"}}},
+		{name: "invalid network", req: controlRequest{Command: "maintenance", Maintenance: &maintenanceState{Enabled: true, Allow: []string{"10.0.0"}}}, err: "10.0.0"},
+		{name: "unknown instance", req: controlRequest{Command: "maintenance", Instance: "c"}, err: "c"},
+		{name: "off", req: controlRequest{Command: "maintenance", Maintenance: &maintenanceState{}}, states: []maintenanceState{{Instance: "a"}, {Instance: "b"}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := controlCall(path, tt.req)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resp.Maintenance, tt.states) {
+				t.Errorf("states %+v, want %+v", resp.Maintenance, tt.states)
+			}
+		})
+	}
+}
+
+func TestMaintenanceCmd(t *testing.T) {
+	a := testAdmin(true, "a", "b")
+	path := serveControl(t, &control{instances: a.instances})
+	for _, tt := range []struct {
+		args []string
+		code int
+		out  []string // lines of the output after the header.
+	}{
+		{args: []string{"status"}, out: []string{"a  off  false", "b  off  false"}},
+		{args: []string{"-instance", "b", "-allow", "10.0.0.0/8,192.0.2.0/24", "-close", "on"}, out: []string{"b  on  10.0.0.0/8,192.0.2.0/24  true"}},
+		{args: nil, out: []string{"a  off  false", "b  on  10.0.0.0/8,192.0.2.0/24  true"}},
+		{args: []string{"off"}, out: []string{"a  off  false", "b  off  false"}},
+		{args: []string{"-instance", "c"}, code: 1},
+		{args: []string{"restart"}, code: 2},
+	} {
+		var code int
+		out := captureStdout(t, func() {
+			code = maintenance(append([]string{"-control", path}, tt.args...))
+		})
+		if code != tt.code {
+			t.Errorf("%q: exit code %v, want %v", tt.args, code, tt.code)
+			continue
+		}
+		if code != 0 {
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		for i := range lines {
+			lines[i] = strings.Join(strings.Fields(lines[i]), "  ")
+		}
+		var want []string
+		for _, line := range tt.out {
+			want = append(want, strings.Join(strings.Fields(line), "  "))
+		}
+		if len(lines) == 0 || !reflect.DeepEqual(lines[1:], want) {
+			t.Errorf("%q: output %q, want %q", tt.args, lines, want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/cccxg/socks4"
+	"github.com/cccxg/socks4/adminpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// management serves the gRPC management API on the admin listener.
+type management struct {
+	adminpb.UnimplementedManagementServer
+	admin *admin
+}
+
+// grpcHandler returns the handler serving the management API to the gRPC
+// requests and passing the others to next.
+func (a *admin) grpcHandler(next http.Handler) http.Handler {
+	srv := grpc.NewServer(grpc.UnaryInterceptor(a.logCall))
+	adminpb.RegisterManagementServer(srv, &management{admin: a})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			srv.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logCall logs the management calls with the identity of the client
+// certificate.
+func (a *admin) logCall(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	client := "unknown"
+	if p, ok := peer.FromContext(ctx); ok {
+		client = p.Addr.String()
+		if ti, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(ti.State.PeerCertificates) > 0 {
+			client = socks4.CertIdentity(ti.State.PeerCertificates[0])
+		}
+	}
+	resp, err := handler(ctx, req)
+	if err != nil {
+		a.logger.Warnf("management call %v by %v: %v", info.FullMethod, client, err)
+	} else {
+		a.logger.Infof("management call %v by %v", info.FullMethod, client)
+	}
+	return resp, err
+}
+
+func (m *management) selectInstances(name string) ([]*instance, error) {
+	instances, err := m.admin.named(name)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return instances, nil
+}
+
+func (m *management) GetStats(ctx context.Context, req *adminpb.GetStatsRequest) (*adminpb.Stats, error) {
+	instances, err := m.selectInstances(req.Instance)
+	if err != nil {
+		return nil, err
+	}
+	st := sumStats(instances)
+	var rules map[string]*adminpb.RuleStats
+	for id, rs := range st.Rules {
+		if rules == nil {
+			rules = make(map[string]*adminpb.RuleStats)
+		}
+		rules[id] = &adminpb.RuleStats{Matches: rs.Matches, Denied: rs.Denied}
+	}
+	return &adminpb.Stats{
+		StartTime:           timestamppb.New(st.StartTime),
+		Accepted:            st.Accepted,
+		Refused:             st.Refused,
+		Active:              int64(st.Active),
+		Established:         st.Established,
+		Failed:              st.Failed,
+		Tarpitted:           st.Tarpitted,
+		PendingBinds:        int64(st.PendingBinds),
+		AbortedBinds:        st.AbortedBinds,
+		ClientToRemoteBytes: st.ClientToRemoteBytes,
+		RemoteToClientBytes: st.RemoteToClientBytes,
+		Protocols:           st.Protocols,
+		Sniffed:             st.Sniffed,
+		Rejections:          st.Rejections,
+		Rules:               rules,
+	}, nil
+}
+
+func (m *management) ListSessions(ctx context.Context, req *adminpb.ListSessionsRequest) (*adminpb.ListSessionsResponse, error) {
+	instances, err := m.selectInstances(req.Instance)
+	if err != nil {
+		return nil, err
+	}
+	var resp adminpb.ListSessionsResponse
+	for _, ss := range instanceSessions(instances) {
+		resp.Sessions = append(resp.Sessions, &adminpb.Session{
+			Instance:            ss.Instance,
+			Id:                  ss.ID,
+			Client:              ss.Client,
+			Cmd:                 ss.Cmd,
+			Target:              ss.Target,
+			UserId:              ss.UserId,
+			Identity:            ss.Identity,
+			SniffedHost:         ss.SniffedHost,
+			Remote:              ss.Remote,
+			Labels:              ss.Labels,
+			Start:               timestamppb.New(ss.Start),
+			LastActivity:        timestamppb.New(ss.LastActivity),
+			ClientToRemoteBytes: ss.ClientToRemote,
+			RemoteToClientBytes: ss.RemoteToClient,
+		})
+	}
+	return &resp, nil
+}
+
+func (m *management) KillSession(ctx context.Context, req *adminpb.KillSessionRequest) (*adminpb.KillSessionResponse, error) {
+	// the session IDs are unique within an instance.
+	inst, err := findInstance(m.admin.instances, req.Instance)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if !inst.srv.KillSession(req.Id) {
+		return nil, status.Errorf(codes.NotFound, "session %v not found", req.Id)
+	}
+	return &adminpb.KillSessionResponse{}, nil
+}
+
+func (m *management) SetLogLevel(ctx context.Context, req *adminpb.SetLogLevelRequest) (*adminpb.SetLogLevelResponse, error) {
+	if err := setLogLevel(m.admin.instances, m.admin.logs, req.Subsystem, req.Level); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return &adminpb.SetLogLevelResponse{}, nil
+}
+
+func (m *management) ReloadRules(ctx context.Context, req *adminpb.ReloadRulesRequest) (*adminpb.ReloadRulesResponse, error) {
+	_, n, err := reloadConfig(m.admin.instances, m.admin.args, m.admin.logger)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return &adminpb.ReloadRulesResponse{Rules: int64(n)}, nil
+}
+
+func (m *management) SetMaintenance(ctx context.Context, req *adminpb.SetMaintenanceRequest) (*adminpb.SetMaintenanceResponse, error) {
+	instances, err := m.selectInstances(req.Instance)
+	if err != nil {
+		return nil, err
+	}
+	st := maintenanceState{Enabled: req.Enabled, Allow: req.Allow, Close: req.Close}
+	if err := setMaintenance(instances, st); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	var resp adminpb.SetMaintenanceResponse
+	for _, st := range maintenanceStates(instances) {
+		resp.States = append(resp.States, &adminpb.MaintenanceState{
+			Instance: st.Instance,
+			Enabled:  st.Enabled,
+			Allow:    st.Allow,
+			Close:    st.Close,
+		})
+	}
+	return &resp, nil
+}
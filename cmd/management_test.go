@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cccxg/socks4"
+	"github.com/cccxg/socks4/adminpb"
+	"github.com/cccxg/socks4/testutil"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+// adminPKI writes the certificate of an admin server for 127.0.0.1 and the
+// CA of its clients in dir, and returns their configuration with the TLS
+// configuration of a client named ops.
+func adminPKI(t *testing.T, dir string) (tlsConfig, *tls.Config) {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "admin CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	issue := func(serial int64, cn string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	}
+	cfg := tlsConfig{Cert: filepath.Join(dir, "admin.pem"), Key: filepath.Join(dir, "admin.key"), ClientCA: filepath.Join(dir, "ca.pem")}
+	certPEM, keyPEM := issue(2, "admin", x509.ExtKeyUsageServerAuth)
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	for path, b := range map[string][]byte{cfg.Cert: certPEM, cfg.Key: keyPEM, cfg.ClientCA: caPEM} {
+		if err := os.WriteFile(path, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clientPEM, clientKeyPEM := issue(3, "ops", x509.ExtKeyUsageClientAuth)
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return cfg, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}
+}
+
+// syncBuffer is a buffer safe for concurrent use.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestManagement(t *testing.T) {
+	os.Unsetenv("SOCKS4_CONFIG")
+	dir := t.TempDir()
+	serverTLS, clientTLS := adminPKI(t, dir)
+	var log syncBuffer
+	logger := &logrus.Logger{Out: &log, Formatter: &logrus.TextFormatter{}, Level: logrus.InfoLevel}
+	echo, err := testutil.NewEchoServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	a, addr := serveInstance(t, "a")
+	b, _ := serveInstance(t, "b")
+	config := writeConfig(t, "socks4.yaml", "instances:\n  - name: a\n    listen: [\"127.0.0.1:1080\"]\n    rules: [\"deny port 25\", \"allow\"]\n  - name: b\n    listen: [\"127.0.0.1:1081\"]\n")
+	logs := testHub()
+	logs.logger = &logrus.Logger{Out: io.Discard, Formatter: &logrus.TextFormatter{}}
+	adm := &admin{instances: []*instance{a, b}, logs: logs, logger: logger, args: []string{"-config", config}}
+	if adm.tls, err = serverTLS.load(nil, logger); err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go adm.serve(lis)
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(credentials.NewTLS(clientTLS)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := adminpb.NewManagementClient(conn)
+
+	session, err := socks4.NewDialer(addr, socks4.WithDialerUserId("alice"), socks4.WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	var id uint64
+	for _, ss := range a.srv.Sessions() {
+		id = ss.ID
+	}
+
+	for _, tt := range []struct {
+		name string
+		call func(ctx context.Context) (string, error)
+		want string // in the summary of the response.
+		code codes.Code
+	}{
+		{name: "stats", call: func(ctx context.Context) (string, error) {
+			st, err := client.GetStats(ctx, &adminpb.GetStatsRequest{})
+			return fmt.Sprintf("accepted %v established %v", st.GetAccepted(), st.GetEstablished()), err
+		}, want: "accepted 1 established 1"},
+		{name: "stats of an instance", call: func(ctx context.Context) (string, error) {
+			st, err := client.GetStats(ctx, &adminpb.GetStatsRequest{Instance: "b"})
+			return fmt.Sprintf("accepted %v", st.GetAccepted()), err
+		}, want: "accepted 0"},
+		{name: "stats of an unknown instance", call: func(ctx context.Context) (string, error) {
+			_, err := client.GetStats(ctx, &adminpb.GetStatsRequest{Instance: "c"})
+			return "", err
+		}, code: codes.NotFound},
+		{name: "sessions", call: func(ctx context.Context) (string, error) {
+			resp, err := client.ListSessions(ctx, &adminpb.ListSessionsRequest{})
+			var list []string
+			for _, ss := range resp.GetSessions() {
+				list = append(list, fmt.Sprintf("%v/%v %v to %v", ss.Instance, ss.Id, ss.UserId, ss.Target))
+			}
+			return strings.Join(list, ","), err
+		}, want: fmt.Sprintf("a/%v alice to %v", id, echo.Addr)},
+		{name: "kill an unknown session", call: func(ctx context.Context) (string, error) {
+			_, err := client.KillSession(ctx, &adminpb.KillSessionRequest{Instance: "a", Id: id + 1})
+			return "", err
+		}, code: codes.NotFound},
+		{name: "kill without instance", call: func(ctx context.Context) (string, error) {
+			_, err := client.KillSession(ctx, &adminpb.KillSessionRequest{Id: id})
+			return "", err
+		}, code: codes.NotFound},
+		{name: "kill", call: func(ctx context.Context) (string, error) {
+			_, err := client.KillSession(ctx, &adminpb.KillSessionRequest{Instance: "a", Id: id})
+			return "", err
+		}},
+		{name: "log level", call: func(ctx context.Context) (string, error) {
+			_, err := client.SetLogLevel(ctx, &adminpb.SetLogLevelRequest{Level: "debug"})
+			return adm.logs.levels().Level, err
+		}, want: "debug"},
+		{name: "invalid log level", call: func(ctx context.Context) (string, error) {
+			_, err := client.SetLogLevel(ctx, &adminpb.SetLogLevelRequest{Level: "verbose"})
+			return "", err
+		}, code: codes.InvalidArgument},
+		{name: "maintenance", call: func(ctx context.Context) (string, error) {
+			resp, err := client.SetMaintenance(ctx, &adminpb.SetMaintenanceRequest{Instance: "b", Enabled: true})
+			var list []string
+			for _, st := range resp.GetStates() {
+				list = append(list, fmt.Sprintf("%v %v", st.Instance, st.Enabled))
+			}
+			return strings.Join(list, ","), err
+		}, want: "b true"},
+		{name: "reload", call: func(ctx context.Context) (string, error) {
+			resp, err := client.ReloadRules(ctx, &adminpb.ReloadRulesRequest{})
+			return fmt.Sprintf("%v rules, %v in a", resp.GetRules(), len(a.srv.Config().Rules)), err
+		}, want: "2 rules, 2 in a"},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		got, err := tt.call(ctx)
+		cancel()
+		if status.Code(err) != tt.code {
+			t.Errorf("%v: error %v, want code %v", tt.name, err, tt.code)
+		} else if tt.code == codes.OK && !strings.Contains(got, tt.want) {
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+	if want := "management call /socks4.admin.v1.Management/KillSession by ops"; !strings.Contains(log.String(), want) {
+		t.Errorf("log without %q: %q", want, log.String())
+	}
+
+	// the HTTP endpoints are served with TLS too.
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+	resp, err := httpClient.Get("https://" + lis.Addr().String() + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("health status %v", resp.Status)
+	}
+	// the clients need a certificate.
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: clientTLS.RootCAs}}}
+	if resp, err := anonymous.Get("https://" + lis.Addr().String() + "/healthz"); err == nil {
+		resp.Body.Close()
+		t.Error("admin served without a client certificate")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cccxg/socks4"
+)
+
+// writeMetrics writes the stats of the instances in the Prometheus text
+// exposition format. The samples of named instances have an instance label.
+func writeMetrics(w io.Writer, instances []*instance) {
+	stats := make([]socks4.Stats, len(instances))
+	for i, inst := range instances {
+		stats[i] = inst.srv.Stats()
+	}
+	// labelSet adds the instance label of the stats i to the labels.
+	labelSet := func(i int, labels string) string {
+		if inst := instances[i].name; inst != "" {
+			labels = strings.TrimPrefix(labels+fmt.Sprintf(`,instance=%q`, inst), ",")
+		}
+		if labels != "" {
+			labels = "{" + labels + "}"
+		}
+		return labels
+	}
+	metric := func(name, typ, help string, samples func(st socks4.Stats, sample func(labels string, v any))) {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+		for i, st := range stats {
+			samples(st, func(labels string, v any) {
+				fmt.Fprintf(w, "%v%v %v\n", name, labelSet(i, labels), v)
+			})
+		}
+	}
+	histogram := func(name, help string, get func(st socks4.Stats) socks4.Histogram) {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v histogram\n", name, help, name)
+		for i, st := range stats {
+			h := get(st)
+			var cumulative uint64
+			for j, bound := range h.Buckets {
+				cumulative += h.Counts[j]
+				fmt.Fprintf(w, "%v_bucket%v %v\n", name, labelSet(i, fmt.Sprintf(`le="%v"`, bound.Seconds())), cumulative)
+			}
+			fmt.Fprintf(w, "%v_bucket%v %v\n", name, labelSet(i, `le="+Inf"`), h.Count)
+			fmt.Fprintf(w, "%v_sum%v %v\n", name, labelSet(i, ""), h.Sum.Seconds())
+			fmt.Fprintf(w, "%v_count%v %v\n", name, labelSet(i, ""), h.Count)
+		}
+	}
+
+	metric("socks4_start_time_seconds", "gauge", "Start time of the server since unix epoch in seconds.",
+		func(st socks4.Stats, sample func(string, any)) {
+			sample("", float64(st.StartTime.UnixNano())/1e9)
+		})
+	metric("socks4_connections_accepted_total", "counter", "Client connections accepted.",
+		func(st socks4.Stats, sample func(string, any)) {
+			sample("", st.Accepted)
+		})
+	metric("socks4_connections_refused_total", "counter", "Client connections closed at accept by the limits.",
+		func(st socks4.Stats, sample func(string, any)) {
+			sample("", st.Refused)
+		})
+	metric("socks4_connections_active", "gauge", "Client connections being served.",
+		func(st socks4.Stats, sample func(string, any)) {
+			sample("", st.Active)
+		})
+	metric("socks4_connections_handshaking", "gauge", "Client connections in their handshake.",
+		func(st socks4.Stats, sample func(string, any)) {
+			sample("", st.Handshakes)
+		})
+	metric("socks4_relays_active", "gauge", "Relays, including the requests being dialed.",
+		func(st socks4.Stats, sample func(string, any)) {
+			sample("", st.Relays)
+		})
+	metric("socks4_requests_total", "counter", "Requests handled by result.",
+		func(st socks4.Stats, sample func(string, any)) {
+			sample(`result="established"`, st.Established)
+			sample(`result="failed"`, st.Failed)
+		})
+	metric("socks4_tarpitted_requests_total", "counter", "Requests of banned clients held by the tarpit.",
+		func(st socks4.Stats, sample func(string, any)) {
+			sample("", st.Tarpitted)
+		})
+	metric("socks4_binds_pending", "gauge", "BIND requests waiting for the connections of their remote hosts.",
+		func(st socks4.Stats, sample func(string, any)) {
+			sample("", st.PendingBinds)
+		})
+	metric("socks4_binds_aborted_total", "counter", "Pending BIND requests closed by the shutdown.",
+		func(st socks4.Stats, sample func(string, any)) {
+			sample("", st.AbortedBinds)
+		})
+	metric("socks4_relays_stalled_total", "counter", "Relay writes blocked longer than the stall timeout.",
+		func(st socks4.Stats, sample func(string, any)) {
+			sample("", st.Stalled)
+		})
+	metric("socks4_protocol_requests_total", "counter", "Requests read by protocol.",
+		func(st socks4.Stats, sample func(string, any)) {
+			protocols := make([]string, 0, len(st.Protocols))
+			for p := range st.Protocols {
+				protocols = append(protocols, p)
+			}
+			sort.Strings(protocols)
+			for _, p := range protocols {
+				sample(fmt.Sprintf(`protocol=%q`, p), st.Protocols[p])
+			}
+		})
+	metric("socks4_sniffed_relays_total", "counter", "Relays sniffed by protocol.",
+		func(st socks4.Stats, sample func(string, any)) {
+			protocols := make([]string, 0, len(st.Sniffed))
+			for p := range st.Sniffed {
+				protocols = append(protocols, p)
+			}
+			sort.Strings(protocols)
+			for _, p := range protocols {
+				sample(fmt.Sprintf(`protocol=%q`, p), st.Sniffed[p])
+			}
+		})
+	metric("socks4_rejections_total", "counter", "Failed requests by reason.",
+		func(st socks4.Stats, sample func(string, any)) {
+			reasons := make([]string, 0, len(st.Rejections))
+			for r := range st.Rejections {
+				reasons = append(reasons, r)
+			}
+			sort.Strings(reasons)
+			for _, r := range reasons {
+				sample(fmt.Sprintf(`reason=%q`, r), st.Rejections[r])
+			}
+		})
+	// ruleMetric writes a sample of every rule with a counter of the rules.
+	ruleMetric := func(name, help string, value func(rs socks4.RuleStats) uint64) {
+		metric(name, "counter", help, func(st socks4.Stats, sample func(string, any)) {
+			ids := make([]string, 0, len(st.Rules))
+			for id := range st.Rules {
+				ids = append(ids, id)
+			}
+			sort.Strings(ids)
+			for _, id := range ids {
+				sample(fmt.Sprintf(`rule=%q`, id), value(st.Rules[id]))
+			}
+		})
+	}
+	ruleMetric("socks4_rule_matches_total", "Requests decided by rule.",
+		func(rs socks4.RuleStats) uint64 { return rs.Matches })
+	ruleMetric("socks4_rule_denied_total", "Requests rejected and relays closed by rule.",
+		func(rs socks4.RuleStats) uint64 { return rs.Denied })
+	metric("socks4_relayed_bytes_total", "counter", "Bytes relayed by direction.",
+		func(st socks4.Stats, sample func(string, any)) {
+			sample(`direction="client_to_remote"`, st.ClientToRemoteBytes)
+			sample(`direction="remote_to_client"`, st.RemoteToClientBytes)
+		})
+	histogram("socks4_handshake_duration_seconds", "Time from the accept of the clients to their requests read.",
+		func(st socks4.Stats) socks4.Histogram { return st.HandshakeLatency })
+	histogram("socks4_dial_duration_seconds", "Time from the CONNECT requests read to their destinations connected.",
+		func(st socks4.Stats) socks4.Histogram { return st.DialLatency })
+	// probeMetric writes a sample of the instances with a probe.
+	probeMetric := func(name, typ, help string, value func(p *prober) any) {
+		fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, typ)
+		for i, inst := range instances {
+			if inst.probe != nil {
+				fmt.Fprintf(w, "%v%v %v\n", name, labelSet(i, ""), value(inst.probe))
+			}
+		}
+	}
+	probeMetric("socks4_probe_healthy", "gauge", "Whether the synthetic CONNECT probes succeed.",
+		func(p *prober) any {
+			if p.healthy() {
+				return 1
+			}
+			return 0
+		})
+	probeMetric("socks4_probe_failures_total", "counter", "Synthetic CONNECT probes failed.",
+		func(p *prober) any { return p.failures.Load() })
+	probeMetric("socks4_probe_duration_seconds", "gauge", "Duration of the last successful synthetic CONNECT probe.",
+		func(p *prober) any { return time.Duration(p.duration.Load()).Seconds() })
+	metric("socks4_labeled_requests_total", "counter", "Requests handled by session labels and result.",
+		func(st socks4.Stats, sample func(string, any)) {
+			for _, l := range st.Labeled {
+				sample(labelPairs(l.Labels, "result")+`result="established"`, l.Established)
+				sample(labelPairs(l.Labels, "result")+`result="failed"`, l.Failed)
+			}
+		})
+	metric("socks4_labeled_relayed_bytes_total", "counter", "Bytes relayed by session labels and direction.",
+		func(st socks4.Stats, sample func(string, any)) {
+			for _, l := range st.Labeled {
+				sample(labelPairs(l.Labels, "direction")+`direction="client_to_remote"`, l.ClientToRemoteBytes)
+				sample(labelPairs(l.Labels, "direction")+`direction="remote_to_client"`, l.RemoteToClientBytes)
+			}
+		})
+}
+
+// labelPairs formats the session labels as metric labels followed by a
+// comma, ordered by name. Those named like the label of the metric itself
+// or the instance label are left out.
+func labelPairs(labels map[string]string, metricLabel string) string {
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		if k != metricLabel && k != "instance" {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&b, "%v=%q,", k, labels[k])
+	}
+	return b.String()
+}
+
+func (a *admin) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	writeMetrics(w, a.instances)
+}
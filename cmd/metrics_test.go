@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cccxg/socks4"
+	"github.com/cccxg/socks4/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+// sampleLine matches a sample of the Prometheus text format.
+var sampleLine = regexp.MustCompile(`^([a-z0-9_]+)(\{([a-z0-9_]+="[^"]*",?)+\})? [0-9.e+-]+$`)
+
+func TestWriteMetrics(t *testing.T) {
+	logger := &logrus.Logger{Out: io.Discard, Formatter: &logrus.TextFormatter{}}
+	for _, tt := range []struct {
+		name    string
+		names   []string // of the instances.
+		samples []string
+	}{
+		{
+			name:  "single instance",
+			names: []string{""},
+			samples: []string{
+				"socks4_connections_accepted_total 0",
+				`socks4_requests_total{result="established"} 0`,
+				`socks4_handshake_duration_seconds_bucket{le="+Inf"} 0`,
+				`socks4_relayed_bytes_total{direction="client_to_remote"} 0`,
+				"socks4_tarpitted_requests_total 0",
+				"socks4_binds_pending 0",
+				"socks4_binds_aborted_total 0",
+				"socks4_relays_stalled_total 0",
+				"socks4_connections_handshaking 0",
+				"socks4_relays_active 0",
+			},
+		},
+		{
+			name:  "named instances",
+			names: []string{"a", "b"},
+			samples: []string{
+				`socks4_connections_accepted_total{instance="a"} 0`,
+				`socks4_connections_accepted_total{instance="b"} 0`,
+				`socks4_requests_total{result="failed",instance="b"} 0`,
+				`socks4_dial_duration_seconds_bucket{le="0.001",instance="a"} 0`,
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var instances []*instance
+			for _, name := range tt.names {
+				instances = append(instances, &instance{name: name, srv: socks4.NewServer(socks4.WithLogger(logger))})
+			}
+			var b bytes.Buffer
+			writeMetrics(&b, instances)
+			lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+			typed := make(map[string]bool)
+			for _, line := range lines {
+				if name, ok := strings.CutPrefix(line, "# TYPE "); ok {
+					typed[strings.Fields(name)[0]] = true
+					continue
+				}
+				if strings.HasPrefix(line, "# HELP ") {
+					continue
+				}
+				m := sampleLine.FindStringSubmatch(line)
+				if m == nil {
+					t.Errorf("line %q not in the text format", line)
+					continue
+				}
+				family := regexp.MustCompile(`_(bucket|sum|count)$`).ReplaceAllString(m[1], "")
+				if !typed[m[1]] && !typed[family] {
+					t.Errorf("sample %q before its type", line)
+				}
+			}
+			for _, sample := range tt.samples {
+				if !strings.Contains(b.String(), sample+"\n") {
+					t.Errorf("no sample %q in:\n%s", sample, b.String())
+				}
+			}
+		})
+	}
+}
+
+func TestLabelPairs(t *testing.T) {
+	for _, tt := range []struct {
+		labels map[string]string
+		metric string
+		pairs  string
+	}{
+		{nil, "result", ""},
+		{map[string]string{"team": "web", "env": "prod"}, "result", `env="prod",team="web",`},
+		{map[string]string{"result": "x", "instance": "y", "team": "web"}, "result", `team="web",`},
+		{map[string]string{"team": `a"b`}, "direction", `team="a\"b",`},
+	} {
+		if pairs := labelPairs(tt.labels, tt.metric); pairs != tt.pairs {
+			t.Errorf("labels %v of %v formatted as %q, want %q", tt.labels, tt.metric, pairs, tt.pairs)
+		}
+	}
+}
+
+func TestLabeledMetrics(t *testing.T) {
+	echo, err := testutil.NewEchoServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	rules, err := socks4.ParseRules(strings.NewReader("allow label team=web"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var instances []*instance
+	for _, name := range []string{"a", "b"} {
+		inst, addr := serveInstance(t, name, socks4.WithRules(rules))
+		instances = append(instances, inst)
+		conn, err := socks4.NewDialer(addr, socks4.WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	// the session of each instance is counted once established.
+	labeled := map[string]string{"team": "web"}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		sum := sumStats(instances)
+		if len(sum.Labeled) == 1 && sum.Labeled[0].Established == 2 {
+			if !reflect.DeepEqual(sum.Labeled[0].Labels, labeled) {
+				t.Errorf("labeled stats %+v, want the labels %v", sum.Labeled, labeled)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("labeled stats %+v, want the 2 sessions of the instances", sum.Labeled)
+		}
+	}
+
+	var b bytes.Buffer
+	writeMetrics(&b, instances)
+	for _, sample := range []string{
+		`socks4_labeled_requests_total{team="web",result="established",instance="a"} 1`,
+		`socks4_labeled_requests_total{team="web",result="established",instance="b"} 1`,
+		`socks4_labeled_requests_total{team="web",result="failed",instance="a"} 0`,
+	} {
+		if !strings.Contains(b.String(), sample+"\n") {
+			t.Errorf("no sample %q in:\n%s", sample, b.String())
+		}
+	}
+}
+
+func TestHistogramMetrics(t *testing.T) {
+	echo, err := testutil.NewEchoServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	a, addr := serveInstance(t, "a", socks4.WithLatencyBuckets(time.Minute, time.Hour))
+	b, _ := serveInstance(t, "b")
+	conn, err := socks4.NewDialer(addr, socks4.WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); a.srv.Stats().DialLatency.Count != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("dial not observed")
+		}
+	}
+	instances := []*instance{a, b}
+
+	// the buckets are cumulative.
+	var buf bytes.Buffer
+	writeMetrics(&buf, instances)
+	for _, sample := range []string{
+		`socks4_dial_duration_seconds_bucket{le="60",instance="a"} 1`,
+		`socks4_dial_duration_seconds_bucket{le="3600",instance="a"} 1`,
+		`socks4_dial_duration_seconds_bucket{le="+Inf",instance="a"} 1`,
+		`socks4_dial_duration_seconds_count{instance="a"} 1`,
+		`socks4_handshake_duration_seconds_count{instance="a"} 1`,
+		`socks4_dial_duration_seconds_bucket{le="0.001",instance="b"} 0`,
+		`socks4_dial_duration_seconds_count{instance="b"} 0`,
+	} {
+		if !strings.Contains(buf.String(), sample+"\n") {
+			t.Errorf("no sample %q in:\n%s", sample, buf.String())
+		}
+	}
+
+	// the histograms of the instances with other buckets are left out of
+	// the sum.
+	for _, tt := range []struct {
+		name      string
+		instances []*instance
+		buckets   []time.Duration
+		count     uint64
+	}{
+		{"same buckets", []*instance{a, a}, []time.Duration{time.Minute, time.Hour}, 2},
+		{"other buckets", []*instance{a, b}, []time.Duration{time.Minute, time.Hour}, 1},
+		{"other buckets first", []*instance{b, a}, socks4.DefaultLatencyBuckets, 0},
+	} {
+		sum := sumStats(tt.instances)
+		if h := sum.DialLatency; !reflect.DeepEqual(h.Buckets, tt.buckets) || h.Count != tt.count {
+			t.Errorf("%v: dial latency %+v, want %v observations in %v", tt.name, h, tt.count, tt.buckets)
+		}
+	}
+}
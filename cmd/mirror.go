@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"github.com/cccxg/socks4"
+)
+
+var (
+	pcapngMu    sync.Mutex
+	pcapngSinks = make(map[string]*socks4.PcapngSink)
+)
+
+// pcapngSink returns the sink appending to the pcapng file at path. It is
+// shared by the instances and reloads, which keep appending to the section
+// begun by the first one.
+func pcapngSink(path string) (*socks4.PcapngSink, error) {
+	pcapngMu.Lock()
+	defer pcapngMu.Unlock()
+	if sink, ok := pcapngSinks[path]; ok {
+		return sink, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	sink, err := socks4.NewPcapngSink(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	pcapngSinks[path] = sink
+	return sink, nil
+}
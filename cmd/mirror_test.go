@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPcapngSink(t *testing.T) {
+	dir := t.TempDir()
+	first, err := pcapngSink(filepath.Join(dir, "a.pcapng"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		path   string
+		shared bool
+		ok     bool
+	}{
+		{path: filepath.Join(dir, "a.pcapng"), shared: true, ok: true},
+		{path: filepath.Join(dir, "b.pcapng"), ok: true},
+		{path: filepath.Join(dir, "missing", "c.pcapng")},
+	} {
+		sink, err := pcapngSink(tt.path)
+		if (err == nil) != tt.ok || err == nil && (sink == first) != tt.shared {
+			t.Errorf("%v: sink shared %v with error %v, want shared %v", tt.path, sink == first, err, tt.shared)
+		}
+	}
+	// the section header is written once per file.
+	if b, err := os.ReadFile(filepath.Join(dir, "a.pcapng")); err != nil || len(b) != 48 {
+		t.Errorf("pcapng file of %v bytes, want the section and interface headers: %v", len(b), err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/cccxg/socks4"
+)
+
+// egressPoolConfig is an egress dialing through one of its members, like
+// the local IPs of the host for source IP rotation.
+type egressPoolConfig struct {
+	Name     string             `yaml:"name"`
+	Strategy string             `yaml:"strategy"` // round_robin (default), least_connections, sticky_user_id or sticky_client_ip.
+	Members  []poolMemberConfig `yaml:"members"`
+}
+
+// poolMemberConfig is a member of an egress pool, with one of its fields
+// set.
+type poolMemberConfig struct {
+	SourceIP string `yaml:"source_ip"`
+	Upstream string `yaml:"upstream"` // socks5://[user:password@]host:port
+	Egress   string `yaml:"egress"`   // name of an SSH egress or of a pool listed before.
+}
+
+var poolStrategies = map[string]socks4.PoolStrategy{
+	"":                  socks4.RoundRobin,
+	"round_robin":       socks4.RoundRobin,
+	"least_connections": socks4.LeastConnections,
+	"sticky_user_id":    socks4.StickyUserId,
+	"sticky_client_ip":  socks4.StickyClientIP,
+}
+
+// validate validates the pool, whose egress members must be in egresses.
+func (c *egressPoolConfig) validate(egresses map[string]bool) error {
+	if c.Name == "" {
+		return errors.New("no name")
+	}
+	if _, ok := poolStrategies[c.Strategy]; !ok {
+		return fmt.Errorf("unknown strategy %q", c.Strategy)
+	}
+	if len(c.Members) == 0 {
+		return errors.New("no members")
+	}
+	for i, m := range c.Members {
+		set := 0
+		if m.SourceIP != "" {
+			set++
+			if net.ParseIP(m.SourceIP) == nil {
+				return fmt.Errorf("member %v: invalid source IP %q", i, m.SourceIP)
+			}
+		}
+		if m.Upstream != "" {
+			set++
+			if _, _, _, err := parseUpstream(m.Upstream); err != nil {
+				return fmt.Errorf("member %v: %v", i, err)
+			}
+		}
+		if m.Egress != "" {
+			set++
+			if !egresses[m.Egress] {
+				return fmt.Errorf("member %v: unknown egress %v", i, m.Egress)
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("member %v: want one of source_ip, upstream and egress", i)
+		}
+	}
+	return nil
+}
+
+// option returns the option adding the pool, which is valid.
+func (c *egressPoolConfig) option() socks4.OptionFunc {
+	members := make([]socks4.PoolMember, len(c.Members))
+	for i, m := range c.Members {
+		members[i] = socks4.PoolMember{SourceIP: net.ParseIP(m.SourceIP), Egress: m.Egress}
+		if m.Upstream != "" {
+			members[i].Upstream, members[i].Username, members[i].Password, _ = parseUpstream(m.Upstream)
+		}
+	}
+	return socks4.WithEgressPool(c.Name, poolStrategies[c.Strategy], members...)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/cccxg/socks4"
+)
+
+// probeConfig configures the synthetic CONNECT requests sent by the binary
+// to its own listener, which catch the failures a TCP check misses, like
+// exhausted file descriptors or a broken egress.
+type probeConfig struct {
+	Target   string        `yaml:"target"`   // canary host:port connected through the proxy, no probe if empty.
+	UserId   string        `yaml:"user_id"`  // user id of the requests, to match them by the rules.
+	Interval time.Duration `yaml:"interval"` // 30s if 0.
+	Timeout  time.Duration `yaml:"timeout"`  // 5s if 0.
+	// Failures is the number of consecutive failed probes making the
+	// instance unready, 1 if 0.
+	Failures int `yaml:"failures"`
+}
+
+func (c *probeConfig) validate() error {
+	if c.Target == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(c.Target); err != nil {
+		return fmt.Errorf("invalid target %q: %v", c.Target, err)
+	}
+	if c.Interval < 0 || c.Timeout < 0 || c.Failures < 0 {
+		return errors.New("interval, timeout and failures must not be negative")
+	}
+	return nil
+}
+
+// prober probes an instance through its first listener.
+type prober struct {
+	cfg       probeConfig
+	useTLS    bool
+	wsPath    string
+	layer     socks4.Transport
+	logger    socks4.Logger
+	unhealthy atomic.Bool   // the last probes failed.
+	failures  atomic.Uint64 // failed probes.
+	duration  atomic.Int64  // duration of the last successful probe.
+}
+
+// newProber returns the prober of the configuration, nil if none.
+func newProber(c *probeConfig, useTLS bool, wsPath string, layer socks4.Transport, logger socks4.Logger) *prober {
+	if c.Target == "" {
+		return nil
+	}
+	p := &prober{cfg: *c, useTLS: useTLS, wsPath: wsPath, layer: layer, logger: logger}
+	if p.cfg.Interval == 0 {
+		p.cfg.Interval = 30 * time.Second
+	}
+	if p.cfg.Timeout == 0 {
+		p.cfg.Timeout = 5 * time.Second
+	}
+	if p.cfg.Failures == 0 {
+		p.cfg.Failures = 1
+	}
+	return p
+}
+
+// healthy reports whether the probes succeed.
+func (p *prober) healthy() bool {
+	return p == nil || !p.unhealthy.Load()
+}
+
+// run probes the listener address every interval until ctx is done.
+func (p *prober) run(ctx context.Context, addr net.Addr) {
+	d := p.dialer(addr)
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	failed := 0
+	for {
+		start := time.Now()
+		err := p.probe(ctx, d)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			p.failures.Add(1)
+			failed++
+			p.logger.Warnf("probe of %v through %v failed: %v", p.cfg.Target, addr, err)
+			if failed == p.cfg.Failures {
+				p.logger.Errorf("%v consecutive probes failed, the instance is not ready", failed)
+				p.unhealthy.Store(true)
+			}
+		} else {
+			p.duration.Store(int64(time.Since(start)))
+			if p.unhealthy.Load() {
+				p.logger.Infof("probe of %v succeeds again, the instance is ready", p.cfg.Target)
+			}
+			failed = 0
+			p.unhealthy.Store(false)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *prober) probe(ctx context.Context, d *socks4.Dialer) error {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", p.cfg.Target)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// dialer returns the dialer of the probes to the listener address, the
+// loopback one for the listeners on all the interfaces.
+func (p *prober) dialer(addr net.Addr) *socks4.Dialer {
+	host, port, _ := net.SplitHostPort(addr.String())
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+		if ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	proxy := net.JoinHostPort(host, port)
+	opts := []socks4.DialerOption{
+		socks4.WithDialerUserId(p.cfg.UserId),
+		socks4.WithDialerTimeout(p.cfg.Timeout),
+		socks4.WithDialerRejectReason(),
+	}
+	if p.useTLS {
+		// the probes check the service, not the certificate of the
+		// listener.
+		opts = append(opts, socks4.WithDialerTLS(&tls.Config{InsecureSkipVerify: true}))
+	}
+	if p.layer != nil {
+		opts = append(opts, socks4.WithDialerTransportLayer(p.layer))
+	}
+	if p.wsPath != "" {
+		scheme := "ws"
+		if p.useTLS {
+			scheme = "wss"
+		}
+		opts = append(opts, socks4.WithDialerWebSocket(scheme+"://"+proxy+p.wsPath))
+	}
+	return socks4.NewDialer(proxy, opts...)
+}
+
+// probesHealthy reports whether the probes of all the instances succeed.
+func probesHealthy(instances []*instance) bool {
+	for _, inst := range instances {
+		if !inst.probe.healthy() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cccxg/socks4"
+	"github.com/cccxg/socks4/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+func TestNewProber(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		cfg  probeConfig
+		want *probeConfig // nil for no prober.
+	}{
+		{name: "none"},
+		{name: "defaults", cfg: probeConfig{Target: "example.com:80"}, want: &probeConfig{Target: "example.com:80", Interval: 30 * time.Second, Timeout: 5 * time.Second, Failures: 1}},
+		{name: "set", cfg: probeConfig{Target: "example.com:80", UserId: "probe", Interval: time.Minute, Timeout: time.Second, Failures: 3}, want: &probeConfig{Target: "example.com:80", UserId: "probe", Interval: time.Minute, Timeout: time.Second, Failures: 3}},
+	} {
+		p := newProber(&tt.cfg, false, "", nil, nil)
+		if (p == nil) != (tt.want == nil) || p != nil && p.cfg != *tt.want {
+			t.Errorf("%v: prober %+v, want %+v", tt.name, p, tt.want)
+		}
+		if !p.healthy() {
+			t.Errorf("%v: unhealthy before any probe", tt.name)
+		}
+	}
+}
+
+func TestProber(t *testing.T) {
+	echo, err := testutil.NewEchoServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	for _, tt := range []struct {
+		name      string
+		rules     string
+		cfg       probeConfig // of the target of the echo server if none.
+		unhealthy bool        // before the probe.
+		proxy     func(addr *net.TCPAddr) net.Addr
+		failed    bool
+		healthy   bool
+		logged    string
+	}{
+		{name: "succeeded", rules: "allow", healthy: true},
+		{name: "denied", rules: "deny", failed: true, logged: "1 consecutive probes failed"},
+		{name: "denied before the failures", rules: "deny", cfg: probeConfig{Failures: 2}, failed: true, healthy: true, logged: "failed: "},
+		{name: "user id", rules: "allow user probe\ndeny", cfg: probeConfig{UserId: "probe"}, healthy: true},
+		{name: "recovered", rules: "allow", unhealthy: true, healthy: true, logged: "succeeds again"},
+		{name: "all interfaces", rules: "allow", proxy: func(addr *net.TCPAddr) net.Addr {
+			return &net.TCPAddr{IP: net.IPv4zero, Port: addr.Port}
+		}, healthy: true},
+		{name: "listener closed", rules: "allow", proxy: func(*net.TCPAddr) net.Addr { return closed.Addr() }, failed: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := socks4.ParseRules(strings.NewReader(tt.rules))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, addr := serveInstance(t, "", socks4.WithRules(rules))
+			var proxy net.Addr
+			if proxy, err = net.ResolveTCPAddr("tcp", addr); err != nil {
+				t.Fatal(err)
+			}
+			if tt.proxy != nil {
+				proxy = tt.proxy(proxy.(*net.TCPAddr))
+			}
+			var log syncBuffer
+			cfg := tt.cfg
+			cfg.Target = echo.Addr
+			// a single probe before the interval.
+			cfg.Interval = time.Hour
+			p := newProber(&cfg, false, "", nil, &logrus.Logger{Out: &log, Formatter: &logrus.TextFormatter{}, Level: logrus.InfoLevel})
+			p.unhealthy.Store(tt.unhealthy)
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				p.run(ctx, proxy)
+			}()
+			for deadline := time.Now().Add(5 * time.Second); p.failures.Load() == 0 && p.duration.Load() == 0; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatal("not probed")
+				}
+			}
+			cancel()
+			<-done
+
+			if p.healthy() != tt.healthy {
+				t.Errorf("healthy %v after %v failures, want %v", p.healthy(), p.failures.Load(), tt.healthy)
+			}
+			if failed := p.failures.Load() != 0; failed != tt.failed || failed == (p.duration.Load() != 0) {
+				t.Errorf("%v failures and a duration of %v, want failed %v", p.failures.Load(), time.Duration(p.duration.Load()), tt.failed)
+			}
+			if !strings.Contains(log.String(), tt.logged) {
+				t.Errorf("logged %q, want %q", log.String(), tt.logged)
+			}
+		})
+	}
+}
+
+func TestProbeReadiness(t *testing.T) {
+	healthy := &instance{name: "a", probe: newProber(&probeConfig{Target: "example.com:80"}, false, "", nil, nil)}
+	unhealthy := &instance{name: "b", probe: newProber(&probeConfig{Target: "example.com:80"}, false, "", nil, nil)}
+	unhealthy.probe.unhealthy.Store(true)
+	unhealthy.probe.failures.Store(2)
+	for _, tt := range []struct {
+		name      string
+		instances []*instance
+		path      string
+		status    int
+		body      string // in the body.
+	}{
+		{name: "healthy", instances: []*instance{healthy}, path: "/readyz", status: http.StatusOK, body: "ok"},
+		{name: "without probe", instances: []*instance{{name: "c"}}, path: "/readyz", status: http.StatusOK, body: "ok"},
+		{name: "unhealthy", instances: []*instance{healthy, unhealthy}, path: "/readyz", status: http.StatusServiceUnavailable, body: "probe failed"},
+		{name: "healthy metric", instances: []*instance{healthy, unhealthy}, path: "/metrics", status: http.StatusOK, body: `socks4_probe_healthy{instance="a"} 1` + "\n"},
+		{name: "unhealthy metric", instances: []*instance{healthy, unhealthy}, path: "/metrics", status: http.StatusOK, body: `socks4_probe_healthy{instance="b"} 0` + "\n"},
+		{name: "failures metric", instances: []*instance{healthy, unhealthy}, path: "/metrics", status: http.StatusOK, body: `socks4_probe_failures_total{instance="b"} 2` + "\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			adm := testAdmin(true)
+			for _, inst := range tt.instances {
+				if inst.srv == nil {
+					inst.srv = socks4.NewServer(socks4.WithLogger(adm.logger))
+				}
+			}
+			adm.instances = tt.instances
+			if status, body := get(adm.handler(), http.MethodGet, tt.path); status != tt.status || !strings.Contains(body, tt.body) {
+				t.Errorf("GET %v: %v %q, want %v with %q", tt.path, status, body, tt.status, tt.body)
+			}
+		})
+	}
+}
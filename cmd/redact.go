@@ -0,0 +1,74 @@
+package main
+
+import "net/url"
+
+// redactedSecret replaces the secrets of the printed configurations.
+const redactedSecret = "REDACTED"
+
+// redact replaces the secret, if set.
+func redact(secret *string) {
+	if *secret != "" {
+		*secret = redactedSecret
+	}
+}
+
+// redactURL returns the URL with its password, if any, replaced.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	if _, ok := u.User.Password(); !ok {
+		return raw
+	}
+	u.User = url.UserPassword(u.User.Username(), redactedSecret)
+	return u.String()
+}
+
+// redacted returns a copy of the configuration whose secrets are replaced,
+// to be printed.
+func (c config) redacted() config {
+	c.proxyConfig = c.proxyConfig.redacted()
+	if c.Instances != nil {
+		instances := make([]instanceConfig, len(c.Instances))
+		for i, inst := range c.Instances {
+			inst.proxyConfig = inst.proxyConfig.redacted()
+			instances[i] = inst
+		}
+		c.Instances = instances
+	}
+	return c
+}
+
+func (c proxyConfig) redacted() proxyConfig {
+	c.Upstream = redactURL(c.Upstream)
+	redact(&c.ObfsKey)
+	redact(&c.JWT.Secret)
+	redact(&c.LDAP.BindPassword)
+	redact(&c.Store.Password)
+	c.Store.Redis = redactURL(c.Store.Redis)
+	redact(&c.Webhook.Secret)
+	redact(&c.RulesSource.Token)
+	if c.SSHEgress != nil {
+		ssh := make([]sshEgressConfig, len(c.SSHEgress))
+		for i, e := range c.SSHEgress {
+			redact(&e.Password)
+			ssh[i] = e
+		}
+		c.SSHEgress = ssh
+	}
+	if c.EgressPools != nil {
+		pools := make([]egressPoolConfig, len(c.EgressPools))
+		for i, p := range c.EgressPools {
+			members := make([]poolMemberConfig, len(p.Members))
+			for j, m := range p.Members {
+				m.Upstream = redactURL(m.Upstream)
+				members[j] = m
+			}
+			p.Members = members
+			pools[i] = p
+		}
+		c.EgressPools = pools
+	}
+	return c
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/cccxg/socks4"
+)
+
+// rulesSourceConfig is the backend watched for the rules of an instance,
+// which replace the ACL file and the inline rules once read.
+type rulesSourceConfig struct {
+	Consul string `yaml:"consul"` // URL of the Consul agent, like http://127.0.0.1:8500.
+	Etcd   string `yaml:"etcd"`   // URL of the etcd server, like http://127.0.0.1:2379.
+	Key    string `yaml:"key"`    // key of the rules.
+	Token  string `yaml:"token"`  // ACL token of Consul or auth token of etcd.
+}
+
+func (c *rulesSourceConfig) validate() error {
+	if c.Consul == "" && c.Etcd == "" {
+		return nil
+	}
+	if c.Consul != "" && c.Etcd != "" {
+		return errors.New("want one of consul and etcd")
+	}
+	if c.Key == "" {
+		return errors.New("no key")
+	}
+	for _, s := range []string{c.Consul, c.Etcd} {
+		if u, err := url.Parse(s); s != "" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			return fmt.Errorf("invalid URL %q", s)
+		}
+	}
+	return nil
+}
+
+// source returns the source of the rules, nil if none.
+func (c *rulesSourceConfig) source() socks4.RuleSource {
+	options := socks4.RuleSourceOptions{Token: c.Token}
+	switch {
+	case c.Consul != "":
+		return socks4.NewConsulRuleSource(c.Consul, c.Key, options)
+	case c.Etcd != "":
+		return socks4.NewEtcdRuleSource(c.Etcd, c.Key, options)
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRulesSourceConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		config rulesSourceConfig
+		source string // type of the source, none if empty.
+		err    string // in the error, valid if empty.
+	}{
+		{name: "none"},
+		{name: "Consul", config: rulesSourceConfig{Consul: "http://127.0.0.1:8500", Key: "socks4/rules"}, source: "*socks4.ConsulRuleSource"},
+		{name: "etcd", config: rulesSourceConfig{Etcd: "https://etcd.example.com:2379", Key: "socks4/rules", Token: "secret"}, source: "*socks4.EtcdRuleSource"},
+		{name: "both", config: rulesSourceConfig{Consul: "http://127.0.0.1:8500", Etcd: "http://127.0.0.1:2379", Key: "socks4/rules"}, err: "want one of consul and etcd"},
+		{name: "no key", config: rulesSourceConfig{Consul: "http://127.0.0.1:8500"}, err: "no key"},
+		{name: "invalid scheme", config: rulesSourceConfig{Etcd: "grpc://127.0.0.1:2379", Key: "socks4/rules"}, err: "invalid URL"},
+		{name: "no host", config: rulesSourceConfig{Consul: "http://", Key: "socks4/rules"}, err: "invalid URL"},
+	} {
+		err := tt.config.validate()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%v: error %v, want %q", tt.name, err, tt.err)
+			continue
+		}
+		if tt.err != "" {
+			continue
+		}
+		if src := tt.config.source(); tt.source == "" && src != nil || tt.source != "" && fmt.Sprintf("%T", src) != tt.source {
+			t.Errorf("%v: source %T, want %v", tt.name, src, tt.source)
+		}
+	}
+}
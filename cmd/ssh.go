@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshEgressConfig is an SSH server through which the rules with "via NAME"
+// send their CONNECT requests.
+type sshEgressConfig struct {
+	Name                  string `yaml:"name"`
+	Address               string `yaml:"address"` // host:port of the SSH server.
+	User                  string `yaml:"user"`
+	Key                   string `yaml:"key"` // path of the private key.
+	Password              string `yaml:"password"`
+	KnownHosts            string `yaml:"known_hosts"` // path of the known_hosts file verifying the server.
+	InsecureIgnoreHostKey bool   `yaml:"insecure_ignore_host_key"`
+}
+
+func (c *sshEgressConfig) validate() error {
+	if c.Name == "" {
+		return errors.New("no name")
+	}
+	if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		return fmt.Errorf("invalid address %q: %v", c.Address, err)
+	}
+	if c.User == "" {
+		return errors.New("no user")
+	}
+	if c.Key == "" && c.Password == "" {
+		return errors.New("no key or password")
+	}
+	if c.KnownHosts == "" && !c.InsecureIgnoreHostKey {
+		return errors.New("no known_hosts file verifying the server")
+	}
+	_, err := c.clientConfig()
+	return err
+}
+
+// clientConfig returns the SSH client configuration of the egress.
+func (c *sshEgressConfig) clientConfig() (*ssh.ClientConfig, error) {
+	config := &ssh.ClientConfig{User: c.User}
+	if c.Key != "" {
+		b, err := os.ReadFile(c.Key)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", c.Key, err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if c.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(c.Password))
+	}
+	if c.KnownHosts != "" {
+		callback, err := knownhosts.New(c.KnownHosts)
+		if err != nil {
+			return nil, err
+		}
+		config.HostKeyCallback = callback
+	} else {
+		config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+	return config, nil
+}
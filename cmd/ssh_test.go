@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHEgressConfig(t *testing.T) {
+	dir := t.TempDir()
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	os.WriteFile(keyFile, pem.EncodeToMemory(block), 0o600)
+	sshPub, _ := ssh.NewPublicKey(pub)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	os.WriteFile(knownHosts, []byte("bastion.example.com "+string(ssh.MarshalAuthorizedKey(sshPub))), 0o600)
+	notKey := filepath.Join(dir, "not_a_key")
+	os.WriteFile(notKey, []byte("not a key"), 0o600)
+
+	valid := sshEgressConfig{Name: "bastion", Address: "bastion.example.com:22", User: "socks4", Key: keyFile, KnownHosts: knownHosts}
+	for _, tt := range []struct {
+		name   string
+		modify func(c *sshEgressConfig)
+		auths  int
+		err    string // in the error, none if empty.
+	}{
+		{name: "key", modify: func(c *sshEgressConfig) {}, auths: 1},
+		{name: "key and password", modify: func(c *sshEgressConfig) { c.Password = "secret" }, auths: 2},
+		{name: "password without host key check", modify: func(c *sshEgressConfig) {
+			c.Key = ""
+			c.Password = "secret"
+			c.KnownHosts = ""
+			c.InsecureIgnoreHostKey = true
+		}, auths: 1},
+		{name: "no name", modify: func(c *sshEgressConfig) { c.Name = "" }, err: "no name"},
+		{name: "no port", modify: func(c *sshEgressConfig) { c.Address = "bastion.example.com" }, err: "invalid address"},
+		{name: "no user", modify: func(c *sshEgressConfig) { c.User = "" }, err: "no user"},
+		{name: "no key or password", modify: func(c *sshEgressConfig) { c.Key = "" }, err: "no key or password"},
+		{name: "no host key check", modify: func(c *sshEgressConfig) { c.KnownHosts = "" }, err: "no known_hosts"},
+		{name: "missing key", modify: func(c *sshEgressConfig) { c.Key = filepath.Join(dir, "missing") }, err: "no such file"},
+		{name: "invalid key", modify: func(c *sshEgressConfig) { c.Key = notKey }, err: "not_a_key"},
+		{name: "missing known hosts", modify: func(c *sshEgressConfig) { c.KnownHosts = filepath.Join(dir, "missing") }, err: "no such file"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			c := valid
+			tt.modify(&c)
+			err := c.validate()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			config, err := c.clientConfig()
+			if err != nil || config.User != c.User || len(config.Auth) != tt.auths || config.HostKeyCallback == nil {
+				t.Errorf("client config %+v: %v, want %v authentication methods", config, err, tt.auths)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.socket")
+	abstract := "@socks4-test-" + strconv.Itoa(os.Getpid())
+	for _, tt := range []struct {
+		name   string
+		socket string // NOTIFY_SOCKET, not notified if empty.
+		listen string // address listened to.
+	}{
+		{name: "not under systemd"},
+		{name: "path", socket: path, listen: path},
+		{name: "abstract socket", socket: abstract, listen: "\x00" + abstract[1:]},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.listen != "" && tt.listen[0] == 0 && runtime.GOOS != "linux" {
+				t.Skip("abstract sockets are of Linux")
+			}
+			t.Setenv("NOTIFY_SOCKET", tt.socket)
+			var conn *net.UnixConn
+			if tt.listen != "" {
+				var err error
+				if conn, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: tt.listen, Net: "unixgram"}); err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+			}
+			if err := sdNotify("READY=1"); err != nil {
+				t.Fatal(err)
+			}
+			if conn == nil {
+				return
+			}
+			b := make([]byte, 64)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := conn.Read(b)
+			if err != nil || string(b[:n]) != "READY=1" {
+				t.Errorf("notified %q: %v, want READY=1", b[:n], err)
+			}
+		})
+	}
+}
+
+func TestSdNotifyUnreachable(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "none.socket"))
+	if err := sdNotify("READY=1"); err == nil {
+		t.Error("notified a missing socket")
+	}
+}
+
+func TestSystemdListenersNotActivated(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		pid  string
+		fds  string
+	}{
+		{name: "no environment"},
+		{name: "other process", pid: strconv.Itoa(os.Getpid() + 1), fds: "1"},
+		{name: "no fds", pid: strconv.Itoa(os.Getpid()), fds: "0"},
+		{name: "invalid fds", pid: strconv.Itoa(os.Getpid()), fds: "x"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("LISTEN_PID", tt.pid)
+			t.Setenv("LISTEN_FDS", tt.fds)
+			listeners, names, err := systemdListeners()
+			if listeners != nil || names != nil || err != nil {
+				t.Errorf("listeners %v %v and error %v, want none", listeners, names, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tail streams the log entries up to level to conn as JSON lines, until
+// the connection is closed by the client.
+func (c *control) tail(conn net.Conn, levelName string) {
+	level := logrus.DebugLevel
+	if levelName != "" {
+		var err error
+		if level, err = logrus.ParseLevel(levelName); err != nil {
+			json.NewEncoder(conn).Encode(controlResponse{Error: err.Error()})
+			return
+		}
+	}
+	sub := c.logs.subscribe(level)
+	defer c.logs.unsubscribe(sub)
+
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+	enc := json.NewEncoder(conn)
+	for {
+		select {
+		case <-closed:
+			return
+		case e := <-sub.entries:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// tailCmd prints the log entries of a running server in real time.
+func tailCmd(args []string) int {
+	fs, path := newControlFlagSet("socks4 tail")
+	levelName := fs.String("level", "debug", "print the entries up to this level")
+	asJSON := fs.Bool("json", false, "print the entries as JSON lines")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	if _, err := logrus.ParseLevel(*levelName); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	conn, err := net.Dial("unix", *path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer conn.Close()
+	if err := json.NewEncoder(conn).Encode(controlRequest{Command: "tail", Level: *levelName}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		if *asJSON {
+			fmt.Println(scanner.Text())
+			continue
+		}
+		var e struct {
+			logEntry
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if e.Error != "" {
+			fmt.Fprintln(os.Stderr, e.Error)
+			return 1
+		}
+		fmt.Println(formatLogEntry(e.logEntry))
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func formatLogEntry(e logEntry) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v %-7v %v", e.Time.Local().Format(time.DateTime), strings.ToUpper(e.Level), e.Message)
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %v=%v", k, e.Fields[k])
+	}
+	return b.String()
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fileHub returns a hub of the level writing to a temporary file, and the
+// path of the file.
+func fileHub(t *testing.T, level string) (*logHub, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "socks4.log")
+	h, err := newLogger(&logConfig{Level: level, Format: "text", Output: "file", File: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.file.f.Close() })
+	return h, path
+}
+
+func TestLogHubSubscribe(t *testing.T) {
+	h, path := fileHub(t, "info")
+	debug := h.subscribe(logrus.DebugLevel)
+	warn := h.subscribe(logrus.WarnLevel)
+	if h.logger.Level != logrus.DebugLevel {
+		t.Errorf("logger level %v with a debug subscriber, want debug", h.logger.Level)
+	}
+	h.logger.Debug("debug entry")
+	h.logger.WithField("client", "10.0.0.1").Info("info entry")
+	h.logger.Warn("warn entry")
+	for _, tt := range []struct {
+		name    string
+		sub     *logSub
+		entries []string
+	}{
+		{name: "debug", sub: debug, entries: []string{"debug entry", "info entry", "warn entry"}},
+		{name: "warn", sub: warn, entries: []string{"warn entry"}},
+	} {
+		var got []string
+		for len(tt.sub.entries) > 0 {
+			e := <-tt.sub.entries
+			got = append(got, e.Message)
+			if e.Message == "info entry" && e.Fields["client"] != "10.0.0.1" {
+				t.Errorf("%v subscriber got the fields %v", tt.name, e.Fields)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(tt.entries, ",") {
+			t.Errorf("%v subscriber got %q, want %q", tt.name, got, tt.entries)
+		}
+	}
+	// the output only gets the configured level.
+	b, _ := os.ReadFile(path)
+	if strings.Contains(string(b), "debug entry") || !strings.Contains(string(b), "info entry") {
+		t.Errorf("log file:\n%s", b)
+	}
+	h.unsubscribe(debug)
+	h.unsubscribe(warn)
+	if h.logger.Level != logrus.InfoLevel {
+		t.Errorf("logger level %v once unsubscribed, want info", h.logger.Level)
+	}
+}
+
+func TestLogHubDropsBehind(t *testing.T) {
+	h, _ := fileHub(t, "info")
+	sub := h.subscribe(logrus.InfoLevel)
+	defer h.unsubscribe(sub)
+	for i := 0; i < cap(sub.entries)+10; i++ {
+		h.logger.Info("entry")
+	}
+	if len(sub.entries) != cap(sub.entries) {
+		t.Errorf("%v entries queued, want %v", len(sub.entries), cap(sub.entries))
+	}
+}
+
+func TestControlTail(t *testing.T) {
+	h, _ := fileHub(t, "info")
+	path := serveControl(t, &control{logs: h, logger: h.logger})
+	for _, tt := range []struct {
+		name    string
+		level   string
+		entries []string
+		err     string
+	}{
+		{name: "warn", level: "warn", entries: []string{"warn entry", "error entry"}},
+		{name: "default level", entries: []string{"debug entry", "info entry", "warn entry", "error entry"}},
+		{name: "invalid level", level: "loud", err: "not a valid logrus Level"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			json.NewEncoder(conn).Encode(controlRequest{Command: "tail", Level: tt.level})
+			r := bufio.NewReader(conn)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if tt.err != "" {
+				var resp controlResponse
+				if err := json.NewDecoder(r).Decode(&resp); err != nil || !strings.Contains(resp.Error, tt.err) {
+					t.Fatalf("response %+v: %v, want %q", resp, err, tt.err)
+				}
+				return
+			}
+			// the entries are logged once subscribed.
+			waitSubscribers(t, h, 1)
+			defer waitSubscribers(t, h, 0)
+			defer conn.Close()
+			h.logger.Debug("debug entry")
+			h.logger.Info("info entry")
+			h.logger.Warn("warn entry")
+			h.logger.Error("error entry")
+			for _, want := range tt.entries {
+				var e logEntry
+				if err := json.NewDecoder(strings.NewReader(readLine(t, r))).Decode(&e); err != nil || e.Message != want {
+					t.Fatalf("entry %+v: %v, want %q", e, err, want)
+				}
+			}
+		})
+	}
+}
+
+// waitSubscribers waits for the hub to have n subscribers.
+func waitSubscribers(t *testing.T, h *logHub, n int) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+		h.mu.Lock()
+		subs := len(h.subs)
+		h.mu.Unlock()
+		if subs == n {
+			return
+		}
+	}
+	t.Fatalf("hub without %v subscribers", n)
+}
+
+func readLine(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func TestFormatLogEntry(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	for _, tt := range []struct {
+		entry logEntry
+		line  string
+	}{
+		{logEntry{Time: at, Level: "info", Message: "hello"}, "2024-05-01 12:00:00 INFO    hello"},
+		{logEntry{Time: at, Level: "warning", Message: "slow", Fields: map[string]any{"z": 1, "a": "x"}}, "2024-05-01 12:00:00 WARNING slow a=x z=1"},
+	} {
+		if line := formatLogEntry(tt.entry); line != tt.line {
+			t.Errorf("entry formatted as %q, want %q", line, tt.line)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cccxg/socks4"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certCheckInterval is the min interval of checking the certificate files
+// for changes.
+const certCheckInterval = 10 * time.Second
+
+// tlsConfig is the TLS configuration of the client connections of an
+// instance. TLS is enabled when the certificate is set or ACME is used.
+type tlsConfig struct {
+	Cert     string `yaml:"cert"`      // path of the PEM certificate chain.
+	Key      string `yaml:"key"`       // path of the PEM private key.
+	ClientCA string `yaml:"client_ca"` // path of the PEM CAs verifying client certificates.
+	// ClientCertOptional accepts clients without certificates when
+	// ClientCA is set.
+	ClientCertOptional bool `yaml:"client_cert_optional"`
+	// ACME gets the certificate from the ACME manager configured by the top
+	// level acme section.
+	ACME bool `yaml:"acme"`
+}
+
+// acmeConfig configures the provisioning and renewal of certificates by
+// ACME, e.g. from Let's Encrypt.
+type acmeConfig struct {
+	Domains      []string `yaml:"domains"`
+	Email        string   `yaml:"email"`
+	CacheDir     string   `yaml:"cache_dir"`     // directory keeping the account and certificates.
+	DirectoryURL string   `yaml:"directory_url"` // Let's Encrypt if empty.
+	// Challenge is "http-01" or "tls-alpn-01".
+	Challenge string `yaml:"challenge"`
+	// ChallengeAddress is the address of the auxiliary listener answering
+	// the challenges. Without it, tls-alpn-01 challenges are answered by
+	// the SOCKS listeners, which must then be reachable on port 443.
+	ChallengeAddress string `yaml:"challenge_address"`
+}
+
+func (c *tlsConfig) enabled() bool {
+	return c.Cert != "" || c.Key != "" || c.ACME
+}
+
+func (c *tlsConfig) validate() error {
+	if c.ACME {
+		if c.Cert != "" || c.Key != "" {
+			return errors.New("TLS certificate files and ACME are exclusive")
+		}
+	} else if _, err := newCertReloader(c.Cert, c.Key, nil); err != nil {
+		return err
+	}
+	if c.ClientCA != "" {
+		if _, err := loadCertPool(c.ClientCA); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load returns the server TLS configuration. The certificate files are
+// reloaded when they change, and acm provides the certificate with ACME.
+func (c *tlsConfig) load(acm *acmeManager, logger socks4.Logger) (*tls.Config, error) {
+	var config *tls.Config
+	if c.ACME {
+		if acm == nil {
+			return nil, errors.New("ACME is not configured")
+		}
+		config = acm.TLSConfig()
+		config.NextProtos = []string{acme.ALPNProto}
+		// clients connecting by IP send no server name, which the manager
+		// requires.
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName == "" {
+				h := *hello
+				h.ServerName = acm.defaultDomain
+				hello = &h
+			}
+			return acm.GetCertificate(hello)
+		}
+	} else {
+		r, err := newCertReloader(c.Cert, c.Key, logger)
+		if err != nil {
+			return nil, err
+		}
+		config = &tls.Config{GetCertificate: r.getCertificate}
+	}
+	config.MinVersion = tls.VersionTLS12
+	if c.ClientCA != "" {
+		var err error
+		if config.ClientCAs, err = loadCertPool(c.ClientCA); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if c.ClientCertOptional {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+	return config, nil
+}
+
+func (c *acmeConfig) validate() error {
+	if len(c.Domains) == 0 {
+		return errors.New("no ACME domains")
+	}
+	switch c.Challenge {
+	case "", "http-01", "tls-alpn-01":
+	default:
+		return fmt.Errorf("invalid ACME challenge %q", c.Challenge)
+	}
+	if c.ChallengeAddress != "" {
+		if _, _, err := net.SplitHostPort(c.ChallengeAddress); err != nil {
+			return fmt.Errorf("invalid ACME challenge address %q: %v", c.ChallengeAddress, err)
+		}
+	}
+	return nil
+}
+
+// acmeManager provides the certificates of the instances using ACME.
+type acmeManager struct {
+	*autocert.Manager
+	defaultDomain string // domain of the clients sending no server name.
+}
+
+// manager returns the ACME manager of the configuration.
+func (c *acmeConfig) manager() *acmeManager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.Domains...),
+		Email:      c.Email,
+	}
+	if c.CacheDir != "" {
+		m.Cache = autocert.DirCache(c.CacheDir)
+	}
+	if c.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: c.DirectoryURL}
+	}
+	return &acmeManager{Manager: m, defaultDomain: c.Domains[0]}
+}
+
+// serveACME answers the ACME challenges on the challenge address, until
+// the returned listener is closed. It returns nil if no auxiliary
+// listener is configured. The listener is taken from or added to h.
+func serveACME(c *acmeConfig, m *acmeManager, h *handoff, logger *logrus.Logger) (net.Listener, error) {
+	addr := c.ChallengeAddress
+	if addr == "" && c.Challenge != "tls-alpn-01" {
+		addr = ":80"
+	}
+	if addr == "" {
+		return nil, nil
+	}
+	lis, err := h.listen("acme", func() (net.Listener, error) { return net.Listen("tcp", addr) })
+	if err != nil {
+		return nil, err
+	}
+	if c.Challenge == "tls-alpn-01" {
+		logger.Infof("ACME tls-alpn-01 challenge server listen on %v", lis.Addr())
+		go serveALPNChallenges(tls.NewListener(lis, m.TLSConfig()), logger)
+		return lis, nil
+	}
+	logger.Infof("ACME http-01 challenge server listen on %v", lis.Addr())
+	go func() {
+		if err := http.Serve(lis, m.HTTPHandler(nil)); err != nil && !isClosedErr(err) {
+			logger.Errorf("ACME challenge server: %v", err)
+		}
+	}()
+	return lis, nil
+}
+
+// serveALPNChallenges completes the TLS handshakes of the connections,
+// which answers the tls-alpn-01 challenges, and closes them.
+func serveALPNChallenges(lis net.Listener, logger *logrus.Logger) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			if !isClosedErr(err) {
+				logger.Errorf("ACME challenge server: %v", err)
+			}
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(30 * time.Second))
+			conn.(*tls.Conn).Handshake()
+		}()
+	}
+}
+
+// certReloader serves a certificate from files, reloading them when they
+// change so that renewed certificates are used without a restart.
+type certReloader struct {
+	certFile, keyFile string
+	logger            socks4.Logger // nil to not log reloads.
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // latest modification time of the files.
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string, logger socks4.Logger) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS requires both a certificate and a key")
+	}
+	r := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	modTime, err := r.modified()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// modified returns the latest modification time of the files.
+func (r *certReloader) modified() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checked = time.Now()
+	modTime, err := r.modified()
+	if err != nil || modTime.Equal(r.modTime) {
+		return r.cert, nil
+	}
+	// keep the current certificate if the new one fails to load, e.g. as
+	// the files are being replaced.
+	if err := r.load(modTime); err != nil {
+		if r.logger != nil {
+			r.logger.Errorf("reload TLS certificate %v: %v", r.certFile, err)
+		}
+		return r.cert, nil
+	}
+	if r.logger != nil {
+		r.logger.Infof("reloaded TLS certificate %v", r.certFile)
+	}
+	return r.cert, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%v: no PEM certificates", path)
+	}
+	return pool, nil
+}
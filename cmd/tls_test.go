@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// writeCert writes a self-signed certificate of the common name and its
+// key as PEM files in dir, and returns their paths.
+func writeCert(t *testing.T, dir, cn string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, cn+".pem"), filepath.Join(dir, cn+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSConfigLoad(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeCert(t, dir, "proxy")
+	ca, _ := writeCert(t, dir, "clients")
+	notPEM := filepath.Join(dir, "ca.txt")
+	os.WriteFile(notPEM, []byte("not a certificate"), 0o600)
+	for _, tt := range []struct {
+		name       string
+		config     tlsConfig
+		clientAuth tls.ClientAuthType
+		err        string // in the error, none if empty.
+	}{
+		{name: "certificate", config: tlsConfig{Cert: cert, Key: key}, clientAuth: tls.NoClientCert},
+		{name: "client certificates", config: tlsConfig{Cert: cert, Key: key, ClientCA: ca}, clientAuth: tls.RequireAndVerifyClientCert},
+		{name: "optional client certificates", config: tlsConfig{Cert: cert, Key: key, ClientCA: ca, ClientCertOptional: true}, clientAuth: tls.VerifyClientCertIfGiven},
+		{name: "no key", config: tlsConfig{Cert: cert}, err: "both a certificate and a key"},
+		{name: "missing key", config: tlsConfig{Cert: cert, Key: filepath.Join(dir, "missing.key")}, err: "no such file"},
+		{name: "key of another certificate", config: tlsConfig{Cert: ca, Key: key}, err: "private key does not match"},
+		{name: "client CA not PEM", config: tlsConfig{Cert: cert, Key: key, ClientCA: notPEM}, err: "no PEM certificates"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.config.enabled() {
+				t.Error("TLS not enabled")
+			}
+			err := tt.config.validate()
+			config, loadErr := tt.config.load(nil, nil)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) || loadErr == nil {
+					t.Fatalf("errors %v and %v, want %q", err, loadErr, tt.err)
+				}
+				return
+			}
+			if err != nil || loadErr != nil {
+				t.Fatalf("errors %v and %v", err, loadErr)
+			}
+			if config.ClientAuth != tt.clientAuth || config.MinVersion != tls.VersionTLS12 {
+				t.Errorf("client auth %v and min version %x, want %v", config.ClientAuth, config.MinVersion, tt.clientAuth)
+			}
+			if c, err := config.GetCertificate(&tls.ClientHelloInfo{}); err != nil || len(c.Certificate) == 0 {
+				t.Errorf("certificate %v: %v", c, err)
+			}
+		})
+	}
+}
+
+func TestACMEConfigValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		config acmeConfig
+		err    string // in the error, none if empty.
+	}{
+		{name: "HTTP challenge", config: acmeConfig{Domains: []string{"proxy.example.com"}}},
+		{name: "TLS-ALPN challenge", config: acmeConfig{Domains: []string{"proxy.example.com"}, Challenge: "tls-alpn-01", ChallengeAddress: ":8443"}},
+		{name: "no domains", config: acmeConfig{}, err: "no ACME domains"},
+		{name: "DNS challenge", config: acmeConfig{Domains: []string{"proxy.example.com"}, Challenge: "dns-01"}, err: "invalid ACME challenge"},
+		{name: "invalid challenge address", config: acmeConfig{Domains: []string{"proxy.example.com"}, ChallengeAddress: "80"}, err: "invalid ACME challenge address"},
+	} {
+		err := tt.config.validate()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%v: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestTLSConfigACME(t *testing.T) {
+	cert, key := writeCert(t, t.TempDir(), "proxy")
+	c := tlsConfig{ACME: true}
+	if err := (&tlsConfig{ACME: true, Cert: cert, Key: key}).validate(); err == nil || !strings.Contains(err.Error(), "exclusive") {
+		t.Errorf("error %v, want the certificate files and ACME exclusive", err)
+	}
+	if _, err := c.load(nil, nil); err == nil {
+		t.Error("loaded without ACME manager")
+	}
+	acm := (&acmeConfig{Domains: []string{"proxy.example.com"}}).manager()
+	config, err := c.load(acm, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.NextProtos) != 1 || config.NextProtos[0] != "acme-tls/1" || config.GetCertificate == nil {
+		t.Errorf("protocols %v, want those of the tls-alpn-01 challenges", config.NextProtos)
+	}
+	// a client sending no server name gets the certificate of the first
+	// domain, which the host policy accepts, rather than a missing server
+	// name error.
+	if err := acm.HostPolicy(context.Background(), acm.defaultDomain); err != nil {
+		t.Errorf("default domain %v rejected: %v", acm.defaultDomain, err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir, "proxy")
+	r, err := newCertReloader(certFile, keyFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, _ := r.getCertificate(nil)
+	renewedCert, renewedKey := writeCert(t, t.TempDir(), "proxy")
+	at := time.Now()
+	for _, tt := range []struct {
+		name    string
+		files   map[string]string // contents written to the files, from the paths.
+		checked time.Duration     // since the last check.
+		renewed bool
+	}{
+		{name: "within the check interval", files: map[string]string{certFile: renewedCert, keyFile: renewedKey}, checked: time.Second},
+		{name: "broken files", files: map[string]string{certFile: ""}, checked: certCheckInterval},
+		{name: "renewed files", files: map[string]string{certFile: renewedCert, keyFile: renewedKey}, checked: certCheckInterval, renewed: true},
+		{name: "unchanged files", checked: certCheckInterval},
+	} {
+		// each change is newer than the previous one.
+		at = at.Add(time.Minute)
+		for dst, src := range tt.files {
+			b, _ := os.ReadFile(src)
+			os.WriteFile(dst, b, 0o600)
+			os.Chtimes(dst, at, at)
+		}
+		r.mu.Lock()
+		r.checked = time.Now().Add(-tt.checked)
+		r.mu.Unlock()
+		cert, err := r.getCertificate(nil)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		if renewed := cert != current; renewed != tt.renewed {
+			t.Errorf("%v: certificate renewed %v, want %v", tt.name, renewed, tt.renewed)
+		}
+		current = cert
+	}
+}
+
+func TestServeACME(t *testing.T) {
+	logger := logrus.New()
+	logger.Out = io.Discard
+	c := &acmeConfig{Domains: []string{"proxy.example.com"}, ChallengeAddress: "127.0.0.1:0"}
+	lis, err := serveACME(c, c.manager(), &handoff{}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{
+		{"/.well-known/acme-challenge/unknown", http.StatusNotFound},
+		{"/", http.StatusFound},
+	} {
+		req, _ := http.NewRequest("GET", "http://"+lis.Addr().String()+tt.path, nil)
+		req.Host = "proxy.example.com"
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%v: status %v, want %v", tt.path, resp.StatusCode, tt.status)
+		}
+	}
+	// the TLS-ALPN challenges are answered by the listeners without an
+	// auxiliary address.
+	if lis, err := serveACME(&acmeConfig{Domains: c.Domains, Challenge: "tls-alpn-01"}, c.manager(), &handoff{}, logger); lis != nil || err != nil {
+		t.Errorf("listener %v: %v, want none", lis, err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// upgradeFDsEnv holds the names of the listeners passed to the new
+	// process of an upgrade, separated by colons, from fd 3 on.
+	upgradeFDsEnv = "SOCKS4_UPGRADE_FDS"
+	// upgradeReadyEnv holds the fd of the pipe on which the new process
+	// reports that it serves.
+	upgradeReadyEnv = "SOCKS4_UPGRADE_READY"
+	// upgradeTimeout is the max time the new process may take to serve.
+	upgradeTimeout = 30 * time.Second
+)
+
+// handoff holds the listeners of the process by name: "instance/NAME" for
+// the proxy listeners of an instance, "admin", "control" and "acme". They
+// are inherited from the process being upgraded, and passed to the new
+// process on the next upgrade, so that the listening sockets are never
+// closed and no connection is refused during an upgrade.
+type handoff struct {
+	inherited map[string][]net.Listener
+	ready     *os.File // pipe to the upgraded process, nil if not upgrading one.
+
+	names     []string
+	listeners []net.Listener
+}
+
+// inheritListeners returns the handoff of the process, with the listeners
+// passed by the process it upgrades if any.
+func inheritListeners() (*handoff, error) {
+	h := &handoff{inherited: make(map[string][]net.Listener)}
+	names := os.Getenv(upgradeFDsEnv)
+	if names == "" {
+		return h, nil
+	}
+	ready, _ := strconv.Atoi(os.Getenv(upgradeReadyEnv))
+	os.Unsetenv(upgradeFDsEnv)
+	os.Unsetenv(upgradeReadyEnv)
+	if ready > 0 {
+		h.ready = os.NewFile(uintptr(ready), "upgrade")
+	}
+	for i, name := range strings.Split(names, ":") {
+		f := os.NewFile(uintptr(listenFDsStart+i), name)
+		lis, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			h.closeInherited()
+			return nil, fmt.Errorf("inherited fd %v (%v): %v", listenFDsStart+i, name, err)
+		}
+		h.inherited[name] = append(h.inherited[name], lis)
+	}
+	return h, nil
+}
+
+// take returns the inherited listeners of the name, nil if there are none.
+func (h *handoff) take(name string) []net.Listener {
+	lis := h.inherited[name]
+	delete(h.inherited, name)
+	return lis
+}
+
+// listen returns the inherited listener of the name, or else the one
+// created by listen, and adds it to the handoff.
+func (h *handoff) listen(name string, listen func() (net.Listener, error)) (net.Listener, error) {
+	if inherited := h.take(name); len(inherited) > 0 {
+		closeListeners(inherited[1:])
+		// the socket file is removed on close like that of a created one.
+		if ul, ok := inherited[0].(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(true)
+		}
+		h.add(name, inherited[0])
+		return inherited[0], nil
+	}
+	lis, err := listen()
+	if err != nil {
+		return nil, err
+	}
+	h.add(name, lis)
+	return lis, nil
+}
+
+// add adds a listener to pass on the next upgrade.
+func (h *handoff) add(name string, lis net.Listener) {
+	h.names = append(h.names, name)
+	h.listeners = append(h.listeners, lis)
+}
+
+// closeInherited closes the inherited listeners which are not used, like
+// those of removed instances.
+func (h *handoff) closeInherited() {
+	for name, lis := range h.inherited {
+		closeListeners(lis)
+		delete(h.inherited, name)
+	}
+}
+
+// serving reports to the upgraded process that this one serves, after
+// which it drains.
+func (h *handoff) serving() {
+	if h.ready == nil {
+		return
+	}
+	h.ready.Write([]byte{1})
+	h.ready.Close()
+	h.ready = nil
+}
+
+// upgrade starts the executable of the process again, passing it the
+// listeners, and waits until it serves. It returns the PID of the new
+// process. This one should then drain and exit, having closed the
+// listeners of the admin server, control socket and ACME challenges by
+// release.
+func (h *handoff) upgrade(logger *logrus.Logger) (pid int, err error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	files := make([]*os.File, 0, len(h.listeners)+1)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for i, lis := range h.listeners {
+		filer, ok := lis.(interface{ File() (*os.File, error) })
+		if !ok {
+			return 0, fmt.Errorf("listener %v on %v cannot be passed", h.names[i], lis.Addr())
+		}
+		f, err := filer.File()
+		if err != nil {
+			return 0, fmt.Errorf("listener %v on %v: %v", h.names[i], lis.Addr(), err)
+		}
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		upgradeFDsEnv+"="+strings.Join(h.names, ":"),
+		upgradeReadyEnv+"="+strconv.Itoa(listenFDsStart+len(files)-1))
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	w.Close()
+	files = files[:len(files)-1]
+	logger.Infof("upgrade: started %v as process %v", exe, cmd.Process.Pid)
+
+	ready := make(chan bool, 1)
+	go func() {
+		// the pipe is closed without a byte if the process exits first.
+		n, _ := r.Read(make([]byte, 1))
+		ready <- n == 1
+	}()
+	timer := time.NewTimer(upgradeTimeout)
+	defer timer.Stop()
+	select {
+	case ok := <-ready:
+		if ok {
+			go cmd.Wait()
+			return cmd.Process.Pid, nil
+		}
+		err = errors.New("the new process exited")
+	case <-timer.C:
+		err = fmt.Errorf("the new process is not serving after %v", upgradeTimeout)
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	return 0, err
+}
+
+// isUpgradeSignal reports whether sig is one of upgradeSignals.
+func isUpgradeSignal(sig os.Signal) bool {
+	for _, s := range upgradeSignals {
+		if sig == s {
+			return true
+		}
+	}
+	return false
+}
+
+// release closes the listeners other than those of the instances after an
+// upgrade, which are closed by the shutdown of the instances. The control
+// socket file is kept for the new process.
+func (h *handoff) release() {
+	for i, lis := range h.listeners {
+		if strings.HasPrefix(h.names[i], "instance/") {
+			continue
+		}
+		if ul, ok := lis.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+		lis.Close()
+	}
+}
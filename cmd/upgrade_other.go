@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// upgradeSignals are the signals upgrading the process to its executable,
+// none as the listeners cannot be passed.
+var upgradeSignals []os.Signal
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// tcpListener listens on a port of the loopback address.
+func tcpListener(t *testing.T) net.Listener {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	return lis
+}
+
+func TestHandoffListen(t *testing.T) {
+	admin, extra, instance := tcpListener(t), tcpListener(t), tcpListener(t)
+	h := &handoff{inherited: map[string][]net.Listener{
+		"admin":      {admin, extra},
+		"instance/a": {instance},
+	}}
+	created := 0
+	listen := func() (net.Listener, error) {
+		created++
+		return tcpListener(t), nil
+	}
+	for _, tt := range []struct {
+		name      string
+		inherited net.Listener // nil for a created listener.
+	}{
+		{name: "admin", inherited: admin},
+		{name: "control"},
+	} {
+		lis, err := h.listen(tt.name, listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.inherited != nil && lis != tt.inherited || tt.inherited == nil && created != 1 {
+			t.Errorf("%v: listener on %v, want the inherited one %v", tt.name, lis.Addr(), tt.inherited != nil)
+		}
+	}
+	// the other inherited listeners of the name are closed.
+	if _, err := net.Dial("tcp", extra.Addr().String()); err == nil {
+		t.Error("extra inherited listener not closed")
+	}
+	if !reflect.DeepEqual(h.names, []string{"admin", "control"}) || len(h.listeners) != 2 {
+		t.Errorf("listeners %v to pass on the next upgrade", h.names)
+	}
+	if lis := h.take("instance/a"); len(lis) != 1 || lis[0] != instance {
+		t.Errorf("listeners %v taken, want the inherited one", lis)
+	}
+	if lis := h.take("instance/a"); lis != nil {
+		t.Errorf("listeners %v taken again", lis)
+	}
+}
+
+func TestHandoffCloseInherited(t *testing.T) {
+	lis := tcpListener(t)
+	h := &handoff{inherited: map[string][]net.Listener{"instance/removed": {lis}}}
+	h.closeInherited()
+	if _, err := net.Dial("tcp", lis.Addr().String()); err == nil || len(h.inherited) != 0 {
+		t.Error("inherited listener of a removed instance not closed")
+	}
+}
+
+func TestHandoffRelease(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	control, err := listenControl(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &handoff{}
+	admin, instance := tcpListener(t), tcpListener(t)
+	h.add("admin", admin)
+	h.add("control", control)
+	h.add("instance/a", instance)
+	h.release()
+	for _, tt := range []struct {
+		lis  net.Listener
+		open bool
+	}{
+		{admin, false},
+		{control, false},
+		{instance, true},
+	} {
+		conn, err := net.Dial(tt.lis.Addr().Network(), tt.lis.Addr().String())
+		if open := err == nil; open != tt.open {
+			t.Errorf("listener on %v open: %v, want %v", tt.lis.Addr(), open, tt.open)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+	}
+	// the control socket file is kept for the new process.
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("control socket file removed: %v", err)
+	}
+}
+
+func TestIsUpgradeSignal(t *testing.T) {
+	for _, sig := range upgradeSignals {
+		if !isUpgradeSignal(sig) {
+			t.Errorf("%v not an upgrade signal", sig)
+		}
+	}
+	if isUpgradeSignal(os.Interrupt) {
+		t.Error("interrupt is an upgrade signal")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// upgradeSignals are the signals upgrading the process to its executable.
+var upgradeSignals = []os.Signal{syscall.SIGUSR2}
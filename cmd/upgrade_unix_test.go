@@ -0,0 +1,94 @@
+//go:build !windows
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// upgradeTestEnv makes the test binary started by an upgrade act as the
+// new process: "serve" serves a connection on the inherited listener, and
+// "exit" exits without serving.
+const upgradeTestEnv = "SOCKS4_TEST_UPGRADE"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(upgradeTestEnv); mode != "" && os.Getenv(upgradeFDsEnv) != "" {
+		os.Exit(upgradedProcess(mode))
+	}
+	os.Exit(m.Run())
+}
+
+// upgradedProcess inherits the listeners and, in the serve mode, writes
+// the names of those inherited to a connection of the instance a.
+func upgradedProcess(mode string) int {
+	h, err := inheritListeners()
+	if err != nil || mode == "exit" {
+		return 1
+	}
+	names := make([]string, 0, len(h.inherited))
+	for name := range h.inherited {
+		names = append(names, name)
+	}
+	lis := h.take("instance/a")
+	if len(lis) != 1 {
+		return 1
+	}
+	h.serving()
+	conn, err := lis[0].Accept()
+	if err != nil {
+		return 1
+	}
+	defer conn.Close()
+	io.WriteString(conn, strings.Join(append(names, "upgraded"), " ")+"\n")
+	return 0
+}
+
+func TestUpgrade(t *testing.T) {
+	logger := &logrus.Logger{Out: io.Discard, Formatter: &logrus.TextFormatter{}}
+	for _, tt := range []struct {
+		mode string
+		ok   bool
+	}{
+		{mode: "serve", ok: true},
+		{mode: "exit"},
+	} {
+		t.Run(tt.mode, func(t *testing.T) {
+			t.Setenv(upgradeTestEnv, tt.mode)
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lis.Close()
+			h := &handoff{}
+			h.add("instance/a", lis)
+			pid, err := h.upgrade(logger)
+			if (err == nil) != tt.ok {
+				t.Fatalf("upgraded to process %v: %v, want %v", pid, err, tt.ok)
+			}
+			if !tt.ok {
+				return
+			}
+			// this process stops accepting, the new one serves on the
+			// same socket.
+			lis.Close()
+			conn, err := net.Dial("tcp", lis.Addr().String())
+			if err != nil {
+				t.Fatalf("connection refused after the upgrade: %v", err)
+			}
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			line, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil || line != "instance/a upgraded\n" {
+				t.Errorf("read %q from the new process: %v", line, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cccxg/socks4"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// loadUsers returns the password authentication by the users file, a file
+// of "username:bcrypt hash" lines like made by "htpasswd -B", or nil if
+// path is empty.
+func loadUsers(path string) (socks4.PasswordAuth, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, hash, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("%v: line %v: missing password hash", path, n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%v: line %v: %v", path, n, err)
+		}
+		users[name] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return func(username, password string) bool {
+		hash, ok := users[username]
+		return ok && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	}, nil
+}
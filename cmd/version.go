@@ -0,0 +1,119 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"text/tabwriter"
+)
+
+// version may be set at build time with -ldflags "-X main.version=v1.2.3",
+// otherwise the module version from the build info is used.
+var version string
+
+// feature is an optional subsystem of the binary.
+type feature struct {
+	name    string
+	enabled func(*config) bool // nil if always available.
+}
+
+// features lists the optional subsystems, with whether they are enabled by
+// the configuration.
+var features = []feature{
+	{"admin", func(c *config) bool { return c.Admin != "" }},
+	{"metrics", func(c *config) bool { return c.Admin != "" }},
+	{"control-socket", func(c *config) bool { return c.ControlSocket != "" }},
+	{"instances", func(c *config) bool { return len(c.Instances) > 0 }},
+	{"tls", anyInstance(func(c *instanceConfig) bool { return c.TLS.enabled() })},
+	{"socks5", anyInstance(func(c *instanceConfig) bool { return c.Socks5 })},
+	{"http-connect", anyInstance(func(c *instanceConfig) bool { return c.HTTPConnect })},
+	{"socks5-upstream", anyInstance(func(c *instanceConfig) bool { return c.Upstream != "" })},
+	{"transparent", anyInstance(func(c *instanceConfig) bool { return c.Transparent != "" })},
+	{"websocket", anyInstance(func(c *instanceConfig) bool { return c.WebSocket != "" })},
+	{"compression", anyInstance(func(c *instanceConfig) bool { return c.Compression })},
+	{"obfuscation", anyInstance(func(c *instanceConfig) bool { return c.ObfsKey != "" })},
+	{"ssh-egress", anyInstance(func(c *instanceConfig) bool { return len(c.SSHEgress) > 0 })},
+	{"reverse", anyInstance(func(c *instanceConfig) bool { return c.Reverse.Enabled })},
+	{"sniffing", anyInstance(func(c *instanceConfig) bool { return c.Sniff })},
+	{"mirror", anyInstance(func(c *instanceConfig) bool { return c.MirrorPcapng != "" })},
+	{"webhook", anyInstance(func(c *instanceConfig) bool { return len(c.Webhook.URLs) > 0 })},
+	{"audit", anyInstance(func(c *instanceConfig) bool { return c.Audit.SQLite != "" })},
+	{"access-log", anyInstance(func(c *instanceConfig) bool { return c.AccessLog.Path != "" })},
+	{"ipfix", anyInstance(func(c *instanceConfig) bool { return c.IPFIX.Collector != "" })},
+	{"rate-limit", anyInstance(func(c *instanceConfig) bool { return c.RateLimit.Connections > 0 })},
+	{"redis-store", anyInstance(func(c *instanceConfig) bool { return c.Store.Redis != "" })},
+	{"proxy-protocol", anyInstance(func(c *instanceConfig) bool { return len(c.ProxyProtocol) > 0 })},
+	{"acme", func(c *config) bool { return c.usesACME() }},
+	{"access-rules", anyInstance(func(c *instanceConfig) bool { return c.ACLFile != "" || len(c.Rules) > 0 })},
+	{"circuit-breaker", anyInstance(func(c *instanceConfig) bool { return c.CircuitBreaker.Threshold > 0 })},
+	{"syslog", func(c *config) bool { return c.Log.Output == "syslog" }},
+	{"journald", func(c *config) bool { return c.Log.Output == "journald" }},
+	{"systemd", nil},
+}
+
+// anyInstance reports a feature enabled if it is for any of the instances.
+func anyInstance(enabled func(*instanceConfig) bool) func(*config) bool {
+	return func(c *config) bool {
+		for _, inst := range c.instances() {
+			if enabled(&inst) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// versionCmd prints the version, build information and features of the
+// binary. The features are reported as enabled according to the
+// configuration given by the same flags, environment and file as the
+// server.
+func versionCmd(args []string) int {
+	cfg, err := loadConfig("socks4 version", args)
+	if err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	v, revision, modified, buildTime := version, "unknown", "", ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" {
+			v = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				revision = s.Value
+			case "vcs.modified":
+				if s.Value == "true" {
+					modified = " (modified)"
+				}
+			case "vcs.time":
+				buildTime = s.Value
+			}
+		}
+	}
+	fmt.Fprintf(w, "version:\t%v\n", v)
+	fmt.Fprintf(w, "revision:\t%v%v\n", revision, modified)
+	if buildTime != "" {
+		fmt.Fprintf(w, "commit time:\t%v\n", buildTime)
+	}
+	fmt.Fprintf(w, "go:\t%v %v/%v\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintln(w, "features:")
+	for _, f := range features {
+		state := "available"
+		if f.enabled != nil {
+			state = "disabled"
+			if f.enabled(cfg) {
+				state = "enabled"
+			}
+		}
+		fmt.Fprintf(w, "  %v\t%v\n", f.name, state)
+	}
+	w.Flush()
+	return 0
+}
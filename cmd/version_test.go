@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what f writes to the standard output.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	defer func() { os.Stdout = stdout }()
+	f()
+	out.Seek(0, io.SeekStart)
+	b, _ := io.ReadAll(out)
+	return string(b)
+}
+
+func TestVersionCmd(t *testing.T) {
+	os.Unsetenv("SOCKS4_CONFIG")
+	instances := writeConfig(t, "socks4.yaml", "instances:\n  - name: internal\n    listen: [\"127.0.0.1:1080\"]\n  - name: external\n    listen: [\":1081\"]\n    socks5: true\n")
+	for _, tt := range []struct {
+		name     string
+		args     []string
+		features map[string]string
+		code     int
+	}{
+		{name: "defaults", features: map[string]string{"admin": "disabled", "socks5": "disabled", "instances": "disabled", "systemd": "available"}},
+		{name: "flags", args: []string{"-admin", "127.0.0.1:9090", "-socks5"}, features: map[string]string{"admin": "enabled", "metrics": "enabled", "socks5": "enabled"}},
+		{name: "one of the instances", args: []string{"-config", instances}, features: map[string]string{"instances": "enabled", "socks5": "enabled", "tls": "disabled"}},
+		{name: "invalid flag", args: []string{"-max-conns", "many"}, code: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var code int
+			out := captureStdout(t, func() { code = versionCmd(tt.args) })
+			if code != tt.code {
+				t.Fatalf("exit code %v, want %v", code, tt.code)
+			}
+			if code != 0 {
+				return
+			}
+			if !strings.Contains(out, runtime.Version()) || !regexp.MustCompile(`(?m)^version: +\S+$`).MatchString(out) || !regexp.MustCompile(`(?m)^revision: +\S+`).MatchString(out) {
+				t.Errorf("output without the version, revision or Go version:\n%s", out)
+			}
+			for name, state := range tt.features {
+				if !regexp.MustCompile(`(?m)^  ` + regexp.QuoteMeta(name) + ` +` + state + `$`).MatchString(out) {
+					t.Errorf("feature %v not %v:\n%s", name, state, out)
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
 	"net"
 	"strconv"
 )
@@ -34,54 +36,155 @@ type Request struct {
 	Address string // target host address, IP or domain name (SOCKS 4A).
 	IsV4A   bool   // denote it is a SOCKS 4A request or not.
 	UserId  string // the user id reported by client's request.
+	// Resolved are the addresses the target host of a CONNECT request
+	// resolved to, or its IP, set before the rules are matched when a rule
+	// has a resolved key or a ResolveHook is set. The direct dials connect
+	// to one of them.
+	Resolved []net.IP
+	// Claims are the claims of the token of a SOCKS 4 request whose user
+	// id is a JSON Web Token, set once it is verified, see WithJWT.
+	Claims map[string]any
+	// Groups are the groups of the user of the request, set once it is
+	// authorized, see WithGroups.
+	Groups []string
 }
 
-func ParseRequest(b []byte) (req Request, err error) {
-	n := len(b)
-	if n < 9 {
-		err = errors.New("invalid SOCKS 4 request")
+// Protocol returns the name of the protocol of the request: "socks4",
+// "socks4a", "socks5", "http" or "transparent".
+func (r Request) Protocol() string {
+	switch r.Version {
+	case Version5:
+		return "socks5"
+	case VersionHTTP:
+		return "http"
+	case VersionTransparent:
+		return "transparent"
+	}
+	if r.IsV4A {
+		return "socks4a"
+	}
+	return "socks4"
+}
+
+// maxRequestFieldSize is the max size of the user id and domain name of a
+// request, NULL excluded.
+const maxRequestFieldSize = 255
+
+// The errors of malformed requests returned by ParseRequest and
+// ReadRequest, tested with errors.Is.
+var (
+	// ErrRequestTruncated is returned for requests ending before their
+	// last NULL byte.
+	ErrRequestTruncated = errors.New("truncated SOCKS 4 request")
+	// ErrInvalidVersion is returned for requests of another version than 4.
+	ErrInvalidVersion = errors.New("invalid SOCKS request VN")
+	// ErrInvalidCommand is returned for unknown commands.
+	ErrInvalidCommand = errors.New("invalid SOCKS request CD")
+	// ErrFieldTooLong is returned for user ids and domain names longer than
+	// 255 bytes.
+	ErrFieldTooLong = errors.New("SOCKS 4 request field too long")
+	// ErrEmptyDomain is returned for SOCKS 4A requests without domain name.
+	ErrEmptyDomain = errors.New("empty SOCKS 4A domain name")
+	// ErrTrailingData is returned by ParseRequest for bytes after the
+	// request, e.g. NULL bytes embedded in its fields, and by the server for
+	// data sent by clients before the reply.
+	ErrTrailingData = errors.New("data after the SOCKS 4 request")
+)
+
+// ParseRequest parses the request in b, which must hold exactly one
+// request. Its errors are those of ReadRequest, and ErrTrailingData.
+func ParseRequest(b []byte) (Request, error) {
+	r := bytes.NewReader(b)
+	req, err := ReadRequest(r)
+	if err == nil && r.Len() > 0 {
+		err = ErrTrailingData
+	}
+	return req, err
+}
+
+// ReadRequest reads a request from r, without reading any byte past its
+// last NULL byte. Malformed requests are reported by the errors
+// ErrRequestTruncated, ErrInvalidVersion, ErrInvalidCommand,
+// ErrFieldTooLong and ErrEmptyDomain; other errors are the ones of r,
+// wrapped.
+func ReadRequest(r io.Reader) (req Request, err error) {
+	return readRequest(r, maxRequestFieldSize)
+}
+
+// readRequest reads a request like ReadRequest, with a user id of up to
+// maxUserId bytes.
+func readRequest(r io.Reader, maxUserId int) (req Request, err error) {
+	b := make([]byte, 8)
+	if _, err = io.ReadFull(r, b); err != nil {
+		err = readRequestError(err)
 		return
 	}
 
 	if version := b[0]; version != Version4 {
-		err = errors.New("invalid SOCKS request VN")
+		err = ErrInvalidVersion
 		return
-	} else {
-		req.Version = Version4
 	}
+	req.Version = Version4
 
-	if cmd := b[1]; cmd != CmdConnect && cmd != CmdBind {
-		err = errors.New("invalid SOCKS request CD")
+	if cmd := b[1]; cmd != CmdConnect && cmd != CmdBind && cmd != CmdReverse {
+		err = ErrInvalidCommand
 		return
-	} else {
-		req.Cmd = cmd
 	}
+	req.Cmd = b[1]
 
 	req.Port = int(binary.BigEndian.Uint16(b[2:4]))
 
+	if req.UserId, err = readRequestField(r, maxUserId); err != nil {
+		return
+	}
+
 	// check SOCKS 4A
 	if b[4] == 0 && b[5] == 0 && b[6] == 0 && b[7] != 0 {
-		// SOCKS 4A
 		req.IsV4A = true
-		bs := bytes.Split(b[8:], []byte{NullByte})
-		if len(bs) != 3 {
-			err = errors.New("invalid SOCKS 4A request")
+		var domainName string
+		if domainName, err = readRequestField(r, maxRequestFieldSize); err != nil {
+			return
+		}
+		if domainName == "" {
+			err = ErrEmptyDomain
 			return
 		}
-		req.UserId = string(bs[0])
-		domainName := string(bs[1])
 		req.Address = domainName + ":" + strconv.Itoa(req.Port)
 	} else {
-		// SOCKS 4
-		req.IsV4A = false
 		ip := net.IPv4(b[4], b[5], b[6], b[7]).String()
 		req.Address = ip + ":" + strconv.Itoa(req.Port)
-		req.UserId = string(b[8 : n-1]) // -1 for the last NULL byte.
 	}
-
 	return
 }
 
+// readRequestField reads a NULL terminated field of up to max bytes of a
+// request a byte at a time, so that no byte after it is consumed.
+func readRequestField(r io.Reader, max int) (string, error) {
+	field := make([]byte, 0, 32)
+	c := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, c); err != nil {
+			return "", readRequestError(err)
+		}
+		if c[0] == NullByte {
+			return string(field), nil
+		}
+		if len(field) == max {
+			return "", ErrFieldTooLong
+		}
+		field = append(field, c[0])
+	}
+}
+
+// readRequestError returns the error of ReadRequest for an error of its
+// reader.
+func readRequestError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrRequestTruncated
+	}
+	return fmt.Errorf("failed to read request: %w", err)
+}
+
 // Reply represents a message that the SOCKS 4 server reply to the client's
 // request.
 type Reply struct {
@@ -90,19 +193,131 @@ type Reply struct {
 	IP   net.IP
 }
 
-func (r Reply) ToBytes() []byte {
-	var b = []byte{0} // init with SOCKS version
-	// add CD
-	if r.Cd != Granted && r.Cd != RejectOrFailure &&
-		r.Cd != RejectNoIdentd && r.Cd != RejectWrongUserId {
-		b = append(b, RejectOrFailure)
+// isReplyCode reports whether cd is a reply code of SOCKS 4.
+func isReplyCode(cd byte) bool {
+	return cd == Granted || cd == RejectOrFailure ||
+		cd == RejectNoIdentd || cd == RejectWrongUserId
+}
+
+// NewReply returns the reply with the code and the address bound by the
+// server, nil for 0.0.0.0:0. It fails for unknown codes and addresses which
+// are not IPv4 ones, except the unspecified IPv6 address replied as 0.0.0.0.
+func NewReply(code byte, addr net.Addr) (Reply, error) {
+	if !isReplyCode(code) {
+		return Reply{}, fmt.Errorf("invalid SOCKS 4 reply code %#x", code)
+	}
+	rep := Reply{Cd: code, IP: net.IPv4zero.To4()}
+	if addr == nil {
+		return rep, nil
+	}
+	var ip net.IP
+	var port int
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		ip, port = ta.IP, ta.Port
 	} else {
-		b = append(b, r.Cd)
+		host, portStr, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return Reply{}, fmt.Errorf("invalid SOCKS 4 reply address %v: %v", addr, err)
+		}
+		if port, err = strconv.Atoi(portStr); err != nil {
+			return Reply{}, fmt.Errorf("invalid SOCKS 4 reply port %q", portStr)
+		}
+		ip = net.ParseIP(host)
+	}
+	// the unspecified address, like the one of the BIND listeners bound
+	// to all interfaces, tells the client to use the address of the
+	// server.
+	if ip.IsUnspecified() {
+		ip = net.IPv4zero
+	}
+	if ip = ip.To4(); ip == nil || port < 0 || port > 65535 {
+		return Reply{}, fmt.Errorf("SOCKS 4 can't reply address %v", addr)
+	}
+	rep.IP, rep.Port = ip, port
+	return rep, nil
+}
+
+// MarshalBinary encodes the reply in the 8 bytes of the SOCKS 4 wire
+// format. It fails for unknown codes, IPs which are not IPv4 ones and
+// invalid ports. A nil IP is encoded as 0.0.0.0.
+func (r Reply) MarshalBinary() ([]byte, error) {
+	if !isReplyCode(r.Cd) {
+		return nil, fmt.Errorf("invalid SOCKS 4 reply code %#x", r.Cd)
+	}
+	if r.Port < 0 || r.Port > 65535 {
+		return nil, fmt.Errorf("invalid SOCKS 4 reply port %v", r.Port)
+	}
+	ip := net.IPv4zero.To4()
+	if r.IP != nil {
+		if ip = r.IP.To4(); ip == nil {
+			return nil, fmt.Errorf("SOCKS 4 can't reply IP %v", r.IP)
+		}
 	}
-	// add port
+	b := []byte{0, r.Cd} // SOCKS 4 replies are version 0.
 	b = binary.BigEndian.AppendUint16(b, uint16(r.Port))
-	// add IP
-	ip := r.IP.To4()
-	b = append(b, ip...)
+	return append(b, ip...), nil
+}
+
+// ToBytes encodes the reply like MarshalBinary, but never fails: unknown
+// codes are replaced by RejectOrFailure and IPs which are not IPv4 ones by
+// 0.0.0.0.
+func (r Reply) ToBytes() []byte {
+	if !isReplyCode(r.Cd) {
+		r.Cd = RejectOrFailure
+	}
+	if r.IP.To4() == nil {
+		r.IP = nil
+	}
+	if r.Port < 0 || r.Port > 65535 {
+		r.Port = 0
+	}
+	b, _ := r.MarshalBinary()
 	return b
 }
+
+// ToBytes encodes the request in the SOCKS 4 wire format. The request is
+// sent as SOCKS 4A if IsV4A is set or the host of Address is not an IPv4
+// address.
+func (r Request) ToBytes() ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(r.Address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, errors.New("invalid port " + portStr)
+	}
+
+	b := []byte{Version4, r.Cmd}
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+	ip := net.ParseIP(host).To4()
+	if !r.IsV4A && ip != nil {
+		b = append(b, ip...)
+		b = append(b, r.UserId...)
+		return append(b, NullByte), nil
+	}
+	if net.ParseIP(host) != nil && ip == nil {
+		return nil, errors.New("SOCKS 4 can't request IPv6 address " + host)
+	}
+	b = append(b, 0, 0, 0, 1) // 0.0.0.x for SOCKS 4A.
+	b = append(b, r.UserId...)
+	b = append(b, NullByte)
+	b = append(b, host...)
+	return append(b, NullByte), nil
+}
+
+// ParseReply parses a reply sent by a SOCKS 4 server.
+func ParseReply(b []byte) (rep Reply, err error) {
+	if len(b) != 8 {
+		err = errors.New("invalid SOCKS 4 reply")
+		return
+	}
+	if b[0] != 0 {
+		err = errors.New("invalid SOCKS reply VN")
+		return
+	}
+	rep.Cd = b[1]
+	rep.Port = int(binary.BigEndian.Uint16(b[2:4]))
+	rep.IP = net.IPv4(b[4], b[5], b[6], b[7])
+	return
+}
@@ -0,0 +1,145 @@
+package socks4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// request returns a SOCKS 4 request of the command to the port and IP,
+// followed by the fields, each NULL terminated.
+func request(cmd byte, port uint16, ip [4]byte, fields ...string) []byte {
+	b := []byte{Version4, cmd, byte(port >> 8), byte(port)}
+	b = append(b, ip[:]...)
+	for _, f := range fields {
+		b = append(append(b, f...), NullByte)
+	}
+	return b
+}
+
+func TestParseRequest(t *testing.T) {
+	long := strings.Repeat("a", 255)
+	for _, tt := range []struct {
+		name string
+		in   []byte
+		want Request
+		err  error
+	}{
+		{
+			name: "connect",
+			in:   request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, "alice"),
+			want: Request{Version: Version4, Cmd: CmdConnect, Port: 80, Address: "10.0.0.1:80", UserId: "alice"},
+		},
+		{
+			name: "bind without user id",
+			in:   request(CmdBind, 0, [4]byte{10, 0, 0, 1}, ""),
+			want: Request{Version: Version4, Cmd: CmdBind, Address: "10.0.0.1:0"},
+		},
+		{
+			name: "4A",
+			in:   request(CmdConnect, 443, [4]byte{0, 0, 0, 1}, "", "example.com"),
+			want: Request{Version: Version4, Cmd: CmdConnect, Port: 443, Address: "example.com:443", IsV4A: true},
+		},
+		{
+			name: "255-byte fields",
+			in:   request(CmdConnect, 443, [4]byte{0, 0, 0, 1}, long, long),
+			want: Request{Version: Version4, Cmd: CmdConnect, Port: 443, Address: long + ":443", IsV4A: true, UserId: long},
+		},
+		{name: "empty", in: nil, err: ErrRequestTruncated},
+		{name: "truncated header", in: []byte{Version4, CmdConnect, 0, 80}, err: ErrRequestTruncated},
+		{name: "truncated user id", in: request(CmdConnect, 80, [4]byte{10, 0, 0, 1}), err: ErrRequestTruncated},
+		{name: "truncated domain", in: append(request(CmdConnect, 80, [4]byte{0, 0, 0, 1}, ""), "example"...), err: ErrRequestTruncated},
+		{name: "version 5", in: []byte{Version5, CmdConnect, 0, 80, 10, 0, 0, 1, 0}, err: ErrInvalidVersion},
+		{name: "unknown command", in: request(0x09, 80, [4]byte{10, 0, 0, 1}, ""), err: ErrInvalidCommand},
+		{name: "256-byte user id", in: request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, long+"a"), err: ErrFieldTooLong},
+		{name: "256-byte domain", in: request(CmdConnect, 80, [4]byte{0, 0, 0, 1}, "", long+"a"), err: ErrFieldTooLong},
+		{name: "empty 4A domain", in: request(CmdConnect, 80, [4]byte{0, 0, 0, 1}, "", ""), err: ErrEmptyDomain},
+		{name: "trailing data", in: append(request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, ""), 'x'), err: ErrTrailingData},
+		{name: "NULL in user id", in: request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, "al", "ice"), err: ErrTrailingData},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := ParseRequest(tt.in)
+			if !errors.Is(err, tt.err) || (tt.err == nil) != (err == nil) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && !reflect.DeepEqual(req, tt.want) {
+				t.Errorf("request %+v, want %+v", req, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadRequestStopsAtLastNull(t *testing.T) {
+	in := append(request(CmdConnect, 443, [4]byte{0, 0, 0, 1}, "bob", "example.com"), "data"...)
+	r := bytes.NewReader(in)
+	if _, err := ReadRequest(r); err != nil {
+		t.Fatal(err)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "data" {
+		t.Errorf("left %q after the request, want the data", rest)
+	}
+}
+
+func TestReadRequestReaderError(t *testing.T) {
+	errRead := errors.New("connection reset")
+	_, err := ReadRequest(io.MultiReader(bytes.NewReader([]byte{Version4, CmdConnect}), &errReader{errRead}))
+	if !errors.Is(err, errRead) || errors.Is(err, ErrRequestTruncated) {
+		t.Errorf("error %v, want the error of the reader", err)
+	}
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestRequestToBytes(t *testing.T) {
+	for _, req := range []Request{
+		{Version: Version4, Cmd: CmdConnect, Port: 80, Address: "10.0.0.1:80", UserId: "alice"},
+		{Version: Version4, Cmd: CmdBind, Port: 8080, Address: "example.com:8080", IsV4A: true},
+		{Version: Version4, Cmd: CmdConnect, Port: 443, Address: "10.0.0.1:443", IsV4A: true},
+	} {
+		b, err := req.ToBytes()
+		if err != nil {
+			t.Fatalf("%+v: %v", req, err)
+		}
+		got, err := ParseRequest(b)
+		if err != nil || !reflect.DeepEqual(got, req) {
+			t.Errorf("%+v parsed back as %+v: %v", req, got, err)
+		}
+	}
+	if _, err := (Request{Cmd: CmdConnect, Address: "[::1]:80"}).ToBytes(); err == nil {
+		t.Error("IPv6 request encoded")
+	}
+}
+
+func FuzzParseRequest(f *testing.F) {
+	f.Add(request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, "alice"))
+	f.Add(request(CmdBind, 443, [4]byte{0, 0, 0, 1}, "", "example.com"))
+	f.Add([]byte{Version4, CmdConnect, 0, 80, 0, 0, 0, 1, 0, 0})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		req, err := ParseRequest(b)
+		r := bytes.NewReader(b)
+		read, readErr := ReadRequest(r)
+		if err == nil {
+			if readErr != nil || !reflect.DeepEqual(read, req) || r.Len() != 0 {
+				t.Fatalf("ReadRequest %+v %v disagrees with ParseRequest %+v", read, readErr, req)
+			}
+			if len(req.UserId) > maxRequestFieldSize || (req.IsV4A && strings.HasPrefix(req.Address, ":")) {
+				t.Fatalf("invalid request %+v parsed", req)
+			}
+			if !req.IsV4A {
+				out, err := req.ToBytes()
+				if err != nil || !bytes.Equal(out, b) {
+					t.Fatalf("request %+v encoded as %v, want %v: %v", req, out, b, err)
+				}
+			}
+			return
+		}
+		if !errors.Is(err, ErrTrailingData) && !errors.Is(err, readErr) {
+			t.Fatalf("ParseRequest error %v, ReadRequest error %v", err, readErr)
+		}
+	})
+}
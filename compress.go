@@ -0,0 +1,157 @@
+package socks4
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// compressMagic starts the connections of the clients asking for
+	// compression, and is neither a SOCKS version nor an HTTP method.
+	compressMagic byte = 0xc4
+	// compressDeflate is the method of the DEFLATE streams (RFC 1951),
+	// flushed at every write.
+	compressDeflate byte = 0x01
+)
+
+// errCompressionRefused is the error of the dialers whose server does not
+// acknowledge the compression.
+var errCompressionRefused = errors.New("SOCKS server does not support compression")
+
+// WithCompression makes the server accept the compression of the
+// connections of the dialers with WithDialerCompression, for the clients
+// on slow links. The other clients are served as usual.
+func WithCompression() OptionFunc {
+	return func(s *Server) {
+		s.compression = true
+	}
+}
+
+// WithDialerCompression makes the dialer compress its connections to the
+// server, which must be configured with WithCompression. The dialer asks
+// for it with its request, and fails if the server does not acknowledge it.
+// The data relayed to the destinations is not compressed.
+func WithDialerCompression() DialerOption {
+	return func(d *Dialer) {
+		d.compression = true
+	}
+}
+
+// acceptCompression returns the connection decompressing the data of the
+// client and compressing the data sent to it if it asks for compression,
+// or else the connection as is.
+func (s *Server) acceptCompression(conn net.Conn) (net.Conn, error) {
+	if timeout := s.handshakeTimeout(); timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	b := make([]byte, 2)
+	if _, err := conn.Read(b[:1]); err != nil {
+		return conn, fmt.Errorf("failed to read from connect: %w", err)
+	}
+	if b[0] != compressMagic {
+		return &prefixedConn{Conn: conn, prefix: b[:1]}, nil
+	}
+	if _, err := io.ReadFull(conn, b[1:]); err != nil {
+		return conn, fmt.Errorf("failed to read compression method: %v", err)
+	}
+	if b[1] != compressDeflate {
+		return conn, fmt.Errorf("unsupported compression method %#x", b[1])
+	}
+	s.log(LogHandshake).Debugf("compress the connection of client %v", conn.RemoteAddr())
+	return &compressedConn{Conn: conn, header: b}, nil
+}
+
+// prefixedConn is a connection whose first bytes were read already.
+type prefixedConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixedConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// compressedConn is a connection whose data is compressed in both
+// directions. The header, compressMagic and the method, is written before
+// the first data, and the one of the peer is read before the first data
+// if expected.
+type compressedConn struct {
+	net.Conn
+
+	rmu    sync.Mutex
+	expect []byte        // header of the peer to read, nil if read.
+	r      io.ReadCloser // nil until the first read.
+
+	wmu    sync.Mutex
+	header []byte // header to write, nil if written.
+	w      *flate.Writer
+	buf    bytes.Buffer // data compressed by a write.
+}
+
+// newCompressedClient returns the connection of a dialer compressing its
+// data.
+func newCompressedClient(conn net.Conn) *compressedConn {
+	header := []byte{compressMagic, compressDeflate}
+	return &compressedConn{Conn: conn, expect: header, header: header}
+}
+
+func (c *compressedConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.expect != nil {
+		header := make([]byte, len(c.expect))
+		if _, err := io.ReadFull(c.Conn, header); err != nil {
+			if err == io.EOF {
+				return 0, errCompressionRefused
+			}
+			return 0, err
+		}
+		if !bytes.Equal(header, c.expect) {
+			return 0, errCompressionRefused
+		}
+		c.expect = nil
+	}
+	if c.r == nil {
+		c.r = flate.NewReader(c.Conn)
+	}
+	n, err := c.r.Read(b)
+	// the streams end with the connections, after the flush of the last
+	// write, instead of a final block.
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (c *compressedConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.w == nil {
+		c.w, _ = flate.NewWriter(&c.buf, flate.DefaultCompression)
+	}
+	c.buf.Reset()
+	if c.header != nil {
+		c.buf.Write(c.header)
+	}
+	c.w.Write(b)
+	// flushed for the peer to read the data of the write, like a request
+	// waiting for its reply.
+	c.w.Flush()
+	if _, err := c.Conn.Write(c.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	c.header = nil
+	return len(b), nil
+}
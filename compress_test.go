@@ -0,0 +1,148 @@
+package socks4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompressedConn(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		writes []string
+	}{
+		{name: "one write", writes: []string{"hello"}},
+		{name: "several writes", writes: []string{"hello", " ", "world"}},
+		{name: "empty write", writes: []string{"", "hello"}},
+		{name: "repeated", writes: []string{strings.Repeat("hello ", 10000)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			var raw bytes.Buffer
+			// the peers read the header of each other, like a dialer and
+			// the server accepting the compression.
+			c := newCompressedClient(client)
+			s := newCompressedClient(recordingConn{Conn: server, w: &raw})
+			go func() {
+				for _, data := range tt.writes {
+					if n, err := c.Write([]byte(data)); err != nil || n != len(data) {
+						t.Errorf("wrote %v bytes of %v: %v", n, len(data), err)
+					}
+				}
+				c.Close()
+			}()
+			s.SetDeadline(time.Now().Add(5 * time.Second))
+			received, err := io.ReadAll(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sent := strings.Join(tt.writes, ""); string(received) != sent {
+				t.Fatalf("received %q, want %q", received, sent)
+			}
+			if raw.Len() < 2 || raw.Bytes()[0] != compressMagic || raw.Bytes()[1] != compressDeflate {
+				t.Errorf("sent %x, want the header first", raw.Bytes())
+			}
+			if sent := len(strings.Join(tt.writes, "")); sent > 1000 && raw.Len() > sent/10 {
+				t.Errorf("%v bytes sent for %v, want them compressed", raw.Len(), sent)
+			}
+		})
+	}
+}
+
+func TestCompressedConnRefused(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		reply []byte
+		err   error
+	}{
+		{name: "closed", reply: nil, err: errCompressionRefused},
+		{name: "SOCKS reply", reply: []byte{0, RejectOrFailure, 0, 0, 0, 0, 0, 0}, err: errCompressionRefused},
+		{name: "short header", reply: []byte{compressMagic}, err: io.ErrUnexpectedEOF},
+	} {
+		conn := newCompressedClient(&bufConn{r: bytes.NewReader(tt.reply)})
+		if _, err := conn.Read(make([]byte, 8)); !errors.Is(err, tt.err) {
+			t.Errorf("%v: error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestAcceptCompression(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		in         []byte
+		compressed bool
+		err        string // in the error, none if empty.
+	}{
+		{name: "SOCKS 4", in: []byte{Version4, CmdConnect}},
+		{name: "compressed", in: []byte{compressMagic, compressDeflate}, compressed: true},
+		{name: "other method", in: []byte{compressMagic, 0x02}, err: "unsupported compression method 0x2"},
+		{name: "no method", in: []byte{compressMagic}, err: "failed to read compression method"},
+		{name: "closed", err: "failed to read from connect"},
+	} {
+		conn, err := newTestServer(WithCompression()).acceptCompression(&bufConn{r: bytes.NewReader(tt.in)})
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%v: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if _, compressed := conn.(*compressedConn); compressed != tt.compressed {
+			t.Errorf("%v: connection %T, want compressed %v", tt.name, conn, tt.compressed)
+		}
+		// the bytes of the request are read again.
+		if !tt.compressed {
+			if rest, _ := io.ReadAll(conn); !bytes.Equal(rest, tt.in) {
+				t.Errorf("%v: read %x, want %x", tt.name, rest, tt.in)
+			}
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	echo := echoTarget(t)
+	for _, tt := range []struct {
+		name   string
+		server bool // accepts compression.
+		dialer bool // asks for it.
+		err    string
+	}{
+		{name: "compressed", server: true, dialer: true},
+		{name: "not asked", server: true},
+		{name: "not accepted", dialer: true, err: errCompressionRefused.Error()},
+		{name: "none"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []OptionFunc
+			if tt.server {
+				opts = append(opts, WithCompression())
+			}
+			_, addr := serve(t, opts...)
+			dopts := []DialerOption{WithDialerTimeout(5 * time.Second)}
+			if tt.dialer {
+				dopts = append(dopts, WithDialerCompression())
+			}
+			conn, err := NewDialer(addr, dopts...).Dial("tcp", echo.Addr)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			assertEcho(t, conn, []byte("hello"))
+			assertEcho(t, conn, bytes.Repeat([]byte("hello"), 10000))
+		})
+	}
+}
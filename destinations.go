@@ -0,0 +1,121 @@
+package socks4
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// maxDestinations is the number of destinations tracked, above which
+	// the least used ones are forgotten.
+	maxDestinations = 1024
+	// destinationHalfLife is the time after which the counters of a
+	// destination are halved, so that the recent traffic outweighs the old
+	// one.
+	destinationHalfLife = time.Hour
+)
+
+// DestinationStats are the counters of the CONNECT requests to a
+// destination. They decay by half every hour.
+type DestinationStats struct {
+	Destination         string    `json:"destination"` // host:port of the requests.
+	Sessions            float64   `json:"sessions"`
+	ClientToRemoteBytes float64   `json:"client_to_remote_bytes"`
+	RemoteToClientBytes float64   `json:"remote_to_client_bytes"`
+	LastSeen            time.Time `json:"last_seen"`
+}
+
+// Bytes returns the bytes relayed in both directions.
+func (d DestinationStats) Bytes() float64 {
+	return d.ClientToRemoteBytes + d.RemoteToClientBytes
+}
+
+// decay returns the counters decayed from their last update to now.
+func (d DestinationStats) decay(now time.Time) DestinationStats {
+	f := math.Exp2(-float64(now.Sub(d.LastSeen)) / float64(destinationHalfLife))
+	if f >= 1 {
+		return d
+	}
+	d.Sessions *= f
+	d.ClientToRemoteBytes *= f
+	d.RemoteToClientBytes *= f
+	return d
+}
+
+// destinations tracks the counters of the most used destinations.
+type destinations struct {
+	mu    sync.Mutex
+	stats map[string]*DestinationStats
+}
+
+// add counts sessions and bytes of the destination at now.
+func (t *destinations) add(now time.Time, dest string, sessions int, toRemote, toClient int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d, ok := t.stats[dest]
+	if !ok {
+		if t.stats == nil {
+			t.stats = make(map[string]*DestinationStats)
+		}
+		if len(t.stats) >= maxDestinations {
+			t.prune(now)
+		}
+		d = &DestinationStats{Destination: dest, LastSeen: now}
+		t.stats[dest] = d
+	}
+	*d = d.decay(now)
+	d.Sessions += float64(sessions)
+	d.ClientToRemoteBytes += float64(toRemote)
+	d.RemoteToClientBytes += float64(toClient)
+	d.LastSeen = now
+}
+
+// prune forgets the least used quarter of the destinations, so that
+// pruning is not needed again for the next additions.
+func (t *destinations) prune(now time.Time) {
+	list := t.sorted(now)
+	for _, d := range list[len(list)-len(list)/4:] {
+		delete(t.stats, d.Destination)
+	}
+}
+
+// sorted returns the decayed counters by descending bytes, then sessions.
+func (t *destinations) sorted(now time.Time) []DestinationStats {
+	list := make([]DestinationStats, 0, len(t.stats))
+	for _, d := range t.stats {
+		list = append(list, d.decay(now))
+	}
+	SortDestinations(list)
+	return list
+}
+
+// SortDestinations sorts the counters by descending bytes, then sessions,
+// like TopDestinations.
+func SortDestinations(list []DestinationStats) {
+	sort.Slice(list, func(i, j int) bool {
+		if bi, bj := list[i].Bytes(), list[j].Bytes(); bi != bj {
+			return bi > bj
+		}
+		if list[i].Sessions != list[j].Sessions {
+			return list[i].Sessions > list[j].Sessions
+		}
+		return list[i].Destination < list[j].Destination
+	})
+}
+
+// TopDestinations returns the counters of the n destinations of CONNECT
+// requests which relayed the most bytes recently, then had the most
+// sessions, or of all of them if n is negative. Sessions are counted when
+// established and their bytes when they end. Up to 1024 destinations are
+// tracked, and their counters decay by half every hour.
+func (s *Server) TopDestinations(n int) []DestinationStats {
+	s.destinations.mu.Lock()
+	list := s.destinations.sorted(s.clock.Now())
+	s.destinations.mu.Unlock()
+	if n >= 0 && n < len(list) {
+		list = list[:n]
+	}
+	return list
+}
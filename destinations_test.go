@@ -0,0 +1,165 @@
+package socks4
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDestinationDecay(t *testing.T) {
+	seen := time.Unix(1000, 0)
+	d := DestinationStats{Destination: "a:80", Sessions: 8, ClientToRemoteBytes: 800, RemoteToClientBytes: 80, LastSeen: seen}
+	for _, tt := range []struct {
+		after    time.Duration
+		sessions float64
+		bytes    float64
+	}{
+		{0, 8, 880},
+		{-time.Minute, 8, 880}, // the clock going back decays nothing.
+		{time.Hour, 4, 440},
+		{2 * time.Hour, 2, 220},
+		{30 * time.Minute, 8 / 1.4142135623730951, 880 / 1.4142135623730951},
+	} {
+		decayed := d.decay(seen.Add(tt.after))
+		if !approx(decayed.Sessions, tt.sessions) || !approx(decayed.Bytes(), tt.bytes) || !decayed.LastSeen.Equal(seen) {
+			t.Errorf("after %v: %v sessions and %v bytes, want %v and %v", tt.after, decayed.Sessions, decayed.Bytes(), tt.sessions, tt.bytes)
+		}
+	}
+}
+
+// approx reports whether a and b are equal but for rounding errors and
+// the decay over a few seconds.
+func approx(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-3*math.Abs(b)
+}
+
+func TestDestinations(t *testing.T) {
+	start := time.Unix(1000, 0)
+	for _, tt := range []struct {
+		name string
+		adds func(d *destinations)
+		at   time.Duration
+		top  []DestinationStats
+	}{
+		{
+			name: "by bytes",
+			adds: func(d *destinations) {
+				d.add(start, "a:80", 1, 10, 10)
+				d.add(start, "b:80", 1, 100, 0)
+				d.add(start, "c:80", 3, 0, 0)
+			},
+			top: []DestinationStats{
+				{Destination: "b:80", Sessions: 1, ClientToRemoteBytes: 100, LastSeen: start},
+				{Destination: "a:80", Sessions: 1, ClientToRemoteBytes: 10, RemoteToClientBytes: 10, LastSeen: start},
+				{Destination: "c:80", Sessions: 3, LastSeen: start},
+			},
+		},
+		{
+			name: "then by sessions and name",
+			adds: func(d *destinations) {
+				d.add(start, "c:80", 1, 0, 0)
+				d.add(start, "b:80", 2, 0, 0)
+				d.add(start, "a:80", 1, 0, 0)
+			},
+			top: []DestinationStats{
+				{Destination: "b:80", Sessions: 2, LastSeen: start},
+				{Destination: "a:80", Sessions: 1, LastSeen: start},
+				{Destination: "c:80", Sessions: 1, LastSeen: start},
+			},
+		},
+		{
+			name: "added up",
+			adds: func(d *destinations) {
+				d.add(start, "a:80", 1, 0, 0)
+				d.add(start, "a:80", 0, 100, 200)
+			},
+			top: []DestinationStats{
+				{Destination: "a:80", Sessions: 1, ClientToRemoteBytes: 100, RemoteToClientBytes: 200, LastSeen: start},
+			},
+		},
+		{
+			name: "decayed before added",
+			adds: func(d *destinations) {
+				d.add(start, "a:80", 2, 200, 0)
+				d.add(start.Add(time.Hour), "a:80", 1, 0, 0)
+			},
+			top: []DestinationStats{
+				{Destination: "a:80", Sessions: 2, ClientToRemoteBytes: 100, LastSeen: start.Add(time.Hour)},
+			},
+		},
+		{
+			name: "decayed when listed",
+			adds: func(d *destinations) {
+				d.add(start, "a:80", 4, 400, 0)
+				d.add(start.Add(time.Hour), "b:80", 1, 300, 0)
+			},
+			at: time.Hour,
+			top: []DestinationStats{
+				{Destination: "b:80", Sessions: 1, ClientToRemoteBytes: 300, LastSeen: start.Add(time.Hour)},
+				{Destination: "a:80", Sessions: 2, ClientToRemoteBytes: 200, LastSeen: start},
+			},
+		},
+	} {
+		var d destinations
+		tt.adds(&d)
+		if top := d.sorted(start.Add(tt.at)); !reflect.DeepEqual(top, tt.top) {
+			t.Errorf("%v: top %+v, want %+v", tt.name, top, tt.top)
+		}
+	}
+}
+
+func TestDestinationsPrune(t *testing.T) {
+	now := time.Unix(1000, 0)
+	var d destinations
+	for i := 0; i < maxDestinations; i++ {
+		d.add(now, fmt.Sprintf("10.0.0.%v:%v", i%256, 1000+i), 1, int64(i+1), 0)
+	}
+	// the least used quarter is forgotten for the new destination.
+	d.add(now, "new:80", 1, 0, 0)
+	if n := len(d.stats); n != maxDestinations-maxDestinations/4+1 {
+		t.Fatalf("%v destinations tracked, want %v", n, maxDestinations-maxDestinations/4+1)
+	}
+	for dest, st := range d.stats {
+		if dest != "new:80" && st.Bytes() <= maxDestinations/4 {
+			t.Errorf("destination %v of %v bytes kept", dest, st.Bytes())
+		}
+	}
+}
+
+func TestTopDestinations(t *testing.T) {
+	echo := echoTarget(t)
+	s, addr := serve(t)
+	for i := 0; i < 2; i++ {
+		conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEcho(t, conn, []byte("hello"))
+		conn.Close()
+	}
+	// the bytes are counted once the sessions end.
+	echo.Close()
+	var top []DestinationStats
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if top = s.TopDestinations(10); len(top) == 1 && approx(top[0].Bytes(), 20) {
+			break
+		}
+	}
+	if len(top) != 1 || top[0].Destination != echo.Addr || !approx(top[0].Sessions, 2) || !approx(top[0].Bytes(), 20) {
+		t.Fatalf("top destinations %+v, want 2 sessions to %v of 20 bytes", top, echo.Addr)
+	}
+	for _, tt := range []struct {
+		n    int
+		want int
+	}{
+		{0, 0},
+		{1, 1},
+		{-1, 1},
+	} {
+		if top := s.TopDestinations(tt.n); len(top) != tt.want {
+			t.Errorf("top %v destinations: %+v, want %v", tt.n, top, tt.want)
+		}
+	}
+}
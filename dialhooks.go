@@ -0,0 +1,177 @@
+package socks4
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DialEvent describes a dial of a Dialer through its proxy server.
+type DialEvent struct {
+	Proxy   string        // address of the proxy server connected, or the configured one.
+	Target  string        // address requested.
+	UserId  string        // user id of the request.
+	Latency time.Duration // since the start of the dial, 0 at the start.
+	Code    byte          // reply code of the server, 0 if none was read.
+	Err     error         // error of the failed dials.
+}
+
+// DialerHooks are called along the dials of a Dialer, see
+// WithDialerHooks. Nil hooks are skipped.
+type DialerHooks struct {
+	OnStart   func(ev DialEvent) // before connecting to the proxy server.
+	OnSuccess func(ev DialEvent) // once the request is granted.
+	OnFailure func(ev DialEvent) // once the dial failed or was rejected.
+}
+
+// WithDialerHooks adds hooks called along the dials, e.g. to trace or
+// measure them like the direct connections of an application. See
+// DialerMetrics for Prometheus metrics.
+func WithDialerHooks(hooks DialerHooks) DialerOption {
+	return func(d *Dialer) {
+		d.hooks = append(d.hooks, hooks)
+	}
+}
+
+// dialStarted calls the start hooks.
+func (d *Dialer) dialStarted(ev DialEvent) {
+	for _, h := range d.hooks {
+		if h.OnStart != nil {
+			h.OnStart(ev)
+		}
+	}
+}
+
+// dialDone calls the success or failure hooks of a dial started at start.
+func (d *Dialer) dialDone(ev DialEvent, start time.Time) {
+	ev.Latency = time.Since(start)
+	for _, h := range d.hooks {
+		if ev.Err == nil && h.OnSuccess != nil {
+			h.OnSuccess(ev)
+		} else if ev.Err != nil && h.OnFailure != nil {
+			h.OnFailure(ev)
+		}
+	}
+}
+
+// DialerMetrics counts the dials of the dialers it hooks, and serves them
+// to Prometheus in its text format, i.e.:
+//
+//	m := socks4.NewDialerMetrics()
+//	d := socks4.NewDialer("127.0.0.1:1080", socks4.WithDialerHooks(m.Hooks()))
+//	http.Handle("/metrics/socks4", m)
+type DialerMetrics struct {
+	inFlight atomic.Int64
+	latency  *histogram // of the granted dials.
+
+	mu      sync.Mutex
+	results map[dialResult]uint64
+}
+
+type dialResult struct {
+	proxy, result string
+}
+
+// NewDialerMetrics returns metrics with the latency buckets, or
+// DefaultLatencyBuckets if none.
+func NewDialerMetrics(buckets ...time.Duration) *DialerMetrics {
+	if len(buckets) == 0 {
+		buckets = DefaultLatencyBuckets
+	}
+	return &DialerMetrics{latency: newHistogram(buckets), results: make(map[dialResult]uint64)}
+}
+
+// Hooks returns the hooks recording the dials.
+func (m *DialerMetrics) Hooks() DialerHooks {
+	return DialerHooks{
+		OnStart: func(DialEvent) {
+			m.inFlight.Add(1)
+		},
+		OnSuccess: func(ev DialEvent) {
+			m.latency.observe(ev.Latency)
+			m.done(ev)
+		},
+		OnFailure: m.done,
+	}
+}
+
+func (m *DialerMetrics) done(ev DialEvent) {
+	m.inFlight.Add(-1)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.results[dialResult{ev.Proxy, dialResultName(ev)}]++
+}
+
+// dialResultName returns the result label of a dial.
+func dialResultName(ev DialEvent) string {
+	switch {
+	case ev.Err == nil:
+		return "granted"
+	case ev.Code == RejectNoIdentd:
+		return "no_identd"
+	case ev.Code == RejectWrongUserId:
+		return "wrong_user_id"
+	case ev.Code != 0:
+		return "rejected"
+	}
+	return "error"
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *DialerMetrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	fmt.Fprintf(cw, "# HELP socks4_dialer_dials_total Dials through the proxy servers by result.\n# TYPE socks4_dialer_dials_total counter\n")
+	m.mu.Lock()
+	results := make([]dialResult, 0, len(m.results))
+	for r := range m.results {
+		results = append(results, r)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].proxy != results[j].proxy {
+			return results[i].proxy < results[j].proxy
+		}
+		return results[i].result < results[j].result
+	})
+	for _, r := range results {
+		fmt.Fprintf(cw, "socks4_dialer_dials_total{proxy=%q,result=%q} %v\n", r.proxy, r.result, m.results[r])
+	}
+	m.mu.Unlock()
+	fmt.Fprintf(cw, "# HELP socks4_dialer_dials_in_flight Dials through the proxy servers in progress.\n# TYPE socks4_dialer_dials_in_flight gauge\nsocks4_dialer_dials_in_flight %v\n", m.inFlight.Load())
+	h := m.latency.snapshot()
+	fmt.Fprintf(cw, "# HELP socks4_dialer_dial_duration_seconds Time to connect through the proxy servers, for the granted dials.\n# TYPE socks4_dialer_dial_duration_seconds histogram\n")
+	var cumulative uint64
+	for i, bound := range h.Buckets {
+		cumulative += h.Counts[i]
+		fmt.Fprintf(cw, "socks4_dialer_dial_duration_seconds_bucket{le=\"%v\"} %v\n", bound.Seconds(), cumulative)
+	}
+	fmt.Fprintf(cw, "socks4_dialer_dial_duration_seconds_bucket{le=\"+Inf\"} %v\n", h.Count)
+	fmt.Fprintf(cw, "socks4_dialer_dial_duration_seconds_sum %v\nsocks4_dialer_dial_duration_seconds_count %v\n", h.Sum.Seconds(), h.Count)
+	return cw.n, cw.err
+}
+
+// ServeHTTP serves the metrics to Prometheus.
+func (m *DialerMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// countingWriter counts the bytes written to w, and keeps its first error.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,115 @@
+package socks4
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDialResultName(t *testing.T) {
+	for _, tt := range []struct {
+		ev     DialEvent
+		result string
+	}{
+		{DialEvent{Code: Granted}, "granted"},
+		{DialEvent{Code: RejectOrFailure, Err: &RejectError{Code: RejectOrFailure}}, "rejected"},
+		{DialEvent{Code: RejectNoIdentd, Err: &RejectError{Code: RejectNoIdentd}}, "no_identd"},
+		{DialEvent{Code: RejectWrongUserId, Err: &RejectError{Code: RejectWrongUserId}}, "wrong_user_id"},
+		{DialEvent{Err: errors.New("connection refused")}, "error"},
+	} {
+		if result := dialResultName(tt.ev); result != tt.result {
+			t.Errorf("result of %+v: %q, want %q", tt.ev, result, tt.result)
+		}
+	}
+}
+
+func TestDialerHooks(t *testing.T) {
+	down := closedAddr(t)
+	for _, tt := range []struct {
+		name   string
+		reply  []byte // of the proxy, none for a closed port.
+		userId string // of the context.
+		events []string
+		code   byte
+	}{
+		{name: "granted", reply: []byte{0, Granted, 0, 80, 10, 0, 0, 1}, events: []string{"start", "success"}, code: Granted},
+		{name: "granted with the user id of the context", reply: []byte{0, Granted, 0, 80, 10, 0, 0, 1}, userId: "bob", events: []string{"start", "success"}, code: Granted},
+		{name: "rejected", reply: []byte{0, RejectOrFailure, 0, 0, 0, 0, 0, 0}, events: []string{"start", "failure"}, code: RejectOrFailure},
+		{name: "short reply", reply: []byte{0, Granted}, events: []string{"start", "failure"}},
+		{name: "proxy down", events: []string{"start", "failure"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := down
+			if tt.reply != nil {
+				addr, _ = fakeProxy(t, tt.reply)
+			}
+			var events []string
+			var last DialEvent
+			record := func(name string) func(ev DialEvent) {
+				return func(ev DialEvent) {
+					events = append(events, name)
+					last = ev
+				}
+			}
+			d := NewDialer(addr, WithDialerUserId("alice"), WithDialerTimeout(5*time.Second),
+				WithDialerHooks(DialerHooks{OnStart: record("start"), OnSuccess: record("success"), OnFailure: record("failure")}),
+				// the nil hooks are skipped.
+				WithDialerHooks(DialerHooks{}))
+			ctx := context.Background()
+			userId := "alice"
+			if tt.userId != "" {
+				ctx, userId = ContextWithDialOptions(ctx, DialOptions{UserId: tt.userId}), tt.userId
+			}
+			conn, err := d.DialContext(ctx, "tcp", "10.0.0.1:80")
+			if err == nil {
+				conn.Close()
+			}
+			if strings.Join(events, ",") != strings.Join(tt.events, ",") {
+				t.Errorf("events %v, want %v", events, tt.events)
+			}
+			if last.Proxy != addr || last.Target != "10.0.0.1:80" || last.UserId != userId || last.Code != tt.code || last.Err != err || last.Latency <= 0 {
+				t.Errorf("event %+v, want the dial by %v through %v with code %#x and error %v", last, userId, addr, tt.code, err)
+			}
+		})
+	}
+}
+
+func TestDialerMetrics(t *testing.T) {
+	m := NewDialerMetrics(10*time.Millisecond, time.Minute)
+	granted, _ := fakeProxy(t, []byte{0, Granted, 0, 80, 10, 0, 0, 1})
+	rejected, _ := fakeProxy(t, []byte{0, RejectNoIdentd, 0, 0, 0, 0, 0, 0})
+	for _, addr := range []string{granted, rejected} {
+		if conn, err := NewDialer(addr, WithDialerHooks(m.Hooks()), WithDialerTimeout(5*time.Second)).Dial("tcp", "10.0.0.1:80"); err == nil {
+			conn.Close()
+		}
+	}
+	var b bytes.Buffer
+	n, err := m.WriteTo(&b)
+	if err != nil || n != int64(b.Len()) {
+		t.Fatalf("wrote %v bytes of %v: %v", n, b.Len(), err)
+	}
+	for _, sample := range []string{
+		"# TYPE socks4_dialer_dials_total counter",
+		`socks4_dialer_dials_total{proxy="` + granted + `",result="granted"} 1`,
+		`socks4_dialer_dials_total{proxy="` + rejected + `",result="no_identd"} 1`,
+		"socks4_dialer_dials_in_flight 0",
+		`socks4_dialer_dial_duration_seconds_bucket{le="60"} 1`,
+		`socks4_dialer_dial_duration_seconds_bucket{le="+Inf"} 1`,
+		"socks4_dialer_dial_duration_seconds_count 1",
+	} {
+		if !strings.Contains(b.String(), sample+"\n") {
+			t.Errorf("no sample %q in:\n%s", sample, b.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") || w.Body.String() != b.String() {
+		t.Errorf("served %v %q with %q, want the metrics", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+}
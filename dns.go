@@ -0,0 +1,398 @@
+package socks4
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DNSOptions are the options of the DoH and DoT resolvers.
+type DNSOptions struct {
+	// Bootstrap are the IPs of the DNS server, connected to without
+	// resolving its name.
+	Bootstrap []string
+	// Timeout of each lookup, 5s by default.
+	Timeout time.Duration
+	// Fallback makes the lookups failing with the DNS server go to the
+	// system resolver. The names not found are not looked up again.
+	Fallback bool
+	// TLSConfig of the connections to the DNS server, nil for the default.
+	TLSConfig *tls.Config
+}
+
+const (
+	defaultDNSTimeout = 5 * time.Second
+	// maxDNSCache is the number of names cached by a resolver.
+	maxDNSCache = 4096
+	// maxDNSMessage is the max size of a DNS response.
+	maxDNSMessage = 65535
+)
+
+// DoHResolver is a Resolver querying a DNS-over-HTTPS server (RFC 8484), so
+// that the lookups are not seen on the local network.
+type DoHResolver struct {
+	*dnsClient
+	url    string
+	client *http.Client
+}
+
+// NewDoHResolver returns a resolver querying the DoH server at url, like
+// https://cloudflare-dns.com/dns-query.
+func NewDoHResolver(rawURL string, opts DNSOptions) (*DoHResolver, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DoH URL: %v", err)
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid DoH URL %q: not https", rawURL)
+	}
+	r := &DoHResolver{url: rawURL}
+	transport := &http.Transport{
+		TLSClientConfig:     opts.TLSConfig,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     time.Minute,
+		ForceAttemptHTTP2:   true,
+	}
+	if len(opts.Bootstrap) > 0 {
+		transport.DialContext = bootstrapDialer(opts.Bootstrap)
+	}
+	r.client = &http.Client{Transport: transport}
+	r.dnsClient = newDNSClient(opts, r.exchange)
+	return r, nil
+}
+
+func (r *DoHResolver) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server replied %v", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxDNSMessage))
+}
+
+// DoTResolver is a Resolver querying a DNS-over-TLS server (RFC 7858), so
+// that the lookups are not seen on the local network.
+type DoTResolver struct {
+	*dnsClient
+	address string
+	dial    func(ctx context.Context, network, address string) (net.Conn, error)
+	config  *tls.Config
+}
+
+// NewDoTResolver returns a resolver querying the DoT server at address
+// (host:port), like dns.google:853.
+func NewDoTResolver(address string, opts DNSOptions) (*DoTResolver, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DoT address %q: %v", address, err)
+	}
+	config := &tls.Config{}
+	if opts.TLSConfig != nil {
+		config = opts.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	r := &DoTResolver{address: address, config: config, dial: (&net.Dialer{}).DialContext}
+	if len(opts.Bootstrap) > 0 {
+		r.dial = bootstrapDialer(opts.Bootstrap)
+	}
+	r.dnsClient = newDNSClient(opts, r.exchange)
+	return r, nil
+}
+
+func (r *DoTResolver) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := r.dial(ctx, "tcp", r.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return exchangeStream(tls.Client(conn, r.config), query)
+}
+
+// exchangeStream sends the query on a stream connection and reads the
+// response, both prefixed by their length.
+func exchangeStream(conn io.ReadWriter, query []byte) ([]byte, error) {
+	msg := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+	if _, err := conn.Write(append(msg, query...)); err != nil {
+		return nil, err
+	}
+	var n uint16
+	if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, n)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// DNSResolver is a Resolver querying a plain DNS server, like the one of
+// an internal network, over UDP and over TCP for the truncated responses.
+// The TLS config and bootstrap IPs of its options are not used.
+type DNSResolver struct {
+	*dnsClient
+	address string
+}
+
+// NewDNSResolver returns a resolver querying the DNS server at address
+// (ip:port).
+func NewDNSResolver(address string, opts DNSOptions) (*DNSResolver, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid DNS address %q: %v", address, err)
+	}
+	r := &DNSResolver{address: address}
+	r.dnsClient = newDNSClient(opts, r.exchange)
+	return r, nil
+}
+
+func (r *DNSResolver) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", r.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	b := make([]byte, maxDNSMessage)
+	n, err := conn.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	// the TC flag asks to query over TCP.
+	if n < 3 || b[2]&0x02 == 0 {
+		return b[:n], nil
+	}
+	tc, err := d.DialContext(ctx, "tcp", r.address)
+	if err != nil {
+		return nil, err
+	}
+	defer tc.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		tc.SetDeadline(deadline)
+	}
+	return exchangeStream(tc, query)
+}
+
+// bootstrapDialer returns a dial function connecting to the port of its
+// address on the bootstrap IPs in turn, instead of resolving its host.
+func bootstrapDialer(bootstrap []string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		_, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range bootstrap {
+			var conn net.Conn
+			if conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// dnsClient looks up the addresses of names with the exchange of DNS
+// messages of a transport, and caches them for their TTL.
+type dnsClient struct {
+	opts     DNSOptions
+	exchange func(ctx context.Context, query []byte) ([]byte, error)
+
+	mu    sync.Mutex
+	cache map[string]dnsEntry
+}
+
+// dnsEntry is a cached lookup.
+type dnsEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+}
+
+func newDNSClient(opts DNSOptions, exchange func(ctx context.Context, query []byte) ([]byte, error)) *dnsClient {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultDNSTimeout
+	}
+	return &dnsClient{opts: opts, exchange: exchange, cache: make(map[string]dnsEntry)}
+}
+
+// errNotFound is the error of the names without addresses.
+var errNotFound = errors.New("no such host")
+
+// LookupIPAddr looks up the IPv4 and IPv6 addresses of host.
+func (c *dnsClient) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+	now := time.Now()
+	c.mu.Lock()
+	e, ok := c.cache[name]
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	qctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+	defer cancel()
+	addrs, ttl, err := c.lookup(qctx, name)
+	if errors.Is(err, errNotFound) {
+		return nil, &net.DNSError{Err: err.Error(), Name: host, IsNotFound: true}
+	}
+	if err != nil {
+		if c.opts.Fallback {
+			return net.DefaultResolver.LookupIPAddr(ctx, host)
+		}
+		return nil, &net.DNSError{Err: err.Error(), Name: host, IsTimeout: qctx.Err() != nil, IsTemporary: true}
+	}
+	if ttl > 0 {
+		c.store(name, dnsEntry{addrs: addrs, expires: now.Add(ttl)}, now)
+	}
+	return addrs, nil
+}
+
+// store caches the entry of the name, making room if the cache is full.
+func (c *dnsClient) store(name string, e dnsEntry, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.cache) >= maxDNSCache {
+		for n, old := range c.cache {
+			if !now.Before(old.expires) {
+				delete(c.cache, n)
+			}
+		}
+		// the map iteration order is random.
+		for n := range c.cache {
+			if len(c.cache) < maxDNSCache {
+				break
+			}
+			delete(c.cache, n)
+		}
+	}
+	c.cache[name] = e
+}
+
+// lookup queries the A and AAAA records of name concurrently, and returns
+// their addresses, IPv4 first, with the min TTL.
+func (c *dnsClient) lookup(ctx context.Context, name string) ([]net.IPAddr, time.Duration, error) {
+	type result struct {
+		addrs []net.IPAddr
+		ttl   time.Duration
+		err   error
+	}
+	results := make(chan result, 1)
+	go func() {
+		addrs, ttl, err := c.query(ctx, name, dnsmessage.TypeAAAA)
+		results <- result{addrs, ttl, err}
+	}()
+	r4 := result{}
+	r4.addrs, r4.ttl, r4.err = c.query(ctx, name, dnsmessage.TypeA)
+	r6 := <-results
+
+	if r4.err != nil && r6.err != nil {
+		if errors.Is(r4.err, errNotFound) {
+			return nil, 0, r6.err
+		}
+		return nil, 0, r4.err
+	}
+	var addrs []net.IPAddr
+	var ttl time.Duration
+	for _, r := range []result{r4, r6} {
+		if r.err != nil || len(r.addrs) == 0 {
+			continue
+		}
+		if len(addrs) == 0 || r.ttl < ttl {
+			ttl = r.ttl
+		}
+		addrs = append(addrs, r.addrs...)
+	}
+	if len(addrs) == 0 {
+		return nil, 0, errNotFound
+	}
+	return addrs, ttl, nil
+}
+
+// query queries the records of the type of name.
+func (c *dnsClient) query(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IPAddr, time.Duration, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(rand.Uint32())
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	b, err := c.exchange(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var resp dnsmessage.Message
+	if err := resp.Unpack(b); err != nil {
+		return nil, 0, fmt.Errorf("invalid DNS response: %v", err)
+	}
+	if resp.ID != id && resp.ID != 0 {
+		return nil, 0, errors.New("DNS response to another query")
+	}
+	switch resp.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, errNotFound
+	default:
+		return nil, 0, fmt.Errorf("DNS server replied %v", resp.RCode)
+	}
+	var addrs []net.IPAddr
+	var ttl time.Duration
+	for _, a := range resp.Answers {
+		var ip net.IP
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			continue // like the CNAME records leading to the addresses.
+		}
+		if t := time.Duration(a.Header.TTL) * time.Second; len(addrs) == 0 || t < ttl {
+			ttl = t
+		}
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return addrs, ttl, nil
+}
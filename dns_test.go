@@ -0,0 +1,500 @@
+package socks4
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsRecords answers the DNS queries of their names, with the TTL. The
+// names not listed are not found.
+type dnsRecords struct {
+	addrs   map[string][]string
+	ttl     uint32
+	rcode   dnsmessage.RCode // of the responses of the listed names.
+	queries atomic.Int32
+}
+
+// answer returns the response to the query.
+func (r *dnsRecords) answer(query []byte) []byte {
+	r.queries.Add(1)
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	q := msg.Questions[0]
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true, RCode: r.rcode},
+		Questions: msg.Questions,
+	}
+	addrs, ok := r.addrs[strings.TrimSuffix(q.Name.String(), ".")]
+	if !ok {
+		resp.RCode = dnsmessage.RCodeNameError
+	}
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		h := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: r.ttl}
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			var body dnsmessage.AResource
+			copy(body.A[:], ip4)
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: h, Body: &body})
+		} else if ip.To4() == nil && q.Type == dnsmessage.TypeAAAA {
+			var body dnsmessage.AAAAResource
+			copy(body.AAAA[:], ip)
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: h, Body: &body})
+		}
+	}
+	b, _ := resp.Pack()
+	return b
+}
+
+func (r *dnsRecords) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	return r.answer(query), nil
+}
+
+// ipList returns the IPs of the addresses separated by commas.
+func ipList(addrs []net.IPAddr) string {
+	ips := make([]string, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP.String()
+	}
+	return strings.Join(ips, ",")
+}
+
+func TestDNSClientLookup(t *testing.T) {
+	records := map[string][]string{
+		"www.example.com":  {"2001:db8::1", "192.0.2.1", "192.0.2.2"},
+		"ipv6.example.com": {"2001:db8::2"},
+		"none.example.com": {},
+	}
+	for _, tt := range []struct {
+		name     string
+		host     string
+		rcode    dnsmessage.RCode
+		addrs    string
+		notFound bool
+		err      bool
+	}{
+		{name: "IPv4 first", host: "www.example.com", addrs: "192.0.2.1,192.0.2.2,2001:db8::1"},
+		{name: "IPv6 only", host: "ipv6.example.com", addrs: "2001:db8::2"},
+		{name: "case and final dot", host: "WWW.Example.com.", addrs: "192.0.2.1,192.0.2.2,2001:db8::1"},
+		{name: "IP", host: "192.0.2.9", addrs: "192.0.2.9"},
+		{name: "not found", host: "other.example.com", notFound: true, err: true},
+		{name: "no addresses", host: "none.example.com", notFound: true, err: true},
+		{name: "server failure", host: "www.example.com", rcode: dnsmessage.RCodeServerFailure, err: true},
+	} {
+		r := &dnsRecords{addrs: records, ttl: 60, rcode: tt.rcode}
+		c := newDNSClient(DNSOptions{}, r.exchange)
+		addrs, err := c.LookupIPAddr(context.Background(), tt.host)
+		var dnsErr *net.DNSError
+		if (err != nil) != tt.err || err != nil && (!errors.As(err, &dnsErr) || dnsErr.IsNotFound != tt.notFound) {
+			t.Errorf("%v: error %v, want %v (not found %v)", tt.name, err, tt.err, tt.notFound)
+			continue
+		}
+		if ipList(addrs) != tt.addrs {
+			t.Errorf("%v: addresses %v, want %v", tt.name, addrs, tt.addrs)
+		}
+	}
+}
+
+func TestDNSClientCache(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		ttl     uint32
+		hosts   []string
+		queries int32 // A and AAAA ones.
+	}{
+		{name: "cached", ttl: 60, hosts: []string{"www.example.com", "www.example.com"}, queries: 2},
+		{name: "same name", ttl: 60, hosts: []string{"www.example.com", "WWW.example.com."}, queries: 2},
+		{name: "other name", ttl: 60, hosts: []string{"www.example.com", "mail.example.com"}, queries: 4},
+		{name: "no TTL", ttl: 0, hosts: []string{"www.example.com", "www.example.com"}, queries: 4},
+		{name: "not found", ttl: 60, hosts: []string{"other.example.com", "other.example.com"}, queries: 4},
+	} {
+		r := &dnsRecords{addrs: map[string][]string{"www.example.com": {"192.0.2.1"}, "mail.example.com": {"192.0.2.2"}}, ttl: tt.ttl}
+		c := newDNSClient(DNSOptions{}, r.exchange)
+		for _, host := range tt.hosts {
+			c.LookupIPAddr(context.Background(), host)
+		}
+		if n := r.queries.Load(); n != tt.queries {
+			t.Errorf("%v: %v queries, want %v", tt.name, n, tt.queries)
+		}
+	}
+}
+
+func TestDNSClientFailure(t *testing.T) {
+	failing := func(ctx context.Context, query []byte) ([]byte, error) {
+		return nil, errors.New("connection refused")
+	}
+	slow := func(ctx context.Context, query []byte) ([]byte, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	otherID := func(ctx context.Context, query []byte) ([]byte, error) {
+		b := (&dnsRecords{addrs: map[string][]string{"localhost": {"192.0.2.1"}}}).answer(query)
+		binary.BigEndian.PutUint16(b, binary.BigEndian.Uint16(b)+1)
+		return b, nil
+	}
+	for _, tt := range []struct {
+		name     string
+		exchange func(ctx context.Context, query []byte) ([]byte, error)
+		opts     DNSOptions
+		timeout  bool
+		fallback bool // to the system resolver.
+	}{
+		{name: "failure", exchange: failing},
+		{name: "timeout", exchange: slow, opts: DNSOptions{Timeout: 50 * time.Millisecond}, timeout: true},
+		{name: "response to another query", exchange: otherID},
+		{name: "invalid response", exchange: func(ctx context.Context, query []byte) ([]byte, error) { return []byte("invalid"), nil }},
+		{name: "fallback", exchange: failing, opts: DNSOptions{Fallback: true}, fallback: true},
+	} {
+		c := newDNSClient(tt.opts, tt.exchange)
+		addrs, err := c.LookupIPAddr(context.Background(), "localhost")
+		if tt.fallback {
+			if err != nil || len(addrs) == 0 {
+				t.Errorf("%v: resolved %v with error %v, want the addresses of the system resolver", tt.name, addrs, err)
+			}
+			continue
+		}
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsTemporary || dnsErr.IsNotFound || dnsErr.IsTimeout != tt.timeout {
+			t.Errorf("%v: error %#v, want a temporary error (timeout %v)", tt.name, err, tt.timeout)
+		}
+	}
+}
+
+// dnsPKI returns the config of the clients trusting the test CA, and the
+// certificate of dns.example.com and 127.0.0.1 it issued.
+func dnsPKI(t *testing.T) (*tls.Config, tls.Certificate) {
+	pki := newTestPKI(t)
+	return &tls.Config{RootCAs: pki.pool}, pki.issue(t, &x509.Certificate{DNSNames: []string{"dns.example.com"}})
+}
+
+func TestDoHResolver(t *testing.T) {
+	client, cert := dnsPKI(t)
+	records := &dnsRecords{addrs: map[string][]string{"www.example.com": {"192.0.2.1"}}, ttl: 60}
+	var failing atomic.Bool
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, _ := io.ReadAll(r.Body)
+		if failing.Load() || r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(records.answer(query))
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	srv.StartTLS()
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	for _, tt := range []struct {
+		name   string
+		url    string
+		opts   DNSOptions
+		failed bool // the server replies an error.
+		err    string
+	}{
+		{name: "IP", url: "https://127.0.0.1:" + port + "/dns-query", opts: DNSOptions{TLSConfig: client}},
+		{name: "bootstrap", url: "https://dns.example.com:" + port + "/dns-query", opts: DNSOptions{TLSConfig: client, Bootstrap: []string{"127.0.0.2", "127.0.0.1"}}},
+		{name: "untrusted server", url: "https://127.0.0.1:" + port + "/dns-query", err: "certificate"},
+		{name: "server error", url: "https://127.0.0.1:" + port + "/dns-query", opts: DNSOptions{TLSConfig: client}, failed: true, err: "400 Bad Request"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			failing.Store(tt.failed)
+			r, err := NewDoHResolver(tt.url, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs, err := r.LookupIPAddr(context.Background(), "www.example.com")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || ipList(addrs) != "192.0.2.1" {
+				t.Errorf("resolved %v with error %v, want 192.0.2.1", addrs, err)
+			}
+		})
+	}
+}
+
+func TestNewDoHResolver(t *testing.T) {
+	for _, tt := range []struct {
+		url string
+		ok  bool
+	}{
+		{"https://cloudflare-dns.com/dns-query", true},
+		{"http://cloudflare-dns.com/dns-query", false},
+		{"cloudflare-dns.com/dns-query", false},
+		{"https://%zz", false},
+	} {
+		if _, err := NewDoHResolver(tt.url, DNSOptions{}); (err == nil) != tt.ok {
+			t.Errorf("URL %q: error %v, want valid %v", tt.url, err, tt.ok)
+		}
+	}
+}
+
+// dotServer serves the DNS records over TLS with the certificate, and
+// returns its port.
+func dotServer(t *testing.T, cert tls.Certificate, records *dnsRecords) string {
+	t.Helper()
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var n uint16
+					if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+						return
+					}
+					query := make([]byte, n)
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					resp := records.answer(query)
+					conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+				}
+			}()
+		}
+	}()
+	return strconv.Itoa(lis.Addr().(*net.TCPAddr).Port)
+}
+
+func TestDoTResolver(t *testing.T) {
+	client, cert := dnsPKI(t)
+	port := dotServer(t, cert, &dnsRecords{addrs: map[string][]string{"www.example.com": {"192.0.2.1", "2001:db8::1"}}, ttl: 60})
+	for _, tt := range []struct {
+		name    string
+		address string
+		opts    DNSOptions
+		err     string
+	}{
+		{name: "bootstrap", address: "dns.example.com:" + port, opts: DNSOptions{TLSConfig: client, Bootstrap: []string{"127.0.0.1"}}},
+		{name: "server name", address: "127.0.0.1:" + port, opts: DNSOptions{TLSConfig: &tls.Config{RootCAs: client.RootCAs, ServerName: "dns.example.com"}}},
+		{name: "untrusted server", address: "127.0.0.1:" + port, err: "certificate"},
+		{name: "other server name", address: "127.0.0.1:" + port, opts: DNSOptions{TLSConfig: &tls.Config{RootCAs: client.RootCAs, ServerName: "other.example.com"}}, err: "certificate"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewDoTResolver(tt.address, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs, err := r.LookupIPAddr(context.Background(), "www.example.com")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || ipList(addrs) != "192.0.2.1,2001:db8::1" {
+				t.Errorf("resolved %v with error %v, want 192.0.2.1 and 2001:db8::1", addrs, err)
+			}
+		})
+	}
+	if _, err := NewDoTResolver("dns.google", DNSOptions{}); err == nil {
+		t.Error("DoT address without port")
+	}
+	// the config of the options is not changed.
+	opts := DNSOptions{TLSConfig: &tls.Config{}}
+	NewDoTResolver("dns.google:853", opts)
+	if opts.TLSConfig.ServerName != "" {
+		t.Errorf("server name %q set in the config of the options", opts.TLSConfig.ServerName)
+	}
+}
+
+func TestWithResolverDoT(t *testing.T) {
+	echo := echoTarget(t)
+	client, cert := dnsPKI(t)
+	port := dotServer(t, cert, &dnsRecords{addrs: map[string][]string{"echo.example.com": {"127.0.0.1"}}, ttl: 60})
+	r, err := NewDoTResolver("127.0.0.1:"+port, DNSOptions{TLSConfig: &tls.Config{RootCAs: client.RootCAs, ServerName: "dns.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := serve(t, WithResolver(r))
+	_, echoPort, _ := net.SplitHostPort(echo.Addr)
+	conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", "echo.example.com:"+echoPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, []byte("hello"))
+}
+
+// dnsServer serves the DNS records on a local UDP port, and over TCP on
+// the same port. The UDP responses are truncated if truncate is set.
+func dnsServer(t *testing.T, records *dnsRecords, truncate bool) string {
+	t.Helper()
+	// the TCP port is taken first, those being the ones the connections of
+	// the other tests leave bound.
+	var lis net.Listener
+	var pc net.PacketConn
+	for i := 0; pc == nil; i++ {
+		var err error
+		if lis, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatal(err)
+		}
+		if pc, err = net.ListenPacket("udp", lis.Addr().String()); err != nil {
+			lis.Close()
+			if i == 10 {
+				t.Fatal(err)
+			}
+		}
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		lis.Close()
+	})
+	go func() {
+		b := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			resp := records.answer(b[:n])
+			if truncate {
+				var msg dnsmessage.Message
+				msg.Unpack(resp)
+				msg.Truncated = true
+				msg.Answers = nil
+				resp, _ = msg.Pack()
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var n uint16
+				if err := binary.Read(conn, binary.BigEndian, &n); err != nil {
+					return
+				}
+				query := make([]byte, n)
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := records.answer(query)
+				conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+			}()
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestDNSResolver(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		truncate bool
+	}{
+		{name: "UDP"},
+		{name: "TCP after a truncated response", truncate: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := dnsServer(t, &dnsRecords{addrs: map[string][]string{"db.corp.example": {"10.0.0.5"}}, ttl: 60}, tt.truncate)
+			r, err := NewDNSResolver(addr, DNSOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			addrs, err := r.LookupIPAddr(context.Background(), "db.corp.example")
+			if err != nil || ipList(addrs) != "10.0.0.5" {
+				t.Errorf("resolved %v with error %v, want 10.0.0.5", addrs, err)
+			}
+		})
+	}
+	if _, err := NewDNSResolver("10.0.0.2", DNSOptions{}); err == nil {
+		t.Error("DNS address without port")
+	}
+}
+
+// staticResolver resolves every name to its IP, counting the lookups.
+type staticResolver struct {
+	ip      string
+	lookups int
+}
+
+func (r *staticResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.lookups++
+	return []net.IPAddr{{IP: net.ParseIP(r.ip)}}, nil
+}
+
+func TestSplitResolver(t *testing.T) {
+	corp := &staticResolver{ip: "10.0.0.5"}
+	lab := &staticResolver{ip: "10.1.0.5"}
+	def := &staticResolver{ip: "192.0.2.1"}
+	s := NewSplitResolver(def)
+	s.Route("*.lab.corp.example", lab)
+	s.Route("*.corp.example", corp)
+	s.Route("intranet", corp)
+	for _, tt := range []struct {
+		host string
+		ip   string
+	}{
+		{"db.corp.example", "10.0.0.5"},
+		{"DB.Corp.Example.", "10.0.0.5"},
+		{"host.lab.corp.example", "10.1.0.5"},
+		{"intranet", "10.0.0.5"},
+		{"intranet.example.com", "192.0.2.1"},
+		{"corp.example", "192.0.2.1"},
+		{"www.example.com", "192.0.2.1"},
+	} {
+		addrs, err := s.LookupIPAddr(context.Background(), tt.host)
+		if err != nil || ipList(addrs) != tt.ip {
+			t.Errorf("%v resolved to %v with error %v, want %v", tt.host, addrs, err, tt.ip)
+		}
+	}
+	if corp.lookups != 3 || lab.lookups != 1 || def.lookups != 3 {
+		t.Errorf("lookups %v, %v and %v, want 3, 1 and 3", corp.lookups, lab.lookups, def.lookups)
+	}
+
+	// the system resolver by default.
+	addrs, err := NewSplitResolver(nil).LookupIPAddr(context.Background(), "localhost")
+	if err != nil || len(addrs) == 0 {
+		t.Errorf("localhost resolved to %v with error %v by the system resolver", addrs, err)
+	}
+}
+
+func TestSplitResolverCaches(t *testing.T) {
+	internal := &dnsRecords{addrs: map[string][]string{"db.corp.example": {"10.0.0.5"}}, ttl: 60}
+	public := &dnsRecords{addrs: map[string][]string{"db.corp.example": {"192.0.2.5"}, "www.example.com": {"192.0.2.1"}}, ttl: 60}
+	s := NewSplitResolver(newDNSClient(DNSOptions{}, public.exchange))
+	s.Route("*.corp.example", newDNSClient(DNSOptions{}, internal.exchange))
+	for i := 0; i < 2; i++ {
+		for host, ip := range map[string]string{"db.corp.example": "10.0.0.5", "www.example.com": "192.0.2.1"} {
+			if addrs, err := s.LookupIPAddr(context.Background(), host); err != nil || ipList(addrs) != ip {
+				t.Errorf("%v resolved to %v with error %v, want %v", host, addrs, err, ip)
+			}
+		}
+	}
+	// the A and AAAA queries of each name once.
+	if internal.queries.Load() != 2 || public.queries.Load() != 2 {
+		t.Errorf("%v internal and %v public queries, want 2 each", internal.queries.Load(), public.queries.Load())
+	}
+}
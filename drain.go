@@ -0,0 +1,124 @@
+package socks4
+
+import "time"
+
+// defaultProgressInterval is the interval of the shutdown progress by
+// default.
+const defaultProgressInterval = 5 * time.Second
+
+// ShutdownProgress is the progress of a graceful shutdown, telling whether
+// to keep waiting for the remaining sessions or to close them.
+type ShutdownProgress struct {
+	Started  time.Time     `json:"started"`
+	Elapsed  time.Duration `json:"elapsed"`
+	Sessions int           `json:"sessions"` // remaining sessions.
+	// PendingBinds are the remaining BIND requests waiting for their
+	// remote hosts, see WithBindDrain.
+	PendingBinds int `json:"pending_binds"`
+	// OldestSession is the age of the oldest remaining session.
+	OldestSession time.Duration `json:"oldest_session"`
+}
+
+// WithShutdownProgress makes ShutDown and ShutdownContext log their
+// progress and call fn with it every interval, 5s by default, while
+// sessions remain. fn may be nil.
+func WithShutdownProgress(interval time.Duration, fn func(ShutdownProgress)) OptionFunc {
+	return func(s *Server) {
+		s.progressInterval = interval
+		s.progressFn = fn
+	}
+}
+
+// ShutdownProgress returns the progress of the graceful shutdown of the
+// server, and false if it is not shutting down.
+func (s *Server) ShutdownProgress() (ShutdownProgress, bool) {
+	now := s.clock.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdownStart.IsZero() {
+		return ShutdownProgress{}, false
+	}
+	p := ShutdownProgress{
+		Started:      s.shutdownStart,
+		Elapsed:      now.Sub(s.shutdownStart),
+		Sessions:     len(s.sessions),
+		PendingBinds: len(s.binds),
+	}
+	for ss := range s.sessions {
+		if age := now.Sub(ss.start); age > p.OldestSession {
+			p.OldestSession = age
+		}
+	}
+	return p, true
+}
+
+// reportProgress logs the progress of the shutdown and passes it to the
+// callback.
+func (s *Server) reportProgress() {
+	p, ok := s.ShutdownProgress()
+	if !ok {
+		return
+	}
+	s.logger.Infof("shutting down for %v, %v sessions remaining, the oldest for %v",
+		p.Elapsed.Round(time.Second), p.Sessions, p.OldestSession.Round(time.Second))
+	if s.progressFn != nil {
+		s.progressFn(p)
+	}
+}
+
+// ShutdownReport sums up a shutdown of the server, e.g. for the deploy
+// tools to record the impact of a restart.
+type ShutdownReport struct {
+	Started  time.Time     `json:"started"`
+	Duration time.Duration `json:"duration"`
+	// Sessions are the sessions being served when the shutdown began,
+	// Drained those complete before its deadline, and ForceClosed those
+	// closed at the deadline or by Close.
+	Sessions    int `json:"sessions"`
+	Drained     int `json:"drained"`
+	ForceClosed int `json:"force_closed"`
+	// AbortedBinds are the pending BIND requests closed, see WithBindDrain.
+	AbortedBinds int `json:"aborted_binds"`
+	// The bytes relayed during the shutdown, by the draining sessions.
+	ClientToRemoteBytes uint64 `json:"client_to_remote_bytes"`
+	RemoteToClientBytes uint64 `json:"remote_to_client_bytes"`
+}
+
+// ShutdownReport returns the report of the last shutdown of the server by
+// ShutDown, ShutdownContext or Close, and false if it has not completed
+// any.
+func (s *Server) ShutdownReport() (ShutdownReport, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdownReport == nil {
+		return ShutdownReport{}, false
+	}
+	return *s.shutdownReport, true
+}
+
+// beginReport returns the report of a shutdown beginning, holding the
+// counters to subtract at its end.
+func (s *Server) beginReport() *ShutdownReport {
+	return &ShutdownReport{
+		Started:             s.clock.Now(),
+		AbortedBinds:        int(s.stats.abortedBinds.Load()),
+		ClientToRemoteBytes: s.stats.clientToRemote.Load(),
+		RemoteToClientBytes: s.stats.remoteToClient.Load(),
+	}
+}
+
+// endReport completes the report of a shutdown ended, logs and keeps it.
+func (s *Server) endReport(rep *ShutdownReport) {
+	rep.Duration = s.clock.Now().Sub(rep.Started)
+	if rep.Drained = rep.Sessions - rep.ForceClosed; rep.Drained < 0 {
+		rep.Drained = 0
+	}
+	rep.AbortedBinds = int(s.stats.abortedBinds.Load()) - rep.AbortedBinds
+	rep.ClientToRemoteBytes = s.stats.clientToRemote.Load() - rep.ClientToRemoteBytes
+	rep.RemoteToClientBytes = s.stats.remoteToClient.Load() - rep.RemoteToClientBytes
+	s.logger.Infof("shut down in %v: %v sessions drained, %v closed, %v pending BIND requests aborted, %v bytes relayed meanwhile",
+		rep.Duration.Round(time.Millisecond), rep.Drained, rep.ForceClosed, rep.AbortedBinds, rep.ClientToRemoteBytes+rep.RemoteToClientBytes)
+	s.mu.Lock()
+	s.shutdownReport = rep
+	s.mu.Unlock()
+}
@@ -0,0 +1,168 @@
+package socks4
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestShutdownProgress(t *testing.T) {
+	echo := echoTarget(t)
+	var log lockedBuffer
+	logger := &logrus.Logger{Out: &log, Formatter: &logrus.TextFormatter{}, Level: logrus.InfoLevel}
+	progress := make(chan ShutdownProgress, 16)
+	s, addr := serve(t, WithLogger(logger), WithShutdownProgress(20*time.Millisecond, func(p ShutdownProgress) {
+		select {
+		case progress <- p:
+		default:
+		}
+	}))
+	if _, ok := s.ShutdownProgress(); ok {
+		t.Error("progress before the shutdown")
+	}
+	conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, []byte("hello"))
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.ShutdownContext(context.Background()) }()
+	select {
+	case p := <-progress:
+		if p.Started.IsZero() || p.Elapsed <= 0 || p.Sessions != 1 || p.PendingBinds != 0 || p.OldestSession < p.Elapsed {
+			t.Errorf("progress %+v, want the session older than the shutdown", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("progress not reported")
+	}
+	if p, ok := s.ShutdownProgress(); !ok || p.Sessions != 1 {
+		t.Errorf("progress %+v (%v) while shutting down, want a session", p, ok)
+	}
+
+	conn.Close()
+	echo.Close()
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown not done")
+	}
+	if _, ok := s.ShutdownProgress(); ok {
+		t.Error("progress after the shutdown")
+	}
+	if !strings.Contains(log.String(), "1 sessions remaining") {
+		t.Errorf("progress not logged: %q", log.String())
+	}
+}
+
+func TestReportProgressNotShuttingDown(t *testing.T) {
+	var log lockedBuffer
+	called := false
+	s := newTestServer(WithLogger(&logrus.Logger{Out: &log, Formatter: &logrus.TextFormatter{}, Level: logrus.InfoLevel}),
+		WithShutdownProgress(time.Second, func(ShutdownProgress) { called = true }))
+	s.reportProgress()
+	if called || log.String() != "" {
+		t.Errorf("progress reported (%v) and logged %q before the shutdown", called, log.String())
+	}
+}
+
+func TestShutdownReport(t *testing.T) {
+	target := echoOnceTarget(t)
+	for _, tt := range []struct {
+		name     string
+		sessions int
+		shutdown func(s *Server) // ends the sessions.
+		report   ShutdownReport
+	}{
+		{
+			name:     "no session",
+			shutdown: func(s *Server) { s.ShutdownContext(context.Background()) },
+		},
+		{
+			name:     "drained",
+			sessions: 2,
+			shutdown: func(s *Server) { s.ShutdownContext(context.Background()) },
+			report:   ShutdownReport{Sessions: 2, Drained: 2, ClientToRemoteBytes: 10, RemoteToClientBytes: 10},
+		},
+		{
+			name:     "deadline",
+			sessions: 1,
+			shutdown: func(s *Server) {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+				defer cancel()
+				s.ShutdownContext(ctx)
+			},
+			report: ShutdownReport{Sessions: 1, ForceClosed: 1},
+		},
+		{
+			name:     "closed",
+			sessions: 1,
+			shutdown: func(s *Server) { s.Close() },
+			report:   ShutdownReport{Sessions: 1, ForceClosed: 1},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := serve(t)
+			if _, ok := s.ShutdownReport(); ok {
+				t.Error("report before the shutdown")
+			}
+			var conns []net.Conn
+			for i := 0; i < tt.sessions; i++ {
+				conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", target)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				conns = append(conns, conn)
+			}
+			// served, and the sessions begun.
+			listening := func() bool {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				return len(s.listeners) > 0
+			}
+			for deadline := time.Now().Add(5 * time.Second); !listening() || len(s.Sessions()) != tt.sessions; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("%v sessions, want %v", len(s.Sessions()), tt.sessions)
+				}
+			}
+			shutdown := make(chan struct{})
+			go func() {
+				tt.shutdown(s)
+				close(shutdown)
+			}()
+			// the drained sessions relay during the shutdown, and are
+			// closed once echoed.
+			if tt.report.Drained > 0 {
+				for _, ok := false, false; !ok; _, ok = s.ShutdownProgress() {
+					time.Sleep(time.Millisecond)
+				}
+				for _, conn := range conns {
+					assertEcho(t, conn, []byte("hello"))
+					conn.Close()
+				}
+			}
+			select {
+			case <-shutdown:
+			case <-time.After(5 * time.Second):
+				t.Fatal("shutdown not done")
+			}
+			rep, ok := s.ShutdownReport()
+			if !ok || rep.Started.IsZero() || rep.Duration < 0 {
+				t.Fatalf("report %+v (%v), want the shutdown", rep, ok)
+			}
+			rep.Started, rep.Duration = time.Time{}, 0
+			if rep != tt.report {
+				t.Errorf("report %+v, want %+v", rep, tt.report)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package socks4
+
+import (
+	"net"
+	"syscall"
+)
+
+// WithDSCP marks the outbound connections to target hosts with the given
+// DSCP class (a 6-bit value, e.g. 46 for EF or 8 for CS1), so that network
+// QoS can prioritize or deprioritize the proxied traffic.
+func WithDSCP(class uint8) OptionFunc {
+	return func(s *Server) {
+		s.dscp = class & 0x3f
+	}
+}
+
+// WithClientDSCP marks the connections accepted from clients with the
+// given DSCP class.
+func WithClientDSCP(class uint8) OptionFunc {
+	return func(s *Server) {
+		s.clientDSCP = class & 0x3f
+	}
+}
+
+// dscpControl returns a net.Dialer Control function which applies the DSCP
+// class to the socket before it connects.
+func dscpControl(class uint8) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		return setDSCP(c, network == "tcp6", class)
+	}
+}
+
+// setConnDSCP applies the DSCP class to an established TCP connection.
+func setConnDSCP(conn net.Conn, class uint8) error {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	c, err := tc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	addr, ok := conn.LocalAddr().(*net.TCPAddr)
+	isV6 := ok && addr.IP.To4() == nil
+	return setDSCP(c, isV6, class)
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package socks4
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setDSCP(c syscall.RawConn, isV6 bool, class uint8) error {
+	return errors.New("DSCP marking is not supported on this platform")
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package socks4
+
+import "syscall"
+
+// setDSCP sets the IP TOS (IPv4) or traffic class (IPv6) of the socket.
+func setDSCP(c syscall.RawConn, isV6 bool, class uint8) error {
+	tos := int(class) << 2 // the low 2 bits are used by ECN.
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		if isV6 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+		} else {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
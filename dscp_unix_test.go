@@ -0,0 +1,92 @@
+//go:build unix
+
+package socks4
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// tos returns the IP TOS of the IPv4 TCP connection.
+func tos(t *testing.T, conn net.Conn) int {
+	t.Helper()
+	c, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v int
+	var sockErr error
+	c.Control(func(fd uintptr) {
+		v, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	})
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return v
+}
+
+func TestDSCP(t *testing.T) {
+	lis, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	for _, tt := range []struct {
+		name  string
+		class uint8
+		tos   int
+	}{
+		{name: "EF", class: 46, tos: 46 << 2},
+		{name: "CS1", class: 8, tos: 8 << 2},
+		{name: "beyond 6 bits", class: 0xff, tos: 0x3f << 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(WithDSCP(tt.class), WithClientDSCP(tt.class))
+			if s.dscp != uint8(tt.tos>>2) || s.clientDSCP != uint8(tt.tos>>2) {
+				t.Fatalf("classes %v and %v, want %v", s.dscp, s.clientDSCP, tt.tos>>2)
+			}
+			// marked before connecting, like the outbound connections.
+			d := net.Dialer{Control: dscpControl(s.dscp)}
+			conn, err := d.Dial("tcp4", lis.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := tos(t, conn); got != tt.tos {
+				t.Errorf("TOS of the dialed connection %#x, want %#x", got, tt.tos)
+			}
+
+			// and once connected, like the client ones.
+			conn, err = net.Dial("tcp4", lis.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if err := setConnDSCP(conn, s.clientDSCP); err != nil {
+				t.Fatal(err)
+			}
+			if got := tos(t, conn); got != tt.tos {
+				t.Errorf("TOS of the connection %#x, want %#x", got, tt.tos)
+			}
+		})
+	}
+}
+
+func TestSetConnDSCPNotTCP(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	if err := setConnDSCP(client, 46); err != nil {
+		t.Errorf("connection not TCP marked with error %v", err)
+	}
+}
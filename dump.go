@@ -0,0 +1,241 @@
+package socks4
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// State is a snapshot of the state of a server, written in JSON by
+// DumpState for support bundles and external tools.
+type State struct {
+	Time        time.Time         `json:"time"`
+	Listeners   []ListenerState   `json:"listeners"`
+	Sessions    []SessionInfo     `json:"sessions"`
+	Rules       RulesState        `json:"rules"`
+	Limits      LimitsState       `json:"limits"`
+	Breaker     []BreakerState    `json:"breaker,omitempty"` // destinations with failed dials, see WithCircuitBreaker.
+	Reverse     []ReverseState    `json:"reverse,omitempty"` // published services, see WithReverse.
+	Pools       []PoolState       `json:"pools,omitempty"`   // egress pools, see WithEgressPool.
+	Maintenance *MaintenanceState `json:"maintenance,omitempty"`
+	Shutdown    *ShutdownProgress `json:"shutdown,omitempty"` // progress of the graceful shutdown, if any.
+	Stats       Stats             `json:"stats"`
+}
+
+// ListenerState is a listener of a server.
+type ListenerState struct {
+	Network string            `json:"network"`
+	Address string            `json:"address"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// RulesState summarizes the rules of a server.
+type RulesState struct {
+	Count    int            `json:"count"`
+	ByAction map[string]int `json:"by_action"`
+	Default  string         `json:"default"`
+	Rules    []string       `json:"rules"` // in the format of ParseRule.
+}
+
+// LimitsState is the state of the connection, rate and memory limits of a
+// server. The limits are 0 when disabled.
+type LimitsState struct {
+	MaxConns          int            `json:"max_conns"`
+	MaxConnsPerClient int            `json:"max_conns_per_client"`
+	Conns             int            `json:"conns"`
+	ConnsByClient     map[string]int `json:"conns_by_client,omitempty"` // by client IP.
+	RateLimit         int            `json:"rate_limit"`
+	RateWindow        string         `json:"rate_window,omitempty"`
+	Store             string         `json:"store"` // type of the store of the counters.
+	MemoryLimit       int64          `json:"memory_limit"`
+	MemoryUsed        int64          `json:"memory_used"`
+	// MaxDialsPerDestination limits the DialsInFlight of each destination.
+	MaxDialsPerDestination int            `json:"max_dials_per_destination"`
+	DialsInFlight          map[string]int `json:"dials_in_flight,omitempty"` // by destination.
+	// FDReserve is the file descriptors kept below MaxFDs, see
+	// WithFDReserve. MaxFDs and OpenFDs are 0 when unknown.
+	FDReserve int `json:"fd_reserve"`
+	MaxFDs    int `json:"max_fds"`
+	OpenFDs   int `json:"open_fds"`
+	// MaxSessionsPerUser limits the SessionsByUser of each user id, see
+	// WithMaxSessionsPerUser.
+	MaxSessionsPerUser int            `json:"max_sessions_per_user"`
+	SessionsByUser     map[string]int `json:"sessions_by_user,omitempty"`
+}
+
+// BreakerState is the circuit of a destination.
+type BreakerState struct {
+	Destination string    `json:"destination"`
+	Failures    int       `json:"failures"` // consecutive failed dials.
+	Open        bool      `json:"open"`
+	OpenedAt    time.Time `json:"opened_at,omitempty"`
+	Probing     bool      `json:"probing"`
+}
+
+// ReverseState is a service published by reverse requests.
+type ReverseState struct {
+	Name          string `json:"name"`
+	Owner         string `json:"owner"`
+	Address       string `json:"address"`
+	Registrations int    `json:"registrations"`
+}
+
+// MaintenanceState is the maintenance mode of a server.
+type MaintenanceState struct {
+	Allow []string `json:"allow,omitempty"`
+	Close bool     `json:"close"`
+}
+
+// State returns a snapshot of the state of the server.
+func (s *Server) State() State {
+	st := State{
+		Time:     s.clock.Now(),
+		Sessions: s.Sessions(),
+		Rules:    s.rulesState(),
+		Limits:   s.limitsState(),
+		Stats:    s.Stats(),
+	}
+
+	s.mu.Lock()
+	for _, lis := range s.listeners {
+		st.Listeners = append(st.Listeners, ListenerState{
+			Network: lis.Addr().Network(),
+			Address: lis.Addr().String(),
+			Labels:  listenerLabels(lis),
+		})
+	}
+	s.mu.Unlock()
+
+	if s.breaker != nil {
+		st.Breaker = s.breaker.state()
+	}
+	if s.reverse != nil {
+		st.Reverse = s.reverse.state()
+	}
+	for _, e := range s.egresses {
+		if p, ok := e.(*egressPool); ok {
+			st.Pools = append(st.Pools, p.state())
+		}
+	}
+	sort.Slice(st.Pools, func(i, j int) bool { return st.Pools[i].Name < st.Pools[j].Name })
+	if m := s.maintenance.Load(); m != nil {
+		ms := &MaintenanceState{Close: m.Close}
+		for _, n := range m.Allow {
+			ms.Allow = append(ms.Allow, n.String())
+		}
+		st.Maintenance = ms
+	}
+	if p, ok := s.ShutdownProgress(); ok {
+		st.Shutdown = &p
+	}
+	return st
+}
+
+// DumpState writes the state of the server to w in JSON.
+func (s *Server) DumpState(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s.State())
+}
+
+func (s *Server) rulesState() RulesState {
+	rules := s.config().Rules
+	rs := RulesState{
+		Count:    len(rules),
+		ByAction: make(map[string]int),
+		Default:  s.config().DefaultAction.String(),
+		Rules:    make([]string, len(rules)),
+	}
+	for i := range rules {
+		rs.ByAction[rules[i].Action.String()]++
+		rs.Rules[i] = rules[i].String()
+	}
+	return rs
+}
+
+func (s *Server) limitsState() LimitsState {
+	c := s.config()
+	ls := LimitsState{
+		MaxConns:          c.MaxConns,
+		MaxConnsPerClient: c.MaxConnsPerClient,
+		RateLimit:         c.RateLimit,
+		Store:             fmt.Sprintf("%T", s.store),
+		MemoryLimit:       s.mem.limit,
+		MemoryUsed:        s.mem.used.Load(),
+	}
+	if c.RateLimit > 0 {
+		ls.RateWindow = c.RateWindow.String()
+	}
+	s.conns.mu.Lock()
+	ls.Conns = s.conns.total
+	if len(s.conns.byClient) > 0 {
+		ls.ConnsByClient = make(map[string]int, len(s.conns.byClient))
+		for ip, n := range s.conns.byClient {
+			ls.ConnsByClient[ip] = n
+		}
+	}
+	s.conns.mu.Unlock()
+	ls.MaxDialsPerDestination = c.MaxDialsPerDestination
+	ls.FDReserve = c.FDReserve
+	s.fds.mu.Lock()
+	ls.OpenFDs, ls.MaxFDs, _ = s.fds.sample(s.clock.Now())
+	s.fds.mu.Unlock()
+	s.dials.mu.Lock()
+	if len(s.dials.inflight) > 0 {
+		ls.DialsInFlight = make(map[string]int, len(s.dials.inflight))
+		for addr, n := range s.dials.inflight {
+			ls.DialsInFlight[addr] = n
+		}
+	}
+	s.dials.mu.Unlock()
+	ls.MaxSessionsPerUser = c.MaxSessionsPerUser
+	s.userSessions.mu.Lock()
+	if len(s.userSessions.sessions) > 0 {
+		ls.SessionsByUser = make(map[string]int, len(s.userSessions.sessions))
+		for user, n := range s.userSessions.sessions {
+			ls.SessionsByUser[user] = n
+		}
+	}
+	s.userSessions.mu.Unlock()
+	return ls
+}
+
+// state returns the circuits of the destinations, sorted.
+func (b *breaker) state() []BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	list := make([]BreakerState, 0, len(b.hosts))
+	for addr, h := range b.hosts {
+		bs := BreakerState{
+			Destination: addr,
+			Failures:    h.failures,
+			Open:        h.open,
+			Probing:     h.probing,
+		}
+		if bs.Open {
+			bs.OpenedAt = h.openedAt
+		}
+		list = append(list, bs)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Destination < list[j].Destination })
+	return list
+}
+
+// state returns the published services, sorted by name.
+func (r *reverseRegistry) state() []ReverseState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]ReverseState, 0, len(r.services))
+	for _, svc := range r.services {
+		list = append(list, ReverseState{
+			Name:          svc.name,
+			Owner:         svc.owner,
+			Address:       svc.lis.Addr().String(),
+			Registrations: svc.refs,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,143 @@
+package socks4
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDumpState(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader("deny to 10.0.0.0/8\nallow port 1-65535\nallow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, maintenance, _ := net.ParseCIDR("10.0.0.0/8")
+	for _, tt := range []struct {
+		name   string
+		opts   []OptionFunc
+		setup  func(s *Server)
+		check  func(st State) bool
+		expect string
+	}{
+		{
+			name: "listener and session",
+			check: func(st State) bool {
+				return len(st.Sessions) == 1 && st.Sessions[0].Cmd == "connect" && st.Stats.Established == 1
+			},
+			expect: "the session",
+		},
+		{
+			name: "rules",
+			opts: []OptionFunc{WithRules(rules), WithDefaultAction(Deny)},
+			check: func(st State) bool {
+				return reflect.DeepEqual(st.Rules, RulesState{
+					Count:    3,
+					ByAction: map[string]int{"allow": 2, "deny": 1},
+					Default:  "deny",
+					Rules:    []string{"deny id #1 to 10.0.0.0/8", "allow id #2 port 1-65535", "allow id #3"},
+				})
+			},
+			expect: "the rules",
+		},
+		{
+			name: "limits",
+			opts: []OptionFunc{WithMaxConns(10), WithMaxConnsPerClient(2), WithRateLimit(100, time.Minute), WithMaxSessionsPerUser(3, nil)},
+			check: func(st State) bool {
+				l := st.Limits
+				return l.MaxConns == 10 && l.MaxConnsPerClient == 2 && l.Conns == 1 && l.ConnsByClient["127.0.0.1"] == 1 &&
+					l.RateLimit == 100 && l.RateWindow == "1m0s" && l.MaxSessionsPerUser == 3
+			},
+			expect: "the limits and the connection of the session",
+		},
+		{
+			name: "no limits",
+			check: func(st State) bool {
+				return st.Limits.MaxConns == 0 && st.Limits.MaxConnsPerClient == 0 && st.Limits.RateWindow == ""
+			},
+			expect: "no limits",
+		},
+		{
+			name:  "maintenance",
+			setup: func(s *Server) { s.SetMaintenance(&Maintenance{Allow: []*net.IPNet{maintenance}, Close: true}) },
+			check: func(st State) bool {
+				return reflect.DeepEqual(st.Maintenance, &MaintenanceState{Allow: []string{"10.0.0.0/8"}, Close: true})
+			},
+			expect: "the maintenance mode",
+		},
+		{
+			name: "no maintenance",
+			check: func(st State) bool {
+				return st.Maintenance == nil && st.Breaker == nil && st.Reverse == nil && st.Shutdown == nil
+			},
+			expect: "the optional states left out",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			echo := echoTarget(t)
+			s := newTestServer(tt.opts...)
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.Serve(LabelListener(lis, map[string]string{"zone": "dmz"}))
+			}()
+			defer func() {
+				s.Close()
+				<-done
+			}()
+			conn, err := NewDialer(lis.Addr().String(), WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			assertEcho(t, conn, []byte("hello"))
+			if tt.setup != nil {
+				tt.setup(s)
+			}
+
+			var b bytes.Buffer
+			if err := s.DumpState(&b); err != nil {
+				t.Fatal(err)
+			}
+			var st State
+			if err := json.Unmarshal(b.Bytes(), &st); err != nil {
+				t.Fatalf("state %s not in JSON: %v", b.Bytes(), err)
+			}
+			want := []ListenerState{{Network: "tcp", Address: lis.Addr().String(), Labels: map[string]string{"zone": "dmz"}}}
+			if !reflect.DeepEqual(st.Listeners, want) || st.Time.IsZero() {
+				t.Errorf("listeners %+v at %v, want %+v", st.Listeners, st.Time, want)
+			}
+			if !tt.check(st) {
+				t.Errorf("state %s, want %v", b.Bytes(), tt.expect)
+			}
+		})
+	}
+}
+
+func TestBreakerState(t *testing.T) {
+	clock := &stepClock{now: time.Unix(1000, 0)}
+	opened := clock.now
+	b := newBreaker(2, time.Minute)
+	b.clock = clock
+	for _, addr := range []string{"a:80", "b:80", "b:80", "c:80", "c:80"} {
+		b.report(addr, errDial)
+	}
+	// the circuit of c:80 is probed once the cooldown is over.
+	clock.now = clock.now.Add(time.Minute)
+	b.allow("c:80")
+	want := []BreakerState{
+		{Destination: "a:80", Failures: 1},
+		{Destination: "b:80", Failures: 2, Open: true, OpenedAt: opened},
+		{Destination: "c:80", Failures: 2, Open: true, OpenedAt: opened, Probing: true},
+	}
+	if st := b.state(); !reflect.DeepEqual(st, want) {
+		t.Errorf("breaker state %+v, want %+v", st, want)
+	}
+}
@@ -0,0 +1,151 @@
+package socks4
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// ContextDialer connects to addresses, like *net.Dialer and *Dialer.
+type ContextDialer interface {
+	Dial(network, address string) (net.Conn, error)
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// DialerFromEnvironment returns the dialer of the proxy of the all_proxy or
+// ALL_PROXY environment variable, like curl: socks4://host[:port] for a
+// server the dialer sends the resolved addresses to, socks4a://host[:port]
+// for one resolving the names itself, 1080 being the default port. The
+// user of the URL is the user id of the requests. The addresses matched by
+// no_proxy or NO_PROXY, a comma separated list of host names matching their
+// subdomains too, IP addresses and CIDRs, with an optional port, or "*" for
+// all, are dialed directly. It returns a direct dialer when no proxy is
+// set, and an error for the other schemes. opts apply to the dialer of the
+// proxy, i.e.:
+//
+//	d, err := socks4.DialerFromEnvironment(socks4.WithDialerTimeout(10 * time.Second))
+//	conn, err := d.Dial("tcp", "example.com:80")
+func DialerFromEnvironment(opts ...DialerOption) (ContextDialer, error) {
+	direct := &net.Dialer{}
+	proxy := getenv("all_proxy", "ALL_PROXY")
+	if proxy == "" {
+		return direct, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %q: %v", proxy, err)
+	}
+	switch u.Scheme {
+	case "socks4":
+		opts = append([]DialerOption{WithLocalResolve()}, opts...)
+	case "socks4a":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: no host", proxy)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "1080"
+	}
+	if u.User != nil {
+		opts = append([]DialerOption{WithDialerUserId(u.User.Username())}, opts...)
+	}
+	d := NewDialer(net.JoinHostPort(u.Hostname(), port), opts...)
+	noProxy := parseNoProxy(getenv("no_proxy", "NO_PROXY"))
+	if len(noProxy) == 0 {
+		return d, nil
+	}
+	return &envDialer{proxy: d, direct: direct, noProxy: noProxy}, nil
+}
+
+// getenv returns the value of the first variable set among names.
+func getenv(names ...string) string {
+	for _, name := range names {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// envDialer dials the addresses through the proxy, but those excluded by
+// NO_PROXY.
+type envDialer struct {
+	proxy   *Dialer
+	direct  *net.Dialer
+	noProxy []noProxyEntry
+}
+
+func (d *envDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *envDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range d.noProxy {
+		if e.match(host, port) {
+			return d.direct.DialContext(ctx, network, address)
+		}
+	}
+	return d.proxy.DialContext(ctx, network, address)
+}
+
+// noProxyEntry is an entry of NO_PROXY.
+type noProxyEntry struct {
+	all     bool       // "*", matching any address.
+	network *net.IPNet // IP or CIDR, nil for a name.
+	name    string     // lowercase name, without its leading dot.
+	port    string     // "" for any port.
+}
+
+func parseNoProxy(s string) []noProxyEntry {
+	var entries []noProxyEntry
+	for _, v := range strings.Split(s, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if v == "" {
+			continue
+		}
+		if v == "*" {
+			entries = append(entries, noProxyEntry{all: true})
+			continue
+		}
+		var e noProxyEntry
+		if host, port, err := net.SplitHostPort(v); err == nil {
+			v, e.port = host, port
+		}
+		v = strings.Trim(v, "[]")
+		if _, network, err := net.ParseCIDR(v); err == nil {
+			e.network = network
+		} else if ip := net.ParseIP(v); ip != nil {
+			e.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(8*len(ip), 8*len(ip))}
+		} else {
+			e.name = strings.TrimPrefix(strings.TrimPrefix(v, "*"), ".")
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// match reports whether the entry excludes the address of host and port.
+func (e *noProxyEntry) match(host, port string) bool {
+	if e.all {
+		return true
+	}
+	if e.port != "" && e.port != port {
+		return false
+	}
+	if e.network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && e.network.Contains(ip)
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return host == e.name || strings.HasSuffix(host, "."+e.name)
+}
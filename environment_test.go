@@ -0,0 +1,126 @@
+package socks4
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNoProxyMatch(t *testing.T) {
+	for _, tt := range []struct {
+		noProxy string
+		address string
+		match   bool
+	}{
+		{noProxy: "", address: "example.com:80"},
+		{noProxy: "*", address: "example.com:80", match: true},
+		{noProxy: "example.com", address: "example.com:80", match: true},
+		{noProxy: "example.com", address: "www.example.com:443", match: true},
+		{noProxy: "example.com", address: "EXAMPLE.COM.:80", match: true},
+		{noProxy: ".example.com", address: "example.com:80", match: true},
+		{noProxy: "*.example.com", address: "www.example.com:80", match: true},
+		{noProxy: "example.com", address: "badexample.com:80"},
+		{noProxy: "example.com:443", address: "example.com:443", match: true},
+		{noProxy: "example.com:443", address: "example.com:80"},
+		{noProxy: "10.0.0.1", address: "10.0.0.1:80", match: true},
+		{noProxy: "10.0.0.1", address: "10.0.0.2:80"},
+		{noProxy: "10.0.0.0/8", address: "10.1.2.3:80", match: true},
+		{noProxy: "10.0.0.0/8", address: "192.0.2.1:80"},
+		{noProxy: "10.0.0.0/8", address: "example.com:80"},
+		{noProxy: "::1", address: "[::1]:80", match: true},
+		{noProxy: "[2001:db8::1]:443", address: "[2001:db8::1]:443", match: true},
+		{noProxy: "2001:db8::/32", address: "[2001:db8::5]:80", match: true},
+		{noProxy: "localhost, 127.0.0.0/8 ,,example.com", address: "127.0.0.1:80", match: true},
+		{noProxy: "localhost,127.0.0.0/8", address: "example.com:80"},
+	} {
+		host, port, _ := net.SplitHostPort(tt.address)
+		match := false
+		for _, e := range parseNoProxy(tt.noProxy) {
+			if e.match(host, port) {
+				match = true
+			}
+		}
+		if match != tt.match {
+			t.Errorf("NO_PROXY %q matched %v: %v, want %v", tt.noProxy, tt.address, match, tt.match)
+		}
+	}
+}
+
+func TestDialerFromEnvironment(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		env   map[string]string
+		proxy *Dialer // of the dialer, nil for a direct one.
+		err   string  // in the error, none if empty.
+	}{
+		{name: "no proxy"},
+		{name: "SOCKS 4", env: map[string]string{"ALL_PROXY": "socks4://proxy.example.com"}, proxy: &Dialer{proxyAddress: "proxy.example.com:1080", localResolve: true}},
+		{name: "SOCKS 4A", env: map[string]string{"ALL_PROXY": "socks4a://proxy.example.com:1081"}, proxy: &Dialer{proxyAddress: "proxy.example.com:1081"}},
+		{name: "user id", env: map[string]string{"ALL_PROXY": "socks4a://alice@10.0.0.1"}, proxy: &Dialer{proxyAddress: "10.0.0.1:1080", userId: "alice"}},
+		{name: "lowercase first", env: map[string]string{"all_proxy": "socks4a://a.example.com", "ALL_PROXY": "socks4a://b.example.com"}, proxy: &Dialer{proxyAddress: "a.example.com:1080"}},
+		{name: "IPv6 proxy", env: map[string]string{"ALL_PROXY": "socks4a://[2001:db8::1]:1080"}, proxy: &Dialer{proxyAddress: "[2001:db8::1]:1080"}},
+		{name: "unsupported scheme", env: map[string]string{"ALL_PROXY": "socks5://proxy.example.com"}, err: `unsupported proxy scheme "socks5"`},
+		{name: "no host", env: map[string]string{"ALL_PROXY": "socks4a://:1080"}, err: "no host"},
+		{name: "invalid URL", env: map[string]string{"ALL_PROXY": "socks4a://proxy.example.com:port"}, err: "invalid proxy URL"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"all_proxy", "ALL_PROXY", "no_proxy", "NO_PROXY"} {
+				t.Setenv(name, tt.env[name])
+			}
+			d, err := DialerFromEnvironment()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.proxy == nil {
+				if _, ok := d.(*net.Dialer); !ok {
+					t.Errorf("dialer %T, want a direct one", d)
+				}
+				return
+			}
+			p, ok := d.(*Dialer)
+			if !ok || p.proxyAddress != tt.proxy.proxyAddress || p.userId != tt.proxy.userId || p.localResolve != tt.proxy.localResolve {
+				t.Errorf("dialer %+v, want %+v", d, tt.proxy)
+			}
+		})
+	}
+}
+
+func TestDialerFromEnvironmentNoProxy(t *testing.T) {
+	echo := echoTarget(t)
+	s, addr := serve(t)
+	t.Setenv("ALL_PROXY", "socks4a://"+addr)
+	t.Setenv("all_proxy", "")
+	for _, tt := range []struct {
+		noProxy string
+		proxied bool
+	}{
+		{noProxy: "", proxied: true},
+		{noProxy: "example.com", proxied: true},
+		{noProxy: "127.0.0.0/8"},
+		{noProxy: "*"},
+	} {
+		t.Setenv("NO_PROXY", tt.noProxy)
+		t.Setenv("no_proxy", "")
+		d, err := DialerFromEnvironment(WithDialerTimeout(5 * time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := s.Stats().Established
+		conn, err := d.Dial("tcp", echo.Addr)
+		if err != nil {
+			t.Fatalf("NO_PROXY %q: %v", tt.noProxy, err)
+		}
+		assertEcho(t, conn, []byte("hello"))
+		if proxied := s.Stats().Established == before+1; proxied != tt.proxied {
+			t.Errorf("NO_PROXY %q: proxied %v, want %v", tt.noProxy, proxied, tt.proxied)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,101 @@
+package socks4
+
+import (
+	"net"
+	"time"
+)
+
+// Types of the session events.
+const (
+	EventEstablished = "established" // the request is granted and the relay begins.
+	EventRejected    = "rejected"    // the request is denied or failed.
+	EventClosed      = "closed"      // the relay of an established session ended.
+	EventStalled     = "stalled"     // a direction of the relay is blocked, see WithStallTimeout.
+)
+
+// Event is an event of a session, notified to the EventNotifiers of the
+// server.
+type Event struct {
+	Type     string      `json:"type"`
+	Time     time.Time   `json:"time"`
+	Session  SessionInfo `json:"session"`
+	Remote   string      `json:"remote,omitempty"`   // address of the remote host, empty for rejections.
+	Listener string      `json:"listener,omitempty"` // address of the server the client connected to.
+	Egress   string      `json:"egress,omitempty"`   // local address of the connection to the remote host.
+	Error    string      `json:"error,omitempty"`    // reason of a rejection or a stall.
+	// Direction is the direction of the relay of a stall, e.g.
+	// DirectionClientToRemote.
+	Direction string `json:"direction,omitempty"`
+	// Request is the complete request of a rejection, nil unless detailed
+	// by WithRejectAudit.
+	Request *RequestDetail `json:"request,omitempty"`
+}
+
+// EventNotifier is notified of the session events, e.g. to send them to
+// an alerting system (see Webhook). Notify is called by the goroutines of
+// the sessions and should not block.
+type EventNotifier interface {
+	Notify(ev Event)
+}
+
+// WithEventNotifier makes the server notify n of the session events, in
+// addition to the notifiers of previous options.
+func WithEventNotifier(n EventNotifier) OptionFunc {
+	return func(s *Server) {
+		s.notifiers = append(s.notifiers, n)
+	}
+}
+
+// notify notifies the event of the session to the notifiers.
+// remote is the connection to the remote host, nil for rejections.
+func (s *Server) notify(typ string, ss *session, remote net.Conn, err error) {
+	if len(s.notifiers) == 0 {
+		return
+	}
+	s.send(s.event(typ, ss, remote, err))
+}
+
+// notifyStall notifies the stall of a direction of the relay of the
+// session.
+func (s *Server) notifyStall(ss *session, remote net.Conn, dir string, err error) {
+	if len(s.notifiers) == 0 {
+		return
+	}
+	ev := s.event(EventStalled, ss, remote, err)
+	ev.Direction = dir
+	s.send(ev)
+}
+
+// notifyRejected notifies the rejection of the session, with the detail of
+// its request if not nil.
+func (s *Server) notifyRejected(ss *session, err error, detail *RequestDetail) {
+	if len(s.notifiers) == 0 {
+		return
+	}
+	ev := s.event(EventRejected, ss, nil, err)
+	ev.Request = detail
+	s.send(ev)
+}
+
+func (s *Server) event(typ string, ss *session, remote net.Conn, err error) Event {
+	ev := Event{
+		Type:     typ,
+		Time:     s.clock.Now(),
+		Session:  ss.info(),
+		Listener: ss.client.LocalAddr().String(),
+	}
+	if remote != nil {
+		ev.Remote = remote.RemoteAddr().String()
+		ev.Egress = remote.LocalAddr().String()
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	return ev
+}
+
+func (s *Server) send(ev Event) {
+	for _, n := range s.notifiers {
+		n.Notify(ev)
+	}
+}
@@ -0,0 +1,207 @@
+package socks4
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ProxySelection is the order in which a dialer with several proxy servers
+// tries them, see WithDialerFailover.
+type ProxySelection int
+
+const (
+	// Failover tries the proxy servers in the order they are given.
+	Failover ProxySelection = iota
+	// LeastLatency tries the proxy servers connected the fastest first.
+	LeastLatency
+)
+
+func (p ProxySelection) String() string {
+	switch p {
+	case Failover:
+		return "failover"
+	case LeastLatency:
+		return "least_latency"
+	}
+	return fmt.Sprintf("ProxySelection(%d)", int(p))
+}
+
+// WithDialerFailover adds proxy servers the dialer connects to when the
+// previous ones fail, the proxy address of NewDialer being the first. The
+// servers failing are tried after the healthy ones until they connect
+// again, or pass a health check (see WithDialerHealthCheck). The dialers
+// connecting by WithDialerWebSocket or WithDialerTransport ignore them.
+func WithDialerFailover(addresses ...string) DialerOption {
+	return func(d *Dialer) {
+		d.fallbacks = append(d.fallbacks, addresses...)
+	}
+}
+
+// WithDialerSelection sets the order in which the dialer tries its proxy
+// servers, Failover by default.
+func WithDialerSelection(selection ProxySelection) DialerOption {
+	return func(d *Dialer) {
+		d.selection = selection
+	}
+}
+
+// WithDialerHealthCheck makes the dialer connect to each of its proxy
+// servers every interval, recording whether they are up and their latency,
+// until Close is called.
+func WithDialerHealthCheck(interval time.Duration) DialerOption {
+	return func(d *Dialer) {
+		d.checkInterval = interval
+	}
+}
+
+// ProxyHealth is the state of a proxy server of a dialer.
+type ProxyHealth struct {
+	Address string
+	Healthy bool          // the last connection or health check succeeded.
+	Latency time.Duration // moving average of the connection times, 0 before the first.
+}
+
+// proxySet is the proxy servers of a dialer.
+type proxySet struct {
+	selection ProxySelection
+	proxies   []*proxyState
+	stop      chan struct{} // closed to stop the health checks.
+	stopOnce  sync.Once
+}
+
+type proxyState struct {
+	address   string
+	unhealthy atomic.Bool
+	latency   atomic.Int64 // moving average in nanoseconds.
+}
+
+func newProxySet(addresses []string, selection ProxySelection) *proxySet {
+	ps := &proxySet{selection: selection, stop: make(chan struct{})}
+	for _, address := range addresses {
+		ps.proxies = append(ps.proxies, &proxyState{address: address})
+	}
+	return ps
+}
+
+// observe records the result of a connection to the proxy started at
+// start.
+func (p *proxyState) observe(start time.Time, err error) {
+	if err != nil {
+		p.unhealthy.Store(true)
+		return
+	}
+	p.unhealthy.Store(false)
+	d := int64(time.Since(start))
+	if avg := p.latency.Load(); avg != 0 {
+		// weighs the last connection by a quarter.
+		d = avg + (d-avg)/4
+	}
+	p.latency.Store(d)
+}
+
+// order returns the proxies in the order they are tried.
+func (ps *proxySet) order() []*proxyState {
+	order := make([]*proxyState, len(ps.proxies))
+	copy(order, ps.proxies)
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if a.unhealthy.Load() != b.unhealthy.Load() {
+			return !a.unhealthy.Load()
+		}
+		if ps.selection == LeastLatency {
+			// the proxies never connected are tried first, to measure
+			// them.
+			return a.latency.Load() < b.latency.Load()
+		}
+		return false
+	})
+	return order
+}
+
+// dial connects to the first proxy server of the order that succeeds.
+func (ps *proxySet) dial(ctx context.Context, d *Dialer) (net.Conn, error) {
+	var failed []string
+	for _, p := range ps.order() {
+		start := time.Now()
+		conn, err := d.dialAddress(ctx, p.address)
+		if err != nil && ctx.Err() != nil {
+			// the failure is the caller's, not the proxy's.
+			return nil, err
+		}
+		p.observe(start, err)
+		if err == nil {
+			return conn, nil
+		}
+		failed = append(failed, fmt.Sprintf("%v: %v", p.address, err))
+	}
+	return nil, fmt.Errorf("all SOCKS servers failed: %v", strings.Join(failed, "; "))
+}
+
+// check connects to every proxy server every interval until stopped.
+func (ps *proxySet) check(interval, timeout time.Duration) {
+	if timeout == 0 || timeout > interval {
+		timeout = interval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, p := range ps.proxies {
+			wg.Add(1)
+			go func(p *proxyState) {
+				defer wg.Done()
+				start := time.Now()
+				conn, err := net.DialTimeout("tcp", p.address, timeout)
+				if err == nil {
+					conn.Close()
+				}
+				p.observe(start, err)
+			}(p)
+		}
+		wg.Wait()
+		select {
+		case <-ticker.C:
+		case <-ps.stop:
+			return
+		}
+	}
+}
+
+// ProxyHealth returns the state of the proxy servers of the dialer, in the
+// order they are given.
+func (d *Dialer) ProxyHealth() []ProxyHealth {
+	ps := d.proxySet()
+	health := make([]ProxyHealth, len(ps.proxies))
+	for i, p := range ps.proxies {
+		health[i] = ProxyHealth{
+			Address: p.address,
+			Healthy: !p.unhealthy.Load(),
+			Latency: time.Duration(p.latency.Load()),
+		}
+	}
+	return health
+}
+
+// proxySet returns the proxy servers of the dialer, only the proxy address
+// without WithDialerFailover.
+func (d *Dialer) proxySet() *proxySet {
+	if d.proxies != nil {
+		return d.proxies
+	}
+	return &proxySet{proxies: []*proxyState{{address: d.proxyAddress}}}
+}
+
+// Close stops the health checks of the dialer. The connections it dialed
+// stay open.
+func (d *Dialer) Close() error {
+	if d.proxies != nil {
+		d.proxies.stopOnce.Do(func() { close(d.proxies.stop) })
+	}
+	return nil
+}
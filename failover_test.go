@@ -0,0 +1,154 @@
+package socks4
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxySetOrder(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		selection ProxySelection
+		unhealthy []bool
+		latencies []time.Duration
+		order     []string
+	}{
+		{name: "failover", order: []string{"a", "b", "c"}},
+		{name: "failover of unhealthy proxies", unhealthy: []bool{true, false, true}, order: []string{"b", "a", "c"}},
+		{name: "failover whatever the latency", latencies: []time.Duration{3, 2, 1}, order: []string{"a", "b", "c"}},
+		{name: "least latency", selection: LeastLatency, latencies: []time.Duration{3, 1, 2}, order: []string{"b", "c", "a"}},
+		{name: "least latency of unmeasured proxies", selection: LeastLatency, latencies: []time.Duration{3, 0, 2}, order: []string{"b", "c", "a"}},
+		{name: "least latency of unhealthy proxies", selection: LeastLatency, unhealthy: []bool{false, true, false}, latencies: []time.Duration{3, 1, 2}, order: []string{"c", "a", "b"}},
+	} {
+		ps := newProxySet([]string{"a", "b", "c"}, tt.selection)
+		for i, p := range ps.proxies {
+			if tt.unhealthy != nil {
+				p.unhealthy.Store(tt.unhealthy[i])
+			}
+			if tt.latencies != nil {
+				p.latency.Store(int64(tt.latencies[i]))
+			}
+		}
+		var order []string
+		for _, p := range ps.order() {
+			order = append(order, p.address)
+		}
+		if !reflect.DeepEqual(order, tt.order) {
+			t.Errorf("%v: order %v, want %v", tt.name, order, tt.order)
+		}
+	}
+}
+
+func TestProxyStateObserve(t *testing.T) {
+	var p proxyState
+	p.observe(time.Now().Add(-4*time.Second), nil)
+	if p.unhealthy.Load() || time.Duration(p.latency.Load()) < 4*time.Second {
+		t.Fatalf("latency %v, want the first connection time", time.Duration(p.latency.Load()))
+	}
+	p.observe(time.Now(), nil)
+	if latency := time.Duration(p.latency.Load()); latency < 3*time.Second || latency > 3100*time.Millisecond {
+		t.Errorf("latency %v, want the last connection weighed by a quarter", latency)
+	}
+	p.observe(time.Now(), errors.New("refused"))
+	if !p.unhealthy.Load() || time.Duration(p.latency.Load()) < 3*time.Second {
+		t.Errorf("unhealthy %v with the latency %v, want the failure without latency", p.unhealthy.Load(), time.Duration(p.latency.Load()))
+	}
+}
+
+func TestDialerFailover(t *testing.T) {
+	echo := echoTarget(t)
+	_, up := serve(t)
+	down := closedAddr(t)
+	for _, tt := range []struct {
+		name    string
+		proxies []string
+		health  []bool
+		err     string // in the error, none if empty.
+	}{
+		{name: "first up", proxies: []string{up, down}, health: []bool{true, true}},
+		{name: "first down", proxies: []string{down, up}, health: []bool{false, true}},
+		{name: "all down", proxies: []string{down, closedAddr(t)}, health: []bool{false, false}, err: "all SOCKS servers failed: " + down + ": "},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDialer(tt.proxies[0], WithDialerTimeout(5*time.Second), WithDialerFailover(tt.proxies[1:]...))
+			defer d.Close()
+			conn, err := d.Dial("tcp", echo.Addr)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else {
+				assertEcho(t, conn, []byte("hello"))
+				conn.Close()
+			}
+			health := d.ProxyHealth()
+			if len(health) != len(tt.proxies) {
+				t.Fatalf("health %+v of %v proxies", health, len(tt.proxies))
+			}
+			for i, h := range health {
+				if h.Address != tt.proxies[i] || h.Healthy != tt.health[i] {
+					t.Errorf("health %+v, want %v healthy %v", h, tt.proxies[i], tt.health[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDialerFailoverCanceled(t *testing.T) {
+	d := NewDialer(closedAddr(t), WithDialerFailover(closedAddr(t)))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.DialContext(ctx, "tcp", "10.0.0.1:80"); !errors.Is(err, context.Canceled) {
+		t.Errorf("error %v, want canceled", err)
+	}
+	for _, h := range d.ProxyHealth() {
+		if !h.Healthy {
+			t.Errorf("health %+v, want the proxy healthy when the dial is canceled", h)
+		}
+	}
+}
+
+func TestDialerHealthCheck(t *testing.T) {
+	_, up := serve(t)
+	down := closedAddr(t)
+	d := NewDialer(down, WithDialerFailover(up), WithDialerHealthCheck(10*time.Millisecond))
+	defer d.Close()
+	want := []bool{false, true}
+	var health []ProxyHealth
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if health = d.ProxyHealth(); !health[0].Healthy && health[1].Latency > 0 {
+			break
+		}
+	}
+	for i, h := range health {
+		if h.Healthy != want[i] || h.Healthy != (h.Latency > 0) {
+			t.Errorf("health %+v, want healthy %v", h, want[i])
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Error(err)
+	}
+	// closed twice.
+	d.Close()
+}
+
+func TestProxySelectionString(t *testing.T) {
+	for _, tt := range []struct {
+		selection ProxySelection
+		s         string
+	}{
+		{Failover, "failover"},
+		{LeastLatency, "least_latency"},
+		{ProxySelection(9), "ProxySelection(9)"},
+	} {
+		if s := tt.selection.String(); s != tt.s {
+			t.Errorf("selection %d: %q, want %q", int(tt.selection), s, tt.s)
+		}
+	}
+}
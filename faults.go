@@ -0,0 +1,87 @@
+package socks4
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// Faults are faults injected by the server to test the resilience of its
+// clients, e.g. their retries. Zero fields inject nothing. They are meant
+// for test deployments only.
+type Faults struct {
+	HandshakeDelay time.Duration // delay before the requests are carried out.
+	RejectRate     float64       // probability of rejecting a request.
+	RelayLatency   time.Duration // delay of each chunk of relayed data.
+	Bandwidth      int64         // max bytes per second of each relay direction, 0 for no limit.
+	ResetRate      float64       // probability of resetting a relay at each chunk of relayed data.
+}
+
+// errFault is the error of the requests rejected by an injected fault.
+var errFault = errors.New("rejected by fault injection")
+
+// WithFaults makes the server inject the faults into the handshakes and
+// relays.
+func WithFaults(f Faults) OptionFunc {
+	return func(s *Server) {
+		s.faults = &f
+	}
+}
+
+// injectHandshake delays the request and reports whether it is rejected
+// by the faults.
+func (f *Faults) injectHandshake(clock Clock) error {
+	if f.HandshakeDelay > 0 {
+		clock.Sleep(f.HandshakeDelay)
+	}
+	if f.RejectRate > 0 && rand.Float64() < f.RejectRate {
+		return errFault
+	}
+	return nil
+}
+
+// faultWriter writes the data of a relay direction with the faults.
+type faultWriter struct {
+	io.Writer
+	faults         *Faults
+	clock          Clock
+	client, remote net.Conn // reset together.
+	start          time.Time
+	written        int64
+}
+
+func newFaultWriter(w io.Writer, f *Faults, clock Clock, client, remote net.Conn) *faultWriter {
+	return &faultWriter{Writer: w, faults: f, clock: clock, client: client, remote: remote, start: clock.Now()}
+}
+
+func (w *faultWriter) Write(b []byte) (int, error) {
+	f := w.faults
+	if f.ResetRate > 0 && rand.Float64() < f.ResetRate {
+		resetConn(w.client)
+		resetConn(w.remote)
+		return 0, errFault
+	}
+	if f.RelayLatency > 0 {
+		w.clock.Sleep(f.RelayLatency)
+	}
+	if f.Bandwidth > 0 {
+		// wait until the bytes written so far fit the bandwidth.
+		due := w.start.Add(time.Duration(float64(w.written+int64(len(b))) / float64(f.Bandwidth) * float64(time.Second)))
+		if wait := due.Sub(w.clock.Now()); wait > 0 {
+			w.clock.Sleep(wait)
+		}
+	}
+	n, err := w.Writer.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+// resetConn closes the connection with a TCP reset if it is a TCP one.
+func resetConn(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+	conn.Close()
+}
@@ -0,0 +1,135 @@
+package socks4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// advancingClock is a step clock whose sleeps advance it.
+type advancingClock struct {
+	stepClock
+	sleeps []time.Duration
+}
+
+func (c *advancingClock) Sleep(d time.Duration) {
+	c.sleeps = append(c.sleeps, d)
+	c.now = c.now.Add(d)
+}
+
+func TestInjectHandshake(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		faults Faults
+		err    bool
+		sleeps []time.Duration
+	}{
+		{name: "none"},
+		{name: "delay", faults: Faults{HandshakeDelay: time.Second}, sleeps: []time.Duration{time.Second}},
+		{name: "rejected", faults: Faults{RejectRate: 1}, err: true},
+		{name: "delayed and rejected", faults: Faults{HandshakeDelay: time.Second, RejectRate: 1}, err: true, sleeps: []time.Duration{time.Second}},
+		{name: "relay faults only", faults: Faults{RelayLatency: time.Second, ResetRate: 1}},
+	} {
+		clock := &sleepClock{}
+		err := tt.faults.injectHandshake(clock)
+		if (err != nil) != tt.err || err != nil && !errors.Is(err, errFault) {
+			t.Errorf("%v: error %v, want %v", tt.name, err, tt.err)
+		}
+		if !reflect.DeepEqual(clock.sleeps, tt.sleeps) {
+			t.Errorf("%v: slept %v, want %v", tt.name, clock.sleeps, tt.sleeps)
+		}
+	}
+}
+
+func TestFaultWriter(t *testing.T) {
+	ms := time.Millisecond
+	for _, tt := range []struct {
+		name   string
+		faults Faults
+		writes []int
+		sleeps []time.Duration
+	}{
+		{name: "none", writes: []int{100, 100}},
+		{name: "latency", faults: Faults{RelayLatency: 20 * ms}, writes: []int{100, 100}, sleeps: []time.Duration{20 * ms, 20 * ms}},
+		{name: "bandwidth", faults: Faults{Bandwidth: 1000}, writes: []int{100, 100, 300}, sleeps: []time.Duration{100 * ms, 100 * ms, 300 * ms}},
+		// the latency counts in the time of the bandwidth.
+		{name: "latency and bandwidth", faults: Faults{RelayLatency: 20 * ms, Bandwidth: 1000}, writes: []int{100, 100}, sleeps: []time.Duration{20 * ms, 80 * ms, 20 * ms, 80 * ms}},
+		{name: "latency beyond the bandwidth", faults: Faults{RelayLatency: 200 * ms, Bandwidth: 1000}, writes: []int{100, 100}, sleeps: []time.Duration{200 * ms, 200 * ms}},
+	} {
+		var out bytes.Buffer
+		clock := &advancingClock{stepClock: stepClock{now: time.Unix(1000, 0)}}
+		w := newFaultWriter(&out, &tt.faults, clock, nil, nil)
+		total := 0
+		for _, size := range tt.writes {
+			if n, err := w.Write(make([]byte, size)); n != size || err != nil {
+				t.Fatalf("%v: wrote %v bytes with error %v", tt.name, n, err)
+			}
+			total += size
+		}
+		if out.Len() != total || !reflect.DeepEqual(clock.sleeps, tt.sleeps) {
+			t.Errorf("%v: wrote %v bytes after sleeping %v, want %v after %v", tt.name, out.Len(), clock.sleeps, total, tt.sleeps)
+		}
+	}
+}
+
+func TestFaultWriterReset(t *testing.T) {
+	client, peer := tcpPair(t)
+	defer peer.Close()
+	remote, remotePeer := tcpPair(t)
+	defer remotePeer.Close()
+	var out bytes.Buffer
+	w := newFaultWriter(&out, &Faults{ResetRate: 1}, systemClock{}, client, remote)
+	if n, err := w.Write([]byte("hello")); n != 0 || !errors.Is(err, errFault) || out.Len() != 0 {
+		t.Fatalf("wrote %v bytes with error %v, want a reset", n, err)
+	}
+	// both peers see a reset rather than an orderly close.
+	for _, conn := range []net.Conn{peer, remotePeer} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, io.EOF) {
+			t.Errorf("peer read error %v, want a reset", err)
+		}
+	}
+}
+
+func TestFaults(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		faults   Faults
+		rejected bool
+		reset    bool
+	}{
+		{name: "delayed handshake", faults: Faults{HandshakeDelay: 20 * time.Millisecond, RelayLatency: 10 * time.Millisecond}},
+		{name: "rejected", faults: Faults{RejectRate: 1}, rejected: true},
+		{name: "reset", faults: Faults{ResetRate: 1}, reset: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			echo := echoTarget(t)
+			_, addr := serve(t, WithFaults(tt.faults))
+			conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+			if tt.rejected {
+				var rej *RejectError
+				if !errors.As(err, &rej) || rej.Code != RejectOrFailure {
+					t.Fatalf("dial error %v, want a rejection", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if !tt.reset {
+				assertEcho(t, conn, []byte("hello"))
+				return
+			}
+			conn.Write([]byte("hello"))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if n, err := conn.Read(make([]byte, 5)); err == nil {
+				t.Errorf("read %v bytes of the reset relay", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package socks4
+
+import (
+	"sync"
+	"time"
+)
+
+// fdSampleInterval is the max age of the count of the open file
+// descriptors checked at accept.
+const fdSampleInterval = time.Second
+
+// WithFDReserve makes the server close the new connections right after
+// being accepted while fewer than reserve file descriptors are left below
+// RLIMIT_NOFILE, rather than failing them midway when the accepts and
+// dials run out of descriptors. Unsupported on platforms without
+// RLIMIT_NOFILE.
+func WithFDReserve(reserve int) OptionFunc {
+	return func(s *Server) {
+		s.config().FDReserve = reserve
+	}
+}
+
+// fdSampler counts the open file descriptors of the process, sampled at
+// most every fdSampleInterval. Each connection admitted in between counts
+// for 2, its own and the one of its remote host.
+type fdSampler struct {
+	mu      sync.Mutex
+	sampled time.Time
+	open    int
+	max     int // 0 if unlimited.
+	err     error
+	warned  bool
+}
+
+// sample returns the open file descriptors and their limit.
+func (f *fdSampler) sample(now time.Time) (open, max int, err error) {
+	if f.err == nil && now.Sub(f.sampled) >= fdSampleInterval {
+		f.sampled = now
+		if f.open, f.err = openFDs(); f.err == nil {
+			f.max, f.err = maxFDs()
+		}
+	}
+	return f.open, f.max, f.err
+}
+
+// fdsLow reports whether the open file descriptors are within the reserve
+// of their limit, and counts the connection as admitted otherwise.
+func (s *Server) fdsLow(reserve int) (open, max int, low bool) {
+	s.fds.mu.Lock()
+	defer s.fds.mu.Unlock()
+	open, max, err := s.fds.sample(s.clock.Now())
+	if err != nil {
+		if !s.fds.warned {
+			s.fds.warned = true
+			s.log(LogAccept).Warnf("file descriptor reserve disabled: %v", err)
+		}
+		return 0, 0, false
+	}
+	if max > 0 && max-open < reserve {
+		return open, max, true
+	}
+	s.fds.open += 2
+	return open, max, false
+}
@@ -0,0 +1,15 @@
+//go:build !unix
+
+package socks4
+
+import "errors"
+
+var errNoFDLimit = errors.New("file descriptor limit is not supported on this platform")
+
+func openFDs() (int, error) {
+	return 0, errNoFDLimit
+}
+
+func maxFDs() (int, error) {
+	return 0, errNoFDLimit
+}
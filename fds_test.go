@@ -0,0 +1,167 @@
+package socks4
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFDsLow(t *testing.T) {
+	errLimit := errors.New("no limit")
+	for _, tt := range []struct {
+		name    string
+		open    int
+		max     int
+		err     error
+		reserve int
+		low     []bool // of the connections in order.
+	}{
+		{name: "plenty", open: 10, max: 1024, reserve: 100, low: []bool{false, false}},
+		{name: "within the reserve", open: 950, max: 1024, reserve: 100, low: []bool{true, true}},
+		{name: "admitted connections", open: 919, max: 1024, reserve: 100, low: []bool{false, false, false, true}},
+		{name: "unlimited", open: 100000, reserve: 100, low: []bool{false, false}},
+		{name: "unsupported", err: errLimit, reserve: 100, low: []bool{false, false}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var logger linesLogger
+			clock := &stepClock{now: time.Unix(1000, 0)}
+			s := newTestServer(WithClock(clock), WithLogger(&logger))
+			// sampled now, and not sampled again.
+			s.fds = fdSampler{sampled: clock.now, open: tt.open, max: tt.max, err: tt.err}
+			for i, want := range tt.low {
+				if _, _, low := s.fdsLow(tt.reserve); low != want {
+					t.Errorf("connection %v: low %v, want %v", i+1, low, want)
+				}
+			}
+			// the unsupported limits are warned once.
+			var warned []string
+			if tt.err != nil {
+				warned = []string{"warn: file descriptor reserve disabled: no limit"}
+			}
+			if !reflect.DeepEqual(logger.lines, warned) {
+				t.Errorf("logged %q, want %q", logger.lines, warned)
+			}
+		})
+	}
+}
+
+func TestFDSampler(t *testing.T) {
+	now := time.Unix(1000, 0)
+	for _, tt := range []struct {
+		name    string
+		sampled time.Time
+		again   bool // sampled again.
+	}{
+		{name: "fresh", sampled: now.Add(-fdSampleInterval / 2)},
+		{name: "stale", sampled: now.Add(-fdSampleInterval), again: true},
+	} {
+		f := fdSampler{sampled: tt.sampled, open: -1, max: -1}
+		open, max, err := f.sample(now)
+		if again := open != -1; again != tt.again {
+			t.Errorf("%v: sampled %v open of %v: %v, want sampled again %v", tt.name, open, max, err, tt.again)
+		}
+		if tt.again && (f.sampled != now || (err == nil && (open <= 0 || max < 0))) {
+			t.Errorf("%v: sampled at %v %v open of %v: %v", tt.name, f.sampled, open, max, err)
+		}
+	}
+}
+
+// scriptedListener returns the errors of its script before blocking until
+// closed.
+type scriptedListener struct {
+	net.Listener
+	script []error
+	done   chan struct{} // closed once the script is over.
+	closed chan struct{}
+	once   sync.Once
+}
+
+func (l *scriptedListener) Accept() (net.Conn, error) {
+	if len(l.script) > 0 {
+		err := l.script[0]
+		l.script = l.script[1:]
+		if err == nil {
+			client, server := net.Pipe()
+			client.Close()
+			return server, nil
+		}
+		return nil, err
+	}
+	close(l.done)
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *scriptedListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *scriptedListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	for _, tt := range []struct {
+		name   string
+		script []error // nil for an accepted connection.
+		sleeps []time.Duration
+	}{
+		{name: "accepted", script: []error{nil, nil}},
+		{name: "other error", script: []error{errors.New("failed"), errors.New("failed")}},
+		{name: "out of descriptors", script: []error{emfile, emfile, syscall.ENFILE}, sleeps: []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond}},
+		{name: "reset by a connection", script: []error{emfile, emfile, nil, emfile}, sleeps: []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 5 * time.Millisecond}},
+		{name: "capped", script: []error{emfile, emfile, emfile, emfile, emfile, emfile, emfile, emfile, emfile}, sleeps: []time.Duration{
+			5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 80 * time.Millisecond,
+			160 * time.Millisecond, 320 * time.Millisecond, 640 * time.Millisecond, time.Second,
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := &sleepClock{}
+			s := newTestServer(WithClock(clock))
+			lis := &scriptedListener{script: tt.script, done: make(chan struct{}), closed: make(chan struct{})}
+			served := make(chan struct{})
+			go func() {
+				s.Serve(lis)
+				close(served)
+			}()
+			<-lis.done
+			s.Close()
+			<-served
+			if !reflect.DeepEqual(clock.sleeps, tt.sleeps) {
+				t.Errorf("slept %v, want %v", clock.sleeps, tt.sleeps)
+			}
+		})
+	}
+}
+
+func TestFDReserve(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		reserve  int
+		admitted bool
+	}{
+		{name: "no reserve", admitted: true},
+		{name: "small reserve", reserve: 1, admitted: true},
+		{name: "reserve of all the descriptors", reserve: 1 << 30},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if max, err := maxFDs(); err != nil || max == 0 {
+				t.Skipf("no file descriptor limit: %v", err)
+			}
+			s := newTestServer(WithFDReserve(tt.reserve))
+			if admitted := s.admit(fromIP("10.0.0.1")); admitted != tt.admitted {
+				t.Errorf("admitted %v, want %v", admitted, tt.admitted)
+			}
+			// listed in the state.
+			if ls := s.State().Limits; ls.FDReserve != tt.reserve || ls.MaxFDs == 0 || ls.OpenFDs == 0 {
+				t.Errorf("limits %+v, want the reserve of %v and the descriptors", ls, tt.reserve)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+//go:build unix
+
+package socks4
+
+import (
+	"math"
+	"os"
+	"syscall"
+)
+
+// openFDs returns the number of file descriptors open by the process.
+func openFDs() (int, error) {
+	dir := "/proc/self/fd"
+	if _, err := os.Stat(dir); err != nil {
+		dir = "/dev/fd"
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return 0, err
+	}
+	// without the descriptor reading the directory.
+	return len(names) - 1, nil
+}
+
+// maxFDs returns the soft RLIMIT_NOFILE of the process, 0 if unlimited.
+func maxFDs() (int, error) {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0, err
+	}
+	if rl.Cur > math.MaxInt32 {
+		return 0, nil
+	}
+	return int(rl.Cur), nil
+}
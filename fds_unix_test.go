@@ -0,0 +1,42 @@
+//go:build unix
+
+package socks4
+
+import (
+	"os"
+	"testing"
+)
+
+func TestOpenFDs(t *testing.T) {
+	for _, tt := range []struct {
+		files int
+	}{
+		{files: 1},
+		{files: 3},
+	} {
+		before, err := openFDs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []*os.File
+		for i := 0; i < tt.files; i++ {
+			f, err := os.Open(os.DevNull)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, f)
+		}
+		// at least, other goroutines may open descriptors.
+		open, err := openFDs()
+		if err != nil || open < before+tt.files {
+			t.Errorf("%v open with %v files opened: %v, want %v", open, tt.files, err, before+tt.files)
+		}
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	open, _ := openFDs()
+	if max, err := maxFDs(); err != nil || max < 0 || (max > 0 && max < open) {
+		t.Errorf("limit %v of %v open: %v", max, open, err)
+	}
+}
@@ -3,9 +3,20 @@ module github.com/cccxg/socks4
 go 1.20
 
 require (
-	github.com/sirupsen/logrus v1.9.3 // indirect
+	github.com/mattn/go-sqlite3 v1.14.33
+	github.com/sirupsen/logrus v1.9.3
+	golang.org/x/crypto v0.21.0
+	golang.org/x/net v0.21.0
+	google.golang.org/grpc v1.63.2
+	google.golang.org/protobuf v1.33.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
 	go.uber.org/atomic v1.7.0 // indirect
 	go.uber.org/multierr v1.6.0 // indirect
 	go.uber.org/zap v1.24.0 // indirect
-	golang.org/x/sys v0.0.0-20220715151400-c0bba94af5f8 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240227224415-6ceb2ff114de // indirect
 )
@@ -0,0 +1,154 @@
+package socks4
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// The pprof labels of the goroutines serving the sessions, which also
+// label the goroutines they start, so that the goroutine, CPU and other
+// profiles show the session of each goroutine. The user and target labels
+// are set once the request is read.
+const (
+	ServerLabel  = "socks4_server"  // the server, a number unique in the process.
+	SessionLabel = "socks4_session" // the ID of the session.
+	UserLabel    = "socks4_user"    // the user id of the request.
+	TargetLabel  = "socks4_target"  // the target address of the request.
+)
+
+// serverSerial numbers the servers of the process for their ServerLabel.
+var serverSerial atomic.Uint64
+
+// traceSession begins the trace task of the session and sets its pprof
+// labels on the current goroutine. It returns the function ending them.
+// The handshake, the dial and the relay are the regions of the task.
+func (s *Server) traceSession(ss *session) func() {
+	ctx, task := trace.NewTask(context.Background(), "socks4.session")
+	ss.trace = ctx
+	s.labelSession(ss)
+	return func() {
+		pprof.SetGoroutineLabels(context.Background())
+		task.End()
+	}
+}
+
+// traceRequest logs the request in the trace of the session and adds it
+// to the pprof labels of the session.
+func (s *Server) traceRequest(ss *session, req Request) {
+	trace.Logf(ss.trace, "request", "%v cmd %v to %v by %q", req.Protocol(), req.Cmd, req.Address, req.UserId)
+	s.labelSession(ss, UserLabel, req.UserId, TargetLabel, req.Address)
+}
+
+// labelSession sets the pprof labels of the session, and the other labels
+// as key value pairs, on the current goroutine.
+func (s *Server) labelSession(ss *session, labels ...string) {
+	labels = append([]string{
+		ServerLabel, strconv.FormatUint(s.serial, 10),
+		SessionLabel, strconv.FormatUint(ss.id, 10),
+	}, labels...)
+	pprof.SetGoroutineLabels(pprof.WithLabels(context.Background(), pprof.Labels(labels...)))
+}
+
+// SessionGoroutines are the goroutines of a session, see
+// Server.SessionGoroutines.
+type SessionGoroutines struct {
+	Session SessionInfo       `json:"session"`
+	Labels  map[string]string `json:"labels"` // pprof labels of the goroutines.
+	// Goroutines is the number of goroutines of the session, and Stacks
+	// their stacks, one per group of identical goroutines.
+	Goroutines int      `json:"goroutines"`
+	Stacks     []string `json:"stacks,omitempty"`
+}
+
+// SessionGoroutines returns the goroutines of the active sessions, read
+// from the goroutine profile, to find those of a stuck session.
+func (s *Server) SessionGoroutines() ([]SessionGoroutines, error) {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 1); err != nil {
+		return nil, fmt.Errorf("goroutine profile: %v", err)
+	}
+	groups := parseGoroutines(&buf)
+
+	serial := strconv.FormatUint(s.serial, 10)
+	sessions := s.Sessions()
+	list := make([]SessionGoroutines, len(sessions))
+	byID := make(map[string]*SessionGoroutines, len(sessions))
+	for i, info := range sessions {
+		list[i] = SessionGoroutines{Session: info}
+		byID[strconv.FormatUint(info.ID, 10)] = &list[i]
+	}
+	for _, g := range groups {
+		if g.labels[ServerLabel] != serial {
+			continue
+		}
+		sg := byID[g.labels[SessionLabel]]
+		if sg == nil {
+			continue
+		}
+		sg.Labels = g.labels
+		sg.Goroutines += g.count
+		sg.Stacks = append(sg.Stacks, g.stack)
+	}
+	return list, nil
+}
+
+// goroutineGroup is a group of identical goroutines of a goroutine
+// profile.
+type goroutineGroup struct {
+	count  int
+	labels map[string]string
+	stack  string
+}
+
+// parseGoroutines parses a goroutine profile written with debug 1, i.e.:
+//
+//	2 @ 0x43e2ce 0x4500a5
+//	# labels: {"socks4_session":"3"}
+//	#	0x4500a4	io.Copy+0x24	/usr/lib/go/src/io/io.go:388
+func parseGoroutines(r *bytes.Buffer) []goroutineGroup {
+	var groups []goroutineGroup
+	var g *goroutineGroup
+	var stack []string
+	end := func() {
+		if g != nil {
+			g.stack = strings.Join(stack, "\n")
+			groups = append(groups, *g)
+		}
+		g, stack = nil, nil
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			end()
+		case strings.HasPrefix(line, "# labels: "):
+			if g != nil {
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "# labels: ")), &g.labels)
+			}
+		case strings.HasPrefix(line, "#\t"):
+			// the address, the function and its file and line, aligned by
+			// tabs.
+			if fields := strings.Fields(line[2:]); g != nil && len(fields) == 3 {
+				stack = append(stack, fields[1]+" "+fields[2])
+			}
+		default:
+			n, _, ok := strings.Cut(line, " @ ")
+			if count, err := strconv.Atoi(n); ok && err == nil {
+				end()
+				g = &goroutineGroup{count: count}
+			}
+		}
+	}
+	end()
+	return groups
+}
@@ -0,0 +1,162 @@
+package socks4
+
+import (
+	"bytes"
+	"reflect"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseGoroutines(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		profile string
+		groups  []goroutineGroup
+	}{
+		{name: "empty"},
+		{
+			name: "labeled",
+			profile: "goroutine profile: total 3\n" +
+				"2 @ 0x43e2ce 0x4500a5\n" +
+				"# labels: {\"socks4_server\":\"1\", \"socks4_session\":\"3\"}\n" +
+				"#\t0x4500a4\tio.Copy+0x24\t/usr/lib/go/src/io/io.go:388\n" +
+				"#\t0x4500b5\tmain.relay+0x15\t/src/relay.go:10\n" +
+				"\n" +
+				"1 @ 0x43e2ce\n" +
+				"#\t0x43e2cd\truntime.gopark+0xcd\t/usr/lib/go/src/runtime/proc.go:398\n",
+			groups: []goroutineGroup{
+				{count: 2, labels: map[string]string{ServerLabel: "1", SessionLabel: "3"}, stack: "io.Copy+0x24 /usr/lib/go/src/io/io.go:388\nmain.relay+0x15 /src/relay.go:10"},
+				{count: 1, stack: "runtime.gopark+0xcd /usr/lib/go/src/runtime/proc.go:398"},
+			},
+		},
+		{
+			name:    "invalid labels",
+			profile: "1 @ 0x43e2ce\n# labels: {\n#\t0x4500a4\tio.Copy+0x24\t/usr/lib/go/src/io/io.go:388\n",
+			groups:  []goroutineGroup{{count: 1, stack: "io.Copy+0x24 /usr/lib/go/src/io/io.go:388"}},
+		},
+		{
+			name:    "no blank line",
+			profile: "1 @ 0x1\n#\t0x1\ta+0x1\ta.go:1\n2 @ 0x2\n#\t0x2\tb+0x2\tb.go:2\n",
+			groups:  []goroutineGroup{{count: 1, stack: "a+0x1 a.go:1"}, {count: 2, stack: "b+0x2 b.go:2"}},
+		},
+	} {
+		if groups := parseGoroutines(bytes.NewBufferString(tt.profile)); !reflect.DeepEqual(groups, tt.groups) {
+			t.Errorf("%v: groups %+v, want %+v", tt.name, groups, tt.groups)
+		}
+	}
+}
+
+func TestSessionGoroutines(t *testing.T) {
+	echo := echoTarget(t)
+	for _, tt := range []struct {
+		name     string
+		sessions int
+	}{
+		{name: "none"},
+		{name: "one", sessions: 1},
+		{name: "several", sessions: 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := serve(t)
+			// the goroutines of another server are not listed.
+			other, otherAddr := serve(t)
+			if conn, err := NewDialer(otherAddr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr); err == nil {
+				defer conn.Close()
+			}
+			for i := 0; i < tt.sessions; i++ {
+				conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				assertEcho(t, conn, []byte("hello"))
+			}
+			list, err := s.SessionGoroutines()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != tt.sessions {
+				t.Fatalf("goroutines of %v sessions, want %v", len(list), tt.sessions)
+			}
+			for _, sg := range list {
+				server, session := strconv.FormatUint(s.serial, 10), strconv.FormatUint(sg.Session.ID, 10)
+				if sg.Labels[ServerLabel] != server || sg.Labels[SessionLabel] != session || sg.Goroutines < 2 || len(sg.Stacks) == 0 {
+					t.Errorf("goroutines %+v, want those of session %v of server %v", sg, session, server)
+				}
+				// the relays are in the stacks.
+				if !strings.Contains(strings.Join(sg.Stacks, "\n"), "socks4.(*Server).transfer") {
+					t.Errorf("stacks %q, want those of the relay", sg.Stacks)
+				}
+			}
+			if other.serial == s.serial {
+				t.Errorf("serial %v of both servers", s.serial)
+			}
+		})
+	}
+}
+
+func TestSessionLabels(t *testing.T) {
+	echo := echoTarget(t)
+	for _, tt := range []struct {
+		name   string
+		userId string
+	}{
+		{name: "user", userId: "alice"},
+		{name: "no user"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := serve(t)
+			conn, err := NewDialer(addr, WithDialerUserId(tt.userId), WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			assertEcho(t, conn, []byte("hello"))
+			list, err := s.SessionGoroutines()
+			if err != nil || len(list) != 1 {
+				t.Fatalf("goroutines of %v sessions: %v, want 1", len(list), err)
+			}
+			labels := map[string]string{
+				ServerLabel:  strconv.FormatUint(s.serial, 10),
+				SessionLabel: strconv.FormatUint(list[0].Session.ID, 10),
+				UserLabel:    tt.userId,
+				TargetLabel:  echo.Addr,
+			}
+			for k, v := range labels {
+				if list[0].Labels[k] != v {
+					t.Errorf("labels %v, want %v", list[0].Labels, labels)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestSessionTrace(t *testing.T) {
+	if trace.IsEnabled() {
+		t.Skip("tracing already")
+	}
+	echo := echoTarget(t)
+	_, addr := serve(t)
+	var b bytes.Buffer
+	if err := trace.Start(&b); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := NewDialer(addr, WithDialerUserId("alice"), WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+	if err != nil {
+		trace.Stop()
+		t.Fatal(err)
+	}
+	assertEcho(t, conn, []byte("hello"))
+	conn.Close()
+	trace.Stop()
+	// the task, its regions and the log of the request.
+	for _, name := range []string{"socks4.session", "handshake", "dial", "relay", "request", `"alice"`} {
+		if !bytes.Contains(b.Bytes(), []byte(name)) {
+			t.Errorf("no %q in the trace", name)
+		}
+	}
+}
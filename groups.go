@@ -0,0 +1,160 @@
+package socks4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnknownUser is the error of a GroupResolver for the user ids missing
+// from its directory.
+var ErrUnknownUser = errors.New("unknown user")
+
+// GroupResolver returns the groups of the users of a directory, like
+// LDAPGroups.
+type GroupResolver interface {
+	// UserGroups returns the groups of the user, or ErrUnknownUser.
+	UserGroups(ctx context.Context, userId string) ([]string, error)
+}
+
+const (
+	// defaultGroupsTTL is the time the groups of a user are cached by
+	// default.
+	defaultGroupsTTL = 5 * time.Minute
+	// groupsTimeout is the max time of a lookup of groups.
+	groupsTimeout = 10 * time.Second
+	// maxGroupsCache is the number of users whose groups are cached.
+	maxGroupsCache = 10000
+)
+
+// WithGroups makes the server authorize the user ids of the requests by r:
+// the requests of the users unknown to r are rejected like those of the
+// rejected user ids, and the groups of the others are set in
+// Request.Groups and matched by the group key of the rules. The groups, and
+// the unknown users, are cached for ttl, 5m if 0. The requests are
+// rejected when r fails, their users being neither allowed nor denied.
+//
+// Only authenticated user ids are authorized, so that clients can't claim
+// the groups of other users: those of client certificates (WithCertUserId),
+// tokens (WithJWT), PAM with a secret (WithPAM) or SOCKS 5 and HTTP
+// passwords. The requests with other user ids are rejected like those of
+// the unknown users.
+func WithGroups(r GroupResolver, ttl time.Duration) OptionFunc {
+	return func(s *Server) {
+		if ttl <= 0 {
+			ttl = defaultGroupsTTL
+		}
+		s.groups = &groupCache{resolver: r, ttl: ttl, cache: make(map[string]groupEntry)}
+	}
+}
+
+// groupCache caches the groups of the users of a resolver.
+type groupCache struct {
+	resolver GroupResolver
+	ttl      time.Duration
+
+	mu    sync.Mutex
+	cache map[string]groupEntry
+}
+
+// groupEntry is the cached groups of a user.
+type groupEntry struct {
+	groups  []string
+	unknown bool // the user is unknown.
+	expires time.Time
+}
+
+// lookup returns the groups of the user, cached or from the resolver.
+func (c *groupCache) lookup(userId string, now time.Time) ([]string, error) {
+	c.mu.Lock()
+	e, ok := c.cache[userId]
+	c.mu.Unlock()
+	if !ok || !now.Before(e.expires) {
+		ctx, cancel := context.WithTimeout(context.Background(), groupsTimeout)
+		defer cancel()
+		groups, err := c.resolver.UserGroups(ctx, userId)
+		if err != nil && !errors.Is(err, ErrUnknownUser) {
+			return nil, err
+		}
+		e = groupEntry{groups: groups, unknown: err != nil, expires: now.Add(c.ttl)}
+		c.store(userId, e, now)
+	}
+	if e.unknown {
+		return nil, ErrUnknownUser
+	}
+	return e.groups, nil
+}
+
+// store caches the entry of the user, making room if the cache is full.
+func (c *groupCache) store(userId string, e groupEntry, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.cache) >= maxGroupsCache {
+		for u, old := range c.cache {
+			if !now.Before(old.expires) {
+				delete(c.cache, u)
+			}
+		}
+		// the map iteration order is random.
+		for u := range c.cache {
+			if len(c.cache) < maxGroupsCache {
+				break
+			}
+			delete(c.cache, u)
+		}
+	}
+	c.cache[userId] = e
+}
+
+// resolveGroups returns the request of the client on conn with the groups
+// of its user.
+func (s *Server) resolveGroups(conn net.Conn, req Request) (Request, error) {
+	if s.groups == nil || req.Version == VersionTransparent {
+		return req, nil
+	}
+	if !s.authenticated(conn, req) {
+		return req, fmt.Errorf("%w: groups of unauthenticated user %q", ErrUserIdRejected, req.UserId)
+	}
+	groups, err := s.groups.lookup(req.UserId, s.clock.Now())
+	if errors.Is(err, ErrUnknownUser) {
+		return req, fmt.Errorf("%w: %v %q", ErrUserIdRejected, err, req.UserId)
+	}
+	if err != nil {
+		return req, fmt.Errorf("groups of user %q: %v", req.UserId, err)
+	}
+	s.log(LogHandshake).Debugf("user %q is in the groups %v", req.UserId, groups)
+	req.Groups = groups
+	return req, nil
+}
+
+// matchGroup reports whether any of the groups is the group name, by their
+// whole names, case-insensitively, or as distinguished names like
+// "CN=net-admins,OU=Groups,DC=example,DC=com", regardless of the spaces
+// around their separators and with the spaces of their values written \20.
+func matchGroup(groups []string, name string) bool {
+	name = normalizeDN(name)
+	for _, g := range groups {
+		if normalizeDN(g) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeDN returns the lower case name with the escaped spaces decoded
+// and the spaces around the separators of distinguished names removed.
+func normalizeDN(name string) string {
+	name = strings.ToLower(strings.ReplaceAll(name, `\20`, " "))
+	for _, sep := range []string{",", "=", "+"} {
+		parts := strings.Split(name, sep)
+		for i := range parts {
+			parts[i] = strings.TrimSpace(parts[i])
+		}
+		name = strings.Join(parts, sep)
+	}
+	return strings.TrimSpace(name)
+}
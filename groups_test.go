@@ -0,0 +1,117 @@
+package socks4
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchGroup(t *testing.T) {
+	groups := []string{"CN=net-admins,OU=Security Groups,DC=example,DC=com", "staff"}
+	for _, tt := range []struct {
+		name  string
+		match bool
+	}{
+		{"staff", true},
+		{"STAFF", true},
+		{"CN=net-admins,OU=Security\\20Groups,DC=example,DC=com", true},
+		{"cn=net-admins, ou=security\\20groups, dc=example, dc=com", true},
+		{"CN = net-admins,OU=Security\\20Groups,DC=example,DC=com", true},
+		{"net-admins", false},
+		{"CN=net-admins", false},
+		{"CN=net-admins,OU=Contractors,DC=example,DC=com", false},
+		{"staf", false},
+	} {
+		if match := matchGroup(groups, tt.name); match != tt.match {
+			t.Errorf("group %q matched %v, want %v", tt.name, match, tt.match)
+		}
+	}
+}
+
+// staticGroups resolves the groups of the users of its map.
+type staticGroups struct {
+	users   map[string][]string
+	lookups int
+	err     error
+}
+
+func (g *staticGroups) UserGroups(ctx context.Context, userId string) ([]string, error) {
+	g.lookups++
+	if g.err != nil {
+		return nil, g.err
+	}
+	groups, ok := g.users[userId]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	return groups, nil
+}
+
+func TestResolveGroups(t *testing.T) {
+	users := map[string][]string{"alice": {"staff"}}
+	jwt := WithJWT(NewJWTValidator(JWTConfig{Keys: map[string]any{"": []byte("secret")}}))
+	for _, tt := range []struct {
+		name     string
+		opts     []OptionFunc
+		req      Request
+		resolver *staticGroups
+		groups   []string
+		err      error
+	}{
+		{name: "authenticated SOCKS 4", opts: []OptionFunc{jwt}, req: Request{Version: Version4, UserId: "alice"}, groups: []string{"staff"}},
+		{name: "authenticated SOCKS 5", opts: []OptionFunc{WithSocks5(func(string, string) bool { return true })}, req: Request{Version: Version5, UserId: "alice"}, groups: []string{"staff"}},
+		{name: "claimed SOCKS 4", req: Request{Version: Version4, UserId: "alice"}, err: ErrUserIdRejected},
+		{name: "claimed SOCKS 5", req: Request{Version: Version5, UserId: "alice"}, err: ErrUserIdRejected},
+		{name: "PAM without secret", opts: []OptionFunc{WithPAM(PAMConfig{Service: "socks4"})}, req: Request{Version: Version4, UserId: "alice"}, err: ErrUserIdRejected},
+		{name: "unknown user", opts: []OptionFunc{jwt}, req: Request{Version: Version4, UserId: "bob"}, err: ErrUserIdRejected},
+		{name: "transparent", req: Request{Version: VersionTransparent}},
+		{name: "resolver failure", opts: []OptionFunc{jwt}, req: Request{Version: Version4, UserId: "alice"}, resolver: &staticGroups{err: errors.New("directory down")}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.resolver
+			if r == nil {
+				r = &staticGroups{users: users}
+			}
+			s := newTestServer(append(tt.opts, WithGroups(r, time.Minute))...)
+			req, err := s.resolveGroups(&bufConn{}, tt.req)
+			if tt.resolver != nil && tt.resolver.err != nil {
+				if err == nil || errors.Is(err, ErrUserIdRejected) || !strings.Contains(err.Error(), "directory down") {
+					t.Fatalf("error %v, want the error of the resolver", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(req.Groups, tt.groups) {
+				t.Errorf("groups %v, want %v", req.Groups, tt.groups)
+			}
+		})
+	}
+}
+
+func TestGroupCache(t *testing.T) {
+	r := &staticGroups{users: map[string][]string{"alice": {"staff"}}}
+	c := &groupCache{resolver: r, ttl: time.Minute, cache: make(map[string]groupEntry)}
+	now := time.Unix(1000, 0)
+	for _, tt := range []struct {
+		user    string
+		at      time.Duration
+		err     error
+		lookups int
+	}{
+		{user: "alice", lookups: 1},
+		{user: "alice", at: 30 * time.Second, lookups: 1},
+		{user: "bob", at: 30 * time.Second, err: ErrUnknownUser, lookups: 2},
+		{user: "bob", at: 40 * time.Second, err: ErrUnknownUser, lookups: 2},
+		{user: "alice", at: time.Minute, lookups: 3},
+	} {
+		_, err := c.lookup(tt.user, now.Add(tt.at))
+		if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) || r.lookups != tt.lookups {
+			t.Errorf("%v at %v: error %v after %v lookups, want %v after %v", tt.user, tt.at, err, r.lookups, tt.err, tt.lookups)
+		}
+	}
+}
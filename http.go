@@ -0,0 +1,138 @@
+package socks4
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// VersionHTTP is the Version of the requests received by HTTP CONNECT. It
+// is not a SOCKS version: the value is the first byte of the method.
+var VersionHTTP byte = 'C'
+
+// isHTTPMethod reports whether the first byte of a client message starts
+// an HTTP method, which no SOCKS version does.
+func isHTTPMethod(c byte) bool {
+	return c >= 'A' && c <= 'Z'
+}
+
+// maxHTTPHeaderSize is the max size of the header of an HTTP CONNECT
+// request.
+const maxHTTPHeaderSize = 8 * 1024
+
+// WithHTTPConnect makes the server also serve HTTP proxy clients on its
+// listeners, which tunnel connections with the CONNECT method. If auth is
+// not nil, clients authenticate with the Basic scheme of the
+// Proxy-Authorization header, and the username is the user id of the
+// request for the rules and logs.
+func WithHTTPConnect(auth PasswordAuth) OptionFunc {
+	return func(s *Server) {
+		s.httpConnect = true
+		s.httpAuth = auth
+	}
+}
+
+// readHTTPConnect reads the header of an HTTP CONNECT request. first holds
+// the bytes of the client already read.
+func (s *Server) readHTTPConnect(conn net.Conn, first []byte) (Request, error) {
+	// the header is read a byte at a time so that no data after it is
+	// consumed.
+	b := append(make([]byte, 0, 512), first...)
+	c := make([]byte, 1)
+	for !bytes.HasSuffix(b, []byte("\r\n\r\n")) {
+		if len(b) >= maxHTTPHeaderSize {
+			writeHTTPStatus(conn, http.StatusRequestHeaderFieldsTooLarge, nil)
+			return Request{}, errors.New("HTTP request header too large")
+		}
+		if _, err := io.ReadFull(conn, c); err != nil {
+			return Request{}, fmt.Errorf("failed to read HTTP request: %v", err)
+		}
+		b = append(b, c[0])
+	}
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		writeHTTPStatus(conn, http.StatusBadRequest, nil)
+		return Request{}, fmt.Errorf("invalid HTTP request: %v", err)
+	}
+	if r.Method != http.MethodConnect {
+		writeHTTPStatus(conn, http.StatusMethodNotAllowed, http.Header{"Allow": {http.MethodConnect}})
+		return Request{}, fmt.Errorf("unsupported HTTP method %v", r.Method)
+	}
+
+	req := Request{Version: VersionHTTP, Cmd: CmdConnect, Address: r.Host}
+	host, portStr, err := net.SplitHostPort(r.Host)
+	port, pErr := strconv.Atoi(portStr)
+	if err != nil || pErr != nil || host == "" || port <= 0 || port > 65535 {
+		writeHTTPStatus(conn, http.StatusBadRequest, nil)
+		return req, fmt.Errorf("invalid HTTP CONNECT target %q", r.Host)
+	}
+	req.Port = port
+
+	if s.httpAuth != nil {
+		username, password, ok := parseProxyAuthorization(r.Header.Get("Proxy-Authorization"))
+		if !ok || !s.httpAuth(username, password) {
+			writeHTTPStatus(conn, http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {`Basic realm="proxy"`}})
+			if !ok {
+				return req, errors.New("HTTP client sent no credentials")
+			}
+			// the username is not logged, as it may be a mistyped password.
+			return req, errors.New("HTTP authentication failed")
+		}
+		req.UserId = username
+	}
+	s.log(LogHandshake).Debugf("read HTTP CONNECT request from client %v: %v", conn.RemoteAddr(), req)
+	return req, nil
+}
+
+// parseProxyAuthorization parses the credentials of the Basic scheme.
+func parseProxyAuthorization(auth string) (username, password string, ok bool) {
+	encoded, ok := strings.CutPrefix(auth, "Basic ")
+	if !ok {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(b), ":")
+}
+
+// httpReplier writes the HTTP responses of CONNECT requests.
+type httpReplier struct{}
+
+func (httpReplier) granted(conn net.Conn, bound net.Addr) error {
+	_, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	return err
+}
+
+func (httpReplier) rejected(conn net.Conn, err error) error {
+	code := http.StatusBadGateway
+	var netErr net.Error
+	if errors.Is(err, errDenied) {
+		code = http.StatusForbidden
+	} else if errors.Is(err, errMaintenance) || errors.Is(err, errTooManyDials) || errors.Is(err, errTooManyRelays) ||
+		errors.Is(err, errTooManyUserSessions) {
+		code = http.StatusServiceUnavailable
+	} else if errors.As(err, &netErr) && netErr.Timeout() {
+		code = http.StatusGatewayTimeout
+	}
+	return writeHTTPStatus(conn, code, nil)
+}
+
+// writeHTTPStatus writes a response with the status code and header and
+// no body, which ends the connection.
+func writeHTTPStatus(conn net.Conn, code int, header http.Header) error {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "HTTP/1.1 %v %v\r\n", code, http.StatusText(code))
+	header.Write(&b)
+	b.WriteString("Connection: close\r\nContent-Length: 0\r\n\r\n")
+	_, err := conn.Write(b.Bytes())
+	return err
+}
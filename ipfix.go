@@ -0,0 +1,295 @@
+package socks4
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// Information elements of the IPFIX flow records (RFC 7012), the
+// client-side 5-tuple being the pre-NAT one and the egress-side 5-tuple
+// the post-NAT one, like for a NAT device.
+const (
+	ipfixOctetDeltaCount            = 1
+	ipfixPacketDeltaCount           = 2
+	ipfixProtocolIdentifier         = 4
+	ipfixSourceTransportPort        = 7
+	ipfixSourceIPv4Address          = 8
+	ipfixDestinationTransportPort   = 11
+	ipfixDestinationIPv4Address     = 12
+	ipfixSourceIPv6Address          = 27
+	ipfixDestinationIPv6Address     = 28
+	ipfixFlowStartMilliseconds      = 152
+	ipfixFlowEndMilliseconds        = 153
+	ipfixPostNATSourceIPv4Address   = 225
+	ipfixPostNATDestIPv4Address     = 226
+	ipfixPostNAPTSourcePort         = 227
+	ipfixPostNAPTDestPort           = 228
+	ipfixPostNATSourceIPv6Address   = 281
+	ipfixPostNATDestIPv6Address     = 282
+	ipfixReverseEnterpriseNumber    = 29305 // reverse elements of biflows (RFC 5103).
+	ipfixVersion                    = 10
+	ipfixTemplateSetID              = 2
+	ipfixFirstTemplateID            = 256
+	ipfixMaxMessage                 = 1400 // max size of a message, within the MTU.
+	ipfixTemplateInterval           = time.Minute
+	ipfixEstimatedSegmentSize       = 1460
+	ipfixFieldIPv4, ipfixFieldIPv6  = 4, 16
+	ipfixFieldPort, ipfixFieldCount = 2, 8
+)
+
+// ipfixField is a field of a template.
+type ipfixField struct {
+	id         uint16
+	length     uint16
+	enterprise uint32 // 0 for the IANA elements.
+}
+
+// ipfixTemplate returns the fields of the template of the flows whose
+// client side is IPv6 if v6 is true, and the egress side if egressV6 is.
+func ipfixTemplate(v6, egressV6 bool) []ipfixField {
+	var fields []ipfixField
+	if v6 {
+		fields = append(fields, ipfixField{id: ipfixSourceIPv6Address, length: ipfixFieldIPv6},
+			ipfixField{id: ipfixDestinationIPv6Address, length: ipfixFieldIPv6})
+	} else {
+		fields = append(fields, ipfixField{id: ipfixSourceIPv4Address, length: ipfixFieldIPv4},
+			ipfixField{id: ipfixDestinationIPv4Address, length: ipfixFieldIPv4})
+	}
+	if egressV6 {
+		fields = append(fields, ipfixField{id: ipfixPostNATSourceIPv6Address, length: ipfixFieldIPv6},
+			ipfixField{id: ipfixPostNATDestIPv6Address, length: ipfixFieldIPv6})
+	} else {
+		fields = append(fields, ipfixField{id: ipfixPostNATSourceIPv4Address, length: ipfixFieldIPv4},
+			ipfixField{id: ipfixPostNATDestIPv4Address, length: ipfixFieldIPv4})
+	}
+	return append(fields,
+		ipfixField{id: ipfixSourceTransportPort, length: ipfixFieldPort},
+		ipfixField{id: ipfixDestinationTransportPort, length: ipfixFieldPort},
+		ipfixField{id: ipfixPostNAPTSourcePort, length: ipfixFieldPort},
+		ipfixField{id: ipfixPostNAPTDestPort, length: ipfixFieldPort},
+		ipfixField{id: ipfixProtocolIdentifier, length: 1},
+		ipfixField{id: ipfixOctetDeltaCount, length: ipfixFieldCount},
+		ipfixField{id: ipfixPacketDeltaCount, length: ipfixFieldCount},
+		ipfixField{id: ipfixOctetDeltaCount, length: ipfixFieldCount, enterprise: ipfixReverseEnterpriseNumber},
+		ipfixField{id: ipfixPacketDeltaCount, length: ipfixFieldCount, enterprise: ipfixReverseEnterpriseNumber},
+		ipfixField{id: ipfixFlowStartMilliseconds, length: ipfixFieldCount},
+		ipfixField{id: ipfixFlowEndMilliseconds, length: ipfixFieldCount},
+	)
+}
+
+// ipfixTemplateID returns the ID of the template of the flows.
+func ipfixTemplateID(v6, egressV6 bool) uint16 {
+	id := uint16(ipfixFirstTemplateID)
+	if v6 {
+		id += 2
+	}
+	if egressV6 {
+		id++
+	}
+	return id
+}
+
+// ipfixFlow is the flow record of a session.
+type ipfixFlow struct {
+	client, listener, egress, remote *net.TCPAddr
+	toRemote, toClient               uint64 // bytes.
+	start, end                       time.Time
+}
+
+// IPFIXExporter is an EventNotifier exporting a flow record of every
+// closed session to an IPFIX collector over UDP, for the network teams
+// consuming flow data. A record carries the client-side 5-tuple (client to
+// listener) as the flow and the egress-side one (egress to remote host) as
+// its post-NAT addresses, the bytes in both directions as a biflow and the
+// times of the session. The proxy does not see the TCP segments, so the
+// packet counts are estimated from the bytes.
+type IPFIXExporter struct {
+	conn     net.Conn
+	domainID uint32
+	logger   Logger
+	batcher  *batcher[ipfixFlow]
+
+	mu           sync.Mutex // guards the fields below, used by the batcher.
+	sequence     uint32     // number of data records sent.
+	templateSent time.Time
+}
+
+// NewIPFIXExporter creates an exporter to the collector at the UDP
+// address, with the observation domain ID of the records. Send errors are
+// logged to logger if it is not nil. Close it to send the pending
+// records.
+func NewIPFIXExporter(address string, domainID uint32, logger Logger) (*IPFIXExporter, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	e := &IPFIXExporter{conn: conn, domainID: domainID, logger: logger}
+	e.batcher = newBatcher(32, time.Second, e.send)
+	return e, nil
+}
+
+// Notify queues the flow record of a closed session.
+func (e *IPFIXExporter) Notify(ev Event) {
+	if ev.Type != EventClosed {
+		return
+	}
+	flow := ipfixFlow{
+		client:   ipfixAddr(ev.Session.Client),
+		listener: ipfixAddr(ev.Listener),
+		egress:   ipfixAddr(ev.Egress),
+		remote:   ipfixAddr(ev.Remote),
+		toRemote: ev.Session.ClientToRemote,
+		toClient: ev.Session.RemoteToClient,
+		start:    ev.Session.Start,
+		end:      ev.Time,
+	}
+	if !e.batcher.add(flow) && e.logger != nil {
+		e.logger.Warnf("IPFIX queue is full, flow of session %v dropped", ev.Session.ID)
+	}
+}
+
+// Close sends the pending records and closes the connection.
+func (e *IPFIXExporter) Close() error {
+	e.batcher.close()
+	return e.conn.Close()
+}
+
+// ipfixAddr parses the address, the unspecified IPv4 one if it is not an
+// IP address.
+func ipfixAddr(s string) *net.TCPAddr {
+	addr := &net.TCPAddr{IP: net.IPv4zero}
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return addr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		addr.IP = ip
+	}
+	addr.Port, _ = net.LookupPort("tcp", port)
+	return addr
+}
+
+// ipfixIsIPv6 reports whether the flow addresses of a side are IPv6, which are
+// both made IPv6 if only one is.
+func ipfixIsIPv6(a, b *net.TCPAddr) bool {
+	return a.IP.To4() == nil || b.IP.To4() == nil
+}
+
+// send sends the flows in messages, preceded by the templates in the first
+// message and then every ipfixTemplateInterval.
+func (e *IPFIXExporter) send(flows []ipfixFlow) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var msg []byte
+	if time.Since(e.templateSent) >= ipfixTemplateInterval {
+		msg = e.appendTemplates(e.header())
+		e.templateSent = time.Now()
+	}
+	for len(flows) > 0 {
+		if msg == nil {
+			msg = e.header()
+		}
+		v6, egressV6 := ipfixIsIPv6(flows[0].client, flows[0].listener), ipfixIsIPv6(flows[0].egress, flows[0].remote)
+		setStart := len(msg)
+		msg = binary.BigEndian.AppendUint16(msg, ipfixTemplateID(v6, egressV6))
+		msg = binary.BigEndian.AppendUint16(msg, 0) // length, set below.
+		n := 0
+		for _, f := range flows {
+			if ipfixIsIPv6(f.client, f.listener) != v6 || ipfixIsIPv6(f.egress, f.remote) != egressV6 {
+				break
+			}
+			record := appendIPFIXRecord(nil, &f, v6, egressV6)
+			if n > 0 && len(msg)+len(record) > ipfixMaxMessage {
+				break
+			}
+			msg = append(msg, record...)
+			n++
+		}
+		binary.BigEndian.PutUint16(msg[setStart+2:], uint16(len(msg)-setStart))
+		e.sequence += uint32(n)
+		e.write(msg)
+		msg = nil
+		flows = flows[n:]
+	}
+	if msg != nil {
+		e.write(msg)
+	}
+}
+
+// header returns a message header, whose length is set by write.
+func (e *IPFIXExporter) header() []byte {
+	b := make([]byte, 0, ipfixMaxMessage)
+	b = binary.BigEndian.AppendUint16(b, ipfixVersion)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint32(b, uint32(time.Now().Unix()))
+	b = binary.BigEndian.AppendUint32(b, e.sequence)
+	return binary.BigEndian.AppendUint32(b, e.domainID)
+}
+
+// appendTemplates appends a template set of the templates of the flows.
+func (e *IPFIXExporter) appendTemplates(b []byte) []byte {
+	setStart := len(b)
+	b = binary.BigEndian.AppendUint16(b, ipfixTemplateSetID)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	for _, v6 := range []bool{false, true} {
+		for _, egressV6 := range []bool{false, true} {
+			fields := ipfixTemplate(v6, egressV6)
+			b = binary.BigEndian.AppendUint16(b, ipfixTemplateID(v6, egressV6))
+			b = binary.BigEndian.AppendUint16(b, uint16(len(fields)))
+			for _, f := range fields {
+				if f.enterprise != 0 {
+					b = binary.BigEndian.AppendUint16(b, f.id|0x8000)
+					b = binary.BigEndian.AppendUint16(b, f.length)
+					b = binary.BigEndian.AppendUint32(b, f.enterprise)
+				} else {
+					b = binary.BigEndian.AppendUint16(b, f.id)
+					b = binary.BigEndian.AppendUint16(b, f.length)
+				}
+			}
+		}
+	}
+	binary.BigEndian.PutUint16(b[setStart+2:], uint16(len(b)-setStart))
+	return b
+}
+
+// appendIPFIXRecord appends the data record of the flow, in the order of
+// the fields of its template.
+func appendIPFIXRecord(b []byte, f *ipfixFlow, v6, egressV6 bool) []byte {
+	ip := func(b []byte, addr *net.TCPAddr, v6 bool) []byte {
+		if v6 {
+			return append(b, addr.IP.To16()...)
+		}
+		return append(b, addr.IP.To4()...)
+	}
+	b = ip(b, f.client, v6)
+	b = ip(b, f.listener, v6)
+	b = ip(b, f.egress, egressV6)
+	b = ip(b, f.remote, egressV6)
+	b = binary.BigEndian.AppendUint16(b, uint16(f.client.Port))
+	b = binary.BigEndian.AppendUint16(b, uint16(f.listener.Port))
+	b = binary.BigEndian.AppendUint16(b, uint16(f.egress.Port))
+	b = binary.BigEndian.AppendUint16(b, uint16(f.remote.Port))
+	b = append(b, 6) // TCP.
+	b = binary.BigEndian.AppendUint64(b, f.toRemote)
+	b = binary.BigEndian.AppendUint64(b, estimatePackets(f.toRemote))
+	b = binary.BigEndian.AppendUint64(b, f.toClient)
+	b = binary.BigEndian.AppendUint64(b, estimatePackets(f.toClient))
+	b = binary.BigEndian.AppendUint64(b, uint64(f.start.UnixMilli()))
+	return binary.BigEndian.AppendUint64(b, uint64(f.end.UnixMilli()))
+}
+
+// estimatePackets estimates the packets carrying the bytes in full-sized
+// segments.
+func estimatePackets(bytes uint64) uint64 {
+	return (bytes + ipfixEstimatedSegmentSize - 1) / ipfixEstimatedSegmentSize
+}
+
+// write sets the length of the message and sends it.
+func (e *IPFIXExporter) write(msg []byte) {
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+	if _, err := e.conn.Write(msg); err != nil && e.logger != nil {
+		e.logger.Warnf("IPFIX export: %v", err)
+	}
+}
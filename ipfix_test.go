@@ -0,0 +1,253 @@
+package socks4
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// ipfixMessage is a parsed IPFIX message.
+type ipfixMessage struct {
+	sequence  uint32
+	domainID  uint32
+	templates map[uint16][]ipfixField
+	records   []ipfixDataRecord
+}
+
+// ipfixDataRecord is a data record by the IDs of its fields, the reverse
+// elements being negated.
+type ipfixDataRecord struct {
+	template uint16
+	fields   map[int][]byte
+}
+
+// parseIPFIX parses a message, whose data sets use the templates.
+func parseIPFIX(t *testing.T, b []byte, templates map[uint16][]ipfixField) ipfixMessage {
+	t.Helper()
+	if len(b) < 16 || binary.BigEndian.Uint16(b) != ipfixVersion || int(binary.BigEndian.Uint16(b[2:])) != len(b) || len(b) > ipfixMaxMessage {
+		t.Fatalf("invalid message header %x of %v bytes", b[:16], len(b))
+	}
+	m := ipfixMessage{sequence: binary.BigEndian.Uint32(b[8:]), domainID: binary.BigEndian.Uint32(b[12:]), templates: make(map[uint16][]ipfixField)}
+	for b = b[16:]; len(b) > 0; {
+		id, size := binary.BigEndian.Uint16(b), int(binary.BigEndian.Uint16(b[2:]))
+		if size < 4 || size > len(b) {
+			t.Fatalf("set %v of invalid length %v", id, size)
+		}
+		set := b[4:size]
+		b = b[size:]
+		if id == ipfixTemplateSetID {
+			for len(set) > 0 {
+				tid, n := binary.BigEndian.Uint16(set), int(binary.BigEndian.Uint16(set[2:]))
+				set = set[4:]
+				var fields []ipfixField
+				for i := 0; i < n; i++ {
+					f := ipfixField{id: binary.BigEndian.Uint16(set), length: binary.BigEndian.Uint16(set[2:])}
+					set = set[4:]
+					if f.id&0x8000 != 0 {
+						f.id &^= 0x8000
+						f.enterprise = binary.BigEndian.Uint32(set)
+						set = set[4:]
+					}
+					fields = append(fields, f)
+				}
+				m.templates[tid] = fields
+				templates[tid] = fields
+			}
+			continue
+		}
+		fields, ok := templates[id]
+		if !ok {
+			t.Fatalf("data set of the unknown template %v", id)
+		}
+		for len(set) > 0 {
+			r := ipfixDataRecord{template: id, fields: make(map[int][]byte)}
+			for _, f := range fields {
+				if int(f.length) > len(set) {
+					t.Fatalf("record of template %v truncated", id)
+				}
+				key := int(f.id)
+				if f.enterprise == ipfixReverseEnterpriseNumber {
+					key = -key
+				}
+				r.fields[key] = set[:f.length]
+				set = set[f.length:]
+			}
+			m.records = append(m.records, r)
+		}
+	}
+	return m
+}
+
+func TestIPFIXExporter(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	e, err := NewIPFIXExporter(collector.LocalAddr().String(), 7, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.UnixMilli(1714564800123)
+	closed := func(client, listener, egress, remote string, toRemote, toClient uint64) Event {
+		return Event{
+			Type:     EventClosed,
+			Time:     start.Add(time.Minute),
+			Session:  SessionInfo{Client: client, Start: start, ClientToRemote: toRemote, RemoteToClient: toClient},
+			Listener: listener,
+			Egress:   egress,
+			Remote:   remote,
+		}
+	}
+	e.Notify(closed("192.0.2.1:50000", "192.0.2.10:1080", "198.51.100.10:40000", "198.51.100.1:80", 100, 3000))
+	e.Notify(Event{Type: EventEstablished, Session: SessionInfo{Client: "192.0.2.1:50001"}})
+	e.Notify(Event{Type: EventRejected, Session: SessionInfo{Client: "192.0.2.1:50002"}})
+	e.Notify(closed("[2001:db8::1]:50000", "[2001:db8::10]:1080", "198.51.100.10:40001", "198.51.100.1:443", 0, 1))
+	e.Notify(closed("192.0.2.1:50003", "192.0.2.10:1080", "[2001:db8:1::10]:40002", "[2001:db8:1::1]:80", 1460, 1461))
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	templates := make(map[uint16][]ipfixField)
+	var records []ipfixDataRecord
+	var sequence uint32
+	for i := 0; len(records) < 3; i++ {
+		collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 65536)
+		n, _, err := collector.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("%v records received: %v", len(records), err)
+		}
+		m := parseIPFIX(t, b[:n], templates)
+		if m.domainID != 7 || m.sequence != sequence {
+			t.Errorf("message %v of domain %v and sequence %v, want 7 and %v", i, m.domainID, m.sequence, sequence)
+		}
+		// the templates are sent first.
+		if (len(m.templates) != 0) != (i == 0) {
+			t.Errorf("message %v with %v templates", i, len(m.templates))
+		}
+		sequence += uint32(len(m.records))
+		records = append(records, m.records...)
+	}
+	if len(templates) != 4 {
+		t.Fatalf("%v templates, want 4", len(templates))
+	}
+	for id, fields := range templates {
+		if id < ipfixFirstTemplateID || id > ipfixFirstTemplateID+3 {
+			t.Errorf("template ID %v", id)
+		}
+		if want := ipfixTemplate(id&2 != 0, id&1 != 0); !reflect.DeepEqual(fields, want) {
+			t.Errorf("template %v: fields %v, want %v", id, fields, want)
+		}
+	}
+
+	ip := func(s string) []byte {
+		if ip := net.ParseIP(s); ip.To4() != nil {
+			return ip.To4()
+		}
+		return net.ParseIP(s)
+	}
+	u16 := func(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+	u64 := func(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+	for i, want := range []struct {
+		template                       uint16
+		src, dst, natSrc, natDst       []byte
+		srcPort, dstPort               uint16
+		natSrcPort, natDstPort         uint16
+		octets, packets, rOctets, rPkt uint64
+	}{
+		{ipfixFirstTemplateID, ip("192.0.2.1"), ip("192.0.2.10"), ip("198.51.100.10"), ip("198.51.100.1"), 50000, 1080, 40000, 80, 100, 1, 3000, 3},
+		{ipfixFirstTemplateID + 2, ip("2001:db8::1"), ip("2001:db8::10"), ip("198.51.100.10"), ip("198.51.100.1"), 50000, 1080, 40001, 443, 0, 0, 1, 1},
+		{ipfixFirstTemplateID + 1, ip("192.0.2.1"), ip("192.0.2.10"), ip("2001:db8:1::10"), ip("2001:db8:1::1"), 50003, 1080, 40002, 80, 1460, 1, 1461, 2},
+	} {
+		r := records[i]
+		srcID, dstID, natSrcID, natDstID := ipfixSourceIPv4Address, ipfixDestinationIPv4Address, ipfixPostNATSourceIPv4Address, ipfixPostNATDestIPv4Address
+		if len(want.src) == net.IPv6len {
+			srcID, dstID = ipfixSourceIPv6Address, ipfixDestinationIPv6Address
+		}
+		if len(want.natSrc) == net.IPv6len {
+			natSrcID, natDstID = ipfixPostNATSourceIPv6Address, ipfixPostNATDestIPv6Address
+		}
+		wantFields := map[int][]byte{
+			srcID: want.src, dstID: want.dst, natSrcID: want.natSrc, natDstID: want.natDst,
+			ipfixSourceTransportPort: u16(want.srcPort), ipfixDestinationTransportPort: u16(want.dstPort),
+			ipfixPostNAPTSourcePort: u16(want.natSrcPort), ipfixPostNAPTDestPort: u16(want.natDstPort),
+			ipfixProtocolIdentifier: {6},
+			ipfixOctetDeltaCount:    u64(want.octets), ipfixPacketDeltaCount: u64(want.packets),
+			-ipfixOctetDeltaCount: u64(want.rOctets), -ipfixPacketDeltaCount: u64(want.rPkt),
+			ipfixFlowStartMilliseconds: u64(1714564800123), ipfixFlowEndMilliseconds: u64(1714564860123),
+		}
+		if r.template != want.template || !reflect.DeepEqual(r.fields, wantFields) {
+			t.Errorf("record %v of template %v: %x, want %v: %x", i, r.template, r.fields, want.template, wantFields)
+		}
+	}
+}
+
+func TestIPFIXMessageSize(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	e, err := NewIPFIXExporter(collector.LocalAddr().String(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const flows = 32
+	for i := 0; i < flows; i++ {
+		e.Notify(Event{Type: EventClosed, Session: SessionInfo{Client: "[2001:db8::1]:50000"}, Listener: "[2001:db8::10]:1080",
+			Egress: "[2001:db8:1::10]:40000", Remote: "[2001:db8:1::1]:80"})
+	}
+	e.Close()
+	templates := make(map[uint16][]ipfixField)
+	var received, messages int
+	for received < flows {
+		collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 65536)
+		n, _, err := collector.ReadFrom(b)
+		if err != nil {
+			t.Fatalf("%v records received: %v", received, err)
+		}
+		// parseIPFIX checks the max size of the messages.
+		received += len(parseIPFIX(t, b[:n], templates).records)
+		messages++
+	}
+	if messages < 2 {
+		t.Errorf("%v records sent in a single message", flows)
+	}
+}
+
+func TestIPFIXAddr(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{"192.0.2.1:80", "192.0.2.1:80"},
+		{"[2001:db8::1]:443", "[2001:db8::1]:443"},
+		{"example.com:443", "0.0.0.0:443"},
+		{"", "0.0.0.0:0"},
+		{"192.0.2.1", "0.0.0.0:0"},
+	} {
+		if got := ipfixAddr(tt.in).String(); got != tt.want {
+			t.Errorf("%q parsed as %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestEstimatePackets(t *testing.T) {
+	for _, tt := range []struct {
+		bytes, packets uint64
+	}{
+		{0, 0},
+		{1, 1},
+		{ipfixEstimatedSegmentSize, 1},
+		{ipfixEstimatedSegmentSize + 1, 2},
+		{10 * ipfixEstimatedSegmentSize, 10},
+	} {
+		if got := estimatePackets(tt.bytes); got != tt.packets {
+			t.Errorf("%v bytes in %v packets, want %v", tt.bytes, got, tt.packets)
+		}
+	}
+}
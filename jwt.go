@@ -0,0 +1,459 @@
+package socks4
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWTConfig is the configuration of a JWTValidator.
+type JWTConfig struct {
+	// Keys are the static keys verifying the tokens by their key id, ""
+	// for the tokens without one: *rsa.PublicKey, *ecdsa.PublicKey or
+	// ed25519.PublicKey, or a []byte secret of the HS algorithms.
+	Keys map[string]any
+	// JWKSURL is the URL of the JSON Web Key Set verifying the tokens whose
+	// key is not a static one, none if empty.
+	JWKSURL string
+	// JWKSRefresh is the max age of the key set, 1h if 0. The key set is
+	// fetched again sooner for the tokens of unknown key ids, at most once
+	// a minute.
+	JWKSRefresh time.Duration
+	Timeout     time.Duration // timeout of the key set requests, 10s if 0.
+	Issuer      string        // required iss claim, any if empty.
+	Audience    string        // required in the aud claim, any if empty.
+	Leeway      time.Duration // clock skew allowed to the exp, nbf and iat claims.
+	// AllowNoExpiry accepts the tokens without exp claim, which never
+	// expire. They are rejected otherwise.
+	AllowNoExpiry bool
+	// DestinationsClaim is the claim listing the destinations the token
+	// allows, "dst" if empty, see WithJWT.
+	DestinationsClaim string
+}
+
+// JWTValidator verifies the JSON Web Tokens (RFC 7519) in compact
+// serialization signed by HS256, RS256, PS256, ES256 or EdDSA, and their
+// SHA-384 and SHA-512 variants, with static keys or the keys of a JWKS URL.
+type JWTValidator struct {
+	config JWTConfig
+	client *http.Client
+
+	mu       sync.Mutex
+	jwks     map[string]any // the keys of the key set by key id.
+	fetched  time.Time      // when the key set was fetched.
+	tried    time.Time      // when the key set was last requested.
+	fetching chan struct{}  // closed once the key set being fetched is, nil if none.
+}
+
+// minJWKSRefresh is the min delay between the requests of the key set for
+// unknown key ids.
+const minJWKSRefresh = time.Minute
+
+// NewJWTValidator creates a validator of the tokens.
+func NewJWTValidator(config JWTConfig) *JWTValidator {
+	if config.JWKSRefresh <= 0 {
+		config.JWKSRefresh = time.Hour
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.DestinationsClaim == "" {
+		config.DestinationsClaim = "dst"
+	}
+	return &JWTValidator{config: config, client: &http.Client{Timeout: config.Timeout}}
+}
+
+// WithJWT makes the server take the user ids of the SOCKS 4 requests for
+// JSON Web Tokens verified by v, whose sub claim replaces them once
+// verified. The requests with invalid or expired tokens are rejected with
+// RejectWrongUserId, and those to destinations missing from the
+// destinations claim of their token, when it has one, with
+// RejectOrFailure. The destinations are host patterns like those of the
+// to key of the rules, with an optional port, like "*.example.com:443".
+// The claims are set in Request.Claims and matched by the claim key of the
+// rules, e.g. to give a byte limit to the tokens of a tier.
+func WithJWT(v *JWTValidator) OptionFunc {
+	return func(s *Server) {
+		s.jwt = v
+	}
+}
+
+// maxTokenSize is the max size of the user ids of the SOCKS 4 requests
+// when they are tokens, which are longer than the usual user ids.
+const maxTokenSize = 8192
+
+// maxUserIdSize returns the max size of the user ids of the SOCKS 4
+// requests.
+func (s *Server) maxUserIdSize() int {
+	if s.jwt != nil {
+		return maxTokenSize
+	}
+	return maxRequestFieldSize
+}
+
+// errTokenDenied is the error of the requests to destinations their token
+// does not allow.
+var errTokenDenied = errors.New("denied by token")
+
+// verifyToken returns the request with the subject and the claims of its
+// token. The user id of the requests whose token fails to verify is
+// cleared, not to log the token.
+func (s *Server) verifyToken(req Request) (Request, error) {
+	if s.jwt == nil || req.Version != Version4 {
+		return req, nil
+	}
+	claims, err := s.jwt.Verify(req.UserId, s.clock.Now())
+	if err != nil {
+		req.UserId = ""
+		return req, fmt.Errorf("%w: %v", ErrUserIdRejected, err)
+	}
+	req.UserId, _ = claims["sub"].(string)
+	req.Claims = claims
+	if dst, ok := claims[s.jwt.config.DestinationsClaim]; ok && !tokenAllows(dst, req) {
+		return req, errTokenDenied
+	}
+	return req, nil
+}
+
+// tokenAllows reports whether the destinations claim allows the
+// destination of the request.
+func tokenAllows(dst any, req Request) bool {
+	host, port, err := net.SplitHostPort(req.Address)
+	if err != nil {
+		return false
+	}
+	for _, d := range claimStrings(dst) {
+		pattern, p, err := net.SplitHostPort(d)
+		if err != nil {
+			pattern, p = d, ""
+		}
+		if (p == "" || p == port) && matchHost(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// claimStrings returns the values of a claim, a string, a number or a
+// boolean, or an array of them, as strings.
+func claimStrings(v any) []string {
+	switch v := v.(type) {
+	case string:
+		return []string{v}
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}
+	case bool:
+		return []string{strconv.FormatBool(v)}
+	case []any:
+		var values []string
+		for _, e := range v {
+			values = append(values, claimStrings(e)...)
+		}
+		return values
+	}
+	return nil
+}
+
+// matchClaim reports whether the claim, or any of its values, equals
+// value.
+func matchClaim(claims map[string]any, name, value string) bool {
+	for _, v := range claimStrings(claims[name]) {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify verifies the signature of the token and its exp, nbf, iat, iss
+// and aud claims at now, and returns its claims. The exp claim is
+// required, unless AllowNoExpiry.
+func (v *JWTValidator) Verify(token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid JWT header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT signature: %v", err)
+	}
+	key, err := v.key(header.Kid, now)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWS(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid JWT claims: %v", err)
+	}
+	if exp, ok := claims["exp"].(float64); !ok && !v.config.AllowNoExpiry {
+		return nil, errors.New("token without expiry")
+	} else if ok && !now.Before(jwtTime(exp).Add(v.config.Leeway)) {
+		return nil, errors.New("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.config.Leeway).Before(jwtTime(nbf)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if iat, ok := claims["iat"].(float64); ok && now.Add(v.config.Leeway).Before(jwtTime(iat)) {
+		return nil, errors.New("token issued in the future")
+	}
+	if v.config.Issuer != "" && claims["iss"] != v.config.Issuer {
+		return nil, fmt.Errorf("token not issued by %v", v.config.Issuer)
+	}
+	if v.config.Audience != "" && !matchClaim(claims, "aud", v.config.Audience) {
+		return nil, fmt.Errorf("token not for audience %v", v.config.Audience)
+	}
+	return claims, nil
+}
+
+// jwtTime returns the time of a NumericDate.
+func jwtTime(seconds float64) time.Time {
+	return time.Unix(int64(seconds), 0)
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// key returns the key of the key id, static or from the key set. The key
+// set is fetched without holding the lock, so that the keys already known
+// are returned meanwhile; the unknown ones wait for it.
+func (v *JWTValidator) key(kid string, now time.Time) (any, error) {
+	if key, ok := v.config.Keys[kid]; ok {
+		return key, nil
+	}
+	if v.config.JWKSURL == "" {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	v.mu.Lock()
+	key, ok := v.jwks[kid]
+	stale := now.Sub(v.fetched) >= v.config.JWKSRefresh
+	fetching := v.fetching
+	switch {
+	case (stale || !ok) && fetching == nil && now.Sub(v.tried) >= minJWKSRefresh:
+		v.tried = now
+		done := make(chan struct{})
+		v.fetching = done
+		v.mu.Unlock()
+		jwks, err := v.fetchJWKS()
+		v.mu.Lock()
+		v.fetching = nil
+		close(done)
+		if err != nil && v.jwks == nil {
+			v.mu.Unlock()
+			return nil, fmt.Errorf("key set: %v", err)
+		}
+		if err == nil {
+			v.jwks, v.fetched = jwks, now
+		}
+		key, ok = v.jwks[kid]
+	case !ok && fetching != nil:
+		v.mu.Unlock()
+		<-fetching
+		v.mu.Lock()
+		key, ok = v.jwks[kid]
+	}
+	v.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return key, nil
+}
+
+// maxJWKSize is the max size of a key set.
+const maxJWKSize = 1 << 20
+
+// fetchJWKS returns the signature keys of the key set by key id.
+func (v *JWTValidator) fetchJWKS() (map[string]any, error) {
+	resp, err := v.client.Get(v.config.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %v", resp.Status)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSize)).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %v", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+// jwk is a public key of a key set (RFC 7517).
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// esCurves are the curves of the ECDSA algorithms.
+var esCurves = map[string]string{"ES256": "P-256", "ES384": "P-384", "ES512": "P-521"}
+
+// verifyJWS verifies the signature of the signing input by the key with
+// the algorithm alg.
+func verifyJWS(alg string, key any, input string, sig []byte) error {
+	var hash crypto.Hash
+	switch {
+	case strings.HasSuffix(alg, "256"):
+		hash = crypto.SHA256
+	case strings.HasSuffix(alg, "384"):
+		hash = crypto.SHA384
+	case strings.HasSuffix(alg, "512"):
+		hash = crypto.SHA512
+	}
+	digest := func() []byte {
+		h := hash.New()
+		h.Write([]byte(input))
+		return h.Sum(nil)
+	}
+	invalid := errors.New("invalid JWT signature")
+	switch {
+	case alg == "EdDSA":
+		pub, ok := key.(ed25519.PublicKey)
+		if !ok {
+			break
+		}
+		if !ed25519.Verify(pub, []byte(input), sig) {
+			return invalid
+		}
+		return nil
+	case hash == 0:
+	case strings.HasPrefix(alg, "HS"):
+		secret, ok := key.([]byte)
+		if !ok {
+			break
+		}
+		mac := hmac.New(hash.New, secret)
+		mac.Write([]byte(input))
+		if !hmac.Equal(mac.Sum(nil), sig) {
+			return invalid
+		}
+		return nil
+	case strings.HasPrefix(alg, "RS"), strings.HasPrefix(alg, "PS"):
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			break
+		}
+		var err error
+		if alg[0] == 'R' {
+			err = rsa.VerifyPKCS1v15(pub, hash, digest(), sig)
+		} else {
+			err = rsa.VerifyPSS(pub, hash, digest(), sig, nil)
+		}
+		if err != nil {
+			return invalid
+		}
+		return nil
+	case strings.HasPrefix(alg, "ES"):
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve.Params().Name != esCurves[alg] {
+			break
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return invalid
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest(), r, s) {
+			return invalid
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported JWT algorithm %q for the key", alg)
+}
@@ -0,0 +1,125 @@
+package socks4
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// hsToken returns an HS256 token of the claims signed with the secret.
+func hsToken(secret string, claims map[string]any) string {
+	input := jwtPart(map[string]any{"alg": "HS256", "typ": "JWT"}) + "." + jwtPart(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// edToken returns an EdDSA token of the claims signed with the key of id
+// kid.
+func edToken(key ed25519.PrivateKey, kid string, claims map[string]any) string {
+	input := jwtPart(map[string]any{"alg": "EdDSA", "kid": kid}) + "." + jwtPart(claims)
+	return input + "." + base64.RawURLEncoding.EncodeToString(ed25519.Sign(key, []byte(input)))
+}
+
+func jwtPart(v any) string {
+	b, _ := json.Marshal(v)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func TestVerifyExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for _, tt := range []struct {
+		name          string
+		claims        map[string]any
+		allowNoExpiry bool
+		valid         bool
+	}{
+		{name: "valid", claims: map[string]any{"sub": "alice", "exp": now.Unix() + 60}, valid: true},
+		{name: "expired", claims: map[string]any{"sub": "alice", "exp": now.Unix()}},
+		{name: "without expiry", claims: map[string]any{"sub": "alice"}},
+		{name: "invalid expiry", claims: map[string]any{"sub": "alice", "exp": "tomorrow"}},
+		{name: "without expiry allowed", claims: map[string]any{"sub": "alice"}, allowNoExpiry: true, valid: true},
+		{name: "expired with no expiry allowed", claims: map[string]any{"sub": "alice", "exp": now.Unix()}, allowNoExpiry: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			v := NewJWTValidator(JWTConfig{Keys: map[string]any{"": []byte("secret")}, AllowNoExpiry: tt.allowNoExpiry})
+			_, err := v.Verify(hsToken("secret", tt.claims), now)
+			if (err == nil) != tt.valid {
+				t.Errorf("verified: %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestJWKSFetchedWithoutLock(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requested, release := make(chan struct{}, 2), make(chan struct{})
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches.Add(1) > 1 {
+			requested <- struct{}{}
+			<-release
+		}
+		fmt.Fprintf(w, `{"keys":[{"kty":"OKP","crv":"Ed25519","kid":"a","x":%q}]}`, base64.RawURLEncoding.EncodeToString(pub))
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	now := time.Now()
+	v := NewJWTValidator(JWTConfig{JWKSURL: srv.URL, JWKSRefresh: time.Hour})
+	token := edToken(priv, "a", map[string]any{"sub": "alice", "exp": now.Add(3 * time.Hour).Unix()})
+	if _, err := v.Verify(token, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// the refresh of the stale key set hangs, and the known key is still
+	// verified meanwhile.
+	later := now.Add(2 * time.Hour)
+	go v.Verify(token, later)
+	<-requested
+	verified := make(chan error, 1)
+	go func() {
+		_, err := v.Verify(token, later)
+		verified <- err
+	}()
+	select {
+	case err := <-verified:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("verification blocked by the request of the key set")
+	}
+}
+
+func TestTokenNotLogged(t *testing.T) {
+	var log bytes.Buffer
+	logger := &logrus.Logger{Out: &log, Formatter: &logrus.TextFormatter{}, Level: logrus.DebugLevel}
+	s := NewServer(WithLogger(logger), WithJWT(NewJWTValidator(JWTConfig{Keys: map[string]any{"": []byte("secret")}})))
+	token := hsToken("other", map[string]any{"sub": "alice"})
+	conn := &bufConn{r: bytes.NewReader(request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, token))}
+	if _, _, err := s.establishProxy(&session{trace: context.Background()}, conn, time.Now(), 0); !errors.Is(err, ErrUserIdRejected) {
+		t.Fatalf("error %v, want the token rejected", err)
+	}
+	out := log.String()
+	if !strings.Contains(out, "read request from client") || strings.Contains(out, token[:8]) || strings.Contains(out, strings.Trim(fmt.Sprint([]byte(token[:8])), "[]")) {
+		t.Errorf("request logged with the token:\n%s", out)
+	}
+}
@@ -0,0 +1,181 @@
+package socks4
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// validLabelName matches the label names, which are usable as Prometheus
+// label names.
+var validLabelName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidLabelName reports whether name is a valid label name.
+func ValidLabelName(name string) bool {
+	return validLabelName.MatchString(name)
+}
+
+// labeledListener is a listener whose sessions carry labels.
+type labeledListener struct {
+	net.Listener
+	labels map[string]string
+}
+
+// LabelListener returns the listener with labels, e.g. env=prod, carried
+// by the sessions of the connections it accepts when served by the
+// server: they are shown in the sessions and events, added as fields to
+// the log entries of the sessions if the logger is a logrus one, and
+// counted in Stats.Labeled. The labels of the rules matching the requests
+// are added to them.
+func LabelListener(lis net.Listener, labels map[string]string) net.Listener {
+	if len(labels) == 0 {
+		return lis
+	}
+	return &labeledListener{Listener: lis, labels: labels}
+}
+
+// ServeConnWithLabels is like ServeConn for a connection whose session
+// carries labels, like those of LabelListener, e.g. the account of the
+// application it is served for. The names must be valid label names to be
+// exported as metrics.
+func (s *Server) ServeConnWithLabels(conn net.Conn, labels map[string]string) {
+	s.serveAccepted(conn, mergeLabels(nil, labels))
+}
+
+// listenerLabels returns the labels of the listener, nil if it has none.
+func listenerLabels(lis net.Listener) map[string]string {
+	if ll, ok := lis.(*labeledListener); ok {
+		return ll.labels
+	}
+	return nil
+}
+
+// mergeLabels returns the labels with those of more added, replacing
+// those of the same names.
+func mergeLabels(labels, more map[string]string) map[string]string {
+	if len(more) == 0 {
+		return labels
+	}
+	merged := make(map[string]string, len(labels)+len(more))
+	for k, v := range labels {
+		merged[k] = v
+	}
+	for k, v := range more {
+		merged[k] = v
+	}
+	return merged
+}
+
+// labelsKey returns a string identifying the label set.
+func labelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%v=%q,", k, labels[k])
+	}
+	return b.String()
+}
+
+// LabeledStats are the counters of the sessions with a label set.
+type LabeledStats struct {
+	Labels              map[string]string `json:"labels"`
+	Established         uint64            `json:"established"`
+	Failed              uint64            `json:"failed"`
+	ClientToRemoteBytes uint64            `json:"client_to_remote_bytes"`
+	RemoteToClientBytes uint64            `json:"remote_to_client_bytes"`
+}
+
+// labeledCounters are the counters of a label set.
+type labeledCounters struct {
+	labels         map[string]string
+	established    atomic.Uint64
+	failed         atomic.Uint64
+	clientToRemote atomic.Uint64
+	remoteToClient atomic.Uint64
+}
+
+// labeledStats holds the counters by label set.
+type labeledStats struct {
+	m sync.Map // labelsKey to *labeledCounters.
+}
+
+// counters returns the counters of the label set, nil if it is empty.
+func (ls *labeledStats) counters(labels map[string]string) *labeledCounters {
+	if len(labels) == 0 {
+		return nil
+	}
+	key := labelsKey(labels)
+	c, ok := ls.m.Load(key)
+	if !ok {
+		c, _ = ls.m.LoadOrStore(key, &labeledCounters{labels: labels})
+	}
+	return c.(*labeledCounters)
+}
+
+// snapshot returns the counters ordered by label set.
+func (ls *labeledStats) snapshot() []LabeledStats {
+	var keys []string
+	byKey := make(map[string]*labeledCounters)
+	ls.m.Range(func(k, v any) bool {
+		keys = append(keys, k.(string))
+		byKey[k.(string)] = v.(*labeledCounters)
+		return true
+	})
+	sort.Strings(keys)
+	list := make([]LabeledStats, len(keys))
+	for i, k := range keys {
+		c := byKey[k]
+		list[i] = LabeledStats{
+			Labels:              c.labels,
+			Established:         c.established.Load(),
+			Failed:              c.failed.Load(),
+			ClientToRemoteBytes: c.clientToRemote.Load(),
+			RemoteToClientBytes: c.remoteToClient.Load(),
+		}
+	}
+	return list
+}
+
+// sessionLogger returns the handshake logger of the session, with its
+// labels as fields if the logger of the server is a logrus one.
+func (s *Server) sessionLogger(ss *session) Logger {
+	labels := ss.getLabels()
+	if len(labels) == 0 {
+		return s.log(LogHandshake)
+	}
+	fields := make(logrus.Fields, len(labels))
+	for k, v := range labels {
+		fields[k] = v
+	}
+	return s.subsystemLogger(LogHandshake, withFields(s.logger, fields))
+}
+
+// withFields returns logger with the fields if it is a logrus one, or
+// logger itself otherwise.
+func withFields(logger Logger, fields logrus.Fields) Logger {
+	sl, sampled := logger.(*sampledLogger)
+	if sampled {
+		logger = sl.Logger
+	}
+	fl, ok := logger.(logrus.FieldLogger)
+	if !ok {
+		if sampled {
+			return sl
+		}
+		return logger
+	}
+	if sampled {
+		return sl.with(fl.WithFields(fields))
+	}
+	return fl.WithFields(fields)
+}
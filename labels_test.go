@@ -0,0 +1,261 @@
+package socks4
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestValidLabelName(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		valid bool
+	}{
+		{"team", true},
+		{"_team", true},
+		{"Team_2", true},
+		{"", false},
+		{"2team", false},
+		{"team-name", false},
+		{"team.name", false},
+		{"équipe", false},
+	} {
+		if valid := ValidLabelName(tt.name); valid != tt.valid {
+			t.Errorf("label name %q valid: %v, want %v", tt.name, valid, tt.valid)
+		}
+	}
+}
+
+func TestMergeLabels(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		labels map[string]string
+		more   map[string]string
+		merged map[string]string
+	}{
+		{name: "none"},
+		{name: "more only", more: map[string]string{"team": "web"}, merged: map[string]string{"team": "web"}},
+		{name: "labels only", labels: map[string]string{"env": "prod"}, merged: map[string]string{"env": "prod"}},
+		{name: "added", labels: map[string]string{"env": "prod"}, more: map[string]string{"team": "web"}, merged: map[string]string{"env": "prod", "team": "web"}},
+		{name: "replaced", labels: map[string]string{"env": "prod", "team": "db"}, more: map[string]string{"team": "web"}, merged: map[string]string{"env": "prod", "team": "web"}},
+	} {
+		var before map[string]string
+		if tt.labels != nil {
+			before = mergeLabels(nil, tt.labels)
+		}
+		if merged := mergeLabels(tt.labels, tt.more); !reflect.DeepEqual(merged, tt.merged) {
+			t.Errorf("%v: merged %v, want %v", tt.name, merged, tt.merged)
+		}
+		if !reflect.DeepEqual(tt.labels, before) {
+			t.Errorf("%v: labels changed to %v", tt.name, tt.labels)
+		}
+	}
+}
+
+func TestLabelsKey(t *testing.T) {
+	for _, tt := range []struct {
+		a, b  map[string]string
+		equal bool
+	}{
+		{map[string]string{"env": "prod", "team": "web"}, map[string]string{"team": "web", "env": "prod"}, true},
+		{map[string]string{"env": "prod"}, map[string]string{"env": "dev"}, false},
+		{map[string]string{"a": "1,b=2"}, map[string]string{"a": "1", "b": "2"}, false},
+		{map[string]string{"a": `"`}, map[string]string{"a": `\`}, false},
+	} {
+		if equal := labelsKey(tt.a) == labelsKey(tt.b); equal != tt.equal {
+			t.Errorf("keys of %v and %v equal: %v, want %v", tt.a, tt.b, equal, tt.equal)
+		}
+	}
+}
+
+func TestParseRuleLabels(t *testing.T) {
+	for _, tt := range []struct {
+		rule   string
+		labels map[string]string
+		ok     bool
+	}{
+		{rule: "allow label team=web", labels: map[string]string{"team": "web"}, ok: true},
+		{rule: "allow label team=web label env=prod", labels: map[string]string{"team": "web", "env": "prod"}, ok: true},
+		{rule: "allow label team=web label team=db", labels: map[string]string{"team": "db"}, ok: true},
+		{rule: "allow label team=", labels: map[string]string{"team": ""}, ok: true},
+		{rule: "allow label team"},
+		{rule: "allow label =web"},
+		{rule: "allow label team-name=web"},
+		{rule: "allow label"},
+	} {
+		rule, err := ParseRule(tt.rule)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: error %v, want parsed %v", tt.rule, err, tt.ok)
+			continue
+		}
+		if tt.ok && !reflect.DeepEqual(rule.Labels, tt.labels) {
+			t.Errorf("%q: labels %v, want %v", tt.rule, rule.Labels, tt.labels)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		listener map[string]string
+		rule     string
+		labels   map[string]string
+	}{
+		{name: "none", rule: "allow"},
+		{name: "listener", listener: map[string]string{"env": "prod"}, rule: "allow", labels: map[string]string{"env": "prod"}},
+		{name: "rule", rule: "allow label team=web", labels: map[string]string{"team": "web"}},
+		{name: "listener and rule", listener: map[string]string{"env": "prod"}, rule: "allow label team=web", labels: map[string]string{"env": "prod", "team": "web"}},
+		{name: "rule replacing the listener", listener: map[string]string{"env": "prod", "team": "db"}, rule: "allow label team=web", labels: map[string]string{"env": "prod", "team": "web"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			echo := echoTarget(t)
+			rules, err := ParseRules(strings.NewReader(tt.rule))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var log lockedBuffer
+			events := make(eventChan, 4)
+			logger := &logrus.Logger{Out: &log, Formatter: &logrus.JSONFormatter{}, Level: logrus.InfoLevel}
+			s := newTestServer(WithLogger(logger), WithRules(rules), WithEventNotifier(events))
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.Serve(LabelListener(lis, tt.listener))
+			}()
+			defer func() {
+				s.Close()
+				<-done
+			}()
+
+			conn, err := NewDialer(lis.Addr().String(), WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEcho(t, conn, []byte("hello"))
+			if sessions := s.Sessions(); len(sessions) != 1 || !reflect.DeepEqual(sessions[0].Labels, tt.labels) {
+				t.Errorf("sessions %+v, want the labels %v", sessions, tt.labels)
+			}
+			conn.Close()
+			echo.Close()
+
+			for _, want := range []string{EventEstablished, EventClosed} {
+				select {
+				case ev := <-events:
+					if ev.Type != want || !reflect.DeepEqual(ev.Session.Labels, tt.labels) {
+						t.Errorf("event %v with the labels %v, want %v with %v", ev.Type, ev.Session.Labels, want, tt.labels)
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("%v event not notified", want)
+				}
+			}
+
+			// the counters are added once the relay ended.
+			var labeled []LabeledStats
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				labeled = s.Stats().Labeled
+				if len(labeled) == 0 || labeled[0].RemoteToClientBytes > 0 {
+					break
+				}
+			}
+			if tt.labels == nil {
+				if len(labeled) != 0 {
+					t.Errorf("labeled stats %+v, want none", labeled)
+				}
+			} else if len(labeled) != 1 || !reflect.DeepEqual(labeled[0], LabeledStats{Labels: tt.labels, Established: 1, ClientToRemoteBytes: 5, RemoteToClientBytes: 5}) {
+				t.Errorf("labeled stats %+v, want an established session of 5 bytes each way with the labels %v", labeled, tt.labels)
+			}
+
+			// the log entry of the established session has the labels as
+			// fields.
+			var entry string
+			for _, line := range strings.Split(log.String(), "\n") {
+				if strings.Contains(line, "established by") {
+					entry = line
+				}
+			}
+			if entry == "" {
+				t.Fatalf("established session not logged: %q", log.String())
+			}
+			for k, v := range tt.labels {
+				if !strings.Contains(entry, `"`+k+`":"`+v+`"`) {
+					t.Errorf("log entry %q without the label %v=%v", entry, k, v)
+				}
+			}
+		})
+	}
+}
+
+func TestServeConnWithLabels(t *testing.T) {
+	echo := echoTarget(t)
+	for _, tt := range []struct {
+		name   string
+		labels map[string]string
+	}{
+		{name: "none"},
+		{name: "empty", labels: map[string]string{}},
+		{name: "account", labels: map[string]string{"account": "acme"}},
+		{name: "several", labels: map[string]string{"account": "acme", "plan": "pro"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer()
+			defer s.Close()
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lis.Close()
+			labels := mergeLabels(nil, tt.labels)
+			go func() {
+				if conn, err := lis.Accept(); err == nil {
+					s.ServeConnWithLabels(conn, labels)
+				}
+			}()
+			conn, err := NewDialer(lis.Addr().String(), WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			assertEcho(t, conn, []byte("hello"))
+			want := mergeLabels(nil, tt.labels)
+			if sessions := s.Sessions(); len(sessions) != 1 || !reflect.DeepEqual(sessions[0].Labels, want) {
+				t.Errorf("sessions %+v, want the labels %v", sessions, want)
+			}
+			// the session has its own copy of the labels.
+			if labels != nil {
+				labels["account"] = "other"
+				if sessions := s.Sessions(); len(sessions) != 1 || !reflect.DeepEqual(sessions[0].Labels, want) {
+					t.Errorf("sessions %+v changed by the labels of the caller", sessions)
+				}
+			}
+		})
+	}
+}
+
+func TestLabeledStats(t *testing.T) {
+	var ls labeledStats
+	if c := ls.counters(nil); c != nil {
+		t.Fatal("counters of the empty label set")
+	}
+	a := ls.counters(map[string]string{"team": "web", "env": "prod"})
+	b := ls.counters(map[string]string{"env": "prod", "team": "web"})
+	if a != b {
+		t.Fatal("counters of the same label set differ")
+	}
+	a.failed.Add(1)
+	ls.counters(map[string]string{"team": "db"}).established.Add(2)
+	want := []LabeledStats{
+		{Labels: map[string]string{"env": "prod", "team": "web"}, Failed: 1},
+		{Labels: map[string]string{"team": "db"}, Established: 2},
+	}
+	if list := ls.snapshot(); !reflect.DeepEqual(list, want) {
+		t.Errorf("snapshot %+v, want %+v", list, want)
+	}
+}
@@ -0,0 +1,96 @@
+package socks4
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds of the buckets of the latency
+// histograms, unless set by WithLatencyBuckets.
+var DefaultLatencyBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond,
+	25 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond,
+	250 * time.Millisecond, 500 * time.Millisecond, time.Second,
+	2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// WithLatencyBuckets sets the upper bounds of the buckets of the latency
+// histograms of Stats, DefaultLatencyBuckets by default.
+func WithLatencyBuckets(buckets ...time.Duration) OptionFunc {
+	return func(s *Server) {
+		s.latencyBuckets = buckets
+	}
+}
+
+// Histogram is a histogram of durations.
+type Histogram struct {
+	// Buckets are the upper bounds of the buckets, ascending.
+	Buckets []time.Duration `json:"buckets"`
+	// Counts are the numbers of observations of each bucket, not
+	// cumulative, followed by the number of those above the last bound.
+	Counts []uint64      `json:"counts"`
+	Count  uint64        `json:"count"`
+	Sum    time.Duration `json:"sum"`
+}
+
+// Add adds the observations of o to h, and reports whether it could: they
+// must have the same buckets, unless h is empty.
+func (h *Histogram) Add(o Histogram) bool {
+	if h.Counts == nil {
+		h.Buckets = o.Buckets
+		h.Counts = make([]uint64, len(o.Counts))
+	}
+	if len(h.Buckets) != len(o.Buckets) || len(h.Counts) != len(o.Counts) {
+		return false
+	}
+	for i := range h.Buckets {
+		if h.Buckets[i] != o.Buckets[i] {
+			return false
+		}
+	}
+	for i := range h.Counts {
+		h.Counts[i] += o.Counts[i]
+	}
+	h.Count += o.Count
+	h.Sum += o.Sum
+	return true
+}
+
+// histogram records the observations of a Histogram.
+type histogram struct {
+	bounds []time.Duration
+	counts []atomic.Uint64 // one more than bounds.
+	sum    atomic.Int64
+}
+
+func newHistogram(bounds []time.Duration) *histogram {
+	bounds = append([]time.Duration(nil), bounds...)
+	sort.Slice(bounds, func(i, j int) bool { return bounds[i] < bounds[j] })
+	return &histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+	h.counts[i].Add(1)
+	h.sum.Add(int64(d))
+}
+
+func (h *histogram) snapshot() Histogram {
+	snap := Histogram{
+		Buckets: h.bounds,
+		Counts:  make([]uint64, len(h.counts)),
+		Sum:     time.Duration(h.sum.Load()),
+	}
+	for i := range h.counts {
+		snap.Counts[i] = h.counts[i].Load()
+		snap.Count += snap.Counts[i]
+	}
+	return snap
+}
+
+// requestRead counts a request read from a client accepted at start.
+func (s *Server) requestRead(req Request, start time.Time) {
+	s.stats.countProtocol(req)
+	s.stats.handshake.observe(s.clock.Now().Sub(start))
+}
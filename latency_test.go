@@ -0,0 +1,127 @@
+package socks4
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	ms := time.Millisecond
+	for _, tt := range []struct {
+		name         string
+		bounds       []time.Duration
+		observations []time.Duration
+		snapshot     Histogram
+	}{
+		{
+			name:     "empty",
+			bounds:   []time.Duration{ms, 10 * ms},
+			snapshot: Histogram{Buckets: []time.Duration{ms, 10 * ms}, Counts: []uint64{0, 0, 0}},
+		},
+		{
+			name:         "bounds inclusive",
+			bounds:       []time.Duration{ms, 10 * ms},
+			observations: []time.Duration{0, ms, ms + 1, 10 * ms, 10*ms + 1, time.Hour},
+			snapshot:     Histogram{Buckets: []time.Duration{ms, 10 * ms}, Counts: []uint64{2, 2, 2}, Count: 6, Sum: 22*ms + 2 + time.Hour},
+		},
+		{
+			name:         "unsorted bounds",
+			bounds:       []time.Duration{10 * ms, ms},
+			observations: []time.Duration{5 * ms},
+			snapshot:     Histogram{Buckets: []time.Duration{ms, 10 * ms}, Counts: []uint64{0, 1, 0}, Count: 1, Sum: 5 * ms},
+		},
+		{
+			name:         "no bounds",
+			observations: []time.Duration{ms, 2 * ms},
+			snapshot:     Histogram{Counts: []uint64{2}, Count: 2, Sum: 3 * ms},
+		},
+	} {
+		h := newHistogram(tt.bounds)
+		for _, d := range tt.observations {
+			h.observe(d)
+		}
+		if snap := h.snapshot(); !reflect.DeepEqual(snap, tt.snapshot) {
+			t.Errorf("%v: snapshot %+v, want %+v", tt.name, snap, tt.snapshot)
+		}
+	}
+}
+
+func TestHistogramAdd(t *testing.T) {
+	ms := time.Millisecond
+	a := Histogram{Buckets: []time.Duration{ms, 10 * ms}, Counts: []uint64{1, 2, 3}, Count: 6, Sum: time.Second}
+	for _, tt := range []struct {
+		name  string
+		h, o  Histogram
+		ok    bool
+		added Histogram
+	}{
+		{name: "to empty", o: a, ok: true, added: a},
+		{
+			name:  "same buckets",
+			h:     a,
+			o:     Histogram{Buckets: []time.Duration{ms, 10 * ms}, Counts: []uint64{1, 0, 0}, Count: 1, Sum: ms},
+			ok:    true,
+			added: Histogram{Buckets: []time.Duration{ms, 10 * ms}, Counts: []uint64{2, 2, 3}, Count: 7, Sum: time.Second + ms},
+		},
+		{name: "other bounds", h: a, o: Histogram{Buckets: []time.Duration{ms, 5 * ms}, Counts: []uint64{1, 0, 0}, Count: 1}, added: a},
+		{name: "other buckets", h: a, o: Histogram{Buckets: []time.Duration{ms}, Counts: []uint64{1, 0}, Count: 1}, added: a},
+	} {
+		// the counts of a are not shared.
+		if tt.h.Counts != nil {
+			tt.h.Counts = append([]uint64(nil), tt.h.Counts...)
+		}
+		h := tt.h
+		if ok := h.Add(tt.o); ok != tt.ok || !reflect.DeepEqual(h, tt.added) {
+			t.Errorf("%v: added %+v (%v), want %+v (%v)", tt.name, h, ok, tt.added, tt.ok)
+		}
+	}
+	if !reflect.DeepEqual(a.Counts, []uint64{1, 2, 3}) {
+		t.Errorf("added histogram changed to %+v", a)
+	}
+}
+
+func TestLatencyHistograms(t *testing.T) {
+	buckets := []time.Duration{time.Minute, time.Hour}
+	for _, tt := range []struct {
+		name    string
+		opts    []OptionFunc
+		buckets []time.Duration
+		first   bool // the observations are in the first bucket.
+	}{
+		{name: "default buckets", buckets: DefaultLatencyBuckets},
+		{name: "set buckets", opts: []OptionFunc{WithLatencyBuckets(buckets...)}, buckets: buckets, first: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			echo := echoTarget(t)
+			s, addr := serve(t, tt.opts...)
+			conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// the handshake of the failed dials is observed, not the dial.
+			if _, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", "127.0.0.1:1"); err == nil {
+				t.Fatal("dial to a closed port succeeded")
+			}
+			var st Stats
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				if st = s.Stats(); st.HandshakeLatency.Count == 2 && st.DialLatency.Count == 1 {
+					break
+				}
+			}
+			for _, l := range []struct {
+				name  string
+				h     Histogram
+				count uint64
+			}{
+				{"handshake", st.HandshakeLatency, 2},
+				{"dial", st.DialLatency, 1},
+			} {
+				if !reflect.DeepEqual(l.h.Buckets, tt.buckets) || len(l.h.Counts) != len(tt.buckets)+1 || l.h.Count != l.count || tt.first && l.h.Counts[0] != l.count || l.h.Sum <= 0 {
+					t.Errorf("%v latency %+v, want %v observations in the buckets %v", l.name, l.h, l.count, tt.buckets)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,406 @@
+package socks4
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// LDAPConfig is the configuration of LDAPGroups.
+type LDAPConfig struct {
+	// URL is the server, like ldap://ldap.example.com or
+	// ldaps://ad.example.com:636.
+	URL          string
+	TLSConfig    *tls.Config // TLS configuration of ldaps://, the default one if nil.
+	BindDN       string      // DN the searches are made as, anonymous if empty.
+	BindPassword string
+	BaseDN       string // DN under which the users are searched.
+	// UserAttribute is the attribute holding the user ids, "uid" if empty,
+	// like "sAMAccountName" for Active Directory.
+	UserAttribute string
+	// GroupAttribute is the attribute of the users listing their groups,
+	// "memberOf" if empty.
+	GroupAttribute string
+	Timeout        time.Duration // timeout of a lookup, 10s if 0.
+}
+
+// LDAPGroups is a GroupResolver looking up the groups of the users in an
+// LDAP directory, like Active Directory: the entry of a user is searched
+// under the base DN by its user attribute, and its groups are the values of
+// its group attribute, the distinguished names of the groups for memberOf.
+type LDAPGroups struct {
+	config LDAPConfig
+	dialer net.Dialer
+}
+
+// NewLDAPGroups creates a resolver of the groups of an LDAP directory.
+func NewLDAPGroups(config LDAPConfig) (*LDAPGroups, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("invalid LDAP URL %q", config.URL)
+	}
+	if config.UserAttribute == "" {
+		config.UserAttribute = "uid"
+	}
+	if config.GroupAttribute == "" {
+		config.GroupAttribute = "memberOf"
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	return &LDAPGroups{config: config}, nil
+}
+
+// UserGroups returns the groups of the user, or ErrUnknownUser if its entry
+// is not found.
+func (l *LDAPGroups) UserGroups(ctx context.Context, userId string) ([]string, error) {
+	if userId == "" {
+		return nil, ErrUnknownUser
+	}
+	ctx, cancel := context.WithTimeout(ctx, l.config.Timeout)
+	defer cancel()
+	conn, err := l.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c := &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+	if l.config.BindDN != "" {
+		if err := c.bind(l.config.BindDN, l.config.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+	entries, err := c.search(l.config.BaseDN, l.config.UserAttribute, userId, l.config.GroupAttribute)
+	if err != nil {
+		return nil, err
+	}
+	c.unbind()
+	switch len(entries) {
+	case 0:
+		return nil, ErrUnknownUser
+	case 1:
+		return entries[0], nil
+	}
+	return nil, fmt.Errorf("%v entries of user %q", len(entries), userId)
+}
+
+func (l *LDAPGroups) dial(ctx context.Context) (net.Conn, error) {
+	u, _ := url.Parse(l.config.URL)
+	host := u.Host
+	if u.Port() == "" {
+		port := "389"
+		if u.Scheme == "ldaps" {
+			port = "636"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.Scheme == "ldap" {
+		return l.dialer.DialContext(ctx, "tcp", host)
+	}
+	config := l.config.TLSConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = u.Hostname()
+	}
+	td := tls.Dialer{NetDialer: &l.dialer, Config: config}
+	return td.DialContext(ctx, "tcp", host)
+}
+
+// The BER tags of the LDAP messages (RFC 4511).
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berBoolean     = 0x01
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+
+	ldapBindRequest       = 0x60
+	ldapBindResponse      = 0x61
+	ldapUnbindRequest     = 0x42
+	ldapSearchRequest     = 0x63
+	ldapSearchEntry       = 0x64
+	ldapSearchDone        = 0x65
+	ldapSearchReference   = 0x73
+	ldapSimpleAuth        = 0x80
+	ldapEqualityMatch     = 0xa3
+	ldapScopeSubtree      = 2
+	ldapNeverDerefAliases = 0
+	ldapSuccess           = 0
+)
+
+// maxLDAPMessage is the max size of an LDAP message read.
+const maxLDAPMessage = 1 << 20
+
+// ldapConn is a connection to an LDAP server.
+type ldapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	id   int
+}
+
+// bind authenticates the connection by the password of the DN.
+func (c *ldapConn) bind(dn, password string) error {
+	err := c.send(ber(ldapBindRequest,
+		berInt(berInteger, 3),
+		ber(berOctetString, []byte(dn)),
+		ber(ldapSimpleAuth, []byte(password))))
+	if err != nil {
+		return err
+	}
+	tag, op, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if tag != ldapBindResponse {
+		return fmt.Errorf("unexpected LDAP response %#x to bind", tag)
+	}
+	if err := ldapResult(op); err != nil {
+		return fmt.Errorf("LDAP bind: %v", err)
+	}
+	return nil
+}
+
+// search returns the values of the attribute of the entries under base
+// whose filter attribute equals value.
+func (c *ldapConn) search(base, filter, value, attr string) ([][]string, error) {
+	err := c.send(ber(ldapSearchRequest,
+		ber(berOctetString, []byte(base)),
+		berInt(berEnumerated, ldapScopeSubtree),
+		berInt(berEnumerated, ldapNeverDerefAliases),
+		berInt(berInteger, 2),
+		berInt(berInteger, 0),
+		ber(berBoolean, []byte{0}),
+		ber(ldapEqualityMatch,
+			ber(berOctetString, []byte(filter)),
+			ber(berOctetString, []byte(value))),
+		ber(berSequence, ber(berOctetString, []byte(attr)))))
+	if err != nil {
+		return nil, err
+	}
+	var entries [][]string
+	for {
+		tag, op, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch tag {
+		case ldapSearchEntry:
+			values, err := entryValues(op, attr)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, values)
+		case ldapSearchReference:
+		case ldapSearchDone:
+			if err := ldapResult(op); err != nil {
+				return nil, fmt.Errorf("LDAP search: %v", err)
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("unexpected LDAP response %#x to search", tag)
+		}
+	}
+}
+
+// unbind ends the session, without waiting for the server.
+func (c *ldapConn) unbind() {
+	c.send([]byte{ldapUnbindRequest, 0})
+}
+
+// send sends the operation in a message.
+func (c *ldapConn) send(op []byte) error {
+	c.id++
+	_, err := c.conn.Write(ber(berSequence, berInt(berInteger, c.id), op))
+	return err
+}
+
+// receive returns the tag and the content of the operation of the next
+// message, which must be a response to the last one sent.
+func (c *ldapConn) receive() (byte, []byte, error) {
+	tag, msg, err := readBER(c.r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("LDAP response: %v", err)
+	}
+	if tag != berSequence {
+		return 0, nil, fmt.Errorf("invalid LDAP message %#x", tag)
+	}
+	tag, id, msg, err := parseBER(msg)
+	if err != nil || tag != berInteger {
+		return 0, nil, errors.New("invalid LDAP message ID")
+	}
+	if berIntValue(id) != c.id {
+		return 0, nil, fmt.Errorf("unexpected LDAP message ID %v", berIntValue(id))
+	}
+	tag, op, _, err := parseBER(msg)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid LDAP message: %v", err)
+	}
+	return tag, op, nil
+}
+
+// ldapResult returns the error of an LDAPResult, nil for success.
+func ldapResult(op []byte) error {
+	tag, code, rest, err := parseBER(op)
+	if err != nil || tag != berEnumerated {
+		return errors.New("invalid LDAP result")
+	}
+	if berIntValue(code) == ldapSuccess {
+		return nil
+	}
+	// the matched DN, then the diagnostic message.
+	_, _, rest, _ = parseBER(rest)
+	_, msg, _, _ := parseBER(rest)
+	return fmt.Errorf("result code %v: %s", berIntValue(code), msg)
+}
+
+// entryValues returns the values of the attribute of a SearchResultEntry.
+func entryValues(op []byte, attr string) ([]string, error) {
+	_, _, rest, err := parseBER(op) // the DN of the entry.
+	if err != nil {
+		return nil, errors.New("invalid LDAP entry")
+	}
+	_, attrs, _, err := parseBER(rest)
+	if err != nil {
+		return nil, errors.New("invalid LDAP entry")
+	}
+	var values []string
+	for len(attrs) > 0 {
+		var a []byte
+		if _, a, attrs, err = parseBER(attrs); err != nil {
+			return nil, errors.New("invalid LDAP attribute")
+		}
+		_, name, set, err := parseBER(a)
+		if err != nil {
+			return nil, errors.New("invalid LDAP attribute")
+		}
+		if _, set, _, err = parseBER(set); err != nil {
+			return nil, errors.New("invalid LDAP attribute")
+		}
+		if !strings.EqualFold(string(name), attr) {
+			continue
+		}
+		for len(set) > 0 {
+			var v []byte
+			if _, v, set, err = parseBER(set); err != nil {
+				return nil, errors.New("invalid LDAP attribute value")
+			}
+			values = append(values, string(v))
+		}
+	}
+	return values, nil
+}
+
+// ber encodes the TLV of the tag with the contents.
+func ber(tag byte, contents ...[]byte) []byte {
+	n := 0
+	for _, c := range contents {
+		n += len(c)
+	}
+	b := []byte{tag}
+	switch {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n < 0x100:
+		b = append(b, 0x81, byte(n))
+	case n < 0x10000:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// berInt encodes a non-negative integer.
+func berInt(tag byte, v int) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return ber(tag, b)
+}
+
+func berIntValue(b []byte) int {
+	v := 0
+	for _, c := range b {
+		v = v<<8 | int(c)
+	}
+	return v
+}
+
+// readBER reads a TLV.
+func readBER(r *bufio.Reader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	l, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n := int(l)
+	if l&0x80 != 0 {
+		size := int(l & 0x7f)
+		if size == 0 || size > 4 {
+			return 0, nil, errors.New("invalid BER length")
+		}
+		n = 0
+		for i := 0; i < size; i++ {
+			c, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			n = n<<8 | int(c)
+		}
+	}
+	if n < 0 || n > maxLDAPMessage {
+		return 0, nil, fmt.Errorf("LDAP message of %v bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	return tag, b, nil
+}
+
+// parseBER returns the tag and the contents of the first TLV of b, and
+// the bytes after it.
+func parseBER(b []byte) (tag byte, contents, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	tag, n, b := b[0], int(b[1]), b[2:]
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 || len(b) < size {
+			return 0, nil, nil, errors.New("invalid BER length")
+		}
+		n = 0
+		for _, c := range b[:size] {
+			n = n<<8 | int(c)
+		}
+		b = b[size:]
+	}
+	if n < 0 || n > len(b) {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	return tag, b[:n], b[n:], nil
+}
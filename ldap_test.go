@@ -0,0 +1,226 @@
+package socks4
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseBER(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		in       []byte
+		tag      byte
+		contents []byte
+		rest     []byte
+		err      bool
+	}{
+		{name: "short form", in: []byte{berOctetString, 2, 'a', 'b', 'c'}, tag: berOctetString, contents: []byte("ab"), rest: []byte("c")},
+		{name: "long form", in: append([]byte{berOctetString, 0x81, 0x80}, make([]byte, 0x80)...), tag: berOctetString, contents: make([]byte, 0x80), rest: []byte{}},
+		{name: "empty", in: []byte{berSequence, 0}, tag: berSequence, contents: []byte{}, rest: []byte{}},
+		{name: "no length", in: []byte{berOctetString}, err: true},
+		{name: "truncated contents", in: []byte{berOctetString, 3, 'a', 'b'}, err: true},
+		{name: "truncated length", in: []byte{berOctetString, 0x82, 0x01}, err: true},
+		{name: "indefinite length", in: []byte{berOctetString, 0x80, 'a', 0, 0}, err: true},
+		{name: "length of 5 bytes", in: []byte{berOctetString, 0x85, 0, 0, 0, 0, 1, 'a'}, err: true},
+		{name: "length beyond the contents", in: []byte{berOctetString, 0x84, 0x7f, 0xff, 0xff, 0xff, 'a'}, err: true},
+		{name: "max length", in: []byte{berOctetString, 0x84, 0xff, 0xff, 0xff, 0xff, 'a'}, err: true},
+	} {
+		tag, contents, rest, err := parseBER(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("%v: error %v, want %v", tt.name, err, tt.err)
+			continue
+		}
+		if !tt.err && (tag != tt.tag || !bytes.Equal(contents, tt.contents) || !bytes.Equal(rest, tt.rest)) {
+			t.Errorf("%v: parsed %#x %q %q, want %#x %q %q", tt.name, tag, contents, rest, tt.tag, tt.contents, tt.rest)
+		}
+	}
+}
+
+func TestReadBER(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		in       []byte
+		contents []byte
+		err      bool
+	}{
+		{name: "short form", in: []byte{berSequence, 1, 'a'}, contents: []byte("a")},
+		{name: "long form", in: []byte{berSequence, 0x82, 0, 1, 'a'}, contents: []byte("a")},
+		{name: "empty", in: nil, err: true},
+		{name: "no length", in: []byte{berSequence}, err: true},
+		{name: "truncated length", in: []byte{berSequence, 0x84, 0, 0}, err: true},
+		{name: "truncated contents", in: []byte{berSequence, 2, 'a'}, err: true},
+		{name: "indefinite length", in: []byte{berSequence, 0x80}, err: true},
+		{name: "length of 5 bytes", in: []byte{berSequence, 0x85, 0, 0, 0, 0, 1}, err: true},
+		{name: "beyond the max message", in: []byte{berSequence, 0x83, 0x10, 0, 1}, err: true},
+		{name: "max length", in: []byte{berSequence, 0x84, 0xff, 0xff, 0xff, 0xff}, err: true},
+	} {
+		_, contents, err := readBER(bufio.NewReader(bytes.NewReader(tt.in)))
+		if (err != nil) != tt.err || !tt.err && !bytes.Equal(contents, tt.contents) {
+			t.Errorf("%v: read %q with error %v, want %q and error %v", tt.name, contents, err, tt.contents, tt.err)
+		}
+	}
+}
+
+func TestBERInt(t *testing.T) {
+	for _, v := range []int{0, 1, 0x7f, 0x80, 0xff, 0x100, 0x12345678} {
+		tag, contents, rest, err := parseBER(berInt(berInteger, v))
+		if err != nil || tag != berInteger || len(rest) != 0 || berIntValue(contents) != v || contents[0]&0x80 != 0 {
+			t.Errorf("%v encoded as %#x %x: %v", v, tag, contents, err)
+		}
+	}
+}
+
+// fakeLDAP serves the groups of the users as their memberOf attribute, to
+// the clients bound with the password "secret" or anonymous.
+func fakeLDAP(t *testing.T, users map[string][]string) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go serveLDAP(conn, users)
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func serveLDAP(conn net.Conn, users map[string][]string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(id []byte, ops ...[]byte) {
+		for _, op := range ops {
+			conn.Write(ber(berSequence, ber(berInteger, id), op))
+		}
+	}
+	result := func(tag byte, code int) []byte {
+		return ber(tag, berInt(berEnumerated, code), ber(berOctetString), ber(berOctetString))
+	}
+	for {
+		_, msg, err := readBER(r)
+		if err != nil {
+			return
+		}
+		_, id, msg, _ := parseBER(msg)
+		tag, op, _, _ := parseBER(msg)
+		switch tag {
+		case ldapBindRequest:
+			_, _, rest, _ := parseBER(op) // version
+			_, _, rest, _ = parseBER(rest)
+			_, password, _, _ := parseBER(rest)
+			code := ldapSuccess
+			if string(password) != "secret" {
+				code = 49 // invalidCredentials
+			}
+			reply(id, result(ldapBindResponse, code))
+		case ldapSearchRequest:
+			// the base, scope, deref, size and time limits and types only,
+			// then the equality filter.
+			rest := op
+			for i := 0; i < 6; i++ {
+				_, _, rest, _ = parseBER(rest)
+			}
+			_, filter, _, _ := parseBER(rest)
+			_, _, value, _ := parseBER(filter)
+			_, user, _, _ := parseBER(value)
+			var ops [][]byte
+			if groups, ok := users[string(user)]; ok {
+				var values [][]byte
+				for _, g := range groups {
+					values = append(values, ber(berOctetString, []byte(g)))
+				}
+				attr := ber(berSequence, ber(berOctetString, []byte("memberOf")), ber(0x31, values...))
+				ops = append(ops, ber(ldapSearchEntry, ber(berOctetString, []byte("uid="+string(user))), ber(berSequence, attr)))
+			}
+			reply(id, append(ops, result(ldapSearchDone, ldapSuccess))...)
+		default:
+			return
+		}
+	}
+}
+
+func TestLDAPGroups(t *testing.T) {
+	addr := fakeLDAP(t, map[string][]string{
+		"alice": {"CN=net-admins,OU=Groups,DC=example,DC=com", "CN=staff,OU=Groups,DC=example,DC=com"},
+		"bob":   nil,
+	})
+	for _, tt := range []struct {
+		name     string
+		bindDN   string
+		password string
+		user     string
+		groups   []string
+		err      error // nil for any error if errs.
+		errs     bool
+	}{
+		{name: "anonymous", user: "alice", groups: []string{"CN=net-admins,OU=Groups,DC=example,DC=com", "CN=staff,OU=Groups,DC=example,DC=com"}},
+		{name: "bound", bindDN: "CN=socks4", password: "secret", user: "alice", groups: []string{"CN=net-admins,OU=Groups,DC=example,DC=com", "CN=staff,OU=Groups,DC=example,DC=com"}},
+		{name: "no groups", user: "bob"},
+		{name: "unknown user", user: "carol", err: ErrUnknownUser, errs: true},
+		{name: "empty user id", user: "", err: ErrUnknownUser, errs: true},
+		{name: "wrong bind password", bindDN: "CN=socks4", password: "wrong", user: "alice", errs: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := NewLDAPGroups(LDAPConfig{URL: "ldap://" + addr, BindDN: tt.bindDN, BindPassword: tt.password, BaseDN: "DC=example,DC=com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			groups, err := l.UserGroups(context.Background(), tt.user)
+			if (err != nil) != tt.errs || tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(groups, tt.groups) {
+				t.Errorf("groups %q, want %q", groups, tt.groups)
+			}
+		})
+	}
+}
+
+func TestLDAPInvalidResponse(t *testing.T) {
+	for _, resp := range [][]byte{
+		{berSequence, 0x84, 0xff, 0xff, 0xff, 0xff},
+		{berSequence, 3, berInteger, 1, 1},
+		{berOctetString, 0},
+	} {
+		server, client := net.Pipe()
+		go func() {
+			readBER(bufio.NewReader(server))
+			server.Write(resp)
+			server.Close()
+		}()
+		c := &ldapConn{conn: client, r: bufio.NewReader(client)}
+		if err := c.bind("CN=socks4", "secret"); err == nil || !strings.Contains(err.Error(), "LDAP") {
+			t.Errorf("response %x: error %v, want an invalid LDAP response", resp, err)
+		}
+		client.Close()
+	}
+}
+
+func TestNewLDAPGroups(t *testing.T) {
+	for _, tt := range []struct {
+		url string
+		ok  bool
+	}{
+		{"ldap://ldap.example.com", true},
+		{"ldaps://ad.example.com:636", true},
+		{"http://ldap.example.com", false},
+		{"ldap://", false},
+		{"ldap.example.com", false},
+	} {
+		if _, err := NewLDAPGroups(LDAPConfig{URL: tt.url}); (err == nil) != tt.ok {
+			t.Errorf("URL %q: error %v, want valid %v", tt.url, err, tt.ok)
+		}
+	}
+}
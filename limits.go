@@ -0,0 +1,252 @@
+package socks4
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// WithMaxConns limits the number of concurrent client connections. New
+// connections beyond the limit are closed right after being accepted.
+func WithMaxConns(n int) OptionFunc {
+	return func(s *Server) {
+		s.config().MaxConns = n
+	}
+}
+
+// WithMaxConnsPerClient limits the number of concurrent connections from
+// the same client IP.
+func WithMaxConnsPerClient(n int) OptionFunc {
+	return func(s *Server) {
+		s.config().MaxConnsPerClient = n
+	}
+}
+
+// WithRateLimit limits the number of new connections from the same client
+// IP within each window, counted in the store of the server (see
+// WithStore) so that a shared store applies the limit across instances.
+func WithRateLimit(n int, window time.Duration) OptionFunc {
+	return func(s *Server) {
+		s.config().RateLimit = n
+		s.config().RateWindow = window
+	}
+}
+
+// WithMaxDialsPerDestination limits the number of concurrent dials to the
+// same destination of CONNECT requests, so that many clients connecting to
+// a dead host do not all wait for the dial timeout. Requests beyond the
+// limit fail right away.
+func WithMaxDialsPerDestination(n int) OptionFunc {
+	return func(s *Server) {
+		s.config().MaxDialsPerDestination = n
+	}
+}
+
+// WithHandshakeLimits limits the connections still in their handshake,
+// i.e. not yet relaying, apart from the established ones, so that a flood
+// of handshakes does not take the capacity of the real traffic. Beyond
+// soft, the handshake timeout of the new connections is cut down to
+// softTimeout; beyond hard, they are closed right after being accepted.
+// Zero disables a limit.
+func WithHandshakeLimits(soft, hard int, softTimeout time.Duration) OptionFunc {
+	return func(s *Server) {
+		s.config().SoftMaxHandshakes = soft
+		s.config().MaxHandshakes = hard
+		s.config().SoftHandshakeTimeout = softTimeout
+	}
+}
+
+// WithMaxRelays limits the number of concurrent relays, counting the
+// requests being dialed. Requests beyond the limit are rejected before
+// their dials.
+func WithMaxRelays(n int) OptionFunc {
+	return func(s *Server) {
+		s.config().MaxRelays = n
+	}
+}
+
+// errTooManyRelays is the error of the requests beyond the limit of
+// relays.
+var errTooManyRelays = errors.New("too many relays")
+
+// handshakeTimeout returns the handshake timeout of a new connection, cut
+// down beyond the soft limit of handshakes.
+func (s *Server) handshakeTimeout() time.Duration {
+	c := s.config()
+	timeout := c.HandshakeTimeout
+	if c.SoftMaxHandshakes > 0 && c.SoftHandshakeTimeout > 0 && s.handshakes.Load() > int64(c.SoftMaxHandshakes) &&
+		(timeout == 0 || c.SoftHandshakeTimeout < timeout) {
+		timeout = c.SoftHandshakeTimeout
+	}
+	return timeout
+}
+
+// acquireRelay reserves a relay for the session, once whatever its
+// requests, and reports whether it is within the limit. The relay is
+// released by releaseRelay at the end of the session.
+func (s *Server) acquireRelay(ss *session) bool {
+	if ss.relay {
+		return true
+	}
+	n := s.relays.Add(1)
+	if max := s.config().MaxRelays; max > 0 && n > int64(max) {
+		s.relays.Add(-1)
+		return false
+	}
+	ss.relay = true
+	return true
+}
+
+// releaseRelay releases the relay reserved by the session, if any.
+func (s *Server) releaseRelay(ss *session) {
+	if ss.relay {
+		ss.relay = false
+		s.relays.Add(-1)
+	}
+}
+
+// errTooManyDials is the error of the requests beyond the limit of dials
+// to their destination.
+var errTooManyDials = errors.New("too many dials in flight to the destination")
+
+// dialCounter counts the dials in flight by destination, whatever the
+// limit, which may change while they are.
+type dialCounter struct {
+	mu       sync.Mutex
+	inflight map[string]int
+}
+
+// acquire counts a dial to addr and reports whether it is within the
+// limit of max dials, 0 for no limit.
+func (c *dialCounter) acquire(addr string, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max > 0 && c.inflight[addr] >= max {
+		return false
+	}
+	if c.inflight == nil {
+		c.inflight = make(map[string]int)
+	}
+	c.inflight[addr]++
+	return true
+}
+
+// release uncounts a dial acquired to addr.
+func (c *dialCounter) release(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inflight[addr]--; c.inflight[addr] <= 0 {
+		delete(c.inflight, addr)
+	}
+}
+
+// connCounter counts the active client connections, in total and per
+// client IP, whatever the limits, which may change while they are served.
+type connCounter struct {
+	mu       sync.Mutex
+	total    int
+	byClient map[string]int
+}
+
+// acquire counts a connection from ip and reports whether it is within
+// the limits of max connections and maxPerClient from ip, 0 for no limit.
+func (c *connCounter) acquire(ip string, max, maxPerClient int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if max > 0 && c.total >= max {
+		return false
+	}
+	if maxPerClient > 0 && c.byClient[ip] >= maxPerClient {
+		return false
+	}
+	if c.byClient == nil {
+		c.byClient = make(map[string]int)
+	}
+	c.byClient[ip]++
+	c.total++
+	return true
+}
+
+// release uncounts a connection acquired from ip.
+func (c *connCounter) release(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.total--
+	if c.byClient[ip]--; c.byClient[ip] <= 0 {
+		delete(c.byClient, ip)
+	}
+}
+
+// admit checks an accepted connection against the limits of the server
+// and reserves the resources it needs. It reports whether the connection
+// should be handled; if so, leave must be called when it is done.
+func (s *Server) admit(conn net.Conn) bool {
+	ip := clientIP(conn)
+	if !s.allowRate(ip) {
+		s.log(LogAccept).Warnf("close connection from %v: rate limit exceeded", conn.RemoteAddr())
+		return false
+	}
+	c := s.config()
+	if c.FDReserve > 0 {
+		if open, max, low := s.fdsLow(c.FDReserve); low {
+			s.log(LogAccept).Warnf("close connection from %v: %v of %v file descriptors open, within the reserve of %v", conn.RemoteAddr(), open, max, c.FDReserve)
+			return false
+		}
+	}
+	if !s.conns.acquire(ip, c.MaxConns, c.MaxConnsPerClient) {
+		s.log(LogAccept).Warnf("close connection from %v: connection limit exceeded", conn.RemoteAddr())
+		return false
+	}
+	if !s.mem.reserve(s.connMemory()) {
+		s.conns.release(ip)
+		s.log(LogAccept).Warnf("close connection from %v: memory limit %v bytes exceeded", conn.RemoteAddr(), s.mem.limit)
+		return false
+	}
+	// released by handleConn at the end of the handshake.
+	if n := s.handshakes.Add(1); c.MaxHandshakes > 0 && n > int64(c.MaxHandshakes) {
+		s.handshakes.Add(-1)
+		s.mem.release(s.connMemory())
+		s.conns.release(ip)
+		s.log(LogAccept).Warnf("close connection from %v: handshake limit exceeded", conn.RemoteAddr())
+		return false
+	}
+	return true
+}
+
+// allowRate counts a new connection from ip and reports whether it is
+// within the rate limit. Connections are allowed when the store fails, so
+// that an outage of a shared store does not stop the proxy.
+func (s *Server) allowRate(ip string) bool {
+	c := s.config()
+	if c.RateLimit <= 0 {
+		return true
+	}
+	n, err := s.store.Incr("rate:"+ip, 1, c.RateWindow)
+	if err != nil {
+		s.log(LogAccept).Warnf("rate limit of %v: %v", ip, err)
+		s.reportError("store", err, "client", ip)
+		return true
+	}
+	return n <= int64(c.RateLimit)
+}
+
+// leave releases the resources reserved by admit.
+func (s *Server) leave(conn net.Conn) {
+	s.mem.release(s.connMemory())
+	s.conns.release(clientIP(conn))
+}
+
+// clientIP returns the IP of the remote end of conn.
+func clientIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
@@ -0,0 +1,344 @@
+package socks4
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addrConn is a connection from addr.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr { return c.addr }
+
+func fromIP(ip string) net.Conn {
+	return addrConn{addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}
+}
+
+func TestConnCounter(t *testing.T) {
+	var c connCounter
+	for _, tt := range []struct {
+		ip           string
+		max          int
+		maxPerClient int
+		release      bool
+		ok           bool
+	}{
+		{ip: "10.0.0.1", max: 3, maxPerClient: 2, ok: true},
+		{ip: "10.0.0.1", max: 3, maxPerClient: 2, ok: true},
+		{ip: "10.0.0.1", max: 3, maxPerClient: 2},
+		{ip: "10.0.0.2", max: 3, maxPerClient: 2, ok: true},
+		{ip: "10.0.0.3", max: 3, maxPerClient: 2},
+		{ip: "10.0.0.3", max: 0, maxPerClient: 0, ok: true},
+		{ip: "10.0.0.1", release: true},
+		{ip: "10.0.0.1", max: 4, maxPerClient: 2, ok: true},
+	} {
+		if tt.release {
+			c.release(tt.ip)
+			continue
+		}
+		if ok := c.acquire(tt.ip, tt.max, tt.maxPerClient); ok != tt.ok {
+			t.Errorf("connection from %v within %v and %v per client: %v, want %v", tt.ip, tt.max, tt.maxPerClient, ok, tt.ok)
+		}
+	}
+	if c.total != 4 || c.byClient["10.0.0.1"] != 2 {
+		t.Errorf("counted %v connections, %v from 10.0.0.1, want 4 and 2", c.total, c.byClient["10.0.0.1"])
+	}
+	for ip, n := range map[string]int{"10.0.0.1": 2, "10.0.0.2": 1, "10.0.0.3": 1} {
+		for i := 0; i < n; i++ {
+			c.release(ip)
+		}
+	}
+	if c.total != 0 || len(c.byClient) != 0 {
+		t.Errorf("counted %v connections from %v once released", c.total, c.byClient)
+	}
+}
+
+// failingStore fails all its operations.
+type failingStore struct{ Store }
+
+func (failingStore) Incr(key string, n int64, ttl time.Duration) (int64, error) {
+	return 0, errors.New("store down")
+}
+
+func TestAdmit(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		opts  []OptionFunc
+		conns []string // client IPs, admitted in order.
+		ok    []bool
+	}{
+		{name: "no limits", conns: []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"}, ok: []bool{true, true, true}},
+		{name: "max conns", opts: []OptionFunc{WithMaxConns(2)}, conns: []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, ok: []bool{true, true, false}},
+		{name: "max conns per client", opts: []OptionFunc{WithMaxConnsPerClient(1)}, conns: []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"}, ok: []bool{true, false, true}},
+		{name: "rate limit", opts: []OptionFunc{WithRateLimit(2, time.Minute)}, conns: []string{"10.0.0.1", "10.0.0.1", "10.0.0.1", "10.0.0.2"}, ok: []bool{true, true, false, true}},
+		{name: "rate limit of a failing store", opts: []OptionFunc{WithRateLimit(1, time.Minute), WithStore(failingStore{})}, conns: []string{"10.0.0.1", "10.0.0.1"}, ok: []bool{true, true}},
+		{name: "max handshakes", opts: []OptionFunc{WithHandshakeLimits(0, 1, 0)}, conns: []string{"10.0.0.1", "10.0.0.2"}, ok: []bool{true, false}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(tt.opts...)
+			for i, ip := range tt.conns {
+				if ok := s.admit(fromIP(ip)); ok != tt.ok[i] {
+					t.Errorf("connection %v from %v admitted: %v, want %v", i+1, ip, ok, tt.ok[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAdmitLeave(t *testing.T) {
+	s := newTestServer(WithMaxConns(1))
+	conn := fromIP("10.0.0.1")
+	if !s.admit(conn) {
+		t.Fatal("first connection not admitted")
+	}
+	s.handshakes.Add(-1)
+	s.leave(conn)
+	if !s.admit(fromIP("10.0.0.2")) {
+		t.Error("connection not admitted once the first one left")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	for _, tt := range []struct {
+		addr net.Addr
+		ip   string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1080}, "10.0.0.1"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1080}, "2001:db8::1"},
+		{&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443}, "10.0.0.2"},
+		{&net.UnixAddr{Name: "/run/socks4.sock", Net: "unix"}, "/run/socks4.sock"},
+	} {
+		if ip := clientIP(addrConn{addr: tt.addr}); ip != tt.ip {
+			t.Errorf("client IP of %v: %q, want %q", tt.addr, ip, tt.ip)
+		}
+	}
+}
+
+func TestDialCounter(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		max      int
+		ops      []string // addresses acquired, released if prefixed by "-".
+		ok       []bool   // of the acquired addresses.
+		inflight map[string]int
+	}{
+		{name: "no limit", ops: []string{"a:80", "a:80", "a:80"}, ok: []bool{true, true, true}, inflight: map[string]int{"a:80": 3}},
+		{name: "limit", max: 2, ops: []string{"a:80", "a:80", "a:80"}, ok: []bool{true, true, false}, inflight: map[string]int{"a:80": 2}},
+		{name: "other destination", max: 1, ops: []string{"a:80", "b:80", "a:443"}, ok: []bool{true, true, true}, inflight: map[string]int{"a:80": 1, "b:80": 1, "a:443": 1}},
+		{name: "released", max: 1, ops: []string{"a:80", "-a:80", "a:80"}, ok: []bool{true, true}, inflight: map[string]int{"a:80": 1}},
+		{name: "all released", max: 2, ops: []string{"a:80", "a:80", "-a:80", "-a:80"}, ok: []bool{true, true}},
+	} {
+		var c dialCounter
+		var ok []bool
+		for _, op := range tt.ops {
+			if addr, released := strings.CutPrefix(op, "-"); released {
+				c.release(addr)
+				continue
+			}
+			ok = append(ok, c.acquire(op, tt.max))
+		}
+		if !reflect.DeepEqual(ok, tt.ok) {
+			t.Errorf("%v: acquired %v, want %v", tt.name, ok, tt.ok)
+		}
+		if len(c.inflight) != len(tt.inflight) || len(tt.inflight) > 0 && !reflect.DeepEqual(c.inflight, tt.inflight) {
+			t.Errorf("%v: in flight %v, want %v", tt.name, c.inflight, tt.inflight)
+		}
+	}
+}
+
+// blockingNetwork is a pipeNetwork whose dials wait for release to be
+// closed.
+type blockingNetwork struct {
+	pipeNetwork
+	dialing chan string
+	release chan struct{}
+}
+
+func (n *blockingNetwork) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	n.dialing <- address
+	<-n.release
+	return n.pipeNetwork.Dial(network, address, timeout)
+}
+
+func TestMaxDialsPerDestination(t *testing.T) {
+	network := &blockingNetwork{dialing: make(chan string, 4), release: make(chan struct{})}
+	s, addr := serve(t, WithNetwork(network), WithMaxDialsPerDestination(1), WithRejectReasons())
+	d := NewDialer(addr, WithDialerTimeout(5*time.Second), WithDialerRejectReason())
+	dialed := make(chan error, 1)
+	go func() {
+		conn, err := d.Dial("tcp", "203.0.113.1:80")
+		if err == nil {
+			conn.Close()
+		}
+		dialed <- err
+	}()
+	select {
+	case <-network.dialing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("destination not dialed")
+	}
+
+	// the second dial to the destination fails right away.
+	var rej *RejectError
+	if _, err := d.Dial("tcp", "203.0.113.1:80"); !errors.As(err, &rej) || rej.Code != RejectOrFailure || !strings.Contains(rej.Reason, "too many dials") {
+		t.Errorf("error %v, want a rejection for too many dials", err)
+	}
+	if ls := s.limitsState(); ls.MaxDialsPerDestination != 1 || !reflect.DeepEqual(ls.DialsInFlight, map[string]int{"203.0.113.1:80": 1}) {
+		t.Errorf("limits %+v, want a dial in flight to 203.0.113.1:80", ls)
+	}
+
+	close(network.release)
+	if err := <-dialed; err != nil {
+		t.Fatalf("first dial: %v", err)
+	}
+	if ls := s.limitsState(); len(ls.DialsInFlight) != 0 {
+		t.Errorf("dials in flight %v once dialed, want none", ls.DialsInFlight)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		timeout    time.Duration
+		soft       int
+		soft2      time.Duration // soft timeout.
+		handshakes int64
+		want       time.Duration
+	}{
+		{name: "no limit", timeout: 10 * time.Second, handshakes: 100, want: 10 * time.Second},
+		{name: "within the soft limit", timeout: 10 * time.Second, soft: 10, soft2: time.Second, handshakes: 10, want: 10 * time.Second},
+		{name: "beyond the soft limit", timeout: 10 * time.Second, soft: 10, soft2: time.Second, handshakes: 11, want: time.Second},
+		{name: "no handshake timeout", soft: 10, soft2: time.Second, handshakes: 11, want: time.Second},
+		{name: "longer soft timeout", timeout: time.Second, soft: 10, soft2: 10 * time.Second, handshakes: 11, want: time.Second},
+		{name: "no soft timeout", timeout: 10 * time.Second, soft: 10, handshakes: 11, want: 10 * time.Second},
+	} {
+		s := newTestServer(WithHandshakeTimeout(tt.timeout), WithHandshakeLimits(tt.soft, 0, tt.soft2))
+		s.handshakes.Store(tt.handshakes)
+		if timeout := s.handshakeTimeout(); timeout != tt.want {
+			t.Errorf("%v: timeout %v, want %v", tt.name, timeout, tt.want)
+		}
+	}
+}
+
+func TestAcquireRelay(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		max  int
+		ops  []int // sessions acquiring a relay, releasing it if negative.
+		ok   []bool
+	}{
+		{name: "no limit", ops: []int{1, 2, 3}, ok: []bool{true, true, true}},
+		{name: "limit", max: 2, ops: []int{1, 2, 3}, ok: []bool{true, true, false}},
+		{name: "once per session", max: 2, ops: []int{1, 1, 1, 2}, ok: []bool{true, true, true, true}},
+		{name: "released", max: 1, ops: []int{1, 2, -1, 2, 3}, ok: []bool{true, false, true, false}},
+		{name: "released twice", max: 1, ops: []int{1, -1, -1, 2, 3}, ok: []bool{true, true, false}},
+	} {
+		s := newTestServer(WithMaxRelays(tt.max))
+		sessions := make(map[int]*session)
+		var ok []bool
+		for _, op := range tt.ops {
+			id := op
+			if id < 0 {
+				id = -id
+			}
+			if sessions[id] == nil {
+				sessions[id] = &session{id: uint64(id)}
+			}
+			if op < 0 {
+				s.releaseRelay(sessions[id])
+				continue
+			}
+			ok = append(ok, s.acquireRelay(sessions[id]))
+		}
+		if !reflect.DeepEqual(ok, tt.ok) {
+			t.Errorf("%v: acquired %v, want %v", tt.name, ok, tt.ok)
+		}
+		relays := 0
+		for _, ss := range sessions {
+			if ss.relay {
+				relays++
+			}
+		}
+		if n := s.Stats().Relays; n != relays {
+			t.Errorf("%v: %v relays, want %v", tt.name, n, relays)
+		}
+	}
+}
+
+func TestMaxRelays(t *testing.T) {
+	echo := echoTarget(t)
+	for _, tt := range []struct {
+		name   string
+		max    int
+		dials  int
+		relays int // established.
+	}{
+		{name: "no limit", dials: 3, relays: 3},
+		{name: "limit", max: 2, dials: 3, relays: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := serve(t, WithMaxRelays(tt.max))
+			relays := 0
+			for i := 0; i < tt.dials; i++ {
+				conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+				var rej *RejectError
+				if errors.As(err, &rej) {
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				relays++
+			}
+			if relays != tt.relays {
+				t.Errorf("%v relays, want %v", relays, tt.relays)
+			}
+			st := s.Stats()
+			if st.Relays != tt.relays || st.Handshakes != 0 || st.Rejections["limit"] != uint64(tt.dials-tt.relays) {
+				t.Errorf("stats %v relays and %v handshakes, %v rejections, want %v relays", st.Relays, st.Handshakes, st.Rejections, tt.relays)
+			}
+		})
+	}
+}
+
+func TestHandshakesCounted(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		hard       int
+		conns      int
+		handshakes int // in progress.
+	}{
+		{name: "no limit", conns: 3, handshakes: 3},
+		{name: "limit", hard: 2, conns: 3, handshakes: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := serve(t, WithHandshakeLimits(0, tt.hard, 0))
+			// connections without request.
+			for i := 0; i < tt.conns; i++ {
+				conn, err := net.Dial("tcp", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+			}
+			// the connections beyond the limit are accepted, then closed.
+			for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+				st := s.Stats()
+				if st.Accepted == uint64(tt.conns) && st.Handshakes == tt.handshakes {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("%v connections accepted and %v handshakes, want %v and %v", st.Accepted, st.Handshakes, tt.conns, tt.handshakes)
+				}
+			}
+		})
+	}
+}
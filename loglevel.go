@@ -0,0 +1,152 @@
+package socks4
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LogSubsystem is an area of the server whose messages have their own log
+// level, set at runtime by Server.SetLogLevel.
+type LogSubsystem int
+
+const (
+	LogAccept    LogSubsystem = iota // the listeners, accepted connections and client limits.
+	LogHandshake                     // the requests read, carried out and replied.
+	LogResolver                      // the resolution of the targets.
+	LogRules                         // the rewriting and matching of the requests by the rules.
+	LogRelay                         // the relays of the established sessions.
+	numLogSubsystems
+)
+
+var logSubsystemNames = [numLogSubsystems]string{"accept", "handshake", "resolver", "rules", "relay"}
+
+func (sub LogSubsystem) String() string {
+	if sub >= 0 && sub < numLogSubsystems {
+		return logSubsystemNames[sub]
+	}
+	return fmt.Sprintf("LogSubsystem(%d)", int(sub))
+}
+
+// LogSubsystems returns all the subsystems.
+func LogSubsystems() []LogSubsystem {
+	list := make([]LogSubsystem, numLogSubsystems)
+	for i := range list {
+		list[i] = LogSubsystem(i)
+	}
+	return list
+}
+
+// ParseLogSubsystem returns the subsystem of the name, e.g. "relay".
+func ParseLogSubsystem(name string) (LogSubsystem, error) {
+	for i, n := range logSubsystemNames {
+		if n == name {
+			return LogSubsystem(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log subsystem %q", name)
+}
+
+// SetLogLevel sets the level of the messages of the subsystem, e.g.
+// LogDebug to trace the relays during an incident. The messages below it
+// are dropped, and the others are passed to the logger with a "subsystem"
+// field if it is a logrus one. The logger must still let them through its
+// own level.
+func (s *Server) SetLogLevel(sub LogSubsystem, level LogLevel) {
+	s.logLevels[sub].Store(int32(level) + 1)
+}
+
+// ResetLogLevel passes the messages of the subsystem to the logger
+// unfiltered again.
+func (s *Server) ResetLogLevel(sub LogSubsystem) {
+	s.logLevels[sub].Store(0)
+}
+
+// LogLevels returns the levels set by SetLogLevel.
+func (s *Server) LogLevels() map[LogSubsystem]LogLevel {
+	levels := make(map[LogSubsystem]LogLevel)
+	for i := range s.logLevels {
+		if l := s.logLevels[i].Load(); l > 0 {
+			levels[LogSubsystem(i)] = LogLevel(l - 1)
+		}
+	}
+	return levels
+}
+
+// log returns the logger of the messages of the subsystem.
+func (s *Server) log(sub LogSubsystem) Logger {
+	return s.subsystemLogger(sub, s.logger)
+}
+
+func (s *Server) subsystemLogger(sub LogSubsystem, logger Logger) Logger {
+	return &subsystemLogger{Logger: logger, sub: sub, level: &s.logLevels[sub]}
+}
+
+// subsystemLogger filters the messages of a subsystem by its level.
+type subsystemLogger struct {
+	Logger
+	sub   LogSubsystem
+	level *atomic.Int32 // level plus one, 0 if not set.
+}
+
+// at returns the logger of a message of the level, or nil if it is
+// dropped.
+func (l *subsystemLogger) at(level LogLevel) Logger {
+	set := l.level.Load()
+	if set == 0 {
+		return l.Logger
+	}
+	if int32(level)+1 < set {
+		return nil
+	}
+	return withFields(l.Logger, logrus.Fields{"subsystem": l.sub.String()})
+}
+
+func (l *subsystemLogger) Debug(args ...any) {
+	if logger := l.at(LogDebug); logger != nil {
+		logger.Debug(args...)
+	}
+}
+
+func (l *subsystemLogger) Debugf(format string, args ...any) {
+	if logger := l.at(LogDebug); logger != nil {
+		logger.Debugf(format, args...)
+	}
+}
+
+func (l *subsystemLogger) Info(args ...any) {
+	if logger := l.at(LogInfo); logger != nil {
+		logger.Info(args...)
+	}
+}
+
+func (l *subsystemLogger) Infof(format string, args ...any) {
+	if logger := l.at(LogInfo); logger != nil {
+		logger.Infof(format, args...)
+	}
+}
+
+func (l *subsystemLogger) Warn(args ...any) {
+	if logger := l.at(LogWarn); logger != nil {
+		logger.Warn(args...)
+	}
+}
+
+func (l *subsystemLogger) Warnf(format string, args ...any) {
+	if logger := l.at(LogWarn); logger != nil {
+		logger.Warnf(format, args...)
+	}
+}
+
+func (l *subsystemLogger) Error(args ...any) {
+	if logger := l.at(LogError); logger != nil {
+		logger.Error(args...)
+	}
+}
+
+func (l *subsystemLogger) Errorf(format string, args ...any) {
+	if logger := l.at(LogError); logger != nil {
+		logger.Errorf(format, args...)
+	}
+}
@@ -0,0 +1,94 @@
+package socks4
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseLogSubsystem(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		sub  LogSubsystem
+		ok   bool
+	}{
+		{"accept", LogAccept, true},
+		{"handshake", LogHandshake, true},
+		{"resolver", LogResolver, true},
+		{"rules", LogRules, true},
+		{"relay", LogRelay, true},
+		{"Relay", 0, false},
+		{"dns", 0, false},
+		{"", 0, false},
+	} {
+		sub, err := ParseLogSubsystem(tt.name)
+		if (err == nil) != tt.ok || tt.ok && (sub != tt.sub || sub.String() != tt.name) {
+			t.Errorf("%q parsed as %v with error %v, want %v", tt.name, sub, err, tt.sub)
+		}
+	}
+	if s := LogSubsystem(9).String(); s != "LogSubsystem(9)" {
+		t.Errorf("unknown subsystem printed %q", s)
+	}
+	if subs := LogSubsystems(); len(subs) != 5 || subs[0] != LogAccept || subs[4] != LogRelay {
+		t.Errorf("subsystems %v", subs)
+	}
+}
+
+func TestSubsystemLogger(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		level  *LogLevel // of the relay, not set if nil.
+		logs   func(l Logger)
+		output string // the entries as level:msg:subsystem, separated by commas.
+	}{
+		{name: "not set", logs: func(l Logger) { l.Debug("a"); l.Info("b") }, output: "debug:a:,info:b:"},
+		{name: "debug", level: levelOf(LogDebug), logs: func(l Logger) { l.Debugf("%v", "a"); l.Warn("b") }, output: "debug:a:relay,warning:b:relay"},
+		{name: "warnings", level: levelOf(LogWarn), logs: func(l Logger) {
+			l.Debug("a")
+			l.Infof("b")
+			l.Warnf("c")
+			l.Error("d")
+		}, output: "warning:c:relay,error:d:relay"},
+		{name: "errors", level: levelOf(LogError), logs: func(l Logger) { l.Info("a"); l.Warn("b"); l.Errorf("c") }, output: "error:c:relay"},
+	} {
+		var out strings.Builder
+		logger := &logrus.Logger{Out: &out, Formatter: &logrus.JSONFormatter{}, Level: logrus.TraceLevel}
+		s := newTestServer(WithLogger(logger))
+		if tt.level != nil {
+			s.SetLogLevel(LogRelay, *tt.level)
+		}
+		tt.logs(s.log(LogRelay))
+		// the other subsystems are not filtered.
+		s.log(LogAccept).Debug("accepted")
+
+		var entries []string
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			var e struct{ Level, Msg, Subsystem string }
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, e.Level+":"+e.Msg+":"+e.Subsystem)
+		}
+		if want := tt.output + ",debug:accepted:"; strings.Join(entries, ",") != want {
+			t.Errorf("%v: logged %v, want %v", tt.name, strings.Join(entries, ","), want)
+		}
+	}
+}
+
+func levelOf(l LogLevel) *LogLevel { return &l }
+
+func TestLogLevels(t *testing.T) {
+	s := newTestServer()
+	s.SetLogLevel(LogRelay, LogDebug)
+	s.SetLogLevel(LogRules, LogError)
+	if levels := s.LogLevels(); !reflect.DeepEqual(levels, map[LogSubsystem]LogLevel{LogRelay: LogDebug, LogRules: LogError}) {
+		t.Errorf("levels %v", levels)
+	}
+	s.ResetLogLevel(LogRelay)
+	if levels := s.LogLevels(); !reflect.DeepEqual(levels, map[LogSubsystem]LogLevel{LogRules: LogError}) {
+		t.Errorf("levels %v after the reset of the relay", levels)
+	}
+}
@@ -0,0 +1,219 @@
+package socks4
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// LogLevel is the level of a log message.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	}
+	return fmt.Sprintf("LogLevel(%d)", int(l))
+}
+
+// WithLogSampling makes the server log at most burst messages of the same
+// class and level within each window, like the accept or handshake errors
+// of a flood of clients. The messages beyond are collapsed into a single
+// one with their count once the window ends. The class of a message is its
+// format.
+func WithLogSampling(level LogLevel, window time.Duration, burst int) OptionFunc {
+	return func(s *Server) {
+		if s.logSampling == nil {
+			s.logSampling = make(map[LogLevel]logSampling)
+		}
+		if burst < 1 {
+			burst = 1
+		}
+		s.logSampling[level] = logSampling{window: window, burst: burst}
+	}
+}
+
+type logSampling struct {
+	window time.Duration
+	burst  int
+}
+
+// maxLogClasses is the number of message classes beyond which those whose
+// window ended are forgotten.
+const maxLogClasses = 1024
+
+// logSampler counts the messages of each class within their window.
+type logSampler struct {
+	levels map[LogLevel]logSampling
+	clock  Clock
+
+	mu      sync.Mutex
+	classes map[logClass]*logClassState
+}
+
+type logClass struct {
+	level  LogLevel
+	format string
+}
+
+type logClassState struct {
+	start      time.Time
+	count      int    // messages within the window.
+	suppressed int    // messages beyond the burst.
+	last       string // last message suppressed.
+	logger     Logger // logger of the last message suppressed.
+}
+
+// sampledLogger is a Logger sampling the messages of its levels.
+type sampledLogger struct {
+	Logger
+	sampler *logSampler
+}
+
+func newSampledLogger(logger Logger, levels map[LogLevel]logSampling, clock Clock) *sampledLogger {
+	return &sampledLogger{
+		Logger: logger,
+		sampler: &logSampler{
+			levels:  levels,
+			clock:   clock,
+			classes: make(map[logClass]*logClassState),
+		},
+	}
+}
+
+// with returns a logger sampling the messages to logger with the classes
+// of l.
+func (l *sampledLogger) with(logger Logger) *sampledLogger {
+	return &sampledLogger{Logger: logger, sampler: l.sampler}
+}
+
+// allow reports whether a message of the class is logged, counting it
+// otherwise.
+func (l *sampledLogger) allow(c logClass, msg func() string) bool {
+	cfg, ok := l.sampler.levels[c.level]
+	if !ok {
+		return true
+	}
+	sp := l.sampler
+	now := sp.clock.Now()
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	st := sp.classes[c]
+	if st == nil || (st.suppressed == 0 && now.Sub(st.start) >= cfg.window) {
+		if st == nil && len(sp.classes) >= maxLogClasses {
+			sp.prune(now)
+		}
+		st = &logClassState{start: now}
+		sp.classes[c] = st
+	}
+	st.count++
+	if st.count <= cfg.burst {
+		return true
+	}
+	st.suppressed++
+	st.last = msg()
+	st.logger = l.Logger
+	if st.suppressed == 1 {
+		sp.clock.AfterFunc(st.start.Add(cfg.window).Sub(now), func() { sp.flush(c, st, cfg.window) })
+	}
+	return false
+}
+
+// prune forgets the classes whose window ended without suppressed
+// messages.
+func (sp *logSampler) prune(now time.Time) {
+	for c, st := range sp.classes {
+		if st.suppressed == 0 && now.Sub(st.start) >= sp.levels[c.level].window {
+			delete(sp.classes, c)
+		}
+	}
+}
+
+// flush logs the count of the messages of the class suppressed within the
+// window, which then starts over.
+func (sp *logSampler) flush(c logClass, st *logClassState, window time.Duration) {
+	sp.mu.Lock()
+	if sp.classes[c] == st {
+		delete(sp.classes, c)
+	}
+	n, last, logger := st.suppressed, st.last, st.logger
+	sp.mu.Unlock()
+
+	format := "%v similar messages suppressed in %v, last: %v"
+	switch c.level {
+	case LogDebug:
+		logger.Debugf(format, n, window, last)
+	case LogInfo:
+		logger.Infof(format, n, window, last)
+	case LogWarn:
+		logger.Warnf(format, n, window, last)
+	case LogError:
+		logger.Errorf(format, n, window, last)
+	}
+}
+
+func (l *sampledLogger) Debug(args ...any) {
+	msg := fmt.Sprint(args...)
+	if l.allow(logClass{LogDebug, msg}, func() string { return msg }) {
+		l.Logger.Debug(args...)
+	}
+}
+
+func (l *sampledLogger) Debugf(format string, args ...any) {
+	if l.allow(logClass{LogDebug, format}, func() string { return fmt.Sprintf(format, args...) }) {
+		l.Logger.Debugf(format, args...)
+	}
+}
+
+func (l *sampledLogger) Info(args ...any) {
+	msg := fmt.Sprint(args...)
+	if l.allow(logClass{LogInfo, msg}, func() string { return msg }) {
+		l.Logger.Info(args...)
+	}
+}
+
+func (l *sampledLogger) Infof(format string, args ...any) {
+	if l.allow(logClass{LogInfo, format}, func() string { return fmt.Sprintf(format, args...) }) {
+		l.Logger.Infof(format, args...)
+	}
+}
+
+func (l *sampledLogger) Warn(args ...any) {
+	msg := fmt.Sprint(args...)
+	if l.allow(logClass{LogWarn, msg}, func() string { return msg }) {
+		l.Logger.Warn(args...)
+	}
+}
+
+func (l *sampledLogger) Warnf(format string, args ...any) {
+	if l.allow(logClass{LogWarn, format}, func() string { return fmt.Sprintf(format, args...) }) {
+		l.Logger.Warnf(format, args...)
+	}
+}
+
+func (l *sampledLogger) Error(args ...any) {
+	msg := fmt.Sprint(args...)
+	if l.allow(logClass{LogError, msg}, func() string { return msg }) {
+		l.Logger.Error(args...)
+	}
+}
+
+func (l *sampledLogger) Errorf(format string, args ...any) {
+	if l.allow(logClass{LogError, format}, func() string { return fmt.Sprintf(format, args...) }) {
+		l.Logger.Errorf(format, args...)
+	}
+}
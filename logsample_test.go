@@ -0,0 +1,182 @@
+package socks4
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// linesLogger records the messages logged as "level: message".
+type linesLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *linesLogger) add(level LogLevel, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, level.String()+": "+msg)
+}
+
+func (l *linesLogger) Debug(args ...any) { l.add(LogDebug, fmt.Sprint(args...)) }
+func (l *linesLogger) Debugf(format string, args ...any) {
+	l.add(LogDebug, fmt.Sprintf(format, args...))
+}
+func (l *linesLogger) Info(args ...any)                 { l.add(LogInfo, fmt.Sprint(args...)) }
+func (l *linesLogger) Infof(format string, args ...any) { l.add(LogInfo, fmt.Sprintf(format, args...)) }
+func (l *linesLogger) Warn(args ...any)                 { l.add(LogWarn, fmt.Sprint(args...)) }
+func (l *linesLogger) Warnf(format string, args ...any) { l.add(LogWarn, fmt.Sprintf(format, args...)) }
+func (l *linesLogger) Error(args ...any)                { l.add(LogError, fmt.Sprint(args...)) }
+func (l *linesLogger) Errorf(format string, args ...any) {
+	l.add(LogError, fmt.Sprintf(format, args...))
+}
+
+// manualClock is a stepClock whose functions of AfterFunc run when it is
+// advanced past their time.
+type manualClock struct {
+	stepClock
+	funcs []manualFunc
+}
+
+type manualFunc struct {
+	at time.Time
+	f  func()
+}
+
+func (c *manualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.funcs = append(c.funcs, manualFunc{at: c.now.Add(d), f: f})
+	return nil
+}
+
+// advance moves the clock by d, running the functions due in order.
+func (c *manualClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+	sort.SliceStable(c.funcs, func(i, j int) bool { return c.funcs[i].at.Before(c.funcs[j].at) })
+	for len(c.funcs) > 0 && !c.funcs[0].at.After(c.now) {
+		f := c.funcs[0].f
+		c.funcs = c.funcs[1:]
+		f()
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	warn := map[LogLevel]logSampling{LogWarn: {window: time.Minute, burst: 2}}
+	for _, tt := range []struct {
+		name   string
+		levels map[LogLevel]logSampling
+		log    func(l Logger, clock *manualClock)
+		lines  []string
+	}{
+		{name: "within the burst", levels: warn, log: func(l Logger, clock *manualClock) {
+			l.Warnf("dial %v", 1)
+			l.Warnf("dial %v", 2)
+			clock.advance(time.Minute)
+		}, lines: []string{"warn: dial 1", "warn: dial 2"}},
+		{name: "beyond the burst", levels: warn, log: func(l Logger, clock *manualClock) {
+			for i := 1; i <= 5; i++ {
+				l.Warnf("dial %v", i)
+			}
+			clock.advance(time.Minute)
+		}, lines: []string{"warn: dial 1", "warn: dial 2", "warn: 3 similar messages suppressed in 1m0s, last: dial 5"}},
+		{name: "suppressed until the window ends", levels: warn, log: func(l Logger, clock *manualClock) {
+			for i := 1; i <= 3; i++ {
+				l.Warnf("dial %v", i)
+			}
+			clock.advance(30 * time.Second)
+		}, lines: []string{"warn: dial 1", "warn: dial 2"}},
+		{name: "next window", levels: warn, log: func(l Logger, clock *manualClock) {
+			for i := 1; i <= 3; i++ {
+				l.Warnf("dial %v", i)
+			}
+			clock.advance(time.Minute)
+			l.Warnf("dial %v", 4)
+		}, lines: []string{"warn: dial 1", "warn: dial 2", "warn: 1 similar messages suppressed in 1m0s, last: dial 3", "warn: dial 4"}},
+		{name: "window ended without suppressed messages", levels: map[LogLevel]logSampling{LogWarn: {window: time.Minute, burst: 1}}, log: func(l Logger, clock *manualClock) {
+			l.Warnf("dial %v", 1)
+			clock.advance(time.Minute)
+			l.Warnf("dial %v", 2)
+		}, lines: []string{"warn: dial 1", "warn: dial 2"}},
+		{name: "classes by format", levels: map[LogLevel]logSampling{LogWarn: {window: time.Minute, burst: 1}}, log: func(l Logger, clock *manualClock) {
+			l.Warnf("dial %v", 1)
+			l.Warnf("accept %v", 1)
+			l.Warn("closed")
+			l.Warn("reset")
+		}, lines: []string{"warn: dial 1", "warn: accept 1", "warn: closed", "warn: reset"}},
+		{name: "classes by level", levels: map[LogLevel]logSampling{LogWarn: {window: time.Minute, burst: 1}, LogError: {window: time.Minute, burst: 1}}, log: func(l Logger, clock *manualClock) {
+			l.Warnf("dial %v", 1)
+			l.Errorf("dial %v", 2)
+			l.Errorf("dial %v", 3)
+			clock.advance(time.Minute)
+		}, lines: []string{"warn: dial 1", "error: dial 2", "error: 1 similar messages suppressed in 1m0s, last: dial 3"}},
+		{name: "level not sampled", levels: warn, log: func(l Logger, clock *manualClock) {
+			for i := 1; i <= 3; i++ {
+				l.Infof("session %v", i)
+				l.Debug("relay")
+			}
+		}, lines: []string{"info: session 1", "debug: relay", "info: session 2", "debug: relay", "info: session 3", "debug: relay"}},
+		{name: "messages without format", levels: map[LogLevel]logSampling{LogInfo: {window: time.Minute, burst: 1}}, log: func(l Logger, clock *manualClock) {
+			l.Info("accept failed")
+			l.Info("accept failed")
+			clock.advance(time.Minute)
+		}, lines: []string{"info: accept failed", "info: 1 similar messages suppressed in 1m0s, last: accept failed"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &linesLogger{}
+			clock := &manualClock{stepClock: stepClock{now: time.Unix(1000, 0)}}
+			tt.log(newSampledLogger(logger, tt.levels, clock), clock)
+			if !reflect.DeepEqual(logger.lines, tt.lines) {
+				t.Errorf("logged %q, want %q", logger.lines, tt.lines)
+			}
+		})
+	}
+}
+
+func TestWithLogSampling(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		burst int
+		want  int
+	}{
+		{name: "burst", burst: 3, want: 3},
+		{name: "burst of at least one", burst: 0, want: 1},
+	} {
+		s := newTestServer(WithLogSampling(LogWarn, time.Minute, tt.burst))
+		if got := s.logSampling[LogWarn]; got != (logSampling{window: time.Minute, burst: tt.want}) {
+			t.Errorf("%v: sampling %+v, want a burst of %v", tt.name, got, tt.want)
+		}
+		if _, ok := s.logger.(*sampledLogger); !ok {
+			t.Errorf("%v: logger %T, want sampled", tt.name, s.logger)
+		}
+	}
+}
+
+func TestSampledWithFields(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		logger Logger
+		entry  bool // the sampled logger logs to an entry with the fields.
+	}{
+		{name: "logrus", logger: &logrus.Logger{Out: &lockedBuffer{}, Formatter: &logrus.TextFormatter{}, Level: logrus.InfoLevel}, entry: true},
+		{name: "other", logger: &linesLogger{}},
+	} {
+		s := newTestServer(WithLogger(tt.logger), WithLogSampling(LogWarn, time.Minute, 1))
+		// the loggers of the sessions with labels share the classes of the
+		// server.
+		sl, ok := withFields(s.logger, logrus.Fields{"team": "web"}).(*sampledLogger)
+		if !ok {
+			t.Errorf("%v: logger with fields not sampled", tt.name)
+			continue
+		}
+		if sl.sampler != s.logger.(*sampledLogger).sampler {
+			t.Errorf("%v: logger with fields with its own sampler", tt.name)
+		}
+		if _, entry := sl.Logger.(*logrus.Entry); entry != tt.entry {
+			t.Errorf("%v: logger with fields of %T, want an entry %v", tt.name, sl.Logger, tt.entry)
+		}
+	}
+}
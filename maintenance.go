@@ -0,0 +1,49 @@
+package socks4
+
+import (
+	"errors"
+	"net"
+)
+
+// Maintenance is the maintenance mode of a server, see SetMaintenance.
+type Maintenance struct {
+	Allow []*net.IPNet // clients whose requests are still served.
+	Close bool         // close the connections of the other clients without a reply, instead of rejecting their requests.
+}
+
+// errMaintenance is the error of the requests rejected in maintenance.
+var errMaintenance = errors.New("server in maintenance")
+
+// SetMaintenance puts the server in maintenance mode, or takes it out of
+// it if m is nil. In maintenance new requests are rejected, except those
+// of the clients in m.Allow, while the sessions already established go on
+// until they end, so that the server can be drained before a restart.
+func (s *Server) SetMaintenance(m *Maintenance) {
+	prev := s.maintenance.Swap(m)
+	switch {
+	case m != nil && prev == nil:
+		s.logger.Warnf("maintenance mode on, %v clients allowed", len(m.Allow))
+	case m != nil:
+		s.logger.Infof("maintenance mode updated, %v clients allowed", len(m.Allow))
+	case prev != nil:
+		s.logger.Warnf("maintenance mode off")
+	}
+}
+
+// Maintenance returns the maintenance mode of the server, nil if it is not
+// in maintenance.
+func (s *Server) Maintenance() *Maintenance {
+	return s.maintenance.Load()
+}
+
+// allows reports whether the requests of the client are served in
+// maintenance.
+func (m *Maintenance) allows(conn net.Conn) bool {
+	ip := net.ParseIP(clientIP(conn))
+	for _, n := range m.Allow {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package socks4
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceAllows(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	_, v6, _ := net.ParseCIDR("2001:db8::/32")
+	m := &Maintenance{Allow: []*net.IPNet{lan, v6}}
+	for _, tt := range []struct {
+		ip    string
+		allow bool
+	}{
+		{"10.1.2.3", true},
+		{"2001:db8::1", true},
+		{"192.0.2.1", false},
+		{"2001:db9::1", false},
+	} {
+		if allow := m.allows(fromIP(tt.ip)); allow != tt.allow {
+			t.Errorf("%v allowed: %v, want %v", tt.ip, allow, tt.allow)
+		}
+	}
+	if (&Maintenance{}).allows(fromIP("10.1.2.3")) {
+		t.Error("client allowed without networks")
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("192.0.2.0/24")
+	for _, tt := range []struct {
+		name        string
+		maintenance *Maintenance
+		reply       bool // replied rather than closed.
+		granted     bool
+	}{
+		{name: "off", reply: true, granted: true},
+		{name: "on", maintenance: &Maintenance{}, reply: true},
+		{name: "client allowed", maintenance: &Maintenance{Allow: []*net.IPNet{other, loopback}}, reply: true, granted: true},
+		{name: "client not allowed", maintenance: &Maintenance{Allow: []*net.IPNet{other}}, reply: true},
+		{name: "close", maintenance: &Maintenance{Close: true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := serve(t)
+			echo := echoTarget(t)
+			host, p, _ := net.SplitHostPort(echo.Addr)
+			port, _ := strconv.Atoi(p)
+			// a session established before the maintenance goes on.
+			before, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer before.Close()
+			s.SetMaintenance(tt.maintenance)
+			if s.Maintenance() != tt.maintenance {
+				t.Fatalf("maintenance %+v, want %+v", s.Maintenance(), tt.maintenance)
+			}
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write(request(CmdConnect, uint16(port), [4]byte(net.ParseIP(host).To4()), ""))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			reply := make([]byte, 8)
+			_, err = io.ReadFull(conn, reply)
+			if replied := err == nil; replied != tt.reply {
+				t.Fatalf("replied %x: %v, want replied %v", reply, err, tt.reply)
+			}
+			if tt.reply {
+				code := byte(RejectOrFailure)
+				if tt.granted {
+					code = Granted
+				}
+				if reply[1] != code {
+					t.Errorf("reply code %#x, want %#x", reply[1], code)
+				}
+			}
+			assertEcho(t, before, []byte("hello"))
+
+			// and the requests are served again once it is off.
+			s.SetMaintenance(nil)
+			after, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+			if err != nil {
+				t.Fatalf("request rejected after the maintenance: %v", err)
+			}
+			after.Close()
+		})
+	}
+}
+
+func TestMaintenanceHTTPConnect(t *testing.T) {
+	s, addr := serve(t, WithHTTPConnect(nil))
+	s.SetMaintenance(&Maintenance{})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status %v, want %v", resp.Status, http.StatusServiceUnavailable)
+	}
+}
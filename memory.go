@@ -0,0 +1,67 @@
+package socks4
+
+import (
+	"sync/atomic"
+)
+
+const (
+	// requestBufSize is the size of the buffer reading client requests.
+	requestBufSize = 41
+	// defaultRelayBufSize is the default size of the buffer used by each
+	// direction of a relay.
+	defaultRelayBufSize = 32 * 1024
+)
+
+// WithMemoryLimit caps the memory used by request and relay buffers of all
+// connections to limit bytes. A new connection is closed right after being
+// accepted if its buffers would exceed the limit.
+func WithMemoryLimit(limit int64) OptionFunc {
+	return func(s *Server) {
+		s.mem.limit = limit
+	}
+}
+
+// WithRelayBufferSize sets the size of the buffer used by each direction of
+// a relay, 32 KiB by default or if size is not positive.
+func WithRelayBufferSize(size int) OptionFunc {
+	return func(s *Server) {
+		if size <= 0 {
+			size = defaultRelayBufSize
+		}
+		s.relayBufSize = size
+	}
+}
+
+// memBudget accounts the buffer memory reserved by connections.
+type memBudget struct {
+	limit int64 // 0 for no limit.
+	used  atomic.Int64
+}
+
+// reserve reserves n bytes and reports whether it succeeds without
+// exceeding the limit.
+func (m *memBudget) reserve(n int64) bool {
+	if m.limit <= 0 {
+		m.used.Add(n)
+		return true
+	}
+	for {
+		used := m.used.Load()
+		if used+n > m.limit {
+			return false
+		}
+		if m.used.CompareAndSwap(used, used+n) {
+			return true
+		}
+	}
+}
+
+// release returns n reserved bytes to the budget.
+func (m *memBudget) release(n int64) {
+	m.used.Add(-n)
+}
+
+// connMemory returns the buffer memory needed by one connection.
+func (s *Server) connMemory() int64 {
+	return int64(requestBufSize + 2*s.relayBufSize)
+}
@@ -0,0 +1,79 @@
+package socks4
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRelayBufferSize(t *testing.T) {
+	for _, tt := range []struct {
+		size, want int
+	}{
+		{size: 4096, want: 4096},
+		{size: 1, want: 1},
+		{size: 0, want: defaultRelayBufSize},
+		{size: -1, want: defaultRelayBufSize},
+	} {
+		s := newTestServer(WithRelayBufferSize(tt.size))
+		if s.relayBufSize != tt.want || s.connMemory() != int64(requestBufSize+2*tt.want) {
+			t.Errorf("buffer size %v: %v, connection memory %v, want %v", tt.size, s.relayBufSize, s.connMemory(), tt.want)
+		}
+	}
+}
+
+func TestRelayWithBufferSize(t *testing.T) {
+	echo := echoTarget(t)
+	for _, size := range []int{-1, 0, 1, 7} {
+		_, addr := serve(t, WithRelayBufferSize(size))
+		conn, err := NewDialer(addr).Dial("tcp", echo.Addr)
+		if err != nil {
+			t.Fatalf("buffer size %v: %v", size, err)
+		}
+		assertEcho(t, conn, bytes.Repeat([]byte("0123456789"), 100))
+		conn.Close()
+	}
+}
+
+func TestMemBudget(t *testing.T) {
+	m := &memBudget{limit: 100}
+	for _, tt := range []struct {
+		n    int64
+		ok   bool
+		used int64
+	}{
+		{60, true, 60},
+		{50, false, 60},
+		{40, true, 100},
+		{1, false, 100},
+	} {
+		if ok := m.reserve(tt.n); ok != tt.ok || m.used.Load() != tt.used {
+			t.Errorf("reserve %v: %v with %v used, want %v with %v used", tt.n, ok, m.used.Load(), tt.ok, tt.used)
+		}
+	}
+	m.release(60)
+	if !m.reserve(50) {
+		t.Error("released memory not reserved again")
+	}
+
+	unlimited := &memBudget{}
+	if !unlimited.reserve(1<<40) || unlimited.used.Load() != 1<<40 {
+		t.Error("memory not reserved without limit")
+	}
+}
+
+func TestMemoryLimitRejectsConnections(t *testing.T) {
+	echo := echoTarget(t)
+	s, addr := serve(t, WithRelayBufferSize(1024), WithMemoryLimit(requestBufSize+2*1024))
+	first, err := NewDialer(addr).Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	assertEcho(t, first, []byte("hello"))
+	if _, err := NewDialer(addr).Dial("tcp", echo.Addr); err == nil {
+		t.Error("connection beyond the memory limit accepted")
+	}
+	if used := s.mem.used.Load(); used != s.connMemory() {
+		t.Errorf("%v bytes reserved, want those of one connection", used)
+	}
+}
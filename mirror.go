@@ -0,0 +1,111 @@
+package socks4
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// MirrorAll is the Rule.Mirror of the sessions mirrored without limit.
+const MirrorAll int64 = -1
+
+// MirrorSession is a session whose relayed data is mirrored.
+type MirrorSession struct {
+	ID      uint64   // ID of the session, as listed by Server.Sessions.
+	Client  net.Addr // address of the client.
+	Remote  net.Addr // address of the remote host.
+	Request Request
+	Start   time.Time
+}
+
+// MirrorSink records the data relayed for the mirrored sessions, e.g. for
+// an IDS or for inspection. Its methods are called concurrently for
+// different sessions and should not block, which would stall the relays.
+type MirrorSink interface {
+	// Begin is called when the relay of a session begins.
+	Begin(ss *MirrorSession)
+	// Data is called with the data relayed from the client if fromClient
+	// is true, or else from the remote host. b must not be retained.
+	Data(ss *MirrorSession, fromClient bool, b []byte)
+	// End is called when the relay of a session ends.
+	End(ss *MirrorSession)
+}
+
+// WithMirror makes the server copy the data relayed for the sessions
+// allowed by the rules with a mirror key (see Rule.Mirror) to sink, up to
+// the limit of the rule. E.g. "allow mirror all" as the last rule mirrors
+// every session.
+func WithMirror(sink MirrorSink) OptionFunc {
+	return func(s *Server) {
+		s.mirror = sink
+	}
+}
+
+// mirroring is the mirror of a session.
+type mirroring struct {
+	sink  MirrorSink
+	ss    *MirrorSession
+	limit int64 // max bytes mirrored, MirrorAll for no limit.
+	sent  atomic.Int64
+}
+
+// startMirror begins mirroring the session if the rule matching its
+// request says so, returning nil otherwise.
+func (s *Server) startMirror(id uint64, client, remote net.Conn, req Request) *mirroring {
+	if s.mirror == nil {
+		return nil
+	}
+	rule := s.matchRule(client, req)
+	if rule == nil || rule.Mirror == 0 {
+		return nil
+	}
+	m := &mirroring{
+		sink: s.mirror,
+		ss: &MirrorSession{
+			ID:      id,
+			Client:  client.RemoteAddr(),
+			Remote:  remote.RemoteAddr(),
+			Request: req,
+			Start:   s.clock.Now(),
+		},
+		limit: rule.Mirror,
+	}
+	m.sink.Begin(m.ss)
+	return m
+}
+
+// data mirrors b, truncated to the limit.
+func (m *mirroring) data(fromClient bool, b []byte) {
+	if m.limit != MirrorAll {
+		n := int64(len(b))
+		after := m.sent.Add(n)
+		before := after - n
+		if before >= m.limit {
+			return
+		}
+		if after > m.limit {
+			b = b[:m.limit-before]
+		}
+	}
+	m.sink.Data(m.ss, fromClient, b)
+}
+
+func (m *mirroring) end() {
+	m.sink.End(m.ss)
+}
+
+// mirrorWriter mirrors the data written to w.
+type mirrorWriter struct {
+	w          io.Writer
+	m          *mirroring
+	fromClient bool
+}
+
+func (w mirrorWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.m.data(w.fromClient, p[:n])
+	}
+	return n, err
+}
@@ -0,0 +1,173 @@
+package socks4
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink records the mirrored sessions.
+type recordingSink struct {
+	mu      sync.Mutex
+	begun   []*MirrorSession
+	client  map[*MirrorSession]string
+	remote  map[*MirrorSession]string
+	ended   chan *MirrorSession
+	invalid bool // data of a session not begun or ended.
+}
+
+func newRecordingSink() *recordingSink {
+	return &recordingSink{client: make(map[*MirrorSession]string), remote: make(map[*MirrorSession]string), ended: make(chan *MirrorSession, 16)}
+}
+
+func (r *recordingSink) Begin(ss *MirrorSession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.begun = append(r.begun, ss)
+}
+
+func (r *recordingSink) Data(ss *MirrorSession, fromClient bool, b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.begun) == 0 || r.begun[len(r.begun)-1] != ss {
+		r.invalid = true
+	}
+	if fromClient {
+		r.client[ss] += string(b)
+	} else {
+		r.remote[ss] += string(b)
+	}
+}
+
+func (r *recordingSink) End(ss *MirrorSession) {
+	r.ended <- ss
+}
+
+func TestMirror(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		rule     string
+		mirrored bool
+		limit    int // of the bytes mirrored in both directions, 0 for all.
+	}{
+		{name: "all", rule: "allow port %v mirror all", mirrored: true},
+		{name: "limit", rule: "allow port %v mirror 4", mirrored: true, limit: 4},
+		{name: "limit beyond the data", rule: "allow port %v mirror 1K", mirrored: true},
+		{name: "not mirrored", rule: "allow port %v"},
+		{name: "other rule", rule: "allow port 1 mirror all"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			echo := echoTarget(t)
+			host, p, _ := net.SplitHostPort(echo.Addr)
+			rules, err := ParseRules(strings.NewReader(strings.ReplaceAll(tt.rule, "%v", p) + "\nallow\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sink := newRecordingSink()
+			_, addr := serve(t, WithRules(rules), WithMirror(sink))
+			port, _ := strconv.Atoi(p)
+			conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEcho(t, conn, []byte("hello"))
+			conn.Close()
+			echo.Close()
+
+			if !tt.mirrored {
+				select {
+				case <-sink.ended:
+					t.Fatal("session mirrored")
+				case <-time.After(100 * time.Millisecond):
+				}
+				if len(sink.begun) != 0 {
+					t.Fatal("session mirrored")
+				}
+				return
+			}
+			var ss *MirrorSession
+			select {
+			case ss = <-sink.ended:
+			case <-time.After(5 * time.Second):
+				t.Fatal("mirror of the session not ended")
+			}
+			sink.mu.Lock()
+			defer sink.mu.Unlock()
+			if len(sink.begun) != 1 || sink.begun[0] != ss || sink.invalid {
+				t.Fatalf("sessions %v begun for %v", sink.begun, ss)
+			}
+			if ss.Client.String() != conn.LocalAddr().String() || ss.Remote.String() != echo.Addr || ss.Request.Port != port {
+				t.Errorf("session %+v, want from %v to %v", ss, conn.LocalAddr(), echo.Addr)
+			}
+			client, remote := sink.client[ss], sink.remote[ss]
+			if tt.limit == 0 {
+				if client != "hello" || remote != "hello" {
+					t.Errorf("mirrored %q from the client and %q from the remote host, want both", client, remote)
+				}
+				return
+			}
+			// the directions share the limit, in the order the data is
+			// relayed.
+			if len(client)+len(remote) != tt.limit || !strings.HasPrefix("hello", client) || !strings.HasPrefix("hello", remote) {
+				t.Errorf("mirrored %q from the client and %q from the remote host, want %v bytes", client, remote, tt.limit)
+			}
+		})
+	}
+}
+
+func TestMirroringLimit(t *testing.T) {
+	for _, tt := range []struct {
+		limit  int64
+		chunks []string
+		want   string
+	}{
+		{limit: MirrorAll, chunks: []string{"hello", " ", "world"}, want: "hello world"},
+		{limit: 5, chunks: []string{"hello", " ", "world"}, want: "hello"},
+		{limit: 7, chunks: []string{"hello", " ", "world"}, want: "hello w"},
+		{limit: 3, chunks: []string{"hello", " ", "world"}, want: "hel"},
+		{limit: 100, chunks: []string{"hello", " ", "world"}, want: "hello world"},
+	} {
+		sink := newRecordingSink()
+		m := &mirroring{sink: sink, ss: &MirrorSession{}, limit: tt.limit}
+		sink.Begin(m.ss)
+		for _, c := range tt.chunks {
+			m.data(true, []byte(c))
+		}
+		if got := sink.client[m.ss]; got != tt.want {
+			t.Errorf("limit %v: mirrored %q, want %q", tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestParseMirrorRule(t *testing.T) {
+	for _, tt := range []struct {
+		in     string
+		mirror int64
+		ok     bool
+	}{
+		{"allow mirror all", MirrorAll, true},
+		{"allow mirror 512", 512, true},
+		{"allow mirror 64K", 64 << 10, true},
+		{"allow mirror 2M", 2 << 20, true},
+		{"allow mirror 1G", 1 << 30, true},
+		{"allow", 0, true},
+		{"allow mirror 0", 0, false},
+		{"allow mirror -1", 0, false},
+		{"allow mirror lots", 0, false},
+		{"allow mirror K", 0, false},
+	} {
+		rule, err := ParseRule(tt.in)
+		if (err == nil) != tt.ok || err == nil && rule.Mirror != tt.mirror {
+			t.Errorf("%q: mirror %v with error %v, want %v", tt.in, rule.Mirror, err, tt.mirror)
+		}
+		if err != nil {
+			continue
+		}
+		if again, err := ParseRule(rule.String()); err != nil || again.Mirror != rule.Mirror {
+			t.Errorf("%q formatted as %q, parsed back with mirror %v: %v", tt.in, rule.String(), again.Mirror, err)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package socks4
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	mrand "math/rand"
+	"net"
+	"sync"
+)
+
+const (
+	obfsNonceSize  = aes.BlockSize
+	obfsHeaderSize = 3     // payload length and padding length.
+	obfsMaxPayload = 16384 // of a frame.
+)
+
+// obfsTransport is the transport of ObfsTransport.
+type obfsTransport struct {
+	key [sha256.Size]byte
+}
+
+// ObfsTransport returns the transport disguising the SOCKS traffic as
+// random bytes for the clients and servers sharing key: each direction
+// starts with a random nonce, and the data is split in frames with random
+// padding, XORed with the AES-CTR keystream of the key and nonce. It
+// hides the protocol from the filters matching it, but neither
+// authenticates the peers nor the data: use TLS for that.
+func ObfsTransport(key []byte) Transport {
+	return &obfsTransport{key: sha256.Sum256(key)}
+}
+
+func (t *obfsTransport) Client(conn net.Conn) (net.Conn, error) {
+	return &obfsConn{Conn: conn, key: t.key[:]}, nil
+}
+
+func (t *obfsTransport) Server(conn net.Conn) (net.Conn, error) {
+	return &obfsConn{Conn: conn, key: t.key[:]}, nil
+}
+
+// obfsConn is a connection of ObfsTransport.
+type obfsConn struct {
+	net.Conn
+	key []byte
+
+	rmu     sync.Mutex
+	rs      cipher.Stream // nil until the nonce of the peer is read.
+	pending []byte        // payload read and not returned yet.
+
+	wmu sync.Mutex
+	ws  cipher.Stream // nil until the nonce is written.
+}
+
+func (c *obfsConn) stream(nonce []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, nonce), nil
+}
+
+func (c *obfsConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if c.rs == nil {
+		nonce := make([]byte, obfsNonceSize)
+		if _, err := io.ReadFull(c.Conn, nonce); err != nil {
+			return 0, err
+		}
+		rs, err := c.stream(nonce)
+		if err != nil {
+			return 0, err
+		}
+		c.rs = rs
+	}
+	// the frames of padding only carry no payload.
+	for len(c.pending) == 0 {
+		var header [obfsHeaderSize]byte
+		if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+			return 0, err
+		}
+		c.rs.XORKeyStream(header[:], header[:])
+		n, pad := int(binary.BigEndian.Uint16(header[:2])), int(header[2])
+		if n > obfsMaxPayload {
+			return 0, errors.New("invalid obfuscated frame")
+		}
+		frame := make([]byte, n+pad)
+		if _, err := io.ReadFull(c.Conn, frame); err != nil {
+			return 0, noEOF(err)
+		}
+		c.rs.XORKeyStream(frame, frame)
+		c.pending = frame[:n]
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *obfsConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	// the nonce goes with the first payload.
+	if len(b) == 0 {
+		return 0, nil
+	}
+	var out []byte
+	if c.ws == nil {
+		nonce := make([]byte, obfsNonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return 0, err
+		}
+		ws, err := c.stream(nonce)
+		if err != nil {
+			return 0, err
+		}
+		c.ws = ws
+		out = nonce
+	}
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > obfsMaxPayload {
+			n = obfsMaxPayload
+		}
+		pad := mrand.Intn(256)
+		start := len(out)
+		out = append(out, byte(n>>8), byte(n), byte(pad))
+		out = append(out, b[:n]...)
+		out = append(out, make([]byte, pad)...)
+		c.ws.XORKeyStream(out[start:], out[start:])
+		if _, err := c.Conn.Write(out); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+		out = out[:0]
+	}
+	return written, nil
+}
+
+// noEOF turns the EOF in the middle of a frame into io.ErrUnexpectedEOF.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,51 @@
+package socks4
+
+import (
+	"context"
+	"net"
+)
+
+// OutboundSession is the session of the connections dialed and the names
+// resolved by the server, carried by the contexts passed to the Resolver
+// and the ContextNetwork, e.g. for chained upstream dialers correlating
+// their logs with the access log of the proxy.
+type OutboundSession struct {
+	ID      uint64  // ID of the session, see SessionInfo.
+	Request Request // request of the client, once rewritten.
+}
+
+type outboundSessionKey struct{}
+
+// OutboundSessionFromContext returns the session of the dial or lookup of
+// ctx. ok is false for those of no session, like the startup checks.
+func OutboundSessionFromContext(ctx context.Context) (ss OutboundSession, ok bool) {
+	ss, ok = ctx.Value(outboundSessionKey{}).(OutboundSession)
+	return ss, ok
+}
+
+// ContextNetwork is a Network dialing with a context, which carries the
+// OutboundSession of the dial (see OutboundSessionFromContext) and the dial
+// timeout. The server calls DialContext in place of Dial.
+type ContextNetwork interface {
+	Network
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// context returns the context of the dials and lookups of the origin,
+// with the session if any and the dial timeout.
+func (o origin) context(s *Server) (context.Context, context.CancelFunc) {
+	ctx := context.Background()
+	if o.session != 0 {
+		ctx = context.WithValue(ctx, outboundSessionKey{}, OutboundSession{ID: o.session, Request: o.req})
+	}
+	if timeout := s.dialTimeout(); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// origin returns the origin of the dials and lookups of the request of
+// the session.
+func (ss *session) origin(conn net.Conn, req Request) origin {
+	return origin{client: clientIP(conn), userId: req.UserId, resolved: req.Resolved, session: ss.id, req: req}
+}
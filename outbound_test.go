@@ -0,0 +1,119 @@
+package socks4
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOriginContext(t *testing.T) {
+	req := Request{Cmd: CmdConnect, Address: "example.com:80", UserId: "alice"}
+	for _, tt := range []struct {
+		name     string
+		o        origin
+		timeout  time.Duration
+		session  bool
+		deadline bool
+	}{
+		{name: "session", o: origin{session: 7, req: req}, session: true},
+		{name: "session with a dial timeout", o: origin{session: 7, req: req}, timeout: time.Minute, session: true, deadline: true},
+		{name: "no session", o: origin{}},
+		{name: "no session with a dial timeout", o: origin{}, timeout: time.Minute, deadline: true},
+	} {
+		ctx, cancel := tt.o.context(newTestServer(WithDialTimeout(tt.timeout)))
+		ss, ok := OutboundSessionFromContext(ctx)
+		if ok != tt.session || (ok && (ss.ID != tt.o.session || ss.Request.Address != req.Address || ss.Request.UserId != req.UserId)) {
+			t.Errorf("%v: session %+v (%v), want %v", tt.name, ss, ok, tt.session)
+		}
+		if _, deadline := ctx.Deadline(); deadline != tt.deadline {
+			t.Errorf("%v: deadline %v, want %v", tt.name, deadline, tt.deadline)
+		}
+		cancel()
+		if ctx.Err() == nil {
+			t.Errorf("%v: context not canceled", tt.name)
+		}
+	}
+}
+
+// sessionRecorder records the sessions of the contexts of the dials and
+// lookups of the server.
+type sessionRecorder struct {
+	systemNetwork
+	mu       sync.Mutex
+	dials    []OutboundSession
+	lookups  []OutboundSession
+	resolved map[string]string
+}
+
+func (r *sessionRecorder) record(ctx context.Context, to *[]OutboundSession) {
+	ss, _ := OutboundSessionFromContext(ctx)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*to = append(*to, ss)
+}
+
+func (r *sessionRecorder) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	r.record(ctx, &r.dials)
+	var d net.Dialer
+	return d.DialContext(ctx, network, address)
+}
+
+func (r *sessionRecorder) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.record(ctx, &r.lookups)
+	return []net.IPAddr{{IP: net.ParseIP(r.resolved[host])}}, nil
+}
+
+// plainNetwork is a Network without DialContext.
+type plainNetwork struct {
+	systemNetwork
+}
+
+func TestOutboundSession(t *testing.T) {
+	echo := echoTarget(t)
+	_, port, _ := net.SplitHostPort(echo.Addr)
+	for _, tt := range []struct {
+		name    string
+		target  string
+		plain   bool // the network has no DialContext.
+		lookups int
+	}{
+		{name: "address", target: echo.Addr},
+		{name: "name", target: net.JoinHostPort("echo.example.com", port), lookups: 1},
+		{name: "network without context", target: net.JoinHostPort("echo.example.com", port), plain: true, lookups: 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &sessionRecorder{resolved: map[string]string{"echo.example.com": "127.0.0.1"}}
+			var n Network = r
+			if tt.plain {
+				n = plainNetwork{}
+			}
+			s, addr := serve(t, WithNetwork(n), WithResolver(r))
+			conn, err := NewDialer(addr, WithDialerUserId("alice"), WithDialerTimeout(5*time.Second)).Dial("tcp", tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			assertEcho(t, conn, []byte("hello"))
+			sessions := s.Sessions()
+			if len(sessions) != 1 {
+				t.Fatalf("%v sessions, want 1", len(sessions))
+			}
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			dials := 1
+			if tt.plain {
+				dials = 0
+			}
+			if len(r.dials) != dials || len(r.lookups) != tt.lookups {
+				t.Fatalf("%v dials and %v lookups, want %v and %v", len(r.dials), len(r.lookups), dials, tt.lookups)
+			}
+			for _, ss := range append(r.dials, r.lookups...) {
+				if ss.ID != sessions[0].ID || ss.Request.UserId != "alice" || ss.Request.Cmd != CmdConnect {
+					t.Errorf("session %+v, want the request of session %v", ss, sessions[0].ID)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package socks4
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// PAMConfig is the configuration of the PAM checks of the user ids, see
+// WithPAM.
+type PAMConfig struct {
+	// Service is the PAM service checking the accounts, configured by
+	// /etc/pam.d/<Service>, "socks4" if empty.
+	Service string
+	// Separator splits the user ids like "alice:secret" into the account
+	// and the secret the service authenticates it with, its password for
+	// pam_unix. The accounts are only checked by the account management of
+	// the service if empty.
+	Separator string
+}
+
+// errPAMUnsupported is the error of the PAM checks of the binaries built
+// without PAM.
+var errPAMUnsupported = errors.New("PAM is not supported by this build, see the pam build tag")
+
+// WithPAM makes the server check the user ids of the SOCKS 4 requests
+// against the local accounts through PAM, so that the policy of the system
+// accounts, like their expiry or pam_access, applies to the proxy. With a
+// separator the user ids carry a secret authenticating the account, which
+// is removed from them once checked, not to reach the rules and the logs.
+// The requests failing the checks are rejected with RejectWrongUserId.
+//
+// PAM is only supported on Linux, by the binaries built with cgo and the
+// pam build tag, see PAMSupported; the requests are rejected otherwise.
+func WithPAM(config PAMConfig) OptionFunc {
+	return func(s *Server) {
+		if config.Service == "" {
+			config.Service = "socks4"
+		}
+		s.pam = &config
+	}
+}
+
+// checkPAM returns the request with the account of its user id once PAM
+// checks it.
+func (s *Server) checkPAM(req Request) (Request, error) {
+	if s.pam == nil || req.Version != Version4 {
+		return req, nil
+	}
+	account, secret := req.UserId, ""
+	if s.pam.Separator != "" {
+		var ok bool
+		if account, secret, ok = strings.Cut(req.UserId, s.pam.Separator); !ok {
+			// the whole user id may be a secret sent without its account.
+			return s.maskUserId(req), fmt.Errorf("%w: no secret in the user id", ErrUserIdRejected)
+		}
+		req.UserId = account
+	}
+	if account == "" {
+		return req, fmt.Errorf("%w: empty user id", ErrUserIdRejected)
+	}
+	if err := pamCheck(s.pam.Service, account, secret, s.pam.Separator != ""); err != nil {
+		if errors.Is(err, errPAMUnsupported) {
+			return req, err
+		}
+		return req, fmt.Errorf("%w: PAM: %v", ErrUserIdRejected, err)
+	}
+	return req, nil
+}
@@ -0,0 +1,82 @@
+//go:build linux && cgo && pam
+
+package socks4
+
+/*
+#cgo LDFLAGS: -lpam
+#include <security/pam_appl.h>
+#include <stdlib.h>
+#include <string.h>
+
+// socks4_pam_conv answers the prompts of the modules by the secret.
+static int socks4_pam_conv(int n, const struct pam_message **msg, struct pam_response **resp, void *secret) {
+	struct pam_response *r = calloc(n, sizeof(struct pam_response));
+	if (r == NULL) {
+		return PAM_BUF_ERR;
+	}
+	for (int i = 0; i < n; i++) {
+		int style = msg[i]->msg_style;
+		if (style != PAM_PROMPT_ECHO_OFF && style != PAM_PROMPT_ECHO_ON) {
+			continue;
+		}
+		if (secret == NULL || (r[i].resp = strdup(secret)) == NULL) {
+			for (int j = 0; j < i; j++) {
+				free(r[j].resp);
+			}
+			free(r);
+			return PAM_CONV_ERR;
+		}
+	}
+	*resp = r;
+	return PAM_SUCCESS;
+}
+
+static int socks4_pam_start(const char *service, const char *user, char *secret, pam_handle_t **h) {
+	struct pam_conv conv = {socks4_pam_conv, secret};
+	return pam_start(service, user, &conv, h);
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// PAMSupported reports whether the binary checks the user ids through
+// PAM, see WithPAM.
+const PAMSupported = true
+
+// pamCheck checks the account by the account management of the service,
+// after authenticating it by the secret if authenticate.
+func pamCheck(service, account, secret string, authenticate bool) error {
+	cService, cAccount := C.CString(service), C.CString(account)
+	defer C.free(unsafe.Pointer(cService))
+	defer C.free(unsafe.Pointer(cAccount))
+	var cSecret *C.char
+	if authenticate {
+		cSecret = C.CString(secret)
+		defer func() {
+			C.memset(unsafe.Pointer(cSecret), 0, C.size_t(len(secret)))
+			C.free(unsafe.Pointer(cSecret))
+		}()
+	}
+
+	var h *C.pam_handle_t
+	if rc := C.socks4_pam_start(cService, cAccount, cSecret, &h); rc != C.PAM_SUCCESS {
+		return errors.New("can't start PAM transaction")
+	}
+	rc := C.int(C.PAM_SUCCESS)
+	if authenticate {
+		rc = C.pam_authenticate(h, C.PAM_SILENT|C.PAM_DISALLOW_NULL_AUTHTOK)
+	}
+	if rc == C.PAM_SUCCESS {
+		rc = C.pam_acct_mgmt(h, C.PAM_SILENT|C.PAM_DISALLOW_NULL_AUTHTOK)
+	}
+	var err error
+	if rc != C.PAM_SUCCESS {
+		err = errors.New(C.GoString(C.pam_strerror(h, rc)))
+	}
+	C.pam_end(h, rc)
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux || !cgo || !pam
+
+package socks4
+
+// PAMSupported reports whether the binary checks the user ids through
+// PAM, see WithPAM.
+const PAMSupported = false
+
+func pamCheck(service, account, secret string, authenticate bool) error {
+	return errPAMUnsupported
+}
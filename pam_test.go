@@ -0,0 +1,59 @@
+package socks4
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithPAM(t *testing.T) {
+	s := newTestServer(WithPAM(PAMConfig{}))
+	if s.pam.Service != "socks4" {
+		t.Errorf("service %q, want socks4", s.pam.Service)
+	}
+	s = newTestServer(WithPAM(PAMConfig{Service: "login", Separator: ":"}))
+	if s.pam.Service != "login" || s.pam.Separator != ":" {
+		t.Errorf("config %+v, want the login service", *s.pam)
+	}
+}
+
+func TestCheckPAM(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		opts   []OptionFunc
+		req    Request
+		userId string // of the returned request.
+		err    error  // none if nil.
+	}{
+		{name: "no PAM", req: Request{Version: Version4, UserId: "alice:secret"}, userId: "alice:secret"},
+		{name: "SOCKS 5", opts: []OptionFunc{WithPAM(PAMConfig{Separator: ":"})}, req: Request{Version: Version5, UserId: "alice"}, userId: "alice"},
+		{name: "account", opts: []OptionFunc{WithPAM(PAMConfig{})}, req: Request{Version: Version4, UserId: "alice"}, userId: "alice", err: errPAMUnsupported},
+		{name: "account and secret", opts: []OptionFunc{WithPAM(PAMConfig{Separator: ":"})}, req: Request{Version: Version4, UserId: "alice:secret:more"}, userId: "alice", err: errPAMUnsupported},
+		{name: "empty account", opts: []OptionFunc{WithPAM(PAMConfig{})}, req: Request{Version: Version4}, err: ErrUserIdRejected},
+		{name: "empty account with a secret", opts: []OptionFunc{WithPAM(PAMConfig{Separator: ":"})}, req: Request{Version: Version4, UserId: ":secret"}, err: ErrUserIdRejected},
+		{name: "no secret", opts: []OptionFunc{WithPAM(PAMConfig{Separator: ":"})}, req: Request{Version: Version4, UserId: "secret"}, userId: "******", err: ErrUserIdRejected},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := newTestServer(tt.opts...).checkPAM(tt.req)
+			if tt.err == nil && err != nil || tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if req.UserId != tt.userId {
+				t.Errorf("user id %q, want %q", req.UserId, tt.userId)
+			}
+		})
+	}
+}
+
+func TestPAMRejected(t *testing.T) {
+	if PAMSupported {
+		t.Skip("PAM checks the local accounts")
+	}
+	echo := echoTarget(t)
+	_, addr := serve(t, WithPAM(PAMConfig{Separator: ":"}))
+	d := NewDialer(addr, WithDialerUserId("alice:secret"), WithDialerTimeout(5*time.Second))
+	var rej *RejectError
+	if _, err := d.Dial("tcp", echo.Addr); !errors.As(err, &rej) {
+		t.Errorf("error %v, want the request rejected by a build without PAM", err)
+	}
+}
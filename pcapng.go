@@ -0,0 +1,241 @@
+package socks4
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	pcapngSectionHeader    = 0x0a0d0d0a
+	pcapngInterface        = 0x00000001
+	pcapngEnhancedPacket   = 0x00000006
+	pcapngByteOrderMagic   = 0x1a2b3c4d
+	pcapngLinkTypeRaw      = 101   // LINKTYPE_RAW, packets start with an IPv4 or IPv6 header.
+	pcapngMaxSegment       = 65000 // max TCP payload of a packet.
+	tcpFlagFIN, tcpFlagSYN = 0x01, 0x02
+	tcpFlagPSH, tcpFlagACK = 0x08, 0x10
+)
+
+// PcapngSink is a MirrorSink writing the mirrored sessions in the pcapng
+// format, readable by Wireshark, tcpdump or an IDS. Each session is
+// recorded as a TCP connection between the client and the remote host,
+// with a handshake, the relayed data and a close, so that the tools
+// reassemble the streams.
+type PcapngSink struct {
+	mu    sync.Mutex
+	w     io.Writer
+	flows map[*MirrorSession]*pcapngFlow
+}
+
+// pcapngFlow is the TCP state of a recorded session.
+type pcapngFlow struct {
+	client, remote *net.TCPAddr
+	clientSeq      uint32 // next sequence number from the client.
+	remoteSeq      uint32 // next sequence number from the remote host.
+}
+
+// NewPcapngSink writes the section and interface headers to w and returns
+// a sink writing the mirrored sessions to it. A file may be appended to,
+// each run starting a new section.
+func NewPcapngSink(w io.Writer) (*PcapngSink, error) {
+	shb := make([]byte, 0, 28)
+	shb = binary.LittleEndian.AppendUint32(shb, pcapngSectionHeader)
+	shb = binary.LittleEndian.AppendUint32(shb, 28)
+	shb = binary.LittleEndian.AppendUint32(shb, pcapngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1) // major version.
+	shb = binary.LittleEndian.AppendUint16(shb, 0) // minor version.
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	shb = binary.LittleEndian.AppendUint32(shb, 28)
+
+	idb := make([]byte, 0, 20)
+	idb = binary.LittleEndian.AppendUint32(idb, pcapngInterface)
+	idb = binary.LittleEndian.AppendUint32(idb, 20)
+	idb = binary.LittleEndian.AppendUint16(idb, pcapngLinkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0) // no snap length.
+	idb = binary.LittleEndian.AppendUint32(idb, 20)
+
+	if _, err := w.Write(append(shb, idb...)); err != nil {
+		return nil, err
+	}
+	return &PcapngSink{w: w, flows: make(map[*MirrorSession]*pcapngFlow)}, nil
+}
+
+// Begin records the handshake of the session.
+func (p *PcapngSink) Begin(ss *MirrorSession) {
+	f := &pcapngFlow{
+		client:    tcpAddrOf(ss.Client),
+		remote:    tcpAddrOf(ss.Remote),
+		clientSeq: uint32(ss.ID * 7919),
+		remoteSeq: uint32(ss.ID * 104729),
+	}
+	// both ends share the IP family of the packets, IPv6 unless both are
+	// IPv4.
+	if client, remote := f.client.IP.To4(), f.remote.IP.To4(); client != nil && remote != nil {
+		f.client.IP, f.remote.IP = client, remote
+	} else {
+		f.client.IP, f.remote.IP = f.client.IP.To16(), f.remote.IP.To16()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flows[ss] = f
+	p.packet(f, true, tcpFlagSYN, nil)
+	f.clientSeq++
+	p.packet(f, false, tcpFlagSYN|tcpFlagACK, nil)
+	f.remoteSeq++
+	p.packet(f, true, tcpFlagACK, nil)
+}
+
+// Data records the data as packets of the session.
+func (p *PcapngSink) Data(ss *MirrorSession, fromClient bool, b []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := p.flows[ss]
+	if f == nil {
+		return
+	}
+	for len(b) > 0 {
+		n := len(b)
+		if n > pcapngMaxSegment {
+			n = pcapngMaxSegment
+		}
+		p.packet(f, fromClient, tcpFlagPSH|tcpFlagACK, b[:n])
+		if fromClient {
+			f.clientSeq += uint32(n)
+		} else {
+			f.remoteSeq += uint32(n)
+		}
+		b = b[n:]
+	}
+}
+
+// End records the close of the session.
+func (p *PcapngSink) End(ss *MirrorSession) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f := p.flows[ss]
+	if f == nil {
+		return
+	}
+	delete(p.flows, ss)
+	p.packet(f, true, tcpFlagFIN|tcpFlagACK, nil)
+	f.clientSeq++
+	p.packet(f, false, tcpFlagFIN|tcpFlagACK, nil)
+	f.remoteSeq++
+	p.packet(f, true, tcpFlagACK, nil)
+}
+
+// packet writes an enhanced packet block of a TCP segment of the flow.
+// Write errors are ignored, the mirror must not affect the relays.
+func (p *PcapngSink) packet(f *pcapngFlow, fromClient bool, flags byte, payload []byte) {
+	src, dst := f.client, f.remote
+	seq, ack := f.clientSeq, f.remoteSeq
+	if !fromClient {
+		src, dst = dst, src
+		seq, ack = ack, seq
+	}
+	if flags&tcpFlagACK == 0 {
+		ack = 0
+	}
+	pkt := ipPacket(src, dst, tcpSegment(src, dst, seq, ack, flags, payload))
+
+	pad := (4 - len(pkt)%4) % 4
+	size := 32 + len(pkt) + pad
+	now := uint64(time.Now().UnixMicro())
+	b := make([]byte, 0, size)
+	b = binary.LittleEndian.AppendUint32(b, pcapngEnhancedPacket)
+	b = binary.LittleEndian.AppendUint32(b, uint32(size))
+	b = binary.LittleEndian.AppendUint32(b, 0) // interface ID.
+	b = binary.LittleEndian.AppendUint32(b, uint32(now>>32))
+	b = binary.LittleEndian.AppendUint32(b, uint32(now))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(pkt)))
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(pkt)))
+	b = append(b, pkt...)
+	b = append(b, make([]byte, pad)...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(size))
+	p.w.Write(b)
+}
+
+// tcpAddrOf returns the TCP address of addr, with the unspecified IP if
+// its host is not an IP, like the domain name of an upstream target.
+func tcpAddrOf(addr net.Addr) *net.TCPAddr {
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return &net.TCPAddr{IP: a.IP, Port: a.Port}
+	}
+	a := &net.TCPAddr{IP: net.IPv4zero}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return a
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		a.IP = ip
+	}
+	a.Port, _ = net.LookupPort("tcp", port)
+	return a
+}
+
+// tcpSegment returns a TCP segment with its checksum, the IPs of the flow
+// being of the same length.
+func tcpSegment(src, dst *net.TCPAddr, seq, ack uint32, flags byte, payload []byte) []byte {
+	b := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(b[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(b[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(b[4:], seq)
+	binary.BigEndian.PutUint32(b[8:], ack)
+	b[12] = 5 << 4 // data offset.
+	b[13] = flags
+	binary.BigEndian.PutUint16(b[14:], 65535) // window.
+	b = append(b, payload...)
+
+	// the checksum covers a pseudo header of the IP addresses.
+	sum := checksumAdd(0, src.IP)
+	sum = checksumAdd(sum, dst.IP)
+	sum += 6 + uint32(len(b))
+	binary.BigEndian.PutUint16(b[16:], checksumFold(checksumAdd(sum, b)))
+	return b
+}
+
+// ipPacket returns an IPv4 or IPv6 packet of the TCP segment, by the length
+// of the IPs of the flow.
+func ipPacket(src, dst *net.TCPAddr, segment []byte) []byte {
+	if len(src.IP) == net.IPv4len {
+		b := make([]byte, 20, 20+len(segment))
+		b[0] = 0x45 // version 4, header of 5 words.
+		binary.BigEndian.PutUint16(b[2:], uint16(20+len(segment)))
+		b[6] = 0x40 // don't fragment.
+		b[8] = 64   // TTL.
+		b[9] = 6    // TCP.
+		copy(b[12:], src.IP)
+		copy(b[16:], dst.IP)
+		binary.BigEndian.PutUint16(b[10:], checksumFold(checksumAdd(0, b)))
+		return append(b, segment...)
+	}
+	b := make([]byte, 40, 40+len(segment))
+	b[0] = 0x60 // version 6.
+	binary.BigEndian.PutUint16(b[4:], uint16(len(segment)))
+	b[6] = 6  // TCP.
+	b[7] = 64 // hop limit.
+	copy(b[8:], src.IP)
+	copy(b[24:], dst.IP)
+	return append(b, segment...)
+}
+
+func checksumAdd(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
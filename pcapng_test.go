@@ -0,0 +1,167 @@
+package socks4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// pcapngPackets parses the blocks of a pcapng section and returns the
+// packets of its enhanced packet blocks.
+func pcapngPackets(t *testing.T, b []byte) [][]byte {
+	t.Helper()
+	var packets [][]byte
+	for i := 0; len(b) > 0; i++ {
+		if len(b) < 12 {
+			t.Fatalf("block %v truncated: %x", i, b)
+		}
+		typ, size := binary.LittleEndian.Uint32(b), binary.LittleEndian.Uint32(b[4:])
+		if size%4 != 0 || int(size) > len(b) || binary.LittleEndian.Uint32(b[size-4:]) != size {
+			t.Fatalf("block %v of type %#x: invalid length %v", i, typ, size)
+		}
+		switch {
+		case i == 0:
+			if typ != pcapngSectionHeader || binary.LittleEndian.Uint32(b[8:]) != pcapngByteOrderMagic {
+				t.Fatalf("first block %x, want a section header", b[:size])
+			}
+		case i == 1:
+			if typ != pcapngInterface || binary.LittleEndian.Uint16(b[8:]) != pcapngLinkTypeRaw {
+				t.Fatalf("second block %x, want an interface of raw IP", b[:size])
+			}
+		case typ == pcapngEnhancedPacket:
+			n := binary.LittleEndian.Uint32(b[20:])
+			if n != binary.LittleEndian.Uint32(b[24:]) || 28+n > size-4 {
+				t.Fatalf("block %v: invalid packet length %v", i, n)
+			}
+			packets = append(packets, b[28:28+n])
+		default:
+			t.Fatalf("block %v of unknown type %#x", i, typ)
+		}
+		b = b[size:]
+	}
+	return packets
+}
+
+// tcpPacket is a TCP packet parsed from its IP packet.
+type tcpPacket struct {
+	src, dst net.TCPAddr
+	seq, ack uint32
+	flags    byte
+	payload  []byte
+}
+
+// parseTCPPacket parses an IP packet of a TCP segment and checks its
+// checksums.
+func parseTCPPacket(t *testing.T, b []byte) tcpPacket {
+	t.Helper()
+	var p tcpPacket
+	var seg []byte
+	var sum uint32
+	switch b[0] >> 4 {
+	case 4:
+		if checksumFold(checksumAdd(0, b[:20])) != 0 || int(binary.BigEndian.Uint16(b[2:])) != len(b) || b[9] != 6 {
+			t.Fatalf("invalid IPv4 header %x", b[:20])
+		}
+		p.src.IP, p.dst.IP = net.IP(b[12:16]), net.IP(b[16:20])
+		seg = b[20:]
+	case 6:
+		if int(binary.BigEndian.Uint16(b[4:]))+40 != len(b) || b[6] != 6 {
+			t.Fatalf("invalid IPv6 header %x", b[:40])
+		}
+		p.src.IP, p.dst.IP = net.IP(b[8:24]), net.IP(b[24:40])
+		seg = b[40:]
+	default:
+		t.Fatalf("packet %x not of IPv4 or IPv6", b)
+	}
+	sum = checksumAdd(checksumAdd(0, p.src.IP), p.dst.IP) + 6 + uint32(len(seg))
+	if checksumFold(checksumAdd(sum, seg)) != 0 {
+		t.Fatalf("invalid TCP checksum of %x", seg[:20])
+	}
+	p.src.Port, p.dst.Port = int(binary.BigEndian.Uint16(seg)), int(binary.BigEndian.Uint16(seg[2:]))
+	p.seq, p.ack = binary.BigEndian.Uint32(seg[4:]), binary.BigEndian.Uint32(seg[8:])
+	p.flags = seg[13]
+	p.payload = seg[20:]
+	return p
+}
+
+func TestPcapngSink(t *testing.T) {
+	large := strings.Repeat("x", pcapngMaxSegment+1000)
+	for _, tt := range []struct {
+		name           string
+		client, remote net.Addr
+		version        byte   // of the IP packets.
+		src, dst       string // of the packets from the client.
+	}{
+		{name: "IPv4", client: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000}, remote: &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 80}, version: 4, src: "192.0.2.1:50000", dst: "198.51.100.1:80"},
+		{name: "IPv6", client: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 50000}, remote: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}, version: 6, src: "[2001:db8::1]:50000", dst: "[2001:db8::2]:443"},
+		{name: "mixed families", client: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000}, remote: &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}, version: 6, src: "192.0.2.1:50000", dst: "[2001:db8::2]:443"},
+		{name: "domain name", client: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 50000}, remote: addrString("example.com:443"), version: 4, src: "192.0.2.1:50000", dst: "0.0.0.0:443"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			p, err := NewPcapngSink(&b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ss := &MirrorSession{ID: 1, Client: tt.client, Remote: tt.remote}
+			p.Begin(ss)
+			p.Data(ss, true, []byte("GET / HTTP/1.0\r\n\r\n"))
+			p.Data(ss, false, []byte(large))
+			p.End(ss)
+			// data of the sessions ended is ignored.
+			p.Data(ss, true, []byte("late"))
+
+			packets := pcapngPackets(t, b.Bytes())
+			flags := []byte{
+				tcpFlagSYN, tcpFlagSYN | tcpFlagACK, tcpFlagACK,
+				tcpFlagPSH | tcpFlagACK, tcpFlagPSH | tcpFlagACK, tcpFlagPSH | tcpFlagACK,
+				tcpFlagFIN | tcpFlagACK, tcpFlagFIN | tcpFlagACK, tcpFlagACK,
+			}
+			fromClient := []bool{true, false, true, true, false, false, true, false, true}
+			if len(packets) != len(flags) {
+				t.Fatalf("%v packets, want %v", len(packets), len(flags))
+			}
+			// the next sequence number of each direction.
+			next := make(map[bool]uint32)
+			streams := make(map[bool]string)
+			for i, b := range packets {
+				if b[0]>>4 != tt.version {
+					t.Fatalf("packet %v of IP version %v, want %v", i, b[0]>>4, tt.version)
+				}
+				pkt := parseTCPPacket(t, b)
+				src, dst := tt.src, tt.dst
+				if !fromClient[i] {
+					src, dst = dst, src
+				}
+				if pkt.src.String() != src || pkt.dst.String() != dst || pkt.flags != flags[i] {
+					t.Fatalf("packet %v from %v to %v with flags %#x, want from %v to %v with %#x", i, &pkt.src, &pkt.dst, pkt.flags, src, dst, flags[i])
+				}
+				if seq, ok := next[fromClient[i]]; ok && pkt.seq != seq {
+					t.Errorf("packet %v: sequence number %v, want %v", i, pkt.seq, seq)
+				}
+				if peer, ok := next[!fromClient[i]]; ok && pkt.ack != peer {
+					t.Errorf("packet %v: acknowledgment number %v, want %v", i, pkt.ack, peer)
+				}
+				next[fromClient[i]] = pkt.seq + uint32(len(pkt.payload))
+				if pkt.flags&(tcpFlagSYN|tcpFlagFIN) != 0 {
+					next[fromClient[i]]++
+				}
+				if len(pkt.payload) > pcapngMaxSegment {
+					t.Errorf("packet %v of %v bytes", i, len(pkt.payload))
+				}
+				streams[fromClient[i]] += string(pkt.payload)
+			}
+			if streams[true] != "GET / HTTP/1.0\r\n\r\n" || streams[false] != large {
+				t.Errorf("streams of %v and %v bytes, want the data of the session", len(streams[true]), len(streams[false]))
+			}
+		})
+	}
+}
+
+// addrString is a net.Addr of a host name.
+type addrString string
+
+func (a addrString) Network() string { return "tcp" }
+func (a addrString) String() string  { return string(a) }
@@ -0,0 +1,210 @@
+package socks4
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StoreCounter is a counter of a store, as saved by a PersistentStore.
+type StoreCounter struct {
+	Key     string
+	Value   int64
+	Expires time.Time // zero for no expiry.
+}
+
+// StoreSnapshotter saves and loads the counters of a PersistentStore, e.g.
+// in a database.
+type StoreSnapshotter interface {
+	// Save replaces the saved counters with counters.
+	Save(counters []StoreCounter) error
+	// Load returns the saved counters.
+	Load() ([]StoreCounter, error)
+}
+
+// PersistentStore is a MemoryStore restored from a StoreSnapshotter when
+// created and saved to it periodically and when closed, so that the bans
+// and the rate limits survive the restarts of the server.
+type PersistentStore struct {
+	*MemoryStore
+	snap    StoreSnapshotter
+	logger  Logger
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+// NewPersistentStore creates a store with the counters saved in snap, saved
+// again every interval, or only when closed if it is 0. Save errors are
+// logged to logger if it is not nil. Close it to save the last counters.
+func NewPersistentStore(snap StoreSnapshotter, interval time.Duration, logger Logger) (*PersistentStore, error) {
+	counters, err := snap.Load()
+	if err != nil {
+		return nil, fmt.Errorf("load counters: %v", err)
+	}
+	p := &PersistentStore{
+		MemoryStore: NewMemoryStore(),
+		snap:        snap,
+		logger:      logger,
+		done:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	p.restore(counters)
+	go p.snapshotLoop(interval)
+	return p, nil
+}
+
+// Snapshot saves the counters.
+func (p *PersistentStore) Snapshot() error {
+	return p.snap.Save(p.counters())
+}
+
+// Close stops the periodic snapshots and saves the counters.
+func (p *PersistentStore) Close() error {
+	p.once.Do(func() { close(p.done) })
+	<-p.stopped
+	return p.Snapshot()
+}
+
+func (p *PersistentStore) snapshotLoop(interval time.Duration) {
+	defer close(p.stopped)
+	if interval <= 0 {
+		<-p.done
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.Snapshot(); err != nil && p.logger != nil {
+				p.logger.Errorf("store: save counters: %v", err)
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// counters returns the counters which have not expired.
+func (m *MemoryStore) counters() []StoreCounter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	counters := make([]StoreCounter, 0, len(m.entries))
+	for key, e := range m.entries {
+		if !e.expired(now) {
+			counters = append(counters, StoreCounter{Key: key, Value: e.value, Expires: e.expires})
+		}
+	}
+	return counters
+}
+
+// restore sets the counters which have not expired.
+func (m *MemoryStore) restore(counters []StoreCounter) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for _, c := range counters {
+		e := &storeEntry{value: c.Value, expires: c.Expires}
+		if !e.expired(now) {
+			m.entries[c.Key] = e
+		}
+	}
+	m.prune(now)
+}
+
+// maxSnapshotRows is the max rows inserted by a statement, within the 999
+// parameters of the old SQLite versions.
+const maxSnapshotRows = 200
+
+// SQLStoreSnapshotter is a StoreSnapshotter in the socks4_counters table of
+// a SQL database, created if it does not exist. The counters of several
+// stores are told apart by their scope.
+type SQLStoreSnapshotter struct {
+	db      *sql.DB
+	dialect string
+	scope   string
+}
+
+// NewSQLStoreSnapshotter creates a snapshotter of the counters of the scope,
+// like the name of a proxy instance, in db, whose dialect is "sqlite" or
+// "postgres".
+func NewSQLStoreSnapshotter(db *sql.DB, dialect, scope string) (*SQLStoreSnapshotter, error) {
+	if dialect != "sqlite" && dialect != "postgres" {
+		return nil, fmt.Errorf("unsupported SQL dialect %q", dialect)
+	}
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS socks4_counters (
+	scope TEXT NOT NULL,
+	name TEXT NOT NULL,
+	value BIGINT NOT NULL,
+	expires TEXT NOT NULL,
+	PRIMARY KEY (scope, name)
+)`)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStoreSnapshotter{db: db, dialect: dialect, scope: scope}, nil
+}
+
+func (s *SQLStoreSnapshotter) Save(counters []StoreCounter) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM socks4_counters WHERE scope = `+sqlPlaceholders(s.dialect, 0, 1), s.scope); err != nil {
+		return err
+	}
+	const columns = 4
+	for len(counters) > 0 {
+		rows := counters
+		if len(rows) > maxSnapshotRows {
+			rows = rows[:maxSnapshotRows]
+		}
+		counters = counters[len(rows):]
+		var b strings.Builder
+		b.WriteString(`INSERT INTO socks4_counters (scope, name, value, expires) VALUES `)
+		args := make([]any, 0, columns*len(rows))
+		for i, c := range rows {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(sqlPlaceholders(s.dialect, len(args), columns))
+			expires := ""
+			if !c.Expires.IsZero() {
+				expires = c.Expires.UTC().Format(auditTimeFormat)
+			}
+			args = append(args, s.scope, c.Key, c.Value, expires)
+		}
+		if _, err := tx.Exec(b.String(), args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStoreSnapshotter) Load() ([]StoreCounter, error) {
+	rows, err := s.db.Query(`SELECT name, value, expires FROM socks4_counters WHERE scope = `+sqlPlaceholders(s.dialect, 0, 1), s.scope)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var counters []StoreCounter
+	for rows.Next() {
+		var c StoreCounter
+		var expires string
+		if err := rows.Scan(&c.Key, &c.Value, &expires); err != nil {
+			return nil, err
+		}
+		if expires != "" {
+			if c.Expires, err = time.Parse(auditTimeFormat, expires); err != nil {
+				return nil, fmt.Errorf("counter %v: invalid expiry %q", c.Key, expires)
+			}
+		}
+		counters = append(counters, c)
+	}
+	return counters, rows.Err()
+}
@@ -0,0 +1,153 @@
+package socks4
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memSnapshotter keeps the counters saved in memory.
+type memSnapshotter struct {
+	mu       sync.Mutex
+	counters []StoreCounter
+	saves    int
+	err      error // of the loads.
+}
+
+func (m *memSnapshotter) Save(counters []StoreCounter) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters = counters
+	m.saves++
+	return nil
+}
+
+func (m *memSnapshotter) Load() ([]StoreCounter, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.counters, m.err
+}
+
+func (m *memSnapshotter) saved() (map[string]int64, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	values := make(map[string]int64)
+	for _, c := range m.counters {
+		values[c.Key] = c.Value
+	}
+	return values, m.saves
+}
+
+func TestPersistentStore(t *testing.T) {
+	now := time.Now()
+	snap := &memSnapshotter{counters: []StoreCounter{
+		{Key: "ban:10.0.0.1", Value: 1, Expires: now.Add(time.Hour)},
+		{Key: "ban:10.0.0.2", Value: 1, Expires: now.Add(-time.Second)},
+		{Key: "quota:alice", Value: 42},
+	}}
+	store, err := NewPersistentStore(snap, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the counters are restored but the expired ones.
+	testStore(t, store, []storeOp{
+		{op: "get", key: "ban:10.0.0.1", value: 1},
+		{op: "get", key: "ban:10.0.0.2"},
+		{op: "get", key: "quota:alice", value: 42},
+		{op: "incr", key: "quota:alice", n: 8, value: 50},
+		{op: "incr", key: "rate:10.0.0.3", n: 1, ttl: time.Minute, value: 1},
+	})
+	if _, saves := snap.saved(); saves != 0 {
+		t.Errorf("%v saves without interval, want none before closing", saves)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"ban:10.0.0.1": 1, "quota:alice": 50, "rate:10.0.0.3": 1}
+	if values, saves := snap.saved(); saves != 1 || !reflect.DeepEqual(values, want) {
+		t.Errorf("saved %v %v times, want %v once", values, saves, want)
+	}
+
+	// restarted from the saved counters.
+	restarted, err := NewPersistentStore(snap, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	testStore(t, restarted, []storeOp{{op: "get", key: "quota:alice", value: 50}})
+}
+
+func TestPersistentStoreInterval(t *testing.T) {
+	snap := &memSnapshotter{}
+	store, err := NewPersistentStore(snap, 10*time.Millisecond, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	store.Incr("ban:10.0.0.1", 1, time.Hour)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if values, _ := snap.saved(); values["ban:10.0.0.1"] == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("counters not saved periodically")
+		}
+	}
+}
+
+func TestPersistentStoreLoadError(t *testing.T) {
+	if _, err := NewPersistentStore(&memSnapshotter{err: errors.New("disk full")}, 0, nil); err == nil {
+		t.Error("store created without its counters")
+	}
+}
+
+func TestSQLStoreSnapshotter(t *testing.T) {
+	db := openTestDB(t)
+	alpha, err := NewSQLStoreSnapshotter(db, "sqlite", "alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	beta, err := NewSQLStoreSnapshotter(db, "sqlite", "beta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Date(2026, 10, 16, 12, 0, 0, 123456000, time.UTC)
+	// more counters than the rows of a statement.
+	var many []StoreCounter
+	for i := 0; i < 2*maxSnapshotRows+50; i++ {
+		many = append(many, StoreCounter{Key: "rate:" + strconv.Itoa(i), Value: int64(i), Expires: expires})
+	}
+	for _, tt := range []struct {
+		name     string
+		snap     *SQLStoreSnapshotter
+		counters []StoreCounter
+	}{
+		{name: "no counters", snap: alpha},
+		{name: "counters", snap: alpha, counters: []StoreCounter{{Key: "ban:10.0.0.1", Value: 1, Expires: expires}, {Key: "quota:alice", Value: 42}}},
+		{name: "replaced", snap: alpha, counters: []StoreCounter{{Key: "quota:bob", Value: 7}}},
+		{name: "many counters", snap: beta, counters: many},
+	} {
+		if err := tt.snap.Save(tt.counters); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		loaded, err := tt.snap.Load()
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		sort.Slice(loaded, func(i, j int) bool { return loaded[i].Value < loaded[j].Value })
+		if len(loaded) != len(tt.counters) || len(loaded) > 0 && !reflect.DeepEqual(loaded, tt.counters) {
+			t.Errorf("%v: loaded %v counters, want %v", tt.name, len(loaded), len(tt.counters))
+		}
+	}
+	// the scopes have their own counters.
+	if loaded, err := alpha.Load(); err != nil || len(loaded) != 1 || loaded[0].Key != "quota:bob" {
+		t.Errorf("loaded %v with error %v, want the counter of the scope only", loaded, err)
+	}
+	if _, err := NewSQLStoreSnapshotter(db, "mysql", "alpha"); err == nil {
+		t.Error("snapshotter of an unsupported dialect")
+	}
+}
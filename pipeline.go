@@ -0,0 +1,62 @@
+package socks4
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// WithRejectRetry keeps the connections of the SOCKS 4 clients whose
+// request is rejected open for up to wait, and serves the next request they
+// send on them, up to retries times, for the toolchains sending a
+// corrected request, like a BIND after a denied CONNECT, on the same
+// connection. The connections are closed right after the rejection, as by
+// default, when the server writes the reason of the rejection (see
+// WithRejectReasons), for the banned clients, in maintenance and while
+// shutting down.
+func WithRejectRetry(retries int, wait time.Duration) OptionFunc {
+	return func(s *Server) {
+		s.rejectRetries = retries
+		s.rejectWait = wait
+	}
+}
+
+// repliedError is the error of a SOCKS 4 request whose rejection was
+// replied to the client, which may send another request.
+type repliedError struct {
+	err error
+}
+
+func (e *repliedError) Error() string { return e.err.Error() }
+func (e *repliedError) Unwrap() error { return e.err }
+
+// replyTracker records whether a rejection was replied.
+type replyTracker struct {
+	replier
+	rejectedReplied bool
+}
+
+func (t *replyTracker) rejected(conn net.Conn, err error) error {
+	wErr := t.replier.rejected(conn, err)
+	t.rejectedReplied = wErr == nil
+	return wErr
+}
+
+// retriesRequest reports whether the server waits for another request
+// from the client after the error of the previous one.
+func (s *Server) retriesRequest(err error) bool {
+	var replied *repliedError
+	return errors.As(err, &replied) && !errors.Is(err, errBanned) &&
+		!errors.Is(err, errMaintenance) && !s.isClosed()
+}
+
+// noRequest reports whether the client closed its connection or sent
+// nothing after a rejection, which is not another failed request.
+func noRequest(req Request, err error) bool {
+	if err == nil || req.Cmd != 0 {
+		return false
+	}
+	var ne net.Error
+	return errors.Is(err, io.EOF) || errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,139 @@
+package socks4
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNoRequest(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		req  Request
+		err  error
+		none bool
+	}{
+		{name: "request", req: Request{Cmd: CmdConnect}},
+		{name: "closed", err: fmt.Errorf("failed to read from connect: %w", io.EOF), none: true},
+		{name: "timeout", err: &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}, none: true},
+		{name: "malformed", err: ErrInvalidVersion},
+		{name: "rejected", req: Request{Cmd: CmdConnect}, err: errDenied},
+	} {
+		if none := noRequest(tt.req, tt.err); none != tt.none {
+			t.Errorf("%v: no request %v, want %v", tt.name, none, tt.none)
+		}
+	}
+}
+
+func TestRetriesRequest(t *testing.T) {
+	// shutting down.
+	closed := newTestServer()
+	closed.closed = true
+	for _, tt := range []struct {
+		name    string
+		s       *Server
+		err     error
+		retries bool
+	}{
+		{name: "replied", s: newTestServer(), err: &repliedError{err: errDenied}, retries: true},
+		{name: "replied and wrapped", s: newTestServer(), err: fmt.Errorf("session 1: %w", &repliedError{err: errDenied}), retries: true},
+		{name: "not replied", s: newTestServer(), err: errDenied},
+		{name: "banned", s: newTestServer(), err: &repliedError{err: errBanned}},
+		{name: "maintenance", s: newTestServer(), err: &repliedError{err: errMaintenance}},
+		{name: "closed", s: closed, err: &repliedError{err: errDenied}},
+	} {
+		if retries := tt.s.retriesRequest(tt.err); retries != tt.retries {
+			t.Errorf("%v: retries %v, want %v", tt.name, retries, tt.retries)
+		}
+	}
+}
+
+func TestRejectRetry(t *testing.T) {
+	echo := echoTarget(t)
+	port, err := strconv.Atoi(echo.Addr[strings.LastIndex(echo.Addr, ":")+1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ParseRules(strings.NewReader("deny port 80\nallow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied := request(CmdConnect, 80, [4]byte{127, 0, 0, 1}, "")
+	allowed := request(CmdConnect, uint16(port), [4]byte{127, 0, 0, 1}, "")
+	for _, tt := range []struct {
+		name     string
+		opts     []OptionFunc
+		requests [][]byte
+		replies  []byte // codes of the replies, the session relayed if the last is granted, the connection closed otherwise.
+	}{
+		{name: "no retry", requests: [][]byte{denied, allowed}, replies: []byte{RejectOrFailure}},
+		{name: "retried", opts: []OptionFunc{WithRejectRetry(1, 5*time.Second)}, requests: [][]byte{denied, allowed}, replies: []byte{RejectOrFailure, Granted}},
+		{name: "retried twice", opts: []OptionFunc{WithRejectRetry(2, 5*time.Second)}, requests: [][]byte{denied, denied, allowed}, replies: []byte{RejectOrFailure, RejectOrFailure, Granted}},
+		{name: "beyond the retries", opts: []OptionFunc{WithRejectRetry(1, 5*time.Second)}, requests: [][]byte{denied, denied, allowed}, replies: []byte{RejectOrFailure, RejectOrFailure}},
+		{name: "with reject reasons", opts: []OptionFunc{WithRejectRetry(1, 5*time.Second), WithRejectReasons()}, requests: [][]byte{denied}, replies: []byte{RejectOrFailure}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := serve(t, append(tt.opts, WithRules(rules))...)
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			var replies []byte
+			for _, req := range tt.requests {
+				if _, err := conn.Write(req); err != nil {
+					break
+				}
+				rep := make([]byte, 8)
+				if _, err := io.ReadFull(conn, rep); err != nil {
+					break
+				}
+				replies = append(replies, rep[1])
+				if rep[1] == Granted {
+					assertEcho(t, conn, []byte("hello"))
+					break
+				}
+			}
+			if string(replies) != string(tt.replies) {
+				t.Errorf("replies %x, want %x", replies, tt.replies)
+			}
+			if replies[len(replies)-1] != Granted {
+				var ne net.Error
+				if _, err := io.ReadAll(conn); errors.As(err, &ne) && ne.Timeout() {
+					t.Error("connection open after the last rejection")
+				}
+			}
+		})
+	}
+}
+
+func TestRejectRetryWait(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader("deny"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, addr := serve(t, WithRules(rules), WithRejectRetry(1, 50*time.Millisecond))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(request(CmdConnect, 80, [4]byte{127, 0, 0, 1}, ""))
+	// the rejection, then the connection closed once the wait is over.
+	rest, err := io.ReadAll(conn)
+	if err != nil || len(rest) != 8 || rest[1] != RejectOrFailure {
+		t.Errorf("read %x with error %v, want a rejection and the connection closed", rest, err)
+	}
+	// the end of the wait is not another failed request.
+	if failed := s.Stats().Failed; failed != 1 {
+		t.Errorf("%v failed requests, want 1", failed)
+	}
+}
@@ -0,0 +1,243 @@
+package socks4
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// PoolStrategy is the way an egress pool picks the member of a dial.
+type PoolStrategy int
+
+const (
+	// RoundRobin picks the members in turn.
+	RoundRobin PoolStrategy = iota
+	// LeastConnections picks the member with the fewest open connections.
+	LeastConnections
+	// StickyUserId picks the same member for the requests of a user id,
+	// or of a client IP for the requests without user id, so that the
+	// sessions of a user appear from the same source to the destinations.
+	StickyUserId
+	// StickyClientIP picks the same member for the requests of a client
+	// IP.
+	StickyClientIP
+)
+
+func (p PoolStrategy) String() string {
+	switch p {
+	case RoundRobin:
+		return "round_robin"
+	case LeastConnections:
+		return "least_connections"
+	case StickyUserId:
+		return "sticky_user_id"
+	case StickyClientIP:
+		return "sticky_client_ip"
+	}
+	return fmt.Sprintf("PoolStrategy(%d)", int(p))
+}
+
+// PoolMember is a member of an egress pool, which connects to the
+// destinations from a local IP, through a SOCKS 5 upstream server, or
+// through another egress like an SSH one. Only one of SourceIP, Upstream
+// and Egress is set.
+type PoolMember struct {
+	SourceIP           net.IP // local IP of the direct dials, ignored by the networks set by WithNetwork.
+	Upstream           string // address (host:port) of a SOCKS 5 upstream server.
+	Username, Password string // of the upstream server, no authentication if Username is empty.
+	Egress             string // name of another egress.
+}
+
+func (m PoolMember) String() string {
+	switch {
+	case m.Egress != "":
+		return "egress " + m.Egress
+	case m.Upstream != "":
+		return "upstream " + m.Upstream
+	case m.SourceIP != nil:
+		return "source " + m.SourceIP.String()
+	}
+	return "direct"
+}
+
+// WithEgressPool adds the egress named name, which connects to the
+// destinations through one of the members picked by strategy, e.g. to
+// rotate the source IP of the requests. The CONNECT requests allowed by the
+// rules with "via name" go through it.
+func WithEgressPool(name string, strategy PoolStrategy, members ...PoolMember) OptionFunc {
+	return func(s *Server) {
+		if s.egresses == nil {
+			s.egresses = make(map[string]egress)
+		}
+		p := &egressPool{name: name, strategy: strategy}
+		for _, m := range members {
+			p.members = append(p.members, &poolMember{PoolMember: m})
+		}
+		s.egresses[name] = p
+	}
+}
+
+// egressPool is an egress dialing through its members.
+type egressPool struct {
+	name     string
+	strategy PoolStrategy
+	members  []*poolMember
+	next     atomic.Uint64 // turn of the round robin.
+
+	mu sync.Mutex // picks the least connected member.
+}
+
+// poolMember is a member of an egress pool with its counters.
+type poolMember struct {
+	PoolMember
+	active atomic.Int64 // open connections.
+	dials  atomic.Uint64
+	failed atomic.Uint64
+}
+
+func (p *egressPool) dial(address string, o origin, s *Server) (net.Conn, error) {
+	if len(p.members) == 0 {
+		return nil, fmt.Errorf("egress pool %v has no members", p.name)
+	}
+	m := p.pick(o)
+	m.dials.Add(1)
+	conn, err := m.dial(address, o, s)
+	if err != nil {
+		m.failed.Add(1)
+		m.active.Add(-1)
+		return nil, fmt.Errorf("egress pool %v, %v: %v", p.name, m, err)
+	}
+	return &poolConn{Conn: conn, member: m}, nil
+}
+
+// pick returns the member of the next dial from o, counting the
+// connection as active.
+func (p *egressPool) pick(o origin) *poolMember {
+	var m *poolMember
+	switch p.strategy {
+	case LeastConnections:
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		m = p.leastConnected()
+	case StickyUserId, StickyClientIP:
+		key := "ip:" + o.client
+		if p.strategy == StickyUserId && o.userId != "" {
+			key = "user:" + o.userId
+		}
+		m = p.sticky(key)
+	default:
+		m = p.members[(p.next.Add(1)-1)%uint64(len(p.members))]
+	}
+	m.active.Add(1)
+	return m
+}
+
+// leastConnected returns the member with the fewest open connections. It
+// must be called with p.mu held.
+func (p *egressPool) leastConnected() *poolMember {
+	// the search starts at the next turn, so that equally connected
+	// members are picked in turn.
+	start := int(p.next.Add(1) % uint64(len(p.members)))
+	best := p.members[start]
+	for i := 1; i < len(p.members); i++ {
+		m := p.members[(start+i)%len(p.members)]
+		if m.active.Load() < best.active.Load() {
+			best = m
+		}
+	}
+	return best
+}
+
+// sticky returns the member of the key by rendezvous hashing, so that
+// only the keys of a member move when it is added or removed.
+func (p *egressPool) sticky(key string) *poolMember {
+	var best *poolMember
+	var bestScore uint64
+	for _, m := range p.members {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(m.String()))
+		if score := mix64(h.Sum64()); best == nil || score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+	return best
+}
+
+// mix64 spreads the bits of a FNV hash, whose high bits barely depend on
+// the last bytes hashed, like the ones telling the members apart.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// dial connects to address through the member.
+func (m *poolMember) dial(address string, o origin, s *Server) (net.Conn, error) {
+	switch {
+	case m.Egress != "":
+		e := s.egresses[m.Egress]
+		if e == nil {
+			return nil, fmt.Errorf("unknown egress %q", m.Egress)
+		}
+		return e.dial(address, o, s)
+	case m.Upstream != "":
+		u := socks5Upstream{address: m.Upstream, username: m.Username, password: m.Password}
+		return u.dial(address, o, s)
+	}
+	return s.dialDirect(address, o, func(address string) (net.Conn, error) {
+		n, ok := s.network.(systemNetwork)
+		if !ok {
+			return s.dial("tcp", address, o)
+		}
+		n.source = m.SourceIP
+		return n.Dial("tcp", address, s.dialTimeout())
+	})
+}
+
+// poolConn is a connection through a member of an egress pool, counted as
+// active until closed.
+type poolConn struct {
+	net.Conn
+	member *poolMember
+	once   sync.Once
+}
+
+func (c *poolConn) Close() error {
+	c.once.Do(func() { c.member.active.Add(-1) })
+	return c.Conn.Close()
+}
+
+// PoolState is the state of an egress pool.
+type PoolState struct {
+	Name     string            `json:"name"`
+	Strategy string            `json:"strategy"`
+	Members  []PoolMemberState `json:"members"`
+}
+
+// PoolMemberState is the state of a member of an egress pool.
+type PoolMemberState struct {
+	Member string `json:"member"`
+	Active int64  `json:"active"` // open connections.
+	Dials  uint64 `json:"dials"`
+	Failed uint64 `json:"failed"` // failed dials.
+}
+
+func (p *egressPool) state() PoolState {
+	ps := PoolState{Name: p.name, Strategy: p.strategy.String()}
+	for _, m := range p.members {
+		ps.Members = append(ps.Members, PoolMemberState{
+			Member: m.String(),
+			Active: m.active.Load(),
+			Dials:  m.dials.Load(),
+			Failed: m.failed.Load(),
+		})
+	}
+	return ps
+}
@@ -0,0 +1,222 @@
+package socks4
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPoolMemberString(t *testing.T) {
+	for _, tt := range []struct {
+		member PoolMember
+		want   string
+	}{
+		{PoolMember{}, "direct"},
+		{PoolMember{SourceIP: net.IPv4(10, 0, 0, 1)}, "source 10.0.0.1"},
+		{PoolMember{Upstream: "upstream.example.com:1080", Username: "alice"}, "upstream upstream.example.com:1080"},
+		{PoolMember{Egress: "bastion"}, "egress bastion"},
+	} {
+		if s := tt.member.String(); s != tt.want {
+			t.Errorf("member %+v: %q, want %q", tt.member, s, tt.want)
+		}
+	}
+	for _, tt := range []struct {
+		strategy PoolStrategy
+		want     string
+	}{
+		{RoundRobin, "round_robin"},
+		{LeastConnections, "least_connections"},
+		{StickyUserId, "sticky_user_id"},
+		{StickyClientIP, "sticky_client_ip"},
+		{PoolStrategy(9), "PoolStrategy(9)"},
+	} {
+		if s := tt.strategy.String(); s != tt.want {
+			t.Errorf("strategy %d: %q, want %q", int(tt.strategy), s, tt.want)
+		}
+	}
+}
+
+// testPool returns a pool of n members picking them by strategy.
+func testPool(strategy PoolStrategy, n int) *egressPool {
+	p := &egressPool{name: "pool", strategy: strategy}
+	for i := 0; i < n; i++ {
+		p.members = append(p.members, &poolMember{PoolMember: PoolMember{SourceIP: net.IPv4(10, 0, 0, byte(i+1))}})
+	}
+	return p
+}
+
+func TestEgressPoolPick(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		strategy PoolStrategy
+		active   []int64 // of the members before the picks.
+		release  bool    // the connections of the picks are closed in turn.
+		picks    []int
+	}{
+		{name: "round robin", strategy: RoundRobin, active: []int64{0, 0, 0}, picks: []int{0, 1, 2, 0, 1}},
+		{name: "round robin ignoring the connections", strategy: RoundRobin, active: []int64{5, 0, 0}, picks: []int{0, 1, 2}},
+		{name: "least connections", strategy: LeastConnections, active: []int64{2, 0, 1}, picks: []int{1, 2, 1, 1}},
+		{name: "least connections in turn", strategy: LeastConnections, active: []int64{0, 0, 0}, release: true, picks: []int{1, 2, 0, 1}},
+	} {
+		p := testPool(tt.strategy, len(tt.active))
+		for i, n := range tt.active {
+			p.members[i].active.Store(n)
+		}
+		var picks []int
+		for range tt.picks {
+			m := p.pick(origin{client: "10.1.0.1"})
+			for i := range p.members {
+				if p.members[i] == m {
+					picks = append(picks, i)
+				}
+			}
+			if tt.release {
+				m.active.Add(-1)
+			}
+		}
+		if !reflect.DeepEqual(picks, tt.picks) {
+			t.Errorf("%v: picked %v, want %v", tt.name, picks, tt.picks)
+		}
+	}
+}
+
+func TestEgressPool(t *testing.T) {
+	echo := echoTarget(t)
+	rules, err := ParseRules(strings.NewReader("allow via pool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, addr := serve(t, WithRules(rules), WithEgressPool("pool", RoundRobin,
+		PoolMember{SourceIP: net.IPv4(127, 0, 0, 1)},
+		PoolMember{SourceIP: net.ParseIP("192.0.2.1")}, // not a local IP.
+	))
+	d := NewDialer(addr, WithDialerTimeout(5*time.Second))
+	conn, err := d.Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn, []byte("hello"))
+	var rej *RejectError
+	if _, err := d.Dial("tcp", echo.Addr); !errors.As(err, &rej) {
+		t.Errorf("error %v through the member with an unavailable source IP, want a rejection", err)
+	}
+
+	want := PoolState{Name: "pool", Strategy: "round_robin", Members: []PoolMemberState{
+		{Member: "source 127.0.0.1", Active: 1, Dials: 1},
+		{Member: "source 192.0.2.1", Dials: 1, Failed: 1},
+	}}
+	if st := s.State(); len(st.Pools) != 1 || !reflect.DeepEqual(st.Pools[0], want) {
+		t.Errorf("pools %+v, want %+v", st.Pools, want)
+	}
+
+	// the connection is no longer active once the session ends.
+	conn.Close()
+	echo.Close()
+	want.Members[0].Active = 0
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		st := s.State()
+		if reflect.DeepEqual(st.Pools[0], want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pools %+v once closed, want %+v", st.Pools, want)
+		}
+	}
+}
+
+func TestEgressPoolNoMembers(t *testing.T) {
+	p := testPool(RoundRobin, 0)
+	if _, err := p.dial("127.0.0.1:80", origin{}, newTestServer()); err == nil || !strings.Contains(err.Error(), "no members") {
+		t.Errorf("error %v, want no members", err)
+	}
+}
+
+// memberIndex returns the index of m in the members of p, -1 if none.
+func memberIndex(p *egressPool, m *poolMember) int {
+	for i := range p.members {
+		if p.members[i] == m {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestEgressPoolSticky(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		strategy PoolStrategy
+		a, b     origin
+		same     bool // a and b are pinned to the same member.
+	}{
+		{name: "same user", strategy: StickyUserId, a: origin{client: "10.1.0.1", userId: "alice"}, b: origin{client: "10.1.0.2", userId: "alice"}, same: true},
+		{name: "same client without user id", strategy: StickyUserId, a: origin{client: "10.1.0.1"}, b: origin{client: "10.1.0.1"}, same: true},
+		{name: "same client", strategy: StickyClientIP, a: origin{client: "10.1.0.1", userId: "alice"}, b: origin{client: "10.1.0.1", userId: "bob"}, same: true},
+	} {
+		p := testPool(tt.strategy, 8)
+		first := memberIndex(p, p.pick(tt.a))
+		for i := 0; i < 10; i++ {
+			if m := memberIndex(p, p.pick(tt.a)); m != first {
+				t.Errorf("%v: picked %v after %v", tt.name, m, first)
+			}
+		}
+		if same := memberIndex(p, p.pick(tt.b)) == first; same != tt.same {
+			t.Errorf("%v: same member %v, want %v", tt.name, same, tt.same)
+		}
+	}
+}
+
+func TestEgressPoolStickySpread(t *testing.T) {
+	p := testPool(StickyUserId, 4)
+	picks := make(map[string]int)
+	counts := make([]int, len(p.members))
+	for i := 0; i < 400; i++ {
+		user := "user" + strconv.Itoa(i)
+		m := memberIndex(p, p.pick(origin{userId: user}))
+		picks[user] = m
+		counts[m]++
+	}
+	for i, n := range counts {
+		if n < 50 {
+			t.Errorf("member %v picked for %v users of 400, want them spread: %v", i, n, counts)
+		}
+	}
+
+	// only the users of a member removed move.
+	removed := 3
+	p.members = p.members[:removed]
+	for user, m := range picks {
+		if now := memberIndex(p, p.pick(origin{userId: user})); m != removed && now != m {
+			t.Errorf("user %v moved from %v to %v", user, m, now)
+		}
+	}
+}
+
+func TestEgressPoolStickySessions(t *testing.T) {
+	echo := echoTarget(t)
+	rules, err := ParseRules(strings.NewReader("allow via pool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, addr := serve(t, WithRules(rules), WithEgressPool("pool", StickyUserId,
+		PoolMember{SourceIP: net.IPv4(127, 0, 0, 1)},
+		PoolMember{SourceIP: net.IPv4(127, 0, 0, 2)},
+	))
+	for i := 0; i < 3; i++ {
+		conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second), WithDialerUserId("alice")).Dial("tcp", echo.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	var dials []uint64
+	for _, m := range s.State().Pools[0].Members {
+		dials = append(dials, m.Dials)
+	}
+	if !reflect.DeepEqual(dials, []uint64{3, 0}) && !reflect.DeepEqual(dials, []uint64{0, 3}) {
+		t.Errorf("dials %v by member, want all through the member of the user", dials)
+	}
+}
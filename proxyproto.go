@@ -0,0 +1,159 @@
+package socks4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout is the max time to read a PROXY protocol header when
+// no handshake timeout is set.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts the binary header of PROXY protocol version 2.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// WithProxyProtocol makes the server read a PROXY protocol (version 1 or
+// 2) header on the connections from the trusted networks, e.g. those of
+// the load balancers in front of the server, and use the client address it
+// carries in the logs, rules and limits. Connections from other peers are
+// served as they are.
+func WithProxyProtocol(trusted ...*net.IPNet) OptionFunc {
+	return func(s *Server) {
+		s.proxyProtocol = trusted
+	}
+}
+
+// proxiedConn is a connection whose client address is given by a PROXY
+// protocol header.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// isTrustedProxy reports whether the peer ip is a trusted load balancer.
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	for _, n := range s.proxyProtocol {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyHeader reads the PROXY protocol header sent by a trusted peer,
+// and returns the connection with the client address of the header.
+func (s *Server) readProxyHeader(conn net.Conn) (net.Conn, error) {
+	if !s.isTrustedProxy(net.ParseIP(clientIP(conn))) {
+		return conn, nil
+	}
+
+	timeout := s.config().HandshakeTimeout
+	if timeout == 0 {
+		timeout = proxyHeaderTimeout
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	// the header is read exactly, so that the request following it is left
+	// unread. 12 bytes is the v2 signature and shorter than any v1 header.
+	b := make([]byte, 12, 107)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return conn, fmt.Errorf("read header from %v: %v", conn.RemoteAddr(), err)
+	}
+	var remote net.Addr
+	var err error
+	if bytes.Equal(b, proxyV2Signature) {
+		remote, err = readProxyV2(conn)
+	} else if bytes.HasPrefix(b, []byte("PROXY ")) {
+		remote, err = readProxyV1(conn, b)
+	} else {
+		err = errors.New("missing header")
+	}
+	if err != nil {
+		return conn, fmt.Errorf("header from %v: %v", conn.RemoteAddr(), err)
+	}
+	if remote == nil {
+		// LOCAL or UNKNOWN, e.g. a health check of the load balancer.
+		return conn, nil
+	}
+	s.log(LogAccept).Debugf("client %v connected through %v", remote, conn.RemoteAddr())
+	return &proxiedConn{Conn: conn, remote: remote}, nil
+}
+
+// readProxyV1 reads the rest of a text header after its first bytes b,
+// e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n". It returns nil
+// for the UNKNOWN protocol.
+func readProxyV1(conn net.Conn, b []byte) (net.Addr, error) {
+	c := make([]byte, 1)
+	for !bytes.HasSuffix(b, []byte("\r\n")) {
+		if len(b) >= 107 {
+			return nil, errors.New("v1 header too long")
+		}
+		if _, err := io.ReadFull(conn, c); err != nil {
+			return nil, err
+		}
+		b = append(b, c[0])
+	}
+
+	fields := strings.Fields(string(b[:len(b)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid v1 header %q", b)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid v1 header %q", b)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyV2 reads the rest of a binary header after its signature. It
+// returns nil for the LOCAL command and the unsupported families.
+func readProxyV2(conn net.Conn) (net.Addr, error) {
+	h := make([]byte, 4)
+	if _, err := io.ReadFull(conn, h); err != nil {
+		return nil, err
+	}
+	if h[0]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %v", h[0]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(h[2:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+
+	switch cmd := h[0] & 0x0f; cmd {
+	case 0: // LOCAL
+		return nil, nil
+	case 1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %v", cmd)
+	}
+	switch h[1] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,166 @@
+package socks4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 returns a binary header of the command, family and addresses.
+func proxyV2(version, cmd, family byte, addrs []byte) []byte {
+	b := append([]byte{}, proxyV2Signature...)
+	b = append(b, version<<4|cmd, family, 0, 0)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(addrs)))
+	return append(b, addrs...)
+}
+
+// v2Addrs returns the addresses of a v2 header: the source and destination
+// IPs, then ports.
+func v2Addrs(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	b := append(append([]byte{}, src...), dst...)
+	return binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(b, srcPort), dstPort)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	s := newTestServer(WithProxyProtocol(trusted), WithHandshakeTimeout(time.Second))
+	ipv4 := v2Addrs(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4(), 56324, 1080)
+	ipv6 := v2Addrs(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"), 56324, 1080)
+	for _, tt := range []struct {
+		name   string
+		peer   string
+		header []byte
+		remote string // client address, that of the peer if empty.
+		err    string // in the error, none if empty.
+	}{
+		{name: "v1 TCP4", peer: "10.0.0.1", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 1080\r\n"), remote: "192.0.2.1:56324"},
+		{name: "v1 TCP6", peer: "10.0.0.1", header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 1080\r\n"), remote: "[2001:db8::1]:56324"},
+		{name: "v1 UNKNOWN", peer: "10.0.0.1", header: []byte("PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n")},
+		{name: "v1 short UNKNOWN", peer: "10.0.0.1", header: []byte("PROXY UNKNOWN\r\n")},
+		{name: "v1 UDP", peer: "10.0.0.1", header: []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 1080\r\n"), err: "invalid v1 header"},
+		{name: "v1 invalid IP", peer: "10.0.0.1", header: []byte("PROXY TCP4 192.0.2 198.51.100.1 56324 1080\r\n"), err: "invalid v1 header"},
+		{name: "v1 invalid port", peer: "10.0.0.1", header: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 1080\r\n"), err: "invalid v1 header"},
+		{name: "v1 too long", peer: "10.0.0.1", header: []byte("PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n"), err: "too long"},
+		{name: "v2 IPv4", peer: "10.0.0.1", header: proxyV2(2, 1, 0x11, ipv4), remote: "192.0.2.1:56324"},
+		{name: "v2 IPv6", peer: "10.0.0.1", header: proxyV2(2, 1, 0x21, ipv6), remote: "[2001:db8::1]:56324"},
+		{name: "v2 with TLVs", peer: "10.0.0.1", header: proxyV2(2, 1, 0x11, append(ipv4, 0x04, 0, 1, 'x')), remote: "192.0.2.1:56324"},
+		{name: "v2 LOCAL", peer: "10.0.0.1", header: proxyV2(2, 0, 0, nil)},
+		{name: "v2 UDP", peer: "10.0.0.1", header: proxyV2(2, 1, 0x12, ipv4)},
+		{name: "v2 version", peer: "10.0.0.1", header: proxyV2(3, 1, 0x11, ipv4), err: "unsupported v2 version"},
+		{name: "v2 command", peer: "10.0.0.1", header: proxyV2(2, 2, 0x11, ipv4), err: "unsupported v2 command"},
+		{name: "v2 short IPv4", peer: "10.0.0.1", header: proxyV2(2, 1, 0x11, ipv4[:8]), err: "short v2 IPv4"},
+		{name: "v2 short IPv6", peer: "10.0.0.1", header: proxyV2(2, 1, 0x21, ipv4), err: "short v2 IPv6"},
+		{name: "missing header", peer: "10.0.0.1", header: request(CmdConnect, 80, [4]byte{192, 0, 2, 1}, "alice"), err: "missing header"},
+		{name: "truncated header", peer: "10.0.0.1", header: []byte("PROXY TCP4"), err: "EOF"},
+		{name: "untrusted peer", peer: "192.0.2.1", header: []byte("PROXY TCP4 10.0.0.2 198.51.100.1 56324 1080\r\n")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			rest := []byte("request")
+			go func() {
+				client.Write(append(append([]byte{}, tt.header...), rest...))
+				client.Close()
+			}()
+			peer := &net.TCPAddr{IP: net.ParseIP(tt.peer), Port: 40000}
+			conn, err := s.readProxyHeader(addrConn{Conn: server, addr: peer})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote := tt.remote
+			if remote == "" {
+				remote = peer.String()
+			}
+			if conn.RemoteAddr().String() != remote {
+				t.Errorf("client address %v, want %v", conn.RemoteAddr(), remote)
+			}
+			// the bytes following the header are left to the request.
+			if tt.peer != "192.0.2.1" {
+				if b, err := io.ReadAll(conn); err != nil || !bytes.Equal(b, rest) {
+					t.Errorf("read %q after the header: %v, want %q", b, err, rest)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	_, lb, _ := net.ParseCIDR("127.0.0.0/8")
+	rules, err := ParseRules(strings.NewReader("deny from 192.0.2.0/24\nallow\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, addr := serve(t, WithProxyProtocol(lb), WithRules(rules))
+	echo := echoTarget(t)
+	host, p, _ := net.SplitHostPort(echo.Addr)
+	target := net.ParseIP(host).To4()
+	port, _ := strconv.Atoi(p)
+	for _, tt := range []struct {
+		name    string
+		header  string
+		granted bool
+		client  string // of the session.
+	}{
+		{name: "allowed client", header: "PROXY TCP4 198.51.100.7 198.51.100.1 56324 1080\r\n", granted: true, client: "198.51.100.7:56324"},
+		{name: "denied client", header: "PROXY TCP4 192.0.2.7 198.51.100.1 56324 1080\r\n"},
+		{name: "health check", header: "PROXY UNKNOWN\r\n", granted: true},
+		{name: "no header"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write(append([]byte(tt.header), request(CmdConnect, uint16(port), [4]byte(target), "alice")...))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			reply := make([]byte, 8)
+			_, err = io.ReadFull(conn, reply)
+			if granted := err == nil && reply[1] == Granted; granted != tt.granted {
+				t.Fatalf("reply %x: %v, want granted %v", reply, err, tt.granted)
+			}
+			if !tt.granted {
+				return
+			}
+			assertEcho(t, conn, []byte("hello"))
+			client := tt.client
+			if client == "" {
+				client = conn.LocalAddr().String()
+			}
+			found := false
+			for _, ss := range s.Sessions() {
+				found = found || ss.Client == client
+			}
+			if !found {
+				t.Errorf("no session of the client %v in %+v", client, s.Sessions())
+			}
+		})
+	}
+}
+
+func TestProxyProtocolHeaderTimeout(t *testing.T) {
+	_, lb, _ := net.ParseCIDR("127.0.0.0/8")
+	_, addr := serve(t, WithProxyProtocol(lb), WithHandshakeTimeout(100*time.Millisecond))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("read error %v, want the connection closed", err)
+	}
+}
@@ -0,0 +1,211 @@
+// Command socks4-quic carries SOCKS sessions over QUIC between SOCKS
+// clients and a socks4 server speaking TCP.
+//
+// On the client side, forward accepts the TCP connections of the local
+// SOCKS clients and forwards each of them as a stream of a QUIC connection
+// to the server side:
+//
+//	socks4-quic forward -listen 127.0.0.1:1080 -server proxy.example.com:1080 -tls-ca ca.pem
+//
+// On the server side, serve accepts the QUIC connections and relays their
+// streams to the socks4 server, each after a PROXY protocol v2 header
+// carrying the client address, which the server trusts by -proxy-protocol:
+//
+//	socks4-quic serve -listen :1080 -proxy 127.0.0.1:1081 -tls-cert cert.pem -tls-key key.pem
+//	socks4 -listen 127.0.0.1:1081 -proxy-protocol 127.0.0.1
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/cccxg/socks4/quic"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: socks4-quic forward|serve [flags]")
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "forward":
+		os.Exit(forward(os.Args[2:]))
+	case "serve":
+		os.Exit(serve(os.Args[2:]))
+	default:
+		fmt.Fprintln(os.Stderr, "usage: socks4-quic forward|serve [flags]")
+		os.Exit(2)
+	}
+}
+
+// forward forwards local SOCKS clients to the server side over QUIC.
+func forward(args []string) int {
+	fs := flag.NewFlagSet("socks4-quic forward", flag.ContinueOnError)
+	listen := fs.String("listen", "127.0.0.1:1080", "TCP address of the local SOCKS clients")
+	server := fs.String("server", "", "UDP address of the QUIC server side")
+	tlsCA := fs.String("tls-ca", "", "path of the CA certificates verifying the server, the system ones if empty")
+	tlsCert := fs.String("tls-cert", "", "path of the TLS client certificate")
+	tlsKey := fs.String("tls-key", "", "path of the TLS client private key")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+	if *server == "" {
+		fmt.Fprintln(os.Stderr, "no server address")
+		return 2
+	}
+
+	config := &tls.Config{}
+	if *tlsCA != "" {
+		pool, err := loadCertPool(*tlsCA)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		config.RootCAs = pool
+	}
+	if *tlsCert != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	lis, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	t := quic.NewTransport(*server, config)
+	defer t.Close()
+	fmt.Fprintf(os.Stderr, "forwarding %v to %v over QUIC\n", lis.Addr(), *server)
+	if err := quic.Forward(lis, t); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// serve relays the QUIC streams of clients to a socks4 server.
+func serve(args []string) int {
+	fs := flag.NewFlagSet("socks4-quic serve", flag.ContinueOnError)
+	listen := fs.String("listen", ":1080", "UDP address of the QUIC listener")
+	proxy := fs.String("proxy", "127.0.0.1:1081", "TCP address of the socks4 server, which must trust the PROXY protocol header of this side")
+	tlsCert := fs.String("tls-cert", "", "path of the TLS certificate")
+	tlsKey := fs.String("tls-key", "", "path of the TLS private key")
+	tlsClientCA := fs.String("tls-client-ca", "", "path of the CA certificates verifying required client certificates")
+	if err := fs.Parse(args); err == flag.ErrHelp {
+		return 0
+	} else if err != nil {
+		return 2
+	}
+
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if *tlsClientCA != "" {
+		pool, err := loadCertPool(*tlsClientCA)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	ln, err := quic.Listen(*listen, config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "relaying QUIC streams on %v to %v\n", ln.Addr(), *proxy)
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		go func() {
+			for {
+				stream, err := quic.AcceptStream(context.Background(), conn)
+				if err != nil {
+					return
+				}
+				go relayToProxy(stream, *proxy)
+			}
+		}()
+	}
+}
+
+// relayToProxy relays a stream to the socks4 server after a PROXY protocol
+// v2 header with the client address.
+func relayToProxy(stream net.Conn, proxy string) {
+	defer stream.Close()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write(proxyHeader(stream.RemoteAddr(), conn.RemoteAddr())); err != nil {
+		return
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(conn, stream)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(stream, conn)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// proxyHeader returns the PROXY protocol v2 header of a connection from
+// src to dst, or a LOCAL one if they are not of the same IP family.
+func proxyHeader(src, dst net.Addr) []byte {
+	b := bytes.NewBufferString("\r\n\r\n\x00\r\nQUIT\n")
+	s, _ := net.ResolveUDPAddr("udp", src.String())
+	d, _ := net.ResolveTCPAddr("tcp", dst.String())
+	switch {
+	case s != nil && d != nil && s.IP.To4() != nil && d.IP.To4() != nil:
+		b.Write([]byte{0x21, 0x11, 0, 12})
+		b.Write(s.IP.To4())
+		b.Write(d.IP.To4())
+	case s != nil && d != nil && s.IP.To4() == nil && d.IP.To4() == nil:
+		b.Write([]byte{0x21, 0x21, 0, 36})
+		b.Write(s.IP.To16())
+		b.Write(d.IP.To16())
+	default:
+		b.Write([]byte{0x20, 0x00, 0, 0})
+		return b.Bytes()
+	}
+	binary.Write(b, binary.BigEndian, uint16(s.Port))
+	binary.Write(b, binary.BigEndian, uint16(d.Port))
+	return b.Bytes()
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%v: no PEM certificates", path)
+	}
+	return pool, nil
+}
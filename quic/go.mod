@@ -0,0 +1,17 @@
+module github.com/cccxg/socks4/quic
+
+// quic-go needs Go 1.24, which is why QUIC is a module of its own: the
+// socks4 module keeps building with Go 1.20.
+go 1.24
+
+require (
+	github.com/cccxg/socks4 v0.1.0
+	github.com/quic-go/quic-go v0.59.1
+)
+
+require (
+	github.com/sirupsen/logrus v1.9.3 // indirect
+	golang.org/x/crypto v0.41.0 // indirect
+	golang.org/x/net v0.43.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+)
@@ -0,0 +1,218 @@
+// Package quic is an experimental QUIC transport of SOCKS sessions: each
+// session is a bidirectional stream of a QUIC connection between a client
+// and the server, starting with the usual SOCKS request, so that clients
+// get multiplexing and connection migration while the protocol logic of
+// the server stays the same.
+//
+// It is a separate module because QUIC requires a newer Go than the
+// socks4 module.
+package quic
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cccxg/socks4"
+	quicgo "github.com/quic-go/quic-go"
+)
+
+// NextProto is the ALPN protocol of the transport.
+const NextProto = "socks4"
+
+// keepAlivePeriod keeps idle connections open through NATs.
+const keepAlivePeriod = 15 * time.Second
+
+// Listen listens for QUIC connections on the UDP address. The TLS config
+// must have a certificate; NextProto is added to its protocols.
+func Listen(address string, tlsConfig *tls.Config) (*quicgo.Listener, error) {
+	return quicgo.ListenAddr(address, withNextProto(tlsConfig), &quicgo.Config{KeepAlivePeriod: keepAlivePeriod})
+}
+
+func withNextProto(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	if len(config.NextProtos) == 0 {
+		config.NextProtos = []string{NextProto}
+	}
+	return config
+}
+
+// Serve accepts QUIC connections on ln and serves their streams as SOCKS
+// sessions of srv (see socks4.Server.ServeConn), until ln is closed. The
+// client certificates of the connections identify the clients like those
+// of socks4.WithTLS.
+func Serve(srv *socks4.Server, ln *quicgo.Listener) error {
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go func() {
+			for {
+				stream, err := AcceptStream(context.Background(), conn)
+				if err != nil {
+					return
+				}
+				go srv.ServeConn(stream)
+			}
+		}()
+	}
+}
+
+// streamConn is a stream of a QUIC connection.
+type streamConn struct {
+	*quicgo.Stream
+	conn *quicgo.Conn
+}
+
+func newStreamConn(conn *quicgo.Conn, stream *quicgo.Stream) *streamConn {
+	return &streamConn{Stream: stream, conn: conn}
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return c.conn.LocalAddr() }
+func (c *streamConn) RemoteAddr() net.Addr { return c.conn.RemoteAddr() }
+
+// Close closes both directions of the stream, where Stream.Close only
+// closes the write one.
+func (c *streamConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// ConnectionState returns the TLS state of the QUIC connection.
+func (c *streamConn) ConnectionState() tls.ConnectionState {
+	return c.conn.ConnectionState().TLS
+}
+
+// Transport opens streams to a server on a shared QUIC connection, which
+// is established again when it is lost.
+type Transport struct {
+	address   string
+	tlsConfig *tls.Config
+
+	mu     sync.Mutex
+	conn   *quicgo.Conn
+	closed bool
+}
+
+// NewTransport creates a transport to the server at the UDP address. The
+// server name of tlsConfig defaults to the host of the address. Use
+// DialStream as the transport of a dialer:
+//
+//	t := quic.NewTransport("proxy.example.com:1080", &tls.Config{})
+//	d := socks4.NewDialer("", socks4.WithDialerTransport(t.DialStream))
+func NewTransport(address string, tlsConfig *tls.Config) *Transport {
+	config := withNextProto(tlsConfig)
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config.ServerName = host
+		}
+	}
+	return &Transport{address: address, tlsConfig: config}
+}
+
+// DialStream opens a stream to the server.
+func (t *Transport) DialStream(ctx context.Context) (net.Conn, error) {
+	conn, err := t.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		// the connection may be lost, open a stream on a new one.
+		t.drop(conn)
+		if conn, err = t.connection(ctx); err != nil {
+			return nil, err
+		}
+		if stream, err = conn.OpenStreamSync(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return newStreamConn(conn, stream), nil
+}
+
+// connection returns the QUIC connection to the server, connecting if it
+// is not established or lost.
+func (t *Transport) connection(ctx context.Context) (*quicgo.Conn, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, net.ErrClosed
+	}
+	if t.conn != nil && t.conn.Context().Err() == nil {
+		return t.conn, nil
+	}
+	conn, err := quicgo.DialAddr(ctx, t.address, t.tlsConfig, &quicgo.Config{KeepAlivePeriod: keepAlivePeriod})
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	return conn, nil
+}
+
+func (t *Transport) drop(conn *quicgo.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == conn {
+		conn.CloseWithError(0, "")
+		t.conn = nil
+	}
+}
+
+// Close closes the connection to the server and its streams.
+func (t *Transport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	if t.conn == nil {
+		return nil
+	}
+	return t.conn.CloseWithError(0, "")
+}
+
+// Forward forwards the connections accepted on lis to the server as
+// streams of t, until lis is closed. It is the local helper of SOCKS
+// clients which only speak TCP.
+func Forward(lis net.Listener, t *Transport) error {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			stream, err := t.DialStream(context.Background())
+			if err != nil {
+				return
+			}
+			defer stream.Close()
+			relay(conn, stream)
+		}()
+	}
+}
+
+// relay copies data between a and b until either side is done.
+func relay(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// AcceptStream accepts a stream of the QUIC connection as a net.Conn.
+func AcceptStream(ctx context.Context, conn *quicgo.Conn) (net.Conn, error) {
+	stream, err := conn.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return newStreamConn(conn, stream), nil
+}
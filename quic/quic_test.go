@@ -0,0 +1,165 @@
+package quic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cccxg/socks4"
+	"github.com/cccxg/socks4/socks4test"
+)
+
+// testCert returns a self-signed certificate of 127.0.0.1 and a pool
+// trusting it.
+func testCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "proxy"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+// serveQUIC serves the QUIC sessions of a new SOCKS server on an
+// ephemeral UDP port, and returns the server and a transport to it.
+func serveQUIC(t *testing.T, opts ...socks4.OptionFunc) (*socks4test.Server, *Transport) {
+	t.Helper()
+	cert, pool := testCert(t)
+	srv := socks4test.NewServer(t, opts...)
+	ln, err := Listen("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go Serve(srv.Server, ln)
+	t.Cleanup(func() { ln.Close() })
+	tr := NewTransport(ln.Addr().String(), &tls.Config{RootCAs: pool})
+	t.Cleanup(func() { tr.Close() })
+	return srv, tr
+}
+
+func TestQUIC(t *testing.T) {
+	srv, tr := serveQUIC(t)
+	echo := socks4test.NewEchoTarget(t)
+	d := socks4.NewDialer("", socks4.WithDialerTransport(tr.DialStream), socks4.WithDialerTimeout(5*time.Second))
+	// the sessions are streams of the same connection.
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := d.Dial("tcp", echo.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		socks4test.AssertEcho(t, conn, []byte("hello"))
+		conns = append(conns, conn)
+	}
+	if stream(conns[0]).conn != stream(conns[2]).conn {
+		t.Error("sessions on several QUIC connections")
+	}
+	srv.WaitSessions(t, 3, 5*time.Second)
+	_, port, _ := net.SplitHostPort(conns[0].LocalAddr().String())
+	for _, ss := range srv.Sessions() {
+		if ss.Client != "127.0.0.1:"+port {
+			t.Errorf("session client %v, want the QUIC address of port %v", ss.Client, port)
+		}
+	}
+}
+
+// stream returns the stream of a connection of the dialer.
+func stream(conn net.Conn) *streamConn {
+	return conn.(*socks4.Conn).Conn.(*streamConn)
+}
+
+func TestTransportReconnect(t *testing.T) {
+	_, tr := serveQUIC(t)
+	echo := socks4test.NewEchoTarget(t)
+	d := socks4.NewDialer("", socks4.WithDialerTransport(tr.DialStream), socks4.WithDialerTimeout(5*time.Second))
+	conn, err := d.Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lost := stream(conn).conn
+	lost.CloseWithError(0, "")
+	conn.Close()
+
+	conn, err = d.Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	socks4test.AssertEcho(t, conn, []byte("hello"))
+	if stream(conn).conn == lost {
+		t.Error("stream opened on the lost connection")
+	}
+
+	tr.Close()
+	if _, err := tr.DialStream(context.Background()); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("error %v once closed, want net.ErrClosed", err)
+	}
+}
+
+func TestForward(t *testing.T) {
+	_, tr := serveQUIC(t)
+	echo := socks4test.NewEchoTarget(t)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go Forward(lis, tr)
+	// a TCP only client of the local helper.
+	conn, err := socks4.NewDialer(lis.Addr().String(), socks4.WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	socks4test.AssertEcho(t, conn, []byte("hello"))
+}
+
+func TestNewTransportConfig(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		address    string
+		config     *tls.Config
+		serverName string
+		protos     []string
+	}{
+		{name: "defaults", address: "proxy.example.com:1080", config: &tls.Config{}, serverName: "proxy.example.com", protos: []string{NextProto}},
+		{name: "server name", address: "192.0.2.1:1080", config: &tls.Config{ServerName: "proxy.example.com"}, serverName: "proxy.example.com", protos: []string{NextProto}},
+		{name: "protocols", address: "proxy.example.com:1080", config: &tls.Config{NextProtos: []string{"socks4-v2"}}, serverName: "proxy.example.com", protos: []string{"socks4-v2"}},
+	} {
+		protos := tt.config.NextProtos
+		tr := NewTransport(tt.address, tt.config)
+		if tr.tlsConfig.ServerName != tt.serverName || len(tr.tlsConfig.NextProtos) != len(tt.protos) || tr.tlsConfig.NextProtos[0] != tt.protos[0] {
+			t.Errorf("%v: server name %q and protocols %v, want %q and %v", tt.name, tr.tlsConfig.ServerName, tr.tlsConfig.NextProtos, tt.serverName, tt.protos)
+		}
+		if len(tt.config.NextProtos) != len(protos) || tt.name == "defaults" && tt.config.ServerName != "" {
+			t.Errorf("%v: the TLS config of the caller is modified", tt.name)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package socks4
+
+import (
+	"io"
+	"net"
+	"time"
+)
+
+// maxRejectReason is the max length of the reasons written after the
+// SOCKS 4 rejections.
+const maxRejectReason = 255
+
+// rejectReasonTimeout is the max time a dialer waits for the reason of a
+// rejection, see WithDialerRejectReason.
+const rejectReasonTimeout = time.Second
+
+// WithRejectReasons makes the server write the reason of the rejections
+// after the 8 bytes of the SOCKS 4 reject replies sent to the clients in
+// the networks, or to all clients if none, as a length byte followed by up
+// to 255 bytes of text. It is an extension for cooperating clients in
+// controlled environments, like the Dialer with WithDialerRejectReason, as
+// the reasons may show internal addresses and strict clients don't expect
+// them.
+func WithRejectReasons(clients ...*net.IPNet) OptionFunc {
+	return func(s *Server) {
+		s.rejectReasons = true
+		s.reasonClients = clients
+	}
+}
+
+// sendsRejectReason reports whether the rejections of the client are
+// followed by their reason.
+func (s *Server) sendsRejectReason(conn net.Conn) bool {
+	if !s.rejectReasons {
+		return false
+	}
+	if len(s.reasonClients) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP(conn))
+	for _, n := range s.reasonClients {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectReason returns the reason of err written after a rejection.
+func rejectReason(err error) []byte {
+	reason := err.Error()
+	if len(reason) > maxRejectReason {
+		reason = reason[:maxRejectReason]
+	}
+	return append([]byte{byte(len(reason))}, reason...)
+}
+
+// readRejectReason reads the reason written by the server after a
+// rejection, empty if it wrote none.
+func readRejectReason(conn net.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(rejectReasonTimeout))
+	n := make([]byte, 1)
+	if _, err := io.ReadFull(conn, n); err != nil {
+		return ""
+	}
+	reason := make([]byte, n[0])
+	read, _ := io.ReadFull(conn, reason)
+	return string(reason[:read])
+}
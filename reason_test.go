@@ -0,0 +1,114 @@
+package socks4
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRejectReason(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		err    error
+		reason []byte
+	}{
+		{name: "short", err: errDenied, reason: append([]byte{14}, "denied by rule"...)},
+		{name: "empty", err: errors.New(""), reason: []byte{0}},
+		{name: "max length", err: errors.New(strings.Repeat("a", 255)), reason: append([]byte{255}, strings.Repeat("a", 255)...)},
+		{name: "truncated", err: errors.New(strings.Repeat("a", 300)), reason: append([]byte{255}, strings.Repeat("a", 255)...)},
+	} {
+		if reason := rejectReason(tt.err); !bytes.Equal(reason, tt.reason) {
+			t.Errorf("%v: reason %q, want %q", tt.name, reason, tt.reason)
+		}
+	}
+}
+
+func TestReadRejectReason(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		written []byte
+		reason  string
+	}{
+		{name: "reason", written: append([]byte{14}, "denied by rule"...), reason: "denied by rule"},
+		{name: "empty", written: []byte{0}},
+		{name: "none"},
+		{name: "truncated", written: append([]byte{14}, "denied"...), reason: "denied"},
+	} {
+		client, server := net.Pipe()
+		go func() {
+			server.Write(tt.written)
+			server.Close()
+		}()
+		if reason := readRejectReason(client); reason != tt.reason {
+			t.Errorf("%v: read %q, want %q", tt.name, reason, tt.reason)
+		}
+		client.Close()
+	}
+}
+
+func TestSendsRejectReason(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	for _, tt := range []struct {
+		name   string
+		opts   []OptionFunc
+		client string
+		sends  bool
+	}{
+		{name: "disabled", client: "10.0.0.1"},
+		{name: "all clients", opts: []OptionFunc{WithRejectReasons()}, client: "192.0.2.1", sends: true},
+		{name: "client in the networks", opts: []OptionFunc{WithRejectReasons(lan)}, client: "10.0.0.1", sends: true},
+		{name: "other client", opts: []OptionFunc{WithRejectReasons(lan)}, client: "192.0.2.1"},
+	} {
+		if sends := newTestServer(tt.opts...).sendsRejectReason(fromIP(tt.client)); sends != tt.sends {
+			t.Errorf("%v: sends the reasons %v, want %v", tt.name, sends, tt.sends)
+		}
+	}
+}
+
+func TestRejectErrorReason(t *testing.T) {
+	for _, tt := range []struct {
+		err  RejectError
+		want string
+	}{
+		{RejectError{Code: RejectOrFailure}, "SOCKS request rejected or failed (code 0x5b)"},
+		{RejectError{Code: RejectOrFailure, Reason: "denied by rule"}, "SOCKS request rejected or failed (code 0x5b): denied by rule"},
+		{RejectError{Code: RejectWrongUserId, Reason: "user id rejected"}, "SOCKS request rejected: user id mismatch: user id rejected"},
+	} {
+		if msg := tt.err.Error(); msg != tt.want {
+			t.Errorf("error %q, want %q", msg, tt.want)
+		}
+	}
+}
+
+func TestRejectReasons(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader("deny"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	for _, tt := range []struct {
+		name    string
+		clients []*net.IPNet
+		opts    []DialerOption
+		reason  string // in the reason, none if empty.
+	}{
+		{name: "read", opts: []DialerOption{WithDialerRejectReason()}, reason: "denied by rule"},
+		{name: "not read"},
+		{name: "client outside the networks", clients: []*net.IPNet{lan}, opts: []DialerOption{WithDialerRejectReason()}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := serve(t, WithRules(rules), WithRejectReasons(tt.clients...))
+			_, err := NewDialer(addr, append(tt.opts, WithDialerTimeout(5*time.Second))...).Dial("tcp", "127.0.0.1:80")
+			var rej *RejectError
+			if !errors.As(err, &rej) {
+				t.Fatalf("error %v, want a rejection", err)
+			}
+			if rej.Code != RejectOrFailure || !strings.Contains(rej.Reason, tt.reason) || tt.reason == "" && rej.Reason != "" {
+				t.Errorf("rejected with code %#x and reason %q, want %q", rej.Code, rej.Reason, tt.reason)
+			}
+		})
+	}
+}
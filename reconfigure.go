@@ -0,0 +1,93 @@
+package socks4
+
+import (
+	"time"
+)
+
+// Config is the configuration of a server changed at runtime by
+// Reconfigure, set by the options of the same name at NewServer. Zero
+// values mean no limit.
+type Config struct {
+	HandshakeTimeout       time.Duration // see WithHandshakeTimeout.
+	DialTimeout            time.Duration // see WithDialTimeout.
+	IdleTimeout            time.Duration // see WithIdleTimeout.
+	StallTimeout           time.Duration // see WithStallTimeout.
+	CloseStalled           bool          // see WithStallTimeout.
+	MaxSessionBytes        int64         // see WithMaxSessionBytes.
+	MaxConns               int           // see WithMaxConns.
+	MaxConnsPerClient      int           // see WithMaxConnsPerClient.
+	MaxDialsPerDestination int           // see WithMaxDialsPerDestination.
+	FDReserve              int           // see WithFDReserve.
+	SoftMaxHandshakes      int           // see WithHandshakeLimits.
+	MaxHandshakes          int           // see WithHandshakeLimits.
+	SoftHandshakeTimeout   time.Duration // see WithHandshakeLimits.
+	MaxRelays              int           // see WithMaxRelays.
+	MaxSessionsPerUser     int           // see WithMaxSessionsPerUser.
+	RateLimit              int           // see WithRateLimit.
+	RateWindow             time.Duration // window of RateLimit.
+	Rules                  []Rule        // see WithRules.
+	DefaultAction          Action        // see WithDefaultAction.
+	// UserMaxSessions are the limits of the sessions of some users, see
+	// WithMaxSessionsPerUser.
+	UserMaxSessions map[string]int
+	// LogLevels are the levels of the log subsystems, see SetLogLevel. The
+	// subsystems left out follow the level of the logger.
+	LogLevels map[LogSubsystem]LogLevel
+}
+
+// config returns the current configuration, which must not be modified
+// once the server is created.
+func (s *Server) config() *Config {
+	return s.conf.Load()
+}
+
+// Config returns the current configuration of the server.
+func (s *Server) Config() Config {
+	c := *s.config()
+	c.Rules = append([]Rule(nil), c.Rules...)
+	if c.UserMaxSessions != nil {
+		perUser := make(map[string]int, len(c.UserMaxSessions))
+		for user, n := range c.UserMaxSessions {
+			perUser[user] = n
+		}
+		c.UserMaxSessions = perUser
+	}
+	c.LogLevels = s.LogLevels()
+	return c
+}
+
+// Reconfigure replaces the configuration of a running server at once. It
+// applies to the connections accepted afterwards, and to the later steps
+// of those being served, like their dials, while the connection limits
+// count the connections already served. Change a copy of Config to keep
+// the rest of the configuration, i.e.:
+//
+//	c := s.Config()
+//	c.IdleTimeout = 5 * time.Minute
+//	s.Reconfigure(c)
+func (s *Server) Reconfigure(c Config) {
+	c.Rules = identifyRules(c.Rules)
+	levels := c.LogLevels
+	c.LogLevels = nil
+
+	s.confMu.Lock()
+	defer s.confMu.Unlock()
+	s.conf.Store(&c)
+	for _, sub := range LogSubsystems() {
+		if level, ok := levels[sub]; ok {
+			s.SetLogLevel(sub, level)
+		} else {
+			s.ResetLogLevel(sub)
+		}
+	}
+	s.warnHiddenRules(c.Rules)
+}
+
+// update replaces the configuration by a copy changed by fn.
+func (s *Server) update(fn func(c *Config)) {
+	s.confMu.Lock()
+	defer s.confMu.Unlock()
+	c := *s.config()
+	fn(&c)
+	s.conf.Store(&c)
+}
@@ -0,0 +1,133 @@
+package socks4
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader("deny port 25\nallow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name  string
+		opts  []OptionFunc
+		check func(c Config) bool
+	}{
+		{name: "none", check: func(c Config) bool {
+			return c.HandshakeTimeout == 0 && c.DialTimeout == 0 && c.MaxConns == 0 && len(c.Rules) == 0 && len(c.LogLevels) == 0
+		}},
+		{name: "timeouts", opts: []OptionFunc{WithHandshakeTimeout(time.Second), WithDialTimeout(2 * time.Second), WithIdleTimeout(time.Minute)}, check: func(c Config) bool {
+			return c.HandshakeTimeout == time.Second && c.DialTimeout == 2*time.Second && c.IdleTimeout == time.Minute
+		}},
+		{name: "limits", opts: []OptionFunc{WithMaxConns(100), WithMaxConnsPerClient(10), WithMaxDialsPerDestination(4), WithRateLimit(5, time.Minute)}, check: func(c Config) bool {
+			return c.MaxConns == 100 && c.MaxConnsPerClient == 10 && c.MaxDialsPerDestination == 4 && c.RateLimit == 5 && c.RateWindow == time.Minute
+		}},
+		{name: "rules", opts: []OptionFunc{WithRules(rules)}, check: func(c Config) bool {
+			return len(c.Rules) == 2 && c.Rules[0].ID == "#1" && c.Rules[1].ID == "#2" && c.Rules[1].Action == Allow
+		}},
+		{name: "log levels", opts: []OptionFunc{func(s *Server) { s.SetLogLevel(LogRelay, LogDebug) }}, check: func(c Config) bool {
+			return reflect.DeepEqual(c.LogLevels, map[LogSubsystem]LogLevel{LogRelay: LogDebug})
+		}},
+	} {
+		if c := newTestServer(tt.opts...).Config(); !tt.check(c) {
+			t.Errorf("%v: config %+v", tt.name, c)
+		}
+	}
+}
+
+func TestConfigCopy(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader("allow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(WithRules(rules))
+	c := s.Config()
+	c.Rules[0].Action = Deny
+	c.LogLevels[LogRelay] = LogDebug
+	if c := s.Config(); c.Rules[0].Action != Allow || len(c.LogLevels) != 0 {
+		t.Errorf("config %+v changed by its copy", c)
+	}
+}
+
+func TestReconfigure(t *testing.T) {
+	echo := echoTarget(t)
+	s, addr := serve(t)
+	d := NewDialer(addr, WithDialerTimeout(5*time.Second))
+	established, err := d.Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer established.Close()
+	assertEcho(t, established, []byte("hello"))
+
+	deny, err := ParseRules(strings.NewReader("deny"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name    string
+		change  func(c *Config)
+		allowed bool
+	}{
+		{name: "rules", change: func(c *Config) { c.Rules = deny }},
+		{name: "rules reset", change: func(c *Config) { c.Rules = nil }, allowed: true},
+		// the established session is counted.
+		{name: "max conns", change: func(c *Config) { c.MaxConns = 1 }},
+		{name: "max conns per client", change: func(c *Config) { c.MaxConns = 0; c.MaxConnsPerClient = 1 }},
+		{name: "limits reset", change: func(c *Config) { c.MaxConnsPerClient = 0 }, allowed: true},
+		{name: "log levels", change: func(c *Config) { c.LogLevels = map[LogSubsystem]LogLevel{LogRules: LogDebug} }, allowed: true},
+	} {
+		c := s.Config()
+		tt.change(&c)
+		s.Reconfigure(c)
+		conn, err := d.Dial("tcp", echo.Addr)
+		if (err == nil) != tt.allowed {
+			t.Errorf("%v: dialed with error %v, want allowed %v", tt.name, err, tt.allowed)
+		}
+		if err == nil {
+			conn.Close()
+		}
+		if got := s.Config(); got.MaxConns != c.MaxConns || got.MaxConnsPerClient != c.MaxConnsPerClient || len(got.Rules) != len(c.Rules) || !reflect.DeepEqual(got.LogLevels, c.LogLevels) {
+			t.Errorf("%v: config %+v, want %+v", tt.name, got, c)
+		}
+	}
+	// the established session is relayed whatever the configuration.
+	assertEcho(t, established, []byte("world"))
+
+	// the levels left out are reset.
+	c := s.Config()
+	c.LogLevels = map[LogSubsystem]LogLevel{LogRelay: LogWarn}
+	s.Reconfigure(c)
+	if levels := s.LogLevels(); !reflect.DeepEqual(levels, map[LogSubsystem]LogLevel{LogRelay: LogWarn}) {
+		t.Errorf("log levels %v, want the relay at warn only", levels)
+	}
+}
+
+// blockingResolver blocks until the context of the lookups is done.
+type blockingResolver struct{}
+
+func (blockingResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestReconfigureDialTimeout(t *testing.T) {
+	s := newTestServer(WithDialTimeout(time.Minute), WithResolver(blockingResolver{}))
+	c := s.Config()
+	c.DialTimeout = 50 * time.Millisecond
+	s.Reconfigure(c)
+	start := time.Now()
+	if _, err := s.lookup("example.com", origin{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("lookup error %v, want the resolver timed out", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("lookup took %v, want the new dial timeout", elapsed)
+	}
+}
@@ -0,0 +1,249 @@
+package socks4
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisOptions are the options of a RedisStore.
+type RedisOptions struct {
+	Password  string        // password of the AUTH command, none if empty.
+	DB        int           // database selected on connection.
+	Prefix    string        // prefix of the keys, e.g. "socks4:".
+	TLSConfig *tls.Config   // TLS of the connections, nil for plaintext.
+	Timeout   time.Duration // timeout of dialing and of each command, 5s if 0.
+	MaxIdle   int           // max idle connections kept open, 4 if 0.
+}
+
+// redisIncrScript increments a counter and sets its TTL when it is created,
+// atomically.
+const redisIncrScript = `local v = redis.call('INCRBY', KEYS[1], ARGV[1])
+if v == tonumber(ARGV[1]) and tonumber(ARGV[2]) > 0 then redis.call('PEXPIRE', KEYS[1], ARGV[2]) end
+return v`
+
+// RedisStore is a Store in a Redis server, shared by the proxy instances
+// using it. It speaks the Redis protocol over a small pool of connections.
+type RedisStore struct {
+	address string
+	options RedisOptions
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+// NewRedisStore creates a store in the Redis server at address. It
+// connects on the first command.
+func NewRedisStore(address string, options RedisOptions) *RedisStore {
+	if options.Timeout <= 0 {
+		options.Timeout = 5 * time.Second
+	}
+	if options.MaxIdle <= 0 {
+		options.MaxIdle = 4
+	}
+	return &RedisStore{address: address, options: options}
+}
+
+func (r *RedisStore) Incr(key string, n int64, ttl time.Duration) (int64, error) {
+	return r.integer("EVAL", redisIncrScript, "1", r.options.Prefix+key,
+		strconv.FormatInt(n, 10), strconv.FormatInt(ttl.Milliseconds(), 10))
+}
+
+func (r *RedisStore) Get(key string) (int64, error) {
+	v, err := r.do("GET", r.options.Prefix+key)
+	if err != nil || v == nil {
+		return 0, err
+	}
+	b, ok := v.([]byte)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply %v to GET", v)
+	}
+	return strconv.ParseInt(string(b), 10, 64)
+}
+
+func (r *RedisStore) Set(key string, value int64, ttl time.Duration) error {
+	args := []string{"SET", r.options.Prefix + key, strconv.FormatInt(value, 10)}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := r.do(args...)
+	return err
+}
+
+func (r *RedisStore) Delete(key string) error {
+	_, err := r.do("DEL", r.options.Prefix+key)
+	return err
+}
+
+// Close closes the idle connections.
+func (r *RedisStore) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, c := range r.idle {
+		c.Close()
+	}
+	r.idle = nil
+	return nil
+}
+
+// integer runs a command replying an integer.
+func (r *RedisStore) integer(args ...string) (int64, error) {
+	v, err := r.do(args...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := v.(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected reply %v to %v", v, args[0])
+	}
+	return n, nil
+}
+
+// do runs a command on a pooled connection and returns its reply: nil,
+// int64, string, []byte or []any. Error replies are returned as
+// RedisError.
+func (r *RedisStore) do(args ...string) (any, error) {
+	c, err := r.get()
+	if err != nil {
+		return nil, err
+	}
+	v, err := c.do(r.options.Timeout, args...)
+	var rErr RedisError
+	if err != nil && !errors.As(err, &rErr) {
+		// the state of the connection is unknown.
+		c.Close()
+		return nil, err
+	}
+	r.put(c)
+	return v, err
+}
+
+// get returns an idle connection, or a new one.
+func (r *RedisStore) get() (*redisConn, error) {
+	r.mu.Lock()
+	if n := len(r.idle); n > 0 {
+		c := r.idle[n-1]
+		r.idle = r.idle[:n-1]
+		r.mu.Unlock()
+		return c, nil
+	}
+	r.mu.Unlock()
+
+	d := net.Dialer{Timeout: r.options.Timeout}
+	var conn net.Conn
+	var err error
+	if r.options.TLSConfig != nil {
+		conn, err = tls.DialWithDialer(&d, "tcp", r.address, r.options.TLSConfig)
+	} else {
+		conn, err = d.Dial("tcp", r.address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis: %v", err)
+	}
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn)}
+	if r.options.Password != "" {
+		if _, err := c.do(r.options.Timeout, "AUTH", r.options.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if r.options.DB != 0 {
+		if _, err := c.do(r.options.Timeout, "SELECT", strconv.Itoa(r.options.DB)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// put returns a connection to the pool.
+func (r *RedisStore) put(c *redisConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.idle) >= r.options.MaxIdle {
+		c.Close()
+		return
+	}
+	r.idle = append(r.idle, c)
+}
+
+// RedisError is an error replied by the Redis server.
+type RedisError string
+
+func (e RedisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection to the Redis server.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends a command and reads its reply.
+func (c *redisConn) do(timeout time.Duration, args ...string) (any, error) {
+	c.SetDeadline(time.Now().Add(timeout))
+	b := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b = append(b, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		b = append(b, arg...)
+		b = append(b, "\r\n"...)
+	}
+	if _, err := c.Write(b); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+// readReply reads a reply of the RESP2 protocol.
+func (c *redisConn) readReply() (any, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, RedisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(rest)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = c.readReply(); err != nil {
+				var rErr RedisError
+				if !errors.As(err, &rErr) {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply type %q", kind)
+	}
+}
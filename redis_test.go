@@ -0,0 +1,253 @@
+package socks4
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves the commands of a RedisStore from its memory. AUTH
+// accepts the password "secret".
+type fakeRedis struct {
+	addr string
+
+	mu      sync.Mutex
+	values  map[string]string
+	expires map[string]time.Time
+	conns   int      // connections accepted.
+	dbs     []string // databases selected.
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	f := &fakeRedis{addr: lis.Addr().String(), values: make(map[string]string), expires: make(map[string]time.Time)}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		conn.Write([]byte(f.do(args)))
+	}
+}
+
+// readCommand reads a command as an array of bulk strings.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil || line[0] != '*' {
+		return nil, errors.New("not a command")
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+// do runs the command and returns its reply.
+func (f *fakeRedis) do(args []string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, at := range f.expires {
+		if !time.Now().Before(at) {
+			delete(f.values, key)
+			delete(f.expires, key)
+		}
+	}
+	switch strings.ToUpper(args[0]) {
+	case "AUTH":
+		if args[1] != "secret" {
+			return "-WRONGPASS invalid password\r\n"
+		}
+		return "+OK\r\n"
+	case "SELECT":
+		f.dbs = append(f.dbs, args[1])
+		return "+OK\r\n"
+	case "GET":
+		v, ok := f.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+	case "SET":
+		f.values[args[1]] = args[2]
+		delete(f.expires, args[1])
+		if len(args) == 5 && args[3] == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			f.expires[args[1]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		_, ok := f.values[args[1]]
+		delete(f.values, args[1])
+		delete(f.expires, args[1])
+		if ok {
+			return ":1\r\n"
+		}
+		return ":0\r\n"
+	case "EVAL":
+		if args[1] != redisIncrScript || args[2] != "1" {
+			return "-ERR unknown script\r\n"
+		}
+		key := args[3]
+		n, _ := strconv.ParseInt(args[4], 10, 64)
+		ms, _ := strconv.Atoi(args[5])
+		v, err := strconv.ParseInt(f.values[key], 10, 64)
+		if err != nil && f.values[key] != "" {
+			return "-ERR value is not an integer\r\n"
+		}
+		v += n
+		f.values[key] = strconv.FormatInt(v, 10)
+		if v == n && ms > 0 {
+			f.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return ":" + f.values[key] + "\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisStore(t *testing.T) {
+	for _, tt := range storeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeRedis(t)
+			r := NewRedisStore(f.addr, RedisOptions{Prefix: "socks4:"})
+			defer r.Close()
+			testStore(t, r, tt.ops)
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			for key := range f.values {
+				if !strings.HasPrefix(key, "socks4:") {
+					t.Errorf("key %q without the prefix", key)
+				}
+			}
+			// the commands run one at a time on the same connection.
+			if f.conns != 1 {
+				t.Errorf("%v connections, want 1", f.conns)
+			}
+		})
+	}
+}
+
+func TestRedisStoreConnect(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		options RedisOptions
+		dbs     []string
+		err     bool
+	}{
+		{name: "password", options: RedisOptions{Password: "secret"}},
+		{name: "wrong password", options: RedisOptions{Password: "wrong"}, err: true},
+		{name: "database", options: RedisOptions{DB: 2}, dbs: []string{"2"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeRedis(t)
+			r := NewRedisStore(f.addr, tt.options)
+			defer r.Close()
+			_, err := r.Incr("a", 1, time.Minute)
+			var rErr RedisError
+			if (err != nil) != tt.err || err != nil && !errors.As(err, &rErr) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			f.mu.Lock()
+			defer f.mu.Unlock()
+			if !reflect.DeepEqual(f.dbs, tt.dbs) {
+				t.Errorf("databases %q selected, want %q", f.dbs, tt.dbs)
+			}
+		})
+	}
+}
+
+func TestRedisStoreErrors(t *testing.T) {
+	f := newFakeRedis(t)
+	r := NewRedisStore(f.addr, RedisOptions{})
+	defer r.Close()
+	r.Set("a", 1, 0)
+	f.mu.Lock()
+	f.values["a"] = "one"
+	f.mu.Unlock()
+	// the error replies keep the connection.
+	var rErr RedisError
+	if _, err := r.Incr("a", 1, 0); !errors.As(err, &rErr) {
+		t.Errorf("error %v, want a Redis error", err)
+	}
+	if _, err := r.Get("a"); err == nil {
+		t.Error("value not an integer read")
+	}
+	if len(r.idle) != 1 {
+		t.Errorf("%v idle connections, want 1", len(r.idle))
+	}
+
+	// the server is down.
+	r = NewRedisStore("127.0.0.1:1", RedisOptions{Timeout: time.Second})
+	if _, err := r.Incr("a", 1, 0); err == nil {
+		t.Error("counter incremented without a server")
+	}
+}
+
+func TestRedisReadReply(t *testing.T) {
+	for _, tt := range []struct {
+		in    string
+		reply any
+		err   bool
+	}{
+		{in: "+OK\r\n", reply: "OK"},
+		{in: "-ERR wrong\r\n", err: true},
+		{in: ":42\r\n", reply: int64(42)},
+		{in: ":-1\r\n", reply: int64(-1)},
+		{in: "$5\r\nhello\r\n", reply: []byte("hello")},
+		{in: "$0\r\n\r\n", reply: []byte{}},
+		{in: "$-1\r\n", reply: nil},
+		{in: "*2\r\n:1\r\n$1\r\na\r\n", reply: []any{int64(1), []byte("a")}},
+		{in: "*2\r\n-ERR one\r\n:2\r\n", reply: []any{nil, int64(2)}},
+		{in: "*-1\r\n", reply: nil},
+		{in: "$5\r\nhel", err: true},
+		{in: ":one\r\n", err: true},
+		{in: "OK\r\n", err: true},
+		{in: "+OK\n", err: true},
+		{in: "", err: true},
+	} {
+		c := &redisConn{r: bufio.NewReader(strings.NewReader(tt.in))}
+		reply, err := c.readReply()
+		if (err != nil) != tt.err || !tt.err && !reflect.DeepEqual(reply, tt.reply) {
+			t.Errorf("%q: reply %#v with error %v, want %#v", tt.in, reply, err, tt.reply)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package socks4
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RequestDetail is the complete request of a rejected session, see
+// WithRejectAudit.
+type RequestDetail struct {
+	Protocol string   `json:"protocol,omitempty"` // empty if the request was not parsed.
+	Version  byte     `json:"version,omitempty"`
+	Cmd      byte     `json:"cmd,omitempty"`
+	Port     int      `json:"port,omitempty"`
+	Address  string   `json:"address,omitempty"`
+	IsV4A    bool     `json:"is_v4a,omitempty"`
+	UserId   string   `json:"user_id,omitempty"`
+	Resolved []string `json:"resolved,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	// Raw are the bytes the request was read from, up to maxRawRequest, with
+	// the user ids carrying secrets or tokens, the SOCKS 5 passwords and
+	// the HTTP credentials masked. Those of the SOCKS 5 and HTTP requests
+	// are the first read of the session.
+	Raw []byte `json:"raw,omitempty"`
+}
+
+// maxRawRequest is the max number of raw bytes of a RequestDetail.
+const maxRawRequest = 1024
+
+// WithRejectAudit makes the server log the complete request of the rejected
+// sessions, as parsed and as read from the client, and add it to their
+// EventRejected as Event.Request for the audit log, so that the probing of
+// the proxy can be investigated. At most burst requests are detailed
+// within each window, those beyond are counted and their number logged
+// once the window ends.
+func WithRejectAudit(window time.Duration, burst int) OptionFunc {
+	return func(s *Server) {
+		if burst < 1 {
+			burst = 1
+		}
+		s.rejectAudit = &rejectAuditor{window: window, burst: burst}
+	}
+}
+
+// rejectAuditor counts the detailed rejections within their window.
+type rejectAuditor struct {
+	window time.Duration
+	burst  int
+
+	mu         sync.Mutex
+	start      time.Time
+	count      int // rejections detailed within the window.
+	suppressed int // rejections beyond the burst.
+}
+
+// allow reports whether a rejection at now is detailed, and the number of
+// rejections suppressed in the previous window, if it ended.
+func (a *rejectAuditor) allow(now time.Time) (bool, int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	suppressed := 0
+	if now.Sub(a.start) >= a.window {
+		suppressed = a.suppressed
+		a.start, a.count, a.suppressed = now, 0, 0
+	}
+	if a.count >= a.burst {
+		a.suppressed++
+		return false, suppressed
+	}
+	a.count++
+	return true, suppressed
+}
+
+// rawRecorder records up to maxRawRequest bytes written to it.
+type rawRecorder struct {
+	buf []byte
+}
+
+func (r *rawRecorder) Write(p []byte) (int, error) {
+	if room := maxRawRequest - len(r.buf); room < len(p) {
+		r.buf = append(r.buf, p[:room]...)
+	} else {
+		r.buf = append(r.buf, p...)
+	}
+	return len(p), nil
+}
+
+// setRaw records the first bytes of the request of the session, if the
+// rejections are audited.
+func (s *Server) setRaw(ss *session, b []byte) {
+	if s.rejectAudit == nil {
+		return
+	}
+	if len(b) > maxRawRequest {
+		b = b[:maxRawRequest]
+	}
+	ss.raw = append([]byte(nil), b...)
+}
+
+// auditRejection returns the detail of the rejected request of the session,
+// nil if the rejections are not audited or beyond their rate.
+func (s *Server) auditRejection(ss *session, req Request, logger Logger) *RequestDetail {
+	if s.rejectAudit == nil {
+		return nil
+	}
+	ok, suppressed := s.rejectAudit.allow(s.clock.Now())
+	if suppressed > 0 {
+		s.logger.Warnf("%v rejected requests beyond the audit rate not detailed", suppressed)
+	}
+	if !ok {
+		return nil
+	}
+	d := &RequestDetail{Raw: s.maskRaw(ss.raw)}
+	if req.Version != 0 {
+		d.Protocol = req.Protocol()
+		d.Version, d.Cmd, d.Port, d.Address, d.IsV4A = req.Version, req.Cmd, req.Port, req.Address, req.IsV4A
+		d.UserId, d.Groups = req.UserId, req.Groups
+		for _, ip := range req.Resolved {
+			d.Resolved = append(d.Resolved, ip.String())
+		}
+	}
+	if b, err := json.Marshal(d); err == nil {
+		logger.Warnf("rejected request: %s", b)
+	}
+	return d
+}
+
+// masksUserIds reports whether the user ids of the SOCKS 4 requests carry
+// PAM secrets or tokens, masked in the logs and the audit.
+func (s *Server) masksUserIds() bool {
+	return s.jwt != nil || (s.pam != nil && s.pam.Separator != "")
+}
+
+// maskUserId returns the request read from a SOCKS 4 client with its user
+// id masked like by maskRaw, for the logs and the sessions of the rejected
+// requests.
+func (s *Server) maskUserId(req Request) Request {
+	if req.Version == Version4 && s.masksUserIds() {
+		req.UserId = strings.Repeat("*", len(req.UserId))
+	}
+	return req
+}
+
+// maskRaw returns the raw bytes of a request with its secrets masked: the
+// user id of a SOCKS 4 request when it carries a PAM secret or a token, the
+// username and password of a SOCKS 5 one, and the credentials of the
+// authorization headers of an HTTP one.
+func (s *Server) maskRaw(raw []byte) []byte {
+	if len(raw) == 0 {
+		return raw
+	}
+	switch {
+	case raw[0] == Version4 && len(raw) > 8 && s.masksUserIds():
+		masked := append([]byte(nil), raw...)
+		maskBytes(masked[8:], bytes.IndexByte(masked[8:], NullByte))
+		return masked
+	case raw[0] == Version5:
+		return maskSocks5Auth(raw)
+	case isHTTPMethod(raw[0]):
+		return maskHTTPAuth(raw)
+	}
+	return raw
+}
+
+// maskSocks5Auth masks the username and password of the SOCKS 5
+// username/password authentication following the greeting in raw, the
+// UNAME and PASSWD of RFC 1929, leaving the request after them as is.
+func maskSocks5Auth(raw []byte) []byte {
+	if len(raw) < 2 {
+		return raw
+	}
+	i := 2 + int(raw[1])
+	if i >= len(raw) || raw[i] != 0x01 {
+		return raw
+	}
+	masked := append([]byte(nil), raw...)
+	// the username, then the password, each after its length.
+	i++
+	for field := 0; field < 2 && i < len(masked); field++ {
+		n := int(masked[i])
+		i++
+		maskBytes(masked[i:], n)
+		i += n
+	}
+	return masked
+}
+
+// maskHTTPAuth masks the values of the authorization headers of raw.
+func maskHTTPAuth(raw []byte) []byte {
+	var masked []byte
+	for i := 0; i < len(raw); {
+		end := bytes.IndexByte(raw[i:], '\n')
+		if end < 0 {
+			end = len(raw) - i
+		}
+		line := raw[i : i+end]
+		if name, _, ok := bytes.Cut(line, []byte(":")); ok && isAuthHeader(string(bytes.TrimSpace(name))) {
+			if masked == nil {
+				masked = append([]byte(nil), raw...)
+			}
+			value := masked[i+len(name)+1 : i+end]
+			maskBytes(value, len(bytes.TrimRight(value, "\r")))
+		}
+		i += end + 1
+	}
+	if masked == nil {
+		return raw
+	}
+	return masked
+}
+
+// isAuthHeader reports whether the header of the name carries credentials.
+func isAuthHeader(name string) bool {
+	return strings.EqualFold(name, "Proxy-Authorization") || strings.EqualFold(name, "Authorization")
+}
+
+// maskBytes masks the first n bytes of b, all of them if n < 0 or beyond.
+func maskBytes(b []byte, n int) {
+	if n < 0 || n > len(b) {
+		n = len(b)
+	}
+	for i := range b[:n] {
+		b[i] = '*'
+	}
+}
@@ -0,0 +1,218 @@
+package socks4
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestMaskRaw(t *testing.T) {
+	stars := func(s string) string { return strings.Repeat("*", len(s)) }
+	jwt := newTestServer(WithJWT(NewJWTValidator(JWTConfig{})))
+	plain := newTestServer()
+	socks5Auth := append([]byte{Version5, 1, methodUserPass, 0x01, 5}, "alice\x06secret"...)
+	for _, tt := range []struct {
+		name string
+		s    *Server
+		raw  string
+		want string
+	}{
+		{
+			name: "SOCKS 4 token",
+			s:    jwt,
+			raw:  string(request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, "eyJ.token", "data")),
+			want: string(request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, "*********", "data")),
+		},
+		{
+			name: "SOCKS 4 truncated token",
+			s:    jwt,
+			raw:  string(request(CmdConnect, 80, [4]byte{10, 0, 0, 1})) + "eyJ",
+			want: string(request(CmdConnect, 80, [4]byte{10, 0, 0, 1})) + "***",
+		},
+		{
+			name: "SOCKS 4 plain user id",
+			s:    plain,
+			raw:  string(request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, "alice")),
+			want: string(request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, "alice")),
+		},
+		{
+			name: "SOCKS 5 credentials",
+			s:    plain,
+			raw:  string(socks5Auth),
+			want: string(socks5Auth[:5]) + "*****\x06******",
+		},
+		{
+			name: "SOCKS 5 credentials and request",
+			s:    plain,
+			raw:  string(socks5Auth) + "\x05\x01\x00\x03\x05alice\x00\x50",
+			want: string(socks5Auth[:5]) + "*****\x06******" + "\x05\x01\x00\x03\x05alice\x00\x50",
+		},
+		{
+			name: "SOCKS 5 truncated credentials",
+			s:    plain,
+			raw:  string(socks5Auth[:12]),
+			want: string(socks5Auth[:5]) + "*****\x06*",
+		},
+		{
+			name: "SOCKS 5 greeting",
+			s:    plain,
+			raw:  string([]byte{Version5, 2, methodNoAuth, methodUserPass}),
+			want: string([]byte{Version5, 2, methodNoAuth, methodUserPass}),
+		},
+		{
+			name: "HTTP credentials",
+			s:    plain,
+			raw:  "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nproxy-authorization: Basic YWxpY2U6c2VjcmV0\r\nAuthorization: Bearer token\r\n\r\n",
+			want: "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\nproxy-authorization:" + stars(" Basic YWxpY2U6c2VjcmV0") + "\r\nAuthorization:" + stars(" Bearer token") + "\r\n\r\n",
+		},
+		{
+			name: "HTTP truncated credentials",
+			s:    plain,
+			raw:  "CONNECT example.com:443 HTTP/1.1\r\nProxy-Authorization: Basic YWxp",
+			want: "CONNECT example.com:443 HTTP/1.1\r\nProxy-Authorization:" + stars(" Basic YWxp"),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := []byte(tt.raw)
+			if got := tt.s.maskRaw(raw); string(got) != tt.want {
+				t.Errorf("masked as %q, want %q", got, tt.want)
+			}
+			if string(raw) != tt.raw {
+				t.Error("raw bytes modified")
+			}
+		})
+	}
+}
+
+func FuzzMaskRaw(f *testing.F) {
+	f.Add(request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, "eyJ.token"))
+	f.Add(append([]byte{Version5, 1, methodUserPass, 0x01, 5}, "alice\x06secret"...))
+	f.Add([]byte("CONNECT example.com:443 HTTP/1.1\r\nProxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n\r\n"))
+	s := newTestServer(WithJWT(NewJWTValidator(JWTConfig{})))
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		masked := s.maskRaw(raw)
+		if len(masked) != len(raw) {
+			t.Fatalf("%q masked as %q", raw, masked)
+		}
+		for i := range masked {
+			if masked[i] != raw[i] && masked[i] != '*' {
+				t.Fatalf("%q masked as %q", raw, masked)
+			}
+		}
+		// the masked bytes are masked again the same.
+		if again := s.maskRaw(masked); !bytes.Equal(again, masked) {
+			t.Fatalf("%q masked again as %q", masked, again)
+		}
+	})
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent writes.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// eventChan sends the events notified to it.
+type eventChan chan Event
+
+func (c eventChan) Notify(ev Event) { c <- ev }
+
+func TestUserIdMasked(t *testing.T) {
+	jwt := WithJWT(NewJWTValidator(JWTConfig{Keys: map[string]any{"": []byte("secret")}}))
+	pam := WithPAM(PAMConfig{Service: "socks4", Separator: ":"})
+	token := hsToken("other", map[string]any{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	payload := strings.Split(token, ".")[1]
+	req := request(CmdConnect, 80, [4]byte{10, 0, 0, 1}, token)
+	for _, tt := range []struct {
+		name        string
+		opts        []OptionFunc
+		maintenance bool
+		raw         []byte
+	}{
+		{name: "invalid token", opts: []OptionFunc{jwt}, raw: req},
+		{name: "maintenance", opts: []OptionFunc{jwt}, maintenance: true, raw: req},
+		{name: "trailing data", opts: []OptionFunc{jwt}, raw: append(req[:len(req):len(req)], "data"...)},
+		{name: "PAM without separator", opts: []OptionFunc{pam}, raw: req},
+		{
+			name: "SOCKS 5 authentication",
+			opts: []OptionFunc{WithSocks5(func(string, string) bool { return false })},
+			raw:  append([]byte{Version5, 1, methodUserPass, 0x01, byte(len(token))}, token+"\x07hunter2"...),
+		},
+		{
+			name: "HTTP authentication",
+			opts: []OptionFunc{WithHTTPConnect(func(string, string) bool { return false })},
+			raw:  []byte("CONNECT example.com:443 HTTP/1.1\r\nProxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(token+":hunter2")) + "\r\n\r\n"),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var log, access lockedBuffer
+			store := &auditRecords{}
+			audit := NewAuditLog(store, 0, nil)
+			accessLog, err := NewAccessLog(&access, AccessLogOptions{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			events := make(eventChan, 1)
+			logger := &logrus.Logger{Out: &log, Formatter: &logrus.JSONFormatter{}, Level: logrus.DebugLevel}
+			s, addr := serve(t, append(tt.opts, WithLogger(logger), WithRejectAudit(time.Minute, 10),
+				WithEventNotifier(audit), WithEventNotifier(accessLog), WithEventNotifier(events))...)
+			if tt.maintenance {
+				s.SetMaintenance(&Maintenance{})
+			}
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write(tt.raw)
+			var ev Event
+			select {
+			case ev = <-events:
+			case <-time.After(5 * time.Second):
+				t.Fatal("rejection not notified")
+			}
+			audit.Close()
+			if ev.Type != EventRejected || ev.Request == nil {
+				t.Fatalf("event %+v, want a detailed rejection", ev)
+			}
+			outputs := map[string]string{
+				"session user id": ev.Session.UserId,
+				"request user id": ev.Request.UserId,
+				"raw request":     string(ev.Request.Raw),
+				"access log":      access.String(),
+				"log":             log.String(),
+			}
+			store.mu.Lock()
+			for _, rec := range store.records {
+				outputs["audit record"] += rec.UserId + " " + rec.Request
+			}
+			store.mu.Unlock()
+			for name, out := range outputs {
+				if strings.Contains(out, payload) || strings.Contains(out, token[len(token)-8:]) || strings.Contains(out, "hunter2") {
+					t.Errorf("%v with the token: %q", name, out)
+				}
+			}
+			if outputs["audit record"] == "" {
+				t.Error("rejection not audited")
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package socks4
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewReply(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		code byte
+		addr net.Addr
+		want []byte
+		fail bool
+	}{
+		{name: "no address", code: Granted, want: []byte{0, Granted, 0, 0, 0, 0, 0, 0}},
+		{name: "IPv4", code: Granted, addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1080}, want: []byte{0, Granted, 4, 56, 10, 0, 0, 1}},
+		{name: "all interfaces", code: Granted, addr: &net.TCPAddr{IP: net.IPv6unspecified, Port: 80}, want: []byte{0, Granted, 0, 80, 0, 0, 0, 0}},
+		{name: "string address", code: RejectOrFailure, addr: &net.UnixAddr{Name: "10.0.0.2:443"}, want: []byte{0, RejectOrFailure, 1, 187, 10, 0, 0, 2}},
+		{name: "IPv6", code: Granted, addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}, fail: true},
+		{name: "unknown code", code: 0x42, fail: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rep, err := NewReply(tt.code, tt.addr)
+			if tt.fail {
+				if err == nil {
+					t.Fatalf("reply %+v built", rep)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := rep.MarshalBinary()
+			if err != nil || !bytes.Equal(b, tt.want) {
+				t.Errorf("encoded as %v, want %v: %v", b, tt.want, err)
+			}
+		})
+	}
+}
+
+func TestReplyMarshalBinary(t *testing.T) {
+	for _, rep := range []Reply{
+		{Cd: 0x42},
+		{Cd: Granted, Port: 65536},
+		{Cd: Granted, Port: -1},
+		{Cd: Granted, IP: net.ParseIP("2001:db8::1")},
+	} {
+		if b, err := rep.MarshalBinary(); err == nil {
+			t.Errorf("%+v encoded as %v", rep, b)
+		}
+		// ToBytes replaces what can't be encoded.
+		if b := rep.ToBytes(); len(b) != 8 || !isReplyCode(b[1]) {
+			t.Errorf("%+v encoded by ToBytes as %v", rep, b)
+		}
+	}
+	if b := (Reply{Cd: 0x42, IP: net.ParseIP("2001:db8::1")}).ToBytes(); !bytes.Equal(b, []byte{0, RejectOrFailure, 0, 0, 0, 0, 0, 0}) {
+		t.Errorf("encoded by ToBytes as %v", b)
+	}
+}
+
+// allInterfacesNetwork is the system network whose listeners report the
+// unspecified IPv6 address, like the dual-stack ones bound to all
+// interfaces.
+type allInterfacesNetwork struct{ systemNetwork }
+
+func (n allInterfacesNetwork) Listen(network, address string) (net.Listener, error) {
+	lis, err := n.systemNetwork.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return allInterfacesListener{lis}, nil
+}
+
+type allInterfacesListener struct{ net.Listener }
+
+func (l allInterfacesListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv6unspecified, Port: l.Listener.Addr().(*net.TCPAddr).Port}
+}
+
+func TestBindAllInterfacesReply(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(WithNetwork(allInterfacesNetwork{}))
+	go s.Serve(lis)
+	defer s.Close()
+
+	client, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write(request(CmdBind, 80, [4]byte{127, 0, 0, 1}, "")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(client, b); err != nil {
+		t.Fatal(err)
+	}
+	if b[1] != Granted || !bytes.Equal(b[4:], []byte{0, 0, 0, 0}) || b[2] == 0 && b[3] == 0 {
+		t.Errorf("BIND reply %v, want granted with 0.0.0.0 and the port of the listener", b)
+	}
+}
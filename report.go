@@ -0,0 +1,77 @@
+package socks4
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+)
+
+// ErrorReporter is called for the unexpected internal errors of a server,
+// like the panics of the sessions or the failures of the listeners and of
+// the store, to send them to an error tracking service. The metadata holds
+// the operation failed as "op", and what is known of the connection, like
+// "client", "session", "target" and the session labels. Routine rejections
+// of requests are not reported.
+type ErrorReporter func(ctx context.Context, err error, meta map[string]string)
+
+// WithErrorReporter makes the server report its internal errors to r. The
+// panics of the sessions are then recovered, closing the sessions, instead
+// of crashing the program.
+func WithErrorReporter(r ErrorReporter) OptionFunc {
+	return func(s *Server) {
+		s.errorReporter = r
+	}
+}
+
+// PanicError is the error reported for a panic of a session.
+type PanicError struct {
+	Value any
+	Stack []byte // of the goroutine panicking.
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// reportError reports err of the operation op to the error reporter, with
+// the metadata in key-value pairs.
+func (s *Server) reportError(op string, err error, meta ...string) {
+	if s.errorReporter == nil {
+		return
+	}
+	m := map[string]string{"op": op}
+	for i := 0; i+1 < len(meta); i += 2 {
+		m[meta[i]] = meta[i+1]
+	}
+	s.errorReporter(context.Background(), err, m)
+}
+
+// recoverSession recovers from a panic of the session, reporting it, if
+// the server has an error reporter.
+func (s *Server) recoverSession(ss *session) {
+	if s.errorReporter == nil {
+		return
+	}
+	v := recover()
+	if v == nil {
+		return
+	}
+	ss.close()
+	err := &PanicError{Value: v, Stack: debug.Stack()}
+	s.logger.Errorf("session %v of client %v: %v", ss.id, ss.client.RemoteAddr(), err)
+
+	info := ss.info()
+	m := map[string]string{"op": "session"}
+	for k, v := range info.Labels {
+		m[k] = v
+	}
+	m["session"] = strconv.FormatUint(info.ID, 10)
+	m["client"] = info.Client
+	if info.Cmd != "" {
+		m["cmd"] = info.Cmd
+		m["target"] = info.Target
+		m["user_id"] = info.UserId
+	}
+	s.errorReporter(context.Background(), err, m)
+}
@@ -0,0 +1,158 @@
+package socks4
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// report is an error reported to an ErrorReporter.
+type report struct {
+	err  error
+	meta map[string]string
+}
+
+// reportChan is an ErrorReporter sending the reports to the channel.
+type reportChan chan report
+
+func (c reportChan) report(ctx context.Context, err error, meta map[string]string) {
+	c <- report{err: err, meta: meta}
+}
+
+func TestReportError(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		meta []string
+		want map[string]string
+	}{
+		{name: "no metadata", want: map[string]string{"op": "store"}},
+		{name: "metadata", meta: []string{"client", "10.0.0.1"}, want: map[string]string{"op": "store", "client": "10.0.0.1"}},
+		{name: "odd metadata", meta: []string{"client", "10.0.0.1", "remote"}, want: map[string]string{"op": "store", "client": "10.0.0.1"}},
+	} {
+		reports := make(reportChan, 1)
+		s := newTestServer(WithErrorReporter(reports.report))
+		s.reportError("store", errDial, tt.meta...)
+		r := <-reports
+		if r.err != errDial || !reflect.DeepEqual(r.meta, tt.want) {
+			t.Errorf("%v: reported %v with %v, want %v with %v", tt.name, r.err, r.meta, errDial, tt.want)
+		}
+	}
+	// without reporter.
+	newTestServer().reportError("store", errDial)
+}
+
+// failingListener fails its first accept.
+type failingListener struct {
+	net.Listener
+	failed atomic.Bool
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if !l.failed.Swap(true) {
+		return nil, errors.New("too many open files")
+	}
+	return l.Listener.Accept()
+}
+
+func TestErrorReporter(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		opts   []OptionFunc
+		failed bool // the listener fails its first accept.
+		meta   map[string]string
+		err    string
+	}{
+		{name: "accept", failed: true, meta: map[string]string{"op": "accept", "listener": "*"}, err: "too many open files"},
+		{name: "rate limit store", opts: []OptionFunc{WithRateLimit(10, time.Minute), WithStore(failingStore{NewMemoryStore()})}, meta: map[string]string{"op": "store", "client": "127.0.0.1"}, err: "store down"},
+		{name: "tarpit store", opts: []OptionFunc{WithRules([]Rule{{Action: Deny}}), WithTarpit(Tarpit{Threshold: 1, Window: time.Minute, Ban: time.Minute, Delay: time.Second}), WithStore(failingStore{NewMemoryStore()})}, meta: map[string]string{"op": "store", "client": "127.0.0.1"}, err: "store down"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reports := make(reportChan, 4)
+			s := newTestServer(append(tt.opts, WithErrorReporter(reports.report))...)
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var served net.Listener = lis
+			if tt.failed {
+				served = &failingListener{Listener: lis}
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.Serve(served)
+			}()
+			defer func() {
+				s.Close()
+				<-done
+			}()
+			conn, err := net.Dial("tcp", lis.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write(request(CmdConnect, 80, [4]byte{127, 0, 0, 1}, ""))
+
+			select {
+			case r := <-reports:
+				if tt.meta["listener"] == "*" {
+					tt.meta["listener"] = lis.Addr().String()
+				}
+				if !strings.Contains(r.err.Error(), tt.err) || !reflect.DeepEqual(r.meta, tt.meta) {
+					t.Errorf("reported %v with %v, want %q with %v", r.err, r.meta, tt.err, tt.meta)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("error not reported")
+			}
+		})
+	}
+}
+
+func TestRecoverSession(t *testing.T) {
+	echo := echoTarget(t)
+	reports := make(reportChan, 1)
+	var panicked atomic.Bool
+	s, addr := serve(t, WithErrorReporter(reports.report), WithRelayHook(func(net.Conn, Request, *Activity) {
+		if !panicked.Swap(true) {
+			panic("relay hook")
+		}
+	}))
+	d := NewDialer(addr, WithDialerTimeout(5*time.Second))
+	conn, err := d.Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	select {
+	case r := <-reports:
+		var pe *PanicError
+		if !errors.As(r.err, &pe) || pe.Value != "relay hook" || !strings.Contains(string(pe.Stack), "TestRecoverSession") {
+			t.Errorf("reported %v, want the panic of the relay hook with its stack", r.err)
+		}
+		if r.meta["op"] != "session" || r.meta["session"] == "" || r.meta["client"] != conn.LocalAddr().String() || r.meta["cmd"] != "connect" || r.meta["target"] != echo.Addr {
+			t.Errorf("reported with %v, want the session, client and target", r.meta)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("panic not reported")
+	}
+	// the session is closed, and the server serves the next ones.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("session of the panic not closed")
+	}
+	next, err := d.Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+	assertEcho(t, next, []byte("hello"))
+	if len(s.Sessions()) != 1 {
+		t.Errorf("%v sessions, want the next one", len(s.Sessions()))
+	}
+}
@@ -0,0 +1,204 @@
+package socks4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Resolver resolves the domain names of the SOCKS 4A and other requests
+// naming their target host. *net.Resolver is one.
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// WithResolver makes the server resolve the domain names of the requests
+// dialed directly with r, instead of the system resolver. The names of the
+// requests going through an upstream server or an SSH egress are resolved
+// by them.
+func WithResolver(r Resolver) OptionFunc {
+	return func(s *Server) {
+		s.resolver = r
+	}
+}
+
+// ErrNoIPv4 is the error of the SOCKS 4A requests rejected by
+// WithIPv4Only, whose target resolves to IPv6 addresses only.
+var ErrNoIPv4 = errors.New("no IPv4 address")
+
+// WithIPv4Only makes the server connect the SOCKS 4 requests to the IPv4
+// addresses of their targets only, as the SOCKS 4 replies can't carry IPv6
+// ones. The requests whose target has none are rejected with ErrNoIPv4.
+func WithIPv4Only() OptionFunc {
+	return func(s *Server) {
+		s.ipv4Only = true
+	}
+}
+
+// WithPreferIPv4 makes the server connect the SOCKS 4 requests to the IPv4
+// addresses of their targets first, so that their replies carry the
+// address bound by the server. The IPv6 ones are replied as 0.0.0.0 with
+// their port, telling the client to use the address of the server.
+func WithPreferIPv4() OptionFunc {
+	return func(s *Server) {
+		s.preferIPv4 = true
+	}
+}
+
+// ResolveHook is called with the CONNECT requests whose target has been
+// resolved, see Request.Resolved, before the rules are matched. The
+// requests are rejected with the errors it returns.
+type ResolveHook func(client net.Conn, req Request) error
+
+// WithResolveHook makes the server resolve the targets of the CONNECT
+// requests before matching the rules, and call hook with every address
+// they resolved to, e.g. to deny the names pointing to any internal host.
+// The requests going through an upstream server or an egress are resolved
+// by the server too.
+func WithResolveHook(hook ResolveHook) OptionFunc {
+	return func(s *Server) {
+		s.resolveHook = hook
+	}
+}
+
+// resolveRequest sets the addresses the target of the request resolves to
+// if the rules, the resolve hook, WithIPv4Only or WithPreferIPv4 need them.
+func (s *Server) resolveRequest(conn net.Conn, req Request, o origin) (Request, error) {
+	ipv4Only := s.ipv4Only && req.Version == Version4
+	preferIPv4 := s.preferIPv4 && req.Version == Version4
+	if req.Cmd != CmdConnect || (s.resolveHook == nil && !ipv4Only && !preferIPv4 && !s.hasResolvedRules()) {
+		return req, nil
+	}
+	host, _, err := net.SplitHostPort(req.Address)
+	if err != nil {
+		return req, err
+	}
+	if req.Resolved, err = s.lookup(host, o); err != nil {
+		s.log(LogResolver).Debugf("target %v of client %v: %v", req.Address, conn.RemoteAddr(), err)
+		return req, err
+	}
+	if ipv4Only {
+		var ips []net.IP
+		for _, ip := range req.Resolved {
+			if ip.To4() != nil {
+				ips = append(ips, ip)
+			}
+		}
+		if ips == nil {
+			return req, fmt.Errorf("%w: %v resolves to %v", ErrNoIPv4, host, req.Resolved)
+		}
+		req.Resolved = ips
+	}
+	if preferIPv4 {
+		sort.SliceStable(req.Resolved, func(i, j int) bool {
+			return req.Resolved[i].To4() != nil && req.Resolved[j].To4() == nil
+		})
+	}
+	s.log(LogResolver).Debugf("target %v of client %v resolved to %v", req.Address, conn.RemoteAddr(), req.Resolved)
+	if s.resolveHook != nil {
+		if err := s.resolveHook(conn, req); err != nil {
+			return req, err
+		}
+	}
+	return req, nil
+}
+
+// lookup returns the addresses of host for the origin, with the resolver
+// of the server if any.
+func (s *Server) lookup(host string, o origin) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	var r Resolver = net.DefaultResolver
+	if s.resolver != nil {
+		r = s.resolver
+	}
+	ctx, cancel := o.context(s)
+	defer cancel()
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %v: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// dialDirect connects to address with dial, trying in turn the addresses
+// its host was resolved to for the rules, or else those resolved by the
+// resolver of the server if any.
+func (s *Server) dialDirect(address string, o origin, dial func(address string) (net.Conn, error)) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return dial(address)
+	}
+	ips := o.resolved
+	if ips == nil {
+		if s.resolver == nil {
+			return dial(address)
+		}
+		if ips, err = s.lookup(host, o); err != nil {
+			return nil, err
+		}
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = dial(net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// SplitResolver resolves the names with the resolver of the first route
+// matching them, like an internal DNS server for the names of a private
+// domain, or else with its default resolver. Each resolver keeps its own
+// cache.
+type SplitResolver struct {
+	routes []splitRoute
+	def    Resolver
+}
+
+type splitRoute struct {
+	pattern  string
+	resolver Resolver
+}
+
+// NewSplitResolver returns a resolver with no routes, resolving the names
+// with def, nil for the system resolver.
+func NewSplitResolver(def Resolver) *SplitResolver {
+	if def == nil {
+		def = net.DefaultResolver
+	}
+	return &SplitResolver{def: def}
+}
+
+// Route resolves the names matching pattern, a name or "*.domain" matching
+// its subdomains, with r, nil for the system resolver. The routes are set
+// before the resolver is used.
+func (s *SplitResolver) Route(pattern string, r Resolver) {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	s.routes = append(s.routes, splitRoute{pattern: pattern, resolver: r})
+}
+
+// LookupIPAddr looks up the addresses of host with the resolver of its
+// route.
+func (s *SplitResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	name := strings.TrimSuffix(host, ".")
+	for _, route := range s.routes {
+		if matchName(route.pattern, name) {
+			return route.resolver.LookupIPAddr(ctx, host)
+		}
+	}
+	return s.def.LookupIPAddr(ctx, host)
+}
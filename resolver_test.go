@@ -0,0 +1,254 @@
+package socks4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestMatchResolved(t *testing.T) {
+	for _, tt := range []struct {
+		cidr  string
+		addrs []string
+		match bool
+	}{
+		{"private", []string{"10.0.0.1"}, true},
+		{"private", []string{"192.0.2.1", "192.168.1.1"}, true},
+		{"private", []string{"127.0.0.1"}, true},
+		{"private", []string{"169.254.169.254"}, true},
+		{"private", []string{"0.0.0.0"}, true},
+		{"private", []string{"fd00::1"}, true},
+		{"private", []string{"::1"}, true},
+		{"private", []string{"192.0.2.1", "2001:db8::1"}, false},
+		{"private", nil, false},
+		{"10.0.0.0/8", []string{"192.0.2.1", "10.1.2.3"}, true},
+		{"10.0.0.0/8", []string{"192.168.1.1"}, false},
+		{"2001:db8::/32", []string{"2001:db8::1"}, true},
+		{"invalid", []string{"10.0.0.1"}, false},
+	} {
+		var ips []net.IP
+		for _, a := range tt.addrs {
+			ips = append(ips, net.ParseIP(a))
+		}
+		if match := matchResolved(tt.cidr, ips); match != tt.match {
+			t.Errorf("%v matched %v: %v, want %v", tt.cidr, tt.addrs, match, tt.match)
+		}
+	}
+}
+
+func TestParseRuleResolved(t *testing.T) {
+	for _, tt := range []struct {
+		rule     string
+		resolved string // as printed.
+		ok       bool
+	}{
+		{rule: "deny resolved private", resolved: "private", ok: true},
+		{rule: "deny resolved 10.0.0.0/8", resolved: "10.0.0.0/8", ok: true},
+		{rule: "deny to *.example.com resolved fd00::/8", resolved: "fd00::/8", ok: true},
+		{rule: "deny resolved 10.0.0.1"},
+		{rule: "deny resolved internal"},
+		{rule: "deny resolved"},
+	} {
+		rule, err := ParseRule(tt.rule)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: error %v, want parsed %v", tt.rule, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if rule.Resolved != tt.resolved || !strings.Contains(rule.String(), "resolved "+tt.resolved) {
+			t.Errorf("%q: resolved %q in %q, want %q", tt.rule, rule.Resolved, rule.String(), tt.resolved)
+		}
+	}
+}
+
+// mapResolver resolves the names of its map, counting the lookups.
+type mapResolver struct {
+	mu      sync.Mutex
+	addrs   map[string][]string
+	lookups int
+}
+
+func (r *mapResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	ips, ok := r.addrs[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestResolvedRules(t *testing.T) {
+	echo := echoTarget(t)
+	_, port, _ := net.SplitHostPort(echo.Addr)
+	resolver := &mapResolver{addrs: map[string][]string{
+		"echo.example.com":     {"127.0.0.1"},
+		"rebound.example.com":  {"127.0.0.1", "10.0.0.1"},
+		"internal.example.com": {"192.0.2.1", "169.254.169.254"},
+	}}
+	for _, tt := range []struct {
+		name    string
+		rules   string
+		host    string
+		granted bool
+	}{
+		{name: "no address in the CIDR", rules: "deny resolved 10.0.0.0/8\nallow", host: "echo.example.com", granted: true},
+		{name: "an address in the CIDR", rules: "deny resolved 10.0.0.0/8\nallow", host: "rebound.example.com"},
+		{name: "a private address", rules: "deny resolved private\nallow", host: "internal.example.com"},
+		{name: "allowed CIDR", rules: "allow resolved 127.0.0.0/8\ndeny", host: "echo.example.com", granted: true},
+		{name: "not resolved", rules: "deny resolved private\nallow", host: "unknown.example.com"},
+		{name: "IP", rules: "deny resolved 10.0.0.0/8\nallow", host: "127.0.0.1", granted: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseRules(strings.NewReader(tt.rules))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, addr := serve(t, WithRules(rules), WithResolver(resolver))
+			conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", net.JoinHostPort(tt.host, port))
+			if tt.granted {
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				assertEcho(t, conn, []byte("hello"))
+				return
+			}
+			var rej *RejectError
+			if !errors.As(err, &rej) {
+				t.Errorf("error %v, want a rejection", err)
+			}
+		})
+	}
+}
+
+func TestResolveHook(t *testing.T) {
+	echo := echoTarget(t)
+	_, port, _ := net.SplitHostPort(echo.Addr)
+	resolver := &mapResolver{addrs: map[string][]string{
+		// the first address refuses the connections.
+		"echo.example.com":    {"127.0.0.2", "127.0.0.1"},
+		"rebound.example.com": {"127.0.0.1", "10.0.0.1"},
+	}}
+	var log lockedBuffer
+	logger := &logrus.Logger{Out: &log, Formatter: &logrus.TextFormatter{}, Level: logrus.InfoLevel}
+	hooked := make(chan Request, 4)
+	_, addr := serve(t, WithLogger(logger), WithResolver(resolver), WithResolveHook(func(client net.Conn, req Request) error {
+		hooked <- req
+		for _, ip := range req.Resolved {
+			if ip.IsPrivate() {
+				return errors.New("private address")
+			}
+		}
+		return nil
+	}))
+	d := NewDialer(addr, WithDialerTimeout(5*time.Second))
+
+	for _, tt := range []struct {
+		host     string
+		resolved []net.IP
+		granted  bool
+	}{
+		{host: "echo.example.com", resolved: []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.1")}, granted: true},
+		{host: "rebound.example.com", resolved: []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("10.0.0.1")}},
+		{host: "127.0.0.1", resolved: []net.IP{net.ParseIP("127.0.0.1")}, granted: true},
+	} {
+		conn, err := d.Dial("tcp", net.JoinHostPort(tt.host, port))
+		if tt.granted && err != nil {
+			t.Errorf("%v: %v", tt.host, err)
+		} else if !tt.granted && err == nil {
+			t.Errorf("%v: granted, want rejected by the hook", tt.host)
+		}
+		if err == nil {
+			conn.Close()
+		}
+		select {
+		case req := <-hooked:
+			if !reflect.DeepEqual(req.Resolved, tt.resolved) {
+				t.Errorf("%v: hook called with %v, want %v", tt.host, req.Resolved, tt.resolved)
+			}
+		default:
+			t.Errorf("%v: hook not called", tt.host)
+		}
+	}
+	// the log tells the address the name resolved to.
+	if want := "to target echo.example.com:" + port + " at 127.0.0.1:" + port; !strings.Contains(log.String(), want) {
+		t.Errorf("log without %q: %q", want, log.String())
+	}
+}
+
+func TestIPv4Only(t *testing.T) {
+	r := &mapResolver{addrs: map[string][]string{
+		"dual.example.com": {"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"},
+		"v4.example.com":   {"192.0.2.1"},
+		"v6.example.com":   {"2001:db8::1"},
+	}}
+	for _, tt := range []struct {
+		name     string
+		opts     []OptionFunc
+		req      Request
+		resolved string
+		err      error
+	}{
+		{name: "dual stack", opts: []OptionFunc{WithIPv4Only()}, req: Request{Version: Version4, Cmd: CmdConnect, Address: "dual.example.com:80"}, resolved: "[192.0.2.1 192.0.2.2]"},
+		{name: "IPv4 only", opts: []OptionFunc{WithIPv4Only()}, req: Request{Version: Version4, Cmd: CmdConnect, Address: "v4.example.com:80"}, resolved: "[192.0.2.1]"},
+		{name: "IPv6 only", opts: []OptionFunc{WithIPv4Only()}, req: Request{Version: Version4, Cmd: CmdConnect, Address: "v6.example.com:80"}, err: ErrNoIPv4},
+		{name: "IPv6 address", opts: []OptionFunc{WithIPv4Only()}, req: Request{Version: Version4, Cmd: CmdConnect, Address: "[2001:db8::1]:80"}, err: ErrNoIPv4},
+		{name: "SOCKS 5", opts: []OptionFunc{WithIPv4Only()}, req: Request{Version: Version5, Cmd: CmdConnect, Address: "v6.example.com:80"}, resolved: "[]"},
+		{name: "BIND", opts: []OptionFunc{WithIPv4Only()}, req: Request{Version: Version4, Cmd: CmdBind, Address: "v6.example.com:80"}, resolved: "[]"},
+		{name: "disabled", req: Request{Version: Version4, Cmd: CmdConnect, Address: "v6.example.com:80"}, resolved: "[]"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(append(tt.opts, WithResolver(r))...)
+			req, err := s.resolveRequest(&bufConn{}, tt.req, origin{})
+			if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if resolved := fmt.Sprint(req.Resolved); err == nil && resolved != tt.resolved {
+				t.Errorf("resolved to %v, want %v", req.Resolved, tt.resolved)
+			}
+			if err != nil && rejectionReason(err) != "resolve" {
+				t.Errorf("rejection reason %q, want resolve", rejectionReason(err))
+			}
+		})
+	}
+}
+
+func TestPreferIPv4(t *testing.T) {
+	r := &mapResolver{addrs: map[string][]string{
+		"dual.example.com": {"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2"},
+		"v6.example.com":   {"2001:db8::1"},
+	}}
+	for _, tt := range []struct {
+		name     string
+		req      Request
+		resolved string // as printed.
+	}{
+		{name: "dual stack", req: Request{Version: Version4, Cmd: CmdConnect, Address: "dual.example.com:80"}, resolved: "[192.0.2.1 192.0.2.2 2001:db8::1 2001:db8::2]"},
+		{name: "IPv6 only", req: Request{Version: Version4, Cmd: CmdConnect, Address: "v6.example.com:80"}, resolved: "[2001:db8::1]"},
+		{name: "SOCKS 5", req: Request{Version: Version5, Cmd: CmdConnect, Address: "dual.example.com:80"}, resolved: "[]"},
+	} {
+		s := newTestServer(WithPreferIPv4(), WithResolver(r))
+		req, err := s.resolveRequest(&bufConn{}, tt.req, origin{})
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+		} else if resolved := fmt.Sprint(req.Resolved); resolved != tt.resolved {
+			t.Errorf("%v: resolved to %v, want %v", tt.name, resolved, tt.resolved)
+		}
+	}
+}
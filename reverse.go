@@ -0,0 +1,272 @@
+package socks4
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CmdReverse is the command of a reverse request, which registers the
+// client to serve a connection to a public port of the server. It is an
+// extension of SOCKS 4, like a BIND whose listener outlives the request.
+var CmdReverse byte = 0x80
+
+const (
+	defaultReverseGrace = time.Minute
+	// max time an inbound connection waits for a registration.
+	reverseWait = 10 * time.Second
+)
+
+// ReversePolicy controls the public ports of reverse services.
+type ReversePolicy struct {
+	Host    string        // host of the public listeners, all interfaces if empty.
+	MinPort int           // lowest assignable public port, any port if 0.
+	MaxPort int           // highest assignable public port.
+	Grace   time.Duration // time a public port is kept without registrations, defaultReverseGrace if 0.
+}
+
+// WithReverse enables reverse requests, by which clients publish services
+// through the server. A client registers a service by sending requests of
+// command CmdReverse, with the service name as the SOCKS 4A host and the
+// wanted public port, 0 to let the server assign one. The first reply
+// carries the public port, and the second one comes when a connection to
+// the port is accepted, after which the request connection relays it like
+// a BIND. Clients keep several registrations waiting to serve concurrent
+// connections, and the public port of a service stays the same as long as
+// it is registered again within the grace period. A service belongs to
+// the client which registered it first, known by the identity of its
+// certificate or by its authenticated user id, see authenticated; the
+// requests of the other clients are rejected with ErrUserIdRejected.
+// Access is controlled by the rules for command "reverse".
+func WithReverse(policy ReversePolicy) OptionFunc {
+	return func(s *Server) {
+		if policy.Grace <= 0 {
+			policy.Grace = defaultReverseGrace
+		}
+		s.reverse = &reverseRegistry{policy: policy, services: make(map[string]*reverseService)}
+	}
+}
+
+var errReverseClosed = errors.New("reverse service is closed")
+
+// reverseRegistry holds the reverse services of a server by name.
+type reverseRegistry struct {
+	policy   ReversePolicy
+	logger   Logger
+	clock    Clock
+	network  Network
+	mu       sync.Mutex
+	services map[string]*reverseService
+	closed   bool
+}
+
+// reverseService is the public listener of a registered service.
+type reverseService struct {
+	name  string
+	owner string
+	lis   net.Listener
+	idle  chan chan net.Conn // registrations waiting for a connection.
+	done  chan struct{}      // closed with the listener.
+	refs  int                // active registrations, guarded by the registry.
+	timer Timer              // closes the service after the grace period.
+}
+
+// register returns the service of the name, creating its public listener
+// on port if it is new.
+func (r *reverseRegistry) register(name, owner string, port int) (*reverseService, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, errReverseClosed
+	}
+	if svc := r.services[name]; svc != nil {
+		if svc.owner != owner {
+			return nil, fmt.Errorf("reverse service %q is registered by another client", name)
+		}
+		if p := svc.lis.Addr().(*net.TCPAddr).Port; port != 0 && port != p {
+			return nil, fmt.Errorf("reverse service %q is registered on port %v", name, p)
+		}
+		if svc.timer != nil {
+			svc.timer.Stop()
+			svc.timer = nil
+		}
+		svc.refs++
+		return svc, nil
+	}
+
+	lis, err := r.listen(port)
+	if err != nil {
+		return nil, err
+	}
+	svc := &reverseService{
+		name:  name,
+		owner: owner,
+		lis:   lis,
+		idle:  make(chan chan net.Conn),
+		done:  make(chan struct{}),
+		refs:  1,
+	}
+	r.services[name] = svc
+	go svc.serve(r.clock)
+	r.logger.Infof("reverse service %q of %q published on %v", name, owner, lis.Addr())
+	return svc, nil
+}
+
+// listen creates a public listener on port, or on a port of the policy if
+// port is 0.
+func (r *reverseRegistry) listen(port int) (net.Listener, error) {
+	p := r.policy
+	if port != 0 {
+		if p.MinPort != 0 && (port < p.MinPort || port > p.MaxPort) {
+			return nil, fmt.Errorf("reverse port %v is out of range %v-%v", port, p.MinPort, p.MaxPort)
+		}
+		return r.network.Listen("tcp", net.JoinHostPort(p.Host, strconv.Itoa(port)))
+	}
+	if p.MinPort == 0 {
+		return r.network.Listen("tcp", net.JoinHostPort(p.Host, "0"))
+	}
+	for port := p.MinPort; port <= p.MaxPort; port++ {
+		lis, err := r.network.Listen("tcp", net.JoinHostPort(p.Host, strconv.Itoa(port)))
+		if err == nil {
+			return lis, nil
+		}
+	}
+	return nil, fmt.Errorf("no free reverse port in range %v-%v", p.MinPort, p.MaxPort)
+}
+
+// release ends a registration of svc. The service is closed when it is
+// not registered again within the grace period.
+func (r *reverseRegistry) release(svc *reverseService) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	svc.refs--
+	if svc.refs > 0 || r.services[svc.name] != svc {
+		return
+	}
+	svc.timer = r.clock.AfterFunc(r.policy.Grace, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if svc.refs > 0 || r.services[svc.name] != svc {
+			return
+		}
+		delete(r.services, svc.name)
+		svc.close()
+		r.logger.Infof("reverse service %q on %v is closed", svc.name, svc.lis.Addr())
+	})
+}
+
+// close closes all services, so that no registration waits any more.
+func (r *reverseRegistry) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	for name, svc := range r.services {
+		if svc.timer != nil {
+			svc.timer.Stop()
+		}
+		svc.close()
+		delete(r.services, name)
+	}
+}
+
+// publicAddr returns the address of the public listener, with the IPv4
+// unspecified address if it listens on all interfaces.
+func (svc *reverseService) publicAddr() net.Addr {
+	addr := *svc.lis.Addr().(*net.TCPAddr)
+	if addr.IP.IsUnspecified() {
+		addr.IP = net.IPv4zero
+	}
+	return &addr
+}
+
+func (svc *reverseService) close() {
+	svc.lis.Close()
+	close(svc.done)
+}
+
+// serve hands the accepted connections to the waiting registrations.
+func (svc *reverseService) serve(clock Clock) {
+	for {
+		conn, err := svc.lis.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			timer := clock.NewTimer(reverseWait)
+			defer timer.Stop()
+			select {
+			case reg := <-svc.idle:
+				reg <- conn
+			case <-timer.C():
+				conn.Close()
+			case <-svc.done:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// establishReverse registers the client for a connection to the public
+// port of the service, and returns the connection.
+func (s *Server) establishReverse(conn net.Conn, req Request, rep replier) (net.Conn, error) {
+	if s.reverse == nil {
+		return nil, errors.New("reverse requests are disabled")
+	}
+	name, _, err := net.SplitHostPort(req.Address)
+	if err != nil || name == "" || net.ParseIP(name) != nil {
+		return nil, fmt.Errorf("invalid reverse service name %q", name)
+	}
+	owner := clientIdentity(conn)
+	if owner == "" && s.authenticated(conn, req) {
+		owner = req.UserId
+	}
+	if owner == "" {
+		return nil, fmt.Errorf("%w: reverse requests need an authenticated client", ErrUserIdRejected)
+	}
+	svc, err := s.reverse.register(name, owner, req.Port)
+	if err != nil {
+		return nil, err
+	}
+	defer s.reverse.release(svc)
+
+	// first reply
+	if err := rep.granted(conn, svc.publicAddr()); err != nil {
+		return nil, err
+	}
+
+	// the client sends nothing until the second reply, so a read returns
+	// only when it goes away.
+	gone := make(chan struct{})
+	go func() {
+		var b [1]byte
+		conn.Read(b[:])
+		close(gone)
+	}()
+	stopRead := func() {
+		conn.SetReadDeadline(time.Now())
+		<-gone
+		conn.SetReadDeadline(time.Time{})
+	}
+
+	reg := make(chan net.Conn, 1)
+	select {
+	case svc.idle <- reg:
+	case <-gone:
+		return nil, errors.New("client closed the reverse registration")
+	case <-svc.done:
+		stopRead()
+		return nil, errReverseClosed
+	}
+	remote := <-reg
+	stopRead()
+	if s.dscp != 0 {
+		if err := setConnDSCP(remote, s.dscp); err != nil {
+			s.log(LogRelay).Warnf("failed to set DSCP for remote %v: %v", remote.RemoteAddr(), err)
+			s.reportError("dscp", err, "remote", remote.RemoteAddr().String())
+		}
+	}
+	return remote, nil
+}
@@ -0,0 +1,108 @@
+package socks4
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReverseRegister(t *testing.T) {
+	s := newTestServer(WithReverse(ReversePolicy{Host: "127.0.0.1"}))
+	defer s.reverse.close()
+	web, err := s.reverse.register("web", "alice", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := web.lis.Addr().(*net.TCPAddr).Port
+	for _, tt := range []struct {
+		name  string
+		owner string
+		port  int
+		ok    bool
+	}{
+		{name: "same owner", owner: "alice", ok: true},
+		{name: "same owner and port", owner: "alice", port: port, ok: true},
+		{name: "other port", owner: "alice", port: port + 1},
+		{name: "other owner", owner: "bob"},
+		{name: "no owner", owner: ""},
+	} {
+		svc, err := s.reverse.register("web", tt.owner, tt.port)
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: registered with error %v, want %v", tt.name, err, tt.ok)
+		}
+		if err == nil && svc != web {
+			t.Errorf("%v: registered another service", tt.name)
+		}
+	}
+}
+
+func TestReverseOwnership(t *testing.T) {
+	jwt := WithJWT(NewJWTValidator(JWTConfig{Keys: map[string]any{"": []byte("secret")}}))
+	exp := time.Now().Add(time.Hour).Unix()
+	alice := hsToken("secret", map[string]any{"sub": "alice", "exp": exp})
+	bob := hsToken("secret", map[string]any{"sub": "bob", "exp": exp})
+	for _, tt := range []struct {
+		name    string
+		opts    []OptionFunc
+		first   string // user id of the first registration.
+		second  string // user id of the second registration, of the same service.
+		granted [2]bool
+		code    byte // of the rejected registrations.
+	}{
+		{name: "claimed user id", first: "alice", second: "alice", code: RejectWrongUserId},
+		{name: "no user id", first: "", second: "", code: RejectWrongUserId},
+		{name: "authenticated user id", opts: []OptionFunc{jwt}, first: alice, second: alice, granted: [2]bool{true, true}},
+		{name: "other authenticated user id", opts: []OptionFunc{jwt}, first: alice, second: bob, granted: [2]bool{true, false}, code: RejectOrFailure},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := serve(t, append(tt.opts, WithReverse(ReversePolicy{Host: "127.0.0.1"}))...)
+			for i, userId := range []string{tt.first, tt.second} {
+				l, err := NewDialer(addr, WithDialerUserId(userId), WithDialerTimeout(5*time.Second)).Listen("web", 0)
+				if granted := err == nil; granted != tt.granted[i] {
+					t.Fatalf("registration %v granted: %v, want %v", i+1, err, tt.granted[i])
+				}
+				if err != nil {
+					var rej *RejectError
+					if !errors.As(err, &rej) || rej.Code != tt.code {
+						t.Errorf("registration %v failed: %v, want code %#x", i+1, err, tt.code)
+					}
+					continue
+				}
+				defer l.Close()
+				if i == 0 {
+					assertReverse(t, l)
+				}
+			}
+		})
+	}
+}
+
+// assertReverse connects to the public port of l and checks that the
+// connection is accepted.
+func assertReverse(t *testing.T, l *ReverseListener) {
+	t.Helper()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+	select {
+	case c := <-accepted:
+		defer c.Close()
+		conn.Write([]byte("hello"))
+		b := make([]byte, 5)
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Read(b); err != nil || string(b) != "hello" {
+			t.Errorf("read %q from the public port: %v", b, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection to the public port not accepted")
+	}
+}
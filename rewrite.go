@@ -0,0 +1,52 @@
+package socks4
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// TargetRewriter returns the request to carry out instead of req, e.g. with
+// its host name lowercased or a service name mapped to its address, or an
+// error rejecting it. The port of the returned request is the one of its
+// Address.
+type TargetRewriter func(ctx context.Context, req Request) (Request, error)
+
+// WithTargetRewriter makes the server rewrite the requests with rw once
+// they are read, before the rules are matched and the targets are dialed.
+// The context is canceled after the dial timeout, see WithDialTimeout.
+func WithTargetRewriter(rw TargetRewriter) OptionFunc {
+	return func(s *Server) {
+		s.rewriter = rw
+	}
+}
+
+// rewriteRequest returns the request rewritten by the rewriter of the
+// server if any.
+func (s *Server) rewriteRequest(req Request) (Request, error) {
+	if s.rewriter == nil {
+		return req, nil
+	}
+	ctx := context.Background()
+	if timeout := s.config().DialTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	rewritten, err := s.rewriter(ctx, req)
+	if err != nil {
+		return req, err
+	}
+	_, port, err := net.SplitHostPort(rewritten.Address)
+	if err != nil {
+		return req, fmt.Errorf("invalid rewritten target %q: %v", rewritten.Address, err)
+	}
+	if rewritten.Port, err = strconv.Atoi(port); err != nil {
+		return req, fmt.Errorf("invalid rewritten target %q", rewritten.Address)
+	}
+	if rewritten.Address != req.Address {
+		s.log(LogRules).Debugf("target %v rewritten to %v", req.Address, rewritten.Address)
+	}
+	return rewritten, nil
+}
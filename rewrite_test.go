@@ -0,0 +1,91 @@
+package socks4
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRewriteRequest(t *testing.T) {
+	lower := func(ctx context.Context, req Request) (Request, error) {
+		host, port, _ := net.SplitHostPort(req.Address)
+		req.Address = net.JoinHostPort(strings.ToLower(strings.TrimSuffix(host, ".")), port)
+		return req, nil
+	}
+	for _, tt := range []struct {
+		name    string
+		rw      TargetRewriter
+		address string
+		port    int
+		err     string // in the error, none if empty.
+	}{
+		{name: "none", address: "WWW.Example.com.:80", port: 80},
+		{name: "lowercased", rw: lower, address: "www.example.com:80", port: 80},
+		{name: "service", rw: func(ctx context.Context, req Request) (Request, error) {
+			req.Address = "10.0.0.5:5432"
+			return req, nil
+		}, address: "10.0.0.5:5432", port: 5432},
+		{name: "rejected", rw: func(ctx context.Context, req Request) (Request, error) {
+			return req, errors.New("unknown service")
+		}, err: "unknown service"},
+		{name: "no port", rw: func(ctx context.Context, req Request) (Request, error) {
+			req.Address = "10.0.0.5"
+			return req, nil
+		}, err: `invalid rewritten target "10.0.0.5"`},
+		{name: "invalid port", rw: func(ctx context.Context, req Request) (Request, error) {
+			req.Address = "10.0.0.5:postgres"
+			return req, nil
+		}, err: `invalid rewritten target "10.0.0.5:postgres"`},
+	} {
+		s := newTestServer(WithTargetRewriter(tt.rw))
+		if tt.rw == nil {
+			s = newTestServer()
+		}
+		req, err := s.rewriteRequest(Request{Version: Version4, Cmd: CmdConnect, Port: 80, Address: "WWW.Example.com.:80"})
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%v: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || req.Address != tt.address || req.Port != tt.port {
+			t.Errorf("%v: rewritten to %v port %v with error %v, want %v port %v", tt.name, req.Address, req.Port, err, tt.address, tt.port)
+		}
+	}
+}
+
+func TestTargetRewriter(t *testing.T) {
+	echo := echoTarget(t)
+	rules, err := ParseRules(strings.NewReader("allow to 127.0.0.1\ndeny"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadlines := make(chan bool, 2)
+	_, addr := serve(t, WithRules(rules), WithDialTimeout(5*time.Second), WithTargetRewriter(func(ctx context.Context, req Request) (Request, error) {
+		_, deadline := ctx.Deadline()
+		deadlines <- deadline
+		if req.Address == "echo.service:1" {
+			req.Address = echo.Addr
+		}
+		return req, nil
+	}))
+	d := NewDialer(addr, WithDialerTimeout(5*time.Second))
+
+	// the rules match the rewritten target.
+	conn, err := d.Dial("tcp", "echo.service:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, []byte("hello"))
+	if !<-deadlines {
+		t.Error("rewriter called without the dial timeout")
+	}
+	var rej *RejectError
+	if _, err := d.Dial("tcp", "other.service:1"); !errors.As(err, &rej) {
+		t.Errorf("error %v, want a rejection", err)
+	}
+}
@@ -0,0 +1,653 @@
+package socks4
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Action is the decision a rule makes on the requests it matches.
+type Action int
+
+const (
+	Allow Action = iota
+	Deny
+)
+
+func (a Action) String() string {
+	if a == Deny {
+		return "deny"
+	}
+	return "allow"
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	From, To int
+}
+
+// ClientInfo describes the client sending a request.
+type ClientInfo struct {
+	IP net.IP
+	// Identity is the identity of the verified TLS client certificate, see
+	// CertIdentity. It is empty if the client presented none.
+	Identity string
+	// SniffedHost is the TLS SNI or HTTP Host the client sent in its relay,
+	// empty before the relay begins or if none was sniffed.
+	SniffedHost string
+}
+
+// A Rule matches requests by client, command, user id and destination, and
+// decides whether they are allowed. Zero fields match anything.
+type Rule struct {
+	Action   Action
+	Client   *net.IPNet        // client network.
+	Cert     string            // client certificate identity, or "*.domain" matching its subdomains.
+	Cmd      byte              // CmdConnect, CmdBind or CmdReverse.
+	UserId   string            // user id reported by the request.
+	Group    string            // group of the user, see WithGroups.
+	Host     string            // destination IP, CIDR, domain name, or "*.domain" matching its subdomains.
+	Resolved string            // CIDR or "private", matched by any address the destination resolved to, see Request.Resolved.
+	SNI      string            // TLS SNI or HTTP Host sniffed in the relay, or "*.domain" matching its subdomains.
+	Ports    []PortRange       // destination ports.
+	Via      string            // egress of the allowed CONNECT requests, e.g. an SSH egress, "" for the default.
+	Mirror   int64             // max bytes of the allowed sessions mirrored (see WithMirror), MirrorAll for all, 0 for none.
+	Claims   map[string]string // claims of the token of the request, see WithJWT.
+	Labels   map[string]string // labels added to the sessions of the matched requests, see LabelListener.
+	ID       string            // identifies the rule in the stats and the logs, its position like "#3" if empty.
+
+	// Transform names the transform of the relays of the allowed
+	// sessions, see WithTransform. None if empty.
+	Transform string
+	// MaxBytes is the max bytes relayed by the allowed sessions, see
+	// WithMaxSessionBytes: the one of the server if 0, none if
+	// UnlimitedBytes.
+	MaxBytes int64
+	// MaxSessions is the max concurrent sessions of the user of the allowed
+	// requests, see WithMaxSessionsPerUser: the one of the server if 0,
+	// none if UnlimitedSessions.
+	MaxSessions int
+}
+
+// Match reports whether the rule matches the request sent from client.
+func (r *Rule) Match(client net.IP, req Request) bool {
+	return r.MatchClient(ClientInfo{IP: client}, req)
+}
+
+// MatchClient reports whether the rule matches the request sent by client.
+func (r *Rule) MatchClient(client ClientInfo, req Request) bool {
+	if r.Client != nil && !r.Client.Contains(client.IP) {
+		return false
+	}
+	if r.Cert != "" && (client.Identity == "" || !matchName(r.Cert, client.Identity)) {
+		return false
+	}
+	if r.Cmd != 0 && r.Cmd != req.Cmd {
+		return false
+	}
+	if r.UserId != "" && r.UserId != req.UserId {
+		return false
+	}
+	if r.Group != "" && !matchGroup(req.Groups, r.Group) {
+		return false
+	}
+	if r.SNI != "" && (client.SniffedHost == "" || !matchName(r.SNI, client.SniffedHost)) {
+		return false
+	}
+	if len(r.Ports) > 0 && !matchPorts(r.Ports, req.Port) {
+		return false
+	}
+	if r.Host != "" {
+		host, _, err := net.SplitHostPort(req.Address)
+		if err != nil || !matchHost(r.Host, host) {
+			return false
+		}
+	}
+	if r.Resolved != "" && !matchResolved(r.Resolved, req.Resolved) {
+		return false
+	}
+	for name, value := range r.Claims {
+		if !matchClaim(req.Claims, name, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchResolved reports whether any of the addresses is in the CIDR, or is
+// private if the CIDR is "private".
+func matchResolved(cidr string, addrs []net.IP) bool {
+	var network *net.IPNet
+	if cidr != "private" {
+		var err error
+		if _, network, err = net.ParseCIDR(cidr); err != nil {
+			return false
+		}
+	}
+	for _, ip := range addrs {
+		if network == nil && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()) {
+			return true
+		}
+		if network != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// String formats the rule in the syntax of ParseRules.
+func (r *Rule) String() string {
+	var b strings.Builder
+	b.WriteString(r.Action.String())
+	if r.ID != "" {
+		b.WriteString(" id " + r.ID)
+	}
+	if r.Client != nil {
+		b.WriteString(" from " + r.Client.String())
+	}
+	if r.Cert != "" {
+		b.WriteString(" cert " + r.Cert)
+	}
+	if r.Cmd == CmdConnect {
+		b.WriteString(" cmd connect")
+	} else if r.Cmd == CmdBind {
+		b.WriteString(" cmd bind")
+	} else if r.Cmd == CmdReverse {
+		b.WriteString(" cmd reverse")
+	}
+	if r.UserId != "" {
+		b.WriteString(" user " + r.UserId)
+	}
+	if r.Group != "" {
+		b.WriteString(" group " + r.Group)
+	}
+	if r.Host != "" {
+		b.WriteString(" to " + r.Host)
+	}
+	if r.Resolved != "" {
+		b.WriteString(" resolved " + r.Resolved)
+	}
+	if r.SNI != "" {
+		b.WriteString(" sni " + r.SNI)
+	}
+	if len(r.Ports) > 0 {
+		ports := make([]string, len(r.Ports))
+		for i, p := range r.Ports {
+			if p.From == p.To {
+				ports[i] = strconv.Itoa(p.From)
+			} else {
+				ports[i] = strconv.Itoa(p.From) + "-" + strconv.Itoa(p.To)
+			}
+		}
+		b.WriteString(" port " + strings.Join(ports, ","))
+	}
+	claims := make([]string, 0, len(r.Claims))
+	for k := range r.Claims {
+		claims = append(claims, k)
+	}
+	sort.Strings(claims)
+	for _, k := range claims {
+		b.WriteString(" claim " + k + "=" + r.Claims[k])
+	}
+	if r.Via != "" {
+		b.WriteString(" via " + r.Via)
+	}
+	if r.Transform != "" {
+		b.WriteString(" transform " + r.Transform)
+	}
+	if r.MaxBytes == UnlimitedBytes {
+		b.WriteString(" bytes unlimited")
+	} else if r.MaxBytes > 0 {
+		b.WriteString(" bytes " + strconv.FormatInt(r.MaxBytes, 10))
+	}
+	if r.MaxSessions == UnlimitedSessions {
+		b.WriteString(" sessions unlimited")
+	} else if r.MaxSessions > 0 {
+		b.WriteString(" sessions " + strconv.Itoa(r.MaxSessions))
+	}
+	if r.Mirror == MirrorAll {
+		b.WriteString(" mirror all")
+	} else if r.Mirror > 0 {
+		b.WriteString(" mirror " + strconv.FormatInt(r.Mirror, 10))
+	}
+	names := make([]string, 0, len(r.Labels))
+	for k := range r.Labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		b.WriteString(" label " + k + "=" + r.Labels[k])
+	}
+	return b.String()
+}
+
+func matchPorts(ranges []PortRange, port int) bool {
+	for _, r := range ranges {
+		if port >= r.From && port <= r.To {
+			return true
+		}
+	}
+	return false
+}
+
+func matchHost(pattern, host string) bool {
+	if strings.Contains(pattern, "/") {
+		_, ipNet, err := net.ParseCIDR(pattern)
+		ip := net.ParseIP(host)
+		return err == nil && ip != nil && ipNet.Contains(ip)
+	}
+	if ip := net.ParseIP(pattern); ip != nil {
+		return ip.Equal(net.ParseIP(host))
+	}
+	return matchName(pattern, host)
+}
+
+// matchName matches a name against a pattern, which is the name or
+// "*.domain" matching its subdomains, case-insensitively and regardless of
+// the trailing dots of fully qualified names.
+func matchName(pattern, name string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(name, suffix)
+	}
+	return pattern == name
+}
+
+// ParseRules parses rules, one per line, each an action followed by keys
+// and their values:
+//
+//	allow|deny [KEY VALUE]...
+//
+// The keys restrict the requests the rule matches, all of them matching:
+//
+//	from CIDR            client network.
+//	cert NAME            identity of the TLS client certificate, or *.domain.
+//	cmd COMMAND          connect, bind or reverse.
+//	user ID              user id of the request.
+//	group GROUP          group of the user, by its name or whole DN, see
+//	                     WithGroups.
+//	to HOST              destination IP, CIDR, domain name or *.domain.
+//	resolved CIDR        any address the destination resolves to is in the
+//	                     CIDR, or is private, loopback or link-local for
+//	                     "private", e.g. to deny the public names of
+//	                     internal hosts.
+//	sni HOST             TLS SNI or HTTP Host sniffed in the relay.
+//	port PORTS           comma separated ports or ranges like 8000-8080.
+//	claim NAME=VALUE     claim of the token of the request, or a claim array
+//	                     holding the value, see WithJWT; repeatable.
+//
+// and the others apply to the requests the rule allows, or identify it:
+//
+//	id ID                unique id in Stats.Rules and the logs, the position
+//	                     of the rule like "#3" if not set.
+//	via EGRESS           egress of the CONNECT requests, see WithSSHEgress.
+//	transform TRANSFORM  transform of the relays, see WithTransform.
+//	bytes LIMIT          max bytes relayed by the sessions, or unlimited, see
+//	                     WithMaxSessionBytes.
+//	sessions N           max concurrent sessions of the user, or unlimited,
+//	                     see WithMaxSessionsPerUser.
+//	mirror LIMIT         max bytes mirrored, or all, see WithMirror.
+//	label KEY=VALUE      label of the sessions; repeatable.
+//
+// where LIMIT is a byte count like 65536 or 64K, M or G.
+//
+// The first matching rule decides, and the requests matching no rule are
+// decided by the default action, see WithDefaultAction. The sni rules never
+// match the requests themselves: they are checked again against the host
+// the client sends once its request is granted, at the beginning of the
+// relay, which is held until it is sniffed (see WithSniffBudget). The first
+// matching rule still decides then, so that a rule without sni listed
+// before an sni rule and matching the same requests hides it; the server
+// warns of the rules hidden so.
+//
+// Empty lines and lines starting with '#' are ignored. i.e.:
+//
+//	deny to 10.0.0.0/8
+//	deny resolved private
+//	allow to *.example.com port 80,443
+//	deny
+func ParseRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	ids := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := ParseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", n, err)
+		}
+		if rule.ID != "" {
+			if ids[rule.ID] {
+				return nil, fmt.Errorf("line %v: duplicate id %q", n, rule.ID)
+			}
+			ids[rule.ID] = true
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// ParseRule parses a single rule in the syntax of ParseRules.
+func ParseRule(line string) (rule Rule, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return rule, fmt.Errorf("empty rule")
+	}
+	switch fields[0] {
+	case "allow":
+		rule.Action = Allow
+	case "deny":
+		rule.Action = Deny
+	default:
+		return rule, fmt.Errorf("invalid action %q", fields[0])
+	}
+
+	fields = fields[1:]
+	if len(fields)%2 != 0 {
+		return rule, fmt.Errorf("missing value of %q", fields[len(fields)-1])
+	}
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fields[i], fields[i+1]
+		switch key {
+		case "id":
+			rule.ID = value
+		case "from":
+			if !strings.Contains(value, "/") {
+				if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+					value += "/32"
+				} else {
+					value += "/128"
+				}
+			}
+			if _, rule.Client, err = net.ParseCIDR(value); err != nil {
+				return rule, err
+			}
+		case "cert":
+			rule.Cert = value
+		case "cmd":
+			switch value {
+			case "connect":
+				rule.Cmd = CmdConnect
+			case "bind":
+				rule.Cmd = CmdBind
+			case "reverse":
+				rule.Cmd = CmdReverse
+			default:
+				return rule, fmt.Errorf("invalid cmd %q", value)
+			}
+		case "user":
+			rule.UserId = value
+		case "group":
+			rule.Group = value
+		case "to":
+			if strings.Contains(value, "/") {
+				if _, _, err = net.ParseCIDR(value); err != nil {
+					return rule, err
+				}
+			}
+			rule.Host = value
+		case "resolved":
+			if value != "private" {
+				if _, _, err = net.ParseCIDR(value); err != nil {
+					return rule, err
+				}
+			}
+			rule.Resolved = value
+		case "sni":
+			rule.SNI = value
+		case "port":
+			if rule.Ports, err = parsePorts(value); err != nil {
+				return rule, err
+			}
+		case "claim":
+			name, v, ok := strings.Cut(value, "=")
+			if !ok || name == "" {
+				return rule, fmt.Errorf("invalid claim %q", value)
+			}
+			if rule.Claims == nil {
+				rule.Claims = make(map[string]string)
+			}
+			rule.Claims[name] = v
+		case "via":
+			rule.Via = value
+		case "transform":
+			rule.Transform = value
+		case "bytes":
+			if value == "unlimited" {
+				rule.MaxBytes = UnlimitedBytes
+			} else if rule.MaxBytes, err = parseSize(value); err != nil || rule.MaxBytes <= 0 {
+				return rule, fmt.Errorf("invalid byte limit %q", value)
+			}
+		case "sessions":
+			if value == "unlimited" {
+				rule.MaxSessions = UnlimitedSessions
+			} else if rule.MaxSessions, err = strconv.Atoi(value); err != nil || rule.MaxSessions <= 0 {
+				return rule, fmt.Errorf("invalid session limit %q", value)
+			}
+		case "mirror":
+			if value == "all" {
+				rule.Mirror = MirrorAll
+			} else if rule.Mirror, err = parseSize(value); err != nil || rule.Mirror <= 0 {
+				return rule, fmt.Errorf("invalid mirror limit %q", value)
+			}
+		case "label":
+			name, v, ok := strings.Cut(value, "=")
+			if !ok || !ValidLabelName(name) {
+				return rule, fmt.Errorf("invalid label %q", value)
+			}
+			if rule.Labels == nil {
+				rule.Labels = make(map[string]string)
+			}
+			rule.Labels[name] = v
+		default:
+			return rule, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	return rule, nil
+}
+
+// parseSize parses a byte count with an optional K, M or G suffix.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n * mult, err
+}
+
+func parsePorts(s string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, p := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(p, "-")
+		if !isRange {
+			to = from
+		}
+		f, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		t, err := strconv.Atoi(to)
+		if err != nil || f < 0 || t > 65535 || f > t {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		ranges = append(ranges, PortRange{From: f, To: t})
+	}
+	return ranges, nil
+}
+
+// WithRules sets the rules checked against every request. The first
+// matching rule decides; requests matching no rule are decided by the
+// default action, see WithDefaultAction.
+func WithRules(rules []Rule) OptionFunc {
+	return func(s *Server) {
+		s.config().Rules = identifyRules(rules)
+	}
+}
+
+// WithDefaultAction sets the decision on the requests matching no rule,
+// Allow by default. With Deny, only the requests explicitly allowed by a
+// rule are granted. The CONNECT requests which a rule with an sni key may
+// still allow are decided once the host of their relay is sniffed, and
+// their relays which can't be sniffed are closed.
+func WithDefaultAction(a Action) OptionFunc {
+	return func(s *Server) {
+		s.config().DefaultAction = a
+	}
+}
+
+// deniedByDefault reports whether the request of the client on conn,
+// matching no rule, is denied by the default action. Before its host is
+// sniffed, a request is allowed if a rule with an sni key may allow it.
+func (s *Server) deniedByDefault(conn net.Conn, req Request, sniffed bool) bool {
+	if s.config().DefaultAction != Deny {
+		return false
+	}
+	return sniffed || !s.maySniffAllow(conn, req)
+}
+
+// maySniffAllow reports whether a rule with an sni key allows the CONNECT
+// request of the client on conn for some sniffed host.
+func (s *Server) maySniffAllow(conn net.Conn, req Request) bool {
+	if req.Cmd != CmdConnect {
+		return false
+	}
+	rules := s.config().Rules
+	client := ClientInfo{IP: net.ParseIP(clientIP(conn)), Identity: clientIdentity(conn)}
+	for i := range rules {
+		if rules[i].SNI == "" || rules[i].Action != Allow {
+			continue
+		}
+		r := rules[i]
+		r.SNI = ""
+		if r.MatchClient(client, req) {
+			return true
+		}
+	}
+	return false
+}
+
+// identifyRules returns a copy of the rules whose rules without an ID are
+// identified by their position.
+func identifyRules(rules []Rule) []Rule {
+	identified := make([]Rule, len(rules))
+	copy(identified, rules)
+	for i := range identified {
+		if identified[i].ID == "" {
+			identified[i].ID = "#" + strconv.Itoa(i+1)
+		}
+	}
+	return identified
+}
+
+// SetRules replaces the rules of a running server. The new rules apply to
+// the requests received afterwards.
+func (s *Server) SetRules(rules []Rule) {
+	rules = identifyRules(rules)
+	s.update(func(c *Config) {
+		c.Rules = rules
+	})
+	s.warnHiddenRules(rules)
+}
+
+// hides reports whether the rule, without an sni key, matches every request
+// the later rule with an sni key matches, so that the later one never
+// decides.
+func (r *Rule) hides(later *Rule) bool {
+	if r.SNI != "" || later.SNI == "" {
+		return false
+	}
+	if r.Client != nil && (later.Client == nil || r.Client.String() != later.Client.String()) {
+		return false
+	}
+	if (r.Cert != "" && r.Cert != later.Cert) || (r.Cmd != 0 && r.Cmd != later.Cmd) ||
+		(r.UserId != "" && r.UserId != later.UserId) || (r.Group != "" && r.Group != later.Group) ||
+		(r.Host != "" && r.Host != later.Host) || (r.Resolved != "" && r.Resolved != later.Resolved) {
+		return false
+	}
+	if len(r.Ports) > 0 && !reflect.DeepEqual(r.Ports, later.Ports) {
+		return false
+	}
+	for name, value := range r.Claims {
+		if v, ok := later.Claims[name]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// warnHiddenRules warns of the rules with an sni key hidden by an earlier
+// rule, see ParseRules.
+func (s *Server) warnHiddenRules(rules []Rule) {
+	for i := range rules {
+		for j := 0; j < i; j++ {
+			if rules[j].hides(&rules[i]) {
+				s.log(LogRules).Warnf("rule %q never decides: rule %q before it matches its requests first", rules[i].ID, rules[j].ID)
+				break
+			}
+		}
+	}
+}
+
+// matchRule returns the first rule matching the request, or nil if none
+// matches.
+func (s *Server) matchRule(conn net.Conn, req Request) *Rule {
+	return s.matchSniffedRule(conn, req, "")
+}
+
+// matchSniffedRule returns the first rule matching the request whose relay
+// sent the sniffed host, or nil if none matches.
+func (s *Server) matchSniffedRule(conn net.Conn, req Request, sniffed string) *Rule {
+	rules := s.config().Rules
+	client := ClientInfo{IP: net.ParseIP(clientIP(conn)), Identity: clientIdentity(conn), SniffedHost: sniffed}
+	for i := range rules {
+		if rules[i].MatchClient(client, req) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// hasResolvedRules reports whether a rule has a resolved key, so that the
+// destinations must be resolved before the rules are matched.
+func (s *Server) hasResolvedRules() bool {
+	rules := s.config().Rules
+	for i := range rules {
+		if rules[i].Resolved != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSniffedRules reports whether a rule has an sni key, so that the relays
+// must be sniffed before they begin.
+func (s *Server) hasSniffedRules() bool {
+	rules := s.config().Rules
+	for i := range rules {
+		if rules[i].SNI != "" {
+			return true
+		}
+	}
+	return false
+}
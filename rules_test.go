@@ -0,0 +1,298 @@
+package socks4
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+# comment
+deny to 10.0.0.0/8
+allow id web from 192.168.0.0/16 to *.example.com port 80,8000-8080 bytes 64K label team=web
+
+deny
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("%v rules, want 3", len(rules))
+	}
+	web := rules[1]
+	if web.Action != Allow || web.ID != "web" || web.Client.String() != "192.168.0.0/16" || web.Host != "*.example.com" ||
+		len(web.Ports) != 2 || web.Ports[1] != (PortRange{8000, 8080}) || web.MaxBytes != 64*1024 || web.Labels["team"] != "web" {
+		t.Errorf("rule parsed as %+v", web)
+	}
+	// the rules are formatted back in the same syntax.
+	for _, rule := range rules {
+		again, err := ParseRule(rule.String())
+		if err != nil || again.String() != rule.String() {
+			t.Errorf("rule %q parsed back as %q: %v", rule.String(), again.String(), err)
+		}
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	for _, in := range []string{
+		"permit",
+		"allow to",
+		"allow nowhere 10.0.0.1",
+		"allow from 10.0.0.0/33",
+		"allow cmd udp",
+		"allow port 80-",
+		"allow bytes lots",
+		"allow sessions -2",
+		"allow claim role",
+		"allow id a\ndeny id a",
+	} {
+		if _, err := ParseRules(strings.NewReader(in)); err == nil {
+			t.Errorf("%q parsed", in)
+		}
+	}
+}
+
+func TestRulesFirstMatch(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader("deny port 8080\nallow to 10.0.0.0/8\ndeny to 10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(WithRules(rules))
+	client := &bufConn{r: strings.NewReader("")}
+	for _, tt := range []struct {
+		address string
+		port    int
+		id      string // of the rule matching first, none if empty.
+	}{
+		{"10.0.0.1:80", 80, "#2"},
+		{"10.0.0.1:8080", 8080, "#1"},
+		{"192.0.2.1:80", 80, ""},
+	} {
+		req := Request{Version: Version4, Cmd: CmdConnect, Port: tt.port, Address: tt.address}
+		rule := s.matchRule(client, req)
+		if (rule == nil && tt.id != "") || (rule != nil && rule.ID != tt.id) {
+			t.Errorf("%v matches rule %v, want %q", tt.address, rule, tt.id)
+		}
+	}
+}
+
+func TestDeniedByDefault(t *testing.T) {
+	connect := Request{Version: Version4, Cmd: CmdConnect, Port: 443, Address: "192.0.2.1:443"}
+	bind := Request{Version: Version4, Cmd: CmdBind, Port: 443, Address: "192.0.2.1:443"}
+	other := Request{Version: Version4, Cmd: CmdConnect, Port: 22, Address: "192.0.2.1:22"}
+	sni, err := ParseRules(strings.NewReader("allow sni *.example.com port 443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	denySNI, err := ParseRules(strings.NewReader("deny sni *.example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name    string
+		s       *Server
+		req     Request
+		sniffed bool
+		denied  bool
+	}{
+		{name: "default allow", s: newTestServer(), req: connect},
+		{name: "default deny", s: newTestServer(WithDefaultAction(Deny)), req: connect, denied: true},
+		{name: "CONNECT awaiting sni", s: newTestServer(WithRules(sni), WithDefaultAction(Deny)), req: connect},
+		{name: "CONNECT sniffed", s: newTestServer(WithRules(sni), WithDefaultAction(Deny)), req: connect, sniffed: true, denied: true},
+		{name: "CONNECT no sni rule may allow", s: newTestServer(WithRules(sni), WithDefaultAction(Deny)), req: other, denied: true},
+		{name: "CONNECT with sni deny rules", s: newTestServer(WithRules(denySNI), WithDefaultAction(Deny)), req: connect, denied: true},
+		{name: "BIND with sni rules", s: newTestServer(WithRules(sni), WithDefaultAction(Deny)), req: bind, denied: true},
+	} {
+		if denied := tt.s.deniedByDefault(&bufConn{}, tt.req, tt.sniffed); denied != tt.denied {
+			t.Errorf("%v: denied %v, want %v", tt.name, denied, tt.denied)
+		}
+	}
+}
+
+func TestDefaultActionDeny(t *testing.T) {
+	// two reachable destinations, the requests to one allowed by a rule.
+	var ports []int
+	for i := 0; i < 2; i++ {
+		dest, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dest.Close()
+		go func() {
+			for {
+				conn, err := dest.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+			}
+		}()
+		ports = append(ports, dest.Addr().(*net.TCPAddr).Port)
+	}
+
+	rules, err := ParseRules(strings.NewReader("allow to 127.0.0.1 port " + strconv.Itoa(ports[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(WithRules(rules), WithDefaultAction(Deny))
+	go s.Serve(lis)
+	defer s.Close()
+
+	for _, tt := range []struct {
+		port int
+		code byte
+	}{
+		{ports[0], Granted},
+		{ports[1], RejectOrFailure},
+	} {
+		client, err := net.Dial("tcp", lis.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := client.Write(request(CmdConnect, uint16(tt.port), [4]byte{127, 0, 0, 1}, "")); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, 8)
+		if _, err := io.ReadFull(client, b); err != nil {
+			t.Fatal(err)
+		}
+		if b[1] != tt.code {
+			t.Errorf("request to port %v replied %#x, want %#x", tt.port, b[1], tt.code)
+		}
+		client.Close()
+	}
+}
+
+func TestDefaultActionDenySniffed(t *testing.T) {
+	// destinations speaking first, the one on the sni port never dialed.
+	var ports []int
+	accepted := make(chan int, 10)
+	for i := 0; i < 2; i++ {
+		dest, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dest.Close()
+		go func(i int) {
+			for {
+				conn, err := dest.Accept()
+				if err != nil {
+					return
+				}
+				accepted <- i
+				go func() {
+					conn.Write([]byte("banner\r\n"))
+					io.Copy(io.Discard, conn)
+					conn.Close()
+				}()
+			}
+		}(i)
+		ports = append(ports, dest.Addr().(*net.TCPAddr).Port)
+	}
+	rules, err := ParseRules(strings.NewReader("allow sni *.example.com port " + strconv.Itoa(ports[0])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := serve(t, WithRules(rules), WithDefaultAction(Deny), WithSniffBudget(0, 100*time.Millisecond))
+
+	for _, tt := range []struct {
+		name    string
+		port    int
+		send    string
+		granted bool
+		relayed bool // the banner of the destination reaches the client.
+	}{
+		{name: "no rule may allow", port: ports[1]},
+		{name: "allowed host", port: ports[0], send: "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n", granted: true, relayed: true},
+		{name: "denied host", port: ports[0], send: "GET / HTTP/1.1\r\nHost: example.org\r\n\r\n", granted: true},
+		{name: "not sniffable", port: ports[0], send: "SSH-2.0-client\r\n", granted: true},
+		{name: "client silent", port: ports[0], granted: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			client.Write(request(CmdConnect, uint16(tt.port), [4]byte{127, 0, 0, 1}, ""))
+			b := make([]byte, 8)
+			if _, err := io.ReadFull(client, b); err != nil {
+				t.Fatal(err)
+			}
+			if granted := b[1] == Granted; granted != tt.granted {
+				t.Fatalf("granted %v, want %v", granted, tt.granted)
+			}
+			if !tt.granted {
+				select {
+				case <-accepted:
+					t.Error("denied destination dialed")
+				case <-time.After(50 * time.Millisecond):
+				}
+				return
+			}
+			<-accepted
+			client.Write([]byte(tt.send))
+			if tt.relayed {
+				b := make([]byte, len("banner\r\n"))
+				if _, err := io.ReadFull(client, b); err != nil || string(b) != "banner\r\n" {
+					t.Errorf("client read %q: %v, want the banner", b, err)
+				}
+				return
+			}
+			// the relay is closed before anything reaches the client.
+			if got, err := io.ReadAll(client); err != nil || len(got) > 0 {
+				t.Errorf("client read %q: %v, want the relay closed", got, err)
+			}
+		})
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"example.com", "example.com", true},
+		{"example.com", "EXAMPLE.com", true},
+		{"Example.COM", "example.com", true},
+		{"example.com", "example.com.", true},
+		{"example.com.", "example.com", true},
+		{"*.example.com", "www.Example.com.", true},
+		{"*.EXAMPLE.com.", "www.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"example.com", "www.example.com", false},
+		{"example.com", "example.org", false},
+	} {
+		if match := matchName(tt.pattern, tt.name); match != tt.match {
+			t.Errorf("%q matches %q: %v, want %v", tt.pattern, tt.name, match, tt.match)
+		}
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, host string
+		match         bool
+	}{
+		{"10.0.0.0/8", "10.1.2.3", true},
+		{"10.0.0.0/8", "192.0.2.1", false},
+		{"10.0.0.1", "10.0.0.1", true},
+		{"*.example.com", "WWW.EXAMPLE.COM.", true},
+		{"example.com.", "Example.com", true},
+		{"10.0.0.0/8", "example.com", false},
+	} {
+		if match := matchHost(tt.pattern, tt.host); match != tt.match {
+			t.Errorf("%q matches %q: %v, want %v", tt.pattern, tt.host, match, tt.match)
+		}
+	}
+}
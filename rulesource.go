@@ -0,0 +1,275 @@
+package socks4
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RuleSource is a backend keeping the rules of a fleet of proxies, like a
+// key of etcd or Consul.
+type RuleSource interface {
+	// Watch calls update with the rules, in the syntax of ParseRules, then
+	// again whenever they change, until ctx is done or it fails.
+	Watch(ctx context.Context, update func(rules string)) error
+}
+
+// maxRuleSourceBackoff is the max wait before watching a failed rule source
+// again.
+const maxRuleSourceBackoff = 30 * time.Second
+
+// WatchRules sets the rules of the server to those of src whenever they
+// change, until ctx is done. The rules which fail to parse are logged and
+// ignored, and src is watched again after a backoff when it fails, the
+// last rules applying meanwhile.
+func (s *Server) WatchRules(ctx context.Context, src RuleSource) error {
+	backoff := time.Second
+	for {
+		err := src.Watch(ctx, func(text string) {
+			backoff = time.Second
+			rules, err := ParseRules(strings.NewReader(text))
+			if err != nil {
+				s.log(LogRules).Errorf("invalid rules from the rule source: %v", err)
+				return
+			}
+			s.SetRules(rules)
+			s.log(LogRules).Infof("rules updated from the rule source, %v rules", len(rules))
+		})
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		s.log(LogRules).Warnf("watch the rule source, retry in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxRuleSourceBackoff {
+			backoff = maxRuleSourceBackoff
+		}
+	}
+}
+
+// RuleSourceOptions are the options of the etcd and Consul rule sources.
+type RuleSourceOptions struct {
+	// Token is the ACL token of Consul, or the auth token of etcd.
+	Token string
+	// TLSConfig is the TLS configuration of the https:// URLs, the
+	// default one if nil.
+	TLSConfig *tls.Config
+}
+
+func (o RuleSourceOptions) client() *http.Client {
+	if o.TLSConfig == nil {
+		return http.DefaultClient
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = o.TLSConfig
+	return &http.Client{Transport: transport}
+}
+
+// consulWait is the max time of the blocking queries of Consul.
+const consulWait = 5 * time.Minute
+
+// ConsulRuleSource is a RuleSource in a key of the Consul KV store, watched
+// by blocking queries.
+type ConsulRuleSource struct {
+	url     string
+	key     string
+	options RuleSourceOptions
+	client  *http.Client
+}
+
+// NewConsulRuleSource returns the source of the rules at key in the Consul
+// agent at url, like http://127.0.0.1:8500.
+func NewConsulRuleSource(url, key string, options RuleSourceOptions) *ConsulRuleSource {
+	return &ConsulRuleSource{
+		url:     strings.TrimSuffix(url, "/"),
+		key:     strings.TrimPrefix(key, "/"),
+		options: options,
+		client:  options.client(),
+	}
+}
+
+func (c *ConsulRuleSource) Watch(ctx context.Context, update func(rules string)) error {
+	var index uint64
+	last := ""
+	for first := true; ; first = false {
+		value, next, err := c.get(ctx, index)
+		if err != nil {
+			return err
+		}
+		// the index may go backwards, like after a restore of Consul.
+		if next < index {
+			next = 0
+		}
+		index = next
+		if first || value != last {
+			last = value
+			update(value)
+		}
+	}
+}
+
+// get returns the value of the key once its index is past index, and its
+// new index.
+func (c *ConsulRuleSource) get(ctx context.Context, index uint64) (string, uint64, error) {
+	u := fmt.Sprintf("%v/v1/kv/%v?raw=true&index=%v&wait=%vs", c.url, c.key, index, int(consulWait.Seconds()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	if c.options.Token != "" {
+		req.Header.Set("X-Consul-Token", c.options.Token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRuleSourceSize))
+	if err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		return "", 0, fmt.Errorf("no key %v in Consul", c.key)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("Consul responded %v", resp.Status)
+	}
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid X-Consul-Index %q", resp.Header.Get("X-Consul-Index"))
+	}
+	return string(body), next, nil
+}
+
+// maxRuleSourceSize is the max size of the rules read from a source.
+const maxRuleSourceSize = 4 << 20
+
+// EtcdRuleSource is a RuleSource in a key of etcd, read and watched by the
+// JSON gateway of its v3 API.
+type EtcdRuleSource struct {
+	url     string
+	key     string
+	options RuleSourceOptions
+	client  *http.Client
+}
+
+// NewEtcdRuleSource returns the source of the rules at key in the etcd
+// server at url, like http://127.0.0.1:2379.
+func NewEtcdRuleSource(url, key string, options RuleSourceOptions) *EtcdRuleSource {
+	return &EtcdRuleSource{
+		url:     strings.TrimSuffix(url, "/"),
+		key:     key,
+		options: options,
+		client:  options.client(),
+	}
+}
+
+// etcdKeyValue is a key-value of the etcd JSON gateway, whose bytes are
+// base64 and int64 strings.
+type etcdKeyValue struct {
+	Value []byte `json:"value"`
+}
+
+func (e *EtcdRuleSource) Watch(ctx context.Context, update func(rules string)) error {
+	var rng struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		Kvs []etcdKeyValue `json:"kvs"`
+	}
+	resp, err := e.post(ctx, "/v3/kv/range", map[string]any{"key": []byte(e.key)})
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&rng)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("invalid etcd range response: %v", err)
+	}
+	if len(rng.Kvs) == 0 {
+		return fmt.Errorf("no key %v in etcd", e.key)
+	}
+	revision, err := strconv.ParseInt(rng.Header.Revision, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid etcd revision %q", rng.Header.Revision)
+	}
+	update(string(rng.Kvs[0].Value))
+
+	resp, err = e.post(ctx, "/v3/watch", map[string]any{
+		"create_request": map[string]any{"key": []byte(e.key), "start_revision": strconv.FormatInt(revision+1, 10)},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Canceled     bool   `json:"canceled"`
+				CancelReason string `json:"cancel_reason"`
+				Events       []struct {
+					Type string       `json:"type"` // omitted for PUT.
+					Kv   etcdKeyValue `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if err == io.EOF {
+				err = errors.New("etcd closed the watch")
+			}
+			return err
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("etcd watch: %v", msg.Error.Message)
+		}
+		if msg.Result.Canceled {
+			return fmt.Errorf("etcd canceled the watch: %v", msg.Result.CancelReason)
+		}
+		for _, ev := range msg.Result.Events {
+			if ev.Type == "DELETE" {
+				return fmt.Errorf("key %v deleted from etcd", e.key)
+			}
+			update(string(ev.Kv.Value))
+		}
+	}
+}
+
+// post posts the JSON request to the path of the gateway.
+func (e *EtcdRuleSource) post(ctx context.Context, path string, body any) (*http.Response, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url+path, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.options.Token != "" {
+		req.Header.Set("Authorization", e.options.Token)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd responded %v", resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,274 @@
+package socks4
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// kvResponse is a response of a fake Consul or etcd server.
+type kvResponse struct {
+	status int    // 200 if 0.
+	index  string // X-Consul-Index, or revision of etcd.
+	value  string
+	events []string // of the etcd watch: the values of the PUT events, DELETE or CANCELED.
+	closed bool     // the etcd watch is closed after the events.
+}
+
+// kvServer serves the responses in turn, then blocks the requests until
+// they are canceled, recording the requests.
+type kvServer struct {
+	mu        sync.Mutex
+	responses []kvResponse
+	requests  []*http.Request
+	bodies    []string
+}
+
+func (s *kvServer) next(r *http.Request) (kvResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	s.requests = append(s.requests, r)
+	s.bodies = append(s.bodies, string(body))
+	if len(s.responses) == 0 {
+		return kvResponse{}, false
+	}
+	resp := s.responses[0]
+	s.responses = s.responses[1:]
+	return resp, true
+}
+
+func (s *kvServer) lastRequest() *http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+// consul serves the responses as the Consul KV API.
+func (s *kvServer) consul(t *testing.T) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, ok := s.next(r)
+		if !ok {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", resp.index)
+		if resp.status != 0 {
+			w.WriteHeader(resp.status)
+		}
+		fmt.Fprint(w, resp.value)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func watchUpdates(src RuleSource) (chan string, chan error, context.CancelFunc) {
+	updates := make(chan string, 10)
+	errs := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		errs <- src.Watch(ctx, func(rules string) { updates <- rules })
+	}()
+	return updates, errs, cancel
+}
+
+// receiveUpdates receives the updates until the watch ends or blocks.
+func receiveUpdates(t *testing.T, updates chan string, errs chan error) ([]string, error) {
+	t.Helper()
+	var got []string
+	for {
+		select {
+		case u := <-updates:
+			got = append(got, u)
+		case err := <-errs:
+			for len(updates) > 0 {
+				got = append(got, <-updates)
+			}
+			return got, err
+		case <-time.After(500 * time.Millisecond):
+			return got, nil
+		}
+	}
+}
+
+func TestConsulRuleSource(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		responses []kvResponse
+		updates   []string
+		err       string // of the watch, none if it blocks.
+		index     string // of the last query.
+	}{
+		{
+			name:      "changes",
+			responses: []kvResponse{{index: "10", value: "deny"}, {index: "11", value: "deny"}, {index: "12", value: "allow"}},
+			updates:   []string{"deny", "allow"},
+			index:     "12",
+		},
+		{
+			name:      "index going backwards",
+			responses: []kvResponse{{index: "10", value: "deny"}, {index: "3", value: "allow"}},
+			updates:   []string{"deny", "allow"},
+			index:     "0",
+		},
+		{name: "no key", responses: []kvResponse{{status: http.StatusNotFound}}, err: "no key rules/proxy in Consul"},
+		{name: "failure", responses: []kvResponse{{index: "10", value: "deny"}, {status: http.StatusInternalServerError}}, updates: []string{"deny"}, err: "Consul responded 500"},
+		{name: "invalid index", responses: []kvResponse{{index: "ten", value: "deny"}}, err: `invalid X-Consul-Index "ten"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := &kvServer{responses: tt.responses}
+			src := NewConsulRuleSource(kv.consul(t)+"/", "/rules/proxy", RuleSourceOptions{Token: "secret"})
+			updates, errs, cancel := watchUpdates(src)
+			defer cancel()
+			got, err := receiveUpdates(t, updates, errs)
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("watch ended with %v, want %q", err, tt.err)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.updates, "|") {
+				t.Errorf("updates %q, want %q", got, tt.updates)
+			}
+			r := kv.lastRequest()
+			if r.URL.Path != "/v1/kv/rules/proxy" || r.Header.Get("X-Consul-Token") != "secret" || r.URL.Query().Get("raw") != "true" {
+				t.Errorf("requested %v with token %q", r.URL, r.Header.Get("X-Consul-Token"))
+			}
+			if tt.index != "" && r.URL.Query().Get("index") != tt.index {
+				t.Errorf("last query at index %v, want %v", r.URL.Query().Get("index"), tt.index)
+			}
+		})
+	}
+}
+
+// etcd serves the responses as the JSON gateway of etcd, the range ones
+// then the watch ones.
+func (s *kvServer) etcd(t *testing.T) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, ok := s.next(r)
+		if !ok {
+			<-r.Context().Done()
+			return
+		}
+		if resp.status != 0 {
+			w.WriteHeader(resp.status)
+			return
+		}
+		switch r.URL.Path {
+		case "/v3/kv/range":
+			kvs := []map[string]string{}
+			if resp.value != "" {
+				kvs = append(kvs, map[string]string{"value": base64.StdEncoding.EncodeToString([]byte(resp.value))})
+			}
+			json.NewEncoder(w).Encode(map[string]any{"header": map[string]string{"revision": resp.index}, "kvs": kvs})
+		case "/v3/watch":
+			enc := json.NewEncoder(w)
+			enc.Encode(map[string]any{"result": map[string]any{"created": true}})
+			for _, ev := range resp.events {
+				switch ev {
+				case "DELETE":
+					enc.Encode(map[string]any{"result": map[string]any{"events": []map[string]any{{"type": "DELETE", "kv": map[string]string{}}}}})
+				case "CANCELED":
+					enc.Encode(map[string]any{"result": map[string]any{"canceled": true, "cancel_reason": "compacted"}})
+				default:
+					enc.Encode(map[string]any{"result": map[string]any{"events": []map[string]any{{"kv": map[string]string{"value": base64.StdEncoding.EncodeToString([]byte(ev))}}}}})
+				}
+			}
+			w.(http.Flusher).Flush()
+			if !resp.closed {
+				<-r.Context().Done()
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestEtcdRuleSource(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		responses []kvResponse
+		updates   []string
+		err       string // of the watch, none if it blocks.
+	}{
+		{
+			name:      "changes",
+			responses: []kvResponse{{index: "41", value: "deny"}, {events: []string{"allow", "allow to 10.0.0.0/8\ndeny"}}},
+			updates:   []string{"deny", "allow", "allow to 10.0.0.0/8\ndeny"},
+		},
+		{name: "no key", responses: []kvResponse{{index: "41"}}, err: "no key rules/proxy in etcd"},
+		{name: "failure", responses: []kvResponse{{status: http.StatusUnauthorized}}, err: "etcd responded 401"},
+		{name: "invalid revision", responses: []kvResponse{{index: "latest", value: "deny"}}, err: `invalid etcd revision "latest"`},
+		{name: "deleted", responses: []kvResponse{{index: "41", value: "deny"}, {events: []string{"DELETE"}}}, updates: []string{"deny"}, err: "key rules/proxy deleted from etcd"},
+		{name: "canceled", responses: []kvResponse{{index: "41", value: "deny"}, {events: []string{"CANCELED"}}}, updates: []string{"deny"}, err: "etcd canceled the watch: compacted"},
+		{name: "closed", responses: []kvResponse{{index: "41", value: "deny"}, {closed: true}}, updates: []string{"deny"}, err: "etcd closed the watch"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			kv := &kvServer{responses: tt.responses}
+			src := NewEtcdRuleSource(kv.etcd(t)+"/", "rules/proxy", RuleSourceOptions{Token: "secret"})
+			updates, errs, cancel := watchUpdates(src)
+			defer cancel()
+			got, err := receiveUpdates(t, updates, errs)
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("watch ended with %v, want %q", err, tt.err)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.updates, "|") {
+				t.Errorf("updates %q, want %q", got, tt.updates)
+			}
+			kv.mu.Lock()
+			defer kv.mu.Unlock()
+			key := base64.StdEncoding.EncodeToString([]byte("rules/proxy"))
+			for i, r := range kv.requests {
+				if r.Header.Get("Authorization") != "secret" || !strings.Contains(kv.bodies[i], key) {
+					t.Errorf("requested %v %s with token %q", r.URL.Path, kv.bodies[i], r.Header.Get("Authorization"))
+				}
+				if r.URL.Path == "/v3/watch" && !strings.Contains(kv.bodies[i], `"start_revision":"42"`) {
+					t.Errorf("watch %s, want it from the revision after the range", kv.bodies[i])
+				}
+			}
+		})
+	}
+}
+
+// funcSource is a RuleSource calling its function.
+type funcSource func(ctx context.Context, update func(rules string)) error
+
+func (f funcSource) Watch(ctx context.Context, update func(rules string)) error {
+	return f(ctx, update)
+}
+
+func TestWatchRules(t *testing.T) {
+	s := newTestServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	watched := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- s.WatchRules(ctx, funcSource(func(ctx context.Context, update func(rules string)) error {
+			update("allow to 10.0.0.0/8\ndeny")
+			// the invalid rules are ignored.
+			update("permit")
+			close(watched)
+			<-ctx.Done()
+			return ctx.Err()
+		}))
+	}()
+	<-watched
+	if rules := s.Config().Rules; len(rules) != 2 || rules[1].Action != Deny {
+		t.Errorf("rules %v, want those of the source", rules)
+	}
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("watch ended with %v, want canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch not ended")
+	}
+}
@@ -1,15 +1,23 @@
 package socks4
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
+	"runtime/trace"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
 )
 
 type OptionFunc func(*Server)
@@ -20,12 +28,146 @@ func WithLogger(logger Logger) OptionFunc {
 	}
 }
 
+// WithDialRetry makes the server retry a failed CONNECT dial up to retries
+// times before rejecting the request. The wait between attempts starts at
+// backoff and doubles after each attempt, and each attempt is bounded by
+// timeout, when shorter than the timeout of WithDialTimeout; 0 for no
+// limit other than it.
+func WithDialRetry(retries int, backoff, timeout time.Duration) OptionFunc {
+	return func(s *Server) {
+		s.dialRetries = retries
+		s.dialBackoff = backoff
+		s.dialAttemptTimeout = timeout
+	}
+}
+
+// WithDialTimeout sets the timeout of dialing target hosts for CONNECT
+// requests.
+func WithDialTimeout(timeout time.Duration) OptionFunc {
+	return func(s *Server) {
+		s.config().DialTimeout = timeout
+	}
+}
+
+// WithHandshakeTimeout sets the max time a client may take to send its
+// request after connecting.
+func WithHandshakeTimeout(timeout time.Duration) OptionFunc {
+	return func(s *Server) {
+		s.config().HandshakeTimeout = timeout
+	}
+}
+
 // Server implements a SOCKS 4 proxy server, which also support SOCKS 4A.
 type Server struct {
-	logger Logger
-	lis    net.Listener
-	wg     sync.WaitGroup
-	closed bool
+	logger        Logger
+	logSampling   map[LogLevel]logSampling // sampled levels of the logger.
+	errorReporter ErrorReporter            // called for the internal errors, nil if not set.
+	mu            sync.Mutex
+	listeners     []net.Listener
+	sessions      map[*session]struct{}
+	binds         map[net.Listener]bool // listeners of the pending BIND requests, true once closed by the shutdown.
+	bindDrain     bool                  // let the pending BIND requests wait on shutdown.
+	wg            sync.WaitGroup
+	closed        bool
+
+	shutdownStart    time.Time              // start of the graceful shutdown, zero if not shutting down.
+	progressInterval time.Duration          // interval of the shutdown progress.
+	progressFn       func(ShutdownProgress) // called with the shutdown progress, nil if not set.
+	shutdownReport   *ShutdownReport        // of the last shutdown, nil if none.
+
+	tlsConfig       *tls.Config       // TLS of client connections, nil for plaintext.
+	socks5          bool              // serve SOCKS 5 clients too.
+	httpConnect     bool              // serve HTTP CONNECT clients too.
+	socks5Auth      PasswordAuth      // of SOCKS 5 clients, nil for no authentication.
+	httpAuth        PasswordAuth      // of HTTP clients, nil for no authentication.
+	userIdValidator UserIdValidator   // of SOCKS 4 requests, nil for no validation.
+	identd          bool              // check the user ids of SOCKS 4 requests against identd.
+	certUserIdMode  CertUserIdMode    // how the client certificates map to the user ids.
+	certUserId      CertUserId        // user id of a client certificate, see WithCertUserId.
+	pam             *PAMConfig        // checks the user ids of SOCKS 4 requests by PAM, nil if not.
+	jwt             *JWTValidator     // verifies the user ids of SOCKS 4 requests as tokens, nil if not.
+	groups          *groupCache       // groups of the users of the requests, nil if not authorized.
+	identdTimeout   time.Duration     // timeout of the identd queries, 0 for no limit.
+	replyHook       ReplyHook         // chooses the codes of the SOCKS 4 rejections, nil if not set.
+	rejectReasons   bool              // write the reasons after the SOCKS 4 rejections, see WithRejectReasons.
+	reasonClients   []*net.IPNet      // clients the reasons are written to, all if empty.
+	rejectAudit     *rejectAuditor    // details the rejected requests, nil if not.
+	upstream        *socks5Upstream   // server carrying out CONNECT requests, nil to dial directly.
+	egresses        map[string]egress // egresses selected by the rules, by name.
+	mirror          MirrorSink        // sink of the sessions mirrored by the rules, nil if disabled.
+	notifiers       []EventNotifier   // notified of the session events.
+	sniffing        bool              // sniff the host names of the relays.
+	sniffBuffer     int               // max bytes held by the relays sniffed for the rules.
+	sniffTimeout    time.Duration     // max time the relays sniffed for the rules are held.
+	rejectRetries   int               // requests served after a rejection on the same connection.
+	rejectWait      time.Duration     // max wait for the request after a rejection.
+	compression     bool              // accept the compression of the client connections.
+	proxyProtocol   []*net.IPNet      // peers sending a PROXY protocol header, nil if disabled.
+	reverse         *reverseRegistry  // services published by reverse requests, nil if disabled.
+
+	dscp        uint8     // DSCP class of outbound connections, 0 for unset.
+	sourceIP    net.IP    // local IP of outbound connections, nil for any.
+	sourcePorts portRange // local ports of outbound connections, unset for any.
+	clientDSCP  uint8     // DSCP class of client connections, 0 for unset.
+
+	dialRetries        int           // max retries of a failed CONNECT dial.
+	dialBackoff        time.Duration // wait before the first retry.
+	dialAttemptTimeout time.Duration // timeout of each dial attempt, 0 for the dial timeout.
+
+	resolver    Resolver       // of the domain names dialed directly, nil for the system one.
+	resolveHook ResolveHook    // called with the resolved CONNECT requests.
+	ipv4Only    bool           // connect the SOCKS 4 requests to IPv4 addresses only.
+	preferIPv4  bool           // connect the SOCKS 4 requests to IPv4 addresses first.
+	rewriter    TargetRewriter // rewrites the requests before the rules, nil if not set.
+
+	breaker      *breaker     // circuit breaker of failing destinations, nil if disabled.
+	breakerRatio breakerRatio // failure rate opening the circuits, see WithCircuitBreakerRatio.
+
+	relayHook RelayHook
+
+	transforms map[string]Transform // transforms of the relays selected by the rules, by name.
+
+	serial uint64 // distinguishes the goroutines of the server, see ServerLabel.
+
+	mem          memBudget // memory accounting of connection buffers.
+	relayBufSize int       // buffer size of each relay direction.
+
+	conns connCounter // active connections.
+	fds   fdSampler   // open file descriptors, see WithFDReserve.
+	dials dialCounter // dials in flight by destination.
+
+	// connections in handshake and relays, see WithHandshakeLimits and
+	// WithMaxRelays.
+	handshakes atomic.Int64
+	relays     atomic.Int64
+
+	userSessions userCounter // sessions by user id, see WithMaxSessionsPerUser.
+
+	store Store // counters of the limits, a MemoryStore by default.
+
+	conf   atomic.Pointer[Config] // timeouts, limits and rules, see Reconfigure.
+	confMu sync.Mutex             // serializes the updates of conf.
+
+	latencyBuckets []time.Duration // of the latency histograms.
+
+	logLevels [numLogSubsystems]atomic.Int32 // levels of the subsystems plus one, see SetLogLevel.
+
+	startup   *StartupChecks // checked before serving, nil if disabled.
+	startupMu sync.Mutex
+	checked   bool // the startup checks passed.
+
+	maintenance atomic.Pointer[Maintenance] // nil when not in maintenance.
+	faults      *Faults                     // faults injected for tests, nil if disabled.
+	tarpit      *Tarpit                     // nil if disabled.
+
+	clock   Clock   // the system clock by default.
+	network Network // the system network by default.
+
+	startTime time.Time
+	stats     stats
+	// counters of the destinations of CONNECT requests, see TopDestinations.
+	destinations destinations
+	lastID       atomic.Uint64 // ID of the last session.
 }
 
 // NewServer creates and return a SOCKS 4 proxy server with given options.
@@ -33,7 +175,14 @@ type Server struct {
 //
 //	s := socks4.NewServer(WithLogger(customLogger))
 func NewServer(opts ...OptionFunc) *Server {
-	srv := &Server{}
+	srv := &Server{
+		relayBufSize: defaultRelayBufSize,
+		sniffBuffer:  maxSniffBytes,
+		sniffTimeout: defaultSniffTimeout,
+	}
+	// the options set the configuration before the server is shared.
+	srv.conf.Store(&Config{})
+	srv.serial = serverSerial.Add(1)
 	for _, opt := range opts {
 		opt(srv)
 	}
@@ -47,6 +196,34 @@ func NewServer(opts ...OptionFunc) *Server {
 			Level: logrus.DebugLevel,
 		}
 	}
+	if srv.clock == nil {
+		srv.clock = systemClock{}
+	}
+	if srv.network == nil {
+		srv.network = systemNetwork{dscp: srv.dscp, source: srv.sourceIP, ports: srv.sourcePorts}
+	}
+	if len(srv.logSampling) > 0 {
+		srv.logger = newSampledLogger(srv.logger, srv.logSampling, srv.clock)
+	}
+	if srv.reverse != nil {
+		srv.reverse.logger = srv.logger
+		srv.reverse.clock = srv.clock
+		srv.reverse.network = srv.network
+	}
+	if srv.breaker != nil {
+		srv.breaker.clock = srv.clock
+		srv.breaker.ratio = srv.breakerRatio
+	}
+	srv.startTime = srv.clock.Now()
+	if srv.latencyBuckets == nil {
+		srv.latencyBuckets = DefaultLatencyBuckets
+	}
+	srv.stats.handshake = newHistogram(srv.latencyBuckets)
+	srv.stats.dial = newHistogram(srv.latencyBuckets)
+	if srv.store == nil {
+		srv.store = NewMemoryStore()
+	}
+	srv.warnHiddenRules(srv.config().Rules)
 
 	return srv
 }
@@ -61,159 +238,756 @@ func (s *Server) Run(address string) error {
 	if err != nil {
 		return err
 	}
-	s.lis = lis
-	s.closed = false
-	s.wg = sync.WaitGroup{}
+	return s.Serve(lis)
+}
+
+// Serve accepts and serves client connections on the listener. It may be
+// called for several listeners concurrently. With WithStartupChecks, it
+// closes the listener and returns the error of the first failed check
+// without accepting any connection.
+func (s *Server) Serve(lis net.Listener) error {
+	return s.serve(lis, false)
+}
+
+func (s *Server) serve(lis net.Listener, transparent bool) error {
+	if err := s.CheckStartup(); err != nil {
+		lis.Close()
+		return err
+	}
+	labels := listenerLabels(lis)
+	s.addListener(lis)
 	defer lis.Close()
-	s.logger.Infof("SOCKS server listen on %v", address)
+	if transparent {
+		s.log(LogAccept).Infof("transparent proxy listen on %v", lis.Addr())
+	} else {
+		s.log(LogAccept).Infof("SOCKS server listen on %v", lis.Addr())
+	}
 
+	var backoff time.Duration // of the accepts out of file descriptors.
 	for {
 		conn, err := lis.Accept()
 		if err != nil {
-			if s.closed {
+			if s.isClosed() {
 				break
 			}
-			s.logger.Warnf("listener accept error: %v", err)
+			s.log(LogAccept).Warnf("listener accept error: %v", err)
+			s.reportError("accept", err, "listener", lis.Addr().String())
+			if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+				// rather than spinning until connections are closed.
+				if backoff = 2 * backoff; backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff > time.Second {
+					backoff = time.Second
+				}
+				s.clock.Sleep(backoff)
+			}
 			continue
 		}
-		s.logger.Infof("accept connection from: %v", conn.RemoteAddr())
+		backoff = 0
+		s.log(LogAccept).Infof("accept connection from: %v", conn.RemoteAddr())
+		s.stats.accepted.Add(1)
+		if s.clientDSCP != 0 {
+			if err := setConnDSCP(conn, s.clientDSCP); err != nil {
+				s.log(LogAccept).Warnf("failed to set DSCP for client %v: %v", conn.RemoteAddr(), err)
+				s.reportError("dscp", err, "client", conn.RemoteAddr().String())
+			}
+		}
 		s.wg.Add(1)
-		go s.handleConn(conn)
+		if transparent {
+			go s.serveIntercepted(conn, lis.Addr(), labels)
+		} else {
+			go s.serveConn(conn, labels)
+		}
 	}
 
 	return errors.New("listencer closed")
 }
 
+// addListener registers a listener closed by the shutdown.
+func (s *Server) addListener(lis net.Listener) {
+	s.mu.Lock()
+	if len(s.listeners) == 0 {
+		s.closed = false
+	}
+	s.listeners = append(s.listeners, lis)
+	s.mu.Unlock()
+}
+
+// ServeConn serves a client connection accepted by the caller, e.g. over
+// another transport, and returns when it is complete. Connections passed
+// after the server is shut down are closed.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.serveAccepted(conn, nil)
+}
+
+// serveAccepted serves a connection accepted by the caller, with the
+// labels of its listener.
+func (s *Server) serveAccepted(conn net.Conn, labels map[string]string) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.wg.Add(1)
+	s.mu.Unlock()
+	s.log(LogAccept).Infof("accept connection from: %v", conn.RemoteAddr())
+	s.stats.accepted.Add(1)
+	s.serveConn(conn, labels)
+}
+
+// serveConn admits and handles an accepted connection, with the labels of
+// its listener.
+func (s *Server) serveConn(conn net.Conn, labels map[string]string) {
+	defer s.wg.Done()
+	if _, ok := conn.(*wsConn); !ok && s.proxyProtocol != nil {
+		var err error
+		if conn, err = s.readProxyHeader(conn); err != nil {
+			s.log(LogAccept).Warnf("PROXY protocol error: %v", err)
+			conn.Close()
+			return
+		}
+	}
+	if !s.admit(conn) {
+		s.stats.refused.Add(1)
+		conn.Close()
+		return
+	}
+	s.handleConn(conn, labels)
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
 // ShutDown shut down the SOCKS server. The server will stop accepting
 // new connections and wait for existing connections to complete.
 func (s *Server) ShutDown() error {
-	if s.lis == nil {
-		return errors.New("can't shut down a server that has not been started")
-	}
-	s.closed = true
-	if err := s.lis.Close(); err != nil {
+	return s.ShutdownContext(context.Background())
+}
+
+// ShutdownContext shuts down the SOCKS server like ShutDown, but when ctx is
+// done before the existing connections complete, it closes them and returns
+// the error of ctx.
+func (s *Server) ShutdownContext(ctx context.Context) error {
+	rep := s.beginReport()
+	if err := s.closeListeners(); err != nil {
 		return err
 	}
-	s.logger.Info("server is shut down, waiting for existing connections to complete")
+	s.mu.Lock()
+	s.shutdownStart = rep.Started
+	rep.Sessions = len(s.sessions)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.shutdownStart = time.Time{}
+		s.mu.Unlock()
+	}()
+	if n := s.pendingBinds(); n > 0 && s.bindDrain {
+		s.logger.Infof("server is shut down, waiting for existing connections to complete, including %v pending BIND requests", n)
+	} else {
+		s.logger.Info("server is shut down, waiting for existing connections to complete")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	interval := s.progressInterval
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			s.logger.Info("all connections are complete")
+			s.endReport(rep)
+			return nil
+		case <-ticker.C():
+			s.reportProgress()
+		case <-ctx.Done():
+			s.logger.Warnf("close remaining connections: %v", ctx.Err())
+			if n := s.closeBinds(); n > 0 {
+				s.logger.Warnf("closed %v pending BIND requests", n)
+			}
+			rep.ForceClosed = s.closeSessions()
+			<-done
+			s.endReport(rep)
+			return ctx.Err()
+		}
+	}
+}
+
+// Close closes the listeners and all connections of the server
+// immediately.
+func (s *Server) Close() error {
+	rep := s.beginReport()
+	err := s.closeListeners()
+	s.closeBinds()
+	rep.ForceClosed = s.closeSessions()
+	rep.Sessions = rep.ForceClosed
 	s.wg.Wait()
-	s.logger.Info("all connections are complete")
-	return nil
+	if err == nil {
+		s.endReport(rep)
+	}
+	return err
+}
+
+// closeListeners makes the server stop accepting new connections.
+func (s *Server) closeListeners() error {
+	s.mu.Lock()
+	listeners := s.listeners
+	s.listeners = nil
+	s.closed = len(listeners) > 0
+	s.mu.Unlock()
+	if len(listeners) == 0 {
+		return errors.New("can't shut down a server that has not been started")
+	}
+	if s.reverse != nil {
+		s.reverse.close()
+	}
+
+	var err error
+	for _, lis := range listeners {
+		if cErr := lis.Close(); cErr != nil {
+			err = cErr
+		}
+	}
+	if !s.bindDrain {
+		if n := s.closeBinds(); n > 0 {
+			s.logger.Infof("closed %v pending BIND requests", n)
+		}
+	}
+	return err
 }
 
 // HandleConn handles connect from client.
-func (s *Server) handleConn(conn net.Conn) {
+func (s *Server) handleConn(conn net.Conn, labels map[string]string) {
 	defer conn.Close()
-	defer s.wg.Done()
+	defer s.leave(conn)
+	ss := s.addSession(conn, labels)
+	defer s.removeSession(ss)
+	defer s.releaseRelay(ss)
+	defer s.releaseUserSession(ss)
+	// the handshake counted by admit.
+	handshaking := true
+	endHandshake := func() {
+		if handshaking {
+			handshaking = false
+			s.handshakes.Add(-1)
+		}
+	}
+	defer endHandshake()
+	defer s.traceSession(ss)()
+	defer s.recoverSession(ss)
 
-	remote, err := s.establishProxy(conn)
+	var remote net.Conn
+	var req Request
+	var err error
+	if ic, ok := conn.(*interceptedConn); ok {
+		remote, req, err = s.establishIntercepted(ss, ic)
+	} else {
+		// the TLS of WebSocket connections is the one of their HTTP server.
+		if _, ok := conn.(*wsConn); !ok && s.tlsConfig != nil {
+			tc, err := s.tlsHandshake(conn)
+			if err != nil {
+				s.log(LogAccept).Warnf("TLS handshake with client %v error: %v", conn.RemoteAddr(), err)
+				return
+			}
+			conn = tc
+		}
+		if id := clientIdentity(conn); id != "" {
+			ss.setIdentity(id)
+			s.log(LogAccept).Infof("client %v authenticated as %q", conn.RemoteAddr(), id)
+		}
+		if s.compression {
+			conn, err = s.acceptCompression(conn)
+		}
+		if err == nil {
+			remote, req, err = s.establishProxy(ss, conn, ss.start, 0)
+		}
+		for retries := 0; err != nil && retries < s.rejectRetries && s.retriesRequest(err); retries++ {
+			s.settleRequest(ss, conn, req, err)
+			s.log(LogHandshake).Debugf("wait up to %v for another request of client %v", s.rejectWait, conn.RemoteAddr())
+			remote, req, err = s.establishProxy(ss, conn, s.clock.Now(), s.rejectWait)
+			if noRequest(req, err) {
+				s.log(LogHandshake).Debugf("client %v sent no other request: %v", conn.RemoteAddr(), err)
+				return
+			}
+		}
+	}
+	endHandshake()
+	logger, lc := s.settleRequest(ss, conn, req, err)
 	if err != nil {
-		s.logger.Warnf("establish proxy error: %v", err)
 		return
 	}
 	defer remote.Close()
+	s.stats.established.Add(1)
+	act := newActivity(s.clock)
+	ss.setRemote(remote, act)
+	s.notify(EventEstablished, ss, remote, nil)
+	defer s.notify(EventClosed, ss, remote, nil)
+	if lc != nil {
+		lc.established.Add(1)
+		defer func() {
+			toRemote, toClient := act.Bytes()
+			lc.clientToRemote.Add(toRemote)
+			lc.remoteToClient.Add(toClient)
+		}()
+	}
+	if req.Cmd == CmdConnect {
+		s.destinations.add(s.clock.Now(), req.Address, 1, 0, 0)
+		defer func() {
+			toRemote, toClient := act.Bytes()
+			s.destinations.add(s.clock.Now(), req.Address, 0, int64(toRemote), int64(toClient))
+		}()
+	}
+
+	target := remote.RemoteAddr().String()
+	if req.Resolved != nil && target != req.Address {
+		// the address the name of the target resolved to.
+		target = req.Address + " at " + target
+	}
+	logger.Infof("proxy conn for client %v to target %v established by %v", conn.RemoteAddr(), target, req.Protocol())
+	t, err := s.relayTransform(conn, req)
+	if err != nil {
+		logger.Errorf("close the relay of client %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	mirror := s.startMirror(ss.id, conn, remote, req)
+	var sn *sniffer
+	// the rules on sniffed hosts are about the destinations of CONNECT.
+	if hold := req.Cmd == CmdConnect && s.hasSniffedRules(); s.sniffing || hold {
+		sn = s.newSniffer(ss)
+		sn.hold = hold
+	}
+	s.transfer(ss, conn, remote, req, act, mirror, sn, t)
+}
 
-	s.logger.Infof("proxy conn for client %v to target %v established", conn.RemoteAddr(), remote.RemoteAddr())
-	s.transfer(conn, remote)
+// settleRequest records the request of the session, with the labels of its
+// rule, and returns the logger and the labeled counters of the session.
+// The failed requests are counted, logged and notified.
+func (s *Server) settleRequest(ss *session, conn net.Conn, req Request, err error) (Logger, *labeledCounters) {
+	ss.setRequest(req)
+	// the labels of the rule deciding the request, matched again like for
+	// the mirror.
+	if req.Cmd != 0 {
+		if rule := s.matchRule(conn, req); rule != nil {
+			ss.addLabels(rule.Labels)
+		}
+	}
+	logger := s.sessionLogger(ss)
+	lc := s.stats.labeled.counters(ss.getLabels())
+	if err == nil {
+		return logger, lc
+	}
+	s.stats.failed.Add(1)
+	s.stats.countRejection(err)
+	if lc != nil {
+		lc.failed.Add(1)
+	}
+	logger.Warnf("establish proxy error: %v", err)
+	// the requests not read, like those of health checks, are not
+	// abuses.
+	if req.Cmd != 0 && !errors.Is(err, errBanned) {
+		s.countRejection(conn)
+	}
+	s.notifyRejected(ss, err, s.auditRejection(ss, req, logger))
+	return logger, lc
 }
 
-// establishProxy establishes a TCP connection with remote host.
-func (s *Server) establishProxy(conn net.Conn) (net.Conn, error) {
-	b := make([]byte, 41)
+// establishProxy establishes a TCP connection with remote host for the
+// client of the session whose request is awaited from start, waiting up to
+// wait for it, the handshake timeout if 0.
+func (s *Server) establishProxy(ss *session, conn net.Conn, start time.Time, wait time.Duration) (net.Conn, Request, error) {
+	defer trace.StartRegion(ss.trace, "handshake").End()
+	b := make([]byte, requestBufSize)
+	if wait == 0 {
+		wait = s.handshakeTimeout()
+	}
+	if wait > 0 {
+		conn.SetReadDeadline(time.Now().Add(wait))
+	}
 	n, err := conn.Read(b)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read from connect: %v", err)
+		return nil, Request{}, fmt.Errorf("failed to read from connect: %w", err)
+	}
+	s.setRaw(ss, b[:n])
+	if b[0] == Version5 && s.socks5 {
+		req, err := s.socks5Handshake(conn, b[:n])
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return nil, req, err
+		}
+		s.requestRead(req, start)
+		return s.establish(ss, conn, req, socks5Replier{})
+	}
+	if isHTTPMethod(b[0]) && s.httpConnect {
+		req, err := s.readHTTPConnect(conn, b[:n])
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return nil, req, err
+		}
+		s.requestRead(req, start)
+		return s.establish(ss, conn, req, httpReplier{})
+	}
+	// the request may be longer than the first read, and is read up to
+	// its last byte. The reply comes before any data of the client.
+	first := bytes.NewReader(b[:n])
+	r := io.MultiReader(first, conn)
+	if s.rejectAudit != nil {
+		// the first read, and what is read beyond it up to the last byte.
+		raw := &rawRecorder{buf: ss.raw}
+		r = io.MultiReader(first, io.TeeReader(conn, raw))
+		defer func() { ss.raw = raw.buf }()
+	}
+	req, err := readRequest(r, s.maxUserIdSize())
+	conn.SetReadDeadline(time.Time{})
+	if err == nil && first.Len() > 0 {
+		err = ErrTrailingData
 	}
-	s.logger.Debugf("read request from client %v: %v", conn.RemoteAddr().String(), b[:n])
-	req, err := ParseRequest(b[:n])
 	if err != nil {
-		return nil, err
+		return nil, s.maskUserId(req), err
+	}
+	s.log(LogHandshake).Debugf("read request from client %v: %v", conn.RemoteAddr(), s.maskUserId(req))
+	s.requestRead(req, start)
+	reason := s.sendsRejectReason(conn)
+	rep := &replyTracker{replier: socks4Replier{req: req, hook: s.replyHook, reason: reason}}
+	remote, req, err := s.establish(ss, conn, req, rep)
+	if err != nil && rep.rejectedReplied && !reason {
+		err = &repliedError{err: err}
+	}
+	return remote, req, err
+}
+
+// replier writes the replies of a SOCKS version to the client.
+type replier interface {
+	// granted replies that the request is granted, with the address the
+	// server bound for it.
+	granted(conn net.Conn, bound net.Addr) error
+	// rejected replies that the request is rejected or failed by err.
+	rejected(conn net.Conn, err error) error
+}
+
+// socks4Replier writes SOCKS 4 replies to the request.
+type socks4Replier struct {
+	req    Request
+	hook   ReplyHook // nil if not set.
+	reason bool      // write the reason after the rejections, see WithRejectReasons.
+}
+
+func (socks4Replier) granted(conn net.Conn, bound net.Addr) error {
+	return writeReply(conn, Granted, socks4Bound(bound), nil)
+}
+
+// socks4Bound returns the bound address replied to SOCKS 4 clients: those
+// which are not IPv4 addresses, like the local addresses of the IPv6
+// connections, are replied as 0.0.0.0 with their port, telling the client
+// to use the address of the server.
+func socks4Bound(addr net.Addr) net.Addr {
+	if addr == nil {
+		return nil
+	}
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		return addr
+	}
+	port, _ := strconv.Atoi(portStr)
+	return &net.TCPAddr{IP: net.IPv4zero, Port: port}
+}
+
+func (r socks4Replier) rejected(conn net.Conn, err error) error {
+	code := socks4ReplyCode(err)
+	if r.hook != nil {
+		if c := r.hook(r.req, err, code); isReplyCode(c) && c != Granted {
+			code = c
+		}
+	}
+	var reason []byte
+	if r.reason {
+		reason = rejectReason(err)
+	}
+	return writeReply(conn, code, nil, reason)
+}
+
+// writeReply writes the SOCKS 4 reply with the code and bound address to
+// the client, followed by extra.
+func writeReply(conn net.Conn, code byte, bound net.Addr, extra []byte) error {
+	rep, err := NewReply(code, bound)
+	if err != nil {
+		return err
+	}
+	b, err := rep.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(b, extra...))
+	return err
+}
+
+// reject replies to the client that its request is rejected for err, and
+// returns the error of the rejection, or the error of the reply.
+func reject(conn net.Conn, req Request, rep replier, err error) (net.Conn, Request, error) {
+	return rejectf(conn, req, rep, err, "request to %v rejected: %w", req.Address, err)
+}
+
+// rejectf is reject with the error of the rejection formatted like
+// fmt.Errorf.
+func rejectf(conn net.Conn, req Request, rep replier, err error, format string, a ...any) (net.Conn, Request, error) {
+	if wErr := rep.rejected(conn, err); wErr != nil {
+		return nil, req, fmt.Errorf("failed to reply to client: %v", wErr)
+	}
+	return nil, req, fmt.Errorf(format, a...)
+}
+
+// errDenied is the error of the requests denied by a rule.
+var errDenied = errors.New("denied by rule")
+
+// errDeniedByDefault is the error of the requests matching no rule, denied
+// by the default action. It is an errDenied.
+var errDeniedByDefault error = deniedByDefaultError{}
+
+type deniedByDefaultError struct{}
+
+func (deniedByDefaultError) Error() string { return "denied by default" }
+func (deniedByDefaultError) Unwrap() error { return errDenied }
+
+// establish checks the request against the rules and carries it out,
+// replying to the client by rep.
+func (s *Server) establish(ss *session, conn net.Conn, req Request, rep replier) (net.Conn, Request, error) {
+	start := s.clock.Now()
+	// the requests rejected before their user id is checked return it
+	// masked, as it may carry a PAM secret or a token.
+	if s.banned(conn) {
+		s.hold(conn)
+		if s.tarpit.Reply {
+			return reject(conn, s.maskUserId(req), rep, errBanned)
+		}
+		return nil, s.maskUserId(req), fmt.Errorf("request to %v rejected: %w", req.Address, errBanned)
+	}
+	if s.tarpit != nil && s.tarpit.RejectDelay > 0 {
+		rep = delayedReplier{replier: rep, delay: s.tarpit.RejectDelay, clock: s.clock}
+	}
+	if m := s.maintenance.Load(); m != nil && !m.allows(conn) {
+		if !m.Close {
+			return reject(conn, s.maskUserId(req), rep, errMaintenance)
+		}
+		return nil, s.maskUserId(req), fmt.Errorf("request to %v rejected: %w", req.Address, errMaintenance)
+	}
+	if s.faults != nil {
+		if err := s.faults.injectHandshake(s.clock); err != nil {
+			return rejectf(conn, s.maskUserId(req), rep, err, "request to %v %w", req.Address, err)
+		}
+	}
+	req, err := s.mapCertUserId(conn, req)
+	if err != nil {
+		return reject(conn, s.maskUserId(req), rep, err)
+	}
+	if req, err = s.checkPAM(req); err != nil {
+		return reject(conn, req, rep, err)
+	}
+	if err := s.checkUserId(conn, req); err != nil {
+		if s.jwt != nil {
+			// the token is not verified yet.
+			req = s.maskUserId(req)
+		}
+		return reject(conn, req, rep, err)
+	}
+	if req, err = s.verifyToken(req); err != nil {
+		return reject(conn, req, rep, err)
+	}
+	if req, err = s.resolveGroups(conn, req); err != nil {
+		return reject(conn, req, rep, err)
+	}
+	if req, err = s.rewriteRequest(req); err != nil {
+		return reject(conn, req, rep, err)
+	}
+	s.traceRequest(ss, req)
+	if req, err = s.resolveRequest(conn, req, ss.origin(conn, req)); err != nil {
+		return reject(conn, req, rep, err)
+	}
+	rule := s.matchRule(conn, req)
+	if rule != nil {
+		s.stats.countRule(rule)
+		s.log(LogRules).Debugf("request of client %v to %v matches rule %q", conn.RemoteAddr(), req.Address, rule)
+	} else {
+		s.log(LogRules).Debugf("request of client %v to %v matches no rule", conn.RemoteAddr(), req.Address)
+	}
+	if rule != nil && rule.Action == Deny {
+		return rejectf(conn, req, rep, errDenied, "request to %v %w %q", req.Address, errDenied, rule)
+	}
+	if rule == nil && s.deniedByDefault(conn, req, false) {
+		return rejectf(conn, req, rep, errDeniedByDefault, "request to %v matching no rule %w", req.Address, errDeniedByDefault)
+	}
+	via := ""
+	if rule != nil {
+		via = rule.Via
+	}
+
+	if !s.acquireUserSession(ss, req, rule) {
+		return rejectf(conn, req, rep, errTooManyUserSessions, "request to %v by user %q rejected: %w", req.Address, req.UserId, errTooManyUserSessions)
+	}
+	if !s.acquireRelay(ss) {
+		return reject(conn, req, rep, errTooManyRelays)
 	}
 
 	var remote net.Conn
 	if req.Cmd == CmdConnect {
-		remote, err = s.establishConnect(conn, req)
+		dial := trace.StartRegion(ss.trace, "dial")
+		remote, err = s.establishConnect(req, via, ss.origin(conn, req))
+		dial.End()
 		if err != nil {
-			_, wErr := conn.Write(Reply{Cd: RejectOrFailure}.ToBytes())
-			if err != nil {
-				remote.Close()
-				return nil, fmt.Errorf("failed to reply to client: %v", wErr)
-			}
-			return nil, fmt.Errorf("failed to establish connect for CONNECT request: %v", err)
+			return rejectf(conn, req, rep, err, "failed to establish connect for CONNECT request: %w", err)
 		}
+		s.stats.dial.observe(s.clock.Now().Sub(start))
 	} else if req.Cmd == CmdBind {
-		remote, err = s.establishBind(conn, req)
+		if s.upstream != nil {
+			err = errors.New("BIND is not supported through the upstream server")
+		} else {
+			remote, err = s.establishBind(conn, req, rep)
+		}
 		if err != nil {
-			_, wErr := conn.Write(Reply{Cd: RejectOrFailure}.ToBytes())
-			if wErr != nil {
-				remote.Close()
-				return nil, fmt.Errorf("failed to reply to client: %v", wErr)
-			}
-			return nil, fmt.Errorf("failed to establish connect for BIND request: %v", err)
+			return rejectf(conn, req, rep, err, "failed to establish connect for BIND request: %w", err)
+		}
+	} else if req.Cmd == CmdReverse {
+		remote, err = s.establishReverse(conn, req, rep)
+		if err != nil {
+			return rejectf(conn, req, rep, err, "failed to establish reverse request: %w", err)
 		}
 	} else {
-		return nil, fmt.Errorf("unexpected error: got a request with operation command %v", req.Cmd)
+		return nil, req, fmt.Errorf("unexpected error: got a request with operation command %v", req.Cmd)
 	}
 
-	local := remote.LocalAddr().String()
-	addr, err := net.ResolveTCPAddr("tcp", local)
-	if err != nil {
+	if err := rep.granted(conn, remote.LocalAddr()); err != nil {
 		remote.Close()
-		return nil, err
+		return nil, req, err
 	}
+	return remote, req, nil
+}
 
-	rep := Reply{
-		Cd:   Granted,
-		Port: addr.Port,
-		IP:   net.ParseIP(addr.IP.String()).To4(),
-	}.ToBytes()
-	_, err = conn.Write(rep)
-	if err != nil {
-		remote.Close()
-		return nil, err
+// establishConnect establishes a TCP connection to remote host for
+// SOCKS 4/4A CONNECT request of the origin, through the egress named via
+// if not empty.
+func (s *Server) establishConnect(req Request, via string, o origin) (net.Conn, error) {
+	// checked first, as the breaker expects the probes it allows to be
+	// dialed.
+	if !s.dials.acquire(req.Address, s.config().MaxDialsPerDestination) {
+		return nil, fmt.Errorf("%w %v", errTooManyDials, req.Address)
 	}
-	return remote, nil
+	defer s.dials.release(req.Address)
+	if s.breaker != nil && !s.breaker.allow(req.Address) {
+		return nil, fmt.Errorf("%w for %v", errCircuitOpen, req.Address)
+	}
+
+	remote, err := s.dialWithRetry(req.Address, via, o)
+	if s.breaker != nil {
+		s.breaker.report(req.Address, err)
+	}
+	return remote, err
 }
 
-// establishConnect establishes a TCP connection to remote host for
-// SOCKS 4/4A CONNECT request.
-func (s *Server) establishConnect(conn net.Conn, req Request) (net.Conn, error) {
-	remote, err := net.Dial("tcp", req.Address)
-	if err != nil {
-		return nil, err
+// dialWithRetry dials the address, retrying on failure as configured by
+// WithDialRetry.
+func (s *Server) dialWithRetry(address, via string, o origin) (net.Conn, error) {
+	backoff := s.dialBackoff
+	for i := 0; ; i++ {
+		remote, err := s.dialTarget(address, via, o)
+		if err == nil {
+			return remote, nil
+		}
+		if i >= s.dialRetries || !isRetryable(err) {
+			return nil, err
+		}
+		s.log(LogHandshake).Debugf("dial %v failed, retry in %v: %v", address, backoff, err)
+		s.clock.Sleep(backoff)
+		backoff *= 2
 	}
+}
 
-	return remote, nil
+// isRetryable reports whether a dial error may succeed on a later attempt.
+// Failures of name resolution and rejections by the upstream server are
+// considered permanent.
+func isRetryable(err error) bool {
+	var upErr *UpstreamError
+	var chErr *ssh.OpenChannelError
+	if errors.As(err, &upErr) || errors.As(err, &chErr) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return dnsErr.IsTimeout || dnsErr.IsTemporary
+	}
+	return true
 }
 
+// dial connects to the address on the named network of the server for
+// the origin, with the dial timeout.
+func (s *Server) dial(network, address string, o origin) (net.Conn, error) {
+	if n, ok := s.network.(ContextNetwork); ok {
+		ctx, cancel := o.context(s)
+		defer cancel()
+		return n.DialContext(ctx, network, address)
+	}
+	return s.network.Dial(network, address, s.dialTimeout())
+}
+
+// dialTimeout returns the timeout of a dial attempt: the dial timeout, or
+// the attempt timeout of WithDialRetry when shorter.
+func (s *Server) dialTimeout() time.Duration {
+	timeout := s.config().DialTimeout
+	if t := s.dialAttemptTimeout; t > 0 && (timeout <= 0 || t < timeout) {
+		timeout = t
+	}
+	return timeout
+}
+
+// bindTimeout is the max time a BIND request waits for the connection of
+// the remote host.
+const bindTimeout = 120 * time.Second
+
 // establishBind establishes an inbound TCP connection from remote host
-// for SOCKS 4/4A BIND request.
-func (s *Server) establishBind(conn net.Conn, req Request) (net.Conn, error) {
-	lis, err := net.Listen("tcp", "")
+// for BIND request.
+func (s *Server) establishBind(conn net.Conn, req Request, rep replier) (net.Conn, error) {
+	lis, err := s.network.Listen("tcp", "")
 	if err != nil {
 		return nil, err
 	}
 	defer lis.Close()
-
-	addr, err := net.ResolveTCPAddr("tcp", lis.Addr().String())
-	if err != nil {
-		return nil, err
+	if !s.addBind(lis) {
+		return nil, errShutDown
 	}
+	defer s.removeBind(lis)
 
 	// first reply
-	if _, err := conn.Write(Reply{Cd: Granted, Port: addr.Port}.ToBytes()); err != nil {
+	if err := rep.granted(conn, lis.Addr()); err != nil {
 		return nil, err
 	}
 
 	// max time for listening remote.
-	go func() {
-		time.Sleep(120 * time.Second)
-		lis.Close()
-	}()
+	timer := s.clock.AfterFunc(bindTimeout, func() { lis.Close() })
+	defer timer.Stop()
 
 	remote, err := lis.Accept()
 	if err != nil {
+		if s.removeBind(lis) {
+			return nil, errShutDown
+		}
 		return nil, err
 	}
+	if s.dscp != 0 {
+		if err := setConnDSCP(remote, s.dscp); err != nil {
+			s.log(LogRelay).Warnf("failed to set DSCP for remote %v: %v", remote.RemoteAddr(), err)
+			s.reportError("dscp", err, "client", conn.RemoteAddr().String(), "remote", remote.RemoteAddr().String())
+		}
+	}
 
 	// TODO.
 	// Normally, it should check wether the IP, port of remote host are
@@ -222,22 +996,94 @@ func (s *Server) establishBind(conn net.Conn, req Request) (net.Conn, error) {
 	return remote, nil
 }
 
-// transfer relays data between client and remote host.
-func (s *Server) transfer(client, remote net.Conn) {
+// transfer relays data between client and remote host, transformed by t
+// if not nil.
+func (s *Server) transfer(ss *session, client, remote net.Conn, req Request, act *Activity, mirror *mirroring, sn *sniffer, t *Transform) {
+	defer trace.StartRegion(ss.trace, "relay").End()
 	cliAddr, remoteAddr := client.RemoteAddr().String(), remote.RemoteAddr().String()
-	s.logger.Infof("begin transfer data between client %v and remote host %v", cliAddr, remoteAddr)
+	s.log(LogRelay).Infof("begin transfer data between client %v and remote host %v", cliAddr, remoteAddr)
+	if s.relayHook != nil {
+		s.relayHook(client, req, act)
+	}
+	done := make(chan struct{})
+	if timeout := s.config().IdleTimeout; timeout > 0 {
+		go s.watchIdle(timeout, act, done, client, remote)
+	}
+	if c := s.config(); c.StallTimeout > 0 {
+		go s.watchStalls(ss, c.StallTimeout, c.CloseStalled, act, done, client, remote)
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
+	var toClient, toRemote io.Writer
+	toClient = activityWriter{client, &act.remoteToClient, &s.stats.remoteToClient, s.clock}
+	toRemote = activityWriter{remote, &act.clientToRemote, &s.stats.clientToRemote, s.clock}
+	if limit := s.sessionBytes(client, req); limit > 0 {
+		budget := &byteBudget{exhausted: func() {
+			s.log(LogRelay).Infof("close proxy conn for client %v: %v bytes relayed", cliAddr, limit)
+			client.Close()
+			remote.Close()
+		}}
+		budget.left.Store(limit)
+		toClient = budgetWriter{toClient, budget}
+		toRemote = budgetWriter{toRemote, budget}
+	}
+	// the writers of the transform, closed at the end of their direction.
+	var transClient, transRemote io.Writer
+	if t != nil {
+		toClient, toRemote = t.wrap(toClient, toRemote, client, req)
+		transClient, transRemote = toClient, toRemote
+	}
+	if mirror != nil {
+		toClient = mirrorWriter{toClient, mirror, false}
+		toRemote = mirrorWriter{toRemote, mirror, true}
+	}
+	if s.faults != nil {
+		toClient = newFaultWriter(toClient, s.faults, s.clock, client, remote)
+		toRemote = newFaultWriter(toRemote, s.faults, s.clock, client, remote)
+	}
+	// the writer of the bytes held for the rules, already sniffed.
+	sniffed := toRemote
+	if sn != nil {
+		toRemote = sniffWriter{toRemote, sn}
+	}
+
+	// the remote host reaches the client once the rules allow the relay.
+	allowed := make(chan bool, 1)
+	hold := sn != nil && sn.hold
+	if !hold {
+		allowed <- true
+	}
+
+	// the readers are wrapped to hide WriterTo from io.CopyBuffer, so that
+	// only the accounted buffers are used.
 	go func() {
-		io.Copy(client, remote)
+		if <-allowed {
+			buf := make([]byte, s.relayBufSize)
+			io.CopyBuffer(toClient, struct{ io.Reader }{remote}, buf)
+		}
+		closeTransformed(transClient)
 		wg.Done()
 	}()
 	go func() {
-		io.Copy(remote, client)
-		wg.Done()
+		defer wg.Done()
+		defer closeTransformed(transRemote)
+		if hold {
+			ok := s.allowSniffed(client, remote, req, sn, sniffed)
+			allowed <- ok
+			if !ok {
+				return
+			}
+		}
+		buf := make([]byte, s.relayBufSize)
+		io.CopyBuffer(toRemote, struct{ io.Reader }{client}, buf)
 	}()
 
 	wg.Wait()
-	s.logger.Infof("stop transfer data between client %v and remote host %v", cliAddr, remoteAddr)
+	close(done)
+	if mirror != nil {
+		mirror.end()
+	}
+	s.log(LogRelay).Infof("stop transfer data between client %v and remote host %v", cliAddr, remoteAddr)
 }
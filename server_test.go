@@ -0,0 +1,338 @@
+package socks4
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cccxg/socks4/testutil"
+)
+
+// failingNetwork fails the first dials, then connects them to pipes, and
+// records the timeout of each dial.
+type failingNetwork struct {
+	systemNetwork
+	failures int
+	timeouts []time.Duration
+}
+
+func (n *failingNetwork) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	n.timeouts = append(n.timeouts, timeout)
+	if len(n.timeouts) <= n.failures {
+		return nil, errDial
+	}
+	conn, peer := net.Pipe()
+	peer.Close()
+	return conn, nil
+}
+
+// sleepClock is a system clock recording its sleeps instead of sleeping.
+type sleepClock struct {
+	systemClock
+	sleeps []time.Duration
+}
+
+func (c *sleepClock) Sleep(d time.Duration) { c.sleeps = append(c.sleeps, d) }
+
+func TestDialRetryTimeout(t *testing.T) {
+	for _, tt := range []struct {
+		dial, attempt time.Duration
+		want          time.Duration
+	}{
+		{dial: 10 * time.Second, attempt: 2 * time.Second, want: 2 * time.Second},
+		{dial: time.Second, attempt: 5 * time.Second, want: time.Second},
+		{dial: 10 * time.Second, want: 10 * time.Second},
+		{attempt: 3 * time.Second, want: 3 * time.Second},
+	} {
+		// the options are applied in both orders.
+		for _, opts := range [][]OptionFunc{
+			{WithDialTimeout(tt.dial), WithDialRetry(2, time.Second, tt.attempt)},
+			{WithDialRetry(2, time.Second, tt.attempt), WithDialTimeout(tt.dial)},
+		} {
+			s := newTestServer(opts...)
+			if s.config().DialTimeout != tt.dial {
+				t.Errorf("dial timeout %v with attempts of %v, want %v", s.config().DialTimeout, tt.attempt, tt.dial)
+			}
+			if got := s.dialTimeout(); got != tt.want {
+				t.Errorf("timeout of the attempts of %v with a dial timeout %v: %v, want %v", tt.attempt, tt.dial, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestDialWithRetry(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		failures int
+		ok       bool
+		sleeps   []time.Duration
+	}{
+		{name: "first attempt", ok: true},
+		{name: "second attempt", failures: 1, ok: true, sleeps: []time.Duration{100 * time.Millisecond}},
+		{name: "last attempt", failures: 3, ok: true, sleeps: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}},
+		{name: "all attempts failed", failures: 4, sleeps: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &failingNetwork{failures: tt.failures}
+			clock := &sleepClock{}
+			s := newTestServer(WithNetwork(n), WithClock(clock), WithDialTimeout(time.Minute), WithDialRetry(3, 100*time.Millisecond, time.Second))
+			conn, err := s.dialWithRetry("10.0.0.1:80", "", origin{})
+			if (err == nil) != tt.ok {
+				t.Fatalf("dialed: %v, want success %v", err, tt.ok)
+			}
+			if conn != nil {
+				conn.Close()
+			}
+			if !reflect.DeepEqual(clock.sleeps, tt.sleeps) {
+				t.Errorf("waits %v, want %v", clock.sleeps, tt.sleeps)
+			}
+			for _, timeout := range n.timeouts {
+				if timeout != time.Second {
+					t.Errorf("attempt dialed with timeout %v, want 1s", timeout)
+				}
+			}
+		})
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want bool
+	}{
+		{errDial, true},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, false},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, true},
+		{&UpstreamError{}, false},
+	} {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("%v retryable %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// serve starts a server of the options on 127.0.0.1:0, closed at the end
+// of the test, and returns it with its address.
+func serve(t *testing.T, opts ...OptionFunc) (*Server, string) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(opts...)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(lis)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		<-done
+	})
+	return s, lis.Addr().String()
+}
+
+// echoTarget starts an echo server on 127.0.0.1:0, closed at the end of
+// the test.
+func echoTarget(t *testing.T) *testutil.Server {
+	t.Helper()
+	srv, err := testutil.NewEchoServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+// assertEcho writes payload to conn, connected to an echo server, and
+// fails the test unless it is read back.
+func assertEcho(t *testing.T, conn net.Conn, payload []byte) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("echoed %q, want %q", got, payload)
+	}
+}
+
+// closedConn fails the writes.
+type closedConn struct{ net.Conn }
+
+func (closedConn) Write([]byte) (int, error) { return 0, net.ErrClosed }
+
+func TestReject(t *testing.T) {
+	req := Request{Version: Version4, Cmd: CmdConnect, Port: 80, Address: "10.0.0.1:80"}
+	rep := socks4Replier{req: req}
+	for _, tt := range []struct {
+		name    string
+		conn    net.Conn
+		reject  func(conn net.Conn) (net.Conn, Request, error)
+		err     string
+		denied  bool // the error is errDenied.
+		replied bool
+	}{
+		{
+			name:    "rejected",
+			conn:    &bufConn{},
+			reject:  func(conn net.Conn) (net.Conn, Request, error) { return reject(conn, req, rep, errDenied) },
+			err:     "request to 10.0.0.1:80 rejected: denied by rule",
+			denied:  true,
+			replied: true,
+		},
+		{
+			name: "formatted",
+			conn: &bufConn{},
+			reject: func(conn net.Conn) (net.Conn, Request, error) {
+				return rejectf(conn, req, rep, errDenied, "request to %v %w %q", req.Address, errDenied, "deny all")
+			},
+			err:     `request to 10.0.0.1:80 denied by rule "deny all"`,
+			denied:  true,
+			replied: true,
+		},
+		{
+			name:   "reply failed",
+			conn:   closedConn{},
+			reject: func(conn net.Conn) (net.Conn, Request, error) { return reject(conn, req, rep, errDenied) },
+			err:    "failed to reply to client: use of closed network connection",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			remote, got, err := tt.reject(tt.conn)
+			if remote != nil || got.Address != req.Address {
+				t.Errorf("returned %v and request %v, want no connection and the request", remote, got)
+			}
+			if err == nil || err.Error() != tt.err || errors.Is(err, errDenied) != tt.denied {
+				t.Errorf("error %v, want %q", err, tt.err)
+			}
+			if c, ok := tt.conn.(*bufConn); ok != tt.replied || ok && !bytes.Equal(c.w.Bytes(), []byte{0, RejectOrFailure, 0, 0, 0, 0, 0, 0}) {
+				t.Errorf("replied %v, want %v", tt.conn, tt.replied)
+			}
+		})
+	}
+}
+
+func TestShutdownContext(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		timeout time.Duration
+		end     bool // the session ends during the shutdown.
+		err     error
+	}{
+		{name: "sessions complete", timeout: 5 * time.Second, end: true},
+		{name: "sessions closed", timeout: 100 * time.Millisecond, err: context.DeadlineExceeded},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			echo := echoTarget(t)
+			s, addr := serve(t)
+			conn, err := NewDialer(addr).Dial("tcp", echo.Addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			assertEcho(t, conn, []byte("hello"))
+
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+			shutdown := make(chan error, 1)
+			go func() { shutdown <- s.ShutdownContext(ctx) }()
+			// the new connections are refused, the session goes on.
+			for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+				c, err := net.Dial("tcp", addr)
+				if err != nil {
+					break
+				}
+				c.Close()
+			}
+			if tt.end {
+				// the relay ends with both of its connections.
+				assertEcho(t, conn, []byte("again"))
+				conn.Close()
+				echo.Close()
+			}
+			select {
+			case err := <-shutdown:
+				if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+					t.Errorf("shutdown error %v, want %v", err, tt.err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("shutdown blocked")
+			}
+			if !tt.end {
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := conn.Read(make([]byte, 1)); err == nil {
+					t.Error("session not closed by the shutdown")
+				}
+			}
+		})
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	echo := echoTarget(t)
+	host, port, _ := net.SplitHostPort(echo.Addr)
+	p, _ := strconv.Atoi(port)
+	s, _ := serve(t)
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeConn(server)
+	}()
+	client.Write(request(CmdConnect, uint16(p), [4]byte(net.ParseIP(host).To4()), ""))
+	reply := make([]byte, 8)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(client, reply); err != nil || reply[1] != Granted {
+		t.Fatalf("reply %x: %v", reply, err)
+	}
+	assertEcho(t, client, []byte("hello"))
+	client.Close()
+	echo.Close()
+	<-done
+
+	// and closed once the server is shut down.
+	s.Close()
+	client, server = net.Pipe()
+	defer client.Close()
+	s.ServeConn(server)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read error %v, want the connection closed", err)
+	}
+}
+
+func TestSocks4Granted(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		bound net.Addr
+		reply []byte
+	}{
+		{name: "IPv4", bound: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080}, reply: []byte{0, Granted, 0x04, 0x38, 192, 0, 2, 1}},
+		{name: "IPv6", bound: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1080}, reply: []byte{0, Granted, 0x04, 0x38, 0, 0, 0, 0}},
+		{name: "IPv4-mapped IPv6", bound: &net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 1080}, reply: []byte{0, Granted, 0x04, 0x38, 192, 0, 2, 1}},
+		{name: "not an IP", bound: &net.UnixAddr{Name: "/run/socks4.sock", Net: "unix"}, reply: []byte{0, Granted, 0, 0, 0, 0, 0, 0}},
+		{name: "none", reply: []byte{0, Granted, 0, 0, 0, 0, 0, 0}},
+	} {
+		conn := &bufConn{}
+		if err := (socks4Replier{}).granted(conn, tt.bound); err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(conn.w.Bytes(), tt.reply) {
+			t.Errorf("%v: replied %v, want %v", tt.name, conn.w.Bytes(), tt.reply)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package socks4
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SessionInfo describes a client connection being served.
+type SessionInfo struct {
+	ID             uint64            `json:"id"`
+	Client         string            `json:"client"`
+	Cmd            string            `json:"cmd,omitempty"`    // "connect", "bind" or "reverse", empty before the request is read.
+	Target         string            `json:"target,omitempty"` // target host address of the request.
+	UserId         string            `json:"user_id,omitempty"`
+	Identity       string            `json:"identity,omitempty"`     // identity of the TLS client certificate.
+	SniffedHost    string            `json:"sniffed_host,omitempty"` // host name sent by the client in the relay, see WithSniffing.
+	Remote         string            `json:"remote,omitempty"`       // address of the remote host connected, e.g. the one the target resolved to.
+	Labels         map[string]string `json:"labels,omitempty"`       // labels of the listener and of the rule matching the request, see LabelListener.
+	Start          time.Time         `json:"start"`
+	LastActivity   time.Time         `json:"last_activity"`
+	ClientToRemote uint64            `json:"client_to_remote_bytes"`
+	RemoteToClient uint64            `json:"remote_to_client_bytes"`
+}
+
+// session tracks the connections of a client being served, so that they
+// can be listed and closed by the server.
+type session struct {
+	id     uint64
+	client net.Conn
+	start  time.Time
+	trace  context.Context // of the trace task of the session, see traceSession.
+	relay  bool            // a relay is reserved, see acquireRelay.
+	user   string          // user whose sessions count the session, see acquireUserSession.
+	raw    []byte          // first bytes of the request, see WithRejectAudit.
+
+	mu       sync.Mutex
+	identity string
+	req      Request
+	sniffed  string            // host name sniffed in the relay.
+	labels   map[string]string // labels of the listener and rule, not modified once set.
+	remote   net.Conn
+	act      *Activity // nil before relay begins.
+	closed   bool
+}
+
+// setIdentity sets the identity of the client certificate.
+func (ss *session) setIdentity(identity string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.identity = identity
+}
+
+// setRequest sets the request read from the client.
+func (ss *session) setRequest(req Request) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.req = req
+}
+
+// setSniffedHost sets the host name sniffed in the relay.
+func (ss *session) setSniffedHost(host string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.sniffed = host
+}
+
+// addLabels adds the labels of the rule matching the request.
+func (ss *session) addLabels(labels map[string]string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.labels = mergeLabels(ss.labels, labels)
+}
+
+// getLabels returns the labels of the session.
+func (ss *session) getLabels() map[string]string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.labels
+}
+
+// target returns the target address of the request.
+func (ss *session) target() string {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	return ss.req.Address
+}
+
+// setRemote sets the connection to the remote host and the activity of
+// the relay. The connection is closed right away if the session has been
+// closed.
+func (ss *session) setRemote(remote net.Conn, act *Activity) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.remote = remote
+	ss.act = act
+	if ss.closed {
+		remote.Close()
+	}
+}
+
+// close closes the connections of the session.
+func (ss *session) close() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.closed = true
+	ss.client.Close()
+	if ss.remote != nil {
+		ss.remote.Close()
+	}
+}
+
+func (ss *session) info() SessionInfo {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	info := SessionInfo{
+		ID:           ss.id,
+		Client:       ss.client.RemoteAddr().String(),
+		Target:       ss.req.Address,
+		UserId:       ss.req.UserId,
+		Identity:     ss.identity,
+		SniffedHost:  ss.sniffed,
+		Labels:       ss.labels,
+		Start:        ss.start,
+		LastActivity: ss.start,
+	}
+	switch ss.req.Cmd {
+	case CmdConnect:
+		info.Cmd = "connect"
+	case CmdBind:
+		info.Cmd = "bind"
+	case CmdReverse:
+		info.Cmd = "reverse"
+	}
+	if ss.remote != nil {
+		info.Remote = ss.remote.RemoteAddr().String()
+	}
+	if ss.act != nil {
+		info.LastActivity = ss.act.Last()
+		info.ClientToRemote, info.RemoteToClient = ss.act.Bytes()
+	}
+	return info
+}
+
+// Sessions returns the client connections being served, ordered by ID.
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	sessions := make([]*session, 0, len(s.sessions))
+	for ss := range s.sessions {
+		sessions = append(sessions, ss)
+	}
+	s.mu.Unlock()
+
+	infos := make([]SessionInfo, len(sessions))
+	for i, ss := range sessions {
+		infos[i] = ss.info()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// addSession starts tracking a session for the client connection, with
+// the labels of its listener.
+func (s *Server) addSession(conn net.Conn, labels map[string]string) *session {
+	ss := &session{
+		id:     s.lastID.Add(1),
+		client: conn,
+		start:  s.clock.Now(),
+		trace:  context.Background(),
+		labels: labels,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[*session]struct{})
+	}
+	s.sessions[ss] = struct{}{}
+	return ss
+}
+
+// removeSession stops tracking the session.
+func (s *Server) removeSession(ss *session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, ss)
+}
+
+// closeSessions closes the connections of all sessions and returns their
+// number.
+func (s *Server) closeSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ss := range s.sessions {
+		ss.close()
+	}
+	return len(s.sessions)
+}
+
+// KillSession closes the connections of the session with the given ID. It
+// reports whether the session was found.
+func (s *Server) KillSession(id uint64) bool {
+	s.mu.Lock()
+	var found *session
+	for ss := range s.sessions {
+		if ss.id == id {
+			found = ss
+			break
+		}
+	}
+	s.mu.Unlock()
+	if found == nil {
+		return false
+	}
+	found.close()
+	s.logger.Infof("session %v of client %v killed", id, found.client.RemoteAddr())
+	return true
+}
@@ -0,0 +1,69 @@
+package socks4
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// UnlimitedBytes is the Rule.MaxBytes of the sessions relayed without
+// limit, whatever WithMaxSessionBytes.
+const UnlimitedBytes int64 = -1
+
+// WithMaxSessionBytes makes the server close a proxy connection once n
+// bytes have been relayed in both directions, 0 for no limit. The MaxBytes
+// of the rule allowing a session overrides it, e.g. for some users.
+func WithMaxSessionBytes(n int64) OptionFunc {
+	return func(s *Server) {
+		s.config().MaxSessionBytes = n
+	}
+}
+
+var errSessionBytes = errors.New("session byte limit reached")
+
+// sessionBytes returns the max bytes relayed for the request, 0 for no
+// limit.
+func (s *Server) sessionBytes(client net.Conn, req Request) int64 {
+	limit := s.config().MaxSessionBytes
+	if rule := s.matchRule(client, req); rule != nil && rule.MaxBytes != 0 {
+		limit = rule.MaxBytes
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// byteBudget is the bytes left to relay in both directions of a session,
+// calling exhausted once when they run out.
+type byteBudget struct {
+	left      atomic.Int64
+	once      sync.Once
+	exhausted func()
+}
+
+// budgetWriter writes to w up to the bytes left in the budget.
+type budgetWriter struct {
+	w      io.Writer
+	budget *byteBudget
+}
+
+func (w budgetWriter) Write(p []byte) (int, error) {
+	n := int64(len(p))
+	left := w.budget.left.Add(-n)
+	if left >= 0 {
+		return w.w.Write(p)
+	}
+	// the bytes of p within the budget, if any.
+	written := 0
+	if allowed := n + left; allowed > 0 {
+		var err error
+		if written, err = w.w.Write(p[:allowed]); err != nil {
+			return written, err
+		}
+	}
+	w.budget.once.Do(w.budget.exhausted)
+	return written, errSessionBytes
+}
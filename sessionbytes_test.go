@@ -0,0 +1,137 @@
+package socks4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRuleBytes(t *testing.T) {
+	for _, tt := range []struct {
+		rule     string
+		maxBytes int64
+		err      bool
+	}{
+		{rule: "allow"},
+		{rule: "allow bytes 1000", maxBytes: 1000},
+		{rule: "allow bytes 64K", maxBytes: 64 << 10},
+		{rule: "allow user alice bytes unlimited", maxBytes: UnlimitedBytes},
+		{rule: "allow bytes 0", err: true},
+		{rule: "allow bytes -1", err: true},
+		{rule: "allow bytes many", err: true},
+	} {
+		rule, err := ParseRule(tt.rule)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: error %v, want %v", tt.rule, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if rule.MaxBytes != tt.maxBytes {
+			t.Errorf("%q: max bytes %v, want %v", tt.rule, rule.MaxBytes, tt.maxBytes)
+		}
+		// the rule is written back with its limit.
+		if again, err := ParseRule(rule.String()); err != nil || again.MaxBytes != tt.maxBytes {
+			t.Errorf("%q written as %q: max bytes %v, want %v", tt.rule, rule.String(), again.MaxBytes, tt.maxBytes)
+		}
+	}
+}
+
+func TestSessionBytesLimit(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		server int64
+		rules  string
+		limit  int64
+	}{
+		{name: "none", rules: "allow"},
+		{name: "server", server: 100, rules: "allow", limit: 100},
+		{name: "rule", rules: "allow bytes 50", limit: 50},
+		{name: "rule over server", server: 100, rules: "allow bytes 50", limit: 50},
+		{name: "unlimited rule", server: 100, rules: "allow bytes unlimited"},
+		{name: "other rule", server: 100, rules: "allow port 22 bytes 50\nallow", limit: 100},
+	} {
+		rules, err := ParseRules(strings.NewReader(tt.rules))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := newTestServer(WithMaxSessionBytes(tt.server), WithRules(rules))
+		if limit := s.sessionBytes(fromIP("10.0.0.1"), Request{Cmd: CmdConnect, Address: "10.0.0.2:80"}); limit != tt.limit {
+			t.Errorf("%v: limit %v, want %v", tt.name, limit, tt.limit)
+		}
+	}
+}
+
+func TestBudgetWriter(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		budget    int64
+		writes    []string
+		written   string
+		exhausted bool
+	}{
+		{name: "within", budget: 10, writes: []string{"hello", "world"}, written: "helloworld"},
+		{name: "beyond", budget: 7, writes: []string{"hello", "world"}, written: "hellowo", exhausted: true},
+		{name: "after", budget: 5, writes: []string{"hello", "world", "again"}, written: "hello", exhausted: true},
+	} {
+		exhausted := 0
+		budget := &byteBudget{exhausted: func() { exhausted++ }}
+		budget.left.Store(tt.budget)
+		var b bytes.Buffer
+		w := budgetWriter{w: &b, budget: budget}
+		var err error
+		for _, data := range tt.writes {
+			var n int
+			n, err = w.Write([]byte(data))
+			if err != nil && !errors.Is(err, errSessionBytes) {
+				t.Errorf("%v: wrote %v bytes: %v", tt.name, n, err)
+			}
+		}
+		if b.String() != tt.written || (err != nil) != tt.exhausted {
+			t.Errorf("%v: wrote %q with error %v, want %q", tt.name, b.String(), err, tt.written)
+		}
+		// exhausted once.
+		if want := map[bool]int{true: 1}[tt.exhausted]; exhausted != want {
+			t.Errorf("%v: exhausted %v times, want %v", tt.name, exhausted, want)
+		}
+	}
+}
+
+func TestMaxSessionBytes(t *testing.T) {
+	echo := echoTarget(t)
+	for _, tt := range []struct {
+		name    string
+		limit   int64
+		rules   string
+		payload int  // bytes written and echoed until the limit.
+		closed  bool // the relay is closed before the echo.
+	}{
+		{name: "within", limit: 100, rules: "allow", payload: 50},
+		{name: "beyond", limit: 100, rules: "allow", payload: 60, closed: true},
+		{name: "rule", rules: "allow bytes 100", payload: 60, closed: true},
+		{name: "unlimited rule", limit: 100, rules: "allow bytes unlimited", payload: 60},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseRules(strings.NewReader(tt.rules))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, addr := serve(t, WithMaxSessionBytes(tt.limit), WithRules(rules))
+			conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			conn.Write(bytes.Repeat([]byte("x"), tt.payload))
+			echoed, err := io.ReadAll(io.LimitReader(conn, int64(tt.payload)))
+			if closed := len(echoed) < tt.payload; closed != tt.closed {
+				t.Errorf("echoed %v bytes of %v with error %v, want closed %v", len(echoed), tt.payload, err, tt.closed)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package socks4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxSniffBytes is the max number of first bytes of a relay inspected by
+// the sniffing, enough for a TLS ClientHello in a single record.
+const maxSniffBytes = 16*1024 + 5
+
+// defaultSniffTimeout is the default max time the relays sniffed for the
+// rules are held.
+const defaultSniffTimeout = 2 * time.Second
+
+// Protocols of the sniffed relays.
+const (
+	SniffedTLS     = "tls"
+	SniffedHTTP    = "http"
+	SniffedUnknown = "unknown"
+)
+
+// WithSniffing makes the server inspect the first bytes sent by the clients
+// through their relays for the TLS SNI or the HTTP Host header, so that the
+// host names accessed by clients requesting IP addresses show in the logs,
+// the sessions (see SessionInfo.SniffedHost) and the stats. The traffic is
+// neither modified nor delayed.
+func WithSniffing() OptionFunc {
+	return func(s *Server) {
+		s.sniffing = true
+	}
+}
+
+// WithSniffBudget sets the max bytes and time the relays are held to sniff
+// their host names for the rules with an sni key, 16 KiB and 2 seconds by
+// default. The relay begins with what was sniffed when the budget runs
+// out, e.g. for the protocols where the server speaks first.
+func WithSniffBudget(size int, timeout time.Duration) OptionFunc {
+	return func(s *Server) {
+		if size > 0 && size < maxSniffBytes {
+			s.sniffBuffer = size
+		}
+		s.sniffTimeout = timeout
+	}
+}
+
+// sniffer inspects the first bytes of a relay from the client. It is used
+// by the goroutine writing them to the remote host.
+type sniffer struct {
+	hold   bool // hold the relay until the bytes are decided, for the rules.
+	buf    []byte
+	done   bool
+	host   string                   // host name sniffed once done.
+	result func(proto, host string) // called once the bytes are decided.
+}
+
+// newSniffer returns the sniffer of the relay of the session.
+func (s *Server) newSniffer(ss *session) *sniffer {
+	return &sniffer{result: func(proto, host string) {
+		s.stats.countSniffed(proto)
+		if host == "" {
+			return
+		}
+		ss.setSniffedHost(host)
+		s.log(LogRelay).Infof("session %v of client %v to %v sniffed %v host %q", ss.id, ss.client.RemoteAddr(), ss.target(), proto, host)
+	}}
+}
+
+// observe inspects the bytes following those already observed.
+func (sn *sniffer) observe(b []byte) {
+	if sn.done {
+		return
+	}
+	if n := maxSniffBytes - len(sn.buf); len(b) > n {
+		b = b[:n]
+	}
+	sn.buf = append(sn.buf, b...)
+	proto, host, more := sniffHost(sn.buf)
+	if more && len(sn.buf) < maxSniffBytes {
+		return
+	}
+	if proto == "" {
+		proto = SniffedUnknown
+	}
+	sn.done = true
+	sn.host = host
+	sn.buf = nil
+	sn.result(proto, host)
+}
+
+// allowSniffed holds the relay from the client until its host name is
+// sniffed, within the budget, and checks it against the rules. If they
+// allow it, it writes the bytes read to w, which must not sniff them again,
+// and returns true; otherwise it closes the connections.
+func (s *Server) allowSniffed(client, remote net.Conn, req Request, sn *sniffer, w io.Writer) bool {
+	var held []byte
+	buf := make([]byte, 4096)
+	if s.sniffTimeout > 0 {
+		client.SetReadDeadline(time.Now().Add(s.sniffTimeout))
+	}
+	for !sn.done && len(held) < s.sniffBuffer {
+		n, err := client.Read(buf)
+		held = append(held, buf[:n]...)
+		sn.observe(buf[:n])
+		if err != nil {
+			// a later read gets the error again, unless it is the timeout.
+			break
+		}
+	}
+	client.SetReadDeadline(time.Time{})
+
+	rule := s.matchSniffedRule(client, req, sn.host)
+	if rule != nil && rule.SNI != "" {
+		// the other rules were counted with the request.
+		s.stats.countRule(rule)
+	}
+	if rule != nil && rule.Action == Deny {
+		s.log(LogRules).Warnf("close relay of client %v to %v: sniffed host %q denied by rule %q", client.RemoteAddr(), req.Address, sn.host, rule)
+		client.Close()
+		remote.Close()
+		return false
+	}
+	if rule == nil && s.deniedByDefault(client, req, true) {
+		s.log(LogRules).Warnf("close relay of client %v to %v: sniffed host %q matches no rule, denied by default", client.RemoteAddr(), req.Address, sn.host)
+		client.Close()
+		remote.Close()
+		return false
+	}
+	if len(held) > 0 {
+		if _, err := w.Write(held); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// sniffWriter observes the data written to w.
+type sniffWriter struct {
+	w  io.Writer
+	sn *sniffer
+}
+
+func (w sniffWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if n > 0 {
+		w.sn.observe(p[:n])
+	}
+	return n, err
+}
+
+// sniffHost returns the protocol and the host name of the first bytes sent
+// by a client, with an empty protocol if it is not known. more is true if b
+// is too short to decide.
+func sniffHost(b []byte) (proto, host string, more bool) {
+	if len(b) == 0 {
+		return "", "", true
+	}
+	if b[0] == 0x16 {
+		return sniffTLS(b)
+	}
+	if isHTTPMethod(b[0]) {
+		return sniffHTTP(b)
+	}
+	return "", "", false
+}
+
+// sniffTLS returns the server name of a TLS ClientHello.
+func sniffTLS(b []byte) (proto, host string, more bool) {
+	// record header: type, version, length.
+	if len(b) < 5 {
+		return "", "", true
+	}
+	if b[1] != 3 {
+		return "", "", false
+	}
+	n := int(binary.BigEndian.Uint16(b[3:]))
+	if len(b) < 5+n {
+		return SniffedTLS, "", true
+	}
+	hs := b[5 : 5+n]
+	// handshake header: type ClientHello (1), length.
+	if len(hs) < 4 || hs[0] != 1 {
+		return "", "", false
+	}
+	hello := hs[4:]
+	if l := int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3]); l < len(hello) {
+		hello = hello[:l]
+	}
+	// version, random, then the session ID, cipher suites and compression
+	// methods, each prefixed by its length.
+	p := &tlsParser{b: hello}
+	p.skip(2 + 32)
+	p.skip(int(p.u8()))
+	p.skip(int(p.u16()))
+	p.skip(int(p.u8()))
+	exts := &tlsParser{b: p.bytes(int(p.u16()))}
+	for !p.failed && len(exts.b) > 0 {
+		typ, data := exts.u16(), exts.bytes(int(exts.u16()))
+		if exts.failed {
+			break
+		}
+		if typ != 0 { // server_name.
+			continue
+		}
+		names := &tlsParser{b: data}
+		list := &tlsParser{b: names.bytes(int(names.u16()))}
+		for !list.failed && len(list.b) > 0 {
+			nameType, name := list.u8(), list.bytes(int(list.u16()))
+			if !list.failed && nameType == 0 {
+				return SniffedTLS, string(name), false
+			}
+		}
+		break
+	}
+	return SniffedTLS, "", false
+}
+
+// tlsParser reads the fields of a TLS message, failing when they are
+// truncated.
+type tlsParser struct {
+	b      []byte
+	failed bool
+}
+
+func (p *tlsParser) bytes(n int) []byte {
+	if p.failed || n > len(p.b) {
+		p.failed = true
+		return nil
+	}
+	b := p.b[:n]
+	p.b = p.b[n:]
+	return b
+}
+
+func (p *tlsParser) skip(n int) {
+	p.bytes(n)
+}
+
+func (p *tlsParser) u8() byte {
+	if b := p.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (p *tlsParser) u16() uint16 {
+	if b := p.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// sniffHTTP returns the Host header of an HTTP/1 request.
+func sniffHTTP(b []byte) (proto, host string, more bool) {
+	lineEnd := bytes.Index(b, []byte("\r\n"))
+	if lineEnd < 0 {
+		// the method must be followed by a space.
+		if sp := bytes.IndexByte(b, ' '); sp < 0 && len(b) > len("OPTIONS") || sp > len("OPTIONS") {
+			return "", "", false
+		}
+		return SniffedHTTP, "", true
+	}
+	if !bytes.Contains(b[:lineEnd], []byte(" HTTP/1.")) {
+		return "", "", false
+	}
+	end := bytes.Index(b, []byte("\r\n\r\n"))
+	if end < 0 {
+		return SniffedHTTP, "", true
+	}
+	lines := strings.Split(string(b[:end]), "\r\n")
+	if !strings.Contains(lines[0], " HTTP/1.") {
+		return "", "", false
+	}
+	for _, line := range lines[1:] {
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(name, "Host") {
+			host = strings.TrimSpace(value)
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return SniffedHTTP, host, false
+		}
+	}
+	return SniffedHTTP, "", false
+}
+
+// countSniffed counts a relay sniffed by its protocol.
+func (st *stats) countSniffed(proto string) {
+	c, ok := st.sniffed.Load(proto)
+	if !ok {
+		c, _ = st.sniffed.LoadOrStore(proto, new(atomic.Uint64))
+	}
+	c.(*atomic.Uint64).Add(1)
+}
@@ -0,0 +1,178 @@
+package socks4
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuleHidesSniffedRules(t *testing.T) {
+	for _, tt := range []struct {
+		rules  string
+		hidden bool
+	}{
+		{"allow\ndeny sni bad.example.com", true},
+		{"allow port 443\ndeny sni bad.example.com port 443", true},
+		{"allow from 10.0.0.0/8\ndeny from 10.0.0.0/8 sni bad.example.com", true},
+		{"allow port 443\ndeny sni bad.example.com", false},
+		{"allow from 10.0.0.0/8\ndeny sni bad.example.com", false},
+		{"allow sni good.example.com\ndeny sni bad.example.com", false},
+		{"deny sni bad.example.com\nallow", false},
+	} {
+		rules, err := ParseRules(strings.NewReader(tt.rules))
+		if err != nil {
+			t.Fatalf("%q: %v", tt.rules, err)
+		}
+		if hidden := rules[0].hides(&rules[1]); hidden != tt.hidden {
+			t.Errorf("%q: hidden %v, want %v", tt.rules, hidden, tt.hidden)
+		}
+	}
+}
+
+// clientHello returns the first TLS record sent by a client of the server
+// name, empty for none.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+	server, client := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	defer client.Close()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:])))
+	copy(record, header)
+	if _, err := io.ReadFull(server, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestSniffHost(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	for _, tt := range []struct {
+		name  string
+		in    []byte
+		proto string
+		host  string
+		more  bool
+	}{
+		{name: "empty", in: nil, more: true},
+		{name: "TLS", in: hello, proto: SniffedTLS, host: "www.example.com"},
+		{name: "TLS without SNI", in: clientHello(t, ""), proto: SniffedTLS},
+		{name: "TLS record header", in: hello[:3], more: true},
+		{name: "TLS record truncated", in: hello[:len(hello)-1], proto: SniffedTLS, more: true},
+		{name: "TLS of another major version", in: []byte{0x16, 2, 0, 0, 4, 1, 0, 0, 0}},
+		{name: "TLS handshake not a ClientHello", in: []byte{0x16, 3, 1, 0, 4, 2, 0, 0, 0}},
+		{name: "TLS ClientHello truncated", in: []byte{0x16, 3, 1, 0, 6, 1, 0, 0, 2, 3, 3}, proto: SniffedTLS},
+		{name: "HTTP", in: []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\nAccept: */*\r\n\r\n"), proto: SniffedHTTP, host: "www.example.com"},
+		{name: "HTTP host with port", in: []byte("POST /form HTTP/1.1\r\nhost: www.example.com:8080\r\n\r\nbody"), proto: SniffedHTTP, host: "www.example.com"},
+		{name: "HTTP IPv6 host", in: []byte("GET / HTTP/1.1\r\nHost: [2001:db8::1]:8080\r\n\r\n"), proto: SniffedHTTP, host: "2001:db8::1"},
+		{name: "HTTP without Host", in: []byte("GET / HTTP/1.0\r\n\r\n"), proto: SniffedHTTP},
+		{name: "HTTP method", in: []byte("GET"), proto: SniffedHTTP, more: true},
+		{name: "HTTP request line", in: []byte("GET /index.html HTT"), proto: SniffedHTTP, more: true},
+		{name: "HTTP headers", in: []byte("GET / HTTP/1.1\r\nHost: www.exa"), proto: SniffedHTTP, more: true},
+		{name: "HTTP/2 preface", in: []byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n")},
+		{name: "long first word", in: []byte("GETTINGS")},
+		{name: "SSH", in: []byte("SSH-2.0-OpenSSH_9.6\r\n")},
+		{name: "binary", in: []byte{0, 1, 2, 3}},
+	} {
+		proto, host, more := sniffHost(tt.in)
+		if proto != tt.proto || host != tt.host || more != tt.more {
+			t.Errorf("%v: sniffed %q %q more %v, want %q %q more %v", tt.name, proto, host, more, tt.proto, tt.host, tt.more)
+		}
+	}
+}
+
+func TestSnifferObserve(t *testing.T) {
+	hello := clientHello(t, "www.example.com")
+	for _, tt := range []struct {
+		name   string
+		chunks [][]byte
+		proto  string
+		host   string
+	}{
+		{name: "TLS at once", chunks: [][]byte{hello}, proto: SniffedTLS, host: "www.example.com"},
+		{name: "TLS in parts", chunks: [][]byte{hello[:1], hello[1:10], hello[10:]}, proto: SniffedTLS, host: "www.example.com"},
+		{name: "HTTP in parts", chunks: [][]byte{[]byte("GET / HT"), []byte("TP/1.1\r\nHost: a.example.com\r\n"), []byte("\r\n")}, proto: SniffedHTTP, host: "a.example.com"},
+		{name: "unknown", chunks: [][]byte{[]byte("SSH-2.0-OpenSSH_9.6\r\n")}, proto: SniffedUnknown},
+		{name: "beyond the max bytes", chunks: [][]byte{[]byte("GET / HTTP/1.1\r\n"), bytes.Repeat([]byte("X-Pad: x\r\n"), maxSniffBytes/10)}, proto: SniffedHTTP},
+		{name: "undecided", chunks: [][]byte{[]byte("GET / HTTP/1.1\r\n")}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var results []string
+			sn := &sniffer{result: func(proto, host string) { results = append(results, proto+" "+host) }}
+			for _, c := range tt.chunks {
+				sn.observe(c)
+			}
+			if sn.done {
+				// the bytes after the decision are not inspected.
+				sn.observe([]byte("GET / HTTP/1.1\r\nHost: later.example.com\r\n\r\n"))
+			}
+			var want []string
+			if tt.proto != "" {
+				want = []string{tt.proto + " " + tt.host}
+			}
+			if !reflect.DeepEqual(results, want) || tt.proto != "" && (!sn.done || sn.host != tt.host || sn.buf != nil) {
+				t.Errorf("results %q, want %q", results, want)
+			}
+		})
+	}
+}
+
+func TestSniffing(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		opts     []OptionFunc
+		payload  string
+		host     string
+		protocol string
+	}{
+		{name: "HTTP", opts: []OptionFunc{WithSniffing()}, payload: "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n", host: "www.example.com", protocol: SniffedHTTP},
+		{name: "unknown", opts: []OptionFunc{WithSniffing()}, payload: "SSH-2.0-OpenSSH_9.6\r\n", protocol: SniffedUnknown},
+		{name: "disabled", payload: "GET / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s, addr := serve(t, tt.opts...)
+			echo := echoTarget(t)
+			conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			// the traffic is relayed unmodified.
+			assertEcho(t, conn, []byte(tt.payload))
+			var want map[string]uint64
+			if tt.protocol != "" {
+				want = map[string]uint64{tt.protocol: 1}
+			}
+			// the bytes are sniffed once written to the remote host.
+			var sessions []SessionInfo
+			var sniffed map[string]uint64
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+				sessions = sessions[:0]
+				for _, ss := range s.Sessions() {
+					if ss.Client == conn.LocalAddr().String() {
+						sessions = append(sessions, ss)
+					}
+				}
+				if sniffed = s.Stats().Sniffed; reflect.DeepEqual(sniffed, want) {
+					break
+				}
+			}
+			if !reflect.DeepEqual(sniffed, want) {
+				t.Errorf("sniffed relays %v, want %v", sniffed, want)
+			}
+			if len(sessions) != 1 || sessions[0].SniffedHost != tt.host {
+				t.Errorf("sessions %+v, want one of the sniffed host %q", sessions, tt.host)
+			}
+		})
+	}
+}
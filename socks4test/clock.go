@@ -0,0 +1,138 @@
+package socks4test
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cccxg/socks4"
+)
+
+// FakeClock is a socks4.Clock whose time only moves when advanced, so that
+// the timeouts of a server (see socks4.WithClock) are tested without
+// waiting. It is safe for concurrent use.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter is a timer, ticker or sleep of a FakeClock.
+type fakeWaiter struct {
+	clock  *FakeClock
+	at     time.Time
+	period time.Duration // of a ticker, 0 otherwise.
+	c      chan time.Time
+	f      func() // of AfterFunc, nil otherwise.
+}
+
+// NewFakeClock returns a clock at start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+// Now returns the time of the clock.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep blocks until the clock is advanced by d.
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.NewTimer(d).C()
+}
+
+// NewTimer returns a timer firing once the clock is advanced by d.
+func (c *FakeClock) NewTimer(d time.Duration) socks4.Timer {
+	return c.add(&fakeWaiter{at: c.Now().Add(d), c: make(chan time.Time, 1)})
+}
+
+// NewTicker returns a ticker firing each time the clock is advanced by d.
+func (c *FakeClock) NewTicker(d time.Duration) socks4.Ticker {
+	return fakeTicker{c.add(&fakeWaiter{at: c.Now().Add(d), period: d, c: make(chan time.Time, 1)})}
+}
+
+// AfterFunc calls f in its own goroutine once the clock is advanced by d.
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) socks4.Timer {
+	return c.add(&fakeWaiter{at: c.Now().Add(d), f: f})
+}
+
+func (c *FakeClock) add(w *fakeWaiter) *fakeWaiter {
+	w.clock = c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !w.at.After(c.now) && w.period == 0 {
+		w.fire(c.now)
+		return w
+	}
+	c.waiters = append(c.waiters, w)
+	return w
+}
+
+// Advance moves the clock forward by d, firing the timers and tickers due
+// in order of their times.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.waiters, func(i, j int) bool { return c.waiters[i].at.Before(c.waiters[j].at) })
+		if len(c.waiters) == 0 || c.waiters[0].at.After(end) {
+			break
+		}
+		w := c.waiters[0]
+		c.now = w.at
+		w.fire(c.now)
+		if w.period > 0 {
+			w.at = w.at.Add(w.period)
+		} else {
+			c.waiters = c.waiters[1:]
+		}
+	}
+	c.now = end
+}
+
+// Waiters returns the number of pending timers, tickers and sleeps, e.g.
+// to wait until the server sleeps before advancing the clock.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// fire notifies the waiter of the time, dropping the ticks not received
+// like time.Ticker.
+func (w *fakeWaiter) fire(now time.Time) {
+	if w.f != nil {
+		go w.f()
+		return
+	}
+	select {
+	case w.c <- now:
+	default:
+	}
+}
+
+func (w *fakeWaiter) C() <-chan time.Time {
+	return w.c
+}
+
+// Stop stops the waiter, reporting whether it was pending.
+func (w *fakeWaiter) Stop() bool {
+	c := w.clock
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, other := range c.waiters {
+		if other == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// fakeTicker is a fakeWaiter with the Stop method of a ticker.
+type fakeTicker struct{ *fakeWaiter }
+
+func (t fakeTicker) Stop() { t.fakeWaiter.Stop() }
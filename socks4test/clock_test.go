@@ -0,0 +1,198 @@
+package socks4test
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cccxg/socks4"
+)
+
+// fired reports whether the channel has a value.
+func fired(c <-chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFakeClockTimer(t *testing.T) {
+	start := time.Unix(1000, 0)
+	for _, tt := range []struct {
+		name    string
+		d       time.Duration
+		advance []time.Duration
+		fired   []bool // after each advance.
+		stop    bool   // before advancing.
+	}{
+		{name: "due", d: time.Second, advance: []time.Duration{time.Second}, fired: []bool{true}},
+		{name: "not yet due", d: time.Second, advance: []time.Duration{999 * time.Millisecond, time.Millisecond}, fired: []bool{false, true}},
+		{name: "past due", d: time.Second, advance: []time.Duration{time.Hour}, fired: []bool{true}},
+		{name: "fires once", d: time.Second, advance: []time.Duration{time.Second, time.Second}, fired: []bool{true, false}},
+		{name: "stopped", d: time.Second, advance: []time.Duration{time.Hour}, fired: []bool{false}, stop: true},
+	} {
+		c := NewFakeClock(start)
+		timer := c.NewTimer(tt.d)
+		if tt.stop && !timer.Stop() {
+			t.Errorf("%v: pending timer not stopped", tt.name)
+		}
+		for i, d := range tt.advance {
+			c.Advance(d)
+			if f := fired(timer.C()); f != tt.fired[i] {
+				t.Errorf("%v: fired %v after advance %v, want %v", tt.name, f, i+1, tt.fired[i])
+			}
+		}
+		if c.Waiters() != 0 {
+			t.Errorf("%v: %v waiters left", tt.name, c.Waiters())
+		}
+	}
+}
+
+func TestFakeClockTicker(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFakeClock(start)
+	ticker := c.NewTicker(time.Second)
+	for _, tt := range []struct {
+		advance time.Duration
+		tick    time.Time // zero for none.
+	}{
+		{advance: 500 * time.Millisecond},
+		{advance: 500 * time.Millisecond, tick: start.Add(time.Second)},
+		{advance: time.Second, tick: start.Add(2 * time.Second)},
+		// the ticks not received are dropped.
+		{advance: 3 * time.Second, tick: start.Add(3 * time.Second)},
+	} {
+		c.Advance(tt.advance)
+		select {
+		case tick := <-ticker.C():
+			if !tick.Equal(tt.tick) {
+				t.Errorf("tick at %v, want %v", tick, tt.tick)
+			}
+		default:
+			if !tt.tick.IsZero() {
+				t.Errorf("no tick at %v, want %v", c.Now(), tt.tick)
+			}
+		}
+	}
+	ticker.Stop()
+	c.Advance(time.Hour)
+	if fired(ticker.C()) || c.Waiters() != 0 {
+		t.Error("stopped ticker ticks")
+	}
+}
+
+func TestFakeClockAfterFunc(t *testing.T) {
+	c := NewFakeClock(time.Unix(1000, 0))
+	called := make(chan time.Time, 2)
+	c.AfterFunc(2*time.Second, func() { called <- c.Now() })
+	stopped := c.AfterFunc(time.Second, func() { called <- time.Time{} })
+	if !stopped.Stop() || stopped.Stop() {
+		t.Error("pending AfterFunc not stopped once")
+	}
+	c.Advance(time.Second)
+	if c.Waiters() != 1 {
+		t.Fatalf("%v waiters, want the pending AfterFunc", c.Waiters())
+	}
+	c.Advance(time.Second)
+	select {
+	case at := <-called:
+		if !at.Equal(time.Unix(1002, 0)) {
+			t.Errorf("called at %v, want once advanced by 2s", at)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("function not called")
+	}
+	// the immediate ones are called without advancing.
+	c.AfterFunc(0, func() { called <- c.Now() })
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("immediate function not called")
+	}
+}
+
+func TestFakeClockSleep(t *testing.T) {
+	c := NewFakeClock(time.Unix(1000, 0))
+	woken := make(chan struct{})
+	go func() {
+		c.Sleep(time.Minute)
+		close(woken)
+	}()
+	waitWaiters(t, c, 1)
+	c.Advance(59 * time.Second)
+	select {
+	case <-woken:
+		t.Fatal("woken before the sleep ended")
+	case <-time.After(10 * time.Millisecond):
+	}
+	c.Advance(time.Second)
+	select {
+	case <-woken:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not woken once the sleep ended")
+	}
+}
+
+// waitWaiters waits until the clock has n waiters.
+func waitWaiters(t *testing.T, c *FakeClock, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); c.Waiters() != n; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v waiters, want %v", c.Waiters(), n)
+		}
+	}
+}
+
+func TestFakeClockIdleTimeout(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := NewFakeClock(start)
+	srv := NewServer(t, socks4.WithClock(clock), socks4.WithIdleTimeout(time.Minute))
+	echo := NewEchoTarget(t)
+	conn, err := srv.Dialer(socks4.WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	AssertEcho(t, conn, []byte("hello"))
+	if sessions := srv.Sessions(); len(sessions) != 1 || !sessions[0].Start.Equal(start) {
+		t.Fatalf("sessions %+v, want one started at the time of the clock", sessions)
+	}
+	// the idle watch ticks each half timeout.
+	waitWaiters(t, clock, 1)
+	clock.Advance(30 * time.Second)
+	AssertEcho(t, conn, []byte("hello"))
+	clock.Advance(time.Minute + time.Second)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("idle relay not closed")
+	}
+	AssertLogged(t, srv.Logs, "idle")
+}
+
+func TestFakeClockBindTimeout(t *testing.T) {
+	clock := NewFakeClock(time.Unix(1000, 0))
+	srv := NewServer(t, socks4.WithClock(clock))
+	conn, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte{socks4.Version4, socks4.CmdBind, 0, 80, 127, 0, 0, 1, 0})
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != socks4.Granted {
+		t.Fatalf("first reply %x: %v", reply, err)
+	}
+	waitWaiters(t, clock, 1)
+	clock.Advance(119 * time.Second)
+	if srv.Stats().PendingBinds != 1 {
+		t.Fatal("BIND timed out early")
+	}
+	clock.Advance(time.Second)
+	if n, err := io.ReadFull(conn, reply); err == nil && reply[1] == socks4.Granted {
+		t.Fatalf("second reply %x after the BIND timeout: %v", reply[:n], err)
+	}
+}
@@ -0,0 +1,179 @@
+// Package socks4test provides an in-process SOCKS server, fake
+// destinations and assertions for testing programs which connect through
+// the proxy, without depending on the network beyond the loopback
+// interface.
+//
+// i.e.:
+//
+//	func TestFetch(t *testing.T) {
+//		srv := socks4test.NewServer(t)
+//		echo := socks4test.NewEchoTarget(t)
+//		conn, err := srv.Dialer().Dial("tcp", echo.Addr)
+//		if err != nil {
+//			t.Fatal(err)
+//		}
+//		socks4test.AssertEcho(t, conn, []byte("hello"))
+//	}
+package socks4test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cccxg/socks4"
+)
+
+// Server is a SOCKS server serving on an ephemeral port of 127.0.0.1,
+// logging in memory. It is closed at the end of the test.
+type Server struct {
+	*socks4.Server
+	Addr string // address of the listener, like 127.0.0.1:41234.
+	Logs *Logs  // log entries of the server.
+}
+
+// NewServer starts a server with the options on 127.0.0.1:0. Its logger
+// is Logs, unless the options set another one.
+func NewServer(tb testing.TB, opts ...socks4.OptionFunc) *Server {
+	tb.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("socks4test: listen: %v", err)
+	}
+	logs := &Logs{}
+	opts = append([]socks4.OptionFunc{socks4.WithLogger(logs)}, opts...)
+	s := &Server{
+		Server: socks4.NewServer(opts...),
+		Addr:   lis.Addr().String(),
+		Logs:   logs,
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Serve(lis)
+	}()
+	tb.Cleanup(func() {
+		s.Close()
+		<-done
+	})
+	return s
+}
+
+// Dialer returns a dialer connecting through the server.
+func (s *Server) Dialer(opts ...socks4.DialerOption) *socks4.Dialer {
+	return socks4.NewDialer(s.Addr, opts...)
+}
+
+// WaitSessions waits up to timeout until the server has n sessions, and
+// fails the test otherwise.
+func (s *Server) WaitSessions(tb testing.TB, n int, timeout time.Duration) {
+	tb.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		got := len(s.Sessions())
+		if got == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			tb.Fatalf("socks4test: %v sessions after %v, want %v", got, timeout, n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// LogEntry is a log entry of a server.
+type LogEntry struct {
+	Level   string // "debug", "info", "warning" or "error".
+	Message string
+}
+
+// Logs is a socks4.Logger keeping the log entries in memory.
+type Logs struct {
+	mu      sync.Mutex
+	entries []LogEntry
+}
+
+func (l *Logs) add(level string, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, LogEntry{Level: level, Message: msg})
+}
+
+func (l *Logs) Debug(args ...any)                 { l.add("debug", fmt.Sprint(args...)) }
+func (l *Logs) Debugf(format string, args ...any) { l.add("debug", fmt.Sprintf(format, args...)) }
+func (l *Logs) Info(args ...any)                  { l.add("info", fmt.Sprint(args...)) }
+func (l *Logs) Infof(format string, args ...any)  { l.add("info", fmt.Sprintf(format, args...)) }
+func (l *Logs) Warn(args ...any)                  { l.add("warning", fmt.Sprint(args...)) }
+func (l *Logs) Warnf(format string, args ...any)  { l.add("warning", fmt.Sprintf(format, args...)) }
+func (l *Logs) Error(args ...any)                 { l.add("error", fmt.Sprint(args...)) }
+func (l *Logs) Errorf(format string, args ...any) { l.add("error", fmt.Sprintf(format, args...)) }
+
+// Entries returns the log entries so far.
+func (l *Logs) Entries() []LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]LogEntry(nil), l.entries...)
+}
+
+// Contains reports whether a log entry contains substr.
+func (l *Logs) Contains(substr string) bool {
+	for _, e := range l.Entries() {
+		if strings.Contains(e.Message, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// AssertLogged fails the test if no log entry of the server contains
+// substr.
+func AssertLogged(tb testing.TB, logs *Logs, substr string) {
+	tb.Helper()
+	if !logs.Contains(substr) {
+		var b strings.Builder
+		for _, e := range logs.Entries() {
+			fmt.Fprintf(&b, "\n\t%v: %v", e.Level, e.Message)
+		}
+		tb.Errorf("socks4test: no log entry contains %q, got:%v", substr, b.String())
+	}
+}
+
+// AssertEcho writes payload to conn, connected to an echo target, and
+// fails the test unless the same bytes are read back within 5 seconds.
+func AssertEcho(tb testing.TB, conn net.Conn, payload []byte) {
+	tb.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	if _, err := conn.Write(payload); err != nil {
+		tb.Fatalf("socks4test: write: %v", err)
+	}
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		tb.Fatalf("socks4test: read echo: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		tb.Fatalf("socks4test: echo is %q, want %q", got, payload)
+	}
+}
+
+// AssertRejected fails the test unless err is the error of a dial
+// rejected by the server, with the code if it is not 0, e.g.
+// socks4.RejectOrFailure.
+func AssertRejected(tb testing.TB, err error, code byte) {
+	tb.Helper()
+	var rejErr *socks4.RejectError
+	switch {
+	case err == nil:
+		tb.Fatal("socks4test: dial succeeded, want a rejection")
+	case !errors.As(err, &rejErr):
+		tb.Fatalf("socks4test: dial error is %v, want a rejection", err)
+	case code != 0 && rejErr.Code != code:
+		tb.Fatalf("socks4test: rejected with code %#x, want %#x", rejErr.Code, code)
+	}
+}
@@ -0,0 +1,175 @@
+package socks4test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cccxg/socks4"
+)
+
+// recordingTB records the failures of the assertions, ending the
+// goroutine on the fatal ones like testing.T.
+type recordingTB struct {
+	testing.TB
+	failures []string
+	fatal    bool
+}
+
+func (tb *recordingTB) Helper() {}
+
+func (tb *recordingTB) Errorf(format string, args ...any) {
+	tb.failures = append(tb.failures, fmt.Sprintf(format, args...))
+}
+
+func (tb *recordingTB) Fatal(args ...any) {
+	tb.failures = append(tb.failures, fmt.Sprint(args...))
+	tb.fatal = true
+	runtime.Goexit()
+}
+
+func (tb *recordingTB) Fatalf(format string, args ...any) {
+	tb.failures = append(tb.failures, fmt.Sprintf(format, args...))
+	tb.fatal = true
+	runtime.Goexit()
+}
+
+// assert runs the assertion with a recordingTB in its own goroutine, for
+// the fatal failures to end it.
+func assert(f func(tb testing.TB)) *recordingTB {
+	tb := &recordingTB{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f(tb)
+	}()
+	<-done
+	return tb
+}
+
+func TestServerEcho(t *testing.T) {
+	srv := NewServer(t)
+	echo := NewEchoTarget(t)
+	conn, err := srv.Dialer(socks4.WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	AssertEcho(t, conn, []byte("hello"))
+	srv.WaitSessions(t, 1, 5*time.Second)
+	if echo.Accepted() != 1 || echo.Received() != 5 {
+		t.Errorf("echo target accepted %v connections and received %v bytes, want 1 and 5", echo.Accepted(), echo.Received())
+	}
+	AssertLogged(t, srv.Logs, "established")
+}
+
+func TestDiscardTarget(t *testing.T) {
+	srv := NewServer(t)
+	discard := NewDiscardTarget(t)
+	conn, err := srv.Dialer(socks4.WithDialerTimeout(5*time.Second)).Dial("tcp", discard.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("hello"))
+	conn.Close()
+	for deadline := time.Now().Add(5 * time.Second); discard.Received() != 5; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("discard target received %v bytes, want 5", discard.Received())
+		}
+	}
+	// the session ends once both ends are closed.
+	discard.Close()
+	srv.WaitSessions(t, 0, 5*time.Second)
+}
+
+func TestServerLogger(t *testing.T) {
+	other := &Logs{}
+	srv := NewServer(t, socks4.WithLogger(other))
+	echo := NewEchoTarget(t)
+	conn, err := srv.Dialer(socks4.WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	AssertEcho(t, conn, []byte("hello"))
+	if len(srv.Logs.Entries()) != 0 || !other.Contains("established") {
+		t.Errorf("logged %v, want the entries in the logger of the options", srv.Logs.Entries())
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	rules, err := socks4.ParseRules(strings.NewReader("deny"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	denying := NewServer(t, socks4.WithRules(rules))
+	_, rejected := denying.Dialer(socks4.WithDialerTimeout(5*time.Second)).Dial("tcp", "127.0.0.1:80")
+	logs := &Logs{}
+	logs.Infof("proxy conn for client %v established", "127.0.0.1:1234")
+	logs.Warn("idle")
+
+	for _, tt := range []struct {
+		name    string
+		assert  func(tb testing.TB)
+		failure string // in the failure, none if empty.
+		fatal   bool
+	}{
+		{name: "logged", assert: func(tb testing.TB) { AssertLogged(tb, logs, "established") }},
+		{name: "not logged", assert: func(tb testing.TB) { AssertLogged(tb, logs, "closed") }, failure: "got:\n\tinfo: proxy conn for client 127.0.0.1:1234 established\n\twarning: idle"},
+		{name: "rejected", assert: func(tb testing.TB) { AssertRejected(tb, rejected, socks4.RejectOrFailure) }},
+		{name: "rejected with any code", assert: func(tb testing.TB) { AssertRejected(tb, rejected, 0) }},
+		{name: "rejected with another code", assert: func(tb testing.TB) { AssertRejected(tb, rejected, socks4.RejectWrongUserId) }, failure: "code 0x5b, want 0x5d", fatal: true},
+		{name: "not rejected", assert: func(tb testing.TB) { AssertRejected(tb, nil, 0) }, failure: "want a rejection", fatal: true},
+		{name: "other error", assert: func(tb testing.TB) { AssertRejected(tb, errors.New("refused"), 0) }, failure: "error is refused", fatal: true},
+		{name: "sessions", assert: func(tb testing.TB) { denying.WaitSessions(tb, 0, time.Second) }},
+		{name: "sessions timeout", assert: func(tb testing.TB) { denying.WaitSessions(tb, 1, 50*time.Millisecond) }, failure: "0 sessions after 50ms, want 1", fatal: true},
+	} {
+		tb := assert(tt.assert)
+		if tt.failure == "" {
+			if len(tb.failures) != 0 {
+				t.Errorf("%v: failed with %q", tt.name, tb.failures)
+			}
+			continue
+		}
+		if len(tb.failures) != 1 || !strings.Contains(tb.failures[0], tt.failure) || tb.fatal != tt.fatal {
+			t.Errorf("%v: failed with %q (fatal %v), want %q (fatal %v)", tt.name, tb.failures, tb.fatal, tt.failure, tt.fatal)
+		}
+	}
+}
+
+func TestAssertEcho(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		target  func(conn net.Conn)
+		failure string
+	}{
+		{name: "echoed", target: func(conn net.Conn) {
+			b := make([]byte, 5)
+			conn.Read(b)
+			conn.Write(b)
+		}},
+		{name: "other bytes", target: func(conn net.Conn) {
+			b := make([]byte, 5)
+			conn.Read(b)
+			conn.Write([]byte("world"))
+		}, failure: `echo is "world", want "hello"`},
+		{name: "closed", target: func(conn net.Conn) {
+			b := make([]byte, 5)
+			conn.Read(b)
+			conn.Close()
+		}, failure: "read echo"},
+	} {
+		client, server := net.Pipe()
+		go tt.target(server)
+		tb := assert(func(tb testing.TB) { AssertEcho(tb, client, []byte("hello")) })
+		client.Close()
+		server.Close()
+		if tt.failure == "" && len(tb.failures) != 0 || tt.failure != "" && (len(tb.failures) != 1 || !strings.Contains(tb.failures[0], tt.failure)) {
+			t.Errorf("%v: failed with %q, want %q", tt.name, tb.failures, tt.failure)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package socks4test
+
+import (
+	"testing"
+
+	"github.com/cccxg/socks4/testutil"
+)
+
+// Target is a fake destination on an ephemeral port of 127.0.0.1. It is
+// closed at the end of the test.
+type Target struct {
+	Addr string // address of the listener, like 127.0.0.1:41234.
+
+	srv *testutil.Server
+}
+
+// NewEchoTarget starts a target writing back the bytes it receives.
+func NewEchoTarget(tb testing.TB) *Target {
+	tb.Helper()
+	return newTarget(tb, testutil.NewEchoServer)
+}
+
+// NewDiscardTarget starts a target reading and discarding the bytes it
+// receives.
+func NewDiscardTarget(tb testing.TB) *Target {
+	tb.Helper()
+	return newTarget(tb, testutil.NewSinkServer)
+}
+
+func newTarget(tb testing.TB, start func(addr string) (*testutil.Server, error)) *Target {
+	tb.Helper()
+	srv, err := start("127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("socks4test: listen: %v", err)
+	}
+	t := &Target{Addr: srv.Addr, srv: srv}
+	tb.Cleanup(t.Close)
+	return t
+}
+
+// Received returns the number of bytes received by the target.
+func (t *Target) Received() int64 {
+	return t.srv.Received()
+}
+
+// Accepted returns the number of connections accepted by the target.
+func (t *Target) Accepted() int64 {
+	return t.srv.Accepted()
+}
+
+// Close closes the listener and the connections of the target.
+func (t *Target) Close() {
+	t.srv.Close()
+}
@@ -0,0 +1,230 @@
+package socks4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	Version5 byte = 0x05
+
+	// SOCKS 5 authentication methods.
+	methodNoAuth       byte = 0x00
+	methodUserPass     byte = 0x02
+	methodNoAcceptable byte = 0xff
+
+	// SOCKS 5 address types.
+	atypIPv4   byte = 0x01
+	atypDomain byte = 0x03
+	atypIPv6   byte = 0x04
+
+	// SOCKS 5 reply codes.
+	rep5Succeeded        byte = 0x00
+	rep5Failure          byte = 0x01
+	rep5NotAllowed       byte = 0x02
+	rep5NetUnreachable   byte = 0x03
+	rep5HostUnreachable  byte = 0x04
+	rep5ConnRefused      byte = 0x05
+	rep5CmdNotSupported  byte = 0x07
+	rep5AddrNotSupported byte = 0x08
+)
+
+// PasswordAuth checks the username and password of a client.
+type PasswordAuth func(username, password string) bool
+
+// WithSocks5 makes the server also serve SOCKS 5 clients (RFC 1928) on its
+// listeners, told apart by the version of their first message. CONNECT
+// and BIND are supported. If auth is not nil, clients authenticate with a
+// username and password (RFC 1929) checked by auth, and the username is
+// the user id of the request for the rules and logs; otherwise they are
+// not authenticated.
+func WithSocks5(auth PasswordAuth) OptionFunc {
+	return func(s *Server) {
+		s.socks5 = true
+		s.socks5Auth = auth
+	}
+}
+
+// socks5Handshake negotiates the authentication method and reads the
+// request of a SOCKS 5 client. first holds the bytes of the client already
+// read.
+func (s *Server) socks5Handshake(conn net.Conn, first []byte) (Request, error) {
+	r := io.MultiReader(bytes.NewReader(first), conn)
+	b := make([]byte, 4)
+
+	// greeting: VER NMETHODS METHODS
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return Request{}, fmt.Errorf("failed to read SOCKS 5 greeting: %v", err)
+	}
+	methods := make([]byte, int(b[1]))
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return Request{}, fmt.Errorf("failed to read SOCKS 5 greeting: %v", err)
+	}
+	method := methodNoAuth
+	if s.socks5Auth != nil {
+		method = methodUserPass
+	}
+	if bytes.IndexByte(methods, method) < 0 {
+		conn.Write([]byte{Version5, methodNoAcceptable})
+		return Request{}, fmt.Errorf("no acceptable SOCKS 5 method in %v", methods)
+	}
+	if _, err := conn.Write([]byte{Version5, method}); err != nil {
+		return Request{}, fmt.Errorf("failed to reply to client: %v", err)
+	}
+
+	var username string
+	if method == methodUserPass {
+		var err error
+		if username, err = s.socks5Authenticate(conn, r); err != nil {
+			return Request{}, err
+		}
+	}
+
+	// request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	if _, err := io.ReadFull(r, b[:4]); err != nil {
+		return Request{}, fmt.Errorf("failed to read SOCKS 5 request: %v", err)
+	}
+	req := Request{Version: Version5, Cmd: b[1], UserId: username}
+	if b[0] != Version5 {
+		return req, errors.New("invalid SOCKS 5 request VER")
+	}
+	var host string
+	switch atyp := b[3]; atyp {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp == atypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return req, fmt.Errorf("failed to read SOCKS 5 request: %v", err)
+		}
+		host = ip.String()
+	case atypDomain:
+		if _, err := io.ReadFull(r, b[:1]); err != nil {
+			return req, fmt.Errorf("failed to read SOCKS 5 request: %v", err)
+		}
+		domain := make([]byte, int(b[0]))
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return req, fmt.Errorf("failed to read SOCKS 5 request: %v", err)
+		}
+		host = string(domain)
+	default:
+		writeSocks5Reply(conn, rep5AddrNotSupported, nil)
+		return req, fmt.Errorf("unsupported SOCKS 5 address type %v", atyp)
+	}
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return req, fmt.Errorf("failed to read SOCKS 5 request: %v", err)
+	}
+	req.Port = int(binary.BigEndian.Uint16(b[:2]))
+	req.Address = net.JoinHostPort(host, strconv.Itoa(req.Port))
+
+	if req.Cmd != CmdConnect && req.Cmd != CmdBind && req.Cmd != CmdReverse {
+		writeSocks5Reply(conn, rep5CmdNotSupported, nil)
+		return req, fmt.Errorf("unsupported SOCKS 5 command %v", req.Cmd)
+	}
+	s.log(LogHandshake).Debugf("read SOCKS 5 request from client %v: %v", conn.RemoteAddr(), req)
+	return req, nil
+}
+
+// socks5Authenticate reads the username/password of the client and checks
+// them, returning the username.
+func (s *Server) socks5Authenticate(conn net.Conn, r io.Reader) (string, error) {
+	// VER ULEN UNAME PLEN PASSWD
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return "", fmt.Errorf("failed to read SOCKS 5 credentials: %v", err)
+	}
+	if b[0] != 0x01 {
+		return "", errors.New("invalid SOCKS 5 credentials version")
+	}
+	username := make([]byte, b[1])
+	if _, err := io.ReadFull(r, username); err != nil {
+		return "", fmt.Errorf("failed to read SOCKS 5 credentials: %v", err)
+	}
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return "", fmt.Errorf("failed to read SOCKS 5 credentials: %v", err)
+	}
+	password := make([]byte, int(b[0]))
+	if _, err := io.ReadFull(r, password); err != nil {
+		return "", fmt.Errorf("failed to read SOCKS 5 credentials: %v", err)
+	}
+
+	if !s.socks5Auth(string(username), string(password)) {
+		conn.Write([]byte{0x01, 0x01})
+		// the username is not logged, as it may be a mistyped password.
+		return "", errors.New("SOCKS 5 authentication failed")
+	}
+	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+		return "", fmt.Errorf("failed to reply to client: %v", err)
+	}
+	return string(username), nil
+}
+
+// socks5Replier writes SOCKS 5 replies.
+type socks5Replier struct{}
+
+func (socks5Replier) granted(conn net.Conn, bound net.Addr) error {
+	return writeSocks5Reply(conn, rep5Succeeded, bound)
+}
+
+func (socks5Replier) rejected(conn net.Conn, err error) error {
+	return writeSocks5Reply(conn, socks5ReplyCode(err), nil)
+}
+
+// socks5ReplyCode returns the reply code telling the client why its
+// request failed by err.
+func socks5ReplyCode(err error) byte {
+	var dnsErr *net.DNSError
+	var upErr *UpstreamError
+	var chErr *ssh.OpenChannelError
+	switch {
+	case errors.Is(err, errDenied):
+		return rep5NotAllowed
+	case errors.As(err, &upErr):
+		return upErr.Code
+	case errors.As(err, &chErr):
+		if chErr.Reason == ssh.Prohibited {
+			return rep5NotAllowed
+		}
+		return rep5ConnRefused
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return rep5ConnRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return rep5NetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return rep5HostUnreachable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return rep5HostUnreachable
+	}
+	return rep5Failure
+}
+
+// writeSocks5Reply writes a reply with the bound address, 0.0.0.0:0 if
+// nil.
+func writeSocks5Reply(conn net.Conn, code byte, bound net.Addr) error {
+	ip, port := net.IPv4zero, 0
+	if addr, ok := bound.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+	b := []byte{Version5, code, 0}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, atypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, atypIPv6)
+		b = append(b, ip.To16()...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+	_, err := conn.Write(b)
+	return err
+}
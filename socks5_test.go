@@ -0,0 +1,101 @@
+package socks4
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newTestServer returns a server of the options logging nothing.
+func newTestServer(opts ...OptionFunc) *Server {
+	return NewServer(append([]OptionFunc{WithLogger(&logrus.Logger{Out: io.Discard, Formatter: &logrus.TextFormatter{}})}, opts...)...)
+}
+
+// bufConn is a connection reading from r, then EOF, and writing to w.
+type bufConn struct {
+	net.Conn
+	r io.Reader
+	w bytes.Buffer
+}
+
+func (c *bufConn) Read(b []byte) (int, error)      { return c.r.Read(b) }
+func (c *bufConn) Write(b []byte) (int, error)     { return c.w.Write(b) }
+func (c *bufConn) RemoteAddr() net.Addr            { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1} }
+func (c *bufConn) SetReadDeadline(time.Time) error { return nil }
+
+// socks5Exchange runs the SOCKS 5 handshake of the server with a client
+// sending in, and returns the request read and the replies of the server.
+func socks5Exchange(s *Server, in []byte) (Request, []byte, error) {
+	conn := &bufConn{r: bytes.NewReader(in)}
+	req, err := s.socks5Handshake(conn, nil)
+	return req, conn.w.Bytes(), err
+}
+
+func TestSocks5HandshakeMaxLengths(t *testing.T) {
+	domain := strings.Repeat("a", 255)
+	request := append([]byte{Version5, CmdConnect, 0, atypDomain, 255}, domain...)
+	request = append(request, 0, 80)
+
+	// 255 methods, the last one acceptable.
+	greeting := append([]byte{Version5, 255}, bytes.Repeat([]byte{0x80}, 254)...)
+	greeting = append(greeting, methodNoAuth)
+	s := newTestServer(WithSocks5(nil))
+	req, replies, err := socks5Exchange(s, append(greeting, request...))
+	if err != nil {
+		t.Fatalf("handshake with 255 methods and a 255-byte domain: %v", err)
+	}
+	if want := net.JoinHostPort(domain, "80"); req.Address != want {
+		t.Errorf("address %q, want %q", req.Address, want)
+	}
+	if !bytes.Equal(replies, []byte{Version5, methodNoAuth}) {
+		t.Errorf("replies %v, want the no authentication method", replies)
+	}
+
+	// 255-byte username and password.
+	user, password := strings.Repeat("u", 255), strings.Repeat("p", 255)
+	s = newTestServer(WithSocks5(func(u, p string) bool { return u == user && p == password }))
+	auth := append([]byte{0x01, 255}, user...)
+	auth = append(append(auth, 255), password...)
+	in := append(append([]byte{Version5, 1, methodUserPass}, auth...), request...)
+	req, replies, err = socks5Exchange(s, in)
+	if err != nil {
+		t.Fatalf("handshake with 255-byte credentials: %v", err)
+	}
+	if req.UserId != user {
+		t.Errorf("user id %q, want the username", req.UserId)
+	}
+	if !bytes.Equal(replies, []byte{Version5, methodUserPass, 0x01, 0x00}) {
+		t.Errorf("replies %v, want the authentication succeeded", replies)
+	}
+}
+
+func TestSocks5HandshakeTruncated(t *testing.T) {
+	s := newTestServer(WithSocks5(nil))
+	for _, in := range [][]byte{
+		{Version5, 0xff},
+		{Version5, 0xfe, 0x00},
+		{Version5, 1, methodNoAuth, Version5, CmdConnect, 0, atypDomain, 0xff, 'a'},
+	} {
+		if _, _, err := socks5Exchange(s, in); err == nil {
+			t.Errorf("handshake of truncated %v succeeded", in)
+		}
+	}
+}
+
+func TestSocks5AuthIndependentOfHTTP(t *testing.T) {
+	auth := func(u, p string) bool { return true }
+	s := newTestServer(WithSocks5(auth), WithHTTPConnect(nil))
+	greeting := []byte{Version5, 1, methodNoAuth}
+	if _, replies, err := socks5Exchange(s, greeting); err == nil || !bytes.Equal(replies, []byte{Version5, methodNoAcceptable}) {
+		t.Errorf("SOCKS 5 client without authentication accepted, replies %v: %v", replies, err)
+	}
+	s = newTestServer(WithHTTPConnect(auth), WithSocks5(nil))
+	if s.httpAuth == nil {
+		t.Error("HTTP authentication disabled by WithSocks5(nil)")
+	}
+}
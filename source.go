@@ -0,0 +1,77 @@
+package socks4
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"syscall"
+)
+
+// WithSourceIP makes the server connect to the destinations from the local
+// ip, e.g. to egress by one of several addresses of the host.
+func WithSourceIP(ip net.IP) OptionFunc {
+	return func(s *Server) {
+		s.sourceIP = ip
+	}
+}
+
+// WithSourcePorts makes the server connect to the destinations from local
+// ports in the range min-max, for the firewalls allowing only those. The
+// ports in use are skipped.
+func WithSourcePorts(min, max int) OptionFunc {
+	return func(s *Server) {
+		s.sourcePorts = portRange{min: min, max: max}
+	}
+}
+
+// maxSourcePortAttempts is the max number of ports of the source range
+// tried by a dial.
+const maxSourcePortAttempts = 32
+
+// portRange is a range of ports, unset if max is 0.
+type portRange struct {
+	min, max int
+}
+
+// dialFrom dials the address from the source IP and ports of the network,
+// trying other ports of the range while they are in use.
+func (n systemNetwork) dialFrom(d net.Dialer, network, address string) (net.Conn, error) {
+	if n.ports.max == 0 {
+		if n.source != nil {
+			d.LocalAddr = &net.TCPAddr{IP: n.source}
+		}
+		return d.Dial(network, address)
+	}
+
+	size := n.ports.max - n.ports.min + 1
+	attempts := size
+	if attempts > maxSourcePortAttempts {
+		attempts = maxSourcePortAttempts
+	}
+	first := rand.Intn(size)
+	var err error
+	for i := 0; i < attempts; i++ {
+		port := n.ports.min + (first+i)%size
+		d.LocalAddr = &net.TCPAddr{IP: n.source, Port: port}
+		var conn net.Conn
+		if conn, err = d.Dial(network, address); err == nil {
+			return conn, nil
+		}
+		if !portInUse(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("no free source port in %v-%v: %v", n.ports.min, n.ports.max, err)
+}
+
+// portInUse reports whether a dial failed by err because its source port
+// is in use, to the same destination for EADDRNOTAVAIL of connect.
+func portInUse(err error) bool {
+	if errors.Is(err, syscall.EADDRINUSE) {
+		return true
+	}
+	var scErr *os.SyscallError
+	return errors.As(err, &scErr) && scErr.Syscall == "connect" && errors.Is(err, syscall.EADDRNOTAVAIL)
+}
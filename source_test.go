@@ -0,0 +1,110 @@
+package socks4
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestPortInUse(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		err   error
+		inUse bool
+	}{
+		{name: "address in use", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}, inUse: true},
+		{name: "connection in use", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EADDRNOTAVAIL)}, inUse: true},
+		{name: "source address not available", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("bind", syscall.EADDRNOTAVAIL)}},
+		{name: "refused", err: &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}},
+		{name: "other", err: errors.New("no route")},
+	} {
+		if inUse := portInUse(tt.err); inUse != tt.inUse {
+			t.Errorf("%v: port in use %v, want %v", tt.name, inUse, tt.inUse)
+		}
+	}
+}
+
+// freePort returns a local port free when it returns.
+func freePort(t *testing.T) int {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().(*net.TCPAddr).Port
+}
+
+func TestDialFrom(t *testing.T) {
+	echo := echoTarget(t)
+	// a port in use by a listener of the source IP. The ports after it may
+	// be bound by the connections of other tests, so that the one skipping
+	// it has a range of them.
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+	usedPort := used.Addr().(*net.TCPAddr).Port
+	free := freePort(t)
+
+	for _, tt := range []struct {
+		name    string
+		network systemNetwork
+		port    int    // of the local address, any if 0.
+		after   bool   // the local port is after port instead, in the range.
+		err     string // in the error, none if empty.
+	}{
+		{name: "any source"},
+		{name: "source IP", network: systemNetwork{source: net.IPv4(127, 0, 0, 1)}},
+		{name: "source port", network: systemNetwork{source: net.IPv4(127, 0, 0, 1), ports: portRange{min: free, max: free}}, port: free},
+		{name: "source port in use", network: systemNetwork{source: net.IPv4(127, 0, 0, 1), ports: portRange{min: usedPort, max: usedPort}}, err: "no free source port"},
+		{name: "source port skipping the port in use", network: systemNetwork{source: net.IPv4(127, 0, 0, 1), ports: portRange{min: usedPort, max: usedPort + 10}}, port: usedPort, after: true},
+		{name: "unavailable source IP", network: systemNetwork{source: net.ParseIP("192.0.2.1")}, err: "bind"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := tt.network.Dial("tcp", echo.Addr, 5*time.Second)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			local := conn.LocalAddr().(*net.TCPAddr)
+			if tt.network.source != nil && !local.IP.Equal(tt.network.source) {
+				t.Errorf("dialed from %v, want %v", local, tt.network.source)
+			}
+			if tt.after && (local.Port <= tt.port || local.Port > tt.network.ports.max) {
+				t.Errorf("dialed from port %v, want one in %v-%v", local.Port, tt.port+1, tt.network.ports.max)
+			} else if !tt.after && tt.port != 0 && local.Port != tt.port {
+				t.Errorf("dialed from port %v, want %v", local.Port, tt.port)
+			}
+			assertEcho(t, conn, []byte("hello"))
+		})
+	}
+}
+
+func TestWithSourcePorts(t *testing.T) {
+	echo := echoTarget(t)
+	port := freePort(t)
+	_, addr := serve(t, WithSourceIP(net.IPv4(127, 0, 0, 1)), WithSourcePorts(port, port))
+	conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assertEcho(t, conn, []byte("hello"))
+	// the only port of the range is used by the first session.
+	var rej *RejectError
+	if _, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr); !errors.As(err, &rej) {
+		t.Errorf("error %v, want a rejection", err)
+	}
+}
@@ -0,0 +1,101 @@
+package socks4
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// egress connects to destinations in place of a direct dial.
+type egress interface {
+	dial(address string, o origin, s *Server) (net.Conn, error)
+}
+
+// origin is the client of a dial, for the egresses picking a route by it.
+type origin struct {
+	client   string // IP of the client.
+	userId   string
+	resolved []net.IP // addresses of the target resolved for the rules, dialed directly instead of resolving it again.
+	session  uint64   // ID of the session, 0 for none.
+	req      Request  // request of the session.
+}
+
+// WithSSHEgress adds the egress named name, which connects to the
+// destinations through direct-tcpip channels of an SSH connection to the
+// server at address (host:port), e.g. a bastion host. The CONNECT requests
+// allowed by the rules with "via name" go through it. The SSH connection
+// is established on first use and again when it is lost, and is shared by
+// the requests.
+func WithSSHEgress(name, address string, config *ssh.ClientConfig) OptionFunc {
+	return func(s *Server) {
+		if s.egresses == nil {
+			s.egresses = make(map[string]egress)
+		}
+		s.egresses[name] = &sshEgress{address: address, config: config}
+	}
+}
+
+// sshEgress dials destinations through an SSH server.
+type sshEgress struct {
+	address string
+	config  *ssh.ClientConfig
+
+	mu     sync.Mutex
+	client *ssh.Client
+}
+
+func (e *sshEgress) dial(address string, o origin, s *Server) (net.Conn, error) {
+	client, err := e.connect(s)
+	if err != nil {
+		return nil, fmt.Errorf("SSH egress %v: %v", e.address, err)
+	}
+	ctx, cancel := o.context(s)
+	defer cancel()
+	return client.DialContext(ctx, "tcp", address)
+}
+
+// connect returns the SSH client, connecting to the server if there is no
+// connection.
+func (e *sshEgress) connect(s *Server) (*ssh.Client, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.client != nil {
+		return e.client, nil
+	}
+
+	// the connection is shared by the sessions.
+	conn, err := s.dial("tcp", e.address, origin{})
+	if err != nil {
+		return nil, err
+	}
+	timeout := e.config.Timeout
+	if timeout == 0 {
+		timeout = s.dialTimeout()
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, e.address, e.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	client := ssh.NewClient(c, chans, reqs)
+	s.logger.Infof("SSH egress connected to %v", e.address)
+	e.client = client
+	go func() {
+		err := client.Wait()
+		s.logger.Warnf("SSH egress connection to %v closed: %v", e.address, err)
+		s.reportError("ssh_egress", err, "address", e.address)
+		e.mu.Lock()
+		if e.client == client {
+			e.client = nil
+		}
+		e.mu.Unlock()
+	}()
+	return client, nil
+}
@@ -0,0 +1,197 @@
+package socks4
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeSSH is an SSH server of the password "secret", connecting the
+// direct-tcpip channels to their destinations.
+type fakeSSH struct {
+	addr    string
+	targets chan string // destinations of the channels.
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newFakeSSH(t *testing.T) *fakeSSH {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) != "secret" {
+				return nil, errors.New("wrong password")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSSH{addr: lis.Addr().String(), targets: make(chan string, 10)}
+	t.Cleanup(func() {
+		lis.Close()
+		f.disconnect()
+	})
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			go f.serve(conn, config)
+		}
+	}()
+	return f
+}
+
+func (f *fakeSSH) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		var payload struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if nc.ChannelType() != "direct-tcpip" || ssh.Unmarshal(nc.ExtraData(), &payload) != nil {
+			nc.Reject(ssh.UnknownChannelType, "unsupported channel")
+			continue
+		}
+		target := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+		f.targets <- target
+		remote, err := net.Dial("tcp", target)
+		if err != nil {
+			nc.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		ch, chReqs, err := nc.Accept()
+		if err != nil {
+			remote.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chReqs)
+		go func() {
+			defer ch.Close()
+			defer remote.Close()
+			go io.Copy(remote, ch)
+			io.Copy(ch, remote)
+		}()
+	}
+}
+
+// disconnect closes the SSH connections.
+func (f *fakeSSH) disconnect() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+}
+
+func TestSSHEgress(t *testing.T) {
+	bastion := newFakeSSH(t)
+	for _, tt := range []struct {
+		name     string
+		rules    string
+		password string
+		via      bool // the request goes through the SSH server.
+		code     byte // of the rejection, 0 if granted.
+	}{
+		{name: "via the egress", rules: "allow via bastion", password: "secret", via: true},
+		{name: "direct", rules: "allow port 1-1023 via bastion\nallow", password: "secret"},
+		{name: "wrong password", rules: "allow via bastion", password: "wrong", code: RejectOrFailure},
+		{name: "unknown egress", rules: "allow via jump", password: "secret", code: RejectOrFailure},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			echo := echoTarget(t)
+			rules, err := ParseRules(strings.NewReader(tt.rules))
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := &ssh.ClientConfig{User: "socks4", Auth: []ssh.AuthMethod{ssh.Password(tt.password)}, HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+			_, addr := serve(t, WithRules(rules), WithSSHEgress("bastion", bastion.addr, config))
+			conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+			if tt.code != 0 {
+				var rej *RejectError
+				if !errors.As(err, &rej) || rej.Code != tt.code {
+					t.Fatalf("error %v, want the code %#x", err, tt.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			assertEcho(t, conn, []byte("hello"))
+			select {
+			case target := <-bastion.targets:
+				if !tt.via || target != echo.Addr {
+					t.Errorf("SSH channel to %v, want via %v", target, tt.via)
+				}
+			default:
+				if tt.via {
+					t.Error("no SSH channel")
+				}
+			}
+		})
+	}
+}
+
+func TestSSHEgressReconnect(t *testing.T) {
+	bastion := newFakeSSH(t)
+	echo := echoTarget(t)
+	rules, _ := ParseRules(strings.NewReader("allow via bastion"))
+	config := &ssh.ClientConfig{User: "socks4", Auth: []ssh.AuthMethod{ssh.Password("secret")}, HostKeyCallback: ssh.InsecureIgnoreHostKey()}
+	s, addr := serve(t, WithRules(rules), WithSSHEgress("bastion", bastion.addr, config))
+	e := s.egresses["bastion"].(*sshEgress)
+	d := NewDialer(addr, WithDialerTimeout(5*time.Second))
+	for i := 0; i < 2; i++ {
+		conn, err := d.Dial("tcp", echo.Addr)
+		if err != nil {
+			t.Fatalf("request %v: %v", i+1, err)
+		}
+		assertEcho(t, conn, []byte("hello"))
+		conn.Close()
+		<-bastion.targets
+		// the connection to the bastion is lost.
+		bastion.disconnect()
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(time.Millisecond) {
+			e.mu.Lock()
+			lost := e.client == nil
+			e.mu.Unlock()
+			if lost {
+				break
+			}
+		}
+	}
+}
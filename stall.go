@@ -0,0 +1,67 @@
+package socks4
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// WithStallTimeout makes the server detect the directions of the relays
+// whose writes have been blocked for longer than timeout, their readers
+// not reading, so that slow peers do not pile up the buffers of the
+// proxy. The stalls are logged, counted by Stats.Stalled and notified as
+// EventStalled, and their relays closed with close.
+func WithStallTimeout(timeout time.Duration, close bool) OptionFunc {
+	return func(s *Server) {
+		s.config().StallTimeout = timeout
+		s.config().CloseStalled = close
+	}
+}
+
+// Directions of the relays, see Event.Direction.
+const (
+	DirectionClientToRemote = "client_to_remote"
+	DirectionRemoteToClient = "remote_to_client"
+)
+
+// watchStalls reports the writes of the relay blocked longer than timeout,
+// once per write, and closes the connections with close. It returns when
+// done is closed.
+func (s *Server) watchStalls(ss *session, timeout time.Duration, close bool, act *Activity, done <-chan struct{}, client, remote net.Conn) {
+	ticker := s.clock.NewTicker(watchInterval(timeout))
+	defer ticker.Stop()
+
+	dirs := []struct {
+		dir    *direction
+		name   string
+		reader string
+	}{
+		{&act.clientToRemote, DirectionClientToRemote, "remote host"},
+		{&act.remoteToClient, DirectionRemoteToClient, "client"},
+	}
+	reported := make([]int64, len(dirs))
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C():
+			for i, d := range dirs {
+				since := d.dir.blocked.Load()
+				if since == 0 || since == reported[i] || now.Sub(time.Unix(0, since)) < timeout {
+					continue
+				}
+				reported[i] = since
+				stalled := now.Sub(time.Unix(0, since)).Round(time.Second)
+				s.stats.stalled.Add(1)
+				s.log(LogRelay).Warnf("relay of client %v stalled: %v not reading for %v", client.RemoteAddr(), d.reader, stalled)
+				s.notifyStall(ss, remote, d.name, fmt.Errorf("%v not reading for %v", d.reader, stalled))
+				if close {
+					s.log(LogRelay).Infof("close proxy conn for client %v: stalled", client.RemoteAddr())
+					client.Close()
+					remote.Close()
+					return
+				}
+			}
+		}
+	}
+}
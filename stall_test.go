@@ -0,0 +1,101 @@
+package socks4
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestActivityBlocked(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		name                           string
+		clientToRemote, remoteToClient time.Time // start of the blocked writes, none if zero.
+		wantToRemote, wantToClient     time.Duration
+	}{
+		{name: "none"},
+		{name: "to remote", clientToRemote: now.Add(-time.Second), wantToRemote: time.Second},
+		{name: "to client", remoteToClient: now.Add(-time.Minute), wantToClient: time.Minute},
+		{name: "both", clientToRemote: now.Add(-time.Second), remoteToClient: now.Add(-time.Minute), wantToRemote: time.Second, wantToClient: time.Minute},
+	} {
+		act := newActivity(newTestServer().clock)
+		if !tt.clientToRemote.IsZero() {
+			act.clientToRemote.blocked.Store(tt.clientToRemote.UnixNano())
+		}
+		if !tt.remoteToClient.IsZero() {
+			act.remoteToClient.blocked.Store(tt.remoteToClient.UnixNano())
+		}
+		if toRemote, toClient := act.Blocked(now); toRemote != tt.wantToRemote || toClient != tt.wantToClient {
+			t.Errorf("%v: blocked %v and %v, want %v and %v", tt.name, toRemote, toClient, tt.wantToRemote, tt.wantToClient)
+		}
+	}
+}
+
+func TestWatchStalls(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		timeout  time.Duration
+		toClient bool          // the write to the client is blocked, else the one to the remote host.
+		blocked  time.Duration // for how long the write is blocked, 0 if none.
+		close    bool
+		stalled  string // peer not reading of the stall event, none if empty.
+	}{
+		{name: "not blocked", timeout: time.Nanosecond, close: true},
+		{name: "blocked shorter", timeout: time.Hour, blocked: time.Second, close: true},
+		{name: "blocked longer", timeout: 20 * time.Millisecond, blocked: time.Minute, close: true, stalled: "remote host"},
+		{name: "tiny timeout", timeout: time.Nanosecond, blocked: time.Millisecond, close: true, stalled: "remote host"},
+		{name: "client not reading", timeout: 20 * time.Millisecond, toClient: true, blocked: time.Minute, close: true, stalled: "client"},
+		{name: "not closed", timeout: 20 * time.Millisecond, blocked: time.Minute, stalled: "remote host"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			events := make(eventChan, 10)
+			s := newTestServer(WithEventNotifier(events))
+			client, clientPeer := net.Pipe()
+			remote, remotePeer := net.Pipe()
+			defer clientPeer.Close()
+			defer remotePeer.Close()
+			act := newActivity(s.clock)
+			if tt.blocked > 0 {
+				dir := &act.clientToRemote
+				if tt.toClient {
+					dir = &act.remoteToClient
+				}
+				dir.blocked.Store(time.Now().Add(-tt.blocked).UnixNano())
+			}
+			done := make(chan struct{})
+			watched := make(chan struct{})
+			go func() {
+				s.watchStalls(&session{client: client}, tt.timeout, tt.close, act, done, client, remote)
+				close(watched)
+			}()
+			select {
+			case <-watched:
+			case <-time.After(100 * time.Millisecond):
+				close(done)
+				<-watched
+			}
+			// once per blocked write.
+			stalled := tt.stalled != ""
+			if n := s.Stats().Stalled; (n == 1) != stalled || n > 1 {
+				t.Errorf("%v stalls, want stalled %v", n, stalled)
+			}
+			if stalled {
+				ev := <-events
+				dir := DirectionClientToRemote
+				if tt.toClient {
+					dir = DirectionRemoteToClient
+				}
+				if ev.Type != EventStalled || ev.Direction != dir || !strings.HasPrefix(ev.Error, tt.stalled+" not reading for ") {
+					t.Errorf("event %+v, want the stall of %v, the %v not reading", ev, dir, tt.stalled)
+				}
+			}
+			remote.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+			if _, err := remote.Write([]byte("x")); errors.Is(err, io.ErrClosedPipe) != (stalled && tt.close) {
+				t.Errorf("remote connection closed: %v, want %v", err, stalled && tt.close)
+			}
+		})
+	}
+}
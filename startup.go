@@ -0,0 +1,62 @@
+package socks4
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StartupChecks are the checks of the outbound connectivity of the server
+// before it serves any client, see WithStartupChecks.
+type StartupChecks struct {
+	// Dial are the host:port targets connected like CONNECT requests,
+	// through the upstream server if any. "host:port via name" connects
+	// through the egress name.
+	Dial []string
+	// Resolve are the host names looked up with the resolver of the server.
+	Resolve []string
+}
+
+// WithStartupChecks makes Serve and Run check that the server connects to
+// and resolves the targets of checks before accepting any client, and
+// fail with a clear error instead of accepting clients it can't serve.
+// The dials and lookups are limited by the timeout of WithDialTimeout.
+func WithStartupChecks(checks StartupChecks) OptionFunc {
+	return func(s *Server) {
+		s.startup = &checks
+	}
+}
+
+// CheckStartup runs the checks of WithStartupChecks, returning an error
+// listing the failed ones. Once they pass, it returns nil without running
+// them again, so that callers may fail fast before listening.
+func (s *Server) CheckStartup() error {
+	if s.startup == nil {
+		return nil
+	}
+	s.startupMu.Lock()
+	defer s.startupMu.Unlock()
+	if s.checked {
+		return nil
+	}
+	var failed []string
+	for _, host := range s.startup.Resolve {
+		if _, err := s.lookup(host, origin{}); err != nil {
+			failed = append(failed, err.Error())
+		}
+	}
+	for _, target := range s.startup.Dial {
+		address, via, _ := strings.Cut(target, " via ")
+		conn, err := s.dialTarget(strings.TrimSpace(address), strings.TrimSpace(via), origin{})
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("dial %v: %v", target, err))
+			continue
+		}
+		conn.Close()
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("startup checks failed: %v", strings.Join(failed, "; "))
+	}
+	s.checked = true
+	s.logger.Infof("startup checks passed: %v dialed, %v resolved", len(s.startup.Dial), len(s.startup.Resolve))
+	return nil
+}
@@ -0,0 +1,93 @@
+package socks4
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCheckStartup(t *testing.T) {
+	echo := echoTarget(t)
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	pool := WithEgressPool("pool", RoundRobin, PoolMember{SourceIP: net.IPv4(127, 0, 0, 1)})
+	for _, tt := range []struct {
+		name   string
+		checks *StartupChecks // none if nil.
+		err    []string       // in the error, none if empty.
+	}{
+		{name: "none"},
+		{name: "empty", checks: &StartupChecks{}},
+		{name: "resolved", checks: &StartupChecks{Resolve: []string{"echo.example.com"}}},
+		{name: "not resolved", checks: &StartupChecks{Resolve: []string{"missing.example.com"}}, err: []string{"startup checks failed: ", "missing.example.com"}},
+		{name: "dialed", checks: &StartupChecks{Dial: []string{echo.Addr}}},
+		{name: "dialed by name", checks: &StartupChecks{Dial: []string{"echo.example.com:" + echo.Addr[strings.LastIndex(echo.Addr, ":")+1:]}}},
+		{name: "refused", checks: &StartupChecks{Dial: []string{closed.Addr().String()}}, err: []string{"dial " + closed.Addr().String() + ": "}},
+		{name: "via egress", checks: &StartupChecks{Dial: []string{echo.Addr + " via pool"}}},
+		{name: "via unknown egress", checks: &StartupChecks{Dial: []string{echo.Addr + " via other"}}, err: []string{`unknown egress "other"`}},
+		{name: "several failures", checks: &StartupChecks{
+			Dial:    []string{echo.Addr, closed.Addr().String()},
+			Resolve: []string{"missing.example.com", "echo.example.com"},
+		}, err: []string{"resolve missing.example.com: ", "no such host; dial " + closed.Addr().String()}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := []OptionFunc{pool, WithResolver(&mapResolver{addrs: map[string][]string{"echo.example.com": {"127.0.0.1"}}})}
+			if tt.checks != nil {
+				opts = append(opts, WithStartupChecks(*tt.checks))
+			}
+			err := newTestServer(opts...).CheckStartup()
+			if (err != nil) != (len(tt.err) > 0) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+			for _, want := range tt.err {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q, want %q in it", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckStartupOnce(t *testing.T) {
+	resolver := &mapResolver{addrs: map[string][]string{"echo.example.com": {"127.0.0.1"}}}
+	s := newTestServer(WithResolver(resolver), WithStartupChecks(StartupChecks{Resolve: []string{"echo.example.com"}}))
+	for i := 0; i < 2; i++ {
+		if err := s.CheckStartup(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if resolver.lookups != 1 {
+		t.Errorf("%v lookups, want the checks run once", resolver.lookups)
+	}
+
+	// failed checks are run again.
+	resolver = &mapResolver{}
+	s = newTestServer(WithResolver(resolver), WithStartupChecks(StartupChecks{Resolve: []string{"echo.example.com"}}))
+	for i := 0; i < 2; i++ {
+		if err := s.CheckStartup(); err == nil {
+			t.Fatal("checks passed, want the lookup failed")
+		}
+	}
+	if resolver.lookups != 2 {
+		t.Errorf("%v lookups, want the checks run each time", resolver.lookups)
+	}
+}
+
+func TestServeStartupChecks(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(WithResolver(&mapResolver{}), WithStartupChecks(StartupChecks{Resolve: []string{"missing.example.com"}}))
+	defer s.Close()
+	if err := s.Serve(lis); err == nil || !strings.Contains(err.Error(), "missing.example.com") {
+		t.Errorf("served with error %v, want the failed check", err)
+	}
+	if _, err := lis.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("accepted with error %v, want the listener closed", err)
+	}
+}
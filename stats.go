@@ -0,0 +1,210 @@
+package socks4
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Stats is a snapshot of the counters of a server.
+type Stats struct {
+	StartTime           time.Time `json:"start_time"`
+	Accepted            uint64    `json:"accepted"`      // client connections accepted.
+	Refused             uint64    `json:"refused"`       // connections closed at accept by the limits.
+	Active              int       `json:"active"`        // connections being served.
+	Handshakes          int       `json:"handshakes"`    // connections in their handshake, see WithHandshakeLimits.
+	Relays              int       `json:"relays"`        // relays and requests being dialed, see WithMaxRelays.
+	Established         uint64    `json:"established"`   // requests granted.
+	Failed              uint64    `json:"failed"`        // requests rejected, failed or malformed.
+	Tarpitted           uint64    `json:"tarpitted"`     // requests of banned clients held, see WithTarpit.
+	PendingBinds        int       `json:"pending_binds"` // BIND requests waiting for the connections of their remote hosts.
+	AbortedBinds        uint64    `json:"aborted_binds"` // pending BIND requests closed by the shutdown, see WithBindDrain.
+	Stalled             uint64    `json:"stalled"`       // relay writes blocked longer than the stall timeout, see WithStallTimeout.
+	ClientToRemoteBytes uint64    `json:"client_to_remote_bytes"`
+	RemoteToClientBytes uint64    `json:"remote_to_client_bytes"`
+	// Protocols counts the requests read by protocol, see Request.Protocol.
+	Protocols map[string]uint64 `json:"protocols"`
+	// Sniffed counts the relays sniffed by protocol, see WithSniffing.
+	Sniffed map[string]uint64 `json:"sniffed,omitempty"`
+	// Rejections counts the failed requests by reason: "banned",
+	// "maintenance", "denied" (by a rule), "user_id", "limit" (dials in
+	// flight, relays or circuit breaker), "resolve", "dial", "timeout",
+	// "malformed", "closed" (by the client before its request), "fault" or
+	// "other".
+	Rejections map[string]uint64 `json:"rejections,omitempty"`
+	// Rules counts the requests decided by each rule, by rule ID.
+	Rules map[string]RuleStats `json:"rules,omitempty"`
+	// Labeled counts the sessions by label set, see LabelListener.
+	Labeled []LabeledStats `json:"labeled,omitempty"`
+	// HandshakeLatency is the time from the accept of the clients to the
+	// requests read, see WithLatencyBuckets.
+	HandshakeLatency Histogram `json:"handshake_latency"`
+	// DialLatency is the time from the CONNECT requests read to their
+	// destinations connected, for the successful ones.
+	DialLatency Histogram `json:"dial_latency"`
+}
+
+// RuleStats are the counters of a rule.
+type RuleStats struct {
+	Matches uint64 `json:"matches"` // requests decided by the rule.
+	Denied  uint64 `json:"denied"`  // requests rejected and relays closed by the rule.
+}
+
+type stats struct {
+	accepted       atomic.Uint64
+	refused        atomic.Uint64
+	established    atomic.Uint64
+	failed         atomic.Uint64
+	tarpitted      atomic.Uint64
+	abortedBinds   atomic.Uint64
+	stalled        atomic.Uint64
+	clientToRemote atomic.Uint64
+	remoteToClient atomic.Uint64
+	protocols      sync.Map // protocol name to *atomic.Uint64.
+	sniffed        sync.Map // sniffed protocol name to *atomic.Uint64.
+	rejections     sync.Map // rejection reason to *atomic.Uint64.
+	rules          sync.Map // rule ID to *ruleCounters.
+	labeled        labeledStats
+	handshake      *histogram
+	dial           *histogram
+}
+
+// countProtocol counts a request read by its protocol.
+func (st *stats) countProtocol(req Request) {
+	c, ok := st.protocols.Load(req.Protocol())
+	if !ok {
+		c, _ = st.protocols.LoadOrStore(req.Protocol(), new(atomic.Uint64))
+	}
+	c.(*atomic.Uint64).Add(1)
+}
+
+// countRejection counts a failed request by the reason of its error.
+func (st *stats) countRejection(err error) {
+	reason := rejectionReason(err)
+	c, ok := st.rejections.Load(reason)
+	if !ok {
+		c, _ = st.rejections.LoadOrStore(reason, new(atomic.Uint64))
+	}
+	c.(*atomic.Uint64).Add(1)
+}
+
+type ruleCounters struct {
+	matches atomic.Uint64
+	denied  atomic.Uint64
+}
+
+// countRule counts a request decided by the rule.
+func (st *stats) countRule(rule *Rule) {
+	c, ok := st.rules.Load(rule.ID)
+	if !ok {
+		c, _ = st.rules.LoadOrStore(rule.ID, new(ruleCounters))
+	}
+	c.(*ruleCounters).matches.Add(1)
+	if rule.Action == Deny {
+		c.(*ruleCounters).denied.Add(1)
+	}
+}
+
+// rejectionReason returns the reason of the error of a failed request
+// counted by Stats.Rejections.
+func rejectionReason(err error) string {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var upErr *UpstreamError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errBanned):
+		return "banned"
+	case errors.Is(err, errMaintenance):
+		return "maintenance"
+	case errors.Is(err, errDenied), errors.Is(err, errTokenDenied):
+		return "denied"
+	case errors.Is(err, errTooManyUserSessions):
+		return "limit"
+	case errors.Is(err, ErrUserIdRejected), errors.Is(err, ErrIdentdUnreachable):
+		return "user_id"
+	case errors.Is(err, errTooManyDials), errors.Is(err, errCircuitOpen), errors.Is(err, errTooManyRelays):
+		return "limit"
+	case errors.Is(err, errFault):
+		return "fault"
+	case errors.Is(err, ErrNoIPv4), errors.As(err, &dnsErr):
+		return "resolve"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &upErr), errors.As(err, &opErr) && opErr.Op == "dial":
+		return "dial"
+	case errors.Is(err, io.EOF), errors.Is(err, syscall.ECONNRESET):
+		return "closed"
+	case errors.Is(err, ErrRequestTruncated), errors.Is(err, ErrInvalidVersion),
+		errors.Is(err, ErrInvalidCommand), errors.Is(err, ErrFieldTooLong),
+		errors.Is(err, ErrEmptyDomain), errors.Is(err, ErrTrailingData):
+		return "malformed"
+	}
+	return "other"
+}
+
+// Stats returns the current counters of the server.
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	active := len(s.sessions)
+	binds := len(s.binds)
+	s.mu.Unlock()
+
+	protocols := make(map[string]uint64)
+	s.stats.protocols.Range(func(k, v any) bool {
+		protocols[k.(string)] = v.(*atomic.Uint64).Load()
+		return true
+	})
+	var sniffed map[string]uint64
+	s.stats.sniffed.Range(func(k, v any) bool {
+		if sniffed == nil {
+			sniffed = make(map[string]uint64)
+		}
+		sniffed[k.(string)] = v.(*atomic.Uint64).Load()
+		return true
+	})
+	var rejections map[string]uint64
+	s.stats.rejections.Range(func(k, v any) bool {
+		if rejections == nil {
+			rejections = make(map[string]uint64)
+		}
+		rejections[k.(string)] = v.(*atomic.Uint64).Load()
+		return true
+	})
+	var rules map[string]RuleStats
+	s.stats.rules.Range(func(k, v any) bool {
+		if rules == nil {
+			rules = make(map[string]RuleStats)
+		}
+		c := v.(*ruleCounters)
+		rules[k.(string)] = RuleStats{Matches: c.matches.Load(), Denied: c.denied.Load()}
+		return true
+	})
+	return Stats{
+		StartTime:           s.startTime,
+		Accepted:            s.stats.accepted.Load(),
+		Refused:             s.stats.refused.Load(),
+		Active:              active,
+		Handshakes:          int(s.handshakes.Load()),
+		Relays:              int(s.relays.Load()),
+		Established:         s.stats.established.Load(),
+		Failed:              s.stats.failed.Load(),
+		Tarpitted:           s.stats.tarpitted.Load(),
+		PendingBinds:        binds,
+		AbortedBinds:        s.stats.abortedBinds.Load(),
+		Stalled:             s.stats.stalled.Load(),
+		ClientToRemoteBytes: s.stats.clientToRemote.Load(),
+		RemoteToClientBytes: s.stats.remoteToClient.Load(),
+		Protocols:           protocols,
+		Sniffed:             sniffed,
+		Rejections:          rejections,
+		Rules:               rules,
+		Labeled:             s.stats.labeled.snapshot(),
+		HandshakeLatency:    s.stats.handshake.snapshot(),
+		DialLatency:         s.stats.dial.snapshot(),
+	}
+}
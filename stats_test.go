@@ -0,0 +1,92 @@
+package socks4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRejectionReason(t *testing.T) {
+	for _, tt := range []struct {
+		err    error
+		reason string
+	}{
+		{fmt.Errorf("request rejected: %w", errBanned), "banned"},
+		{fmt.Errorf("request to 10.0.0.1:80 rejected: %w", errMaintenance), "maintenance"},
+		{fmt.Errorf("request to 10.0.0.1:80 %w %q", errDenied, "deny"), "denied"},
+		{fmt.Errorf("request to 10.0.0.1:80 rejected: %w", ErrUserIdRejected), "user_id"},
+		{ErrIdentdUnreachable, "user_id"},
+		{fmt.Errorf("request to 10.0.0.1:80 rejected: %w", errTooManyDials), "limit"},
+		{fmt.Errorf("request to 10.0.0.1:80 rejected: %w", errTooManyRelays), "limit"},
+		{fmt.Errorf("%w for 10.0.0.1:80", errCircuitOpen), "limit"},
+		{fmt.Errorf("request to 10.0.0.1:80 rejected: %w", errFault), "fault"},
+		{ErrNoIPv4, "resolve"},
+		{&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}, "resolve"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}, "timeout"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, "dial"},
+		{fmt.Errorf("failed to establish connect for CONNECT request: %w", &UpstreamError{Code: 5}), "dial"},
+		{fmt.Errorf("failed to read from connect: %w", io.EOF), "closed"},
+		{&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, "closed"},
+		{fmt.Errorf("failed to read from connect: %w", ErrRequestTruncated), "malformed"},
+		{ErrInvalidVersion, "malformed"},
+		{ErrInvalidCommand, "malformed"},
+		{ErrFieldTooLong, "malformed"},
+		{ErrEmptyDomain, "malformed"},
+		{ErrTrailingData, "malformed"},
+		{context.Canceled, "other"},
+		{errors.New("unknown"), "other"},
+	} {
+		if reason := rejectionReason(tt.err); reason != tt.reason {
+			t.Errorf("reason of %v: %q, want %q", tt.err, reason, tt.reason)
+		}
+	}
+}
+
+func TestRejections(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader("deny port 80\nallow"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, addr := serve(t, WithRules(rules))
+	if st := s.Stats(); st.Rejections != nil {
+		t.Errorf("rejections %v before any request, want none", st.Rejections)
+	}
+	for _, tt := range []struct {
+		name    string
+		request []byte // sent before closing the connection.
+	}{
+		{name: "denied", request: []byte{4, 1, 0, 80, 127, 0, 0, 1, 0}},
+		{name: "malformed", request: []byte{4, 9, 0, 80, 127, 0, 0, 1, 0}},
+		{name: "closed"},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+		conn.Write(tt.request)
+		if len(tt.request) != 0 {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			io.ReadAll(conn)
+		}
+		conn.Close()
+	}
+
+	want := map[string]uint64{"denied": 1, "malformed": 1, "closed": 1}
+	var rejections map[string]uint64
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if rejections = s.Stats().Rejections; reflect.DeepEqual(rejections, want) {
+			break
+		}
+	}
+	if !reflect.DeepEqual(rejections, want) {
+		t.Errorf("rejections %v, want %v", rejections, want)
+	}
+}
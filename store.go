@@ -0,0 +1,123 @@
+package socks4
+
+import (
+	"sync"
+	"time"
+)
+
+// Store keeps the counters of the limits of the server, like the rate
+// limit. The default MemoryStore is local to the server; a shared store
+// like RedisStore applies the limits across the proxy instances behind a
+// load balancer. A counter expires after its TTL from its creation.
+type Store interface {
+	// Incr adds n to the counter at key, created with the TTL if it does
+	// not exist, and returns its new value.
+	Incr(key string, n int64, ttl time.Duration) (int64, error)
+	// Get returns the value of the counter at key, 0 if it does not exist.
+	Get(key string) (int64, error)
+	// Set sets the counter at key to value, expiring after ttl, or never if
+	// ttl is 0.
+	Set(key string, value int64, ttl time.Duration) error
+	// Delete deletes the counter at key.
+	Delete(key string) error
+}
+
+// WithStore sets the store of the counters of the limits, a MemoryStore by
+// default.
+func WithStore(store Store) OptionFunc {
+	return func(s *Server) {
+		s.store = store
+	}
+}
+
+// minStorePrune is the number of counters of a MemoryStore above which the
+// expired ones are pruned.
+const minStorePrune = 4096
+
+type storeEntry struct {
+	value   int64
+	expires time.Time // zero for no expiry.
+}
+
+func (e *storeEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// MemoryStore is a Store in the memory of the process.
+type MemoryStore struct {
+	mu        sync.Mutex
+	entries   map[string]*storeEntry
+	pruneSize int // size of entries triggering the next pruning.
+}
+
+// NewMemoryStore creates an empty memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		entries:   make(map[string]*storeEntry),
+		pruneSize: minStorePrune,
+	}
+}
+
+func (m *MemoryStore) Incr(key string, n int64, ttl time.Duration) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	e := m.entries[key]
+	if e == nil || e.expired(now) {
+		e = &storeEntry{}
+		if ttl > 0 {
+			e.expires = now.Add(ttl)
+		}
+		m.entries[key] = e
+		m.prune(now)
+	}
+	e.value += n
+	return e.value, nil
+}
+
+func (m *MemoryStore) Get(key string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e := m.entries[key]
+	if e == nil || e.expired(time.Now()) {
+		return 0, nil
+	}
+	return e.value, nil
+}
+
+func (m *MemoryStore) Set(key string, value int64, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	e := &storeEntry{value: value}
+	if ttl > 0 {
+		e.expires = now.Add(ttl)
+	}
+	m.entries[key] = e
+	m.prune(now)
+	return nil
+}
+
+func (m *MemoryStore) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+	return nil
+}
+
+// prune deletes the expired counters once their number has doubled since
+// the last pruning.
+func (m *MemoryStore) prune(now time.Time) {
+	if len(m.entries) < m.pruneSize {
+		return
+	}
+	for key, e := range m.entries {
+		if e.expired(now) {
+			delete(m.entries, key)
+		}
+	}
+	m.pruneSize = 2 * len(m.entries)
+	if m.pruneSize < minStorePrune {
+		m.pruneSize = minStorePrune
+	}
+}
@@ -0,0 +1,100 @@
+package socks4
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// storeOp is an operation on a Store and its expected result.
+type storeOp struct {
+	op    string // incr, get, set, delete or sleep.
+	key   string
+	n     int64
+	ttl   time.Duration
+	value int64 // returned by incr and get.
+}
+
+// testStore runs the operations on the store.
+func testStore(t *testing.T, store Store, ops []storeOp) {
+	t.Helper()
+	for i, op := range ops {
+		var value int64
+		var err error
+		switch op.op {
+		case "incr":
+			value, err = store.Incr(op.key, op.n, op.ttl)
+		case "get":
+			value, err = store.Get(op.key)
+		case "set":
+			err = store.Set(op.key, op.n, op.ttl)
+		case "delete":
+			err = store.Delete(op.key)
+		case "sleep":
+			time.Sleep(op.ttl)
+		}
+		if err != nil || value != op.value {
+			t.Fatalf("operation %v %+v: value %v with error %v, want %v", i, op, value, err, op.value)
+		}
+	}
+}
+
+// storeTests are the operations of the tests of the stores.
+var storeTests = []struct {
+	name string
+	ops  []storeOp
+}{
+	{name: "incr", ops: []storeOp{
+		{op: "incr", key: "a", n: 1, ttl: time.Minute, value: 1},
+		{op: "incr", key: "a", n: 2, ttl: time.Minute, value: 3},
+		{op: "incr", key: "b", n: 5, value: 5},
+		{op: "get", key: "a", value: 3},
+		{op: "get", key: "c"},
+	}},
+	{name: "set and delete", ops: []storeOp{
+		{op: "set", key: "a", n: 7},
+		{op: "get", key: "a", value: 7},
+		{op: "incr", key: "a", n: -2, ttl: time.Minute, value: 5},
+		{op: "delete", key: "a"},
+		{op: "get", key: "a"},
+		{op: "delete", key: "a"},
+	}},
+	{name: "expiry", ops: []storeOp{
+		{op: "incr", key: "a", n: 1, ttl: 50 * time.Millisecond, value: 1},
+		{op: "set", key: "b", n: 1, ttl: 50 * time.Millisecond},
+		{op: "set", key: "c", n: 1},
+		{op: "sleep", ttl: 30 * time.Millisecond},
+		// the TTL runs from the creation of the counter.
+		{op: "incr", key: "a", n: 1, ttl: 50 * time.Millisecond, value: 2},
+		{op: "sleep", ttl: 30 * time.Millisecond},
+		{op: "get", key: "a"},
+		{op: "get", key: "b"},
+		{op: "get", key: "c", value: 1},
+		{op: "incr", key: "a", n: 1, ttl: time.Minute, value: 1},
+	}},
+}
+
+func TestMemoryStore(t *testing.T) {
+	for _, tt := range storeTests {
+		t.Run(tt.name, func(t *testing.T) {
+			testStore(t, NewMemoryStore(), tt.ops)
+		})
+	}
+}
+
+func TestMemoryStorePrune(t *testing.T) {
+	m := NewMemoryStore()
+	for i := 0; i < minStorePrune-1; i++ {
+		m.Incr(strconv.Itoa(i), 1, time.Nanosecond)
+	}
+	m.Set("kept", 1, 0)
+	time.Sleep(time.Millisecond)
+	// the counter over the threshold prunes the expired ones.
+	m.Incr("new", 1, time.Minute)
+	if len(m.entries) != 2 || m.pruneSize != minStorePrune {
+		t.Errorf("%v counters after pruning, next pruning at %v", len(m.entries), m.pruneSize)
+	}
+	if v, _ := m.Get("kept"); v != 1 {
+		t.Errorf("counter without TTL pruned")
+	}
+}
@@ -0,0 +1,95 @@
+package socks4
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// Tarpit slows down the clients abusing the proxy, like port scanners or
+// user id guessers: a client whose requests are rejected or failed
+// Threshold times within Window is banned for Ban, and the requests of
+// banned clients are held for Delay before being rejected, or closed
+// without a reply. The bans are kept in the store of the server, see
+// WithStore.
+type Tarpit struct {
+	Threshold   int           // rejections banning a client, 0 to ban none.
+	Window      time.Duration // window of the rejections counted.
+	Ban         time.Duration // duration of the bans.
+	Delay       time.Duration // time the requests of banned clients are held.
+	Reply       bool          // reject the requests of banned clients after the delay, instead of closing them.
+	RejectDelay time.Duration // delay of every rejection, 0 for none.
+}
+
+// errBanned is the error of the requests of banned clients.
+var errBanned = errors.New("client banned")
+
+// WithTarpit makes the server tarpit the abusing clients.
+func WithTarpit(t Tarpit) OptionFunc {
+	return func(s *Server) {
+		s.tarpit = &t
+	}
+}
+
+// banned reports whether the client of conn is banned.
+func (s *Server) banned(conn net.Conn) bool {
+	if s.tarpit == nil || s.tarpit.Threshold <= 0 {
+		return false
+	}
+	n, err := s.store.Get("ban:" + clientIP(conn))
+	if err != nil {
+		s.log(LogAccept).Warnf("ban of %v: %v", clientIP(conn), err)
+		s.reportError("store", err, "client", clientIP(conn))
+		return false
+	}
+	return n > 0
+}
+
+// countRejection counts a rejected or failed request of the client of conn,
+// banning it once it reaches the threshold.
+func (s *Server) countRejection(conn net.Conn) {
+	if s.tarpit == nil || s.tarpit.Threshold <= 0 {
+		return
+	}
+	ip := clientIP(conn)
+	n, err := s.store.Incr("rejects:"+ip, 1, s.tarpit.Window)
+	if err != nil {
+		s.log(LogAccept).Warnf("rejections of %v: %v", ip, err)
+		s.reportError("store", err, "client", ip)
+		return
+	}
+	if n < int64(s.tarpit.Threshold) {
+		return
+	}
+	if err := s.store.Set("ban:"+ip, 1, s.tarpit.Ban); err != nil {
+		s.log(LogAccept).Warnf("ban of %v: %v", ip, err)
+		s.reportError("store", err, "client", ip)
+		return
+	}
+	// the rejections start over once the ban expires.
+	s.store.Delete("rejects:" + ip)
+	s.log(LogAccept).Warnf("client %v banned for %v after %v rejected requests", ip, s.tarpit.Ban, n)
+}
+
+// hold holds the connection of a banned client for the delay of the
+// tarpit, discarding what it sends, until the delay passes or the
+// connection is closed.
+func (s *Server) hold(conn net.Conn) {
+	s.stats.tarpitted.Add(1)
+	conn.SetReadDeadline(time.Now().Add(s.tarpit.Delay))
+	io.Copy(io.Discard, conn)
+	conn.SetReadDeadline(time.Time{})
+}
+
+// delayedReplier delays the rejections of a replier.
+type delayedReplier struct {
+	replier
+	delay time.Duration
+	clock Clock
+}
+
+func (r delayedReplier) rejected(conn net.Conn, err error) error {
+	r.clock.Sleep(r.delay)
+	return r.replier.rejected(conn, err)
+}
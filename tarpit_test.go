@@ -0,0 +1,137 @@
+package socks4
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTarpitBans(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		tarpit     *Tarpit
+		rejections int
+		banned     bool
+	}{
+		{name: "below the threshold", tarpit: &Tarpit{Threshold: 3, Window: time.Minute, Ban: time.Minute}, rejections: 2},
+		{name: "threshold", tarpit: &Tarpit{Threshold: 3, Window: time.Minute, Ban: time.Minute}, rejections: 3, banned: true},
+		{name: "no threshold", tarpit: &Tarpit{RejectDelay: time.Second}, rejections: 10},
+		{name: "no tarpit", rejections: 10},
+	} {
+		var opts []OptionFunc
+		if tt.tarpit != nil {
+			opts = append(opts, WithTarpit(*tt.tarpit))
+		}
+		s := newTestServer(opts...)
+		for i := 0; i < tt.rejections; i++ {
+			s.countRejection(fromIP("192.0.2.1"))
+		}
+		if banned := s.banned(fromIP("192.0.2.1")); banned != tt.banned {
+			t.Errorf("%v: banned %v, want %v", tt.name, banned, tt.banned)
+		}
+		if s.banned(fromIP("192.0.2.2")) {
+			t.Errorf("%v: other client banned", tt.name)
+		}
+	}
+}
+
+func TestTarpitBanStoreError(t *testing.T) {
+	s := newTestServer(WithTarpit(Tarpit{Threshold: 1, Window: time.Minute, Ban: time.Minute}), WithStore(failingStore{NewMemoryStore()}))
+	s.countRejection(fromIP("192.0.2.1"))
+	if s.banned(fromIP("192.0.2.1")) {
+		t.Error("client banned with a failing store")
+	}
+}
+
+func TestDelayedReplier(t *testing.T) {
+	clock := &sleepClock{}
+	conn := &bufConn{}
+	rep := delayedReplier{replier: socks4Replier{}, delay: 3 * time.Second, clock: clock}
+	if err := rep.rejected(conn, errDenied); err != nil {
+		t.Fatal(err)
+	}
+	if len(clock.sleeps) != 1 || clock.sleeps[0] != 3*time.Second || conn.w.Len() != 8 || conn.w.Bytes()[1] != RejectOrFailure {
+		t.Errorf("replied %x after sleeping %v, want a rejection after 3s", conn.w.Bytes(), clock.sleeps)
+	}
+	// the grants are not delayed.
+	conn.w.Reset()
+	if err := rep.granted(conn, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 80}); err != nil {
+		t.Fatal(err)
+	}
+	if len(clock.sleeps) != 1 || conn.w.Bytes()[1] != Granted {
+		t.Errorf("granted %x after sleeping %v, want no delay", conn.w.Bytes(), clock.sleeps)
+	}
+}
+
+func TestHold(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		closed bool // by the client before the delay.
+	}{
+		{name: "delay"},
+		{name: "closed by the client", closed: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, conn := tcpPair(t)
+			defer conn.Close()
+			s := newTestServer(WithTarpit(Tarpit{Delay: 200 * time.Millisecond}))
+			client.Write([]byte("discarded"))
+			if tt.closed {
+				client.Close()
+			} else {
+				defer client.Close()
+			}
+			start := time.Now()
+			s.hold(conn)
+			if elapsed := time.Since(start); tt.closed != (elapsed < 200*time.Millisecond) {
+				t.Errorf("held for %v, want the delay %v", elapsed, !tt.closed)
+			}
+			if s.Stats().Tarpitted != 1 {
+				t.Errorf("%v tarpitted, want 1", s.Stats().Tarpitted)
+			}
+		})
+	}
+}
+
+func TestTarpit(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		reply bool
+	}{
+		{name: "closed"},
+		{name: "rejected", reply: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			delay := 200 * time.Millisecond
+			s, addr := serve(t, WithRules([]Rule{{Action: Deny}}), WithTarpit(Tarpit{Threshold: 2, Window: time.Minute, Ban: time.Minute, Delay: delay, Reply: tt.reply}))
+			d := NewDialer(addr, WithDialerTimeout(5*time.Second))
+			for i := 0; i < 2; i++ {
+				var rej *RejectError
+				if _, err := d.Dial("tcp", "127.0.0.1:80"); !errors.As(err, &rej) {
+					t.Fatalf("dial %v: error %v, want a rejection", i+1, err)
+				}
+			}
+			// the client is banned: its next request is held.
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			start := time.Now()
+			conn.Write(request(CmdConnect, 80, [4]byte{127, 0, 0, 1}, ""))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			reply, err := io.ReadAll(conn)
+			if elapsed := time.Since(start); elapsed < delay-10*time.Millisecond {
+				t.Errorf("request answered in %v, want held for %v", elapsed, delay)
+			}
+			if tt.reply && (len(reply) != 8 || reply[1] != RejectOrFailure) || !tt.reply && len(reply) != 0 {
+				t.Errorf("replied %x (%v), want a rejection %v", reply, err, tt.reply)
+			}
+			if st := s.Stats(); st.Tarpitted != 1 {
+				t.Errorf("%v tarpitted, want 1", st.Tarpitted)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+// Package testutil provides TCP destinations counting the bytes they
+// relay, to measure the throughput of the proxy: an echo server writing
+// back what it receives and a sink discarding it. Unlike the socks4test
+// package, it does not depend on the testing package and serves programs
+// as well as tests.
+package testutil
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Server is an echo or sink server.
+type Server struct {
+	Addr string // address of the listener, like 127.0.0.1:41234.
+
+	lis      net.Listener
+	handle   func(conn net.Conn)
+	received atomic.Int64
+	sent     atomic.Int64
+	accepted atomic.Int64
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// NewEchoServer starts a server on addr writing back the bytes it receives,
+// e.g. on 127.0.0.1:0 for an ephemeral port.
+func NewEchoServer(addr string) (*Server, error) {
+	s := &Server{}
+	s.handle = func(conn net.Conn) {
+		io.Copy(countingWriter{conn, &s.sent}, countingReader{conn, &s.received})
+	}
+	return s, s.start(addr)
+}
+
+// NewSinkServer starts a server on addr reading and discarding the bytes it
+// receives.
+func NewSinkServer(addr string) (*Server, error) {
+	s := &Server{}
+	s.handle = func(conn net.Conn) {
+		io.Copy(io.Discard, countingReader{conn, &s.received})
+	}
+	return s, s.start(addr)
+}
+
+func (s *Server) start(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.lis = lis
+	s.Addr = lis.Addr().String()
+	s.conns = make(map[net.Conn]struct{})
+	s.wg.Add(1)
+	go s.serve()
+	return nil
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.lis.Accept()
+		if err != nil {
+			return
+		}
+		s.accepted.Add(1)
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			s.handle(conn)
+		}()
+	}
+}
+
+// Received returns the number of bytes received by the server.
+func (s *Server) Received() int64 {
+	return s.received.Load()
+}
+
+// Sent returns the number of bytes written back by the server, always 0
+// for a sink.
+func (s *Server) Sent() int64 {
+	return s.sent.Load()
+}
+
+// Accepted returns the number of connections accepted by the server.
+func (s *Server) Accepted() int64 {
+	return s.accepted.Load()
+}
+
+// Close closes the listener and the connections of the server, and waits
+// until they are done.
+func (s *Server) Close() error {
+	err := s.lis.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+// countingReader counts the bytes read in n.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (r countingReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written in n.
+type countingWriter struct {
+	w io.Writer
+	n *atomic.Int64
+}
+
+func (w countingWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.n.Add(int64(n))
+	return n, err
+}
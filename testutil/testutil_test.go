@@ -0,0 +1,101 @@
+package testutil
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 10000)
+	for _, tt := range []struct {
+		name  string
+		start func(addr string) (*Server, error)
+		echo  bool
+	}{
+		{name: "echo", start: NewEchoServer, echo: true},
+		{name: "sink", start: NewSinkServer},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, err := tt.start("127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer srv.Close()
+			for i := 0; i < 2; i++ {
+				conn, err := net.Dial("tcp", srv.Addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				go func() {
+					conn.Write(payload)
+					conn.(*net.TCPConn).CloseWrite()
+				}()
+				back, err := io.ReadAll(conn)
+				conn.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.echo && !bytes.Equal(back, payload) || !tt.echo && len(back) != 0 {
+					t.Fatalf("read back %v bytes, want echoed %v", len(back), tt.echo)
+				}
+			}
+			sent := int64(0)
+			if tt.echo {
+				sent = 2 * int64(len(payload))
+			}
+			if srv.Accepted() != 2 || srv.Received() != 2*int64(len(payload)) || srv.Sent() != sent {
+				t.Errorf("accepted %v, received %v and sent %v bytes, want 2, %v and %v",
+					srv.Accepted(), srv.Received(), srv.Sent(), 2*len(payload), sent)
+			}
+		})
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	srv, err := NewSinkServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the connection is served once its bytes are received.
+	conn.Write([]byte("hello"))
+	for deadline := time.Now().Add(5 * time.Second); srv.Received() != 5; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("bytes not received")
+		}
+	}
+	closed := make(chan error, 1)
+	go func() { closed <- srv.Close() }()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close blocked by an open connection")
+	}
+	// the open connections are closed too.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("connection open after close")
+	}
+	if _, err := net.Dial("tcp", srv.Addr); err == nil {
+		t.Error("listener open after close")
+	}
+}
+
+func TestServerListenError(t *testing.T) {
+	for _, start := range []func(string) (*Server, error){NewEchoServer, NewSinkServer} {
+		if _, err := start("127.0.0.1:-1"); err == nil {
+			t.Error("server started on an invalid address")
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package socks4
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"time"
+)
+
+// WithTLS makes the server accept SOCKS over TLS: clients complete a TLS
+// handshake with config before sending their request. Client certificates
+// are requested and verified according to config.ClientAuth, and the
+// identity of a verified certificate is matched by the rules (see
+// Rule.Cert) and reported in the logs and sessions.
+func WithTLS(config *tls.Config) OptionFunc {
+	return func(s *Server) {
+		s.tlsConfig = config
+	}
+}
+
+// tlsHandshake wraps the client connection in TLS and completes the
+// handshake within the handshake timeout.
+func (s *Server) tlsHandshake(conn net.Conn) (*tls.Conn, error) {
+	tc := tls.Server(conn, s.tlsConfig)
+	ctx := context.Background()
+	if timeout := s.handshakeTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := tc.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// clientIdentity returns the identity of the verified client certificate
+// of the connection, or "" if it is not a TLS connection or the client
+// presented no certificate.
+func clientIdentity(conn net.Conn) string {
+	if cert := clientCert(conn); cert != nil {
+		return CertIdentity(cert)
+	}
+	return ""
+}
+
+// CertIdentity returns the identity of a client certificate: its subject
+// common name, or else its first DNS name, email address or URI.
+func CertIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// clientCert returns the verified client certificate of conn, nil if none.
+func clientCert(conn net.Conn) *x509.Certificate {
+	tc, ok := conn.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
@@ -0,0 +1,159 @@
+package socks4
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPKI is a CA issuing the certificates of the tests.
+type testPKI struct {
+	pool *x509.CertPool
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "socks4 test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testPKI{pool: pool, cert: cert, key: key}
+}
+
+// issue returns a certificate of the template, for the servers of
+// 127.0.0.1 and the clients.
+func (p *testPKI) issue(t *testing.T, tmpl *x509.Certificate) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	tmpl.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, p.cert, &key.PublicKey, p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertIdentity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.com/web")
+	for _, tt := range []struct {
+		name     string
+		cert     *x509.Certificate
+		identity string
+	}{
+		{name: "common name", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, DNSNames: []string{"alice.example.com"}}, identity: "alice"},
+		{name: "DNS name", cert: &x509.Certificate{DNSNames: []string{"web.example.com", "www.example.com"}, EmailAddresses: []string{"web@example.com"}}, identity: "web.example.com"},
+		{name: "email address", cert: &x509.Certificate{EmailAddresses: []string{"bob@example.com"}, URIs: []*url.URL{spiffe}}, identity: "bob@example.com"},
+		{name: "URI", cert: &x509.Certificate{URIs: []*url.URL{spiffe}}, identity: "spiffe://example.com/web"},
+		{name: "none", cert: &x509.Certificate{}},
+	} {
+		if identity := CertIdentity(tt.cert); identity != tt.identity {
+			t.Errorf("%v: identity %q, want %q", tt.name, identity, tt.identity)
+		}
+	}
+}
+
+func TestTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	rules, err := ParseRules(strings.NewReader("allow cert alice\nallow cert *.ops.example.com\ndeny\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, addr := serve(t, WithRules(rules), WithTLS(&tls.Config{
+		Certificates: []tls.Certificate{pki.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "proxy"}})},
+		ClientCAs:    pki.pool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}))
+	echo := echoTarget(t)
+	for _, tt := range []struct {
+		name     string
+		cert     *x509.Certificate // of the client, none if nil.
+		identity string            // of the session, rejected if empty.
+	}{
+		{name: "common name", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}, identity: "alice"},
+		{name: "subdomain", cert: &x509.Certificate{DNSNames: []string{"bob.ops.example.com"}}, identity: "bob.ops.example.com"},
+		{name: "other identity", cert: &x509.Certificate{Subject: pkix.Name{CommonName: "mallory"}}},
+		{name: "no certificate"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &tls.Config{RootCAs: pki.pool}
+			if tt.cert != nil {
+				config.Certificates = []tls.Certificate{pki.issue(t, tt.cert)}
+			}
+			conn, err := NewDialer(addr, WithDialerTLS(config), WithDialerTimeout(5*time.Second)).Dial("tcp", echo.Addr)
+			if tt.identity == "" {
+				var rej *RejectError
+				if !errors.As(err, &rej) || rej.Code != RejectOrFailure {
+					t.Fatalf("error %v, want a rejection", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			assertEcho(t, conn, []byte("hello"))
+			var identity string
+			for _, ss := range s.Sessions() {
+				if ss.Client == conn.LocalAddr().String() {
+					identity = ss.Identity
+				}
+			}
+			if identity != tt.identity {
+				t.Errorf("session identity %q, want %q", identity, tt.identity)
+			}
+		})
+	}
+}
+
+func TestTLSPlaintextClient(t *testing.T) {
+	pki := newTestPKI(t)
+	_, addr := serve(t, WithTLS(&tls.Config{Certificates: []tls.Certificate{pki.issue(t, &x509.Certificate{})}}), WithHandshakeTimeout(time.Second))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(request(CmdConnect, 80, [4]byte{127, 0, 0, 1}, ""))
+	// closed without a SOCKS reply, at most after a TLS alert.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := io.ReadAll(conn)
+	if err != nil || len(b) > 0 && b[0] == 0 {
+		t.Errorf("read %x: %v, want the connection closed", b, err)
+	}
+}
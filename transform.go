@@ -0,0 +1,66 @@
+package socks4
+
+import (
+	"fmt"
+	"io"
+	"net"
+)
+
+// Transform wraps the writers of the data relayed for the sessions
+// allowed by the rules naming it (see Rule.Transform), e.g. to record,
+// filter or scrub the data without replacing the relay. A wrapper writes
+// the data it transforms to w, and is closed when its direction of the
+// relay stops if it is an io.Closer, e.g. to flush it. The sniffing and
+// the mirror see the data before the transforms, and the stats after them.
+type Transform struct {
+	// ToRemote wraps the writer of the data the client sends to the
+	// remote host, none if nil.
+	ToRemote func(w io.Writer, client net.Conn, req Request) io.Writer
+	// ToClient wraps the writer of the data the remote host sends to the
+	// client, none if nil.
+	ToClient func(w io.Writer, client net.Conn, req Request) io.Writer
+}
+
+// WithTransform adds the transform named name, applied to the relays of
+// the sessions allowed by the rules with "transform name". The relays of
+// the rules naming an unknown transform are closed.
+func WithTransform(name string, t Transform) OptionFunc {
+	return func(s *Server) {
+		if s.transforms == nil {
+			s.transforms = make(map[string]Transform)
+		}
+		s.transforms[name] = t
+	}
+}
+
+// relayTransform returns the transform of the relay of the request, nil
+// if its rule names none.
+func (s *Server) relayTransform(client net.Conn, req Request) (*Transform, error) {
+	rule := s.matchRule(client, req)
+	if rule == nil || rule.Transform == "" {
+		return nil, nil
+	}
+	t, ok := s.transforms[rule.Transform]
+	if !ok {
+		return nil, fmt.Errorf("unknown transform %q of rule %q", rule.Transform, rule.ID)
+	}
+	return &t, nil
+}
+
+// wrap returns the writers of the relay wrapped by the transform.
+func (t *Transform) wrap(toClient, toRemote io.Writer, client net.Conn, req Request) (io.Writer, io.Writer) {
+	if t.ToClient != nil {
+		toClient = t.ToClient(toClient, client, req)
+	}
+	if t.ToRemote != nil {
+		toRemote = t.ToRemote(toRemote, client, req)
+	}
+	return toClient, toRemote
+}
+
+// closeTransformed closes the writer of a transform if it is an io.Closer.
+func closeTransformed(w io.Writer) {
+	if c, ok := w.(io.Closer); ok {
+		c.Close()
+	}
+}
@@ -0,0 +1,139 @@
+package socks4
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseRuleTransform(t *testing.T) {
+	for _, tt := range []struct {
+		rule      string
+		transform string
+		ok        bool
+	}{
+		{rule: "allow", ok: true},
+		{rule: "allow transform scrub", transform: "scrub", ok: true},
+		{rule: "allow port 80 transform scrub label team=web", transform: "scrub", ok: true},
+		{rule: "allow transform"},
+	} {
+		rule, err := ParseRule(tt.rule)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: error %v, want parsed %v", tt.rule, err, tt.ok)
+			continue
+		}
+		if !tt.ok {
+			continue
+		}
+		if rule.Transform != tt.transform {
+			t.Errorf("%q: transform %q, want %q", tt.rule, rule.Transform, tt.transform)
+		}
+		// the rule is written back with its transform.
+		if again, err := ParseRule(rule.String()); err != nil || again.Transform != tt.transform {
+			t.Errorf("%q written as %q: transform %q, want %q", tt.rule, rule.String(), again.Transform, tt.transform)
+		}
+	}
+}
+
+// upperWriter writes the data upper-cased to w, counting its closes.
+type upperWriter struct {
+	w      io.Writer
+	closed *atomic.Int32
+}
+
+func (u upperWriter) Write(p []byte) (int, error) {
+	return u.w.Write(bytes.ToUpper(p))
+}
+
+func (u upperWriter) Close() error {
+	u.closed.Add(1)
+	return nil
+}
+
+// echoOnceTarget starts a target echoing the first 5 bytes of its
+// connections before closing them, so the relays end.
+func echoOnceTarget(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				b := make([]byte, 5)
+				if _, err := io.ReadFull(conn, b); err == nil {
+					conn.Write(b)
+				}
+			}()
+		}
+	}()
+	return lis.Addr().String()
+}
+
+func TestTransform(t *testing.T) {
+	target := echoOnceTarget(t)
+	for _, tt := range []struct {
+		name   string
+		rules  string
+		echoed string // of "Hello", none if the relay is closed.
+		closes int32  // of the transform writers.
+	}{
+		{name: "none", rules: "allow", echoed: "Hello"},
+		{name: "to remote", rules: "allow transform upper-remote", echoed: "HELLO", closes: 1},
+		{name: "to client", rules: "allow transform upper-client", echoed: "HELLO", closes: 1},
+		{name: "both", rules: "allow transform upper", echoed: "HELLO", closes: 2},
+		{name: "empty", rules: "allow transform empty", echoed: "Hello"},
+		{name: "other rule", rules: "allow port 1 transform upper\nallow", echoed: "Hello"},
+		{name: "unknown", rules: "allow transform other"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseRules(strings.NewReader(tt.rules))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var closed atomic.Int32
+			upper := func(w io.Writer, client net.Conn, req Request) io.Writer {
+				if client == nil || req.Address != target {
+					t.Errorf("transform of client %v and request to %v, want %v", client, req.Address, target)
+				}
+				return upperWriter{w: w, closed: &closed}
+			}
+			s, addr := serve(t, WithRules(rules),
+				WithTransform("upper-remote", Transform{ToRemote: upper}),
+				WithTransform("upper-client", Transform{ToClient: upper}),
+				WithTransform("upper", Transform{ToRemote: upper, ToClient: upper}),
+				WithTransform("empty", Transform{}))
+			conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			conn.Write([]byte("Hello"))
+			echoed := make([]byte, 5)
+			n, _ := io.ReadFull(conn, echoed)
+			if string(echoed[:n]) != tt.echoed {
+				t.Errorf("echoed %q, want %q", echoed[:n], tt.echoed)
+			}
+			// the writers are closed at the end of the relay.
+			conn.Close()
+			for deadline := time.Now().Add(5 * time.Second); closed.Load() != tt.closes || len(s.Sessions()) != 0; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("%v writers closed with %v sessions, want %v", closed.Load(), len(s.Sessions()), tt.closes)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package socks4
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"runtime/trace"
+	"strconv"
+)
+
+// VersionTransparent is the Version of the requests made for intercepted
+// connections. It is not a SOCKS version.
+var VersionTransparent byte = 0xff
+
+// ServeTransparent accepts connections redirected to the listener by the
+// firewall, e.g. by the iptables REDIRECT or TPROXY targets, and connects
+// them to their original destination without any handshake. The rules,
+// limits, relay and accounting of the server apply to them as CONNECT
+// requests. The original destination is read from SO_ORIGINAL_DST for
+// REDIRECT, or is the local address of the connection for TPROXY, whose
+// listener must be created by ListenTransparent. It is only supported on
+// Linux.
+func (s *Server) ServeTransparent(lis net.Listener) error {
+	return s.serve(lis, true)
+}
+
+// ListenTransparent listens on the TCP address with IP_TRANSPARENT set,
+// so that the listener accepts the connections diverted by TPROXY.
+func ListenTransparent(address string) (net.Listener, error) {
+	return listenTransparent(address)
+}
+
+// interceptedConn is an intercepted connection to its original
+// destination.
+type interceptedConn struct {
+	net.Conn
+	dst *net.TCPAddr
+}
+
+// serveIntercepted admits and handles a connection accepted by a
+// transparent listener at lisAddr, with the labels of the listener.
+func (s *Server) serveIntercepted(conn net.Conn, lisAddr net.Addr, labels map[string]string) {
+	defer s.wg.Done()
+	dst, err := originalDst(conn)
+	if err == nil && isListenerAddr(dst, lisAddr) {
+		err = errors.New("connection is not intercepted")
+	}
+	if err != nil {
+		s.log(LogAccept).Warnf("original destination of client %v: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	if !s.admit(conn) {
+		s.stats.refused.Add(1)
+		conn.Close()
+		return
+	}
+	s.handleConn(&interceptedConn{Conn: conn, dst: dst}, labels)
+}
+
+// isListenerAddr reports whether dst is the address of the listener
+// itself, i.e. a client connected to it directly, which would make the
+// server connect to itself.
+func isListenerAddr(dst *net.TCPAddr, lisAddr net.Addr) bool {
+	lis, ok := lisAddr.(*net.TCPAddr)
+	if !ok || dst.Port != lis.Port {
+		return false
+	}
+	if !lis.IP.IsUnspecified() {
+		return dst.IP.Equal(lis.IP)
+	}
+	if dst.IP.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(dst.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// establishIntercepted connects an intercepted connection to its original
+// destination.
+func (s *Server) establishIntercepted(ss *session, conn *interceptedConn) (net.Conn, Request, error) {
+	defer trace.StartRegion(ss.trace, "handshake").End()
+	req := Request{
+		Version: VersionTransparent,
+		Cmd:     CmdConnect,
+		Port:    conn.dst.Port,
+		Address: net.JoinHostPort(conn.dst.IP.String(), strconv.Itoa(conn.dst.Port)),
+	}
+	s.requestRead(req, ss.start)
+	remote, req, err := s.establish(ss, conn, req, nopReplier{})
+	if err != nil {
+		return nil, req, fmt.Errorf("intercepted connection: %v", err)
+	}
+	return remote, req, nil
+}
+
+// nopReplier replies nothing, as intercepted clients expect no handshake.
+type nopReplier struct{}
+
+func (nopReplier) granted(net.Conn, net.Addr) error { return nil }
+func (nopReplier) rejected(net.Conn, error) error   { return nil }
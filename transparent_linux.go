@@ -0,0 +1,87 @@
+//go:build linux
+
+package socks4
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST of linux/netfilter_ipv4.h.
+	ip6tSoOriginalDst = 80 // IP6T_SO_ORIGINAL_DST of linux/netfilter_ipv6/ip6_tables.h.
+	ipv6Transparent   = 75 // IPV6_TRANSPARENT of linux/in6.h.
+)
+
+// originalDst returns the destination of an intercepted connection before
+// it was redirected: SO_ORIGINAL_DST for REDIRECT, or else the local
+// address of the connection, which TPROXY keeps.
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("not a TCP connection")
+	}
+	raw, err := tc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		// the sockaddr is read through getsockopt calls returning structs
+		// large enough to hold it.
+		if local.IP.To4() != nil {
+			var mreq *syscall.IPv6Mreq
+			mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if sockErr == nil {
+				// struct sockaddr_in: family, port, address.
+				b := mreq.Multiaddr[:]
+				dst = &net.TCPAddr{IP: net.IP(append([]byte(nil), b[4:8]...)), Port: int(binary.BigEndian.Uint16(b[2:4]))}
+			}
+		} else {
+			var info *syscall.IPv6MTUInfo
+			info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSoOriginalDst)
+			if sockErr == nil {
+				port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+				dst = &net.TCPAddr{IP: net.IP(append([]byte(nil), info.Addr.Addr[:]...)), Port: int(binary.BigEndian.Uint16(port[:]))}
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		// not redirected by NAT, which is the case of TPROXY.
+		return local, nil
+	}
+	return dst, nil
+}
+
+func listenTransparent(address string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if network == "tcp6" {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				} else {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
@@ -0,0 +1,63 @@
+package socks4
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOriginalDstNotRedirected(t *testing.T) {
+	client, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+	// without NAT, like with TPROXY, the destination is the local address.
+	dst, err := originalDst(server)
+	if err != nil || dst.String() != server.LocalAddr().String() {
+		t.Errorf("original destination %v: %v, want %v", dst, err, server.LocalAddr())
+	}
+	if _, err := originalDst(addrConn{Conn: server}); err == nil {
+		t.Error("original destination of a connection other than TCP")
+	}
+}
+
+func TestServeTransparentDirect(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer()
+	go s.ServeTransparent(lis)
+	defer s.Close()
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// connected to itself rather than intercepted.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("read error %v, want the connection closed", err)
+	}
+}
+
+func TestListenTransparent(t *testing.T) {
+	lis, err := ListenTransparent("127.0.0.1:0")
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("IP_TRANSPARENT requires CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	raw, _ := lis.(*net.TCPListener).SyscallConn()
+	var transparent int
+	raw.Control(func(fd uintptr) {
+		transparent, err = syscall.GetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT)
+	})
+	if err != nil || transparent != 1 {
+		t.Errorf("IP_TRANSPARENT %v: %v, want set", transparent, err)
+	}
+}
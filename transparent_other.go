@@ -0,0 +1,16 @@
+//go:build !linux
+
+package socks4
+
+import (
+	"errors"
+	"net"
+)
+
+func originalDst(conn net.Conn) (*net.TCPAddr, error) {
+	return nil, errors.New("transparent proxy is not supported on this platform")
+}
+
+func listenTransparent(address string) (net.Listener, error) {
+	return nil, errors.New("transparent proxy is not supported on this platform")
+}
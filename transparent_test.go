@@ -0,0 +1,98 @@
+package socks4
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsListenerAddr(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		dst      *net.TCPAddr
+		lis      net.Addr
+		listener bool
+	}{
+		{name: "listen IP", dst: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1080}, lis: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1080}, listener: true},
+		{name: "other IP", dst: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080}, lis: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1080}},
+		{name: "other port", dst: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80}, lis: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1080}},
+		{name: "unspecified and loopback", dst: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}, lis: &net.TCPAddr{IP: net.IPv4zero, Port: 1080}, listener: true},
+		{name: "unspecified and IPv6 loopback", dst: &net.TCPAddr{IP: net.IPv6loopback, Port: 1080}, lis: &net.TCPAddr{IP: net.IPv6unspecified, Port: 1080}, listener: true},
+		{name: "unspecified and remote", dst: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080}, lis: &net.TCPAddr{IP: net.IPv4zero, Port: 1080}},
+		{name: "not TCP", dst: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}, lis: &net.UnixAddr{Name: "/run/socks4.sock", Net: "unix"}},
+	} {
+		if listener := isListenerAddr(tt.dst, tt.lis); listener != tt.listener {
+			t.Errorf("%v: listener address %v, want %v", tt.name, listener, tt.listener)
+		}
+	}
+}
+
+// tcpPair returns both ends of a TCP connection.
+func tcpPair(t *testing.T) (client, server net.Conn) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	client, err = net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server, err = lis.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func TestInterceptedConn(t *testing.T) {
+	echo := echoTarget(t)
+	dst, _ := net.ResolveTCPAddr("tcp", echo.Addr)
+	for _, tt := range []struct {
+		name    string
+		rules   string
+		granted bool
+	}{
+		{name: "allowed", rules: "allow cmd connect", granted: true},
+		{name: "denied", rules: "deny to 127.0.0.0/8"},
+		{name: "user id required", rules: "allow user alice\ndeny"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := ParseRules(strings.NewReader(tt.rules))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := newTestServer(WithRules(rules))
+			client, server := tcpPair(t)
+			defer client.Close()
+			ic := &interceptedConn{Conn: server, dst: dst}
+			if !s.admit(ic) {
+				t.Fatal("connection not admitted")
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				s.handleConn(ic, nil)
+			}()
+			if !tt.granted {
+				// closed without any handshake reply.
+				client.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if b, err := io.ReadAll(client); err != nil || len(b) > 0 {
+					t.Errorf("read %q: %v, want the connection closed", b, err)
+				}
+				<-done
+				return
+			}
+			assertEcho(t, client, []byte("hello"))
+			sessions := s.Sessions()
+			if len(sessions) != 1 || sessions[0].Target != echo.Addr || sessions[0].Cmd != "connect" {
+				t.Errorf("sessions %+v, want a CONNECT of %v", sessions, echo.Addr)
+			}
+			client.Close()
+			echo.Close()
+			<-done
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package socks4
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// Transport wraps the connections between the SOCKS clients and the
+// server, e.g. to disguise the SOCKS traffic on hostile networks. The
+// dialers wrap their connections to the server with it (see
+// WithDialerTransportLayer), and the servers the connections of their
+// listeners (see TransportListener).
+type Transport interface {
+	// Client wraps a connection of a client to the server.
+	Client(conn net.Conn) (net.Conn, error)
+	// Server wraps a connection accepted by the server. It must not wait
+	// for the client, which the server does under its handshake timeout.
+	Server(conn net.Conn) (net.Conn, error)
+}
+
+// WithDialerTransportLayer makes the dialer wrap its TCP connections to the
+// server with t, under the TLS of WithDialerTLS and the WebSocket of
+// WithDialerWebSocket if set. The connections of WithDialerTransport are
+// not wrapped.
+func WithDialerTransportLayer(t Transport) DialerOption {
+	return func(d *Dialer) {
+		d.layer = t
+	}
+}
+
+// transportListener is a listener whose connections are wrapped by a
+// transport.
+type transportListener struct {
+	net.Listener
+	t Transport
+}
+
+// TransportListener returns the listener with its connections wrapped by
+// t, for the clients of the dialers with the same transport. Labels are
+// added to the returned listener, see LabelListener.
+func TransportListener(lis net.Listener, t Transport) net.Listener {
+	return &transportListener{Listener: lis, t: t}
+}
+
+func (l *transportListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		wrapped, err := l.t.Server(conn)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		return wrapped, nil
+	}
+}
+
+// tlsTransport is the transport of TLSTransport.
+type tlsTransport struct {
+	config *tls.Config
+}
+
+// TLSTransport returns the transport wrapping the connections in TLS with
+// config, whose ServerName the dialers must set, e.g. under another
+// transport. WithTLS and WithDialerTLS are simpler otherwise.
+func TLSTransport(config *tls.Config) Transport {
+	return tlsTransport{config: config}
+}
+
+func (t tlsTransport) Client(conn net.Conn) (net.Conn, error) {
+	return tls.Client(conn, t.config), nil
+}
+
+func (t tlsTransport) Server(conn net.Conn) (net.Conn, error) {
+	return tls.Server(conn, t.config), nil
+}
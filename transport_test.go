@@ -0,0 +1,166 @@
+package socks4
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestObfsConn(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		writes []int // sizes of the payloads written.
+	}{
+		{name: "one byte", writes: []int{1}},
+		{name: "request", writes: []int{9}},
+		{name: "several writes", writes: []int{5, 100, 1}},
+		{name: "empty write", writes: []int{0, 3}},
+		{name: "several frames", writes: []int{obfsMaxPayload*2 + 1}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			var raw bytes.Buffer
+			tr := ObfsTransport([]byte("key"))
+			c, _ := tr.Client(client)
+			s, _ := tr.Server(recordingConn{Conn: server, w: &raw})
+			var sent []byte
+			go func() {
+				for i, n := range tt.writes {
+					payload := bytes.Repeat([]byte{'a' + byte(i)}, n)
+					if written, err := c.Write(payload); err != nil || written != n {
+						t.Errorf("wrote %v bytes of %v: %v", written, n, err)
+					}
+				}
+				c.Close()
+			}()
+			for i, n := range tt.writes {
+				sent = append(sent, bytes.Repeat([]byte{'a' + byte(i)}, n)...)
+			}
+			s.SetDeadline(time.Now().Add(5 * time.Second))
+			received, err := io.ReadAll(s)
+			if err != nil && !errors.Is(err, io.EOF) {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(received, sent) {
+				t.Fatalf("received %v bytes, want the %v sent", len(received), len(sent))
+			}
+			// the payload is not seen on the wire.
+			if raw.Len() <= len(sent) || bytes.Contains(raw.Bytes(), []byte("aaaaa")) {
+				t.Errorf("%v bytes on the wire for %v sent, want them obfuscated", raw.Len(), len(sent))
+			}
+		})
+	}
+}
+
+// recordingConn copies what is read from the connection to w.
+type recordingConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.w.Write(b[:n])
+	return n, err
+}
+
+func TestObfsConnInvalid(t *testing.T) {
+	key := ObfsTransport([]byte("key")).(*obfsTransport).key
+	// frame returns the bytes of a frame with the header, obfuscated with
+	// the key and the zero nonce.
+	frame := func(header []byte, rest int) []byte {
+		b := append(make([]byte, obfsNonceSize), header...)
+		b = append(b, make([]byte, rest)...)
+		s, err := (&obfsConn{key: key[:]}).stream(make([]byte, obfsNonceSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.XORKeyStream(b[obfsNonceSize:], b[obfsNonceSize:])
+		return b
+	}
+	for _, tt := range []struct {
+		name string
+		raw  []byte
+		err  error // nil for any error.
+	}{
+		{name: "no nonce", raw: nil, err: io.EOF},
+		{name: "short nonce", raw: make([]byte, obfsNonceSize-1), err: io.ErrUnexpectedEOF},
+		{name: "no frame", raw: make([]byte, obfsNonceSize), err: io.EOF},
+		{name: "short frame", raw: frame([]byte{0, 10, 0}, 5), err: io.ErrUnexpectedEOF},
+		{name: "short padding", raw: frame([]byte{0, 1, 10}, 5), err: io.ErrUnexpectedEOF},
+		{name: "frame too long", raw: frame([]byte{0xff, 0xff, 0}, 0)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &obfsConn{Conn: &bufConn{r: bytes.NewReader(tt.raw)}, key: key[:]}
+			n, err := conn.Read(make([]byte, 100))
+			if err == nil || (tt.err != nil && !errors.Is(err, tt.err)) {
+				t.Errorf("read %v bytes with error %v, want %v", n, err, tt.err)
+			}
+		})
+	}
+}
+
+// failingTransport fails the connections of the server.
+type failingTransport struct{}
+
+func (failingTransport) Client(conn net.Conn) (net.Conn, error) { return conn, nil }
+
+func (failingTransport) Server(conn net.Conn) (net.Conn, error) {
+	return nil, errors.New("failed")
+}
+
+func TestTransportListener(t *testing.T) {
+	echo := echoTarget(t)
+	pki := newTestPKI(t)
+	serverTLS := TLSTransport(&tls.Config{Certificates: []tls.Certificate{pki.issue(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "proxy"}, DNSNames: []string{"proxy.example.com"},
+	})}})
+	clientTLS := TLSTransport(&tls.Config{RootCAs: pki.pool, ServerName: "proxy.example.com"})
+	for _, tt := range []struct {
+		name   string
+		server Transport
+		client Transport // of the dialer, none if nil.
+		ok     bool
+	}{
+		{name: "obfuscated", server: ObfsTransport([]byte("key")), client: ObfsTransport([]byte("key")), ok: true},
+		{name: "TLS", server: serverTLS, client: clientTLS, ok: true},
+		{name: "other key", server: ObfsTransport([]byte("key")), client: ObfsTransport([]byte("other"))},
+		{name: "not obfuscated", server: ObfsTransport([]byte("key"))},
+		{name: "failed", server: failingTransport{}, client: failingTransport{}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			lis, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := newTestServer(WithHandshakeTimeout(time.Second))
+			go s.Serve(TransportListener(lis, tt.server))
+			t.Cleanup(func() { s.Close() })
+			opts := []DialerOption{WithDialerTimeout(5 * time.Second)}
+			if tt.client != nil {
+				opts = append(opts, WithDialerTransportLayer(tt.client))
+			}
+			d := NewDialer(lis.Addr().String(), opts...)
+			// twice, the listener accepting again after a failed
+			// connection.
+			for i := 0; i < 2; i++ {
+				conn, err := d.Dial("tcp", echo.Addr)
+				if (err == nil) != tt.ok {
+					t.Fatalf("dial %v: error %v, want dialed %v", i, err, tt.ok)
+				}
+				if err == nil {
+					assertEcho(t, conn, []byte("hello"))
+					conn.Close()
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package socks4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// WithSocks5Upstream makes the server a gateway to the SOCKS 5 server at
+// address: the CONNECT requests are carried out by the upstream server
+// instead of dialing the targets directly, e.g. to let SOCKS 4 clients
+// reach a SOCKS 5 infrastructure. Domain names of SOCKS 4A requests are
+// resolved by the upstream server. If username is not empty, the server
+// authenticates to the upstream with username and password. BIND requests
+// are rejected in this mode.
+func WithSocks5Upstream(address, username, password string) OptionFunc {
+	return func(s *Server) {
+		s.upstream = &socks5Upstream{address: address, username: username, password: password}
+	}
+}
+
+// socks5Upstream is the SOCKS 5 server the requests are forwarded to.
+type socks5Upstream struct {
+	address            string
+	username, password string
+}
+
+// UpstreamError is the rejection of a request by the upstream server.
+type UpstreamError struct {
+	Code byte // the SOCKS 5 reply code.
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("SOCKS 5 upstream rejected the request (code %#x)", e.Code)
+}
+
+// targetAddr is the address of a target reached through the upstream.
+type targetAddr string
+
+func (a targetAddr) Network() string { return "tcp" }
+func (a targetAddr) String() string  { return string(a) }
+
+// upstreamConn is a connection to a target through the upstream.
+type upstreamConn struct {
+	net.Conn
+	target targetAddr
+}
+
+func (c *upstreamConn) RemoteAddr() net.Addr {
+	return c.target
+}
+
+// dialTarget connects to the target address of a CONNECT request, through
+// the egress named via if not empty, or else the upstream server if
+// configured.
+func (s *Server) dialTarget(address, via string, o origin) (net.Conn, error) {
+	if via != "" {
+		e := s.egresses[via]
+		if e == nil {
+			return nil, fmt.Errorf("unknown egress %q", via)
+		}
+		return e.dial(address, o, s)
+	}
+	if s.upstream == nil {
+		return s.dialDirect(address, o, func(address string) (net.Conn, error) {
+			return s.dial("tcp", address, o)
+		})
+	}
+	return s.upstream.dial(address, o, s)
+}
+
+// dial connects to address through the upstream server.
+func (u *socks5Upstream) dial(address string, o origin, s *Server) (net.Conn, error) {
+	conn, err := s.dial("tcp", u.address, o)
+	if err != nil {
+		return nil, fmt.Errorf("dial SOCKS 5 upstream: %v", err)
+	}
+	if timeout := s.dialTimeout(); timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := u.connect(conn, address); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &upstreamConn{Conn: conn, target: targetAddr(address)}, nil
+}
+
+// connect requests the upstream server on conn to connect to address.
+func (u *socks5Upstream) connect(conn net.Conn, address string) error {
+	method := methodNoAuth
+	if u.username != "" {
+		method = methodUserPass
+	}
+	if _, err := conn.Write([]byte{Version5, 1, method}); err != nil {
+		return err
+	}
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return fmt.Errorf("failed to read SOCKS 5 upstream method: %v", err)
+	}
+	if b[0] != Version5 || b[1] != method {
+		return fmt.Errorf("SOCKS 5 upstream refused the authentication method %v", method)
+	}
+
+	if method == methodUserPass {
+		if len(u.username) > 255 || len(u.password) > 255 {
+			return errors.New("SOCKS 5 upstream username or password too long")
+		}
+		msg := []byte{0x01, byte(len(u.username))}
+		msg = append(msg, u.username...)
+		msg = append(msg, byte(len(u.password)))
+		msg = append(msg, u.password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return fmt.Errorf("failed to read SOCKS 5 upstream authentication: %v", err)
+		}
+		if b[1] != 0 {
+			return errors.New("SOCKS 5 upstream authentication failed")
+		}
+	}
+
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid port %v", portStr)
+	}
+	msg := []byte{Version5, CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("domain name too long: %v", host)
+		}
+		msg = append(msg, atypDomain, byte(len(host)))
+		msg = append(msg, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		msg = append(msg, atypIPv4)
+		msg = append(msg, ip4...)
+	} else {
+		msg = append(msg, atypIPv6)
+		msg = append(msg, ip...)
+	}
+	msg = binary.BigEndian.AppendUint16(msg, uint16(port))
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	// reply: VER REP RSV ATYP BND.ADDR BND.PORT
+	rep := make([]byte, 4)
+	if _, err := io.ReadFull(conn, rep); err != nil {
+		return fmt.Errorf("failed to read SOCKS 5 upstream reply: %v", err)
+	}
+	if rep[0] != Version5 {
+		return errors.New("invalid SOCKS 5 upstream reply VER")
+	}
+	if rep[1] != rep5Succeeded {
+		return &UpstreamError{Code: rep[1]}
+	}
+	var n int
+	switch rep[3] {
+	case atypIPv4:
+		n = net.IPv4len
+	case atypIPv6:
+		n = net.IPv6len
+	case atypDomain:
+		if _, err := io.ReadFull(conn, rep[:1]); err != nil {
+			return fmt.Errorf("failed to read SOCKS 5 upstream reply: %v", err)
+		}
+		n = int(rep[0])
+	default:
+		return fmt.Errorf("invalid SOCKS 5 upstream reply address type %v", rep[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, n+2)); err != nil {
+		return fmt.Errorf("failed to read SOCKS 5 upstream reply: %v", err)
+	}
+	return nil
+}
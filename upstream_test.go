@@ -0,0 +1,212 @@
+package socks4
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeUpstream is a SOCKS 5 server accepting the username and password if
+// set, replying rep to the CONNECT requests and echoing the data of those
+// granted.
+type fakeUpstream struct {
+	addr               string
+	username, password string
+	rep                byte
+	targets            chan string // requested addresses.
+}
+
+func newFakeUpstream(t *testing.T, username, password string, rep byte) *fakeUpstream {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	u := &fakeUpstream{addr: lis.Addr().String(), username: username, password: password, rep: rep, targets: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go u.serve(conn)
+		}
+	}()
+	return u
+}
+
+func (u *fakeUpstream) serve(conn net.Conn) {
+	defer conn.Close()
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return
+	}
+	methods := make([]byte, b[1])
+	io.ReadFull(conn, methods)
+	method := methodNoAuth
+	if u.username != "" {
+		method = methodUserPass
+	}
+	if !strings.Contains(string(methods), string([]byte{method})) {
+		conn.Write([]byte{Version5, 0xff})
+		return
+	}
+	conn.Write([]byte{Version5, method})
+	if method == methodUserPass {
+		username := readField(conn, 1)
+		password := readField(conn, 0)
+		if username != u.username || password != u.password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	var host string
+	switch req[3] {
+	case atypIPv4, atypIPv6:
+		ip := make(net.IP, 4)
+		if req[3] == atypIPv6 {
+			ip = make(net.IP, 16)
+		}
+		io.ReadFull(conn, ip)
+		host = ip.String()
+	case atypDomain:
+		host = readField(conn, 0)
+	}
+	port := make([]byte, 2)
+	io.ReadFull(conn, port)
+	u.targets <- net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	conn.Write([]byte{Version5, u.rep, 0, atypDomain, 4, 'h', 'o', 's', 't', 0, 80})
+	if u.rep == rep5Succeeded {
+		io.Copy(conn, conn)
+	}
+}
+
+// readField reads the bytes skipped and a field prefixed by its length.
+func readField(r io.Reader, skip int) string {
+	b := make([]byte, skip+1)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return ""
+	}
+	field := make([]byte, b[skip])
+	io.ReadFull(r, field)
+	return string(field)
+}
+
+func TestSocks5Upstream(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		username string // of the upstream.
+		password string // given by the gateway.
+		rep      byte
+		target   string
+		userId   string
+		upstream string // address requested to the upstream, none if empty.
+		code     byte   // of the rejection, 0 if granted.
+	}{
+		{name: "IPv4", rep: rep5Succeeded, target: "192.0.2.1:80", upstream: "192.0.2.1:80"},
+		{name: "domain name not resolved", rep: rep5Succeeded, target: "example.invalid:443", upstream: "example.invalid:443"},
+		{name: "authentication", username: "gw", password: "secret", rep: rep5Succeeded, target: "192.0.2.1:80", upstream: "192.0.2.1:80"},
+		{name: "failed authentication", username: "gw", password: "wrong", rep: rep5Succeeded, target: "192.0.2.1:80", code: RejectOrFailure},
+		{name: "upstream rejection", rep: rep5ConnRefused, target: "192.0.2.1:80", upstream: "192.0.2.1:80", code: RejectOrFailure},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			up := newFakeUpstream(t, tt.username, "secret", tt.rep)
+			_, addr := serve(t, WithSocks5Upstream(up.addr, tt.username, tt.password))
+			conn, err := NewDialer(addr, WithDialerTimeout(5*time.Second)).Dial("tcp", tt.target)
+			if tt.code != 0 {
+				var rej *RejectError
+				if !errors.As(err, &rej) || rej.Code != tt.code {
+					t.Fatalf("error %v, want the code %#x", err, tt.code)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				assertEcho(t, conn, []byte("hello"))
+			}
+			select {
+			case target := <-up.targets:
+				if target != tt.upstream {
+					t.Errorf("upstream requested %v, want %v", target, tt.upstream)
+				}
+			default:
+				if tt.upstream != "" {
+					t.Errorf("upstream not requested %v", tt.upstream)
+				}
+			}
+		})
+	}
+}
+
+func TestSocks5UpstreamBind(t *testing.T) {
+	up := newFakeUpstream(t, "", "", rep5Succeeded)
+	_, addr := serve(t, WithSocks5Upstream(up.addr, "", ""))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(request(CmdBind, 80, [4]byte{192, 0, 2, 1}, ""))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != RejectOrFailure {
+		t.Errorf("reply %x: %v, want the BIND request rejected", reply, err)
+	}
+}
+
+func TestUpstreamConnect(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		address string
+		reply   []byte // after the method.
+		request []byte // CONNECT request, none if nil.
+		err     string // in the error, none if empty.
+	}{
+		{name: "IPv6", address: "[2001:db8::1]:443", reply: []byte{Version5, 0, 0, atypIPv6, 15: 0, 21: 0},
+			request: append([]byte{Version5, CmdConnect, 0, atypIPv6, 0x20, 0x01, 0x0d, 0xb8, 15: 0, 19: 1}, 1, 0xbb)},
+		{name: "IPv4 reply", address: "192.0.2.1:80", reply: []byte{Version5, 0, 0, atypIPv4, 0, 0, 0, 0, 0, 0},
+			request: []byte{Version5, CmdConnect, 0, atypIPv4, 192, 0, 2, 1, 0, 80}},
+		{name: "domain name too long", address: strings.Repeat("a", 256) + ":80", err: "domain name too long"},
+		{name: "invalid reply version", address: "192.0.2.1:80", reply: []byte{4, 0, 0, atypIPv4}, err: "invalid SOCKS 5 upstream reply VER"},
+		{name: "invalid reply address type", address: "192.0.2.1:80", reply: []byte{Version5, 0, 0, 9}, err: "address type"},
+		{name: "truncated reply", address: "192.0.2.1:80", reply: []byte{Version5, 0, 0, atypIPv4, 0}, err: "failed to read SOCKS 5 upstream reply"},
+		{name: "rejected", address: "192.0.2.1:80", reply: []byte{Version5, rep5NotAllowed, 0, atypIPv4}, err: "code 0x2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			requested := make(chan []byte, 1)
+			go func() {
+				defer server.Close()
+				io.ReadFull(server, make([]byte, 3))
+				server.Write([]byte{Version5, methodNoAuth})
+				b := make([]byte, 512)
+				n, _ := server.Read(b)
+				requested <- b[:n]
+				server.Write(tt.reply)
+			}()
+			err := (&socks5Upstream{}).connect(client, tt.address)
+			client.Close()
+			if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("error %v, want %q", err, tt.err)
+			}
+			if tt.request != nil {
+				if req := <-requested; string(req) != string(tt.request) {
+					t.Errorf("request %x, want %x", req, tt.request)
+				}
+			}
+		})
+	}
+}
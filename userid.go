@@ -0,0 +1,168 @@
+package socks4
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The errors of the SOCKS 4 requests rejected for their user ids, replied
+// with their own codes.
+var (
+	// ErrUserIdRejected is the error of the requests whose user id is
+	// rejected by the validator or differs from the one reported by identd,
+	// replied with RejectWrongUserId.
+	ErrUserIdRejected = errors.New("user id rejected")
+	// ErrIdentdUnreachable is the error of the requests whose client runs
+	// no reachable identd, replied with RejectNoIdentd.
+	ErrIdentdUnreachable = errors.New("can't connect to identd on client")
+)
+
+// authenticated reports whether the user id of the request, once checked,
+// is proven by its client: mapped from a client certificate, verified as a
+// token or by PAM with a secret, or sent with the password of a SOCKS 5 or
+// HTTP client. The other user ids, identd ones included, are only claimed.
+func (s *Server) authenticated(conn net.Conn, req Request) bool {
+	if s.certUserIdMode != CertUserIdOff && clientCert(conn) != nil {
+		return true
+	}
+	switch req.Version {
+	case Version4:
+		return s.jwt != nil || s.pam != nil && s.pam.Separator != ""
+	case Version5:
+		return s.socks5Auth != nil
+	case VersionHTTP:
+		return s.httpAuth != nil
+	}
+	return false
+}
+
+// UserIdValidator checks the user id of a SOCKS 4 request from client. The
+// requests it returns an error for are rejected with RejectWrongUserId,
+// unless the error is ErrIdentdUnreachable.
+type UserIdValidator func(userId string, client net.Addr) error
+
+// WithUserIdValidator makes the server check the user ids of the SOCKS 4
+// requests with v.
+func WithUserIdValidator(v UserIdValidator) OptionFunc {
+	return func(s *Server) {
+		s.userIdValidator = v
+	}
+}
+
+// WithIdentd makes the server check the user ids of the SOCKS 4 requests
+// against the identd of their clients (RFC 1413), queried with the timeout.
+// The requests of clients without a reachable identd are rejected with
+// RejectNoIdentd, and those whose user id differs from the one reported by
+// identd with RejectWrongUserId.
+func WithIdentd(timeout time.Duration) OptionFunc {
+	return func(s *Server) {
+		s.identd = true
+		s.identdTimeout = timeout
+	}
+}
+
+// ReplyHook returns the code of the SOCKS 4 reply rejecting the request for
+// err, given the code chosen by the server. Codes which are not SOCKS 4
+// rejection codes are ignored.
+type ReplyHook func(req Request, err error, code byte) byte
+
+// WithReplyHook makes the server call hook to choose the code of the
+// SOCKS 4 replies rejecting requests.
+func WithReplyHook(hook ReplyHook) OptionFunc {
+	return func(s *Server) {
+		s.replyHook = hook
+	}
+}
+
+// socks4ReplyCode returns the reply code telling the client why its
+// request failed by err.
+func socks4ReplyCode(err error) byte {
+	switch {
+	case errors.Is(err, ErrIdentdUnreachable):
+		return RejectNoIdentd
+	case errors.Is(err, ErrUserIdRejected):
+		return RejectWrongUserId
+	}
+	return RejectOrFailure
+}
+
+// checkUserId checks the user id of a SOCKS 4 request with the validator
+// and identd of the server.
+func (s *Server) checkUserId(conn net.Conn, req Request) error {
+	if req.Version != Version4 {
+		return nil
+	}
+	if s.userIdValidator != nil {
+		if err := s.userIdValidator(req.UserId, conn.RemoteAddr()); err != nil {
+			if errors.Is(err, ErrIdentdUnreachable) || errors.Is(err, ErrUserIdRejected) {
+				return err
+			}
+			return fmt.Errorf("%w: %v", ErrUserIdRejected, err)
+		}
+	}
+	if s.identd {
+		user, err := s.queryIdentd(conn)
+		if err != nil {
+			return err
+		}
+		if user != req.UserId {
+			return fmt.Errorf("%w: identd reports user %q", ErrUserIdRejected, user)
+		}
+	}
+	return nil
+}
+
+const (
+	// identdPort is the port of identd.
+	identdPort = 113
+	// maxIdentdResponse is the max size of an identd response.
+	maxIdentdResponse = 1024
+)
+
+// queryIdentd returns the user owning the client connection on its host,
+// as reported by its identd.
+func (s *Server) queryIdentd(conn net.Conn) (string, error) {
+	client, ok := conn.RemoteAddr().(*net.TCPAddr)
+	local, lok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok || !lok {
+		return "", fmt.Errorf("%w: not a TCP client", ErrIdentdUnreachable)
+	}
+	ic, err := s.network.Dial("tcp", net.JoinHostPort(client.IP.String(), strconv.Itoa(identdPort)), s.identdTimeout)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrIdentdUnreachable, err)
+	}
+	defer ic.Close()
+	if s.identdTimeout > 0 {
+		ic.SetDeadline(time.Now().Add(s.identdTimeout))
+	}
+
+	// the ports are those of the connection as seen from the client host.
+	if _, err := fmt.Fprintf(ic, "%d , %d\r\n", client.Port, local.Port); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrIdentdUnreachable, err)
+	}
+	line, err := bufio.NewReader(io.LimitReader(ic, maxIdentdResponse)).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrIdentdUnreachable, err)
+	}
+	return parseIdentdResponse(line)
+}
+
+// parseIdentdResponse returns the user of an identd response, like
+// "6193, 23 : USERID : UNIX : stjohns".
+func parseIdentdResponse(line string) (string, error) {
+	fields := strings.SplitN(strings.TrimRight(line, "\r\n"), ":", 4)
+	if len(fields) >= 3 && strings.TrimSpace(fields[1]) == "ERROR" {
+		return "", fmt.Errorf("%w: identd error %v", ErrUserIdRejected, strings.TrimSpace(fields[2]))
+	}
+	if len(fields) != 4 || strings.TrimSpace(fields[1]) != "USERID" {
+		return "", fmt.Errorf("%w: invalid identd response %q", ErrIdentdUnreachable, line)
+	}
+	// the user id is not trimmed, as its spaces are significant.
+	return strings.TrimPrefix(fields[3], " "), nil
+}
@@ -0,0 +1,232 @@
+package socks4
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseIdentdResponse(t *testing.T) {
+	for _, tt := range []struct {
+		line string
+		user string
+		err  error
+	}{
+		{line: "6193, 23 : USERID : UNIX : stjohns\r\n", user: "stjohns"},
+		{line: "6193,23:USERID:UNIX:stjohns", user: "stjohns"},
+		{line: "6193, 23 : USERID : UNIX :  two spaces \r\n", user: " two spaces "},
+		{line: "6193, 23 : USERID : OTHER,UTF-8 : a:b\r\n", user: "a:b"},
+		{line: "6193, 23 : ERROR : NO-USER\r\n", err: ErrUserIdRejected},
+		{line: "6193, 23 : ERROR : HIDDEN-USER\r\n", err: ErrUserIdRejected},
+		{line: "6193, 23 : USERID : UNIX\r\n", err: ErrIdentdUnreachable},
+		{line: "garbage\r\n", err: ErrIdentdUnreachable},
+		{line: "", err: ErrIdentdUnreachable},
+	} {
+		user, err := parseIdentdResponse(tt.line)
+		if user != tt.user || !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+			t.Errorf("%q parsed as %q with error %v, want %q with %v", tt.line, user, err, tt.user, tt.err)
+		}
+	}
+}
+
+func TestSocks4ReplyCode(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		code byte
+	}{
+		{ErrUserIdRejected, RejectWrongUserId},
+		{fmt.Errorf("request rejected: %w", ErrUserIdRejected), RejectWrongUserId},
+		{ErrIdentdUnreachable, RejectNoIdentd},
+		{fmt.Errorf("%w: connection refused", ErrIdentdUnreachable), RejectNoIdentd},
+		{errDenied, RejectOrFailure},
+		{errors.New("connection refused"), RejectOrFailure},
+		{nil, RejectOrFailure},
+	} {
+		if code := socks4ReplyCode(tt.err); code != tt.code {
+			t.Errorf("error %v replied with %#x, want %#x", tt.err, code, tt.code)
+		}
+	}
+}
+
+func TestReplyHook(t *testing.T) {
+	req := Request{Version: Version4, Cmd: CmdConnect, Port: 80, Address: "10.0.0.1:80"}
+	for _, tt := range []struct {
+		name string
+		hook ReplyHook
+		err  error
+		code byte
+	}{
+		{name: "no hook", err: ErrUserIdRejected, code: RejectWrongUserId},
+		{name: "kept", hook: func(req Request, err error, code byte) byte { return code }, err: ErrUserIdRejected, code: RejectWrongUserId},
+		{name: "overridden", hook: func(req Request, err error, code byte) byte { return RejectOrFailure }, err: ErrUserIdRejected, code: RejectOrFailure},
+		{name: "by error", hook: func(req Request, err error, code byte) byte {
+			if errors.Is(err, errDenied) {
+				return RejectWrongUserId
+			}
+			return code
+		}, err: errDenied, code: RejectWrongUserId},
+		{name: "granted ignored", hook: func(req Request, err error, code byte) byte { return Granted }, err: errDenied, code: RejectOrFailure},
+		{name: "invalid code ignored", hook: func(req Request, err error, code byte) byte { return 0x42 }, err: ErrIdentdUnreachable, code: RejectNoIdentd},
+	} {
+		var hooked Request
+		hook := tt.hook
+		if hook != nil {
+			hook = func(r Request, err error, code byte) byte {
+				hooked = r
+				return tt.hook(r, err, code)
+			}
+		}
+		conn := &bufConn{}
+		if err := (socks4Replier{req: req, hook: hook}).rejected(conn, tt.err); err != nil {
+			t.Fatal(err)
+		}
+		if b := conn.w.Bytes(); len(b) != 8 || b[1] != tt.code {
+			t.Errorf("%v: replied %x, want code %#x", tt.name, b, tt.code)
+		}
+		if hook != nil && hooked.Address != req.Address {
+			t.Errorf("%v: hook called with %+v, want the request", tt.name, hooked)
+		}
+	}
+}
+
+// identdNetwork dials identd servers replying with response, or failing
+// with err, and records the queries.
+type identdNetwork struct {
+	response string
+	err      error
+	addrs    chan string
+	queries  chan string
+}
+
+func newIdentdNetwork(response string, err error) *identdNetwork {
+	return &identdNetwork{response: response, err: err, addrs: make(chan string, 1), queries: make(chan string, 1)}
+}
+
+func (n *identdNetwork) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	n.addrs <- address
+	if n.err != nil {
+		return nil, n.err
+	}
+	conn, peer := net.Pipe()
+	go func() {
+		defer peer.Close()
+		query, err := bufio.NewReader(peer).ReadString('\n')
+		if err != nil {
+			return
+		}
+		n.queries <- query
+		io.WriteString(peer, n.response)
+	}()
+	return conn, nil
+}
+
+func (n *identdNetwork) Listen(network, address string) (net.Listener, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestIdentd(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		userId   string
+		response string
+		dialErr  error
+		err      error
+	}{
+		{name: "same user", userId: "alice", response: "%v : USERID : UNIX : alice\r\n"},
+		{name: "other user", userId: "alice", response: "%v : USERID : UNIX : bob\r\n", err: ErrUserIdRejected},
+		{name: "no user", userId: "alice", response: "%v : ERROR : NO-USER\r\n", err: ErrUserIdRejected},
+		{name: "invalid response", userId: "alice", response: "hello\r\n", err: ErrIdentdUnreachable},
+		{name: "no response", userId: "alice", response: "", err: ErrIdentdUnreachable},
+		{name: "unreachable", userId: "alice", dialErr: errors.New("connection refused"), err: ErrIdentdUnreachable},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, conn := tcpPair(t)
+			defer client.Close()
+			defer conn.Close()
+			clientPort := conn.RemoteAddr().(*net.TCPAddr).Port
+			serverPort := conn.LocalAddr().(*net.TCPAddr).Port
+			ports := fmt.Sprintf("%d , %d", clientPort, serverPort)
+			network := newIdentdNetwork(strings.ReplaceAll(tt.response, "%v", ports), tt.dialErr)
+			s := newTestServer(WithIdentd(time.Second), WithNetwork(network))
+			err := s.checkUserId(conn, Request{Version: Version4, UserId: tt.userId})
+			if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if addr := <-network.addrs; addr != "127.0.0.1:"+strconv.Itoa(identdPort) {
+				t.Errorf("identd dialed at %v, want port 113 of the client", addr)
+			}
+			if tt.dialErr == nil {
+				if query := <-network.queries; query != ports+"\r\n" {
+					t.Errorf("identd query %q, want %q", query, ports+"\r\n")
+				}
+			}
+		})
+	}
+}
+
+func TestCheckUserId(t *testing.T) {
+	errLocked := errors.New("account locked")
+	for _, tt := range []struct {
+		name    string
+		req     Request
+		invalid error
+		err     error
+	}{
+		{name: "valid", req: Request{Version: Version4, UserId: "alice"}},
+		{name: "invalid", req: Request{Version: Version4, UserId: "alice"}, invalid: errLocked, err: ErrUserIdRejected},
+		{name: "rejected", req: Request{Version: Version4, UserId: "alice"}, invalid: ErrUserIdRejected, err: ErrUserIdRejected},
+		{name: "identd unreachable", req: Request{Version: Version4, UserId: "alice"}, invalid: ErrIdentdUnreachable, err: ErrIdentdUnreachable},
+		{name: "SOCKS 5 not checked", req: Request{Version: Version5, UserId: "alice"}, invalid: errLocked},
+	} {
+		var checked string
+		s := newTestServer(WithUserIdValidator(func(userId string, client net.Addr) error {
+			checked = userId + " from " + client.String()
+			return tt.invalid
+		}))
+		err := s.checkUserId(fromIP("192.0.2.1"), tt.req)
+		if !errors.Is(err, tt.err) || (err == nil) != (tt.err == nil) {
+			t.Errorf("%v: error %v, want %v", tt.name, err, tt.err)
+		}
+		if tt.invalid == errLocked && err != nil && !strings.Contains(err.Error(), "account locked") {
+			t.Errorf("%v: error %v without the error of the validator", tt.name, err)
+		}
+		if want := "alice from 192.0.2.1:40000"; tt.req.Version == Version4 && checked != want {
+			t.Errorf("%v: validator called for %q, want %q", tt.name, checked, want)
+		}
+	}
+}
+
+func TestUserIdReplies(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		opts []OptionFunc
+		code byte
+	}{
+		{name: "wrong user id", opts: []OptionFunc{WithUserIdValidator(func(string, net.Addr) error { return errors.New("unknown") })}, code: RejectWrongUserId},
+		{name: "no identd", opts: []OptionFunc{WithUserIdValidator(func(string, net.Addr) error { return ErrIdentdUnreachable })}, code: RejectNoIdentd},
+		{name: "denied destination", opts: []OptionFunc{WithRules([]Rule{{Action: Deny}})}, code: RejectOrFailure},
+		{
+			name: "hook",
+			opts: []OptionFunc{
+				WithUserIdValidator(func(string, net.Addr) error { return errors.New("unknown") }),
+				WithReplyHook(func(Request, error, byte) byte { return RejectOrFailure }),
+			},
+			code: RejectOrFailure,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, addr := serve(t, tt.opts...)
+			_, err := NewDialer(addr, WithDialerUserId("alice"), WithDialerTimeout(5*time.Second)).Dial("tcp", "127.0.0.1:80")
+			var rej *RejectError
+			if !errors.As(err, &rej) || rej.Code != tt.code {
+				t.Errorf("dial error %v, want a rejection with %#x", err, tt.code)
+			}
+		})
+	}
+}
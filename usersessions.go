@@ -0,0 +1,99 @@
+package socks4
+
+import (
+	"fmt"
+	"sync"
+)
+
+// UnlimitedSessions is the Rule.MaxSessions of the users whose sessions
+// are not limited, whatever WithMaxSessionsPerUser.
+const UnlimitedSessions = -1
+
+// WithMaxSessionsPerUser limits the concurrent sessions of each user id,
+// whatever the IPs of its clients, to n, and those of the users of perUser
+// to their own limits; 0 for no limit. The MaxSessions of the rule
+// allowing a request overrides them. The requests beyond the limit are
+// rejected like the wrong user ids, with RejectWrongUserId, and those
+// without user id are not limited.
+func WithMaxSessionsPerUser(n int, perUser map[string]int) OptionFunc {
+	return func(s *Server) {
+		s.config().MaxSessionsPerUser = n
+		s.config().UserMaxSessions = perUser
+	}
+}
+
+// errTooManyUserSessions is the error of the requests beyond the limit of
+// sessions of their user.
+var errTooManyUserSessions = fmt.Errorf("%w: too many sessions of the user", ErrUserIdRejected)
+
+// userCounter counts the sessions by user id, whatever the limits, which
+// may change while they are.
+type userCounter struct {
+	mu       sync.Mutex
+	sessions map[string]int
+}
+
+// acquire counts a session of the user and reports whether it is within
+// the limit of max sessions, 0 for no limit.
+func (c *userCounter) acquire(user string, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max > 0 && c.sessions[user] >= max {
+		return false
+	}
+	if c.sessions == nil {
+		c.sessions = make(map[string]int)
+	}
+	c.sessions[user]++
+	return true
+}
+
+// release uncounts a session acquired for the user.
+func (c *userCounter) release(user string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sessions[user]--; c.sessions[user] <= 0 {
+		delete(c.sessions, user)
+	}
+}
+
+// userSessionLimit returns the max sessions of the user of the request
+// allowed by rule, if not nil, 0 for no limit.
+func (s *Server) userSessionLimit(req Request, rule *Rule) int {
+	c := s.config()
+	limit := c.MaxSessionsPerUser
+	if n, ok := c.UserMaxSessions[req.UserId]; ok {
+		limit = n
+	}
+	if rule != nil && rule.MaxSessions != 0 {
+		limit = rule.MaxSessions
+	}
+	if limit < 0 {
+		return 0
+	}
+	return limit
+}
+
+// acquireUserSession counts the session for the user of its request, and
+// reports whether it is within the limit of the user. The session is
+// uncounted by releaseUserSession at its end, or when it makes another
+// request.
+func (s *Server) acquireUserSession(ss *session, req Request, rule *Rule) bool {
+	s.releaseUserSession(ss)
+	if req.UserId == "" {
+		return true
+	}
+	if !s.userSessions.acquire(req.UserId, s.userSessionLimit(req, rule)) {
+		return false
+	}
+	ss.user = req.UserId
+	return true
+}
+
+// releaseUserSession uncounts the session for its user, if counted.
+func (s *Server) releaseUserSession(ss *session) {
+	if ss.user != "" {
+		s.userSessions.release(ss.user)
+		ss.user = ""
+	}
+}
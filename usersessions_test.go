@@ -0,0 +1,65 @@
+package socks4
+
+import "testing"
+
+func TestUserSessionLimit(t *testing.T) {
+	s := newTestServer(WithMaxSessionsPerUser(2, map[string]int{"bob": 5, "admin": UnlimitedSessions}))
+	for _, tt := range []struct {
+		user string
+		rule *Rule
+		want int
+	}{
+		{user: "alice", want: 2},
+		{user: "bob", want: 5},
+		{user: "admin", want: 0},
+		{user: "alice", rule: &Rule{}, want: 2},
+		{user: "alice", rule: &Rule{MaxSessions: 1}, want: 1},
+		{user: "bob", rule: &Rule{MaxSessions: 1}, want: 1},
+		{user: "alice", rule: &Rule{MaxSessions: UnlimitedSessions}, want: 0},
+	} {
+		if got := s.userSessionLimit(Request{UserId: tt.user}, tt.rule); got != tt.want {
+			t.Errorf("limit of %v by rule %+v: %v, want %v", tt.user, tt.rule, got, tt.want)
+		}
+	}
+}
+
+func TestAcquireUserSession(t *testing.T) {
+	s := newTestServer(WithMaxSessionsPerUser(2, nil))
+	alice := Request{Version: Version4, UserId: "alice"}
+	ss1, ss2, ss3 := &session{}, &session{}, &session{}
+	if !s.acquireUserSession(ss1, alice, nil) || !s.acquireUserSession(ss2, alice, nil) {
+		t.Fatal("sessions within the limit rejected")
+	}
+	if s.acquireUserSession(ss3, alice, nil) {
+		t.Fatal("session beyond the limit accepted")
+	}
+	if ss3.user != "" {
+		t.Errorf("rejected session counted for %q", ss3.user)
+	}
+	// the other users and the requests without user id are not limited
+	// by the sessions of alice.
+	if !s.acquireUserSession(ss3, Request{Version: Version4, UserId: "bob"}, nil) {
+		t.Error("session of another user rejected")
+	}
+	if !s.acquireUserSession(&session{}, Request{Version: Version4}, nil) {
+		t.Error("session without user id rejected")
+	}
+
+	// a new request of a session uncounts its previous one.
+	if !s.acquireUserSession(ss1, alice, nil) {
+		t.Error("new request of a counted session rejected")
+	}
+	s.releaseUserSession(ss1)
+	s.releaseUserSession(ss1)
+	if ss1.user != "" || s.userSessions.sessions["alice"] != 1 {
+		t.Errorf("%v sessions of alice counted once one is released twice, want 1", s.userSessions.sessions["alice"])
+	}
+	if !s.acquireUserSession(ss3, alice, nil) {
+		t.Error("session within the limit rejected once another ended")
+	}
+	s.releaseUserSession(ss2)
+	s.releaseUserSession(ss3)
+	if len(s.userSessions.sessions) != 0 {
+		t.Errorf("sessions %v counted once all ended", s.userSessions.sessions)
+	}
+}
@@ -0,0 +1,129 @@
+package socks4
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// WebhookSignatureHeader is the header of the HMAC-SHA256 signature of the
+// webhook bodies, "sha256=" followed by the hex digest.
+const WebhookSignatureHeader = "X-Socks4-Signature"
+
+// WebhookConfig is the configuration of a Webhook.
+type WebhookConfig struct {
+	URLs          []string      // URLs the events are posted to.
+	Secret        string        // key of the HMAC signature of the bodies, no signature if empty.
+	BatchSize     int           // max events per request, 100 if 0.
+	FlushInterval time.Duration // max delay of an event, 1s if 0.
+	Retries       int           // retries of a failed request, 3 if 0, none if negative.
+	Timeout       time.Duration // timeout of a request, 10s if 0.
+	Logger        Logger        // logger of the failed requests, nil to not log them.
+}
+
+// Webhook is an EventNotifier posting the events as JSON arrays to URLs.
+// The events are batched, and a failed request is retried with a backoff
+// before its events are dropped. Events are dropped too when the URLs
+// fall behind, so that the sessions are never blocked.
+//
+// A receiver verifies the WebhookSignatureHeader of a request by the
+// HMAC-SHA256 of its body with the shared secret.
+type Webhook struct {
+	config  WebhookConfig
+	client  *http.Client
+	batcher *batcher[Event]
+}
+
+// NewWebhook creates a webhook and starts its sender. Close it to send the
+// pending events.
+func NewWebhook(config WebhookConfig) *Webhook {
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = time.Second
+	}
+	if config.Retries == 0 {
+		config.Retries = 3
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	w := &Webhook{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+	w.batcher = newBatcher(config.BatchSize, config.FlushInterval, w.send)
+	return w
+}
+
+// Notify queues the event, or drops it if the queue is full or the
+// webhook is closed.
+func (w *Webhook) Notify(ev Event) {
+	if !w.batcher.add(ev) && w.config.Logger != nil {
+		w.config.Logger.Warnf("webhook queue is full, %v event of session %v dropped", ev.Type, ev.Session.ID)
+	}
+}
+
+// Close sends the pending events and stops the sender.
+func (w *Webhook) Close() error {
+	w.batcher.close()
+	return nil
+}
+
+// send posts the batch to every URL.
+func (w *Webhook) send(batch []Event) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return
+	}
+	var signature string
+	if w.config.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.config.Secret))
+		mac.Write(body)
+		signature = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	for _, url := range w.config.URLs {
+		if err := w.post(url, body, signature); err != nil && w.config.Logger != nil {
+			w.config.Logger.Warnf("webhook %v: %v events dropped: %v", url, len(batch), err)
+		}
+	}
+}
+
+// post posts the body to the URL, retrying on failure.
+func (w *Webhook) post(url string, body []byte, signature string) error {
+	backoff := time.Second
+	for i := 0; ; i++ {
+		err := w.postOnce(url, body, signature)
+		if err == nil || i >= w.config.Retries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *Webhook) postOnce(url string, body []byte, signature string) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if signature != "" {
+		req.Header.Set(WebhookSignatureHeader, signature)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
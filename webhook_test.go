@@ -0,0 +1,198 @@
+package socks4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records the events posted to it, failing the first
+// requests.
+type webhookReceiver struct {
+	mu         sync.Mutex
+	fail       int // requests left to fail.
+	requests   int
+	batches    [][]Event
+	signatures []string
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests++
+	if r.fail > 0 {
+		r.fail--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := io.ReadAll(req.Body)
+	var batch []Event
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" || json.Unmarshal(body, &batch) != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.batches = append(r.batches, batch)
+	if sig := req.Header.Get(WebhookSignatureHeader); sig != "" {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write(body)
+		if sig != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+			sig = "invalid"
+		}
+		r.signatures = append(r.signatures, sig)
+	}
+}
+
+func testEvent(id uint64) Event {
+	return Event{Type: EventEstablished, Time: time.Unix(1000, 0).UTC(), Session: SessionInfo{ID: id, Client: "192.0.2.1:50000"}, Remote: "198.51.100.1:80"}
+}
+
+func TestWebhook(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		config  WebhookConfig
+		events  int
+		batches []int // sizes of the batches received by each URL.
+		signed  bool
+	}{
+		{name: "single batch", config: WebhookConfig{FlushInterval: time.Hour}, events: 3, batches: []int{3}},
+		{name: "batch size", config: WebhookConfig{BatchSize: 2, FlushInterval: time.Hour}, events: 5, batches: []int{2, 2, 1}},
+		{name: "signed", config: WebhookConfig{Secret: "secret", FlushInterval: time.Hour}, events: 1, batches: []int{1}, signed: true},
+		{name: "no events", config: WebhookConfig{FlushInterval: time.Hour}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var receivers [2]webhookReceiver
+			for i := range receivers {
+				srv := httptest.NewServer(&receivers[i])
+				defer srv.Close()
+				tt.config.URLs = append(tt.config.URLs, srv.URL)
+			}
+			w := NewWebhook(tt.config)
+			for i := 0; i < tt.events; i++ {
+				w.Notify(testEvent(uint64(i + 1)))
+			}
+			w.Close()
+			// dropped once closed.
+			w.Notify(testEvent(100))
+
+			for i := range receivers {
+				r := &receivers[i]
+				var sizes []int
+				var id uint64
+				for _, batch := range r.batches {
+					sizes = append(sizes, len(batch))
+					for _, ev := range batch {
+						id++
+						if !reflect.DeepEqual(ev, testEvent(id)) {
+							t.Errorf("URL %v: event %+v, want %+v", i, ev, testEvent(id))
+						}
+					}
+				}
+				if !reflect.DeepEqual(sizes, tt.batches) {
+					t.Errorf("URL %v: batches of %v events, want %v", i, sizes, tt.batches)
+				}
+				if tt.signed && (len(r.signatures) != len(r.batches) || r.signatures[0] == "invalid") || !tt.signed && len(r.signatures) != 0 {
+					t.Errorf("URL %v: signatures %q", i, r.signatures)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookFlushInterval(t *testing.T) {
+	r := &webhookReceiver{}
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+	w := NewWebhook(WebhookConfig{URLs: []string{srv.URL}, FlushInterval: 10 * time.Millisecond})
+	defer w.Close()
+	w.Notify(testEvent(1))
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		r.mu.Lock()
+		sent := len(r.batches)
+		r.mu.Unlock()
+		if sent == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("event not sent at the flush interval")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		retries   int
+		fail      int
+		requests  int
+		delivered bool
+	}{
+		{name: "no retries", retries: -1, fail: 1, requests: 1},
+		{name: "retried", retries: 1, fail: 1, requests: 2, delivered: true},
+		{name: "retries exhausted", retries: 1, fail: 2, requests: 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &webhookReceiver{fail: tt.fail}
+			srv := httptest.NewServer(r)
+			defer srv.Close()
+			w := NewWebhook(WebhookConfig{URLs: []string{srv.URL}, Retries: tt.retries})
+			w.Notify(testEvent(1))
+			w.Close()
+			if r.requests != tt.requests || (len(r.batches) == 1) != tt.delivered {
+				t.Errorf("%v requests delivering %v batches, want %v delivering %v", r.requests, len(r.batches), tt.requests, tt.delivered)
+			}
+		})
+	}
+}
+
+func TestEvents(t *testing.T) {
+	echo := echoTarget(t)
+	events := make(eventChan, 3)
+	rules, err := ParseRules(strings.NewReader("deny port 1\nallow\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := serve(t, WithRules(rules), WithEventNotifier(events))
+	d := NewDialer(addr, WithDialerUserId("alice"), WithDialerTimeout(5*time.Second))
+
+	if _, err := d.Dial("tcp", "127.0.0.1:1"); err == nil {
+		t.Fatal("denied request granted")
+	}
+	conn, err := d.Dial("tcp", echo.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn, []byte("hello"))
+	conn.Close()
+	echo.Close()
+
+	for _, want := range []string{EventRejected, EventEstablished, EventClosed} {
+		var ev Event
+		select {
+		case ev = <-events:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%v event not notified", want)
+		}
+		if ev.Type != want || ev.Session.UserId != "alice" || ev.Listener != addr {
+			t.Errorf("event %+v, want %v of the session of alice", ev, want)
+		}
+		if want == EventRejected {
+			if ev.Remote != "" || ev.Error == "" {
+				t.Errorf("rejection %+v, want its error and no remote host", ev)
+			}
+			continue
+		}
+		if ev.Remote != echo.Addr || ev.Egress == "" || ev.Session.Client != conn.LocalAddr().String() {
+			t.Errorf("event %+v, want the session of %v to %v", ev, conn.LocalAddr(), echo.Addr)
+		}
+	}
+}
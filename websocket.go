@@ -0,0 +1,102 @@
+package socks4
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+// ServeWebSocket accepts HTTP connections on the listener and serves the
+// SOCKS sessions carried by the WebSocket connections upgraded on path
+// (see WebSocketHandler). With WithTLS the listener serves HTTPS, i.e.
+// wss:// URLs, instead of a TLS handshake inside the WebSocket stream.
+func (s *Server) ServeWebSocket(lis net.Listener, path string) error {
+	s.addListener(lis)
+	defer lis.Close()
+	labels := listenerLabels(lis)
+	s.log(LogAccept).Infof("WebSocket server listen on %v%v", lis.Addr(), path)
+	if s.tlsConfig != nil {
+		lis = tls.NewListener(lis, s.tlsConfig)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, s.webSocketHandler(labels))
+	hs := &http.Server{Handler: mux, ReadHeaderTimeout: s.config().HandshakeTimeout}
+	if err := hs.Serve(lis); err != nil && !s.isClosed() {
+		return err
+	}
+	return errors.New("listencer closed")
+}
+
+// WebSocketHandler returns a handler upgrading the requests to WebSocket
+// connections, each carrying the byte stream of a SOCKS session in binary
+// messages, so that the proxy can be reached through HTTP infrastructure.
+// The client address is the one of the HTTP connection, or the last one of
+// X-Forwarded-For if it comes from a trusted load balancer (see
+// WithProxyProtocol).
+func (s *Server) WebSocketHandler() http.Handler {
+	return s.webSocketHandler(nil)
+}
+
+// webSocketHandler returns the WebSocket handler of the sessions with the
+// labels of the listener.
+func (s *Server) webSocketHandler(labels map[string]string) http.Handler {
+	return websocket.Server{
+		// there is no origin check, the clients are not browsers.
+		Handler: func(ws *websocket.Conn) {
+			ws.PayloadType = websocket.BinaryFrame
+			s.serveAccepted(s.newWSConn(ws), labels)
+		},
+	}
+}
+
+// wsConn is a SOCKS session carried by a WebSocket connection.
+type wsConn struct {
+	*websocket.Conn
+	local, remote net.Addr
+	state         *tls.ConnectionState
+}
+
+func (s *Server) newWSConn(ws *websocket.Conn) *wsConn {
+	r := ws.Request()
+	c := &wsConn{Conn: ws, state: r.TLS}
+	c.local, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	c.remote, _ = net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if c.remote == nil {
+		c.remote = ws.RemoteAddr()
+	}
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" && s.isTrustedProxy(net.ParseIP(clientIP(c))) {
+		hops := strings.Split(xff, ",")
+		if ip := net.ParseIP(strings.TrimSpace(hops[len(hops)-1])); ip != nil {
+			c.remote = &net.TCPAddr{IP: ip}
+		}
+	}
+	return c
+}
+
+// LocalAddr returns the address of the HTTP connection, where the
+// websocket package returns the URL.
+func (c *wsConn) LocalAddr() net.Addr {
+	if c.local == nil {
+		return c.Conn.LocalAddr()
+	}
+	return c.local
+}
+
+// RemoteAddr returns the address of the client, where the websocket
+// package returns the origin.
+func (c *wsConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// ConnectionState returns the state of the TLS connection of HTTPS
+// requests, so that client certificates identify the clients.
+func (c *wsConn) ConnectionState() tls.ConnectionState {
+	if c.state == nil {
+		return tls.ConnectionState{}
+	}
+	return *c.state
+}
@@ -0,0 +1,129 @@
+package socks4
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// serveWebSocket serves the WebSocket sessions on path of a new server and
+// returns it with its listen address.
+func serveWebSocket(t *testing.T, path string, opts ...OptionFunc) (*Server, string) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(opts...)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ServeWebSocket(lis, path)
+	}()
+	t.Cleanup(func() {
+		s.Close()
+		<-done
+	})
+	return s, lis.Addr().String()
+}
+
+// sessionClients returns the client addresses of the sessions of the
+// target.
+func sessionClients(s *Server, target string) []string {
+	var clients []string
+	for _, ss := range s.Sessions() {
+		if ss.Target == target {
+			clients = append(clients, ss.Client)
+		}
+	}
+	return clients
+}
+
+func TestWebSocket(t *testing.T) {
+	pki := newTestPKI(t)
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{pki.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "proxy"}})}}
+	for _, tt := range []struct {
+		name   string
+		scheme string
+		path   string // requested by the dialer.
+		opts   []OptionFunc
+		dialer []DialerOption
+		err    string // in the dial error, none if empty.
+	}{
+		{name: "ws", scheme: "ws", path: "/socks"},
+		{name: "wss", scheme: "wss", path: "/socks", opts: []OptionFunc{WithTLS(serverTLS)}, dialer: []DialerOption{WithDialerTLS(&tls.Config{RootCAs: pki.pool})}},
+		{name: "wss not trusted", scheme: "wss", path: "/socks", opts: []OptionFunc{WithTLS(serverTLS)}, err: "certificate"},
+		{name: "other path", scheme: "ws", path: "/other", err: "WebSocket handshake"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			echo := echoTarget(t)
+			_, addr := serveWebSocket(t, "/socks", tt.opts...)
+			opts := append([]DialerOption{WithDialerWebSocket(tt.scheme + "://" + addr + tt.path), WithDialerTimeout(5 * time.Second)}, tt.dialer...)
+			conn, err := NewDialer(addr, opts...).Dial("tcp", echo.Addr)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			assertEcho(t, conn, []byte("hello"))
+		})
+	}
+}
+
+func TestWebSocketClientAddress(t *testing.T) {
+	_, lb, _ := net.ParseCIDR("127.0.0.0/8")
+	for _, tt := range []struct {
+		name   string
+		opts   []OptionFunc
+		xff    string
+		client string // IP of the session client.
+	}{
+		{name: "connection", client: "127.0.0.1"},
+		{name: "trusted load balancer", opts: []OptionFunc{WithProxyProtocol(lb)}, xff: "203.0.113.9, 198.51.100.7", client: "198.51.100.7"},
+		{name: "untrusted forwarded for", xff: "198.51.100.7", client: "127.0.0.1"},
+		{name: "invalid forwarded for", opts: []OptionFunc{WithProxyProtocol(lb)}, xff: "unknown", client: "127.0.0.1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			echo := echoTarget(t)
+			s, addr := serveWebSocket(t, "/socks", tt.opts...)
+			config, _ := websocket.NewConfig("ws://"+addr+"/socks", "http://localhost/")
+			config.Header = http.Header{}
+			if tt.xff != "" {
+				config.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			ws, err := websocket.DialConfig(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+			ws.PayloadType = websocket.BinaryFrame
+			host, port, _ := net.SplitHostPort(echo.Addr)
+			ip := net.ParseIP(host).To4()
+			p, _ := strconv.Atoi(port)
+			ws.Write(request(CmdConnect, uint16(p), [4]byte(ip), ""))
+			reply := make([]byte, 8)
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(ws, reply); err != nil || reply[1] != Granted {
+				t.Fatalf("reply %x: %v", reply, err)
+			}
+			clients := sessionClients(s, echo.Addr)
+			if len(clients) != 1 || !strings.HasPrefix(clients[0], tt.client+":") {
+				t.Errorf("session clients %v, want %v", clients, tt.client)
+			}
+		})
+	}
+}